@@ -0,0 +1,1206 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cloud
+
+// This file contains a provideri implementation for AWS EC2, or any cloud that
+// offers an EC2-compatible API. We use the AWS SDK's EC2 client, but configure
+// it solely from our own environment variables, without reading the SDK's
+// shared config and credential files.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/hashicorp/go-multierror"
+	"github.com/sb10/waitgroup"
+	"github.com/wtsi-ssg/wr/clog"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	awsRequestTimeout = 1 * time.Minute
+	awsAnywhere       = "0.0.0.0/0"
+)
+
+// awsPollFrequency is how often we check on the state of an instance while
+// waiting for it to start or terminate.
+var awsPollFrequency = 1 * time.Second
+
+// awsSpawnTimeout is how long we wait for a new instance to become running.
+var awsSpawnTimeout = initialServerSpawnTimeout
+
+// AWS resource names (keypair, security group names and Name tags) can contain
+// most characters, but we keep to the same set as for OpenStack so that
+// resource names are portable between providers.
+var awsValidResourceNameRegexp = regexp.MustCompile(`^[\w -]+$`)
+
+// awsEnvs contains the environment variable names we need to connect to AWS.
+// AWS_ENDPOINT_URL_EC2 lets you use a different EC2-compatible endpoint to the
+// default one for your AWS_REGION, AWS_SESSION_TOKEN is needed when using
+// temporary credentials, and WR_AWS_IMAGE_OWNERS is a comma separated list of
+// the owners of the images we'll consider when finding an image by name.
+var (
+	awsReqEnvs   = [...]string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_REGION"}
+	awsMaybeEnvs = [...]string{"AWS_SESSION_TOKEN", "AWS_ENDPOINT_URL_EC2", "WR_AWS_IMAGE_OWNERS"}
+)
+
+// awsDefaultImageOwners are the owners of the images we consider when finding
+// an image by name, if WR_AWS_IMAGE_OWNERS isn't set. Anyone can publish an
+// image with any name, so we must not pick from all public images.
+const awsDefaultImageOwners = "self,amazon"
+
+// awsMaxInstances is the account attribute that tells us our instance limit.
+// (The SDK only has constants for the other attributes.)
+const awsMaxInstances types.AccountAttributeName = "max-instances"
+
+// awsp is our implementer of provideri
+type awsp struct {
+	lastFlavorCache time.Time
+	ownID           string
+	ownKeyName      string
+	securityGroup   string
+	subnetID        string
+	ec2             *ec2.Client
+	imageOwners     []string
+	fmap            map[string]*Flavor
+	imap            map[string]*types.Image
+	fmapMutex       sync.RWMutex
+	imapMutex       sync.RWMutex
+	eipMutex        sync.Mutex
+	createdKeyPair  bool
+}
+
+// requiredEnv returns envs that are definitely required.
+func (p *awsp) requiredEnv() []string {
+	return awsReqEnvs[:]
+}
+
+// maybeEnv returns envs that might be required.
+func (p *awsp) maybeEnv() []string {
+	return awsMaybeEnvs[:]
+}
+
+// initialize uses our required environment variables to create an EC2 client.
+// No API calls are made.
+func (p *awsp) initialize() error {
+	creds := aws.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Source:          "wr environment variables",
+	}
+
+	opts := ec2.Options{
+		Region: os.Getenv("AWS_REGION"),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return creds, nil
+		}),
+		HTTPClient: &http.Client{Timeout: awsRequestTimeout},
+
+		// a lack of capacity for an instance type isn't worth retrying, since
+		// our callers try a different flavor instead
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Retryables = append([]retry.IsErrorRetryable{
+				retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+					if awsErrIsNoHardware(err) {
+						return aws.FalseTernary
+					}
+
+					return aws.UnknownTernary
+				}),
+			}, o.Retryables...)
+		}),
+	}
+
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_EC2"); endpoint != "" {
+		opts.BaseEndpoint = aws.String(endpoint)
+	}
+
+	p.ec2 = ec2.New(opts)
+
+	owners := os.Getenv("WR_AWS_IMAGE_OWNERS")
+	if owners == "" {
+		owners = awsDefaultImageOwners
+	}
+	for _, owner := range strings.Split(owners, ",") {
+		if owner = strings.TrimSpace(owner); owner != "" {
+			p.imageOwners = append(p.imageOwners, owner)
+		}
+	}
+
+	// flavors and images are retrieved on-demand via caching methods that store
+	// in these maps
+	p.fmap = make(map[string]*Flavor)
+	p.imap = make(map[string]*types.Image)
+
+	return nil
+}
+
+// awsFilters converts the given filters to those of an EC2 Describe* request.
+func awsFilters(filters map[string][]string) []types.Filter {
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f := make([]types.Filter, 0, len(names))
+	for _, name := range names {
+		f = append(f, types.Filter{Name: aws.String(name), Values: filters[name]})
+	}
+
+	return f
+}
+
+// awsNameTag returns the tag specifications for a create request that will
+// give the created resource of the given type a Name tag with the given value.
+func awsNameTag(resourceType types.ResourceType, name string) []types.TagSpecification {
+	return []types.TagSpecification{{
+		ResourceType: resourceType,
+		Tags:         []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+	}}
+}
+
+// awsInstanceName returns the value of the given instance's Name tag.
+func awsInstanceName(instance *types.Instance) string {
+	for _, tag := range instance.Tags {
+		if aws.ToString(tag.Key) == "Name" {
+			return aws.ToString(tag.Value)
+		}
+	}
+
+	return ""
+}
+
+// awsInstanceState returns the name of the given instance's state.
+func awsInstanceState(instance *types.Instance) types.InstanceStateName {
+	if instance.State == nil {
+		return ""
+	}
+
+	return instance.State.Name
+}
+
+// awsRootSize returns the size in GB of the given image's root volume.
+func awsRootSize(image *types.Image) int {
+	for _, bd := range image.BlockDeviceMappings {
+		if aws.ToString(bd.DeviceName) == aws.ToString(image.RootDeviceName) && bd.Ebs != nil {
+			return int(aws.ToInt32(bd.Ebs.VolumeSize))
+		}
+	}
+
+	return 0
+}
+
+// awsErrorCode returns the code of the given EC2 API error, or blank if err
+// isn't one.
+func awsErrorCode(err error) string {
+	var aerr smithy.APIError
+	if errors.As(err, &aerr) {
+		return aerr.ErrorCode()
+	}
+
+	return ""
+}
+
+// awsErrorIsNotFound tells you if the given error is an EC2 API error about a
+// resource not existing.
+func awsErrorIsNotFound(err error) bool {
+	return strings.HasSuffix(awsErrorCode(err), ".NotFound")
+}
+
+// describeInstances returns all the instances matching the given filters.
+func (p *awsp) describeInstances(ctx context.Context, filters map[string][]string) ([]*types.Instance, error) {
+	var instances []*types.Instance
+
+	pager := ec2.NewDescribeInstancesPaginator(p.ec2, &ec2.DescribeInstancesInput{Filters: awsFilters(filters)})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range page.Reservations {
+			for i := range r.Instances {
+				instances = append(instances, &r.Instances[i])
+			}
+		}
+	}
+
+	return instances, nil
+}
+
+// getInstance returns the instance with the given ID. If it doesn't exist,
+// the error will satisfy awsErrorIsNotFound().
+func (p *awsp) getInstance(ctx context.Context, instanceID string) (*types.Instance, error) {
+	resp, err := p.ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range resp.Reservations {
+		for i := range r.Instances {
+			if aws.ToString(r.Instances[i].InstanceId) == instanceID {
+				return &r.Instances[i], nil
+			}
+		}
+	}
+
+	return nil, &smithy.GenericAPIError{
+		Code:    "InvalidInstanceID.NotFound",
+		Message: "the instance ID '" + instanceID + "' does not exist",
+	}
+}
+
+// cacheFlavors retrieves the current list of instance types from EC2 and
+// caches them in p.
+func (p *awsp) cacheFlavors(ctx context.Context) error {
+	p.fmapMutex.Lock()
+	defer func() {
+		p.lastFlavorCache = time.Now()
+		p.fmapMutex.Unlock()
+	}()
+
+	pager := ec2.NewDescribeInstanceTypesPaginator(p.ec2, &ec2.DescribeInstanceTypesInput{MaxResults: aws.Int32(100)})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, it := range page.InstanceTypes {
+			f := &Flavor{
+				ID:   string(it.InstanceType),
+				Name: string(it.InstanceType),
+			}
+			if it.VCpuInfo != nil {
+				f.Cores = int(aws.ToInt32(it.VCpuInfo.DefaultVCpus))
+			}
+			if it.MemoryInfo != nil {
+				f.RAM = int(aws.ToInt64(it.MemoryInfo.SizeInMiB))
+			}
+			if it.InstanceStorageInfo != nil {
+				f.Disk = int(aws.ToInt64(it.InstanceStorageInfo.TotalSizeInGB))
+			}
+			p.fmap[f.ID] = f
+		}
+	}
+
+	return nil
+}
+
+// getImage retrieves the desired image by name prefix or id from the cache. If
+// it's not in the cache, will ask EC2 for the most recent available image with
+// that id or name prefix. Name prefixes only match images belonging to one of
+// our imageOwners.
+func (p *awsp) getImage(ctx context.Context, prefix string) (*types.Image, error) {
+	p.imapMutex.RLock()
+	image, found := p.imap[prefix]
+	p.imapMutex.RUnlock()
+	if found {
+		return image, nil
+	}
+
+	input := &ec2.DescribeImagesInput{}
+	if strings.HasPrefix(prefix, "ami-") {
+		input.ImageIds = []string{prefix}
+	} else {
+		input.Filters = awsFilters(map[string][]string{"name": {prefix + "*"}, "state": {"available"}})
+		input.Owners = p.imageOwners
+	}
+
+	resp, err := p.ec2.DescribeImages(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range resp.Images {
+		if image == nil || aws.ToString(resp.Images[i].CreationDate) > aws.ToString(image.CreationDate) {
+			image = &resp.Images[i]
+		}
+	}
+
+	if image == nil {
+		return nil, errors.New("no OS image with prefix [" + prefix + "] was found")
+	}
+
+	p.imapMutex.Lock()
+	p.imap[prefix] = image
+	p.imapMutex.Unlock()
+
+	return image, nil
+}
+
+// deploy achieves the aims of Deploy().
+func (p *awsp) deploy(ctx context.Context, resources *Resources, requiredPorts []int, useConfigDrive bool,
+	gatewayIP, cidr string, dnsNameServers []string,
+) error {
+	if !awsValidResourceNameRegexp.MatchString(resources.ResourceName) {
+		return Error{"aws", "deploy", ErrBadResourceName}
+	}
+
+	// (config drives aren't a thing in EC2, and subnets always get their
+	// gateway at the first address and use Amazon's DNS, so we ignore
+	// useConfigDrive, gatewayIP and dnsNameServers)
+
+	err := p.deployKeyPair(ctx, resources)
+	if err != nil {
+		return err
+	}
+
+	// don't create a network if we're already running in EC2; spawn in the
+	// same subnet as ourselves
+	var vpcID string
+	if p.ownID != "" {
+		own, errg := p.getInstance(ctx, p.ownID)
+		if errg != nil {
+			return errg
+		}
+
+		subnets, errd := p.ec2.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{SubnetIds: []string{aws.ToString(own.SubnetId)}})
+		if errd != nil {
+			return errd
+		}
+		if len(subnets.Subnets) == 0 || aws.ToString(subnets.Subnets[0].CidrBlock) != cidr {
+			return Error{"aws", "deploy", ErrBadCIDR}
+		}
+
+		p.subnetID = aws.ToString(own.SubnetId)
+		vpcID = aws.ToString(own.VpcId)
+	} else {
+		vpcID, err = p.deployNetwork(ctx, resources, cidr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(requiredPorts) > 0 {
+		err = p.deploySecurityGroup(ctx, resources, vpcID, requiredPorts)
+	}
+
+	return err
+}
+
+// deployKeyPair gets or creates a keypair named after our resource name.
+func (p *awsp) deployKeyPair(ctx context.Context, resources *Resources) error {
+	name := resources.ResourceName
+
+	_, err := p.ec2.DescribeKeyPairs(ctx, &ec2.DescribeKeyPairsInput{KeyNames: []string{name}})
+	if err == nil {
+		resources.Details["keypair"] = name
+
+		return nil
+	}
+	if !awsErrorIsNotFound(err) {
+		return err
+	}
+
+	// we create the key ourselves and import the public part, so that we get
+	// a private key in the format the GO built-in library supports
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.ec2.ImportKeyPair(ctx, &ec2.ImportKeyPairInput{
+		KeyName:           aws.String(name),
+		PublicKeyMaterial: ssh.MarshalAuthorizedKey(pub),
+	})
+	if err != nil {
+		return err
+	}
+	p.createdKeyPair = true
+
+	resources.PrivateKey = string(pem.EncodeToMemory(privateKeyPEM))
+	resources.Details["keypair"] = name
+
+	return nil
+}
+
+// deployNetwork gets or creates a VPC with a subnet of the given CIDR that has
+// internet access, all named after our resource name. Returns the VPC ID.
+func (p *awsp) deployNetwork(ctx context.Context, resources *Resources, cidr string) (string, error) {
+	name := resources.ResourceName
+
+	// get/create vpc
+	vpcs, err := p.ec2.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{
+		Filters: awsFilters(map[string][]string{"tag:Name": {name}}),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var vpcID string
+	if len(vpcs.Vpcs) > 0 {
+		vpcID = aws.ToString(vpcs.Vpcs[0].VpcId)
+	} else {
+		vpc, errc := p.ec2.CreateVpc(ctx, &ec2.CreateVpcInput{
+			CidrBlock:         aws.String(cidr),
+			TagSpecifications: awsNameTag(types.ResourceTypeVpc, name),
+		})
+		if errc != nil {
+			return "", errc
+		}
+		vpcID = aws.ToString(vpc.Vpc.VpcId)
+	}
+	resources.Details["vpc"] = vpcID
+
+	// get/create subnet, which gives instances public IPs so that they can
+	// reach the internet
+	subnets, err := p.ec2.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		Filters: awsFilters(map[string][]string{"vpc-id": {vpcID}}),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(subnets.Subnets) > 0 {
+		p.subnetID = aws.ToString(subnets.Subnets[0].SubnetId)
+	} else {
+		subnet, errc := p.ec2.CreateSubnet(ctx, &ec2.CreateSubnetInput{
+			VpcId:             aws.String(vpcID),
+			CidrBlock:         aws.String(cidr),
+			TagSpecifications: awsNameTag(types.ResourceTypeSubnet, name),
+		})
+		if errc != nil {
+			return "", errc
+		}
+		p.subnetID = aws.ToString(subnet.Subnet.SubnetId)
+
+		_, err = p.ec2.ModifySubnetAttribute(ctx, &ec2.ModifySubnetAttributeInput{
+			SubnetId:            aws.String(p.subnetID),
+			MapPublicIpOnLaunch: &types.AttributeBooleanValue{Value: aws.Bool(true)},
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	resources.Details["subnet"] = p.subnetID
+
+	// get/create internet gateway and route to it
+	gateways, err := p.ec2.DescribeInternetGateways(ctx, &ec2.DescribeInternetGatewaysInput{
+		Filters: awsFilters(map[string][]string{"attachment.vpc-id": {vpcID}}),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var gatewayID string
+	if len(gateways.InternetGateways) > 0 {
+		gatewayID = aws.ToString(gateways.InternetGateways[0].InternetGatewayId)
+	} else {
+		gateway, errc := p.ec2.CreateInternetGateway(ctx, &ec2.CreateInternetGatewayInput{
+			TagSpecifications: awsNameTag(types.ResourceTypeInternetGateway, name),
+		})
+		if errc != nil {
+			return "", errc
+		}
+		gatewayID = aws.ToString(gateway.InternetGateway.InternetGatewayId)
+
+		_, err = p.ec2.AttachInternetGateway(ctx, &ec2.AttachInternetGatewayInput{
+			InternetGatewayId: aws.String(gatewayID),
+			VpcId:             aws.String(vpcID),
+		})
+		if err != nil {
+			// if this fails, we'd be stuck with a useless gateway, so we try
+			// and delete it
+			_, errd := p.ec2.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{
+				InternetGatewayId: aws.String(gatewayID),
+			})
+			if errd != nil {
+				clog.Warn(ctx, "failed to delete unattached internet gateway", "id", gatewayID, "err", errd)
+			}
+
+			return "", err
+		}
+
+		tables, errd := p.ec2.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{
+			Filters: awsFilters(map[string][]string{"vpc-id": {vpcID}, "association.main": {"true"}}),
+		})
+		if errd != nil {
+			return "", errd
+		}
+		if len(tables.RouteTables) == 0 {
+			return "", fmt.Errorf("vpc %s has no main route table", vpcID)
+		}
+
+		_, err = p.ec2.CreateRoute(ctx, &ec2.CreateRouteInput{
+			RouteTableId:         tables.RouteTables[0].RouteTableId,
+			DestinationCidrBlock: aws.String(awsAnywhere),
+			GatewayId:            aws.String(gatewayID),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	resources.Details["gateway"] = gatewayID
+
+	return vpcID, nil
+}
+
+// deploySecurityGroup gets or creates a security group named after our
+// resource name, allowing access to the given ports, and all access between
+// the servers in the group.
+func (p *awsp) deploySecurityGroup(ctx context.Context, resources *Resources, vpcID string, requiredPorts []int) error {
+	name := resources.ResourceName
+
+	groups, err := p.ec2.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: awsFilters(map[string][]string{"group-name": {name}, "vpc-id": {vpcID}}),
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(groups.SecurityGroups) > 0 {
+		p.securityGroup = aws.ToString(groups.SecurityGroups[0].GroupId)
+		resources.Details["secgroup"] = p.securityGroup
+
+		return nil
+	}
+
+	group, err := p.ec2.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(name),
+		Description: aws.String("access amongst wr-spawned nodes"),
+		VpcId:       aws.String(vpcID),
+	})
+	if err != nil {
+		return err
+	}
+	p.securityGroup = aws.ToString(group.GroupId)
+	resources.Details["secgroup"] = p.securityGroup
+
+	anywhere := []types.IpRange{{CidrIp: aws.String(awsAnywhere)}}
+	rules := make([]types.IpPermission, 0, len(requiredPorts)+2)
+	for _, port := range requiredPorts {
+		rules = append(rules, types.IpPermission{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int32(int32(port)),
+			ToPort:     aws.Int32(int32(port)),
+			IpRanges:   anywhere,
+		})
+	}
+
+	// ICMP may help networking work as expected, and our servers should be
+	// able to talk to each other freely
+	rules = append(rules,
+		types.IpPermission{
+			IpProtocol: aws.String("icmp"),
+			FromPort:   aws.Int32(-1),
+			ToPort:     aws.Int32(-1),
+			IpRanges:   anywhere,
+		},
+		types.IpPermission{
+			IpProtocol:       aws.String("-1"),
+			UserIdGroupPairs: []types.UserIdGroupPair{{GroupId: aws.String(p.securityGroup)}},
+		},
+	)
+
+	_, err = p.ec2.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(p.securityGroup),
+		IpPermissions: rules,
+	})
+
+	return err
+}
+
+// getCurrentServers returns details of other servers with the given resource
+// name prefix.
+func (p *awsp) getCurrentServers(resources *Resources) ([][]string, error) {
+	instances, err := p.describeInstances(context.Background(), map[string][]string{
+		"tag:Name":            {resources.ResourceName + "*"},
+		"instance-state-name": {"pending", "running"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var sdetails [][]string
+	for _, instance := range instances {
+		name := awsInstanceName(instance)
+		if aws.ToString(instance.InstanceId) == p.ownID || !strings.HasPrefix(name, resources.ResourceName) {
+			continue
+		}
+
+		sdetails = append(sdetails, []string{aws.ToString(instance.InstanceId), aws.ToString(instance.PrivateIpAddress), name, ""})
+	}
+
+	return sdetails, nil
+}
+
+// inCloud checks if we're currently running on an EC2 instance based on our
+// hostname matching the Name tag or private DNS name of a running instance.
+func (p *awsp) inCloud(ctx context.Context) bool {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return false
+	}
+
+	instances, err := p.describeInstances(ctx, map[string][]string{"instance-state-name": {"running"}})
+	if err != nil {
+		clog.Warn(ctx, "describing instances failed", "err", err)
+
+		return false
+	}
+
+	for _, instance := range instances {
+		dnsHost, _, _ := strings.Cut(aws.ToString(instance.PrivateDnsName), ".")
+		if nameToHostName(awsInstanceName(instance)) == hostname || dnsHost == hostname {
+			p.ownID = aws.ToString(instance.InstanceId)
+			p.ownKeyName = aws.ToString(instance.KeyName)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// flavors returns all our flavors.
+func (p *awsp) flavors(ctx context.Context) map[string]*Flavor {
+	// update the cached flavors at most once every half hour
+	p.fmapMutex.RLock()
+	if time.Since(p.lastFlavorCache) > 30*time.Minute {
+		p.fmapMutex.RUnlock()
+		err := p.cacheFlavors(ctx)
+		if err != nil {
+			clog.Warn(ctx, "failed to cache available flavors", "err", err)
+		}
+		p.fmapMutex.RLock()
+	}
+	fmap := make(map[string]*Flavor)
+	for key, val := range p.fmap {
+		fmap[key] = val
+	}
+	p.fmapMutex.RUnlock()
+
+	return fmap
+}
+
+// getQuota achieves the aims of GetQuota(). EC2 only tells us about the max
+// number of instances; limits on vCPUs are only available from the separate
+// Service Quotas API, so we treat cores and RAM as unlimited.
+func (p *awsp) getQuota(ctx context.Context) (*Quota, error) {
+	attrs, err := p.ec2.DescribeAccountAttributes(ctx, &ec2.DescribeAccountAttributesInput{
+		AttributeNames: []types.AccountAttributeName{awsMaxInstances},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	quota := &Quota{}
+	for _, attr := range attrs.AccountAttributes {
+		if aws.ToString(attr.AttributeName) == string(awsMaxInstances) && len(attr.AttributeValues) > 0 {
+			quota.MaxInstances, err = strconv.Atoi(aws.ToString(attr.AttributeValues[0].AttributeValue))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	instances, err := p.describeInstances(ctx, map[string][]string{"instance-state-name": {"pending", "running"}})
+	if err != nil {
+		return nil, err
+	}
+
+	flavors := p.flavors(ctx)
+	for _, instance := range instances {
+		quota.UsedInstances++
+		if f, found := flavors[string(instance.InstanceType)]; found {
+			quota.UsedCores += f.Cores
+			quota.UsedRAM += f.RAM
+		}
+	}
+
+	return quota, nil
+}
+
+// awsUserData returns the user data script for a new instance with the given
+// name. As well as doing what sentinelInitScript does, it sets the hostname to
+// match the name, like OpenStack does automatically.
+func awsUserData(serverName string) string {
+	hostname := nameToHostName(serverName)
+
+	return strings.Replace(string(sentinelInitScript), "#!/bin/bash\n",
+		"#!/bin/bash\nhostnamectl set-hostname "+hostname+" || hostname "+hostname+"\n", 1)
+}
+
+// spawn achieves the aims of Spawn()
+func (p *awsp) spawn(ctx context.Context, resources *Resources, osPrefix string, flavorID string, diskGB int,
+	externalIP bool, usingQuotaCh chan bool,
+) (serverID, serverIP, serverName, adminPass string, err error) {
+	// get the image that matches desired OS
+	image, err := p.getImage(ctx, osPrefix)
+	if err != nil {
+		usingQuotaCh <- false
+
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	serverName = uniqueResourceName(resources.ResourceName)
+	input := &ec2.RunInstancesInput{
+		ImageId:           image.ImageId,
+		InstanceType:      types.InstanceType(flavorID),
+		MinCount:          aws.Int32(1),
+		MaxCount:          aws.Int32(1),
+		KeyName:           aws.String(resources.ResourceName),
+		UserData:          aws.String(base64.StdEncoding.EncodeToString([]byte(awsUserData(serverName)))),
+		TagSpecifications: awsNameTag(types.ResourceTypeInstance, serverName),
+	}
+
+	if p.subnetID != "" {
+		input.SubnetId = aws.String(p.subnetID)
+	}
+
+	if p.securityGroup != "" {
+		input.SecurityGroupIds = []string{p.securityGroup}
+	}
+
+	// if the image's root volume is too small, ask for a bigger one
+	if diskGB > awsRootSize(image) && aws.ToString(image.RootDeviceName) != "" {
+		input.BlockDeviceMappings = []types.BlockDeviceMapping{{
+			DeviceName: image.RootDeviceName,
+			Ebs: &types.EbsBlockDevice{
+				VolumeSize:          aws.Int32(int32(diskGB)),
+				DeleteOnTermination: aws.Bool(true),
+			},
+		}}
+	}
+
+	t := time.Now()
+	resp, err := p.ec2.RunInstances(ctx, input)
+	if err == nil {
+		if len(resp.Instances) == 1 {
+			serverID = aws.ToString(resp.Instances[0].InstanceId)
+		} else {
+			err = fmt.Errorf("RunInstances returned %d instances", len(resp.Instances))
+		}
+	}
+
+	clog.Debug(ctx, "server create attempted", "took", time.Since(t), "id", serverID, "worked", err == nil)
+
+	usingQuotaCh <- true
+
+	if err != nil {
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	instance, err := p.waitUntilRunning(ctx, serverID)
+	if err != nil {
+		// since we're going to return an error that we failed to spawn, try and
+		// delete the bad server in case it is still there
+		delerr := p.destroyServer(ctx, serverID)
+		if delerr != nil {
+			err = fmt.Errorf("%w\nadditionally, there was an error deleting the bad server: %s", err, delerr)
+		}
+
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	serverIP = aws.ToString(instance.PrivateIpAddress)
+
+	if externalIP {
+		ip, erra := p.associateElasticIP(ctx, resources, serverID)
+		if erra != nil {
+			errd := p.destroyServer(ctx, serverID)
+			if errd != nil {
+				clog.Warn(ctx, "server destruction after not associating IP failed", "server", serverID, "err", errd)
+			}
+
+			return serverID, serverIP, serverName, adminPass, erra
+		}
+
+		serverIP = ip
+	}
+
+	return serverID, serverIP, serverName, adminPass, err
+}
+
+// waitUntilRunning waits for the given instance to become running, returning
+// its details once it is.
+func (p *awsp) waitUntilRunning(ctx context.Context, instanceID string) (*types.Instance, error) {
+	timeout := time.After(awsSpawnTimeout)
+	ticker := time.NewTicker(awsPollFrequency)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			instance, err := p.getInstance(ctx, instanceID)
+			if err != nil {
+				// new instances may not be visible straight away
+				if awsErrorIsNotFound(err) {
+					continue
+				}
+
+				return nil, err
+			}
+
+			state := awsInstanceState(instance)
+			switch state {
+			case types.InstanceStateNameRunning:
+				clog.Debug(ctx, "server became running", "id", instanceID, "took", time.Since(start))
+
+				return instance, nil
+			case types.InstanceStateNamePending:
+				continue
+			default:
+				var msg string
+				if instance.StateReason != nil {
+					msg = aws.ToString(instance.StateReason.Message)
+				}
+				if msg == "" {
+					msg = "unknown problem"
+				}
+
+				return nil, fmt.Errorf("server %s is %s after %s: %s", instanceID, state, time.Since(start), msg)
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("server %s did not become running after %s", instanceID, awsSpawnTimeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// associateElasticIP gives the given instance a public IP address that will
+// last until the instance is destroyed, reusing one of our unassociated
+// addresses if possible.
+func (p *awsp) associateElasticIP(ctx context.Context, resources *Resources, instanceID string) (string, error) {
+	p.eipMutex.Lock()
+	defer p.eipMutex.Unlock()
+
+	addrs, err := p.ec2.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		Filters: awsFilters(map[string][]string{"tag:Name": {resources.ResourceName}}),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var allocationID, publicIP string
+	for _, a := range addrs.Addresses {
+		if aws.ToString(a.AssociationId) == "" {
+			allocationID, publicIP = aws.ToString(a.AllocationId), aws.ToString(a.PublicIp)
+
+			break
+		}
+	}
+
+	if allocationID == "" {
+		address, erra := p.ec2.AllocateAddress(ctx, &ec2.AllocateAddressInput{
+			Domain:            types.DomainTypeVpc,
+			TagSpecifications: awsNameTag(types.ResourceTypeElasticIp, resources.ResourceName),
+		})
+		if erra != nil {
+			return "", erra
+		}
+		allocationID, publicIP = aws.ToString(address.AllocationId), aws.ToString(address.PublicIp)
+	}
+
+	_, err = p.ec2.AssociateAddress(ctx, &ec2.AssociateAddressInput{
+		InstanceId:   aws.String(instanceID),
+		AllocationId: aws.String(allocationID),
+	})
+
+	return publicIP, err
+}
+
+// releaseElasticIPs releases the public IP addresses matching the given
+// filters.
+func (p *awsp) releaseElasticIPs(ctx context.Context, filters map[string][]string) error {
+	p.eipMutex.Lock()
+	defer p.eipMutex.Unlock()
+
+	addrs, err := p.ec2.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{Filters: awsFilters(filters)})
+	if err != nil {
+		return err
+	}
+
+	var merr *multierror.Error
+	for _, a := range addrs.Addresses {
+		if a.AssociationId != nil {
+			_, err = p.ec2.DisassociateAddress(ctx, &ec2.DisassociateAddressInput{AssociationId: a.AssociationId})
+			merr = p.combineError(merr, err)
+		}
+
+		_, err = p.ec2.ReleaseAddress(ctx, &ec2.ReleaseAddressInput{AllocationId: a.AllocationId})
+		merr = p.combineError(merr, err)
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// errIsNoHardware returns true if error is about EC2 having insufficient
+// capacity.
+func (p *awsp) errIsNoHardware(err error) bool {
+	return awsErrIsNoHardware(err)
+}
+
+// awsErrIsNoHardware tells you if the given error is an EC2 API error about
+// there being insufficient capacity.
+func awsErrIsNoHardware(err error) bool {
+	switch awsErrorCode(err) {
+	case "InsufficientInstanceCapacity", "InsufficientHostCapacity":
+		return true
+	}
+
+	return false
+}
+
+// checkServer achieves the aims of CheckServer().
+func (p *awsp) checkServer(serverID string) (bool, error) {
+	instance, err := p.getInstance(context.Background(), serverID)
+	if err != nil {
+		if awsErrorIsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return awsInstanceState(instance) == types.InstanceStateNameRunning, nil
+}
+
+// serverIsKnown achieves the aims of ServerIsKnown().
+func (p *awsp) serverIsKnown(serverID string) (bool, error) {
+	instance, err := p.getInstance(context.Background(), serverID)
+	if err != nil {
+		if awsErrorIsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return awsInstanceState(instance) != types.InstanceStateNameTerminated, nil
+}
+
+// destroyServer achieves the aims of DestroyServer().
+func (p *awsp) destroyServer(ctx context.Context, serverID string) error {
+	instance, err := p.getInstance(ctx, serverID)
+	if err != nil {
+		if awsErrorIsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	// elastic IPs cost money when not in use, so we don't keep them around
+	if errr := p.releaseElasticIPs(ctx, map[string][]string{"instance-id": {serverID}}); errr != nil {
+		clog.Warn(ctx, "failed to release a server's public IP", "server", serverID, "err", errr)
+	}
+
+	_, err = p.ec2.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{serverID}})
+	if err != nil {
+		if awsErrorIsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	// wait for it to really be terminated, or we won't be able to delete the
+	// security group and subnet later
+	limit := time.After(destroyServerTimeout)
+	ticker := time.NewTicker(destroyServerCheckFrequency)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			instance, err = p.getInstance(ctx, serverID)
+			if err != nil {
+				if awsErrorIsNotFound(err) {
+					return nil
+				}
+
+				return err
+			}
+
+			if awsInstanceState(instance) == types.InstanceStateNameTerminated {
+				return nil
+			}
+		case <-limit:
+			return fmt.Errorf("server not terminated, still has status '%s'", awsInstanceState(instance))
+		}
+	}
+}
+
+// sshPort returns the standard ssh port, which our servers always use.
+func (p *awsp) sshPort() int {
+	return defaultSSHPort
+}
+
+// serversAreLocal returns false, since our servers are real.
+func (p *awsp) serversAreLocal() bool {
+	return false
+}
+
+// tearDown achieves the aims of TearDown()
+func (p *awsp) tearDown(ctx context.Context, resources *Resources) error {
+	// throughout we'll ignore errors because we want to try and delete
+	// as much as possible; we'll end up returning a concatenation of all of
+	// them though
+	var merr *multierror.Error
+
+	// delete servers, except for ourselves
+	instances, err := p.describeInstances(ctx, map[string][]string{
+		"tag:Name":            {resources.ResourceName + "*"},
+		"instance-state-name": {"pending", "running", "stopping", "stopped"},
+	})
+	merr = p.combineError(merr, err)
+
+	var toDestroy []string
+	for _, instance := range instances {
+		id := aws.ToString(instance.InstanceId)
+		if id != p.ownID && strings.HasPrefix(awsInstanceName(instance), resources.ResourceName) {
+			toDestroy = append(toDestroy, id)
+		}
+	}
+
+	var didSomething bool
+	if len(toDestroy) > 0 {
+		didSomething = true
+		wg := waitgroup.New()
+		wgk := wg.Add(len(toDestroy))
+		for _, sid := range toDestroy {
+			go func(id string) {
+				defer internal.LogPanic(ctx, "cloud aws tearDown destroyServer", false)
+				defer wg.Done(wgk)
+
+				t := time.Now()
+				errd := p.destroyServer(ctx, id)
+				clog.Debug(ctx, "delete server", "time", time.Since(t), "id", id)
+				if errd != nil {
+					// ignore errors, just try to delete others
+					clog.Warn(ctx, "server destruction during teardown failed", "server", id, "err", errd)
+				}
+			}(sid)
+		}
+		wg.Wait(destroyServersTimeout)
+	}
+
+	if p.ownID == "" {
+		merr = p.combineError(merr, p.releaseElasticIPs(ctx, map[string][]string{"tag:Name": {resources.ResourceName}}))
+
+		vpcID := resources.Details["vpc"]
+		deletions := []struct {
+			detail, action string
+			counts         bool
+			del            func(id string) error
+		}{
+			{"secgroup", "delete security group", true, func(id string) error {
+				_, errd := p.ec2.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{GroupId: aws.String(id)})
+				return errd
+			}},
+			{"subnet", "delete subnet", true, func(id string) error {
+				_, errd := p.ec2.DeleteSubnet(ctx, &ec2.DeleteSubnetInput{SubnetId: aws.String(id)})
+				return errd
+			}},
+			{"gateway", "detach internet gateway", false, func(id string) error {
+				_, errd := p.ec2.DetachInternetGateway(ctx, &ec2.DetachInternetGatewayInput{
+					InternetGatewayId: aws.String(id),
+					VpcId:             aws.String(vpcID),
+				})
+				return errd
+			}},
+			{"gateway", "delete internet gateway", true, func(id string) error {
+				_, errd := p.ec2.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{InternetGatewayId: aws.String(id)})
+				return errd
+			}},
+			{"vpc", "delete vpc", true, func(id string) error {
+				_, errd := p.ec2.DeleteVpc(ctx, &ec2.DeleteVpcInput{VpcId: aws.String(id)})
+				return errd
+			}},
+		}
+
+		for _, d := range deletions {
+			id := resources.Details[d.detail]
+			if id == "" {
+				continue
+			}
+
+			t := time.Now()
+			err = d.del(id)
+			clog.Debug(ctx, d.action, "time", time.Since(t), "id", id, "err", err)
+			if err == nil && d.counts {
+				didSomething = true
+			}
+			merr = p.combineError(merr, err)
+		}
+	}
+
+	// delete keypair, unless we're running in EC2 and our own instance was
+	// created with the same keypair. Bypass the exception if we definitely
+	// created the key pair this session
+	if id := resources.Details["keypair"]; id != "" {
+		if p.createdKeyPair || p.ownID == "" || p.ownKeyName != id {
+			t := time.Now()
+			_, err = p.ec2.DeleteKeyPair(ctx, &ec2.DeleteKeyPairInput{KeyName: aws.String(id)})
+			clog.Debug(ctx, "delete keypair", "time", time.Since(t), "id", id, "err", err)
+			// keypairs are not credential-specific enough, so we don't consider
+			// deleting one as didSomething
+			merr = p.combineError(merr, err)
+			resources.PrivateKey = ""
+		}
+	}
+
+	rerr := merr.ErrorOrNil()
+	if rerr == nil && !didSomething {
+		return Error{"aws", "tearDown", ErrNoTearDown}
+	}
+
+	return rerr
+}
+
+// combineError Append()s the given err on merr, but ignores err if it is about
+// a resource not existing.
+func (p *awsp) combineError(merr *multierror.Error, err error) *multierror.Error {
+	if err != nil && !awsErrorIsNotFound(err) {
+		merr = multierror.Append(merr, err)
+	}
+
+	return merr
+}
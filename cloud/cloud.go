@@ -21,8 +21,10 @@ Package cloud provides functions to interact with cloud providers, used to
 create cloud resources so that you can spawn servers, then delete those
 resources when you're done.
 
-Currently implemented providers are OpenStack, with AWS planned for the future.
-The implementation of each supported provider is in its own .go file.
+Currently implemented providers are OpenStack and AWS (or any other cloud with
+an EC2-compatible API). There is also a "fake" provider, where every server is
+really the local machine, for testing. The implementation of each supported
+provider is in its own .go file.
 
 It's a pseudo plug-in system in that it is designed so that you can easily add a
 go file that implements the methods of the provideri interface, to support a
@@ -58,11 +60,11 @@ than 1 process at a time.
 	    // simplistic way of making the most of the server by running as many
 	    // commands as possible:
 	    for _, cmd := range myCmds {
-	        if server.HasSpaceFor(1, 1024, 1) > 0 {
-	            server.Allocate(1, 1024, 1)
+	        if server.HasSpaceFor(1, 1024, 1, nil) > 0 {
+	            server.Allocate(ctx, 1, 1024, 1, nil)
 	            go func() {
 	                server.RunCmd(ctx, cmd, false)
-	                server.Release(1, 1024, 1)
+	                server.Release(ctx, 1, 1024, 1, nil)
 	            }()
 	        } else {
 	            break
@@ -161,7 +163,11 @@ const touchStampFormat = "2006-01-02T15:04:05-0700"
 // hostNameRegex is used by nameToHostName() to make strings valid hostnames.
 var hostNameRegex = regexp.MustCompile(`[^a-z0-9\-]+`)
 
-const openstackName = "openstack"
+const (
+	openstackName = "openstack"
+	awsName       = "aws"
+	fakeName      = "fake"
+)
 
 // Error records an error and the operation and provider caused it.
 type Error struct {
@@ -234,18 +240,24 @@ type provideri interface {
 	destroyServer(ctx context.Context, serverID string) error
 	// achieve the aims of TearDown()
 	tearDown(ctx context.Context, resources *Resources) error
+	// return the port that ssh listens on for the servers we spawn
+	sshPort() int
+	// return true if the servers we spawn are really this machine, and so
+	// must not be shut down
+	serversAreLocal() bool
 }
 
 // Provider gives you access to all of the methods you'll need to interact with
 // a cloud provider.
 type Provider struct {
-	impl         provideri
-	Name         string
-	savePath     string
-	resources    *Resources
-	inCloud      bool
-	madeHeadNode bool
-	servers      map[string]*Server // by name
+	impl            provideri
+	Name            string
+	savePath        string
+	resources       *Resources
+	flavorResources []*FlavorResources
+	inCloud         bool
+	madeHeadNode    bool
+	servers         map[string]*Server // by name
 	sync.RWMutex
 }
 
@@ -288,6 +300,10 @@ func RequiredEnv(providerName string) ([]string, error) {
 	switch providerName {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case awsName:
+		p = &Provider{impl: new(awsp)}
+	case fakeName:
+		p = &Provider{impl: new(fakep)}
 	default:
 		return nil, Error{providerName, "RequiredEnv", ErrBadProvider}
 	}
@@ -302,6 +318,10 @@ func MaybeEnv(providerName string) ([]string, error) {
 	switch providerName {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case awsName:
+		p = &Provider{impl: new(awsp)}
+	case fakeName:
+		p = &Provider{impl: new(fakep)}
 	default:
 		return nil, Error{providerName, "MaybeEnv", ErrBadProvider}
 	}
@@ -315,6 +335,10 @@ func AllEnv(providerName string) ([]string, error) {
 	switch providerName {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case awsName:
+		p = &Provider{impl: new(awsp)}
+	case fakeName:
+		p = &Provider{impl: new(fakep)}
 	default:
 		return nil, Error{providerName, "MaybeEnv", ErrBadProvider}
 	}
@@ -326,7 +350,7 @@ func AllEnv(providerName string) ([]string, error) {
 }
 
 // New creates a new Provider to interact with the given cloud provider.
-// Possible names so far are "openstack" ("aws" is planned). You must provide a
+// Possible names so far are "openstack", "aws" and "fake". You must provide a
 // resource name that will be used to name any created cloud resources. You must
 // also provide a file path prefix to save details of created resources to (the
 // actual file created will be suffixed with your resourceName).
@@ -342,6 +366,10 @@ func New(ctx context.Context, name string, resourceName string, savePath string)
 	switch name {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case awsName:
+		p = &Provider{impl: new(awsp)}
+	case fakeName:
+		p = &Provider{impl: &fakep{savePath: savePath + "." + resourceName}}
 	default:
 		return nil, Error{name, "New", ErrBadProvider}
 	}
@@ -499,12 +527,20 @@ func (p *Provider) GetQuota(ctx context.Context) (*Quota, error) {
 // is larger than the flavor's root disk a larger volume will be created
 // automatically.
 func (p *Provider) CheapestServerFlavor(ctx context.Context, cores, ramMB int, regex string) (*Flavor, error) {
+	return p.cheapestServerFlavor(ctx, cores, ramMB, regex, nil)
+}
+
+// cheapestServerFlavor is like CheapestServerFlavor(), but also requires that
+// the flavor has at least the given named consumable resources.
+func (p *Provider) cheapestServerFlavor(ctx context.Context, cores, ramMB int, regex string,
+	resources map[string]int,
+) (*Flavor, error) {
 	r, err := p.regexStrToRegexp(regex)
 	if err != nil {
 		return nil, err
 	}
 
-	f := p.pickCheapestFlavorFromSubset(ctx, cores, ramMB, r, []*regexp.Regexp{})
+	f := p.pickCheapestFlavorFromSubset(ctx, cores, ramMB, resources, r, []*regexp.Regexp{})
 	if f == nil {
 		return nil, Error{"cloud", "CheapestServerFlavor", ErrNoFlavor}
 	}
@@ -524,17 +560,21 @@ func (p *Provider) regexStrToRegexp(regex string) (*regexp.Regexp, error) {
 	return r, nil
 }
 
-// pickCheapestFlavorFromSubset looks through p.impl.flavors() for the
-// cheapest flavor with a Name that matches the regexp, and that also matches
-// at least one of the regexps in the subset. regexp can be nil to match any
-// flavor, and subset can be empty to pick from the superset, but subset
-// elements cannot be nil.
-func (p *Provider) pickCheapestFlavorFromSubset(ctx context.Context, cores, ramMB int, regexp *regexp.Regexp, subset []*regexp.Regexp) *Flavor {
+// pickCheapestFlavorFromSubset looks through p.flavors() for the cheapest
+// flavor with a Name that matches the regexp, and that also matches at least
+// one of the regexps in the subset. regexp can be nil to match any flavor, and
+// subset can be empty to pick from the superset, but subset elements cannot be
+// nil. Flavors that have named consumable resources that weren't asked for are
+// only picked if no flavor without them is suitable, so that they are kept for
+// the things that need them.
+func (p *Provider) pickCheapestFlavorFromSubset(ctx context.Context, cores, ramMB int, resources map[string]int,
+	regexp *regexp.Regexp, subset []*regexp.Regexp,
+) *Flavor {
 	// from flavours in the subset, pick the one that has the lowest ram, disk
 	// and cpus that meet our minimums, and also matches the regex
-	var fr *Flavor
+	var fr, frWithSpare *Flavor
 
-	for _, f := range p.impl.flavors(p.cloudContext(ctx)) {
+	for _, f := range p.flavors(ctx) {
 		if regexp != nil && !regexp.MatchString(f.Name) {
 			continue
 		}
@@ -554,27 +594,43 @@ func (p *Provider) pickCheapestFlavorFromSubset(ctx context.Context, cores, ramM
 			continue
 		}
 
-		if f.Cores >= cores && f.RAM >= ramMB {
-			if fr != nil {
-				if f.Cores < fr.Cores {
-					fr = f
-				} else if f.Cores == fr.Cores {
-					if f.RAM < fr.RAM {
-						fr = f
-					} else if f.RAM == fr.RAM && f.Disk < fr.Disk {
-						fr = f
-					}
-				}
+		if f.Cores >= cores && f.RAM >= ramMB && internal.ResourcesCanFit(f.Resources, nil, resources) != 0 {
+			if f.hasSpareResources(resources) {
+				frWithSpare = cheaperFlavor(frWithSpare, f)
 			} else {
-				fr = f
+				fr = cheaperFlavor(fr, f)
 			}
 		}
 	}
+
+	if fr == nil {
+		return frWithSpare
+	}
 	return fr
 }
 
+// cheaperFlavor returns the cheaper of the given flavors, which is the one with
+// the fewest cores, then the least RAM, then the least disk. current can be nil.
+func cheaperFlavor(current, f *Flavor) *Flavor {
+	if current == nil {
+		return f
+	}
+
+	if f.Cores < current.Cores {
+		return f
+	} else if f.Cores == current.Cores {
+		if f.RAM < current.RAM {
+			return f
+		} else if f.RAM == current.RAM && f.Disk < current.Disk {
+			return f
+		}
+	}
+	return current
+}
+
 // CheapestServerFlavors is like CheapestServerFlavor(), taking the same first 3
-// arguments, but also a slice of slices that describe sets of flavors. For
+// arguments, but also the named consumable resources the flavor must have (nil
+// for none), and a slice of slices that describe sets of flavors. For
 // example, [][]string{{"f1","f2"},{"f3","f4"}}. Here, flavors f1 and f2 are in
 // one set, and f3 and f4 are in another. The names are treated as regular
 // expressions so you can describe multiple flavors in a set with a single
@@ -588,10 +644,10 @@ func (p *Provider) pickCheapestFlavorFromSubset(ctx context.Context, cores, ramM
 // In the special case that sets is an empty slice, returns the result of
 // CheapestServerFlavor() in a 1 element slice.
 func (p *Provider) CheapestServerFlavors(ctx context.Context, cores, ramMB int,
-	regex string, sets [][]string,
+	regex string, sets [][]string, resources map[string]int,
 ) ([]*Flavor, error) {
 	if len(sets) == 0 {
-		f, err := p.CheapestServerFlavor(ctx, cores, ramMB, regex)
+		f, err := p.cheapestServerFlavor(ctx, cores, ramMB, regex, resources)
 		return []*Flavor{f}, err
 	}
 
@@ -614,7 +670,7 @@ func (p *Provider) CheapestServerFlavors(ctx context.Context, cores, ramMB int,
 			subset[j] = rf
 		}
 
-		matches[i] = p.pickCheapestFlavorFromSubset(ctx, cores, ramMB, r, subset)
+		matches[i] = p.pickCheapestFlavorFromSubset(ctx, cores, ramMB, resources, r, subset)
 	}
 
 	return matches, nil
@@ -623,7 +679,7 @@ func (p *Provider) CheapestServerFlavors(ctx context.Context, cores, ramMB int,
 // GetServerFlavor returns the flavor with the given ID or name. If no flavor
 // exactly matches you will get an error matching ErrBadFlavor.
 func (p *Provider) GetServerFlavor(ctx context.Context, idOrName string) (*Flavor, error) {
-	flavors := p.impl.flavors(p.cloudContext(ctx))
+	flavors := p.flavors(ctx)
 	fr, existed := flavors[idOrName]
 
 	if !existed {
@@ -642,6 +698,61 @@ func (p *Provider) GetServerFlavor(ctx context.Context, idOrName string) (*Flavo
 	return fr, nil
 }
 
+// FlavorResources describes the named consumable resources (such as GPUs) that
+// servers of flavors with names matching a regular expression have.
+type FlavorResources struct {
+	Regex     string
+	Resources map[string]int
+	regexp    *regexp.Regexp
+}
+
+// SetFlavorResources sets the named consumable resources that servers of
+// certain flavors have. The first of the given FlavorResources with a Regex that
+// matches a flavor's Name gives the Resources of that flavor. Flavors that
+// don't match any have no resources. This affects the flavors subsequently
+// returned by our methods, and the servers subsequently Spawn()ed.
+func (p *Provider) SetFlavorResources(frs []*FlavorResources) error {
+	for _, fr := range frs {
+		r, err := regexp.Compile(fr.Regex)
+		if err != nil {
+			return Error{"cloud", "SetFlavorResources", ErrBadRegex}
+		}
+		fr.regexp = r
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.flavorResources = frs
+
+	return nil
+}
+
+// flavors returns p.impl.flavors(), with copies of the flavors that have
+// resources according to SetFlavorResources().
+func (p *Provider) flavors(ctx context.Context) map[string]*Flavor {
+	flavors := p.impl.flavors(p.cloudContext(ctx))
+
+	p.RLock()
+	defer p.RUnlock()
+	if len(p.flavorResources) == 0 {
+		return flavors
+	}
+
+	for id, f := range flavors {
+		for _, fr := range p.flavorResources {
+			if fr.regexp.MatchString(f.Name) {
+				fc := *f
+				fc.Resources = fr.Resources
+				flavors[id] = &fc
+
+				break
+			}
+		}
+	}
+
+	return flavors
+}
+
 // SpawnUsingQuotaCallback is the callback function you supply to Spawn() that
 // will be called as soon as the request for the new server has been issued and
 // is counted as using up quota (but before it has powered up).
@@ -680,7 +791,7 @@ type SpawnUsingQuotaCallback func()
 func (p *Provider) Spawn(ctx context.Context, os string, osUser string, flavorID string,
 	diskGB int, ttd time.Duration, externalIP bool, usingQuotaCB ...SpawnUsingQuotaCallback,
 ) (*Server, error) {
-	f, found := p.impl.flavors(p.cloudContext(ctx))[flavorID]
+	f, found := p.flavors(ctx)[flavorID]
 	if !found {
 		return nil, Error{"cloud", "Spawn", ErrBadFlavor}
 	}
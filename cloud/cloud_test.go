@@ -20,12 +20,19 @@ package cloud
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -40,6 +47,28 @@ func TestUtility(t *testing.T) {
 		So(nameToHostName("test_123-one"), ShouldEqual, "test-123-one")
 		So(nameToHostName("test_123*ONE"), ShouldEqual, "test-123-one")
 	})
+
+	Convey("Flavors and Servers bin-pack named consumable resources", t, func() {
+		ctx := context.Background()
+		flavor := &Flavor{Name: "gpu.small", Cores: 8, RAM: 8000, Disk: 10, Resources: map[string]int{"gpu": 2}}
+		gpu := map[string]int{"gpu": 1}
+		So(flavor.HasSpaceFor(1, 1, 1, nil), ShouldEqual, 8)
+		So(flavor.HasSpaceFor(1, 1, 1, gpu), ShouldEqual, 2)
+		So(flavor.HasSpaceFor(1, 1, 1, map[string]int{"gpu": 3}), ShouldEqual, 0)
+		So(flavor.HasSpaceFor(1, 1, 1, map[string]int{"licence": 1}), ShouldEqual, 0)
+		So(flavor.hasSpareResources(nil), ShouldBeTrue)
+		So(flavor.hasSpareResources(gpu), ShouldBeFalse)
+
+		server := &Server{Name: localhostName, Flavor: flavor, Disk: flavor.Disk}
+		So(server.Allocate(ctx, 1, 1, 1, gpu), ShouldBeTrue)
+		So(server.HasSpaceFor(1, 1, 1, gpu), ShouldEqual, 1)
+		So(server.HasSpaceFor(1, 1, 1, nil), ShouldEqual, 7)
+		So(server.Allocate(ctx, 1, 1, 1, gpu), ShouldBeTrue)
+		So(server.HasSpaceFor(1, 1, 1, gpu), ShouldEqual, 0)
+		So(server.Allocate(ctx, 1, 1, 1, gpu), ShouldBeFalse)
+		server.Release(ctx, 1, 1, 1, gpu)
+		So(server.HasSpaceFor(1, 1, 1, gpu), ShouldEqual, 1)
+	})
 }
 
 func TestOpenStack(t *testing.T) {
@@ -166,7 +195,7 @@ func TestOpenStack(t *testing.T) {
 
 				// author only tests, where I know the expected results
 				if host == "vr-2-2-02" && len(flavorSets) > 1 {
-					flavors, err := p.CheapestServerFlavors(ctx, 1, 2048, flavorRegex, flavorSets)
+					flavors, err := p.CheapestServerFlavors(ctx, 1, 2048, flavorRegex, flavorSets, nil)
 					So(err, ShouldBeNil)
 					So(len(flavors), ShouldEqual, 3)
 					So(flavors[0].Name, ShouldEqual, "m1.tiny")
@@ -277,30 +306,30 @@ func TestOpenStack(t *testing.T) {
 					ok := server.Alive(ctx, true)
 					So(ok, ShouldBeTrue)
 
-					n := server.HasSpaceFor(1, 0, 0)
+					n := server.HasSpaceFor(1, 0, 0, nil)
 					So(n, ShouldEqual, flavor.Cores)
 
-					worked := server.Allocate(ctx, float64(flavor.Cores+1), 100, 0)
+					worked := server.Allocate(ctx, float64(flavor.Cores+1), 100, 0, nil)
 					So(worked, ShouldEqual, false)
-					worked = server.Allocate(ctx, float64(flavor.Cores), 100, 0)
+					worked = server.Allocate(ctx, float64(flavor.Cores), 100, 0, nil)
 					So(worked, ShouldEqual, true)
-					n = server.HasSpaceFor(1, 0, 0)
+					n = server.HasSpaceFor(1, 0, 0, nil)
 					So(n, ShouldEqual, 0)
-					worked = server.Allocate(ctx, 1, 0, 0)
+					worked = server.Allocate(ctx, 1, 0, 0, nil)
 					So(worked, ShouldEqual, false)
 
-					server.Release(ctx, float64(flavor.Cores), 100, 0)
-					n = server.HasSpaceFor(1, 0, 0)
+					server.Release(ctx, float64(flavor.Cores), 100, 0, nil)
+					n = server.HasSpaceFor(1, 0, 0, nil)
 					So(n, ShouldEqual, flavor.Cores)
 
-					n = server.HasSpaceFor(1, flavor.RAM, 0)
+					n = server.HasSpaceFor(1, flavor.RAM, 0, nil)
 					So(n, ShouldEqual, 1)
-					n = server.HasSpaceFor(1, flavor.RAM+1, 0)
+					n = server.HasSpaceFor(1, flavor.RAM+1, 0, nil)
 					So(n, ShouldEqual, 0)
 
-					n = server.HasSpaceFor(1, flavor.RAM, flavor.Disk)
+					n = server.HasSpaceFor(1, flavor.RAM, flavor.Disk, nil)
 					So(n, ShouldEqual, 1)
-					n = server.HasSpaceFor(1, flavor.RAM, flavor.Disk+1)
+					n = server.HasSpaceFor(1, flavor.RAM, flavor.Disk+1, nil)
 					So(n, ShouldEqual, 0)
 
 					Convey("You can also interact with the server over ssh, running commands and creating files and directories", func() {
@@ -487,24 +516,24 @@ func TestOpenStack(t *testing.T) {
 					ok = server3.Alive(ctx)
 					So(ok, ShouldBeTrue)
 
-					server3.Allocate(ctx, 1, 100, 0)
-					server3.Release(ctx, 1, 100, 0)
+					server3.Allocate(ctx, 1, 100, 0, nil)
+					server3.Release(ctx, 1, 100, 0, nil)
 					<-time.After(1 * time.Second)
-					server3.Allocate(ctx, 1, 100, 0)
+					server3.Allocate(ctx, 1, 100, 0, nil)
 					<-time.After(2 * time.Second)
 
 					ok = server3.Alive(ctx)
 					So(ok, ShouldBeTrue)
 
-					server3.Allocate(ctx, 0, 100, 0)
-					server3.Release(ctx, 0, 100, 0)
+					server3.Allocate(ctx, 0, 100, 0, nil)
+					server3.Release(ctx, 0, 100, 0, nil)
 
 					<-time.After(3 * time.Second)
 
 					ok = server3.Alive(ctx)
 					So(ok, ShouldBeTrue)
 
-					server3.Release(ctx, 1, 100, 0)
+					server3.Release(ctx, 1, 100, 0, nil)
 
 					<-time.After(3 * time.Second)
 
@@ -575,3 +604,875 @@ func TestOpenStack(t *testing.T) {
 		})
 	}
 }
+
+func TestAWS(t *testing.T) {
+	ctx := context.Background()
+
+	// we test against a mock EC2-compatible endpoint
+	mock := newMockEC2()
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	for key, val := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "mockkey",
+		"AWS_SECRET_ACCESS_KEY": "mocksecret",
+		"AWS_REGION":            "mock-region-1",
+		"AWS_SESSION_TOKEN":     "",
+		"AWS_ENDPOINT_URL_EC2":  ts.URL,
+		"WR_AWS_IMAGE_OWNERS":   "",
+	} {
+		orig, set := os.LookupEnv(key)
+		os.Setenv(key, val)
+		if set {
+			defer os.Setenv(key, orig)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	crdir, err := os.MkdirTemp("", "wr_testing_aws_cr")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(crdir)
+	crfileprefix := filepath.Join(crdir, "resources")
+	resourceName := "wr-testing-aws"
+
+	Convey("You can find out the environment variables needed for aws", t, func() {
+		vars, err := RequiredEnv("aws")
+		So(err, ShouldBeNil)
+		So(vars, ShouldResemble, []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_REGION"})
+
+		vars, err = AllEnv("aws")
+		So(err, ShouldBeNil)
+		So(vars, ShouldResemble, []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_REGION", "AWS_SESSION_TOKEN", "AWS_ENDPOINT_URL_EC2", "WR_AWS_IMAGE_OWNERS"})
+	})
+
+	Convey("You can't get a new AWS Provider without credentials", t, func() {
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		defer os.Setenv("AWS_SECRET_ACCESS_KEY", "mocksecret")
+		_, err := New(ctx, "aws", resourceName, crfileprefix)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "AWS_SECRET_ACCESS_KEY")
+	})
+
+	Convey("AWS images are only found by name if they have a trusted owner", t, func() {
+		p, err := New(ctx, "aws", resourceName, crfileprefix)
+		So(err, ShouldBeNil)
+		impl := p.impl.(*awsp) //nolint:forcetypeassert
+		So(impl.imageOwners, ShouldResemble, []string{"self", "amazon"})
+		image, err := impl.getImage(ctx, "ubuntu-jammy")
+		So(err, ShouldBeNil)
+		So(*image.ImageId, ShouldEqual, "ami-new")
+
+		os.Setenv("WR_AWS_IMAGE_OWNERS", "amazon, 123456789012")
+		defer os.Setenv("WR_AWS_IMAGE_OWNERS", "")
+		p, err = New(ctx, "aws", resourceName, crfileprefix)
+		So(err, ShouldBeNil)
+		impl = p.impl.(*awsp) //nolint:forcetypeassert
+		So(impl.imageOwners, ShouldResemble, []string{"amazon", "123456789012"})
+		image, err = impl.getImage(ctx, "ubuntu-jammy")
+		So(err, ShouldBeNil)
+		So(*image.ImageId, ShouldEqual, "ami-squat")
+	})
+
+	Convey("You can get a new AWS Provider and use it", t, func() {
+		p, err := New(ctx, "aws", resourceName, crfileprefix)
+		So(err, ShouldBeNil)
+		So(p, ShouldNotBeNil)
+		So(p.InCloud(), ShouldBeFalse)
+		So(mock.lastAuth, ShouldStartWith, "AWS4-HMAC-SHA256 Credential=mockkey/")
+		So(mock.lastAuth, ShouldContainSubstring, "/mock-region-1/ec2/aws4_request, SignedHeaders=")
+		So(mock.lastAuth, ShouldContainSubstring, ";host;")
+
+		q, err := p.GetQuota(ctx)
+		So(err, ShouldBeNil)
+		So(q.MaxInstances, ShouldEqual, 20)
+		So(q.UsedInstances, ShouldEqual, 0)
+
+		flavor, err := p.CheapestServerFlavor(ctx, 1, 1000, "")
+		So(err, ShouldBeNil)
+		So(flavor.ID, ShouldEqual, "t3.micro")
+		So(flavor.Cores, ShouldEqual, 2)
+		So(flavor.RAM, ShouldEqual, 1024)
+
+		flavor, err = p.CheapestServerFlavor(ctx, 3, 4000, "")
+		So(err, ShouldBeNil)
+		So(flavor.ID, ShouldEqual, "c5.xlarge")
+
+		_, err = p.CheapestServerFlavor(ctx, 1, 1000, "^m5")
+		So(err, ShouldBeNil)
+
+		_, err = p.CheapestServerFlavor(ctx, 100, 1000, "")
+		So(err, ShouldNotBeNil)
+
+		err = p.Deploy(ctx, &DeployConfig{RequiredPorts: []int{22, 1234}})
+		So(err, ShouldBeNil)
+		So(p.PrivateKey(), ShouldNotBeBlank)
+		So(p.resources.Details["keypair"], ShouldEqual, resourceName)
+		So(p.resources.Details["vpc"], ShouldNotBeBlank)
+		So(p.resources.Details["subnet"], ShouldNotBeBlank)
+		So(p.resources.Details["gateway"], ShouldNotBeBlank)
+		So(p.resources.Details["secgroup"], ShouldNotBeBlank)
+		So(mock.count("vpc"), ShouldEqual, 1)
+		So(mock.res["vpc"][p.resources.Details["vpc"]]["cidr"], ShouldEqual, "192.168.64.0/18")
+		So(mock.res["subnet"][p.resources.Details["subnet"]]["public"], ShouldEqual, "true")
+		So(mock.res["gateway"][p.resources.Details["gateway"]]["vpc"], ShouldEqual, p.resources.Details["vpc"])
+		So(mock.res["vpc"][p.resources.Details["vpc"]]["route"], ShouldEqual, p.resources.Details["gateway"])
+		So(mock.res["group"][p.resources.Details["secgroup"]]["rules"], ShouldEqual, "tcp:22,tcp:1234,icmp:-1,-1:"+p.resources.Details["secgroup"])
+		So(mock.res["key"][resourceName]["material"], ShouldStartWith, "ssh-rsa ")
+
+		err = p.Deploy(ctx, &DeployConfig{RequiredPorts: []int{22, 1234}})
+		So(err, ShouldBeNil)
+		So(mock.count("vpc"), ShouldEqual, 1)
+		So(mock.count("subnet"), ShouldEqual, 1)
+		So(mock.count("gateway"), ShouldEqual, 1)
+		So(mock.count("group"), ShouldEqual, 1)
+
+		_, err = p.Spawn(ctx, "centos", "centos", "t3.micro", 1, 0*time.Second, true)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "no OS image with prefix [centos] was found")
+
+		usedQuota := make(chan bool, 1)
+		server, err := p.Spawn(ctx, "ubuntu-jammy", "ubuntu", "t3.micro", 20, 0*time.Second, true, func() {
+			usedQuota <- true
+		})
+		So(err, ShouldBeNil)
+		So(<-usedQuota, ShouldBeTrue)
+		So(server.ID, ShouldStartWith, "i-")
+		So(server.Name, ShouldStartWith, resourceName+"-")
+		So(server.IP, ShouldStartWith, "203.0.113.")
+		So(server.Disk, ShouldEqual, 20)
+		So(p.Servers()[server.ID], ShouldNotBeNil)
+
+		instance := mock.res["instance"][server.ID]
+		So(instance["image"], ShouldEqual, "ami-new")
+		So(instance["disk"], ShouldEqual, "20")
+		So(instance["group"], ShouldEqual, p.resources.Details["secgroup"])
+		So(instance["subnet"], ShouldEqual, p.resources.Details["subnet"])
+		So(instance["userdata"], ShouldContainSubstring, "hostnamectl set-hostname "+nameToHostName(server.Name))
+		So(instance["userdata"], ShouldContainSubstring, "touch "+sentinelFilePath)
+
+		ok, err := p.ServerIsKnown(server.ID)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		ok, err = p.CheckServer(ctx, server.ID)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		internalServer, err := p.Spawn(ctx, "ami-old", "ubuntu", "m5.large", 1, 0*time.Second, false)
+		So(err, ShouldBeNil)
+		So(internalServer.IP, ShouldStartWith, "192.168.64.")
+		So(internalServer.Disk, ShouldEqual, 1)
+		So(mock.res["instance"][internalServer.ID]["disk"], ShouldBeBlank)
+		So(p.Servers()[internalServer.ID], ShouldBeNil)
+
+		q, err = p.GetQuota(ctx)
+		So(err, ShouldBeNil)
+		So(q.UsedInstances, ShouldEqual, 2)
+		So(q.UsedCores, ShouldEqual, 4)
+		So(q.UsedRAM, ShouldEqual, 9216)
+
+		_, err = p.Spawn(ctx, "ubuntu-jammy", "ubuntu", "r5.4xlarge", 1, 0*time.Second, false)
+		So(err, ShouldNotBeNil)
+		So(p.ErrIsNoHardware(err), ShouldBeTrue)
+
+		err = p.DestroyServer(ctx, server.ID)
+		So(err, ShouldBeNil)
+		ok, err = p.CheckServer(ctx, server.ID)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		ok, err = p.ServerIsKnown(server.ID)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		So(p.Servers()[server.ID], ShouldBeNil)
+		So(mock.count("address"), ShouldEqual, 0)
+
+		ok, err = p.ServerIsKnown("i-unknown")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		err = p.TearDown(ctx)
+		So(err, ShouldBeNil)
+		So(mock.res["instance"][internalServer.ID]["state"], ShouldEqual, "terminated")
+		for _, kind := range []string{"key", "vpc", "subnet", "gateway", "group", "address"} {
+			So(mock.count(kind), ShouldEqual, 0)
+		}
+
+		err = p.TearDown(ctx)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "nothing to tear down")
+	})
+}
+
+func TestFake(t *testing.T) {
+	ctx := context.Background()
+
+	tmpdir, err := os.MkdirTemp("", "wr_testing_fake")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	authorizedKeys := filepath.Join(tmpdir, "authorized_keys")
+	err = os.WriteFile(authorizedKeys, []byte("ssh-rsa AAAA existing\n"), 0o600)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	origKeepTime := fakeSentinelKeepTime
+	fakeSentinelKeepTime = 100 * time.Millisecond
+	defer func() {
+		fakeSentinelKeepTime = origKeepTime
+	}()
+
+	for key, val := range map[string]string{
+		"WR_FAKE_CLOUD_DIR":             filepath.Join(tmpdir, "cloud"),
+		"WR_FAKE_CLOUD_IP":              "",
+		"WR_FAKE_CLOUD_SSH_PORT":        "",
+		"WR_FAKE_CLOUD_AUTHORIZED_KEYS": authorizedKeys,
+		"WR_FAKE_CLOUD_FLAVORS":         "",
+		"WR_FAKE_CLOUD_QUOTA":           "instances=3,cores=6",
+		"WR_FAKE_CLOUD_SPAWN_TIME":      "10ms",
+		"WR_FAKE_CLOUD_FAILURES":        "spawn=1,nohardware=1,build=1,dead=1",
+	} {
+		orig, set := os.LookupEnv(key)
+		os.Setenv(key, val)
+		if set {
+			defer os.Setenv(key, orig)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	crfileprefix := filepath.Join(tmpdir, "resources")
+	resourceName := "wr-testing-fake"
+
+	Convey("The fake provider needs no environment variables", t, func() {
+		vars, err := RequiredEnv("fake")
+		So(err, ShouldBeNil)
+		So(vars, ShouldBeEmpty)
+
+		vars, err = AllEnv("fake")
+		So(err, ShouldBeNil)
+		So(vars, ShouldContain, "WR_FAKE_CLOUD_FAILURES")
+	})
+
+	Convey("You can't get a fake Provider with bad configuration", t, func() {
+		for key, val := range map[string]string{
+			"WR_FAKE_CLOUD_SSH_PORT":   "ssh",
+			"WR_FAKE_CLOUD_FLAVORS":    "foo:1:2",
+			"WR_FAKE_CLOUD_QUOTA":      "servers=2",
+			"WR_FAKE_CLOUD_SPAWN_TIME": "10",
+			"WR_FAKE_CLOUD_FAILURES":   "explode=1",
+		} {
+			orig := os.Getenv(key)
+			os.Setenv(key, val)
+			_, err := New(ctx, "fake", resourceName, crfileprefix)
+			So(err, ShouldNotBeNil)
+			os.Setenv(key, orig)
+		}
+	})
+
+	Convey("The fake cloud's state is private unless you choose its directory", t, func() {
+		origHome := os.Getenv("HOME")
+		os.Setenv("HOME", filepath.Join(tmpdir, "home"))
+		defer os.Setenv("HOME", origHome)
+		os.Setenv("WR_FAKE_CLOUD_DIR", "")
+		defer os.Setenv("WR_FAKE_CLOUD_DIR", filepath.Join(tmpdir, "cloud"))
+
+		permsOf := func(path string) os.FileMode {
+			info, errs := os.Stat(path)
+			So(errs, ShouldBeNil)
+			return info.Mode().Perm()
+		}
+
+		for _, shared := range []bool{false, true} {
+			if shared {
+				os.Setenv("WR_FAKE_CLOUD_DIR", filepath.Join(tmpdir, "shared"))
+			}
+
+			p, err := New(ctx, "fake", resourceName, crfileprefix)
+			So(err, ShouldBeNil)
+			impl := p.impl.(*fakep) //nolint:forcetypeassert
+
+			path := impl.serverPath("perms")
+			So(impl.writeJSON(path, &fakeServer{ID: "perms"}), ShouldBeNil)
+			entries, err := os.ReadDir(filepath.Dir(path))
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+
+			if shared {
+				So(impl.dir, ShouldEqual, filepath.Join(tmpdir, "shared"))
+				So(permsOf(impl.dir), ShouldEqual, os.FileMode(0o777))
+				So(permsOf(path), ShouldEqual, os.FileMode(0o666))
+			} else {
+				So(impl.dir, ShouldEqual, filepath.Join(tmpdir, "home", ".wr_fake_cloud"))
+				So(permsOf(impl.dir), ShouldEqual, os.FileMode(0o700))
+				So(permsOf(path), ShouldEqual, os.FileMode(0o600))
+			}
+		}
+	})
+
+	Convey("You can get a fake Provider and use it", t, func() {
+		p, err := New(ctx, "fake", resourceName, crfileprefix)
+		So(err, ShouldBeNil)
+		So(p.InCloud(), ShouldBeTrue)
+
+		err = p.Deploy(ctx, &DeployConfig{RequiredPorts: []int{22}})
+		So(err, ShouldBeNil)
+		So(p.PrivateKey(), ShouldNotBeBlank)
+		So(p.resources.Details["keypair"], ShouldEqual, resourceName)
+		ak, err := os.ReadFile(authorizedKeys)
+		So(err, ShouldBeNil)
+		lines := strings.Split(strings.TrimSpace(string(ak)), "\n")
+		So(len(lines), ShouldEqual, 2)
+		So(lines[0], ShouldEqual, "ssh-rsa AAAA existing")
+		So(lines[1], ShouldStartWith, "ssh-rsa ")
+		So(lines[1], ShouldEndWith, " wr-fake-cloud:"+resourceName)
+
+		flavor, err := p.CheapestServerFlavor(ctx, 1, 1000, "")
+		So(err, ShouldBeNil)
+		So(flavor.ID, ShouldEqual, "fake1")
+		flavor, err = p.CheapestServerFlavor(ctx, 3, 5000, "")
+		So(err, ShouldBeNil)
+		So(flavor.ID, ShouldEqual, "fake4")
+		_, err = p.CheapestServerFlavor(ctx, 16, 1000, "")
+		So(err, ShouldNotBeNil)
+
+		q, err := p.GetQuota(ctx)
+		So(err, ShouldBeNil)
+		So(q.MaxInstances, ShouldEqual, 3)
+		So(q.MaxCores, ShouldEqual, 6)
+		So(q.MaxRAM, ShouldEqual, 0)
+		So(q.UsedInstances, ShouldEqual, 0)
+
+		Convey("Injected failures happen in order", func() {
+			_, err = p.Spawn(ctx, "any", "user", "fake1", 0, 0*time.Second, false)
+			So(err, ShouldNotBeNil)
+			So(p.ErrIsNoHardware(err), ShouldBeFalse)
+
+			_, err = p.Spawn(ctx, "any", "user", "fake1", 0, 0*time.Second, false)
+			So(err, ShouldNotBeNil)
+			So(p.ErrIsNoHardware(err), ShouldBeTrue)
+
+			_, err = p.Spawn(ctx, "any", "user", "fake1", 0, 0*time.Second, false)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failed to build")
+			q, err = p.GetQuota(ctx)
+			So(err, ShouldBeNil)
+			So(q.UsedInstances, ShouldEqual, 0)
+
+			dead, err := p.Spawn(ctx, "any", "user", "fake1", 0, 0*time.Second, false)
+			So(err, ShouldBeNil)
+			ok, err := p.ServerIsKnown(dead.ID)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = p.CheckServer(ctx, dead.ID)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			server, err := p.Spawn(ctx, "any", "user", "fake1", 50, 0*time.Second, false)
+			So(err, ShouldBeNil)
+			So(server.IP, ShouldEqual, "127.0.0.1")
+			So(server.Name, ShouldStartWith, resourceName+"-")
+			So(server.Disk, ShouldEqual, 50)
+			ok, err = p.CheckServer(ctx, server.ID)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			_, err = os.Stat(sentinelFilePath)
+			So(err, ShouldBeNil)
+
+			q, err = p.GetQuota(ctx)
+			So(err, ShouldBeNil)
+			So(q.UsedInstances, ShouldEqual, 2)
+			So(q.UsedCores, ShouldEqual, 2)
+			So(q.UsedRAM, ShouldEqual, 4096)
+			So(q.UsedVolume, ShouldEqual, 50)
+
+			Convey("Quota is enforced", func() {
+				_, err = p.Spawn(ctx, "any", "user", "fake8", 0, 0*time.Second, false)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "quota exceeded: cores")
+
+				_, err = p.Spawn(ctx, "any", "user", "fake4", 0, 0*time.Second, false)
+				So(err, ShouldBeNil)
+
+				_, err = p.Spawn(ctx, "any", "user", "fake1", 0, 0*time.Second, false)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "quota exceeded: instances")
+			})
+
+			Convey("Servers can be destroyed, and are seen by other processes", func() {
+				os.Setenv("WR_FAKE_CLOUD_FAILURES", "destroy=1")
+				p2, err := New(ctx, "fake", resourceName, crfileprefix)
+				So(err, ShouldBeNil)
+				os.Setenv("WR_FAKE_CLOUD_FAILURES", "spawn=1,nohardware=1,build=1,dead=1")
+
+				err = p2.DestroyServer(ctx, dead.ID)
+				So(err, ShouldNotBeNil)
+				err = p2.DestroyServer(ctx, dead.ID)
+				So(err, ShouldBeNil)
+				ok, err = p.ServerIsKnown(dead.ID)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeFalse)
+
+				ok, err = p2.ServerIsKnown(server.ID)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+				err = p2.Deploy(ctx, &DeployConfig{})
+				So(err, ShouldBeNil)
+				So(p2.GetServerByName(server.Name), ShouldNotBeNil)
+			})
+
+			Convey("A manager on a head node doesn't tear down the head node", func() {
+				head, err := p.Spawn(ctx, "any", "user", "fake1", 0, 0*time.Second, true)
+				So(err, ShouldBeNil)
+				So(head.IsHeadNode, ShouldBeTrue)
+
+				impl := p.impl.(*fakep) //nolint:forcetypeassert
+				kpPath := impl.keyPairPath(resourceName)
+				kp := &fakeKeyPair{}
+				So(readFakeJSON(kpPath, kp), ShouldBeNil)
+				realUser := kp.User
+				kp.User = "someone_else"
+				So(impl.writeJSON(kpPath, kp), ShouldBeNil)
+				impl.createdKeyPair = false
+
+				err = p.TearDown(ctx)
+				So(err, ShouldBeNil)
+				ok, err = p.ServerIsKnown(server.ID)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeFalse)
+				ok, err = p.ServerIsKnown(head.ID)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+				So(p.PrivateKey(), ShouldNotBeBlank)
+
+				kp.User = realUser
+				So(impl.writeJSON(kpPath, kp), ShouldBeNil)
+			})
+
+			Convey("A manager deployed to this machine by the same user doesn't tear down the head node", func() {
+				head, err := p.Spawn(ctx, "any", "user", "fake1", 0, 0*time.Second, true)
+				So(err, ShouldBeNil)
+
+				// the deployed manager has a copy of our resources, saved
+				// somewhere else
+				content, err := os.ReadFile(crfileprefix + "." + resourceName)
+				So(err, ShouldBeNil)
+				So(os.WriteFile(crfileprefix+".deployed."+resourceName, content, 0o600), ShouldBeNil)
+
+				deployed, err := New(ctx, "fake", resourceName, crfileprefix+".deployed")
+				So(err, ShouldBeNil)
+
+				err = deployed.TearDown(ctx)
+				So(err, ShouldBeNil)
+				ok, err = p.ServerIsKnown(server.ID)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeFalse)
+				ok, err = p.ServerIsKnown(head.ID)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+
+				impl := p.impl.(*fakep) //nolint:forcetypeassert
+				_, err = os.Stat(impl.keyPairPath(resourceName))
+				So(err, ShouldBeNil)
+			})
+
+			Reset(func() {
+				err = p.TearDown(ctx)
+				So(err, ShouldBeNil)
+
+				q, err = p.GetQuota(ctx)
+				So(err, ShouldBeNil)
+				So(q.UsedInstances, ShouldEqual, 0)
+
+				ak, err = os.ReadFile(authorizedKeys)
+				So(err, ShouldBeNil)
+				So(string(ak), ShouldEqual, "ssh-rsa AAAA existing\n")
+
+				<-time.After(200 * time.Millisecond)
+				_, err = os.Stat(sentinelFilePath)
+				So(os.IsNotExist(err), ShouldBeTrue)
+
+				err = p.TearDown(ctx)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "nothing to tear down")
+			})
+		})
+	})
+}
+
+// mockEC2 is an in-memory implementation of the parts of the EC2 Query API
+// used by the aws provider. Resources are stored in res as kind => id =>
+// attributes.
+type mockEC2 struct {
+	res      map[string]map[string]map[string]string
+	lastAuth string
+	ids      int
+	sync.Mutex
+}
+
+func newMockEC2() *mockEC2 {
+	m := &mockEC2{res: make(map[string]map[string]map[string]string)}
+	for _, kind := range []string{"key", "vpc", "subnet", "gateway", "group", "instance", "address"} {
+		m.res[kind] = make(map[string]map[string]string)
+	}
+
+	return m
+}
+
+// count returns the number of resources of the given kind.
+func (m *mockEC2) count(kind string) int {
+	m.Lock()
+	defer m.Unlock()
+
+	return len(m.res[kind])
+}
+
+// add creates a resource of the given kind with the given attributes and
+// returns its id.
+func (m *mockEC2) add(kind, prefix string, attrs map[string]string) string {
+	m.ids++
+	id := fmt.Sprintf("%s-%d", prefix, m.ids)
+	attrs["id"] = id
+	m.res[kind][id] = attrs
+
+	return id
+}
+
+// filtered returns the ids of resources of the given kind that match the
+// request's filters, where filter names are mapped to attribute names by
+// attrs.
+func (m *mockEC2) filtered(form url.Values, kind string, attrs map[string]string) []string {
+	filters := make(map[string][]string)
+	for i := 1; form.Get(fmt.Sprintf("Filter.%d.Name", i)) != ""; i++ {
+		name := form.Get(fmt.Sprintf("Filter.%d.Name", i))
+		for j := 1; form.Get(fmt.Sprintf("Filter.%d.Value.%d", i, j)) != ""; j++ {
+			filters[name] = append(filters[name], form.Get(fmt.Sprintf("Filter.%d.Value.%d", i, j)))
+		}
+	}
+
+	var ids []string
+RES:
+	for id, r := range m.res[kind] {
+		for name, vals := range filters {
+			matched := false
+			for _, val := range vals {
+				actual := r[attrs[name]]
+				if actual == val || (strings.HasSuffix(val, "*") && strings.HasPrefix(actual, strings.TrimSuffix(val, "*"))) {
+					matched = true
+				}
+			}
+			if !matched {
+				continue RES
+			}
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func (m *mockEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.lastAuth = r.Header.Get("Authorization")
+	if !strings.HasPrefix(m.lastAuth, "AWS4-HMAC-SHA256 Credential=mockkey/") {
+		mockEC2Error(w, http.StatusUnauthorized, "AuthFailure", "bad credentials")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		mockEC2Error(w, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	f := r.Form
+	action := f.Get("Action")
+
+	notFound := func(kind, id string) bool {
+		if _, exists := m.res[kind][id]; !exists {
+			mockEC2Error(w, http.StatusBadRequest, "Invalid"+strings.ToUpper(kind[:1])+kind[1:]+"ID.NotFound", id+" does not exist")
+			return true
+		}
+		return false
+	}
+
+	var body strings.Builder
+	switch action {
+	case "DescribeInstanceTypes":
+		body.WriteString("<instanceTypeSet>")
+		for _, it := range [][]int{{2, 512}, {2, 1024}, {2, 8192}, {4, 8192}, {16, 131072}} {
+			name := map[int]string{512: "t3.nano", 1024: "t3.micro", 131072: "r5.4xlarge"}[it[1]]
+			if it[1] == 8192 {
+				name = map[int]string{2: "m5.large", 4: "c5.xlarge"}[it[0]]
+			}
+			fmt.Fprintf(&body, "<item><instanceType>%s</instanceType><vCpuInfo><defaultVCpus>%d</defaultVCpus></vCpuInfo><memoryInfo><sizeInMiB>%d</sizeInMiB></memoryInfo></item>", name, it[0], it[1])
+		}
+		body.WriteString("</instanceTypeSet>")
+	case "DescribeAccountAttributes":
+		body.WriteString("<accountAttributeSet><item><attributeName>max-instances</attributeName><attributeValueSet><item><attributeValue>20</attributeValue></item></attributeValueSet></item></accountAttributeSet>")
+	case "DescribeImages":
+		body.WriteString("<imagesSet>")
+		owners := make(map[string]bool)
+		for i := 1; f.Get("Owner."+strconv.Itoa(i)) != ""; i++ {
+			owners[f.Get("Owner."+strconv.Itoa(i))] = true
+		}
+		for _, image := range [][]string{{"ami-old", "ubuntu-jammy-2024-01-01", "2024-01-01T00:00:00.000Z", "amazon"}, {"ami-new", "ubuntu-jammy-2024-03-01", "2024-03-01T00:00:00.000Z", "amazon"}, {"ami-squat", "ubuntu-jammy-2024-06-01", "2024-06-01T00:00:00.000Z", "123456789012"}} {
+			if id := f.Get("ImageId.1"); id != "" && id != image[0] {
+				continue
+			}
+			if len(owners) > 0 && !owners[image[3]] {
+				continue
+			}
+			if name := f.Get("Filter.1.Value.1"); name != "" && !strings.HasPrefix(image[1], strings.TrimSuffix(name, "*")) {
+				continue
+			}
+			fmt.Fprintf(&body, "<item><imageId>%s</imageId><name>%s</name><creationDate>%s</creationDate><rootDeviceName>/dev/sda1</rootDeviceName><blockDeviceMapping><item><deviceName>/dev/sda1</deviceName><ebs><volumeSize>8</volumeSize></ebs></item></blockDeviceMapping></item>", image[0], image[1], image[2])
+		}
+		body.WriteString("</imagesSet>")
+	case "DescribeKeyPairs":
+		name := f.Get("KeyName.1")
+		if _, exists := m.res["key"][name]; !exists {
+			mockEC2Error(w, http.StatusBadRequest, "InvalidKeyPair.NotFound", "The key pair '"+name+"' does not exist")
+			return
+		}
+		fmt.Fprintf(&body, "<keySet><item><keyName>%s</keyName></item></keySet>", name)
+	case "ImportKeyPair":
+		material, _ := base64.StdEncoding.DecodeString(f.Get("PublicKeyMaterial"))
+		m.res["key"][f.Get("KeyName")] = map[string]string{"material": string(material)}
+		fmt.Fprintf(&body, "<keyName>%s</keyName>", f.Get("KeyName"))
+	case "DeleteKeyPair":
+		delete(m.res["key"], f.Get("KeyName"))
+	case "DescribeVpcs":
+		body.WriteString("<vpcSet>")
+		for _, id := range m.filtered(f, "vpc", map[string]string{"tag:Name": "name"}) {
+			fmt.Fprintf(&body, "<item><vpcId>%s</vpcId></item>", id)
+		}
+		body.WriteString("</vpcSet>")
+	case "CreateVpc":
+		id := m.add("vpc", "vpc", map[string]string{"cidr": f.Get("CidrBlock"), "name": f.Get("TagSpecification.1.Tag.1.Value"), "main": "true"})
+		fmt.Fprintf(&body, "<vpc><vpcId>%s</vpcId></vpc>", id)
+	case "DeleteVpc":
+		id := f.Get("VpcId")
+		if notFound("vpc", id) {
+			return
+		}
+		for _, kind := range []string{"subnet", "gateway", "group"} {
+			if len(m.filtered(url.Values{"Filter.1.Name": {"vpc"}, "Filter.1.Value.1": {id}}, kind, map[string]string{"vpc": "vpc"})) > 0 {
+				mockEC2Error(w, http.StatusBadRequest, "DependencyViolation", "vpc has a dependent "+kind)
+				return
+			}
+		}
+		delete(m.res["vpc"], id)
+	case "DescribeSubnets":
+		ids := m.filtered(f, "subnet", map[string]string{"vpc-id": "vpc"})
+		if id := f.Get("SubnetId.1"); id != "" {
+			ids = []string{id}
+		}
+		body.WriteString("<subnetSet>")
+		for _, id := range ids {
+			fmt.Fprintf(&body, "<item><subnetId>%s</subnetId><cidrBlock>%s</cidrBlock></item>", id, m.res["subnet"][id]["cidr"])
+		}
+		body.WriteString("</subnetSet>")
+	case "CreateSubnet":
+		id := m.add("subnet", "subnet", map[string]string{"vpc": f.Get("VpcId"), "cidr": f.Get("CidrBlock")})
+		fmt.Fprintf(&body, "<subnet><subnetId>%s</subnetId></subnet>", id)
+	case "ModifySubnetAttribute":
+		if notFound("subnet", f.Get("SubnetId")) {
+			return
+		}
+		m.res["subnet"][f.Get("SubnetId")]["public"] = f.Get("MapPublicIpOnLaunch.Value")
+	case "DeleteSubnet":
+		id := f.Get("SubnetId")
+		if notFound("subnet", id) {
+			return
+		}
+		for _, instance := range m.res["instance"] {
+			if instance["subnet"] == id && instance["state"] != "terminated" {
+				mockEC2Error(w, http.StatusBadRequest, "DependencyViolation", "subnet has dependent instances")
+				return
+			}
+		}
+		delete(m.res["subnet"], id)
+	case "DescribeInternetGateways":
+		body.WriteString("<internetGatewaySet>")
+		for _, id := range m.filtered(f, "gateway", map[string]string{"attachment.vpc-id": "vpc"}) {
+			fmt.Fprintf(&body, "<item><internetGatewayId>%s</internetGatewayId></item>", id)
+		}
+		body.WriteString("</internetGatewaySet>")
+	case "CreateInternetGateway":
+		id := m.add("gateway", "igw", map[string]string{})
+		fmt.Fprintf(&body, "<internetGateway><internetGatewayId>%s</internetGatewayId></internetGateway>", id)
+	case "AttachInternetGateway", "DetachInternetGateway":
+		id := f.Get("InternetGatewayId")
+		if notFound("gateway", id) {
+			return
+		}
+		if action == "AttachInternetGateway" {
+			m.res["gateway"][id]["vpc"] = f.Get("VpcId")
+		} else {
+			m.res["gateway"][id]["vpc"] = ""
+		}
+	case "DeleteInternetGateway":
+		id := f.Get("InternetGatewayId")
+		if notFound("gateway", id) {
+			return
+		}
+		if m.res["gateway"][id]["vpc"] != "" {
+			mockEC2Error(w, http.StatusBadRequest, "DependencyViolation", "gateway is attached")
+			return
+		}
+		delete(m.res["gateway"], id)
+	case "DescribeRouteTables":
+		body.WriteString("<routeTableSet>")
+		for _, id := range m.filtered(f, "vpc", map[string]string{"vpc-id": "id", "association.main": "main"}) {
+			fmt.Fprintf(&body, "<item><routeTableId>rtb-%s</routeTableId></item>", id)
+		}
+		body.WriteString("</routeTableSet>")
+	case "CreateRoute":
+		id := strings.TrimPrefix(f.Get("RouteTableId"), "rtb-")
+		if notFound("vpc", id) {
+			return
+		}
+		m.res["vpc"][id]["route"] = f.Get("GatewayId")
+	case "DescribeSecurityGroups":
+		body.WriteString("<securityGroupInfo>")
+		for _, id := range m.filtered(f, "group", map[string]string{"group-name": "name", "vpc-id": "vpc"}) {
+			fmt.Fprintf(&body, "<item><groupId>%s</groupId></item>", id)
+		}
+		body.WriteString("</securityGroupInfo>")
+	case "CreateSecurityGroup":
+		id := m.add("group", "sg", map[string]string{"name": f.Get("GroupName"), "vpc": f.Get("VpcId")})
+		fmt.Fprintf(&body, "<groupId>%s</groupId>", id)
+	case "AuthorizeSecurityGroupIngress":
+		id := f.Get("GroupId")
+		if notFound("group", id) {
+			return
+		}
+		var rules []string
+		for i := 1; f.Get(fmt.Sprintf("IpPermissions.%d.IpProtocol", i)) != ""; i++ {
+			prefix := fmt.Sprintf("IpPermissions.%d.", i)
+			rules = append(rules, f.Get(prefix+"IpProtocol")+":"+f.Get(prefix+"FromPort")+f.Get(prefix+"Groups.1.GroupId"))
+		}
+		m.res["group"][id]["rules"] = strings.Join(rules, ",")
+	case "DeleteSecurityGroup":
+		id := f.Get("GroupId")
+		if notFound("group", id) {
+			return
+		}
+		for _, instance := range m.res["instance"] {
+			if instance["group"] == id && instance["state"] != "terminated" {
+				mockEC2Error(w, http.StatusBadRequest, "DependencyViolation", "group is in use")
+				return
+			}
+		}
+		delete(m.res["group"], id)
+	case "RunInstances":
+		if f.Get("InstanceType") == "r5.4xlarge" {
+			mockEC2Error(w, http.StatusInternalServerError, "InsufficientInstanceCapacity", "We currently do not have sufficient capacity")
+			return
+		}
+		userData, _ := base64.StdEncoding.DecodeString(f.Get("UserData"))
+		id := m.add("instance", "i", map[string]string{
+			"type":     f.Get("InstanceType"),
+			"image":    f.Get("ImageId"),
+			"state":    "pending",
+			"name":     f.Get("TagSpecification.1.Tag.1.Value"),
+			"subnet":   f.Get("SubnetId"),
+			"group":    f.Get("SecurityGroupId.1"),
+			"disk":     f.Get("BlockDeviceMapping.1.Ebs.VolumeSize"),
+			"userdata": string(userData),
+		})
+		m.res["instance"][id]["ip"] = fmt.Sprintf("192.168.64.%d", m.ids)
+		fmt.Fprintf(&body, "<instancesSet>%s</instancesSet>", m.instanceXML(id))
+	case "DescribeInstances":
+		ids := m.filtered(f, "instance", map[string]string{"tag:Name": "name", "instance-state-name": "state"})
+		if id := f.Get("InstanceId.1"); id != "" {
+			if notFound("instance", id) {
+				return
+			}
+			ids = []string{id}
+		}
+		body.WriteString("<reservationSet>")
+		for _, id := range ids {
+			fmt.Fprintf(&body, "<item><instancesSet>%s</instancesSet></item>", m.instanceXML(id))
+		}
+		body.WriteString("</reservationSet>")
+
+		// time passes for our instances each time they're looked at
+		for _, id := range ids {
+			instance := m.res["instance"][id]
+			switch instance["state"] {
+			case "pending":
+				instance["state"] = "running"
+			case "shutting-down":
+				instance["state"] = "terminated"
+			}
+		}
+	case "TerminateInstances":
+		id := f.Get("InstanceId.1")
+		if notFound("instance", id) {
+			return
+		}
+		m.res["instance"][id]["state"] = "shutting-down"
+	case "DescribeAddresses":
+		body.WriteString("<addressesSet>")
+		for _, id := range m.filtered(f, "address", map[string]string{"tag:Name": "name", "instance-id": "instance"}) {
+			a := m.res["address"][id]
+			fmt.Fprintf(&body, "<item><publicIp>%s</publicIp><allocationId>%s</allocationId><associationId>%s</associationId><instanceId>%s</instanceId></item>", a["ip"], id, a["association"], a["instance"])
+		}
+		body.WriteString("</addressesSet>")
+	case "AllocateAddress":
+		id := m.add("address", "eipalloc", map[string]string{"name": f.Get("TagSpecification.1.Tag.1.Value")})
+		m.res["address"][id]["ip"] = fmt.Sprintf("203.0.113.%d", m.ids)
+		fmt.Fprintf(&body, "<publicIp>%s</publicIp><allocationId>%s</allocationId>", m.res["address"][id]["ip"], id)
+	case "AssociateAddress":
+		id := f.Get("AllocationId")
+		if notFound("address", id) || notFound("instance", f.Get("InstanceId")) {
+			return
+		}
+		m.res["address"][id]["instance"] = f.Get("InstanceId")
+		m.res["address"][id]["association"] = "eipassoc-" + id
+	case "DisassociateAddress":
+		for _, a := range m.res["address"] {
+			if a["association"] == f.Get("AssociationId") {
+				a["instance"] = ""
+				a["association"] = ""
+			}
+		}
+	case "ReleaseAddress":
+		id := f.Get("AllocationId")
+		if notFound("address", id) {
+			return
+		}
+		if m.res["address"][id]["association"] != "" {
+			mockEC2Error(w, http.StatusBadRequest, "InvalidIPAddress.InUse", "address is associated")
+			return
+		}
+		delete(m.res["address"], id)
+	default:
+		mockEC2Error(w, http.StatusBadRequest, "InvalidAction", "unsupported action "+action)
+		return
+	}
+
+	fmt.Fprintf(w, "<%sResponse><requestId>mock</requestId>%s</%sResponse>", action, body.String(), action)
+}
+
+// instanceXML returns the XML description of the given instance.
+func (m *mockEC2) instanceXML(id string) string {
+	i := m.res["instance"][id]
+	vpc := m.res["subnet"][i["subnet"]]["vpc"]
+
+	return fmt.Sprintf("<item><instanceId>%s</instanceId><instanceType>%s</instanceType><instanceState><name>%s</name></instanceState><privateIpAddress>%s</privateIpAddress><privateDnsName>ip-%s.ec2.internal</privateDnsName><subnetId>%s</subnetId><vpcId>%s</vpcId><tagSet><item><key>Name</key><value>%s</value></item></tagSet></item>",
+		id, i["type"], i["state"], i["ip"], strings.ReplaceAll(i["ip"], ".", "-"), i["subnet"], vpc, i["name"])
+}
+
+// mockEC2Error writes an EC2 API error response.
+func mockEC2Error(w http.ResponseWriter, status int, code, msg string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Response><Errors><Error><Code>%s</Code><Message>%s</Message></Error></Errors><RequestID>mock</RequestID></Response>", code, msg)
+}
@@ -0,0 +1,916 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cloud
+
+// This file contains a provideri implementation for a fake cloud, where every
+// "server" is really the local machine, with whatever resources its flavor
+// claims. It lets you test cloud scheduling from end to end (flavor choice,
+// quotas, spawn failures, bad servers and so on) without a real cloud: all you
+// need is to be able to ssh to localhost.
+//
+// The state of the fake cloud (its servers and key pairs) is stored in files
+// in a directory, so that it is shared between processes just like a real
+// cloud would be.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/gofrs/uuid"
+	"github.com/hashicorp/go-multierror"
+	"github.com/wtsi-ssg/wr/clog"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	fakeDefaultIP       = "127.0.0.1"
+	fakeKeyComment      = "wr-fake-cloud:"
+	fakeServersDir      = "servers"
+	fakeKeysDir         = "keys"
+	fakeStateBuild      = "BUILD"
+	fakeStateActive     = "ACTIVE"
+	fakeNoHardwareMsg   = "not enough hardware available to create a server of that flavor"
+	fakeDefaultDir      = "~/.wr_fake_cloud"
+	fakeDirPerms        = 0o700
+	fakeFilePerms       = 0o600
+	fakeSharedDirPerms  = 0o777
+	fakeSharedFilePerms = 0o666
+)
+
+// fakeDefaultFlavors are the flavors offered if WR_FAKE_CLOUD_FLAVORS is not
+// set, in the same id:cores:ramMB:diskGB,... format.
+const fakeDefaultFlavors = "fake1:1:2048:20,fake2:2:4096:40,fake4:4:8192:80,fake8:8:16384:160"
+
+// fakeFailureKinds are the kinds of failure that can be injected with
+// WR_FAKE_CLOUD_FAILURES.
+var fakeFailureKinds = map[string]bool{"spawn": true, "nohardware": true, "build": true, "destroy": true, "dead": true}
+
+// fakeSentinelKeepTime is how long after the most recent spawn we make sure
+// that sentinelFilePath exists. Since all fake servers share the local
+// filesystem, a Server.WaitUntilReady() for one server can delete the sentinel
+// file that another server is waiting on, so we keep recreating it.
+var fakeSentinelKeepTime = 1 * time.Minute
+
+// fakeSentinelCheckFrequency is how often we check sentinelFilePath exists
+// while keeping it.
+var fakeSentinelCheckFrequency = 250 * time.Millisecond
+
+// fakeEnvs contains the environment variable names you can use to configure
+// the fake cloud. None of them are required:
+//
+// WR_FAKE_CLOUD_DIR is the directory the state of the cloud is stored in
+// (default ~/.wr_fake_cloud, which only you can access). If set, the directory
+// and the files within it are made accessible to all users, so that managers
+// run as different users can share the cloud.
+//
+// WR_FAKE_CLOUD_IP is the IP address that all servers have (default
+// 127.0.0.1).
+//
+// WR_FAKE_CLOUD_SSH_PORT is the port that ssh listens on for all servers
+// (default 22), eg. for an sshd you run yourself as a normal user.
+//
+// WR_FAKE_CLOUD_AUTHORIZED_KEYS is the path to an authorized_keys file that the
+// public key created during Deploy() gets added to (and removed from during
+// TearDown()), so that you can ssh to the servers, eg. ~/.ssh/authorized_keys.
+//
+// WR_FAKE_CLOUD_FLAVORS describes the available flavors in the form
+// id:cores:ramMB:diskGB,id:cores:ramMB:diskGB.
+//
+// WR_FAKE_CLOUD_QUOTA limits resource usage in the form
+// instances=n,cores=n,ram=MB,volume=GB; anything not specified is unlimited.
+//
+// WR_FAKE_CLOUD_SPAWN_TIME is how long it takes a server to spawn, eg. 5s.
+//
+// WR_FAKE_CLOUD_FAILURES makes the next n operations of certain kinds fail, in
+// the form kind=n,kind=n. "spawn" makes spawn requests fail outright,
+// "nohardware" makes them fail due to lack of hardware, "build" makes spawned
+// servers fail to build (after they used up quota), "destroy" makes server
+// destruction fail and "dead" makes spawned servers stop working right after
+// they become ready.
+var fakeMaybeEnvs = [...]string{"WR_FAKE_CLOUD_DIR", "WR_FAKE_CLOUD_IP", "WR_FAKE_CLOUD_SSH_PORT", "WR_FAKE_CLOUD_AUTHORIZED_KEYS",
+	"WR_FAKE_CLOUD_FLAVORS", "WR_FAKE_CLOUD_QUOTA", "WR_FAKE_CLOUD_SPAWN_TIME", "WR_FAKE_CLOUD_FAILURES"}
+
+// fakeServer is how a server is stored in the fake cloud.
+type fakeServer struct {
+	ID       string
+	Name     string
+	IP       string
+	Flavor   string
+	Disk     int
+	External bool
+	State    string
+	Dead     bool
+}
+
+// fakeKeyPair is how a key pair is stored in the fake cloud.
+type fakeKeyPair struct {
+	PublicKey string
+	User      string // the user that created the key pair
+	SavePath  string // where its creator saved its resources
+}
+
+// fakep is our implementer of provideri
+type fakep struct {
+	savePath        string
+	dir             string
+	dirPerms        os.FileMode
+	filePerms       os.FileMode
+	ip              string
+	port            int
+	authorizedKeys  string
+	user            string
+	spawnTime       time.Duration
+	quota           *Quota
+	fmap            map[string]*Flavor
+	failures        map[string]int
+	sentinelUntil   time.Time
+	keepingSentinel bool
+	createdKeyPair  bool
+	akMutex         sync.Mutex
+	sync.Mutex
+}
+
+// requiredEnv returns envs that are definitely required.
+func (p *fakep) requiredEnv() []string {
+	return nil
+}
+
+// maybeEnv returns envs that might be required.
+func (p *fakep) maybeEnv() []string {
+	return fakeMaybeEnvs[:]
+}
+
+// initialize parses our environment variables and makes sure our state
+// directory exists.
+func (p *fakep) initialize() error {
+	p.dir = os.Getenv("WR_FAKE_CLOUD_DIR")
+	p.dirPerms, p.filePerms = fakeDirPerms, fakeFilePerms
+	if p.dir == "" {
+		p.dir = internal.TildaToHome(fakeDefaultDir)
+	} else {
+		// an explicitly chosen directory is world writeable so that a manager
+		// started as a different user on a "server" can share the state of
+		// the cloud
+		p.dirPerms, p.filePerms = fakeSharedDirPerms, fakeSharedFilePerms
+	}
+
+	for _, dir := range []string{p.dir, filepath.Join(p.dir, fakeServersDir), filepath.Join(p.dir, fakeKeysDir)} {
+		if err := os.MkdirAll(dir, p.dirPerms); err != nil {
+			return err
+		}
+		os.Chmod(dir, p.dirPerms) //nolint:errcheck // might be another user's
+	}
+
+	p.ip = os.Getenv("WR_FAKE_CLOUD_IP")
+	if p.ip == "" {
+		p.ip = fakeDefaultIP
+	}
+
+	if ak := os.Getenv("WR_FAKE_CLOUD_AUTHORIZED_KEYS"); ak != "" {
+		p.authorizedKeys = internal.TildaToHome(ak)
+	}
+
+	var err error
+	p.user, err = internal.Username()
+	if err != nil {
+		return err
+	}
+
+	p.port = defaultSSHPort
+	if port := os.Getenv("WR_FAKE_CLOUD_SSH_PORT"); port != "" {
+		p.port, err = strconv.Atoi(port)
+		if err != nil || p.port < 1 {
+			return fmt.Errorf("WR_FAKE_CLOUD_SSH_PORT [%s] is not a valid port", port)
+		}
+	}
+
+	flavors := os.Getenv("WR_FAKE_CLOUD_FLAVORS")
+	if flavors == "" {
+		flavors = fakeDefaultFlavors
+	}
+	p.fmap, err = parseFakeFlavors(flavors)
+	if err != nil {
+		return err
+	}
+
+	p.quota, err = parseFakeQuota(os.Getenv("WR_FAKE_CLOUD_QUOTA"))
+	if err != nil {
+		return err
+	}
+
+	if st := os.Getenv("WR_FAKE_CLOUD_SPAWN_TIME"); st != "" {
+		p.spawnTime, err = time.ParseDuration(st)
+		if err != nil {
+			return fmt.Errorf("WR_FAKE_CLOUD_SPAWN_TIME is not a valid duration: %w", err)
+		}
+	}
+
+	p.failures, err = parseFakeFailures(os.Getenv("WR_FAKE_CLOUD_FAILURES"))
+
+	return err
+}
+
+// parseFakeFlavors parses an id:cores:ramMB:diskGB,... flavor description.
+func parseFakeFlavors(spec string) (map[string]*Flavor, error) {
+	fmap := make(map[string]*Flavor)
+
+	for _, def := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(def), ":")
+		if len(parts) != 4 || parts[0] == "" {
+			return nil, fmt.Errorf("fake flavor [%s] is not in the form id:cores:ramMB:diskGB", def)
+		}
+
+		vals := make([]int, 3)
+		for i, part := range parts[1:] {
+			val, err := strconv.Atoi(part)
+			if err != nil || val < 1 {
+				return nil, fmt.Errorf("fake flavor [%s] has an invalid number [%s]", def, part)
+			}
+			vals[i] = val
+		}
+
+		fmap[parts[0]] = &Flavor{ID: parts[0], Name: parts[0], Cores: vals[0], RAM: vals[1], Disk: vals[2]}
+	}
+
+	return fmap, nil
+}
+
+// parseFakeQuota parses an instances=n,cores=n,ram=MB,volume=GB quota
+// description into the Max* values of a Quota.
+func parseFakeQuota(spec string) (*Quota, error) {
+	quota := &Quota{}
+	if spec == "" {
+		return quota, nil
+	}
+
+	for _, def := range strings.Split(spec, ",") {
+		key, val, err := parseFakeKeyVal(def)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case "instances":
+			quota.MaxInstances = val
+		case "cores":
+			quota.MaxCores = val
+		case "ram":
+			quota.MaxRAM = val
+		case "volume":
+			quota.MaxVolume = val
+		default:
+			return nil, fmt.Errorf("fake quota [%s] is not one of instances, cores, ram or volume", key)
+		}
+	}
+
+	return quota, nil
+}
+
+// parseFakeFailures parses a kind=n,kind=n failure description.
+func parseFakeFailures(spec string) (map[string]int, error) {
+	failures := make(map[string]int)
+	if spec == "" {
+		return failures, nil
+	}
+
+	for _, def := range strings.Split(spec, ",") {
+		kind, n, err := parseFakeKeyVal(def)
+		if err != nil {
+			return nil, err
+		}
+
+		if !fakeFailureKinds[kind] {
+			return nil, fmt.Errorf("fake failure kind [%s] is not one of spawn, nohardware, build, destroy or dead", kind)
+		}
+
+		failures[kind] = n
+	}
+
+	return failures, nil
+}
+
+// parseFakeKeyVal parses a key=n string.
+func parseFakeKeyVal(def string) (string, int, error) {
+	key, valStr, found := strings.Cut(strings.TrimSpace(def), "=")
+	if !found {
+		return "", 0, fmt.Errorf("[%s] is not in the form key=n", def)
+	}
+
+	val, err := strconv.Atoi(valStr)
+	if err != nil || val < 0 {
+		return "", 0, fmt.Errorf("[%s] does not have a valid number", def)
+	}
+
+	return key, val, nil
+}
+
+// fail returns true if we have been asked to inject a failure of the given
+// kind, using up one of those failures.
+func (p *fakep) fail(kind string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.failures[kind] > 0 {
+		p.failures[kind]--
+
+		return true
+	}
+
+	return false
+}
+
+// serverPath returns the path to the file that stores the server with the
+// given ID.
+func (p *fakep) serverPath(serverID string) string {
+	return filepath.Join(p.dir, fakeServersDir, filepath.Base(serverID))
+}
+
+// keyPairPath returns the path to the file that stores the key pair with the
+// given name.
+func (p *fakep) keyPairPath(name string) string {
+	return filepath.Join(p.dir, fakeKeysDir, filepath.Base(name))
+}
+
+// writeJSON atomically stores the given thing as JSON in the given file in our
+// state directory.
+func (p *fakep) writeJSON(path string, thing interface{}) error {
+	content, err := json.Marshal(thing)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone once renamed
+
+	_, err = tmp.Write(content)
+	if errc := tmp.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+
+	// (CreateTemp() files are only accessible to us, which would stop other
+	// users sharing the cloud from updating the file)
+	if err = os.Chmod(tmp.Name(), p.filePerms); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// readFakeJSON reads the JSON in the given file into the given thing.
+func readFakeJSON(path string, thing interface{}) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, thing)
+}
+
+// getServer returns the stored server with the given ID. If it doesn't exist,
+// the error will satisfy os.IsNotExist().
+func (p *fakep) getServer(serverID string) (*fakeServer, error) {
+	server := &fakeServer{}
+	err := readFakeJSON(p.serverPath(serverID), server)
+
+	return server, err
+}
+
+// getServers returns all stored servers.
+func (p *fakep) getServers() ([]*fakeServer, error) {
+	entries, err := os.ReadDir(filepath.Join(p.dir, fakeServersDir))
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make([]*fakeServer, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+
+		server, errg := p.getServer(entry.Name())
+		if errg != nil {
+			if os.IsNotExist(errg) {
+				continue
+			}
+
+			return nil, errg
+		}
+
+		servers = append(servers, server)
+	}
+
+	return servers, nil
+}
+
+// getKeyPair returns the stored key pair with the given name, or nil if it
+// doesn't exist.
+func (p *fakep) getKeyPair(name string) (*fakeKeyPair, error) {
+	kp := &fakeKeyPair{}
+	err := readFakeJSON(p.keyPairPath(name), kp)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return kp, err
+}
+
+// onHeadNode returns true if the key pair for the given resources was created
+// by a different user to us, or by someone saving their resources somewhere
+// else, in which case we assume we're a manager that 'wr cloud deploy' started
+// on a head node (which keeps its files apart from those of its deployer, since
+// they share this machine), and that our head node and key pair should be left
+// alone.
+func (p *fakep) onHeadNode(resources *Resources) bool {
+	kp, err := p.getKeyPair(resources.ResourceName)
+
+	return err == nil && kp != nil && (kp.User != p.user || (kp.SavePath != "" && kp.SavePath != p.savePath))
+}
+
+// deploy achieves the aims of Deploy(). The only resource we need is a key
+// pair, and if WR_FAKE_CLOUD_AUTHORIZED_KEYS was set, we make our key work for
+// ssh.
+func (p *fakep) deploy(ctx context.Context, resources *Resources, requiredPorts []int,
+	useConfigDrive bool, gatewayIP, cidr string, dnsNameServers []string,
+) error {
+	name := resources.ResourceName
+
+	kp, err := p.getKeyPair(name)
+	if err != nil {
+		return err
+	}
+
+	if kp != nil {
+		resources.Details["keypair"] = name
+
+		return nil
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	kp = &fakeKeyPair{PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))), User: p.user,
+		SavePath: p.savePath}
+	if err = p.writeJSON(p.keyPairPath(name), kp); err != nil {
+		return err
+	}
+	p.createdKeyPair = true
+
+	if p.authorizedKeys != "" {
+		if err = p.authorizeKey(kp.PublicKey, name); err != nil {
+			return err
+		}
+		clog.Debug(ctx, "authorized fake cloud key", "path", p.authorizedKeys)
+	}
+
+	resources.PrivateKey = string(pem.EncodeToMemory(privateKeyPEM))
+	resources.Details["keypair"] = name
+
+	return nil
+}
+
+// authorizeKey appends the given public key to our authorized_keys file, with
+// a comment that lets us remove it later.
+func (p *fakep) authorizeKey(publicKey, name string) error {
+	p.akMutex.Lock()
+	defer p.akMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(p.authorizedKeys), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p.authorizedKeys, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s %s%s\n", publicKey, fakeKeyComment, name)
+	if err != nil {
+		f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
+
+// unauthorizeKey removes the key for the given resource name that
+// authorizeKey() added to our authorized_keys file.
+func (p *fakep) unauthorizeKey(name string) error {
+	p.akMutex.Lock()
+	defer p.akMutex.Unlock()
+
+	f, err := os.Open(p.authorizedKeys)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	var kept []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasSuffix(line, " "+fakeKeyComment+name) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	f.Close()
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	content := strings.Join(kept, "\n")
+	if len(kept) > 0 {
+		content += "\n"
+	}
+
+	return os.WriteFile(p.authorizedKeys, []byte(content), 0o600)
+}
+
+// inCloud always returns true, since every server is this machine, and so we
+// are always on the same network as them.
+func (p *fakep) inCloud(ctx context.Context) bool {
+	return true
+}
+
+// getCurrentServers returns details of other servers with the given resource
+// name prefix.
+func (p *fakep) getCurrentServers(resources *Resources) ([][]string, error) {
+	servers, err := p.getServers()
+	if err != nil {
+		return nil, err
+	}
+
+	onHeadNode := p.onHeadNode(resources)
+
+	var sdetails [][]string
+	for _, server := range servers {
+		if !strings.HasPrefix(server.Name, resources.ResourceName) || (onHeadNode && server.External) {
+			continue
+		}
+
+		sdetails = append(sdetails, []string{server.ID, server.IP, server.Name, ""})
+	}
+
+	return sdetails, nil
+}
+
+// flavors returns all our flavors.
+func (p *fakep) flavors(ctx context.Context) map[string]*Flavor {
+	fmap := make(map[string]*Flavor)
+	for key, val := range p.fmap {
+		fmap[key] = val
+	}
+
+	return fmap
+}
+
+// getQuota achieves the aims of GetQuota().
+func (p *fakep) getQuota(ctx context.Context) (*Quota, error) {
+	servers, err := p.getServers()
+	if err != nil {
+		return nil, err
+	}
+
+	quota := *p.quota
+	for _, server := range servers {
+		quota.UsedInstances++
+		if f, found := p.fmap[server.Flavor]; found {
+			quota.UsedCores += f.Cores
+			quota.UsedRAM += f.RAM
+			if server.Disk > f.Disk {
+				quota.UsedVolume += server.Disk
+			}
+		}
+	}
+
+	return &quota, nil
+}
+
+// checkQuota returns an error if a server of the given flavor and disk size
+// would exceed our quota.
+func (p *fakep) checkQuota(ctx context.Context, f *Flavor, diskGB int) error {
+	quota, err := p.getQuota(ctx)
+	if err != nil {
+		return err
+	}
+
+	var volume int
+	if diskGB > f.Disk {
+		volume = diskGB
+	}
+
+	switch {
+	case quota.MaxInstances > 0 && quota.UsedInstances+1 > quota.MaxInstances:
+		return errors.New("quota exceeded: instances")
+	case quota.MaxCores > 0 && quota.UsedCores+f.Cores > quota.MaxCores:
+		return errors.New("quota exceeded: cores")
+	case quota.MaxRAM > 0 && quota.UsedRAM+f.RAM > quota.MaxRAM:
+		return errors.New("quota exceeded: ram")
+	case quota.MaxVolume > 0 && quota.UsedVolume+volume > quota.MaxVolume:
+		return errors.New("quota exceeded: volume")
+	}
+
+	return nil
+}
+
+// spawn achieves the aims of Spawn(). The OS is ignored, since every server is
+// this machine.
+func (p *fakep) spawn(ctx context.Context, resources *Resources, osPrefix string, flavorID string, diskGB int,
+	externalIP bool, usingQuotaCh chan bool,
+) (serverID, serverIP, serverName, adminPass string, err error) {
+	f, found := p.fmap[flavorID]
+	if !found {
+		usingQuotaCh <- false
+
+		return serverID, serverIP, serverName, adminPass, Error{"fake", "spawn", ErrBadFlavor}
+	}
+
+	if p.fail("spawn") {
+		usingQuotaCh <- false
+
+		return serverID, serverIP, serverName, adminPass, errors.New("fake server creation failed")
+	}
+
+	if p.fail("nohardware") {
+		usingQuotaCh <- false
+
+		return serverID, serverIP, serverName, adminPass, errors.New(fakeNoHardwareMsg)
+	}
+
+	// we hold our lock while checking quota and storing the new server, so
+	// that simultaneous spawns can't exceed it
+	p.Lock()
+	if err = p.checkQuota(ctx, f, diskGB); err != nil {
+		p.Unlock()
+		usingQuotaCh <- false
+
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		p.Unlock()
+		usingQuotaCh <- false
+
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	server := &fakeServer{
+		ID:       u.String(),
+		Name:     uniqueResourceName(resources.ResourceName),
+		IP:       p.ip,
+		Flavor:   flavorID,
+		Disk:     diskGB,
+		External: externalIP,
+		State:    fakeStateBuild,
+	}
+	err = p.writeJSON(p.serverPath(server.ID), server)
+	p.Unlock()
+	usingQuotaCh <- err == nil
+	if err != nil {
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	clog.Debug(ctx, "spawned fake server", "id", server.ID, "flavor", flavorID)
+
+	select {
+	case <-time.After(p.spawnTime):
+	case <-ctx.Done():
+		p.destroyServerAndLog(ctx, server.ID)
+
+		return serverID, serverIP, serverName, adminPass, ctx.Err()
+	}
+
+	if p.fail("build") {
+		p.destroyServerAndLog(ctx, server.ID)
+
+		return serverID, serverIP, serverName, adminPass, errors.New("fake server failed to build")
+	}
+
+	server.State = fakeStateActive
+	server.Dead = p.fail("dead")
+	if err = p.writeJSON(p.serverPath(server.ID), server); err != nil {
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	p.keepSentinel(ctx)
+
+	return server.ID, server.IP, server.Name, adminPass, nil
+}
+
+// destroyServerAndLog destroys the given server, logging any error.
+func (p *fakep) destroyServerAndLog(ctx context.Context, serverID string) {
+	if err := os.Remove(p.serverPath(serverID)); err != nil {
+		clog.Warn(ctx, "failed to destroy fake server", "id", serverID, "err", err)
+	}
+}
+
+// keepSentinel makes sure that sentinelFilePath exists for the next
+// fakeSentinelKeepTime.
+func (p *fakep) keepSentinel(ctx context.Context) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.sentinelUntil = time.Now().Add(fakeSentinelKeepTime)
+	createFakeSentinel(ctx)
+
+	if p.keepingSentinel {
+		return
+	}
+	p.keepingSentinel = true
+
+	go func() {
+		defer internal.LogPanic(ctx, "fake cloud keepSentinel", false)
+
+		ticker := time.NewTicker(fakeSentinelCheckFrequency)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			p.Lock()
+			if time.Now().After(p.sentinelUntil) {
+				p.keepingSentinel = false
+				p.Unlock()
+
+				return
+			}
+			p.Unlock()
+
+			createFakeSentinel(ctx)
+		}
+	}()
+}
+
+// createFakeSentinel creates sentinelFilePath if it doesn't already exist.
+func createFakeSentinel(ctx context.Context) {
+	f, err := os.OpenFile(sentinelFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fakeFilePerms)
+	if err != nil {
+		if !os.IsExist(err) {
+			clog.Warn(ctx, "failed to create sentinel file", "path", sentinelFilePath, "err", err)
+		}
+
+		return
+	}
+
+	internal.LogClose(ctx, f, "sentinel file", "path", sentinelFilePath)
+}
+
+// errIsNoHardware returns true if the error is one of our injected lack of
+// hardware errors.
+func (p *fakep) errIsNoHardware(err error) bool {
+	return strings.Contains(err.Error(), fakeNoHardwareMsg)
+}
+
+// checkServer achieves the aims of CheckServer().
+func (p *fakep) checkServer(serverID string) (bool, error) {
+	server, err := p.getServer(serverID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return server.State == fakeStateActive && !server.Dead, nil
+}
+
+// serverIsKnown achieves the aims of ServerIsKnown().
+func (p *fakep) serverIsKnown(serverID string) (bool, error) {
+	_, err := p.getServer(serverID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// destroyServer achieves the aims of DestroyServer().
+func (p *fakep) destroyServer(ctx context.Context, serverID string) error {
+	if p.fail("destroy") {
+		return errors.New("fake server destruction failed")
+	}
+
+	err := os.Remove(p.serverPath(serverID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// sshPort returns the port configured with WR_FAKE_CLOUD_SSH_PORT.
+func (p *fakep) sshPort() int {
+	return p.port
+}
+
+// serversAreLocal returns true, since every server is this machine.
+func (p *fakep) serversAreLocal() bool {
+	return true
+}
+
+// tearDown achieves the aims of TearDown()
+func (p *fakep) tearDown(ctx context.Context, resources *Resources) error {
+	var merr *multierror.Error
+
+	servers, err := p.getServers()
+	if err != nil {
+		return err
+	}
+
+	onHeadNode := p.onHeadNode(resources)
+
+	var didSomething bool
+	for _, server := range servers {
+		if !strings.HasPrefix(server.Name, resources.ResourceName) || (onHeadNode && server.External) {
+			continue
+		}
+
+		didSomething = true
+		if errd := p.destroyServer(ctx, server.ID); errd != nil {
+			merr = multierror.Append(merr, errd)
+		}
+	}
+
+	if name := resources.Details["keypair"]; name != "" && (p.createdKeyPair || !onHeadNode) {
+		err = os.Remove(p.keyPairPath(name))
+		if err != nil && !os.IsNotExist(err) {
+			merr = multierror.Append(merr, err)
+		}
+
+		if p.authorizedKeys != "" {
+			if erru := p.unauthorizeKey(name); erru != nil {
+				merr = multierror.Append(merr, erru)
+			}
+		}
+
+		delete(resources.Details, "keypair")
+		resources.PrivateKey = ""
+		didSomething = true
+	}
+
+	if remaining, errg := p.getServers(); errg == nil && len(remaining) == 0 {
+		err = os.Remove(sentinelFilePath)
+		if err != nil && !os.IsNotExist(err) {
+			clog.Warn(ctx, "failed to remove sentinel file", "path", sentinelFilePath, "err", err)
+		}
+	}
+
+	err = merr.ErrorOrNil()
+	if err == nil && !didSomething {
+		return Error{"fake", "tearDown", ErrNoTearDown}
+	}
+
+	return err
+}
@@ -1168,6 +1168,16 @@ WAIT:
 	return err
 }
 
+// sshPort returns the standard ssh port, which our servers always use.
+func (p *openstackp) sshPort() int {
+	return defaultSSHPort
+}
+
+// serversAreLocal returns false, since our servers are real.
+func (p *openstackp) serversAreLocal() bool {
+	return false
+}
+
 // tearDown achieves the aims of TearDown()
 func (p *openstackp) tearDown(ctx context.Context, resources *Resources) error {
 	// throughout we'll ignore errors because we want to try and delete
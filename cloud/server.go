@@ -28,9 +28,11 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -47,6 +49,7 @@ const (
 	sharePath       = "/shared" // mount point for the *SharedDisk methods
 	sshShortTimeOut = 15 * time.Second
 	localhostName   = "localhost"
+	defaultSSHPort  = 22
 )
 
 // maxSSHSessions is the maximum number of sessions we will try and multiplex on
@@ -64,18 +67,19 @@ const maxSSHSessions = 10
 // Flavor describes a "flavor" of server, which is a certain (virtual) hardware
 // configuration
 type Flavor struct {
-	ID    string
-	Name  string
-	Cores int
-	RAM   int // MB
-	Disk  int // GB
+	ID        string
+	Name      string
+	Cores     int
+	RAM       int            // MB
+	Disk      int            // GB
+	Resources map[string]int // named consumable resources, see Provider.SetFlavorResources()
 }
 
-// HasSpaceFor takes the cpu, ram and disk requirements of a command and tells
-// you how many of those commands could run simultaneously on a server of our
-// flavor. Returns 0 if not even 1 command could fit on a server with this
-// flavor.
-func (f *Flavor) HasSpaceFor(cores float64, ramMB, diskGB int) int {
+// HasSpaceFor takes the cpu, ram, disk and named consumable resource
+// requirements of a command and tells you how many of those commands could run
+// simultaneously on a server of our flavor. Returns 0 if not even 1 command
+// could fit on a server with this flavor.
+func (f *Flavor) HasSpaceFor(cores float64, ramMB, diskGB int, resources map[string]int) int {
 	if mth.FloatLessThan(float64(f.Cores), cores) || (f.RAM < ramMB) || (f.Disk < diskGB) {
 		return 0
 	}
@@ -105,9 +109,23 @@ func (f *Flavor) HasSpaceFor(cores float64, ramMB, diskGB int) int {
 			}
 		}
 	}
+	if n := internal.ResourcesCanFit(f.Resources, nil, resources); n >= 0 && n < canDo {
+		canDo = n
+	}
 	return canDo
 }
 
+// hasSpareResources tells you if this flavor has any named consumable
+// resources that are not amongst the given ones.
+func (f *Flavor) hasSpareResources(resources map[string]int) bool {
+	for name, count := range f.Resources {
+		if count > 0 && resources[name] == 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // Server provides details of the server that Spawn() created for you, and some
 // methods that let you keep track of how you use that server.
 type Server struct {
@@ -139,11 +157,13 @@ type Server struct {
 	usedZeroCores     int // we keep track of how many zero core things are allocated
 	usedDisk          int
 	usedRAM           int
+	usedResources     map[string]int
 	mutex             sync.RWMutex
 	hmutex            sync.Mutex
 	csmutex           sync.Mutex
 	IsHeadNode        bool
 	SharedDisk        bool // the server will mount /shared
+	Unowned           bool // the server isn't ours to shut down or destroy, eg. a host in a static pool
 	created           bool // to distinguish instances we discovered or spawned
 	toBeDestroyed     bool
 	destroyed         bool
@@ -324,14 +344,15 @@ func (s *Server) Matches(os string, script []byte, configFiles string, flavor *F
 
 // Allocate considers the current usage (according to prior calls)
 // and records the given resources have now been used up on this server, if
-// there was enough space. Returns true if there was enough space and the
-// allocation occurred.
-func (s *Server) Allocate(ctx context.Context, cores float64, ramMB, diskGB int) bool {
+// there was enough space. resources are the named consumable resources (nil
+// for none) that must be amongst the Resources of the server's Flavor. Returns
+// true if there was enough space and the allocation occurred.
+func (s *Server) Allocate(ctx context.Context, cores float64, ramMB, diskGB int, resources map[string]int) bool {
 	ctx = s.getContextWithServerID(ctx)
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if s.checkSpace(cores, ramMB, diskGB) == 0 {
+	if s.checkSpace(cores, ramMB, diskGB, resources) == 0 {
 		return false
 	}
 
@@ -344,9 +365,16 @@ func (s *Server) Allocate(ctx context.Context, cores float64, ramMB, diskGB int)
 	}
 	s.usedRAM += ramMB
 	s.usedDisk += diskGB
+	for name, count := range resources {
+		if s.usedResources == nil {
+			s.usedResources = make(map[string]int)
+		}
+		s.usedResources[name] += count
+	}
 
-	clog.Debug(ctx, "server allocate", "cores", cores, "RAM", ramMB, "disk", diskGB, "usedCores",
-		s.usedCores, "usedZeroCores", s.usedZeroCores, "usedRAM", s.usedRAM, "usedDisk", s.usedDisk)
+	clog.Debug(ctx, "server allocate", "cores", cores, "RAM", ramMB, "disk", diskGB, "resources", resources,
+		"usedCores", s.usedCores, "usedZeroCores", s.usedZeroCores, "usedRAM", s.usedRAM, "usedDisk", s.usedDisk,
+		"usedResources", s.usedResources)
 
 	// if the host has initiated its countdown to destruction, cancel that
 	if s.onDeathrow {
@@ -376,8 +404,9 @@ func (s *Server) Used() bool {
 	return s.used
 }
 
-// Release records that the given resources have now been freed.
-func (s *Server) Release(ctx context.Context, cores float64, ramMB, diskGB int) {
+// Release records that the given resources (as previously supplied to
+// Allocate()) have now been freed.
+func (s *Server) Release(ctx context.Context, cores float64, ramMB, diskGB int, resources map[string]int) {
 	ctx = s.getContextWithServerID(ctx)
 
 	s.mutex.Lock()
@@ -389,8 +418,15 @@ func (s *Server) Release(ctx context.Context, cores float64, ramMB, diskGB int)
 	}
 	s.usedRAM -= ramMB
 	s.usedDisk -= diskGB
-	clog.Debug(ctx, "server release", "cores", cores, "RAM", ramMB, "disk", diskGB, "usedCores", s.usedCores,
-		"usedZeroCores", s.usedZeroCores, "usedRAM", s.usedRAM, "usedDisk", s.usedDisk)
+	for name, count := range resources {
+		if s.usedResources == nil {
+			s.usedResources = make(map[string]int)
+		}
+		s.usedResources[name] -= count
+	}
+	clog.Debug(ctx, "server release", "cores", cores, "RAM", ramMB, "disk", diskGB, "resources", resources,
+		"usedCores", s.usedCores, "usedZeroCores", s.usedZeroCores, "usedRAM", s.usedRAM, "usedDisk", s.usedDisk,
+		"usedResources", s.usedResources)
 
 	// if the server is now doing nothing, we'll initiate a countdown to
 	// destroying the host
@@ -456,14 +492,14 @@ func (s *Server) Release(ctx context.Context, cores float64, ramMB, diskGB int)
 // HasSpaceFor considers the current usage (according to prior Allocation calls)
 // and tells you how many of a cmd needing the given resources can run on this
 // server.
-func (s *Server) HasSpaceFor(cores float64, ramMB, diskGB int) int {
+func (s *Server) HasSpaceFor(cores float64, ramMB, diskGB int, resources map[string]int) int {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	return s.checkSpace(cores, ramMB, diskGB)
+	return s.checkSpace(cores, ramMB, diskGB, resources)
 }
 
 // checkSpace does the work of HasSpaceFor. You must hold a read lock on mutex!
-func (s *Server) checkSpace(cores float64, ramMB, diskGB int) int {
+func (s *Server) checkSpace(cores float64, ramMB, diskGB int, resources map[string]int) int {
 	if s.destroyed {
 		return 0
 	}
@@ -503,6 +539,9 @@ func (s *Server) checkSpace(cores float64, ramMB, diskGB int) int {
 			}
 		}
 	}
+	if n := internal.ResourcesCanFit(s.Flavor.Resources, s.usedResources, resources); n >= 0 && n < canDo {
+		canDo = n
+	}
 	return canDo
 }
 
@@ -540,10 +579,11 @@ func (s *Server) createSSHClientConfig(ctx context.Context) error {
 }
 
 // SSHClient returns an ssh.Client object that could be used to ssh to the
-// server. Requires that port 22 is accessible for SSH. The client returned will
-// be one that hasn't failed to create a session yet; a new client will be
-// created if necessary. You get back the client's index, so that if this client
-// fails to create a session you can mark this client as bad.
+// server. Requires that port 22 (or the provider's ssh port) is accessible for
+// SSH. The client returned will be one that hasn't failed to create a session
+// yet; a new client will be created if necessary. You get back the client's
+// index, so that if this client fails to create a session you can mark this
+// client as bad.
 func (s *Server) SSHClient(ctx context.Context) (*ssh.Client, int, error) {
 	ctx = s.getContextWithServerID(ctx)
 	s.mutex.Lock()
@@ -576,7 +616,7 @@ func (s *Server) SSHClient(ctx context.Context) (*ssh.Client, int, error) {
 	// dial in to the server, allowing certain errors that indicate that the
 	// network or server isn't really ready for ssh yet; wait for up to
 	// 5mins for success, if we had only just created this server
-	hostAndPort := s.IP + ":22"
+	hostAndPort := net.JoinHostPort(s.IP, strconv.Itoa(s.sshPort()))
 	client, err := sshDial(ctx, hostAndPort, s.sshClientConfig)
 	if err != nil {
 		// if we're trying to destroy this server, just give up straight away
@@ -665,6 +705,20 @@ func sshDial(ctx context.Context, addr string, sshConfig *ssh.ClientConfig) (*ss
 	}
 }
 
+// sshPort returns the port that ssh listens on for this server.
+func (s *Server) sshPort() int {
+	if s.provider == nil {
+		return defaultSSHPort
+	}
+
+	return s.provider.impl.sshPort()
+}
+
+// isLocal returns true if this server is really the machine we're running on.
+func (s *Server) isLocal() bool {
+	return s.provider != nil && s.provider.impl.serversAreLocal()
+}
+
 // SSHSession returns an ssh.Session object that could be used to do things via
 // ssh on the server. Will time out and return an error if the session can't be
 // created within 5s. Also returns the index of the client this session came
@@ -1267,7 +1321,7 @@ func (s *Server) PermanentProblem() string {
 }
 
 // Destroy destroys the server, first trying to run any script that was set with
-// SetDestroyScript().
+// SetDestroyScript(). For Unowned servers, we only stop using them.
 func (s *Server) Destroy(ctx context.Context) error {
 	ctx = s.getContextWithServerID(ctx)
 	s.mutex.Lock()
@@ -1289,7 +1343,7 @@ func (s *Server) Destroy(ctx context.Context) error {
 	s.toBeDestroyed = false
 	s.destroyed = true
 
-	if s.sshStarted {
+	if s.sshStarted && !s.Unowned {
 		destroyScript := s.DestroyScript
 		s.mutex.Unlock()
 
@@ -1310,13 +1364,16 @@ func (s *Server) Destroy(ctx context.Context) error {
 				}
 			}
 
-			t = time.Now()
-			stdo, stde, err := s.RunCmd(context.Background(), cleanShutDownCmd, false)
-			rt := time.Since(t)
-			if err != nil {
-				clog.Warn(ctx, "clean shutdown failed", "took", rt, "err", err, "stdout", stdo, "stderr", stde)
-			} else if rt > 10*time.Second {
-				clog.Warn(ctx, "clean shutdown took a long time", "took", rt, "stdout", stdo)
+			// (we must never remount our own filesystems read-only)
+			if !s.isLocal() {
+				t = time.Now()
+				stdo, stde, err := s.RunCmd(context.Background(), cleanShutDownCmd, false)
+				rt := time.Since(t)
+				if err != nil {
+					clog.Warn(ctx, "clean shutdown failed", "took", rt, "err", err, "stdout", stdo, "stderr", stde)
+				} else if rt > 10*time.Second {
+					clog.Warn(ctx, "clean shutdown took a long time", "took", rt, "stdout", stdo)
+				}
 			}
 
 			s.CloseSSHSession(ctx, session, clientIndex)
@@ -1334,6 +1391,10 @@ func (s *Server) Destroy(ctx context.Context) error {
 		s.goneBad = time.Now()
 	}
 
+	if s.Unowned {
+		return nil
+	}
+
 	// for testing purposes, we anticipate that provider isn't set
 	if s.provider == nil {
 		return fmt.Errorf("provider not set")
@@ -31,6 +31,7 @@ import (
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/VertebrateResequencing/wr/jobqueue"
+	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
 	"github.com/jpillora/backoff"
 	"github.com/spf13/cobra"
 )
@@ -66,6 +67,7 @@ var (
 	cmdDepGroups          string
 	cmdCmdDeps            string
 	cmdGroupDeps          string
+	cmdOnDepFail          string
 	cmdOnFailure          string
 	cmdOnSuccess          string
 	cmdOnExit             string
@@ -87,6 +89,11 @@ var (
 	cmdWithSingularity    string
 	cmdContainerMounts    string
 	cmdNoRetry            string
+	cmdRetryPolicy        string
+	cmdCheckpoint         string
+	cmdResources          string
+	cmdArrayTable         string
+	cmdArrayRanges        []string
 	rtimeoutint           int
 	simpleOutput          bool
 	syncMode              bool
@@ -119,10 +126,11 @@ alternatively have only a JSON object in column 1 that also specifies the
 command as one of the name:value pairs. The possible options are:
 
 cmd cwd cwd_matters change_home on_failure on_success on_exit mounts req_grp
-memory time override cpus disk queue misc priority retries rep_grp dep_grps deps
-cmd_deps monitor_docker with_docker with_singularity container_mounts cloud_os
-cloud_username cloud_ram cloud_script cloud_config_files cloud_flavor
-cloud_shared env bsub_mode
+memory time override cpus disk resources queue misc priority retries
+retry_policy checkpoint rep_grp dep_grps deps cmd_deps on_dep_fail monitor_docker with_docker
+with_singularity container_mounts cloud_os cloud_username cloud_ram
+cloud_script cloud_config_files cloud_flavor cloud_shared env bsub_mode
+array_table array_ranges
 
 If any of these will be the same for all your commands, you can instead specify
 them as flags (which are treated as defaults in the case that they are
@@ -171,7 +179,10 @@ cwd_matters is false (no effect when cwd_matters is true); "cleanup", which is
 like cleanup_all except that it doesn't delete files that have been specified as
 inputs or outputs [since you can't currently specify this, the current behaviour
 is identical to cleanup_all]; "run", which takes a string command to run after
-the main cmd runs; and "remove", which takes a boolean value and if true that
+the main cmd runs; "copy_to_manager", which takes an array of paths to small
+files (relative to the actual working directory) that will be copied to the
+manager before any other behaviours trigger, and can later be retrieved using
+'wr status --copied'; and "remove", which takes a boolean value and if true that
 means that if the cmd gets buried, it will then immediately be removed from the
 queue (useful for Cromwell compatibility).
 For example [{"run":"cp error.log /shared/logs/this.log"},{"cleanup":true}]
@@ -242,6 +253,13 @@ create temporary volumes of the specified size if necessary. Note that disk
 space usage checking and learning only occurs for jobs where cwd doesn't matter
 (is a unique directory), and ignores the contents of mounted directories.
 
+"resources" tells wr manager how many of each named consumable resource your
+command needs, in the form name=count,name=count, eg. gpu=1,matlab_licence=1.
+These are resources that hosts only have a certain number of, as defined when
+the manager was started (see the --resources and --cloud_flavor_resources
+options of 'wr manager start'). Commands will only be run on hosts with enough
+of them free, and commands needing resources no host has will never run.
+
 "queue" tells wr which queue a job should be submitted to, when using a job
 scheduler that has queues (eg. LSF). If queue is not specified, wr will use
 heuristics to pick the most appropriate queue based on the time, memory and cpu
@@ -281,6 +299,40 @@ issue, and would likely succeed if retried, but are always expected to fail if
 they get past initialization and then fail. The default value of 0 time disables
 this feature and jobs will always retry according to "retries".
 
+"retry_policy" lets you change how a command is retried, as semi-colon separated
+settings (all of them optional), eg.
+"backoff=5m;max=2h;factor=3;jitter=0.5;no_retry=2,127;different_host":
+  backoff: the delay before the first retry, instead of 30s.
+  max: the maximum delay, instead of 30mins.
+  factor: what the delay is multiplied by after each attempt, instead of 2.
+  jitter: the fraction (0 to 1) by which the delay is randomly increased or
+    decreased, so that commands that failed together don't all retry together.
+  no_retry: comma separated exit codes that indicate a permanent failure;
+    commands that exit with one of these will be buried immediately, regardless
+    of the "retries" value.
+  different_host: retry the command on a different host to the one(s) it
+    failed on (only for the lsf, slurm, sge and sshpool schedulers, which can
+    choose hosts).
+
+"checkpoint" lets long-running commands resume from where they left off if
+they have to stop before completing, as semi-colon separated settings, eg.
+"dir=ckpt;signal=USR1;grace=5m":
+  dir: the directory, relative to the command's working directory, that the
+    command saves its state in. Required.
+  signal: the signal (one of TERM, INT, QUIT, HUP, USR1 or USR2) that tells
+    your command to save its state in dir and exit. Defaults to TERM.
+  grace: how long your command has after being sent signal to exit, before it
+    is killed. Defaults to 1m.
+When the runner executing your command is signalled (eg. because its host is
+being shut down, or the job scheduler says it has run out of time), or when it
+runs out of time while running in a cgroup (see "runnercgroup" in "wr conf"),
+your command is sent the signal, and once it exits, dir is saved. Before the
+next attempt at running your command, dir is restored in to its new working
+directory. Your command should check for saved state there when it starts.
+If dir is within a writable mount (see "mounts", above), the mount takes care of
+saving and restoring it. Otherwise it is stored by the manager, so should not
+be very large.
+
 "rep_grp" is an arbitrary group you can give your commands so you can query
 their status later. This is only used for reporting and presentation purposes
 when viewing status.
@@ -331,6 +383,25 @@ name:value pairs (if cwd doesn't matter for a cmd, provide it as an empty
 string). These are static dependencies; once resolved they do not get re-
 evaluated.
 
+By default a dependency is only satisfied when the commands it refers to
+complete successfully. You can change this by suffixing a dep_grp in "deps" with
+":failure", so that the dependency is satisfied when those commands get buried
+instead (useful for clean-up or alerting commands), or with ":any", so that it
+is satisfied when they either complete or get buried. For "cmd_deps", supply
+the same as a "mode" name:value pair in each JSON object (eg. "mode":"failure").
+With the --deps and --cmd_deps flags, suffix a dep_grp or cwd respectively (eg.
+--deps "dg1:failure,dg2" or --cmd_deps "cmd1,cwd1:any"). For this reason,
+dep_grps can't contain ":".
+
+"on_dep_fail" determines what happens to this command when one of its
+dependencies can never be satisfied, eg. if a command it needs to complete
+successfully gets buried, or a command it needs to get buried completes
+successfully. By default (if unset), the command will stay waiting in the
+dependent state, so that it will still run if you fix and retry the command it
+depends on. Set it to "bury" to have the command get buried instead (which in
+turn affects commands that depend on it), or to "delete" to delete it along with
+all the commands that depend upon it.
+
 "monitor_docker" turns on monitoring of a docker container identified by the
 given string, which could be the container's --name or path to its --cidfile. If
 the string contains ? or * symbols and doesn't match a name or file name
@@ -419,7 +490,27 @@ machine was started.
 "bsub_mode" is a boolean that results in the job being assigned a unique (for
 this manager session) job id, and turns on bsub emulation, which means that if
 your Cmd calls bsub, it will instead result in a command being added to wr. The
-new job will have this job's mount and cloud_* options.`,
+new job will have this job's mount and cloud_* options.
+
+"array_table" and "array_ranges" turn the command in to a template for a job
+array, letting you add many similar commands without having to write them all
+out. The template contains {name} placeholders, and the manager adds a command
+for every combination of parameter values, with the placeholders replaced by
+those values. "array_table" is an array of arrays of strings, where the first
+gives the parameter names and the rest give the values. "array_ranges" is an
+array of integer parameters in the form "name=start-end" or
+"name=start-end:step". Every row of the table is combined with every value of
+each range. For example, with --array_table pointing to a tab separated file
+with a header line "sample" followed by 1000 sample names, and with
+--array_range chunk=1-100, the single command 'process {sample} {chunk}' would
+result in 100,000 commands being added. Arrays can have up to 1,000,000
+commands; only the first 1000 are added to the queue straight away, with the
+rest being added as earlier ones complete or are removed (removing all of an
+array's commands that are in the queue cancels the rest). The flags can only be
+used when adding a single command. When they run, the commands will have the environment
+variables $WR_ARRAY_ID (the id shared by all the commands in the array, which
+you can use with "wr status -a") and $WR_ARRAY_INDEX (the 0-based index of the
+command in the array) set.`,
 	Run: func(combraCmd *cobra.Command, args []string) {
 		// check the command line options
 		if cmdFile == "" {
@@ -446,6 +537,14 @@ new job will have this job's mount and cloud_* options.`,
 			die("You must add exactly 1 command when using synchronous mode.")
 		}
 
+		if (cmdArrayTable != "" || len(cmdArrayRanges) > 0) && len(jobs) != 1 {
+			die("You must add exactly 1 command when using --array_table or --array_range.")
+		}
+
+		if syncMode && jobs[0].Array != nil {
+			die("You can't use synchronous mode with a job array.")
+		}
+
 		var envVars []string
 		if isLocal {
 			envVars = os.Environ()
@@ -480,6 +579,12 @@ new job will have this job's mount and cloud_* options.`,
 			} else {
 				info("Added %d new commands (%d were duplicates) to the queue", inserts, dups)
 			}
+
+			for _, job := range jobs {
+				if job.Array != nil {
+					info("Job array %s has %d commands", job.ArrayKey(), job.Array.Size())
+				}
+			}
 		}
 	},
 }
@@ -500,12 +605,16 @@ func init() {
 	addCmd.Flags().StringVarP(&cmdTime, "time", "t", "1h", "max time est. [specify units such as m for minutes or h for hours]")
 	addCmd.Flags().Float64Var(&cmdCPUs, "cpus", 1, "cpu cores needed")
 	addCmd.Flags().IntVar(&cmdDisk, "disk", 0, "number of GB of disk space required (default 0)")
+	addCmd.Flags().StringVar(&cmdResources, "resources", "", "named consumable resources required, eg. \"gpu=1,matlab_licence=1\"")
 	addCmd.Flags().IntVarP(&cmdOvr, "override", "o", 0, "[0|1|2] should your mem/time estimates override? (default 0)")
 	addCmd.Flags().IntVarP(&cmdPri, "priority", "p", 0, "[0-255] command priority (default 0)")
 	addCmd.Flags().IntVarP(&cmdRet, "retries", "r", 3, "[0-255] number of automatic retries for failed commands")
 	addCmd.Flags().StringVarP(&cmdNoRetry, "no_retry_over_walltime", "n", "", "do not retry if cmd runs longer than this [specify units such as m for minutes or h for hours]")
-	addCmd.Flags().StringVar(&cmdCmdDeps, "cmd_deps", "", "dependencies of your commands, in the form \"command1,cwd1,command2,cwd2...\"")
-	addCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2...\"")
+	addCmd.Flags().StringVar(&cmdRetryPolicy, "retry_policy", "", "how to retry failed cmds, eg. \"backoff=5m;max=2h;no_retry=2;different_host\"")
+	addCmd.Flags().StringVar(&cmdCheckpoint, "checkpoint", "", "how cmds save state to resume from, eg. \"dir=ckpt;signal=USR1;grace=5m\"")
+	addCmd.Flags().StringVar(&cmdCmdDeps, "cmd_deps", "", "dependencies of your commands, in the form \"command1,cwd1,command2,cwd2[:failure|:any]...\"")
+	addCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2[:failure|:any]...\"")
+	addCmd.Flags().StringVar(&cmdOnDepFail, "on_dep_fail", "", "[bury|delete] what to do with commands whose dependencies can never be satisfied")
 	addCmd.Flags().StringVar(&cmdMonitorDocker, "monitor_docker", "", "monitor resource usage of docker container with given --name or --cidfile path")
 	addCmd.Flags().StringVar(&cmdWithDocker, "with_docker", "", "run the cmd inside a docker container running this image")
 	addCmd.Flags().StringVar(&cmdWithSingularity, "with_singularity", "", "run the cmd inside a singularity container running this image")
@@ -529,6 +638,8 @@ func init() {
 	addCmd.Flags().StringVar(&cmdEnv, "env", "", "comma-separated list of key=value environment variables to set before running the commands")
 	addCmd.Flags().BoolVar(&cmdReRun, "rerun", false, "re-run any commands that you add that had been previously added and have since completed")
 	addCmd.Flags().BoolVar(&cmdBsubMode, "bsub", false, "enable bsub emulation mode")
+	addCmd.Flags().StringVar(&cmdArrayTable, "array_table", "", "tab separated file of parameters (with a header line of names) to make a job array from a single templated command")
+	addCmd.Flags().StringArrayVar(&cmdArrayRanges, "array_range", nil, "name=start-end[:step] integer parameter to make a job array from a single templated command (can be repeated)")
 
 	addCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 	addCmd.Flags().IntVar(&rtimeoutint, "reserve_timeout", 1, "how long (seconds) to wait before a runner exits when there is no more work'")
@@ -541,18 +652,20 @@ func init() {
 	}
 }
 
-// convert cmd,cwd columns in to Dependency.
+// convert cmd,cwd columns in to Dependency. cwd can be suffixed with :mode.
 func colsToDeps(cols []string) (deps jobqueue.Dependencies) {
 	for i := 0; i < len(cols); i += 2 {
-		deps = append(deps, jobqueue.NewEssenceDependency(cols[i], cols[i+1]))
+		cwd, mode := jobqueue.SplitDependencyMode(cols[i+1])
+		deps = append(deps, jobqueue.NewConditionalDependency(jobqueue.NewEssenceDependency(cols[i], cwd), mode))
 	}
 	return
 }
 
-// convert group1,group2,... in to a Dependency.
+// convert group1,group2:mode,... in to a Dependency.
 func groupsToDeps(groups string) (deps jobqueue.Dependencies) {
 	for _, depgroup := range strings.Split(groups, ",") {
-		deps = append(deps, jobqueue.NewDepGroupDependency(depgroup))
+		group, mode := jobqueue.SplitDependencyMode(depgroup)
+		deps = append(deps, jobqueue.NewConditionalDependency(jobqueue.NewDepGroupDependency(group), mode))
 	}
 	return
 }
@@ -650,6 +763,21 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 		}
 	}
 
+	jd.RetryPolicy, err = jobqueue.ParseRetryPolicy(cmdRetryPolicy)
+	if err != nil {
+		die("--retry_policy was not specified correctly: %s", err)
+	}
+
+	jd.Checkpoint, err = jobqueue.ParseCheckpoint(cmdCheckpoint)
+	if err != nil {
+		die("--checkpoint was not specified correctly: %s", err)
+	}
+
+	jd.Resources, err = jqs.ParseResources(cmdResources)
+	if err != nil {
+		die("--resources was not specified correctly: %s", err)
+	}
+
 	if cmdLimitGroups != "" {
 		jd.LimitGroups = strings.Split(cmdLimitGroups, ",")
 	}
@@ -668,6 +796,12 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 	if cmdGroupDeps != "" {
 		jd.Deps = append(jd.Deps, groupsToDeps(cmdGroupDeps)...)
 	}
+	if cmdOnDepFail != "" {
+		jd.OnDepFailure, err = jobqueue.ParseDepFailureAction(cmdOnDepFail)
+		if err != nil {
+			die("--on_dep_fail: %s", err)
+		}
+	}
 
 	if cmdOnFailure != "" {
 		var bjs jobqueue.BehavioursViaJSON
@@ -698,6 +832,10 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 		jd.MountConfigs = mountParse(mountJSON, mountSimple)
 	}
 
+	if cmdArrayTable != "" || len(cmdArrayRanges) > 0 {
+		jd.Array = arrayParse(cmdArrayTable, cmdArrayRanges)
+	}
+
 	// open file or set up to read from STDIN
 	var reader io.Reader
 	if cmdFile == "-" {
@@ -801,6 +939,35 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 	return jobs, isLocal, defaultedRepG
 }
 
+// arrayParse creates a JobArray from the given path to a parameter table file
+// and range specifications.
+func arrayParse(tablePath string, ranges []string) *jobqueue.JobArray {
+	array := &jobqueue.JobArray{}
+
+	if tablePath != "" {
+		f, err := os.Open(tablePath)
+		if err != nil {
+			die("could not open --array_table file: %s", err)
+		}
+		defer internal.LogClose(context.Background(), f, "array table file", "path", tablePath)
+
+		array, err = jobqueue.ParseArrayTable(f)
+		if err != nil {
+			die("bad --array_table: %s", err)
+		}
+	}
+
+	for _, spec := range ranges {
+		ar, err := jobqueue.ParseArrayRange(spec)
+		if err != nil {
+			die("bad --array_range: %s", err)
+		}
+		array.Ranges = append(array.Ranges, ar)
+	}
+
+	return array
+}
+
 // copyCloudConfigFiles copies local config files to the manager's machine to a
 // path based on the file's MD5, and then returns an altered input value to use
 // the MD5 paths as the sources, keeping the desired destinations. It does not
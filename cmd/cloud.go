@@ -23,6 +23,7 @@ import (
 	"context"
 	crand "crypto/rand"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -53,6 +54,11 @@ const wrConfigFileName = ".wr_config.yml"
 // when we start the manager on our created cloud server
 const wrEnvFileName = ".wr_envvars"
 
+// cloudLocalManagerDir is the directory, in the home directory, that holds the
+// config and manager files of a manager deployed to a server that is really
+// this machine (as with the fake provider), so that they don't clash with ours
+const cloudLocalManagerDir = ".wr_cloud_manager"
+
 // options for this cmd
 var (
 	providerName                string
@@ -65,6 +71,7 @@ var (
 	flavorRegex                 string
 	managerFlavor               string
 	flavorSets                  string
+	flavorResources             string
 	postCreationScript          string
 	preDestroyScript            string
 	postDeploymentScript        string
@@ -237,7 +244,41 @@ http:// urls, this is most likely to succeed if you use an IP address instead of
 a domain name. For https:// urls you'll need a domain name, and will have to
 ask your administrator for the appropriate --network_dns settings (or clouddns
 config option) to use; the DNS must be able to resolve the domain name from
-within OpenStack.`,
+within OpenStack.
+
+The aws provider needs these environment variables to be set:
+AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION.
+If you're using temporary credentials you will also need AWS_SESSION_TOKEN.
+To use a different EC2-compatible cloud, set AWS_ENDPOINT_URL_EC2 to the URL of
+its EC2 API. With aws, --os can be an AMI id (eg. ami-0abcdef1234567890), or a
+prefix of an image name, in which case the newest matching image owned by you
+or Amazon is used; to trust other image owners, set WR_AWS_IMAGE_OWNERS to a
+comma separated list of account ids or aliases (default "self,amazon"). A
+new VPC, subnet and internet gateway are created for your servers (unless you
+deploy from within EC2, in which case your own instance's subnet is used), and
+servers get an Elastic IP when they need to be reachable from outside.
+
+The fake provider is for testing wr itself: every server it spawns is really
+this machine, pretending to have the resources of its flavor. No environment
+variables are required, but these let you configure it:
+WR_FAKE_CLOUD_DIR: where the state of the fake cloud is stored (default
+  ~/.wr_fake_cloud, private to you; a directory you set here is made writable
+  by all users, so that they can share the fake cloud)
+WR_FAKE_CLOUD_IP: the IP address of every server (default 127.0.0.1)
+WR_FAKE_CLOUD_SSH_PORT: the port ssh listens on for every server (default 22)
+WR_FAKE_CLOUD_AUTHORIZED_KEYS: an authorized_keys file that the ssh key we
+  create will be added to, so that ssh to the servers works
+WR_FAKE_CLOUD_FLAVORS: the available flavors, eg. f1:1:2048:20,f2:2:4096:40
+  for flavors f1 and f2 with the given cores, MB of RAM and GB of disk
+WR_FAKE_CLOUD_QUOTA: limits such as instances=4,cores=8,ram=16384,volume=100
+WR_FAKE_CLOUD_SPAWN_TIME: how long spawning a server takes, eg. 5s
+WR_FAKE_CLOUD_FAILURES: make the next n operations of a kind fail, eg.
+  spawn=1,nohardware=2,build=1,destroy=1,dead=1 ("dead" servers spawn but then
+  stop working)
+Since the deployed wr manager runs on this machine, it keeps its config and
+files in ~/.wr_cloud_manager instead of your own ~/.wr_* directory (so you
+mustn't set managerdir in a config file), and --username can be you as long as
+WR_FAKE_CLOUD_AUTHORIZED_KEYS is set to your ~/.ssh/authorized_keys file.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
 		if providerName == "" {
@@ -501,15 +542,17 @@ and accessible.`,
 			headNodeKnown = headNode.Known(ctx)
 		}
 
-		// now check if the ssh forwarding is up
+		// now check if the ssh forwarding is up (there is none to a head node
+		// that is really this machine)
 		fmPidFile := filepath.Join(config.ManagerDir, "cloud_resources."+providerName+".fm.pid")
 		fmPid, fmRunning := checkProcess(fmPidFile)
+		managerReachable := fmRunning || (headNodeKnown && serverIsLocal(headNode.IP))
 
 		// try and stop the remote manager
 		noManagerMsg := "; deploy first or use --force option"
 		noManagerForcedMsg := "; tearing down anyway - you may lose changes if not backing up the database to S3!"
 		serverHadProblems := false
-		if fmRunning {
+		if managerReachable {
 			jq := connect(1*time.Second, true)
 			if jq != nil {
 				if !headNodeKnown {
@@ -582,7 +625,7 @@ and accessible.`,
 		// shutdown message doing things this way, but ok?...
 		if headNodeKnown && headNode.Alive(ctx) {
 			cloudLogFilePath := config.ManagerLogFile + "." + providerName
-			errf := headNode.DownloadFile(context.Background(), filepath.Join("./.wr_"+config.Deployment, "log"), cloudLogFilePath)
+			errf := headNode.DownloadFile(context.Background(), filepath.Join(remoteManagerDir(headNode.IP), "log"), cloudLogFilePath)
 
 			if errf != nil {
 				warn("could not download the remote log file: %s", errf)
@@ -778,7 +821,7 @@ func init() {
 
 	// flags specific to these sub-commands
 	defaultConfig := internal.DefaultConfig(ctx)
-	cloudDeployCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack'] cloud provider")
+	cloudDeployCmd.Flags().StringVarP(&providerName, "provider", "p", defaultConfig.CloudProvider, "['openstack','aws','fake'] cloud provider")
 	cloudDeployCmd.Flags().StringVar(&cloudResourceNameUniquer, "resource_name", realUsername(), fmt.Sprintf("name to be included when naming cloud resources (should be unique to you, max length %d)", maxCloudResourceUsernameLength))
 	cloudDeployCmd.Flags().StringVarP(&osPrefix, "os", "o", defaultConfig.CloudOS, "prefix of name, or ID, of the OS image your servers should use")
 	cloudDeployCmd.Flags().StringVarP(&osUsername, "username", "u", defaultConfig.CloudUser, "username needed to log in to the OS image specified by --os")
@@ -791,6 +834,7 @@ func init() {
 	}
 	cloudDeployCmd.Flags().StringVar(&managerFlavor, "manager_flavor", defaultConfig.CloudFlavorManager, "like --flavor, but specific to the first server created to run the manager"+defaultNote)
 	cloudDeployCmd.Flags().StringVar(&flavorSets, "flavor_sets", defaultConfig.CloudFlavorSets, "sets of flavors assigned to different hardware, in the form f1,f2;f3,f4")
+	cloudDeployCmd.Flags().StringVar(&flavorResources, "flavor_resources", defaultConfig.CloudFlavorResources, "named consumable resources of flavors, in the form regex:name=count,name=count;regex:name=count")
 	cloudDeployCmd.Flags().StringVarP(&postCreationScript, "script", "s", defaultConfig.CloudScript, "path to a start-up script that will be run on each server created")
 	cloudDeployCmd.Flags().StringVarP(&preDestroyScript, "destroy_script", "y", defaultConfig.CloudDestroyScript, "path to a script that will be run on each server before destruction")
 	cloudDeployCmd.Flags().IntVar(&cloudSpawns, "max_spawns", defaultConfig.CloudSpawns, "maximum number of simultaneous server spawns during scale-up")
@@ -809,7 +853,7 @@ func init() {
 	cloudDeployCmd.Flags().BoolVar(&cloudDebug, "debug", false, "include extra debugging information in the logs, and have runners log to syslog on their machines")
 	cloudDeployCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "remote file systems to mount on all servers at bootup, in JSON format; see 'wr mount -h'")
 
-	cloudTearDownCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack'] cloud provider")
+	cloudTearDownCmd.Flags().StringVarP(&providerName, "provider", "p", defaultConfig.CloudProvider, "['openstack','aws','fake'] cloud provider")
 	cloudTearDownCmd.Flags().StringVar(&cloudResourceNameUniquer, "resource_name", realUsername(), "name you set during deploy")
 	cloudTearDownCmd.Flags().BoolVarP(&forceTearDown, "force", "f", false, "force teardown even when the remote manager cannot be accessed")
 	cloudTearDownCmd.Flags().BoolVar(&cloudDebug, "debug", false, "show details of the teardown process")
@@ -824,12 +868,32 @@ func init() {
 func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe string, mp int, wp int, keyPath string, wrMayHaveStarted bool, domainMatchesIP bool) {
 	ctx := context.Background()
 
-	// upload ourselves to /tmp
-	remoteExe := filepath.Join(cloudBinDir, "wr")
-	err := server.UploadFile(ctx, exe, remoteExe)
-	if err != nil && !wrMayHaveStarted {
-		teardown(ctx, provider)
-		die("failed to upload wr to the server at %s: %s", server.IP, err)
+	// if the server is really this machine (as with the fake provider), the
+	// manager we start there keeps its files in cloudLocalManagerDir, which
+	// only works if no config file of ours says where they go
+	remoteHome := remoteManagerHome(server.IP)
+	remoteDir := remoteManagerDir(server.IP)
+	var localManagerEnv string
+	if serverIsLocal(server.IP) {
+		if source := config.Source("ManagerDir"); source != internal.ConfigSourceDefault && source != internal.ConfigSourceEnvVar {
+			teardown(ctx, provider)
+			die("the server at %s is this machine, so managerdir must not be set in %s", server.IP, source)
+		}
+		localManagerEnv = fmt.Sprintf("WR_CONFIG_DIR=\"$HOME/%s\" WR_MANAGERDIR=\"$HOME/%s/.wr\" ",
+			cloudLocalManagerDir, cloudLocalManagerDir)
+	}
+
+	// upload ourselves to /tmp (unless the server is this machine and so
+	// already has us)
+	remoteExe := exe
+	var err error
+	if !serverIsLocal(server.IP) {
+		remoteExe = filepath.Join(cloudBinDir, "wr")
+		err = server.UploadFile(ctx, exe, remoteExe)
+		if err != nil && !wrMayHaveStarted {
+			teardown(ctx, provider)
+			die("failed to upload wr to the server at %s: %s", server.IP, err)
+		}
 	}
 
 	// create a config file on the remote to have the remote wr work on the same
@@ -842,7 +906,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 		// copy over our database
 		if _, errf := os.Stat(config.ManagerDBFile); errf == nil {
 			if errf = server.UploadFile(ctx, config.ManagerDBFile,
-				filepath.Join("./.wr_"+config.Deployment, "db")); errf == nil {
+				filepath.Join(remoteDir, "db")); errf == nil {
 				info("copied local database to remote server")
 			} else if !wrMayHaveStarted {
 				teardown(ctx, provider)
@@ -853,14 +917,14 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 			die("failed to access the local database: %s", errf)
 		}
 	}
-	if err = server.CreateFile(ctx, fmt.Sprintf("managerport: \"%d\"\nmanagerweb: \"%d\"\nmanagerdbbkfile: \"%s\"\nmanagercertdomain: \"%s\"\nmanagerumask: %d\n", mp, wp, dbBk, config.ManagerCertDomain, config.ManagerUmask), wrConfigFileName); err != nil {
+	if err = server.CreateFile(ctx, fmt.Sprintf("managerport: \"%d\"\nmanagerweb: \"%d\"\nmanagerdbbkfile: \"%s\"\nmanagercertdomain: \"%s\"\nmanagerumask: %d\n", mp, wp, dbBk, config.ManagerCertDomain, config.ManagerUmask), filepath.Join(remoteHome, wrConfigFileName)); err != nil {
 		teardown(ctx, provider)
 		die("failed to create our config file on the server at %s: %s", server.IP, err)
 	}
 
 	// copy over our token file, if we're in a recovery situation
 	if _, errf := os.Stat(config.ManagerTokenFile); errf == nil {
-		if errf = server.UploadFile(ctx, config.ManagerTokenFile, filepath.Join("./.wr_"+config.Deployment, "client.token")); errf == nil {
+		if errf = server.UploadFile(ctx, config.ManagerTokenFile, filepath.Join(remoteDir, "client.token")); errf == nil {
 			info("copied existing client.token to remote server")
 		}
 	}
@@ -873,7 +937,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 	// copy over our cloud resource details, including our ssh key
 	cRN := cloudResourceName(cloudResourceNameUniquer)
 	localResourceFile := filepath.Join(config.ManagerDir, "cloud_resources."+providerName+"."+cRN)
-	remoteResourceFile := filepath.Join("./.wr_"+config.Deployment, "cloud_resources."+providerName+"."+cRN)
+	remoteResourceFile := filepath.Join(remoteDir, "cloud_resources."+providerName+"."+cRN)
 	if err = server.UploadFile(ctx, localResourceFile, remoteResourceFile); err != nil && !wrMayHaveStarted {
 		teardown(ctx, provider)
 		die("failed to upload wr cloud resources file to the server at %s: %s", server.IP, err)
@@ -884,7 +948,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 		teardown(ctx, provider)
 		die("failed to create key file %s: %s", localKeyFile, err)
 	}
-	remoteKeyFile := filepath.Join("./.wr_"+config.Deployment, "cloud_resources."+providerName+".key")
+	remoteKeyFile := filepath.Join(remoteDir, "cloud_resources."+providerName+".key")
 	if err = server.UploadFile(ctx, localKeyFile, remoteKeyFile); err != nil && !wrMayHaveStarted {
 		teardown(ctx, provider)
 		die("failed to upload wr cloud key file to the server at %s: %s", server.IP, err)
@@ -899,12 +963,12 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 	}
 
 	// copy over our ca, cert and key files
-	remoteCertFile := filepath.Join("./.wr_"+config.Deployment, "cert.pem")
+	remoteCertFile := filepath.Join(remoteDir, "cert.pem")
 	if err = server.UploadFile(ctx, config.ManagerCertFile, remoteCertFile); err != nil && !wrMayHaveStarted {
 		teardown(ctx, provider)
 		die("failed to upload wr manager certificate file to the server at %s: %s", server.IP, err)
 	}
-	remoteKeyFile = filepath.Join("./.wr_"+config.Deployment, "key.pem")
+	remoteKeyFile = filepath.Join(remoteDir, "key.pem")
 	if err = server.UploadFile(ctx, config.ManagerKeyFile, remoteKeyFile); err != nil && !wrMayHaveStarted {
 		teardown(ctx, provider)
 		die("failed to upload wr manager key file to the server at %s: %s", server.IP, err)
@@ -919,7 +983,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 	}
 	_, err = os.Stat(config.ManagerCAFile)
 	if err == nil {
-		remoteCAFile := filepath.Join("./.wr_"+config.Deployment, "ca.pem")
+		remoteCAFile := filepath.Join(remoteDir, "ca.pem")
 		if err = server.UploadFile(ctx, config.ManagerCAFile, remoteCAFile); err != nil && !wrMayHaveStarted {
 			teardown(ctx, provider)
 			die("failed to upload wr manager CA file to the server at %s: %s", server.IP, err)
@@ -941,7 +1005,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 	// start up the manager
 	var alreadyStarted bool
 	if wrMayHaveStarted {
-		response, _, errf := server.RunCmd(ctx, fmt.Sprintf("%s manager status --deployment %s", remoteExe, config.Deployment), false)
+		response, _, errf := server.RunCmd(ctx, fmt.Sprintf("%s%s manager status --deployment %s", localManagerEnv, remoteExe, config.Deployment), false)
 		if errf == nil && response == "started\n" {
 			alreadyStarted = true
 		}
@@ -962,21 +1026,22 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 			// *** this is bash-like only; is that a problem?
 			envvarExports += fmt.Sprintf("export %s=\"%s\"\n", env, val)
 		}
-		err = server.CreateFile(ctx, envvarExports, wrEnvFileName)
+		envFile := filepath.Join(remoteHome, wrEnvFileName)
+		err = server.CreateFile(ctx, envvarExports, envFile)
 		if err != nil {
 			teardown(ctx, provider)
 			die("failed to create our environment variables file on the server at %s: %s", server.IP, err)
 		}
-		_, _, err = server.RunCmd(ctx, "chmod 600 "+wrEnvFileName, false)
+		_, _, err = server.RunCmd(ctx, "chmod 600 "+envFile, false)
 		if err != nil {
-			warn("failed to chmod 600 %s: %s", wrEnvFileName, err)
+			warn("failed to chmod 600 %s: %s", envFile, err)
 		}
 
 		var postCreationArg string
 		if postCreationScript != "" {
 			// copy over the post creation script to the server so remote
 			// manager can use it
-			remoteScriptFile := filepath.Join("./.wr_"+config.Deployment, "cloud_resources."+providerName+".script")
+			remoteScriptFile := filepath.Join(remoteDir, "cloud_resources."+providerName+".script")
 			err = server.UploadFile(ctx, postCreationScript, remoteScriptFile)
 			if err != nil && !wrMayHaveStarted {
 				teardown(ctx, provider)
@@ -990,7 +1055,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 		if preDestroyScript != "" {
 			// copy over the pre destroy script to the server so remote
 			// manager can use it
-			remoteScriptFile := filepath.Join("./.wr_"+config.Deployment, "cloud_resources."+providerName+".destroy_script")
+			remoteScriptFile := filepath.Join(remoteDir, "cloud_resources."+providerName+".destroy_script")
 			err = server.UploadFile(ctx, preDestroyScript, remoteScriptFile)
 			if err != nil && !wrMayHaveStarted {
 				teardown(ctx, provider)
@@ -1023,6 +1088,9 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 		if flavorSets != "" {
 			flavorArg += " --cloud_flavor_sets '" + flavorSets + "'"
 		}
+		if flavorResources != "" {
+			flavorArg += " --cloud_flavor_resources '" + flavorResources + "'"
+		}
 
 		var osDiskArg string
 		if osDisk > 0 {
@@ -1044,7 +1112,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 		if domainMatchesIP {
 			useCertDomainStr = " --use_cert_domain"
 		}
-		mCmd := fmt.Sprintf("source %s && %s manager start --deployment %s -s %s -k %d -o '%s' -r %d -m %d -u %s%s%s%s%s%s%s  --cloud_cidr '%s' --local_username '%s' --cloud_spawns %d --max_cores %d --max_ram %d --timeout %d --cloud_auto_confirm_dead %d%s%s && rm %s", wrEnvFileName, remoteExe, config.Deployment, providerName, serverKeepAlive, osPrefix, osRAM, m, osUsername, postCreationArg, preDestroyArg, flavorArg, osDiskArg, mountsArg, configFilesArg, cloudCIDR, cloudResourceNameUniquer, cloudSpawns, maxManagerCores, maxManagerRAM, cloudManagerTimeoutSeconds, cloudServersAutoConfirmDead, useCertDomainStr, debugStr, wrEnvFileName)
+		mCmd := fmt.Sprintf("source %s && %s%s manager start --deployment %s -s cloud --cloud_provider %s -k %d -o '%s' -r %d -m %d -u %s%s%s%s%s%s%s  --cloud_cidr '%s' --local_username '%s' --cloud_spawns %d --max_cores %d --max_ram %d --timeout %d --cloud_auto_confirm_dead %d%s%s && rm %s", envFile, localManagerEnv, remoteExe, config.Deployment, providerName, serverKeepAlive, osPrefix, osRAM, m, osUsername, postCreationArg, preDestroyArg, flavorArg, osDiskArg, mountsArg, configFilesArg, cloudCIDR, cloudResourceNameUniquer, cloudSpawns, maxManagerCores, maxManagerRAM, cloudManagerTimeoutSeconds, cloudServersAutoConfirmDead, useCertDomainStr, debugStr, envFile)
 
 		var e string
 		_, e, err = server.RunCmd(ctx, mCmd, false)
@@ -1057,7 +1125,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 			// copy over any manager logs that got created locally (ignore
 			// errors, and overwrite any existing file)
 			cloudLogFilePath := config.ManagerLogFile + "." + providerName
-			errf := server.DownloadFile(ctx, filepath.Join("./.wr_"+config.Deployment, "log"), cloudLogFilePath)
+			errf := server.DownloadFile(ctx, filepath.Join(remoteDir, "log"), cloudLogFilePath)
 
 			// display any non-info lines in that log file
 			if errf == nil {
@@ -1084,7 +1152,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 
 			warn("To debug further you can try to ssh to this server using:")
 			color.Magenta("ssh -i %s %s@%s", keyPath, osUsername, server.IP)
-			fmt.Printf("and see if you can run (checking %s afterwards):\n", "~/.wr_"+config.Deployment+"/log")
+			fmt.Printf("and see if you can run (checking %s afterwards):\n", filepath.Join("~", remoteDir, "log"))
 			color.Magenta(mCmd)
 
 			// now teardown and die, once the user confirms
@@ -1103,7 +1171,7 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 		<-time.After(3 * time.Second)
 	}
 
-	remoteTokenFile := filepath.Join("./.wr_"+config.Deployment, "client.token")
+	remoteTokenFile := filepath.Join(remoteDir, "client.token")
 	err = server.DownloadFile(ctx, remoteTokenFile, config.ManagerTokenFile)
 	if err != nil {
 		teardown(ctx, provider)
@@ -1112,6 +1180,11 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 }
 
 func startForwarding(serverIP, serverUser, keyFile string, port int, pidPath string) error {
+	// if the server is this machine, its ports are already local
+	if serverIsLocal(serverIP) {
+		return nil
+	}
+
 	// first check if pidPath already has a pid and if that pid is alive
 	if _, running := checkProcess(pidPath); running {
 		// info("assuming the process with id %d is already forwarding port %d to %s:%d", pid, port, serverIP, port)
@@ -1134,6 +1207,32 @@ func startForwarding(serverIP, serverUser, keyFile string, port int, pidPath str
 	return err
 }
 
+// remoteManagerHome returns the directory, relative to the home directory on
+// the server with the given IP address, that holds the config of a manager we
+// deploy there.
+func remoteManagerHome(serverIP string) string {
+	if serverIsLocal(serverIP) {
+		return cloudLocalManagerDir
+	}
+
+	return "."
+}
+
+// remoteManagerDir returns the directory, relative to the home directory on
+// the server with the given IP address, that holds the files of a manager we
+// deploy there.
+func remoteManagerDir(serverIP string) string {
+	return filepath.Join(remoteManagerHome(serverIP), ".wr_"+config.Deployment)
+}
+
+// serverIsLocal returns true if the given IP address is a loopback address,
+// meaning that the "server" is really this machine.
+func serverIsLocal(ip string) bool {
+	parsed := net.ParseIP(ip)
+
+	return parsed != nil && parsed.IsLoopback()
+}
+
 func checkProcess(pidPath string) (pid int, running bool) {
 	// read file (treat errors such as file not existing as no process)
 	pidBytes, err := os.ReadFile(pidPath)
@@ -72,6 +72,19 @@ const defaultYML = `# The format of this file is YAML
 # For more details, see the notes for the manager_port option above.
 managerhost: "localhost"
 
+# managerstandbyhost: What host was 'wr manager start --standby' started on?
+# This is optional and defaults to blank, meaning there is no standby manager.
+#
+# A standby manager keeps a copy of the database of the manager running on
+# managerhost, and if that manager dies, takes over on the same ports. Set this
+# to the host you start the standby on, so that wr commands and runners can
+# connect to it once it has taken over.
+# The standby needs the same managertokenfile and security certificates as the
+# manager; if it is on a different host, copy them there before starting it.
+# Stop the standby before stopping the manager if you don't want it to take
+# over.
+managerstandbyhost: ""
+
 # managerdir: Where should the wr manager store its working files?
 # This defaults to a directory prefixed with .wr in your home directory.
 #
@@ -146,6 +159,19 @@ managerdbfile: "db"
 # usage.
 managerdbbkfile: "db_bk"
 
+# managerdbbackend: What kind of database should wr manager use?
+# This defaults to "bolt", a simple embedded key/value store.
+#
+# Set this to "sqlite" to instead store jobs in indexed SQLite tables, so that
+# your job history (in the jobs_complete table, with columns for the cmd,
+# rep_group, req_group, owner, exitcode, peak_ram, peak_disk, secs and end_time
+# of each job) can be queried with the sqlite3 command line tool or similar.
+#
+# The database file and its backups must be of this kind. To switch an existing
+# bolt database to sqlite, stop the manager, run 'wr manager migrate', then
+# change this and managerdbfile (and managerdbbkfile) as it tells you.
+managerdbbackend: "bolt"
+
 # managertokenfile: Where should the manager store the authentication token?
 # This defaults to a file named "client.token" in managerdir.
 #
@@ -159,6 +185,12 @@ managerdbbkfile: "db_bk"
 # order to get the token. The file will only be readable by the person who
 # starts the manager, and so in this way the manager will only be usable by that
 # person (or anyone they choose to share the token with).
+#
+# The person who starts the manager can also use "wr user add" to give other
+# people their own tokens. Those people should write their token to a file that
+# only they can read, and set managertokenfile to the path of that file in their
+# own config. They will then own the commands they add, and can only modify,
+# kill, remove and retry their own commands.
 managertokenfile: "client.token"
 
 # managercertfile: Where is the certificate PEM file the manager should use?
@@ -258,11 +290,42 @@ managerumask: 007
 #
 # "local" means run everything on the local machine.
 # "lsf" means submit to LSF using 'bsub'.
-# "openstack" means spawn additional openstack servers in the current network
-# as necessary to run your commands, and destroy them afterwards. NB: this only
-# works if you are starting the manager on an OpenStack server!
+# "slurm" means submit to Slurm using 'sbatch'.
+# "sge" means submit to Sun/Son of/Univa Grid Engine using 'qsub'.
+# "pbs" means submit to PBS Pro or Torque using 'qsub'.
+# "sshpool" means run commands over ssh on the fixed set of hosts described by
+# managersshhosts.
+# "cloud" means spawn additional servers with the cloudprovider in the current
+# network as necessary to run your commands, and destroy them afterwards. NB:
+# this only works if you are starting the manager on a server in that cloud!
+# "openstack", "aws" and "fake" are like "cloud", but use that cloudprovider.
+# "fake" servers are all really the local machine; it is only useful for testing
+# wr itself.
 managerscheduler: "local"
 
+# managerresources: What named consumable resources does the local machine have?
+# This defaults to none, and is overridden by the --resources option to
+# 'wr manager start'.
+#
+# This is used by the local scheduler, and by cloud schedulers for the server
+# the manager runs on. Note, this takes the form name=count,name=count, eg.
+# "gpu=2,matlab_licence=4". Commands that require resources (see the
+# --resources option of 'wr add') will only be run when enough of them are not
+# in use by other commands.
+# managerresources: ""
+
+# managersshhosts: What hosts can the sshpool scheduler run commands on?
+# This defaults to none, and is overridden by the --ssh_hosts option to
+# 'wr manager start'.
+#
+# This is only used by the sshpool scheduler, and takes the form
+# [user@]host:cores=N,ram=MB[,disk=GB][,name=count];[user@]host:..., eg.
+# "node1:cores=16,ram=64000;bob@node2:cores=8,ram=32000,disk=500,gpu=1". cores
+# and ram are required; other names are named consumable resources as per
+# managerresources. You must be able to ssh to each host without a password
+# using privatekeypath, and the hosts must be able to reach the manager.
+# managersshhosts: ""
+
 # manageruploaddir: Where should the wr manager store uploaded files?
 # This defaults to a dir named "uploads" in managerdir.
 #
@@ -274,6 +337,80 @@ managerscheduler: "local"
 # --cloud_config_files options are passed to "wr add".
 manageruploaddir: "uploads"
 
+# managercopydir: Where should the wr manager store files copied to it by
+# commands that used the copy_to_manager behaviour?
+# This defaults to a dir named "copied" in managerdir.
+#
+# Files are stored in a sub-directory unique to each command, and can be
+# retrieved using "wr status --copied".
+managercopydir: "copied"
+
+# managerjoblogdir: Where should the wr manager store the output that runners
+# stream to it, if runnerstreamlogs and managerjoblogmaxmb are set?
+# This defaults to a dir named "joblogs" in managerdir.
+#
+# Output is stored in files unique to each command, and can be retrieved using
+# "wr logs" after the command has stopped running.
+managerjoblogdir: "joblogs"
+
+# managerjoblogmaxmb: How much of the output of each command should the wr
+# manager store in managerjoblogdir?
+# This defaults to 0, meaning streamed output is only held in memory while
+# commands run (and is not stored in files at all).
+#
+# Set this to a number of megabytes to store up to that much of each of the
+# STDOUT and STDERR of the latest run of each command. Files are not deleted
+# automatically, so you may need to clean out managerjoblogdir yourself.
+managerjoblogmaxmb: 0
+
+# managerwebhooks: Which URLs should the wr manager POST job state changes to?
+# This defaults to none.
+#
+# Each time commands change state, the manager will POST a JSON array of
+# events describing the changes to each URL, retrying a few times if the POST
+# fails. Separate multiple URLs with semi-colons. You can limit the events sent
+# to a URL by following it with a pipe and a rep_group prefix, and optionally
+# another pipe and a comma-separated list of states, eg.
+# "https://host/hook|myproject|complete,buried".
+managerwebhooks: ""
+
+# managerretention: For how long should the wr manager keep completed commands
+# in its database?
+# This defaults to forever.
+#
+# Give a maximum age like "90d" (days) or "720h" (hours), after which completed
+# commands are moved out of the database in to compressed archive files in
+# managerarchivedir, and the database is compacted. Give different ages for
+# different report groups by prefixing an age with a regular expression that
+# matches the report groups and a pipe, and separating these with semi-colons,
+# eg. "^scratch\.|1d;90d". The first matching expression is used; an age without
+# an expression matches every report group. Archived commands can still be
+# found with "wr status --archived". The memory, disk and time usage of archived
+# commands continues to be used to learn the resource requirements of new ones.
+managerretention: ""
+
+# managerarchivedir: Where should the wr manager store archive files of
+# completed commands that were removed from its database due to
+# managerretention?
+# This defaults to a dir named "archive" in managerdir.
+managerarchivedir: "archive"
+
+# managerfairshare: Should the wr manager share out resources fairly between
+# different users or groups of commands?
+# This defaults to no: commands are run in priority order, and then in the order
+# they were added.
+#
+# Give a policy like "owner|7d|alice=2,bob=1" to group commands in to accounts
+# by the user that added them (see "wr user"), or "repgroup" instead of "owner"
+# to group them by the start of their report group, up to the first dot. The
+# second part is the half-life of past usage, which defaults to "7d"; the third
+# part is the relative share of resources of each account, which defaults to 1
+# for accounts not listed. Usage is the CPU time of commands plus their peak
+# memory in GB multiplied by their run time in seconds. Amongst commands of equal
+# priority, those belonging to accounts that have used the least of their share
+# run first. See "wr status --fairshare" for the current state of each account.
+managerfairshare: ""
+
 # runnerexecshell: What shell should be used to run commands in?
 # This defaults to bash, regardless of your current shell.
 #
@@ -281,13 +418,54 @@ manageruploaddir: "uploads"
 # recommended.
 runnerexecshell: "bash"
 
+# runnercgroup: a cgroup v2 directory to run commands beneath.
+# This defaults to blank, meaning commands are not run in cgroups, and memory
+# limits are only enforced by the job scheduler (if at all).
+#
+# If set to a cgroup v2 directory (eg. /sys/fs/cgroup/user.slice/wr) that has
+# the memory controller available and has been delegated to the user that runs
+# wr runners, each command will be run in its own child cgroup, limited to the
+# memory and cpus it reserved. The kernel will kill commands that use more
+# memory than they reserved, and runners will kill commands that run for longer
+# than they reserved; such commands will fail with a reason of "command used
+# too much RAM" or "command used too much time", and will be retried with
+# higher reservations. Peak memory usage will be taken from the cgroup's accounting,
+# so will include all of a command's child processes.
+runnercgroup: ""
+
+# runnerstreamlogs: how often (in seconds) should runners send the output of
+# the commands they run to the manager?
+# This defaults to 0, meaning output is not streamed; only the first and last
+# 4KB of STDOUT and STDERR are sent to the manager once a command exits.
+#
+# If set to a number of seconds (eg. 2), all the output of running commands
+# is sent to the manager this often, so that you can watch it using
+# "wr logs -f". See managerjoblogmaxmb if you'd also like the manager to keep
+# the full output after commands exit.
+runnerstreamlogs: 0
+
 # privatekeypath: path to your private key.
 # This defaults to ~/.ssh/id_rsa.
 #
-# This may be used by some schedulers (currently only LSF) to ssh to servers in
-# order to check on jobs that lose contact with the wr manager.
+# This may be used by some schedulers (currently LSF, Slurm, SGE and PBS) to
+# ssh to servers in order to check on jobs that lose contact with the wr
+# manager, and is used by the sshpool scheduler to run commands on its hosts.
 privatekeypath: "~/.ssh/id_rsa"
 
+# cloudprovider: What cloud should servers be spawned in?
+# This defaults to "openstack". It is overridden by the --provider option to
+# 'wr cloud deploy' and the --cloud_provider option of 'wr manager start'.
+#
+# This option is only relevant when you are using the cloud scheduler.
+#
+# "openstack" spawns servers in the OpenStack tenant (project) described by
+# your OS_* environment variables.
+# "aws" spawns EC2 instances in the region and account described by your AWS_*
+# environment variables.
+# "fake" pretends to spawn servers, which are all really the local machine; it
+# is only useful for testing wr itself.
+cloudprovider: "openstack"
+
 # cloudflavor: What server flavors can be automatically picked?
 # Without being set, any available flavor can be picked. It is overridden by
 # the --flavor option to 'wr cloud deploy' and the --cloud_flavor option of
@@ -339,6 +517,24 @@ privatekeypath: "~/.ssh/id_rsa"
 # have one set), it will never be repicked.
 # cloudflavorsets: ""
 
+# cloudflavorresources: What named consumable resources do server flavors have?
+# This defaults to none, and is overridden by the --flavor_resources option to
+# 'wr cloud deploy' and the --cloud_flavor_resources option of 'wr manager
+# start'. Note, this takes the form regex:name=count,name=count;regex:name=count
+# eg. "gpu.*:gpu=2;.*:scratch=1". The regular expressions are matched against
+# flavor names, and the first that matches says what resources servers of that
+# flavor have.
+#
+# This option is only relevant when you are using a cloud scheduler such as
+# OpenStack.
+#
+# Commands that require resources (see the --resources option of 'wr add') will
+# only be run on servers with enough of them free, and when new servers are
+# spawned for such commands, the cheapest flavor with enough resources is
+# picked. Flavors with resources are not picked for commands that don't need
+# them, unless no other flavor is suitable.
+# cloudflavorresources: ""
+
 # cloudkeepalive: How long should idle spawned server stay alive?
 # This defaults to 120. It is overridden by the --keepalive option to
 # 'wr cloud deploy' and the --cloud_keepalive option of 'wr manager start'.
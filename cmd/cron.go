@@ -0,0 +1,278 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var (
+	cronName       string
+	cronSchedule   string
+	cronCommand    string
+	cronJSON       string
+	cronRepGroup   string
+	cronReqGroup   string
+	cronMem        string
+	cronTime       string
+	cronCPUs       float64
+	cronRetries    int
+	cronPriority   int
+	cronCwdMatters bool
+)
+
+// cronCmd represents the cron command
+var cronCmd = &cobra.Command{
+	Use:   "cron",
+	Short: "Run commands repeatedly on a schedule",
+	Long: `Run commands repeatedly on a schedule.
+
+The manager can add a command to the queue over and over again, according to a
+cron-style schedule. Because the manager does this itself, your command will be
+added as long as the manager is running; no separate crontab is needed.
+
+If the command added at the previous tick of the schedule is still incomplete
+(eg. it is still running, or it failed and got buried), the tick is skipped, so
+you won't get multiple copies of the same command queued up.
+
+Ticks that would have happened while the manager was not running are not caught
+up on when it starts again.
+
+Use the sub-commands to add, list and remove your scheduled commands.`,
+}
+
+// add sub-command adds a new cron
+var cronAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a command to run on a schedule",
+	Long: `Add a command that the manager will add to the queue on a schedule.
+
+Give your scheduled command a unique --name (letters, numbers, _, . and - only),
+which you'll use to remove it later.
+
+--schedule is a standard 5 field cron expression: "minute hour day-of-month
+month day-of-week". Each field can be * (any value), a number, a range (1-5), a
+step (*/15 or 0-30/10), or a comma-separated list of these. Months and days of
+the week can also be given as 3 letter names (jan, mon etc.). For example, "30 2
+* * mon-fri" means at 02:30 every weekday. You can also use one of @hourly,
+@daily, @weekly, @monthly or @yearly. Times are in the manager's local time.
+
+Supply your command with --cmd, and optionally the other flags to specify its
+resource requirements and so on. Alternatively supply --json with a JSON object
+describing your command, which can contain any of the options described in
+"wr add -h"; other flags are treated as defaults for that.
+
+The command will be run with your current environment variables. By default,
+its report group will be "cron.[name]".`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cronName == "" {
+			die("--name is required")
+		}
+		if cronSchedule == "" {
+			die("--schedule is required")
+		}
+		if (cronCommand == "") == (cronJSON == "") {
+			die("exactly one of --cmd or --json is required")
+		}
+
+		_, err := jobqueue.ParseCronSchedule(cronSchedule)
+		if err != nil {
+			die("bad --schedule: %s", err)
+		}
+
+		jvj := &jobqueue.JobViaJSON{Cmd: cronCommand}
+		if cronJSON != "" {
+			err = json.Unmarshal([]byte(cronJSON), jvj)
+			if err != nil {
+				die("bad --json: %s", err)
+			}
+		}
+
+		job, err := jvj.Convert(cronJobDefaults())
+		if err != nil {
+			die("%s", err)
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		cj, err := jq.AddCron(&jobqueue.CronJob{Name: cronName, Schedule: cronSchedule, Job: job}, os.Environ())
+		if err != nil {
+			die("%s", err)
+		}
+
+		info("Added cron %s; %s will next be added at %s", cj.Name, cj.Job.Cmd, cj.NextTick.Format(time.RFC1123))
+	},
+}
+
+// list sub-command lists the current crons
+var cronListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List commands that run on a schedule",
+	Long: `List the commands that the manager is adding to the queue on a schedule.
+
+For each, you'll see its name, schedule and command, when it will next be added,
+and how many times it has been added or skipped because the previous copy was
+still incomplete.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		cjs, err := jq.GetCrons()
+		if err != nil {
+			die("%s", err)
+		}
+
+		if len(cjs) == 0 {
+			info("There are no crons")
+			return
+		}
+
+		for _, cj := range cjs {
+			fmt.Printf("\n# %s\nSchedule: %s\nCmd: %s\nReport group: %s\n", cj.Name, cj.Schedule, cj.Job.Cmd, cj.Job.RepGroup)
+			if cj.Job.Owner != "" {
+				fmt.Printf("Owner: %s\n", cj.Job.Owner)
+			}
+			fmt.Printf("Next: %s\n", cj.NextTick.Format(time.RFC1123))
+			if !cj.LastAdded.IsZero() {
+				fmt.Printf("Last added: %s\n", cj.LastAdded.Format(time.RFC1123))
+			}
+			fmt.Printf("Added: %d; Skipped: %d\n", cj.Added, cj.Skipped)
+		}
+	},
+}
+
+// remove sub-command removes a cron
+var cronRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Stop running a command on a schedule",
+	Long: `Stop the manager adding a command to the queue on a schedule.
+
+Specify the --name you gave to "wr cron add". Any copy of the command that was
+already added to the queue is not affected; use "wr remove" or "wr kill" on it
+(using report group "cron.[name]", if you didn't specify your own) if needed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cronName == "" {
+			die("--name is required")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		err = jq.RemoveCron(cronName)
+		if err != nil {
+			die("%s", err)
+		}
+
+		info("Removed cron %s", cronName)
+	},
+}
+
+// cronJobDefaults converts the flags of cron add in to JobDefaults.
+func cronJobDefaults() *jobqueue.JobDefaults {
+	if cronCPUs < 0 {
+		die("--cpus can't be negative")
+	}
+
+	jd := &jobqueue.JobDefaults{
+		RepGrp:     cronRepGroup,
+		ReqGrp:     cronReqGroup,
+		Cwd:        cmdCwd,
+		CwdMatters: cronCwdMatters,
+		CPUs:       cronCPUs,
+		Priority:   cronPriority,
+		Retries:    cronRetries,
+	}
+
+	if jd.Cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			die("%s", err)
+		}
+		jd.Cwd = wd
+	}
+
+	mb, err := bytefmt.ToMegabytes(cronMem)
+	if err != nil {
+		die("--memory was not specified correctly: %s", err)
+	}
+	jd.Memory = int(mb)
+
+	jd.Time, err = time.ParseDuration(cronTime)
+	if err != nil {
+		die("--time was not specified correctly: %s", err)
+	}
+
+	return jd
+}
+
+func init() {
+	RootCmd.AddCommand(cronCmd)
+	cronCmd.AddCommand(cronAddCmd)
+	cronCmd.AddCommand(cronListCmd)
+	cronCmd.AddCommand(cronRemoveCmd)
+
+	// flags specific to these sub-commands
+	cronAddCmd.Flags().StringVarP(&cronName, "name", "n", "", "unique name for this scheduled command")
+	cronAddCmd.Flags().StringVarP(&cronSchedule, "schedule", "s", "", "cron expression for when to add the command, eg. \"0 2 * * *\"")
+	cronAddCmd.Flags().StringVar(&cronCommand, "cmd", "", "the command to run")
+	cronAddCmd.Flags().StringVarP(&cronJSON, "json", "j", "", "the command to run and its options, in JSON format")
+	cronAddCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "base for the command's working dir")
+	cronAddCmd.Flags().BoolVar(&cronCwdMatters, "cwd_matters", false, "--cwd should be used as the actual working directory")
+	cronAddCmd.Flags().StringVarP(&cronRepGroup, "rep_grp", "i", "", "reporting group for the command (default \"cron.[name]\")")
+	cronAddCmd.Flags().StringVarP(&cronReqGroup, "req_grp", "g", "", "group name for commands with similar reqs")
+	cronAddCmd.Flags().StringVarP(&cronMem, "memory", "m", "1G", "peak mem est. [specify units such as M for Megabytes or G for Gigabytes]")
+	cronAddCmd.Flags().StringVarP(&cronTime, "time", "t", "1h", "max time est. [specify units such as m for minutes or h for hours]")
+	cronAddCmd.Flags().Float64Var(&cronCPUs, "cpus", 1, "cpu cores needed")
+	cronAddCmd.Flags().IntVarP(&cronPriority, "priority", "p", 0, "[0-255] command priority (default 0)")
+	cronAddCmd.Flags().IntVarP(&cronRetries, "retries", "r", 3, "[0-255] number of automatic retries for failed commands")
+	cronRemoveCmd.Flags().StringVarP(&cronName, "name", "n", "", "name of the scheduled command to remove")
+
+	cronAddCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	cronListCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	cronRemoveCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -0,0 +1,150 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// logsFollowWait is how long each request for more output waits for some to
+// arrive when following.
+const logsFollowWait = 10 * time.Second
+
+// options for this cmd
+var logsFollow bool
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:   "logs <job id>",
+	Short: "Get the output of a command",
+	Long: `Get the output of a command.
+
+Specify the internal job id of a command (as shown by "wr status"), and its
+STDOUT is printed to STDOUT and its STDERR to STDERR.
+
+While a command is running, you'll get the most recent output its runner has
+streamed to the manager, if the runnerstreamlogs config option was set. With
+-f you'll then keep getting its output as it is produced, until the command
+stops running.
+
+Once a command has stopped running, you'll get all of the output of its last
+run if the managerjoblogmaxmb config option was set (up to that size).
+Otherwise, you'll only get the first and last 4KB of its STDOUT and STDERR, as
+also seen with "wr status --std".`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		key := args[0]
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		defer func() {
+			err := jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		chunks, seq, live, err := jq.GetLogs(key, 0, 0)
+		if err != nil {
+			die("failed to get output: %s", err)
+		}
+
+		if len(chunks) == 0 && !live {
+			printStoredStd(jq, key)
+
+			return
+		}
+
+		printLogChunks(chunks)
+
+		if !logsFollow {
+			return
+		}
+
+		wait := logsFollowWait
+		if wait >= timeout {
+			wait = timeout / 2
+		}
+
+		for live {
+			chunks, seq, live, err = jq.GetLogs(key, seq, wait)
+			if err != nil {
+				die("failed to get output: %s", err)
+			}
+
+			printLogChunks(chunks)
+		}
+	},
+}
+
+// printLogChunks prints the Data of the given chunks to STDOUT or STDERR,
+// depending on their Stream.
+func printLogChunks(chunks []*jobqueue.LogChunk) {
+	for _, chunk := range chunks {
+		if chunk.Stream == jobqueue.LogStreamStderr {
+			fmt.Fprint(os.Stderr, chunk.Data)
+		} else {
+			fmt.Print(chunk.Data)
+		}
+	}
+}
+
+// printStoredStd prints the StdOut and StdErr stored with the Job with the
+// given key, for when no streamed output is available.
+func printStoredStd(jq *jobqueue.Client, key string) {
+	job, err := jq.GetByEssence(&jobqueue.JobEssence{JobKey: key}, true, false)
+	if err != nil {
+		die("failed to get the command: %s", err)
+	}
+
+	if job == nil {
+		die("no command with id %s was found", key)
+	}
+
+	stdout, err := job.StdOut()
+	if err != nil {
+		die("failed to get the command's STDOUT: %s", err)
+	}
+
+	stderr, err := job.StdErr()
+	if err != nil {
+		die("failed to get the command's STDERR: %s", err)
+	}
+
+	if stdout != "" {
+		fmt.Println(stdout)
+	}
+
+	if stderr != "" {
+		fmt.Fprintln(os.Stderr, stderr)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(logsCmd)
+
+	// flags specific to this sub-command
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "keep getting output until the command stops running")
+	logsCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -26,6 +26,7 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"text/tabwriter"
@@ -53,9 +54,15 @@ var jobStateToLSFState = map[jobqueue.JobState]string{
 
 // options for this cmd
 var (
-	lsfNoHeader bool
-	lsfFormat   string
-	lsfQueue    string
+	lsfNoHeader    bool
+	lsfFormat      string
+	lsfQueue       string
+	lsfAll         bool
+	lsfJobName     string
+	lsfWide        bool
+	lsfUser        string
+	lsfWaitFor     string
+	lsfWaitTimeout int
 )
 
 // lsfCmd represents the lsf command.
@@ -74,12 +81,35 @@ this could result in greater efficiency compared to directly using the real bsub
 command. If you've done a cloud deployment, this allows pipelines that know
 nothing about the cloud to distribute their workload in that cloud environment.
 
-NB: currently the emulation is extremely limited, supporting only the
-interactive "console" mode where you run bsub without any arguments, and it only
-supports single flags per #BSUB line, and it only pays attention to -J, -n and
--M flags. (This is sufficient for compatibility with 10x Genomic's cellranger
-software (which has Martian built in), and to work as the scheduler for
-nextflow in LSF mode.) There is only one "queue", called 'wr'.
+NB: the emulation is limited. bsub supports being given the command to run as
+its final arguments, or the "console" mode where you run bsub without a command
+and it reads a job script from STDIN, in which case options can also be given
+on #BSUB lines. It understands these options:
+
+-J name       job name, or "name[1-100]" for an array (with optional %limit)
+-n cores      number of cores
+-M mem        memory limit (MB, or with a unit suffix like 4G)
+-R "..."      only pays attention to rusage[mem=...]
+-W [h:]m      run time limit
+-q queue      passed on as the scheduler_queue if the manager uses one
+-cwd dir      working directory
+-i file       file to use as STDIN
+-o/-oo file   file to append/write STDOUT (and STDERR, if -e isn't given) to
+-e/-eo file   file to append/write STDERR to
+-w "expr"     dependency expression, using done(), exit() and ended() of
+              job names or ids, joined with &&
+-K            wait for the job to finish, exiting with its exit code
+
+Other standard options are accepted but ignored. In file names, %J is replaced
+with the job id and %I with the array index. Array elements see their index
+in $LSB_JOBINDEX, and all jobs see their id in $LSB_JOBID. Jobs depending on an
+array depend on all of its elements.
+
+bjobs, bkill and bwait are also emulated; see their help for details.
+
+This is sufficient for compatibility with 10x Genomic's cellranger software
+(which has Martian built in), to work as the scheduler for nextflow in LSF mode,
+and for many simple LSF pipelines. There is only one "queue", called 'wr'.
 
 The best way to use this LSF emulation is not to call this command yourself
 directly, but to use 'wr add --bsubs [other opts]' to add the command that you
@@ -92,8 +122,22 @@ effectively emulates all the work being done on an LSF farm with shared disk.`,
 var lsfBsubCmd = &cobra.Command{
 	Use:   "bsub",
 	Short: "Add a job using bsub syntax",
-	Long:  `Add a job to the queue using bsub syntax.`,
+	Long: `Add a job to the queue using bsub syntax.
+
+Either supply the command to run after any options, or supply no command to
+enter "console" mode, where a job script (which may contain #BSUB lines) is read
+from STDIN. Options given on the command line override those on #BSUB lines.
+
+See 'wr lsf -h' for the supported options.`,
+	DisableFlagParsing: true,
 	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "--help") {
+			if err := cmd.Help(); err != nil {
+				die(err.Error())
+			}
+			return
+		}
+
 		wd, errg := os.Getwd()
 		if errg != nil {
 			die(errg.Error())
@@ -124,49 +168,24 @@ var lsfBsubCmd = &cobra.Command{
 			}
 		}
 
-		r := regexp.MustCompile(`^#BSUB\s+-(\w)\s+(.+)$`)
-		// rMem := regexp.MustCompile(`mem[>=](\d+)`)
+		opts := &jobqueue.BsubOptions{}
+		cmdArgs, err := opts.Parse(args)
+		if err != nil {
+			die(err.Error())
+		}
 
-		fmt.Printf("bsub> ")
-		scanner := bufio.NewScanner(os.Stdin)
 		var possibleExe string
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-
-			if strings.HasPrefix(line, "#") {
-				matches := r.FindStringSubmatch(line)
-				if matches != nil {
-					// *** this does not support the (valid) inclusion of
-					// multiple options per line
-					switch matches[1] {
-					case "J":
-						job.RepGroup = matches[2]
-					case "n":
-						if n, err := strconv.ParseFloat(matches[2], 64); err == nil {
-							job.Requirements.Cores = n
-						}
-					case "M":
-						if n, err := strconv.Atoi(matches[2]); err == nil {
-							job.Requirements.RAM = n
-							job.Override = 2
-						}
-					}
-				} else {
-					job.Cmd += line + "\n"
-				}
-			} else {
-				if possibleExe == "" {
-					parts := strings.Split(line, " ")
-					possibleExe = parts[0]
-				}
-				job.Cmd += line + "\n"
-			}
-
-			fmt.Printf("bsub> ")
-		}
+		if len(cmdArgs) > 0 {
+			possibleExe = cmdArgs[0]
+			job.Cmd = strings.Join(cmdArgs, " ")
+		} else {
+			possibleExe = lsfReadJobScript(job, opts)
 
-		if scanner.Err() != nil {
-			die(scanner.Err().Error())
+			// options on the command line take precedence over those in the
+			// script
+			if _, err = opts.Parse(args); err != nil {
+				die(err.Error())
+			}
 		}
 
 		if job.Cmd == "" {
@@ -178,9 +197,17 @@ var lsfBsubCmd = &cobra.Command{
 			job.ReqGroup = possibleExe
 		}
 
+		opts.Apply(job)
+
+		var arrayID string
+		expected := 1
+		if job.Array != nil {
+			arrayID = job.ArrayKey()
+			expected = job.Array.Size()
+		}
+
 		// connect to the server
 		jq := connect(10 * time.Second)
-		var err error
 		defer func() {
 			err = jq.Disconnect()
 			if err != nil {
@@ -194,20 +221,138 @@ var lsfBsubCmd = &cobra.Command{
 			die(err.Error())
 		}
 
-		if inserts != 1 {
+		if inserts != expected {
 			fmt.Println("Duplicate command specified. Job not submitted.")
 			os.Exit(255)
 		}
 
-		j, err := jq.GetByEssence(&jobqueue.JobEssence{Cmd: job.Cmd, Cwd: job.Cwd, MountConfigs: job.MountConfigs}, false, false)
+		var bsubID uint64
+		if arrayID != "" {
+			elements, errg := jq.GetByArray(arrayID, 0, false, false)
+			if errg != nil {
+				die(errg.Error())
+			}
+			if len(elements) == 0 {
+				die("could not find the job array that was just added")
+			}
+			bsubID = elements[0].BsubID
+		} else {
+			j, errg := jq.GetByEssence(&jobqueue.JobEssence{Cmd: job.Cmd, Cwd: job.Cwd, MountConfigs: job.MountConfigs}, false, false)
+			if errg != nil {
+				die(errg.Error())
+			}
+			bsubID = j.BsubID
+		}
+
+		if opts.Queue != "" {
+			fmt.Printf("Job <%d> is submitted to queue <%s>.\n", bsubID, opts.Queue)
+		} else {
+			fmt.Printf("Job <%d> is submitted to default queue <wr>.\n", bsubID)
+		}
+
+		if !opts.Wait {
+			return
+		}
+
+		fmt.Println("<<Waiting for dispatch ...>>")
+		dep := jobqueue.NewConditionalDependency(jobqueue.NewDepGroupDependency(jobqueue.BsubIDDepGroup(bsubID)), jobqueue.DepModeAny)
+		buried, err := lsfWaitForDependencies(jq, jobqueue.Dependencies{dep}, 0)
 		if err != nil {
 			die(err.Error())
 		}
+		fmt.Println("<<Job is finished>>")
 
-		fmt.Printf("Job <%d> is submitted to default queue <wr>.\n", j.BsubID)
+		for _, j := range buried {
+			code := 1
+			if j.Exited && j.Exitcode != 0 {
+				code = j.Exitcode
+			}
+			os.Exit(code)
+		}
 	},
 }
 
+// lsfReadJobScript reads a job script from STDIN in bsub's console mode,
+// parsing any #BSUB lines in to the given options and adding the other lines to
+// the given job's Cmd. Returns the first word of the first command in the
+// script.
+func lsfReadJobScript(job *jobqueue.Job, opts *jobqueue.BsubOptions) string {
+	fmt.Printf("bsub> ")
+	scanner := bufio.NewScanner(os.Stdin)
+	var possibleExe string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		isOpts, err := opts.ParseScriptLine(line)
+		if err != nil {
+			die(err.Error())
+		}
+
+		if !isOpts {
+			if possibleExe == "" && line != "" && !strings.HasPrefix(line, "#") {
+				possibleExe = strings.Split(line, " ")[0]
+			}
+			job.Cmd += line + "\n"
+		}
+
+		fmt.Printf("bsub> ")
+	}
+
+	if scanner.Err() != nil {
+		die(scanner.Err().Error())
+	}
+
+	return possibleExe
+}
+
+// lsfWaitForDependencies polls the server until all the given dependencies (as
+// returned by jobqueue.ParseBsubDependencies()) are satisfied, returning any
+// buried jobs that were depended upon. It returns an error if a dependency
+// becomes impossible to satisfy, or the timeout (if greater than 0) passes.
+func lsfWaitForDependencies(jq *jobqueue.Client, deps jobqueue.Dependencies, timeout time.Duration) ([]*jobqueue.Job, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		var buried []*jobqueue.Job
+		allSatisfied := true
+		for _, dep := range deps {
+			query := &jobqueue.JobQuery{Filter: &jobqueue.JobFilter{DepGroup: dep.DepGroup}}
+			jobs, _, err := jq.QueryJobs("", false, 0, "", query, false, false)
+			if err != nil {
+				return nil, err
+			}
+
+			satisfied, unsatisfiable := jobqueue.BsubDependencyStatus(dep, jobs)
+			if unsatisfiable {
+				return nil, fmt.Errorf("wait condition is never satisfied")
+			}
+			if !satisfied {
+				allSatisfied = false
+				break
+			}
+
+			for _, job := range jobs {
+				if job.State == jobqueue.JobStateBuried {
+					buried = append(buried, job)
+				}
+			}
+		}
+
+		if allSatisfied {
+			return buried, nil
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, fmt.Errorf("wait condition not satisfied within the timeout")
+		}
+
+		<-time.After(500 * time.Millisecond)
+	}
+}
+
 type lsfFieldDisplay func(*jobqueue.Job) string
 
 // bjobs sub-command emulates bjobs.
@@ -217,20 +362,28 @@ var lsfBjobsCmd = &cobra.Command{
 	Long: `See jobs that have been added using the lsf bsub command, using bjobs
 syntax and being formatted the way bjobs display this information.
 
-Only lists all incomplete jobs. Unlike real bjobs, does not list recently
-completed jobs. Unlike real bjobs, does not truncate columns (always effectively
-in -w mode).
+By default lists all incomplete jobs. With -a, also lists jobs that completed
+in the last hour. Unlike real bjobs, does not truncate columns (always
+effectively in -w mode).
 
 Only supports this limited set of real bjobs options:
 -noheader
+-a
+-J <job name>
 -o <output format>
 -q <queue name>
+-u <user name> (ignored)
+-w
+[job IDs]
 
 The output format only supports simple listing of desired columns (not choosing
 their width), and specifying the delimiter. The only columns supported are
-JOBID, USER, STAT, QUEUE, FROM_HOST, EXEC_HOST, JOB_NAME and SUBMIT_TIME.
+JOBID, USER, STAT, QUEUE, FROM_HOST, EXEC_HOST, JOB_NAME, SUBMIT_TIME,
+START_TIME, FINISH_TIME and EXIT_CODE.
 eg. -o 'JOBID STAT SUBMIT_TIME delimiter=","'
 
+Elements of job arrays share a JOBID, and have a JOB_NAME like name[index].
+
 While -q can be provided, and that provided queue will be displayed in the
 output, in reality there is only 1 queue called 'wr', so -q has no real function
 other than providing compatibility with real bjobs command line args.`,
@@ -240,6 +393,8 @@ other than providing compatibility with real bjobs command line args.`,
 			die(err.Error())
 		}
 
+		desired := lsfParseJobIDs(args)
+
 		// connect to the server
 		jq := connect(10 * time.Second)
 		defer func() {
@@ -270,11 +425,29 @@ other than providing compatibility with real bjobs command line args.`,
 			return job.Host
 		}
 		fieldLookup["JOB_NAME"] = func(job *jobqueue.Job) string {
+			if job.ArrayID != "" {
+				return fmt.Sprintf("%s[%d]", job.RepGroup, jobqueue.BsubArrayIndex(job))
+			}
 			return job.RepGroup
 		}
 		fieldLookup["SUBMIT_TIME"] = func(job *jobqueue.Job) string {
 			return job.StartTime.Format(lsfTimeFormat)
 		}
+		fieldLookup["START_TIME"] = func(job *jobqueue.Job) string {
+			return lsfTime(job.StartTime)
+		}
+		fieldLookup["FINISH_TIME"] = func(job *jobqueue.Job) string {
+			if job.State != jobqueue.JobStateBuried && job.State != jobqueue.JobStateComplete {
+				return "-"
+			}
+			return lsfTime(job.EndTime)
+		}
+		fieldLookup["EXIT_CODE"] = func(job *jobqueue.Job) string {
+			if !job.Exited || job.Exitcode == 0 {
+				return "-"
+			}
+			return strconv.Itoa(job.Exitcode)
+		}
 
 		// parse -o
 		var delimiter string
@@ -307,30 +480,34 @@ other than providing compatibility with real bjobs command line args.`,
 			w = tabwriter.NewWriter(os.Stdout, 2, 2, 3, ' ', 0)
 		}
 
-		// get all incomplete jobs
+		// get all incomplete jobs, and with -a the recently completed ones
 		jobs, err := jq.GetIncomplete(0, "", false, false)
 		if err != nil {
 			die(err.Error())
 		}
 
-		// print out details about the ones that have BsubIDs
-		found := false
-		for _, job := range jobs {
-			jid := job.BsubID
-			if jid == 0 {
-				continue
+		if lsfAll {
+			query := &jobqueue.JobQuery{Filter: &jobqueue.JobFilter{EndedAfter: time.Now().Add(-jobqueue.BsubCleanPeriod)}}
+			complete, _, errq := jq.QueryJobs("", true, 0, jobqueue.JobStateComplete, query, false, false)
+			if errq != nil {
+				die(errq.Error())
 			}
+			jobs = append(jobs, complete...)
+		}
 
-			if !found {
-				if !lsfNoHeader {
-					// print header
-					_, errp := fmt.Fprintln(w, strings.Join(fields, delimiter))
-					if errp != nil {
-						warn("failed to print header: %s", errp)
-					}
+		jobs = lsfFilterJobs(jobs, desired, lsfJobName)
+
+		// print out details about the ones that have BsubIDs
+		found := make(map[uint64]bool)
+		for _, job := range jobs {
+			if len(found) == 0 && !lsfNoHeader {
+				// print header
+				_, errp := fmt.Fprintln(w, strings.Join(fields, delimiter))
+				if errp != nil {
+					warn("failed to print header: %s", errp)
 				}
-				found = true
 			}
+			found[job.BsubID] = true
 
 			var vals []string
 			for _, field := range fields {
@@ -350,12 +527,83 @@ other than providing compatibility with real bjobs command line args.`,
 			}
 		}
 
-		if !found {
-			fmt.Println("No unfinished job found")
+		for _, jid := range lsfSortedJobIDs(desired) {
+			if !found[jid] {
+				fmt.Printf("Job <%d> is not found\n", jid)
+			}
+		}
+
+		if len(found) == 0 && len(desired) == 0 {
+			if lsfAll {
+				fmt.Println("No job found")
+			} else {
+				fmt.Println("No unfinished job found")
+			}
 		}
 	},
 }
 
+// lsfTime formats the given time for bjobs output, or returns "-" if it's zero.
+func lsfTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(lsfTimeFormat)
+}
+
+// lsfParseJobIDs converts job id args to uint64s, dying if any aren't numbers.
+func lsfParseJobIDs(args []string) map[uint64]bool {
+	desired := make(map[uint64]bool)
+	for _, arg := range args {
+		i, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			die("could not convert jobID [%s] to an int: %s", arg, err)
+		}
+		desired[i] = true
+	}
+	return desired
+}
+
+// lsfSortedJobIDs returns the keys of the given map in ascending order.
+func lsfSortedJobIDs(ids map[uint64]bool) []uint64 {
+	sorted := make([]uint64, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// lsfFilterJobs returns the jobs that have a BsubID, further restricted to the
+// desired ids (if any) and job name (if not blank), in order of BsubID and
+// array index.
+func lsfFilterJobs(jobs []*jobqueue.Job, desired map[uint64]bool, name string) []*jobqueue.Job {
+	seen := make(map[string]bool)
+	var filtered []*jobqueue.Job
+	for _, job := range jobs {
+		if job.BsubID == 0 || (len(desired) > 0 && !desired[job.BsubID]) || (name != "" && job.RepGroup != name) {
+			continue
+		}
+
+		key := job.Key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		filtered = append(filtered, job)
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		if filtered[i].BsubID != filtered[j].BsubID {
+			return filtered[i].BsubID < filtered[j].BsubID
+		}
+		return jobqueue.BsubArrayIndex(filtered[i]) < jobqueue.BsubArrayIndex(filtered[j])
+	})
+
+	return filtered
+}
+
 // bkill sub-command emulates bkill.
 var lsfBkillCmd = &cobra.Command{
 	Use:   "bkill",
@@ -363,20 +611,13 @@ var lsfBkillCmd = &cobra.Command{
 	Long: `Kill jobs that have been added using the lsf bsub command.
 
 Only supports providing jobIds as command line arguments. Does not currently
-understand any of the options that real bkill does.
+understand any of the options that real bkill does. Giving the jobId of a job
+array kills all of its elements.
 
 Note that if a given jobId is not currently in the queue, always just claims
 that the job has already finished, even if an invalid jobId was supplied.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// convert args to uint64s
-		desired := make(map[uint64]bool)
-		for _, arg := range args {
-			i, err := strconv.Atoi(arg)
-			if err != nil {
-				die("could not convert jobID [%s] to an int: %s", arg, err)
-			}
-			desired[uint64(i)] = true
-		}
+		desired := lsfParseJobIDs(args)
 		if len(desired) == 0 {
 			die("job ID must be specified")
 		}
@@ -397,7 +638,14 @@ that the job has already finished, even if an invalid jobId was supplied.`,
 			die(err.Error())
 		}
 
-		// remove the matching ones
+		// remove the matching ones; all the elements of an array share the
+		// same id, so we only note which ids were terminated after going
+		// through all the jobs. We deal with pending jobs first so that killing
+		// running elements doesn't let other elements of the same array start
+		sort.SliceStable(jobs, func(i, j int) bool {
+			return jobs[i].State != jobqueue.JobStateRunning && jobs[j].State == jobqueue.JobStateRunning
+		})
+		terminated := make(map[uint64]bool)
 	JOBS:
 		for _, job := range jobs {
 			jid := job.BsubID
@@ -433,12 +681,55 @@ that the job has already finished, even if an invalid jobId was supplied.`,
 				continue
 			}
 
-			fmt.Printf("Job <%d> is being terminated\n", jid)
-			delete(desired, jid)
+			terminated[jid] = true
 		}
 
-		for jid := range desired {
-			fmt.Printf("Job <%d>: Job has already finished\n", jid)
+		for _, jid := range lsfSortedJobIDs(desired) {
+			if terminated[jid] {
+				fmt.Printf("Job <%d> is being terminated\n", jid)
+			} else {
+				fmt.Printf("Job <%d>: Job has already finished\n", jid)
+			}
+		}
+	},
+}
+
+// bwait sub-command emulates bwait.
+var lsfBwaitCmd = &cobra.Command{
+	Use:   "bwait",
+	Short: "Wait for jobs added using bsub",
+	Long: `Wait until a dependency condition on jobs added using the lsf bsub
+command is satisfied.
+
+Supports the -w and -t options of real bwait. The -w condition takes the same
+form as for bsub -w, eg. -w 'done(myjob) && ended(123)'. -t is a timeout in
+minutes.
+
+Exits 0 once the condition is satisfied, or exits non-zero if it can never be
+satisfied (eg. because a job that had to be done() was buried) or the timeout
+is reached.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if lsfWaitFor == "" {
+			die("a wait condition must be specified with -w")
+		}
+
+		deps, err := jobqueue.ParseBsubDependencies(lsfWaitFor)
+		if err != nil {
+			die(err.Error())
+		}
+
+		// connect to the server
+		jq := connect(10 * time.Second)
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		_, err = lsfWaitForDependencies(jq, deps, time.Duration(lsfWaitTimeout)*time.Minute)
+		if err != nil {
+			die(err.Error())
 		}
 	},
 }
@@ -459,11 +750,19 @@ func init() {
 	lsfCmd.AddCommand(lsfBsubCmd)
 	lsfCmd.AddCommand(lsfBjobsCmd)
 	lsfCmd.AddCommand(lsfBkillCmd)
+	lsfCmd.AddCommand(lsfBwaitCmd)
 
 	// add lsf single character options using normal method, so these don't get
 	// stripped out from all other wr sub-cmds
 	lsfBjobsCmd.Flags().StringVarP(&lsfFormat, "output", "o", "", "output format")
 	lsfBjobsCmd.Flags().StringVarP(&lsfQueue, "queue", "q", "wr", "queue")
+	lsfBjobsCmd.Flags().BoolVarP(&lsfAll, "all", "a", false, "also show recently finished jobs")
+	lsfBjobsCmd.Flags().StringVarP(&lsfJobName, "jobname", "J", "", "only show jobs with this name")
+	lsfBjobsCmd.Flags().BoolVarP(&lsfWide, "wide", "w", false, "wide format (always on)")
+	lsfBjobsCmd.Flags().StringVarP(&lsfUser, "user", "u", "", "user (ignored)")
+
+	lsfBwaitCmd.Flags().StringVarP(&lsfWaitFor, "wait", "w", "", "dependency condition to wait for")
+	lsfBwaitCmd.Flags().IntVarP(&lsfWaitTimeout, "timeout", "t", 0, "timeout in minutes")
 }
 
 // filterGoFlags splits lsf args, which use single dash named args, from wr
@@ -54,11 +54,16 @@ var (
 	maxServers            int
 	maxLocalCores         int
 	maxLocalRAM           int
+	localResources        string
+	sshHosts              string
 	cloudNoSecurityGroups bool
 	cloudUseConfigDrive   bool
 	useCertDomain         bool
 	runnerSyslog          bool
 	runnerFilelog         string
+	managerStandby        bool
+	migrateFrom           string
+	migrateTo             string
 )
 
 const (
@@ -105,12 +110,13 @@ var managerStartCmd = &cobra.Command{
 If the manager fails to start or dies unexpectedly, you can check the logs which
 are by default found in ~/.wr_[deployment]/log.
 
-To use the openstack scheduler, see 'wr cloud deploy -h' for the details of
-which environment variables you need to use. That help also explains some of the
---cloud* options in further detail.
+To use the cloud scheduler, see 'wr cloud deploy -h' for the details of which
+environment variables your --cloud_provider needs. That help also explains some
+of the --cloud* options in further detail. The openstack, aws and fake
+schedulers are the cloud scheduler with that --cloud_provider.
 
-If using the openstack scheduler, note that you must be running on an OpenStack
-server already. Be sure to set --local_username to your username outside of the
+If using the cloud scheduler, note that you must be running on a server in that
+cloud already. Be sure to set --local_username to your username outside of the
 cloud, so that resources created will not conflict with anyone else in your
 tenant (project) also running wr. When wr creates worker instances, they will
 automatically use the same networks as the manager's server. The first network
@@ -119,9 +125,9 @@ default (if any) and a custom security group will be applied. If there are any
 other networks, they will also be attached to the worker instances, but with no
 security groups.
 
-Instead of creating your own openstack network and instance to start the
-manager on, you can use 'wr cloud deploy -p openstack' to create an OpenStack
-server on which wr manager will be started in OpenStack mode for you. 
+Instead of creating your own cloud network and instance to start the manager on,
+you can use eg. 'wr cloud deploy -p openstack' to create an OpenStack server on
+which wr manager will be started with the cloud scheduler for you.
 
 Similarly, If using the Kubernetes scheduler you must already be running in a
 pod. Be sure to pass a namespace for wr to use that will not have another wr
@@ -140,7 +146,28 @@ you've created yourself, note that --local_username will need to be globally
 unique, since it is used to name the private key that will be created in
 OpenStack, and if a key with that name already exists, the manager will not be
 able to create a new one (or get the existing one), and so will not function
-fully.`,
+fully.
+
+As well as the web interface and REST API, the manager's web port serves
+metrics in the Prometheus text format at /metrics, covering queue sizes, job
+states per reporting group, limit groups, scheduler runners, cloud servers and
+database backups. Configure your scraper to send your token in an
+"Authorization: Bearer" header.
+
+The REST API is described by an OpenAPI document that the manager's web port
+serves at /rest/v1/openapi.json, which does not need your token.
+
+With --standby, instead of starting a new manager, a hot standby is started for
+the manager already running on the configured managerhost. It keeps a copy of
+that manager's database (stored next to your own managerdbfile), and if that
+manager can't be contacted for a while, it becomes the manager, listening on the
+same ports. The standby needs a copy of the manager's token file and
+certificates, and should be started with the same options as the manager. Set
+managerstandbyhost in your config to the host you start the standby on, so that
+wr commands and runners can connect to it after it takes over. Runners that are
+running commands when the manager dies will reconnect to the standby regardless.
+Use 'wr manager stop --standby' to stop the standby; do this before stopping
+the manager if you don't want the standby to take over.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// first we need our working directory to exist
 		createWorkingDir()
@@ -149,7 +176,17 @@ fully.`,
 		// state of the pid file), giving us a meaningful error message in the
 		// most obvious case of failure to start
 		jq := connect(1*time.Second, true)
-		if jq != nil {
+		pidFile := config.ManagerPidFile
+		if managerStandby {
+			if jq == nil {
+				die("a wr manager on %s:%s must be running before a standby can be started for it", config.ManagerHost, config.ManagerPort)
+			}
+			err := jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+			pidFile = standbyPidFile()
+		} else if jq != nil {
 			die("wr manager on port %s is already running (pid %d)", config.ManagerPort, jq.ServerInfo.PID)
 		}
 
@@ -180,7 +217,7 @@ fully.`,
 		preStart := time.Now()
 
 		// if we already have a token file, warn the user
-		if _, errs := os.Stat(config.ManagerTokenFile); errs == nil {
+		if _, errs := os.Stat(config.ManagerTokenFile); errs == nil && !managerStandby {
 			warn("will re-use the existing token in %s", config.ManagerTokenFile)
 		}
 
@@ -190,8 +227,10 @@ fully.`,
 			startJQ(postCreation, preDestroy)
 		} else {
 			config.ToEnv()
-			child, context := daemonize(config.ManagerPidFile, config.ManagerUmask, extraArgs...)
-			if child != nil {
+			child, context := daemonize(pidFile, config.ManagerUmask, extraArgs...)
+			if child != nil && managerStandby {
+				info("wr manager standby for %s:%s started, pid %d", config.ManagerHost, config.ManagerPort, child.Pid)
+			} else if child != nil {
 				// parent; wait a while for our child to bring up the manager
 				// before exiting
 				mTimeout := time.Duration(managerTimeoutSeconds) * time.Second
@@ -264,8 +303,22 @@ var managerStopCmd = &cobra.Command{
 	Long: `Immediately stop the workflow manager, saving its state.
 
 Note that any runners that are currently running will die, along with any
-commands they were running. It is more graceful to use 'drain' instead.`,
+commands they were running. It is more graceful to use 'drain' instead.
+
+With --standby, stops the standby started on this host with 'wr manager start
+--standby' instead, if it has not yet taken over.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if managerStandby {
+			pid, err := daemon.ReadPidFile(standbyPidFile())
+			if err != nil {
+				die("wr manager standby does not seem to be running: %s", err)
+			}
+			if stopdaemon(pid, "pid file "+standbyPidFile()) {
+				info("wr manager standby was stopped")
+			}
+			return
+		}
+
 		// the daemon could be running but be non-responsive, or it could have
 		// exited but left the pid file in place; to best cover all
 		// eventualities we check the pid file first, try and terminate its pid,
@@ -539,6 +592,49 @@ somewhere.)`,
 	},
 }
 
+// migrate sub-command converts a bolt database to sqlite
+var managerMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrate wr's database to sqlite",
+	Long: `Migrate wr's job database from bolt to sqlite.
+
+By default the manager stores its database in a "bolt" file. If you would like
+to be able to query your job history with SQL, you can instead have it use an
+"sqlite" file by setting managerdbbackend in your config file.
+
+This command copies everything in your existing bolt database to a new sqlite
+database. The manager must be stopped first. By default it migrates your
+configured managerdbfile to a new file with a ".sqlite" suffix.
+
+Once done, set managerdbfile to the new file and managerdbbackend to "sqlite"
+(and set managerdbbkfile to a new location, since old backups will be of the
+bolt database), then start the manager again. The old bolt file is left alone.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if migrateFrom == "" {
+			if config.ManagerDBBackend == jobqueue.DBBackendSQLite {
+				die("your managerdbbackend is already sqlite")
+			}
+			migrateFrom = config.ManagerDBFile
+		}
+
+		if pid, err := daemon.ReadPidFile(config.ManagerPidFile); err == nil {
+			die("wr manager is running with pid %d; stop it before migrating its database", pid)
+		}
+
+		if migrateTo == "" {
+			migrateTo = migrateFrom + ".sqlite"
+		}
+
+		migrated, err := jobqueue.MigrateDB(migrateFrom, migrateTo)
+		if err != nil {
+			die("failed to migrate %s: %s", migrateFrom, err)
+		}
+
+		info("migrated %d jobs from %s to %s", migrated, migrateFrom, migrateTo)
+		info("now set managerdbfile: %q and managerdbbackend: %q in your config file", migrateTo, jobqueue.DBBackendSQLite)
+	},
+}
+
 // reportLiveStatus is used by the status command on a working connection to
 // distinguish between the server being in a normal 'started' state or the
 // 'drain' state.
@@ -560,14 +656,18 @@ func init() {
 	managerCmd.AddCommand(managerStopCmd)
 	managerCmd.AddCommand(managerStatusCmd)
 	managerCmd.AddCommand(managerBackupCmd)
+	managerCmd.AddCommand(managerMigrateCmd)
 
 	// flags specific to these sub-commands
 	defaultConfig := internal.DefaultConfig(context.Background())
 	managerStartCmd.Flags().BoolVarP(&foreground, "foreground", "f", false, "do not daemonize")
-	managerStartCmd.Flags().StringVarP(&scheduler, "scheduler", "s", defaultConfig.ManagerScheduler, "['local','lsf','openstack'] job scheduler")
+	managerStartCmd.Flags().StringVarP(&scheduler, "scheduler", "s", defaultConfig.ManagerScheduler, "['local','lsf','slurm','sge','pbs','sshpool','cloud','openstack','aws','fake'] job scheduler")
+	managerStartCmd.Flags().StringVar(&providerName, "cloud_provider", defaultConfig.CloudProvider, "for the cloud scheduler, ['openstack','aws','fake'] cloud provider to spawn servers with")
 	managerStartCmd.Flags().IntVarP(&managerTimeoutSeconds, "timeout", "t", 10, "how long to wait in seconds for the manager to start up")
 	managerStartCmd.Flags().IntVar(&maxLocalCores, "max_cores", runtime.NumCPU(), "maximum number of local cores to use to run cmds; -1 means unlimited, 0 allows only 0-core jobs")
 	managerStartCmd.Flags().IntVar(&maxLocalRAM, "max_ram", defaultMaxRAM, "maximum MB of local memory to use to run cmds; -1 means unlimited, 0 prevents jobs running locally")
+	managerStartCmd.Flags().StringVar(&localResources, "resources", defaultConfig.ManagerResources, "named consumable resources of the local machine that cmds can use, in the form name=count,name=count")
+	managerStartCmd.Flags().StringVar(&sshHosts, "ssh_hosts", defaultConfig.ManagerSSHHosts, "for the sshpool scheduler, hosts to run cmds on, in the form [user@]host:cores=N,ram=MB[,disk=GB][,name=count];[user@]host:...")
 	managerStartCmd.Flags().IntVar(&cloudSpawns, "cloud_spawns", defaultConfig.CloudSpawns, "for cloud schedulers, maximum number of simultaneous server spawns during scale-up")
 	managerStartCmd.Flags().StringVarP(&osPrefix, "cloud_os", "o", defaultConfig.CloudOS, "for cloud schedulers, prefix name of the OS image your servers should use")
 	managerStartCmd.Flags().StringVarP(&osUsername, "cloud_username", "u", defaultConfig.CloudUser, "for cloud schedulers, username needed to log in to the OS image specified by --cloud_os")
@@ -576,6 +676,7 @@ func init() {
 	managerStartCmd.Flags().IntVarP(&osDisk, "cloud_disk", "d", defaultConfig.CloudDisk, "for cloud schedulers, minimum disk (GB) for servers")
 	managerStartCmd.Flags().StringVarP(&flavorRegex, "cloud_flavor", "l", defaultConfig.CloudFlavor, "for cloud schedulers, a regular expression to limit server flavors that can be automatically picked")
 	managerStartCmd.Flags().StringVar(&flavorSets, "cloud_flavor_sets", defaultConfig.CloudFlavorSets, "for cloud schedulers, sets of flavors assigned to different hardware, in the form f1,f2;f3,f4")
+	managerStartCmd.Flags().StringVar(&flavorResources, "cloud_flavor_resources", defaultConfig.CloudFlavorResources, "for cloud schedulers, named consumable resources of flavors, in the form regex:name=count,name=count;regex:name=count")
 	managerStartCmd.Flags().StringVarP(&postCreationScript, "cloud_script", "p", defaultConfig.CloudScript, "for cloud schedulers, path to a start-up script that will be run on each server created")
 	managerStartCmd.Flags().StringVarP(&preDestroyScript, "cloud_destroy_script", "y", defaultConfig.CloudDestroyScript, "for cloud schedulers, path to a script that will be run on each server before it is destroyed")
 	managerStartCmd.Flags().StringVarP(&kubeNamespace, "namespace", "", "", "for the kubernetes scheduler, the namespace to use")
@@ -591,11 +692,17 @@ func init() {
 	managerStartCmd.Flags().BoolVar(&setDomainIP, "set_domain_ip", defaultConfig.ManagerSetDomainIP, "on success, use infoblox to set your domain's IP")
 	managerStartCmd.Flags().BoolVar(&useCertDomain, "use_cert_domain", false, "if cert domain is configured, provide it to spawned clients instead of our IP address")
 	managerStartCmd.Flags().BoolVar(&managerDebug, "debug", false, "include extra debugging information in the logs")
+	managerStartCmd.Flags().BoolVar(&managerStandby, "standby", false, "start a hot standby for the running manager")
 	managerStartCmd.Flags().BoolVar(&runnerSyslog, "runner_syslog", false, "have runners log to syslog on their machines")
 	managerStartCmd.Flags().StringVar(&runnerFilelog, "runner_filelog", "",
 		"have runners log to unique files in the given folder")
 
+	managerStopCmd.Flags().BoolVar(&managerStandby, "standby", false, "stop the standby instead of the manager")
+
 	managerBackupCmd.Flags().StringVarP(&backupPath, "path", "p", "", "backup file path")
+
+	managerMigrateCmd.Flags().StringVarP(&migrateFrom, "from", "f", "", "bolt database file to migrate (defaults to your managerdbfile)")
+	managerMigrateCmd.Flags().StringVarP(&migrateTo, "to", "t", "", "sqlite database file to create (defaults to --from with a .sqlite suffix)")
 }
 
 func logStarted(s *jobqueue.ServerInfo, token []byte) {
@@ -657,14 +764,20 @@ func startJQ(postCreation, preDestroy []byte) {
 		die("wr manager failed to start : %s\n", err)
 	}
 
+	resources, err := jqs.ParseResources(localResources)
+	if err != nil {
+		die("--resources was not specified correctly: %s", err)
+	}
+
 	var schedulerConfig interface{}
 	serverCIDR := ""
 	switch scheduler {
 	case "local":
 		schedulerConfig = &jqs.ConfigLocal{
-			Shell:    config.RunnerExecShell,
-			MaxCores: maxLocalCores,
-			MaxRAM:   maxLocalRAM,
+			Shell:     config.RunnerExecShell,
+			MaxCores:  maxLocalCores,
+			MaxRAM:    maxLocalRAM,
+			Resources: resources,
 		}
 	case "lsf":
 		schedulerConfig = &jqs.ConfigLSF{
@@ -672,7 +785,46 @@ func startJQ(postCreation, preDestroy []byte) {
 			Shell:          config.RunnerExecShell,
 			PrivateKeyPath: config.PrivateKeyPath,
 		}
-	case "openstack":
+	case "slurm":
+		schedulerConfig = &jqs.ConfigSlurm{
+			Deployment:     config.Deployment,
+			Shell:          config.RunnerExecShell,
+			PrivateKeyPath: config.PrivateKeyPath,
+		}
+	case "sge":
+		schedulerConfig = &jqs.ConfigSGE{
+			Deployment:     config.Deployment,
+			Shell:          config.RunnerExecShell,
+			PrivateKeyPath: config.PrivateKeyPath,
+		}
+	case "pbs":
+		schedulerConfig = &jqs.ConfigPBS{
+			Deployment:     config.Deployment,
+			Shell:          config.RunnerExecShell,
+			PrivateKeyPath: config.PrivateKeyPath,
+		}
+	case "sshpool":
+		sshConfig := &jqs.ConfigSSHPool{
+			Hosts:                sshHosts,
+			PrivateKeyPath:       config.PrivateKeyPath,
+			Shell:                config.RunnerExecShell,
+			StateUpdateFrequency: 1 * time.Minute,
+			Umask:                config.ManagerUmask,
+		}
+
+		// like for cloud schedulers, our hosts will need our client.token and
+		// ca.pem files so that runners can connect to us
+		sshConfig.AddConfigFile(config.ManagerTokenFile + ":~/.wr_" + config.Deployment + "/client.token")
+		if config.ManagerCAFile != "" {
+			sshConfig.AddConfigFile(config.ManagerCAFile + ":~/.wr_" + config.Deployment + "/ca.pem")
+		}
+		schedulerConfig = sshConfig
+	case "cloud", "openstack", "aws", "fake":
+		if scheduler != "cloud" {
+			// the other names are aliases of cloud with that provider
+			providerName = scheduler
+		}
+
 		mport, errf := strconv.Atoi(config.ManagerPort)
 		if errf != nil {
 			die("wr manager failed to start : %s\n", errf)
@@ -688,9 +840,10 @@ func startJQ(postCreation, preDestroy []byte) {
 			postCreationForcedCommand = fmt.Sprintf("%s mount -j '%s'", exe, mountJSON)
 		}
 
-		schedulerConfig = &jqs.ConfigOpenStack{
+		schedulerConfig = &jqs.ConfigCloud{
+			Provider:                  providerName,
 			ResourceName:              cloudResourceName(localUsername),
-			SavePath:                  filepath.Join(config.ManagerDir, "cloud_resources.openstack"),
+			SavePath:                  filepath.Join(config.ManagerDir, "cloud_resources."+providerName),
 			ServerPorts:               serverPorts,
 			UseConfigDrive:            cloudUseConfigDrive,
 			OSPrefix:                  osPrefix,
@@ -699,6 +852,7 @@ func startJQ(postCreation, preDestroy []byte) {
 			OSDisk:                    osDisk,
 			FlavorRegex:               flavorRegex,
 			FlavorSets:                flavorSets,
+			FlavorResources:           flavorResources,
 			PostCreationScript:        postCreation,
 			PostCreationForcedCommand: postCreationForcedCommand,
 			PreDestroyScript:          preDestroy,
@@ -709,6 +863,7 @@ func startJQ(postCreation, preDestroy []byte) {
 			SimultaneousSpawns:        cloudSpawns,
 			MaxLocalCores:             &maxLocalCores,
 			MaxLocalRAM:               &maxLocalRAM,
+			LocalResources:            resources,
 			Shell:                     config.RunnerExecShell,
 			CIDR:                      cloudCIDR,
 			Umask:                     config.ManagerUmask,
@@ -742,13 +897,13 @@ func startJQ(postCreation, preDestroy []byte) {
 		if scheduler != kubernetes {
 			// also check that we're actually in the cloud, or this is not going to
 			// work
-			provider, errc := cloud.New(ctx, scheduler, cloudResourceName(localUsername),
-				filepath.Join(config.ManagerDir, "cloud_resources."+scheduler))
+			provider, errc := cloud.New(ctx, providerName, cloudResourceName(localUsername),
+				filepath.Join(config.ManagerDir, "cloud_resources."+providerName))
 			if errc != nil {
-				die("could not connect to %s: %s", scheduler, errc)
+				die("could not connect to %s: %s", providerName, errc)
 			}
 			if !provider.InCloud() {
-				die("according to hostname, this is not an instance in %s", scheduler)
+				die("according to hostname, this is not an instance in %s", providerName)
 			}
 		} else {
 			// kubernetes specific code to check if we are in a wr pod inside a cluster
@@ -767,12 +922,27 @@ func startJQ(postCreation, preDestroy []byte) {
 		runnerCmd += " --logdir " + runnerFilelog
 	}
 
+	webhooks, err := jobqueue.ParseWebhooks(config.ManagerWebhooks)
+	if err != nil {
+		die("bad managerwebhooks config: %s", err)
+	}
+
+	retention, err := jobqueue.ParseRetentionPolicies(config.ManagerRetention)
+	if err != nil {
+		die("bad managerretention config: %s", err)
+	}
+
+	fairShare, err := jobqueue.ParseFairSharePolicy(config.ManagerFairShare)
+	if err != nil {
+		die("bad managerfairshare config: %s", err)
+	}
+
 	var wgDebug strings.Builder
 	waitgroup.Opts.Logger = &wgDebug
 	waitgroup.Opts.Disable = false
 
-	// start the jobqueue server
-	server, msg, token, err := jobqueue.Serve(ctxf, jobqueue.ServerConfig{
+	// start the jobqueue server, or stand by to do so
+	serverConfig := jobqueue.ServerConfig{
 		Port:            config.ManagerPort,
 		WebPort:         config.ManagerWeb,
 		SchedulerName:   scheduler,
@@ -780,8 +950,16 @@ func startJQ(postCreation, preDestroy []byte) {
 		RunnerCmd:       runnerCmd,
 		DBFile:          config.ManagerDBFile,
 		DBFileBackup:    config.ManagerDBBkFile,
+		DBBackend:       config.ManagerDBBackend,
 		TokenFile:       config.ManagerTokenFile,
 		UploadDir:       config.ManagerUploadDir,
+		CopyDir:         config.ManagerCopyDir,
+		JobLogDir:       config.ManagerJobLogDir,
+		JobLogMaxSize:   int64(config.ManagerJobLogMaxMB) * 1024 * 1024,
+		Webhooks:        webhooks,
+		Retention:       retention,
+		ArchiveDir:      config.ManagerArchiveDir,
+		FairShare:       fairShare,
 		CAFile:          config.ManagerCAFile,
 		CertFile:        config.ManagerCertFile,
 		KeyFile:         config.ManagerKeyFile,
@@ -790,7 +968,19 @@ func startJQ(postCreation, preDestroy []byte) {
 		AutoConfirmDead: time.Duration(cloudServersAutoConfirmDead) * time.Minute,
 		Deployment:      config.Deployment,
 		CIDR:            serverCIDR,
-	})
+	}
+
+	var server *jobqueue.Server
+	var msg string
+	var token []byte
+	if managerStandby {
+		server, msg, token, err = standbyJQ(ctxf, serverConfig, serverCIDR)
+		if server == nil && err == nil {
+			return
+		}
+	} else {
+		server, msg, token, err = jobqueue.Serve(ctxf, serverConfig)
+	}
 
 	if msg != "" {
 		info("wr manager : %s", msg)
@@ -829,6 +1019,44 @@ func startJQ(postCreation, preDestroy []byte) {
 	}
 }
 
+// standbyPidFile returns the path to the pid file of a standby manager.
+func standbyPidFile() string {
+	return config.ManagerPidFile + ".standby"
+}
+
+// standbyJQ runs a standby for the manager on the configured host and port,
+// returning the server it starts if it takes over. If the standby stopped
+// without taking over because it was asked to, returns nil server and error.
+func standbyJQ(ctx context.Context, serverConfig jobqueue.ServerConfig, serverCIDR string) (*jobqueue.Server, string, []byte, error) {
+	addr := config.ManagerStandbyHost
+	if addr == "" {
+		var err error
+		addr, err = internal.CurrentIP(serverCIDR)
+		if err != nil {
+			die("wr manager standby could not get the IP address of this host: %s", err)
+		}
+	}
+
+	primary := config.ManagerHost + ":" + config.ManagerPort
+	info("wr manager standing by for %s", primary)
+
+	server, msg, token, err := jobqueue.Standby(ctx, jobqueue.StandbyConfig{
+		PrimaryAddr: primary,
+		Addr:        addr + ":" + config.ManagerPort,
+		ReplicaFile: config.ManagerDBFile + ".standby",
+	}, serverConfig)
+
+	if jqerr, ok := err.(jobqueue.Error); ok && server == nil {
+		switch jqerr.Err {
+		case jobqueue.ErrClosedTerm, jobqueue.ErrClosedInt, jobqueue.ErrStandbyNoToken:
+			info("wr manager standby for %s stopped: %s", primary, jqerr.Err)
+			return nil, "", nil, nil
+		}
+	}
+
+	return server, msg, token, err
+}
+
 // deleteToken should be called on successful, known clean stop of the manager,
 // so that the next time the manager is started it will create a new token.
 // For un-clean exits of the manager, we should keep the token so the manager
@@ -196,6 +196,15 @@ new internal ids is printed.`,
 			req.DiskSet = true
 			setReq = true
 		}
+		if cobraCmd.Flags().Changed("resources") {
+			resources, errp := jqs.ParseResources(cmdResources)
+			if errp != nil {
+				die("--resources was not specified correctly: %s", errp)
+			}
+			req.Resources = resources
+			req.ResourcesSet = true
+			setReq = true
+		}
 
 		other := make(map[string]string)
 		var otherSet bool
@@ -263,6 +272,13 @@ new internal ids is printed.`,
 		if cobraCmd.Flags().Changed("retries") {
 			jm.SetRetries(uint8(cmdRet))
 		}
+		if cobraCmd.Flags().Changed("retry_policy") {
+			policy, err := jobqueue.ParseRetryPolicy(cmdRetryPolicy)
+			if err != nil {
+				die("--retry_policy was not specified correctly: %s", err)
+			}
+			jm.SetRetryPolicy(policy)
+		}
 
 		var deps jobqueue.Dependencies
 		var depsSet bool
@@ -394,11 +410,13 @@ func init() {
 	modCmd.Flags().StringVarP(&cmdTime, "time", "t", "1h", "max time est. [specify units such as m for minutes or h for hours]")
 	modCmd.Flags().Float64Var(&cmdCPUs, "cpus", 1, "cpu cores needed")
 	modCmd.Flags().IntVar(&cmdDisk, "disk", 0, "number of GB of disk space required (default 0)")
+	modCmd.Flags().StringVar(&cmdResources, "resources", "", "named consumable resources required, eg. \"gpu=1\" (\"\" for none)")
 	modCmd.Flags().IntVarP(&cmdOvr, "override", "o", 0, "[0|1|2] should your mem/time estimates override? (default 0)")
 	modCmd.Flags().IntVarP(&cmdPri, "priority", "p", 0, "[0-255] command priority (default 0)")
 	modCmd.Flags().IntVarP(&cmdRet, "retries", "r", 3, "[0-255] number of automatic retries for failed commands")
-	modCmd.Flags().StringVar(&cmdCmdDeps, "cmd_deps", "", "dependencies of your commands, in the form \"command1,cwd1,command2,cwd2...\"")
-	modCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2...\"")
+	modCmd.Flags().StringVar(&cmdRetryPolicy, "retry_policy", "", "how to retry failed cmds, eg. \"backoff=5m;max=2h;no_retry=2;different_host\"")
+	modCmd.Flags().StringVar(&cmdCmdDeps, "cmd_deps", "", "dependencies of your commands, in the form \"command1,cwd1,command2,cwd2[:failure|:any]...\"")
+	modCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2[:failure|:any]...\"")
 	modCmd.Flags().StringVar(&cmdMonitorDocker, "monitor_docker", "", "monitor resource usage of docker container with given --name or --cidfile path")
 	modCmd.Flags().StringVar(&cmdWithDocker, "with_docker", "", "run the cmd inside a docker container running this image")
 	modCmd.Flags().StringVar(&cmdWithSingularity, "with_singularity", "", "run the cmd inside a singularity container running this image")
@@ -113,6 +113,23 @@ complete.`,
 			}
 
 			extraStartInfo = fmt.Sprintf("; LSF job id %s%s", lsfJobID, indexStr)
+		} else if slurmJobID := os.Getenv("SLURM_JOB_ID"); slurmJobID != "" {
+			indexStr := ""
+			if slurmArrayJobID := os.Getenv("SLURM_ARRAY_JOB_ID"); slurmArrayJobID != "" {
+				slurmJobID = slurmArrayJobID
+				indexStr = "_" + os.Getenv("SLURM_ARRAY_TASK_ID")
+			}
+
+			extraStartInfo = fmt.Sprintf("; Slurm job id %s%s", slurmJobID, indexStr)
+		} else if sgeTaskID, isSGE := os.LookupEnv("SGE_TASK_ID"); isSGE {
+			indexStr := ""
+			if sgeTaskID != "undefined" {
+				indexStr = "." + sgeTaskID
+			}
+
+			extraStartInfo = fmt.Sprintf("; SGE job id %s%s", os.Getenv("JOB_ID"), indexStr)
+		} else if pbsJobID := os.Getenv("PBS_JOBID"); pbsJobID != "" {
+			extraStartInfo = fmt.Sprintf("; PBS job id %s", pbsJobID)
 		}
 
 		info("wr runner started for scheduler group '%s'; pid: %d%s", schedgrp, os.Getpid(), extraStartInfo)
@@ -142,6 +159,17 @@ complete.`,
 			}
 		}()
 
+		if config.RunnerCgroup != "" {
+			err = jq.UseCgroups(config.RunnerCgroup)
+			if err != nil {
+				warn("Commands will not be run in cgroups: %s", err)
+			}
+		}
+
+		if config.RunnerStreamLogs > 0 {
+			jq.StreamLogs(time.Duration(config.RunnerStreamLogs) * time.Second)
+		}
+
 		// in case any job we execute has a Cmd that calls `wr add`, we will
 		// override their environment to make that call work
 		var envOverrides []string
@@ -19,12 +19,15 @@
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/jobqueue"
@@ -43,6 +46,7 @@ var (
 	cmdIDStatus     string
 	cmdIDIsSubStr   bool
 	cmdIDIsInternal bool
+	cmdIDIsArray    bool
 	cmdLine         string
 	showBuried      bool
 	showRunning     bool
@@ -51,6 +55,20 @@ var (
 	outputFormat    string
 	statusLimit     int
 	fromHost        string
+	copiedDir       string
+	showArchived    bool
+	statusSort      string
+	statusDesc      bool
+	statusExitCode  int
+	statusFailRsn   string
+	statusStartAft  string
+	statusStartBef  string
+	statusEndAft    string
+	statusEndBef    string
+	statusLimitGrp  string
+	statusDepGrp    string
+	statusPageSize  int
+	statusFairShare bool
 )
 
 // statusCmd represents the status command
@@ -68,10 +86,42 @@ incomplete commands.
 you want the status of now. Combining with -z lets you get the status of jobs
 in multiple report groups, assuming you have arranged that related groups share
 some substring. Alternatively -y lets you specify -i as the internal job id
-reported when using this command.
+reported when using this command, or --array lets you specify -i as the id of a
+job array (as given in "details" output, or to the commands themselves as
+$WR_ARRAY_ID), optionally suffixed with :index to get just the command with
+that index in the array.
 
 The file to provide -f is in the format taken by "wr add".
 
+If your commands used the copy_to_manager behaviour, the files they copied are
+listed in "details" output. Provide --copied with the path to a local directory
+to download those files in to sub-directories of it named after each command's
+internal job id. (In "details" mode you may want to use --limit 0 so that the
+files of every command are downloaded.)
+
+If the manager has been configured with a managerretention policy, completed
+commands are eventually moved out of its database in to archive files. Add
+--archived to -i mode to also search those archives.
+
+If the manager has been configured with a managerfairshare policy, --fairshare
+shows how resources are being shared out between the fair-share accounts,
+instead of the status of any commands. For each account you'll see its share of
+resources, its recent (decayed) usage, its fair-share factor (between 0 and 1;
+amongst commands of equal priority, those in accounts with higher factors run
+first), and how many of its commands are ready and running.
+
+You can filter the commands shown with --host, --exit_code, --fail_reason,
+--limit_grp, --dep_grp and the --started_* and --ended_* options. The latter
+take a time as either a duration ago (eg. 2h), an RFC3339 timestamp (eg.
+2021-06-01T15:04:05Z) or a date (eg. 2021-06-01). In default and -i mode (but
+not with -y or --array) the filtering is done by the manager.
+
+In those same modes (and with --limit 0 for "details" and "json" output),
+commands are retrieved from the manager --page_size at a time, so that you don't
+hit a timeout when there are very many of them. The "plain", "json" and
+"details" output formats are then shown page by page as they are retrieved, and
+you can choose the order commands are shown in with --sort and --desc.
+
 In -f and -l mode you must provide the cwd the commands were set to run in, if
 CwdMatters (and must NOT be provided otherwise). Likewise provide the mounts
 option that was used when the command was added, if any. You can do this by
@@ -84,7 +134,7 @@ name to just the first letter, eg. -o c):
   "summary" shows the counts broken down by report group, along with the mean
     (and standard deviation) resource usage of completed jobs in each report
     group, and the internal identifiers of any buried jobs, broken down by exit
-    code+failure reason.
+    code+failure reason. The counts are also shown for each job array.
   "details" groups jobs with the same state, reason for failure and exitcode
     together and shows the complete details of --limit random jobs in each group
     (and you are told how many are not being displayed). A limit of 0 turns off
@@ -102,6 +152,12 @@ name to just the first letter, eg. -o c):
 		if set > 1 {
 			die("-f, -i and -l are mutually exclusive; only specify one of them")
 		}
+		if statusFairShare && set > 0 {
+			die("--fairshare can't be used with -f, -i or -l")
+		}
+		if showArchived && (cmdIDStatus == "" || cmdIDIsArray) {
+			die("--archived can only be used with -i (and not with --array)")
+		}
 		var cmdState jobqueue.JobState
 		if showBuried {
 			cmdState = jobqueue.JobStateBuried
@@ -119,26 +175,23 @@ name to just the first letter, eg. -o c):
 			}
 		}()
 
+		if statusFairShare {
+			printFairShare(jq)
+			return
+		}
+
 		if !strings.HasPrefix(outputFormat, "d") && !strings.HasPrefix(outputFormat, "j") {
 			statusLimit = 0
 			showStd = false
 			showEnv = false
 		}
-		jobs := getJobs(jq, cmdState, set == 0, statusLimit, showStd, showEnv)
-		showextra := cmdFileStatus == ""
 
-		if fromHost != "" {
-			var subset []*jobqueue.Job
-			for _, job := range jobs {
-				if job.Host == fromHost || job.HostID == fromHost || job.HostIP == fromHost {
-					subset = append(subset, job)
-				}
-			}
-			jobs = subset
-		}
+		pager := newStatusPager(cmd, jq, cmdState, set == 0)
+		showextra := cmdFileStatus == ""
 
 		switch outputFormat {
 		case "counts", "c":
+			jobs := pager.all()
 			var d, re, b, ru, l, c, dep int
 			for _, job := range jobs {
 				switch job.State {
@@ -161,17 +214,21 @@ name to just the first letter, eg. -o c):
 			fmt.Printf("complete: %d\nrunning: %d\nready: %d\ndependent: %d\nlost contact: %d\ndelayed: %d\nburied: %d\n", c, ru, re, dep, l, d, b)
 		case "plain", "p":
 			buried := false
-			for _, job := range jobs {
-				fmt.Printf("%s\t%s\n", job.Key(), job.State)
-				if job.State == jobqueue.JobStateBuried {
-					buried = true
+			for jobs, ok := pager.next(); ok; jobs, ok = pager.next() {
+				for _, job := range jobs {
+					fmt.Printf("%s\t%s\n", job.Key(), job.State)
+					if job.State == jobqueue.JobStateBuried {
+						buried = true
+					}
 				}
 			}
+			pager.finish()
 			if buried {
 				os.Exit(1)
 			}
 			os.Exit(0)
 		case "summary", "s":
+			jobs := pager.all()
 			counts := make(map[string]map[jobqueue.JobState]int)
 			buried := make(map[string]map[string][]string)
 			memory := make(map[string]*runningvariance.RunningStat)
@@ -179,6 +236,8 @@ name to just the first letter, eg. -o c):
 			walltime := make(map[string]*runningvariance.RunningStat)
 			cputime := make(map[string]*runningvariance.RunningStat)
 			startends := make(map[string][]time.Time)
+			arrayCounts := make(map[string]map[jobqueue.JobState]int)
+			arraySizes := make(map[string]int)
 			counts[allRepGrps] = make(map[jobqueue.JobState]int)
 			for _, job := range jobs {
 				if _, exists := counts[job.RepGroup]; !exists {
@@ -191,6 +250,14 @@ name to just the first letter, eg. -o c):
 				counts[job.RepGroup][job.State]++
 				counts[allRepGrps][job.State]++
 
+				if job.ArrayID != "" {
+					if _, exists := arrayCounts[job.ArrayID]; !exists {
+						arrayCounts[job.ArrayID] = make(map[jobqueue.JobState]int)
+						arraySizes[job.ArrayID] = job.ArraySize
+					}
+					arrayCounts[job.ArrayID][state]++
+				}
+
 				if state == jobqueue.JobStateBuried {
 					if _, exists := buried[job.RepGroup]; !exists {
 						buried[job.RepGroup] = make(map[string][]string)
@@ -277,169 +344,55 @@ name to just the first letter, eg. -o c):
 
 				fmt.Printf("%s : complete=%d running=%d ready=%d dependent=%d lost=%d delayed=%d buried=%d%s%s\n", rg, counts[rg][jobqueue.JobStateComplete], counts[rg][jobqueue.JobStateRunning], counts[rg][jobqueue.JobStateReady], counts[rg][jobqueue.JobStateDependent], counts[rg][jobqueue.JobStateLost], counts[rg][jobqueue.JobStateDelayed], counts[rg][jobqueue.JobStateBuried], usage, dead)
 			}
-		case "details", "d":
-			// print out status information for each job
-			for _, job := range jobs {
-				cwd := job.Cwd
-				var mounts string
-				if len(job.MountConfigs) > 0 {
-					mounts = fmt.Sprintf("Mounts: %s\n", job.MountConfigs)
-				}
-				var homeChanged string
-				if job.ActualCwd != "" {
-					cwd = job.ActualCwd
-					if job.ChangeHome {
-						homeChanged = "Changed home: true\n"
-					}
-				}
-				var groups string
-				if len(job.DepGroups) > 0 {
-					groups = fmt.Sprintf("Dependency groups: %s; ", strings.Join(job.DepGroups, ", "))
-				}
-				if len(job.Dependencies) > 0 {
-					groups += fmt.Sprintf("Dependencies: %s; ", strings.Join(job.Dependencies.Stringify(), ", "))
-				}
-				if len(job.LimitGroups) > 0 {
-					groups += fmt.Sprintf("Limit groups: %s; ", strings.Join(job.LimitGroups, ", "))
-				}
-				var containerInfo string
-				if job.WithDocker != "" {
-					containerInfo = fmt.Sprintf("Cmd running inside docker container running image: %s\n", job.WithDocker)
-				}
-				if job.WithSingularity != "" {
-					containerInfo = fmt.Sprintf("Cmd running inside singularity container running image: %s\n", job.WithSingularity)
-				}
-				if job.ContainerMounts != "" {
-					containerInfo += fmt.Sprintf("Container has these mounts: %s\n", job.ContainerMounts)
-				}
-				if job.MonitorDocker != "" {
-					dockerID := job.MonitorDocker
-					if dockerID == "?" {
-						dockerID += " (first container started after cmd)"
-					}
-					containerInfo += fmt.Sprintf("Docker container monitoring turned on for: %s\n", dockerID)
-				}
-				var behaviours string
-				if len(job.Behaviours) > 0 {
-					behaviours = fmt.Sprintf("Behaviours: %s\n", job.Behaviours)
-				}
-				var other string
-				if len(job.Requirements.Other) > 0 {
-					var others []string
-					for key, val := range job.Requirements.Other {
-						others = append(others, key+":"+val)
-					}
-					other = fmt.Sprintf("Resource requirements: %s\n", strings.Join(others, ", "))
-				}
-				fmt.Printf("\n# %s\nCwd: %s\n%s%s%s%s%sId: %s (%s); Requirements group: %s; %sPriority: %d; Attempts: %d\nExpected requirements: { memory: %dMB; time: %s; cpus: %s disk: %dGB }\n", job.Cmd, cwd, mounts, homeChanged, containerInfo, behaviours, other, job.RepGroup, job.Key(), job.ReqGroup, groups, job.Priority, job.Attempts, job.Requirements.RAM, job.Requirements.Time, strconv.FormatFloat(job.Requirements.Cores, 'f', -1, 64), job.Requirements.Disk)
 
-				switch job.State {
-				case jobqueue.JobStateDelayed:
-					ready := job.EndTime.Add(job.DelayTime)
-					fmt.Printf("Status: delayed following a problem, prior to retrying; will become ready in %s (attempted at %s)\n",
-						time.Until(ready).Round(time.Second), job.StartTime.Format(shortTimeFormat))
-				case jobqueue.JobStateReady:
-					fmt.Println("Status: ready to be picked up by a `wr runner`")
-				case jobqueue.JobStateDependent:
-					fmt.Println("Status: dependent on other jobs")
-				case jobqueue.JobStateBuried:
-					fmt.Printf("Status: buried - you need to fix the problem and then `wr retry` (attempted at %s)\n", job.StartTime.Format(shortTimeFormat))
-				case jobqueue.JobStateReserved, jobqueue.JobStateRunning:
-					fmt.Printf("Status: running (started %s)\n", job.StartTime.Format(shortTimeFormat))
-				case jobqueue.JobStateLost:
-					fmt.Printf("Status: lost contact (started %s; lost %s)\n", job.StartTime.Format(shortTimeFormat), job.EndTime.Format(shortTimeFormat))
-				case jobqueue.JobStateComplete:
-					fmt.Printf("Status: complete (started %s; ended %s)\n", job.StartTime.Format(shortTimeFormat), job.EndTime.Format(shortTimeFormat))
-				}
-
-				if job.FailReason != "" {
-					fmt.Printf("Previous problem: %s\n", job.FailReason)
-				}
+			// display summary for each job array
+			arrayIDs := make([]string, 0, len(arrayCounts))
+			for id := range arrayCounts {
+				arrayIDs = append(arrayIDs, id)
+			}
+			sort.Strings(arrayIDs)
 
-				var hostID string
-				if job.HostID != "" {
-					hostID = ", ID: " + job.HostID
+			for _, id := range arrayIDs {
+				ac := arrayCounts[id]
+				fmt.Printf("array %s (%d commands) : complete=%d running=%d ready=%d dependent=%d lost=%d delayed=%d buried=%d\n", id, arraySizes[id], ac[jobqueue.JobStateComplete], ac[jobqueue.JobStateRunning], ac[jobqueue.JobStateReady], ac[jobqueue.JobStateDependent], ac[jobqueue.JobStateLost], ac[jobqueue.JobStateDelayed], ac[jobqueue.JobStateBuried])
+			}
+		case "details", "d":
+			// print out status information for each job
+			for jobs, ok := pager.next(); ok; jobs, ok = pager.next() {
+				for _, job := range jobs {
+					printJobDetails(job, showextra)
 				}
-
-				if job.Exited {
-					prefix := "Stats"
-					if job.State != jobqueue.JobStateComplete {
-						prefix = "Stats of previous attempt"
-					}
-					fmt.Printf("%s: { Exit code: %d; Peak memory: %dMB; Peak disk: %dMB; Wall time: %s; CPU time: %s }\nHost: %s (IP: %s%s); Pid: %d\n", prefix, job.Exitcode, job.PeakRAM, job.PeakDisk, job.WallTime(), job.CPUtime, job.Host, job.HostIP, hostID, job.Pid)
-					if showextra && showStd && job.Exitcode != 0 {
-						stdout, errs := job.StdOut()
-						if errs != nil {
-							warn("problem reading the cmd's STDOUT: %s", errs)
-						} else if stdout != "" {
-							fmt.Printf("StdOut:\n%s\n", stdout)
-						} else {
-							fmt.Printf("StdOut: [none]\n")
-						}
-						stderr, errs := job.StdErr()
-						if errs != nil {
-							warn("problem reading the cmd's STDERR: %s", errs)
-						} else if stderr != "" {
-							fmt.Printf("StdErr:\n%s\n", stderr)
-						} else {
-							fmt.Printf("StdErr: [none]\n")
-						}
-					}
-				} else if job.State == jobqueue.JobStateRunning || job.State == jobqueue.JobStateLost {
-					fmt.Printf("Stats: { Wall time: %s }\nHost: %s (IP: %s%s); Pid: %d\n", job.WallTime(), job.Host, job.HostIP, hostID, job.Pid)
-					//*** we should be able to peek at STDOUT & STDERR, and see
-					// Peak memory during a run... but is that possible/ too
-					// expensive? Maybe we could communicate directly with the
-					// runner?...
-				} else if showextra && showStd {
-					// it's possible for jobs that got buried before they even
-					// ran to have details of the bury in their stderr
-					stderr, errs := job.StdErr()
-					if errs == nil && stderr != "" {
-						fmt.Printf("Details: %s\n", stderr)
+			}
+			pager.finish()
+		case "json", "j":
+			// stream out a JSON array of job statuses, a page at a time
+			var buf bytes.Buffer
+			encoder := json.NewEncoder(&buf)
+			encoder.SetEscapeHTML(false)
+			fmt.Print("[")
+			first := true
+			for jobs, ok := pager.next(); ok; jobs, ok = pager.next() {
+				for _, job := range jobs {
+					jstatus, errs := job.ToStatus()
+					if errs != nil {
+						die("failed to convert job to status: %s", errs)
 					}
-				}
 
-				if showextra && showEnv {
-					env, erre := job.Env()
-					if erre != nil {
-						warn("problem reading the cmd's Env: %s", erre)
-					} else {
-						fmt.Printf("Env: %s\n", env)
+					buf.Reset()
+					err = encoder.Encode(jstatus)
+					if err != nil {
+						die("failed to encode jobs: %s", err)
 					}
-				}
 
-				if job.Similar > 0 {
-					fr := ""
-					if job.FailReason != "" {
-						fr = " and problem"
-					}
-					er := ""
-					if job.Exited && job.Exitcode != 0 {
-						if fr != "" {
-							er = ", exit code"
-						} else {
-							er = " and exit code"
-						}
+					if !first {
+						fmt.Print(",")
 					}
-					fmt.Printf("+ %d other commands with the same status%s%s\n", job.Similar, er, fr)
+					first = false
+					fmt.Print(strings.TrimSuffix(buf.String(), "\n"))
 				}
 			}
-		case "json", "j":
-			jstati := make([]jobqueue.JStatus, len(jobs))
-			for i, job := range jobs {
-				jstati[i], err = job.ToStatus()
-				if err != nil {
-					die("failed to convert job to status: %s", err)
-				}
-			}
-
-			encoder := json.NewEncoder(os.Stdout)
-			encoder.SetEscapeHTML(false)
-			err = encoder.Encode(jstati)
-			if err != nil {
-				die("failed to encode jobs: %s", err)
-			}
+			pager.finish()
+			fmt.Println("]")
 		default:
 			die("invalid -o format specified")
 		}
@@ -456,21 +409,60 @@ func init() {
 	statusCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want the status of")
 	statusCmd.Flags().BoolVarP(&cmdIDIsSubStr, "search", "z", false, "treat -i as a substring to match against all report groups")
 	statusCmd.Flags().BoolVarP(&cmdIDIsInternal, "internal", "y", false, "treat -i as an internal job id")
+	statusCmd.Flags().BoolVar(&cmdIDIsArray, "array", false, "treat -i as a job array id, optionally suffixed with :index")
 	statusCmd.Flags().StringVarP(&cmdLine, "cmdline", "l", "", "a command line you want the status of")
 	statusCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "working dir that the command(s) specified by -l or -f were set to run in")
 	statusCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mounts that the command(s) specified by -l or -f were set to use (JSON format)")
 	statusCmd.Flags().StringVar(&mountSimple, "mounts", "", "mounts that the command(s) specified by -l or -f were set to use (simple format)")
 	statusCmd.Flags().BoolVarP(&showBuried, "buried", "b", false, "in default or -i mode only, only show the status of buried commands")
 	statusCmd.Flags().StringVar(&fromHost, "host", "", "filter output to only show the status of commands that ran on the given host (ID, name or IP)")
+	statusCmd.Flags().IntVar(&statusExitCode, "exit_code", 0, "filter output to only show the status of commands that exited with this exit code")
+	statusCmd.Flags().StringVar(&statusFailRsn, "fail_reason", "", "filter output to only show the status of commands whose failure reason contains this")
+	statusCmd.Flags().StringVar(&statusStartAft, "started_after", "", "filter output to only show the status of commands that started after this time")
+	statusCmd.Flags().StringVar(&statusStartBef, "started_before", "", "filter output to only show the status of commands that started before this time")
+	statusCmd.Flags().StringVar(&statusEndAft, "ended_after", "", "filter output to only show the status of commands that ended after this time")
+	statusCmd.Flags().StringVar(&statusEndBef, "ended_before", "", "filter output to only show the status of commands that ended before this time")
+	statusCmd.Flags().StringVar(&statusLimitGrp, "limit_grp", "", "filter output to only show the status of commands in this limit group")
+	statusCmd.Flags().StringVar(&statusDepGrp, "dep_grp", "", "filter output to only show the status of commands in this dependency group")
 	statusCmd.Flags().BoolVarP(&showRunning, "running", "r", false, "in default or -i mode only, only show the status of running commands")
 	statusCmd.Flags().BoolVarP(&showStd, "std", "s", false, "in -o d mode, except in -f mode, also show the most recent STDOUT and STDERR of incomplete commands")
 	statusCmd.Flags().BoolVarP(&showEnv, "env", "e", false, "in -o d mode, except in -f mode, also show the environment variables the command(s) ran with")
 	statusCmd.Flags().StringVarP(&outputFormat, "output", "o", "details", "['counts','summary','details','json'] output format")
 	statusCmd.Flags().IntVar(&statusLimit, "limit", 1, "in -o d mode, number of commands that share the same properties to display; 0 displays all")
+	statusCmd.Flags().StringVar(&copiedDir, "copied", "", "download files copied to the manager by the chosen commands in to this directory")
+	statusCmd.Flags().StringVar(&statusSort, "sort", "", "['key','start','end','peakram','exitcode'] order to show commands in")
+	statusCmd.Flags().BoolVar(&statusDesc, "desc", false, "show commands in descending --sort order")
+	statusCmd.Flags().IntVar(&statusPageSize, "page_size", 1000, "number of commands to retrieve from the manager at a time; 0 gets them all at once")
+	statusCmd.Flags().BoolVar(&showArchived, "archived", false, "in -i mode, also search completed commands that were archived by the manager")
+	statusCmd.Flags().BoolVar(&statusFairShare, "fairshare", false, "show how resources are being shared between fair-share accounts, instead of the status of commands")
 
 	statusCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 }
 
+// printFairShare prints a table of the manager's fair-share accounts.
+func printFairShare(jq *jobqueue.Client) {
+	accounts, err := jq.GetFairShare()
+	if err != nil {
+		die("%s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Account\tShare\tUsage\tUsage %\tFactor\tReady\tRunning")
+	for _, a := range accounts {
+		name := a.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%s\t%.1f%%\t%.0f\t%.1f%%\t%.3f\t%d\t%d\n",
+			name, a.Share*100, a.Usage, a.UsageFraction*100, a.Factor, a.Ready, a.Running)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		die("%s", err)
+	}
+}
+
 func countGetJobArgs() int {
 	set := 0
 	if cmdFileStatus != "" {
@@ -488,6 +480,177 @@ func countGetJobArgs() int {
 	return set
 }
 
+// printJobDetails prints out the complete status information of the given job
+// for the "details" output format. showextra controls if STDOUT, STDERR and
+// Env are shown, when also requested with --std and --env.
+func printJobDetails(job *jobqueue.Job, showextra bool) {
+	cwd := job.Cwd
+	var mounts string
+	if len(job.MountConfigs) > 0 {
+		mounts = fmt.Sprintf("Mounts: %s\n", job.MountConfigs)
+	}
+	var homeChanged string
+	if job.ActualCwd != "" {
+		cwd = job.ActualCwd
+		if job.ChangeHome {
+			homeChanged = "Changed home: true\n"
+		}
+	}
+	var groups string
+	if len(job.DepGroups) > 0 {
+		groups = fmt.Sprintf("Dependency groups: %s; ", strings.Join(job.DepGroups, ", "))
+	}
+	if len(job.Dependencies) > 0 {
+		groups += fmt.Sprintf("Dependencies: %s; ", strings.Join(job.Dependencies.Stringify(), ", "))
+	}
+	if len(job.LimitGroups) > 0 {
+		groups += fmt.Sprintf("Limit groups: %s; ", strings.Join(job.LimitGroups, ", "))
+	}
+	var containerInfo string
+	if job.WithDocker != "" {
+		containerInfo = fmt.Sprintf("Cmd running inside docker container running image: %s\n", job.WithDocker)
+	}
+	if job.WithSingularity != "" {
+		containerInfo = fmt.Sprintf("Cmd running inside singularity container running image: %s\n", job.WithSingularity)
+	}
+	if job.ContainerMounts != "" {
+		containerInfo += fmt.Sprintf("Container has these mounts: %s\n", job.ContainerMounts)
+	}
+	if job.MonitorDocker != "" {
+		dockerID := job.MonitorDocker
+		if dockerID == "?" {
+			dockerID += " (first container started after cmd)"
+		}
+		containerInfo += fmt.Sprintf("Docker container monitoring turned on for: %s\n", dockerID)
+	}
+	var behaviours string
+	if len(job.Behaviours) > 0 {
+		behaviours = fmt.Sprintf("Behaviours: %s\n", job.Behaviours)
+	}
+	if job.RetryPolicy != nil {
+		behaviours += fmt.Sprintf("Retry policy: %s\n", job.RetryPolicy)
+	}
+	if job.Checkpoint != nil {
+		saved := ""
+		if job.CheckpointSaved {
+			saved = " (saved)"
+		}
+		behaviours += fmt.Sprintf("Checkpoint: %s%s\n", job.Checkpoint, saved)
+	}
+	var array string
+	if job.ArrayID != "" {
+		array = fmt.Sprintf("Job array: %s (index %d of %d)\n", job.ArrayID, job.ArrayIndex, job.ArraySize)
+	}
+	var copied string
+	if len(job.CopiedFiles) > 0 {
+		copied = fmt.Sprintf("Copied to manager: %s\n", strings.Join(job.CopiedFiles, ", "))
+	}
+	if job.Owner != "" {
+		copied += fmt.Sprintf("Owner: %s\n", job.Owner)
+	}
+	var other string
+	if len(job.Requirements.Other) > 0 {
+		var others []string
+		for key, val := range job.Requirements.Other {
+			others = append(others, key+":"+val)
+		}
+		other = fmt.Sprintf("Resource requirements: %s\n", strings.Join(others, ", "))
+	}
+	fmt.Printf("\n# %s\nCwd: %s\n%s%s%s%s%s%sId: %s (%s); Requirements group: %s; %sPriority: %d; Attempts: %d\nExpected requirements: { memory: %dMB; time: %s; cpus: %s disk: %dGB }\n", job.Cmd, cwd, mounts, homeChanged, containerInfo, behaviours, array+copied, other, job.RepGroup, job.Key(), job.ReqGroup, groups, job.Priority, job.Attempts, job.Requirements.RAM, job.Requirements.Time, strconv.FormatFloat(job.Requirements.Cores, 'f', -1, 64), job.Requirements.Disk)
+
+	switch job.State {
+	case jobqueue.JobStateDelayed:
+		ready := job.EndTime.Add(job.DelayTime)
+		fmt.Printf("Status: delayed following a problem, prior to retrying; will become ready in %s (attempted at %s)\n",
+			time.Until(ready).Round(time.Second), job.StartTime.Format(shortTimeFormat))
+	case jobqueue.JobStateReady:
+		fmt.Println("Status: ready to be picked up by a `wr runner`")
+	case jobqueue.JobStateDependent:
+		fmt.Println("Status: dependent on other jobs")
+	case jobqueue.JobStateBuried:
+		fmt.Printf("Status: buried - you need to fix the problem and then `wr retry` (attempted at %s)\n", job.StartTime.Format(shortTimeFormat))
+	case jobqueue.JobStateReserved, jobqueue.JobStateRunning:
+		fmt.Printf("Status: running (started %s)\n", job.StartTime.Format(shortTimeFormat))
+	case jobqueue.JobStateLost:
+		fmt.Printf("Status: lost contact (started %s; lost %s)\n", job.StartTime.Format(shortTimeFormat), job.EndTime.Format(shortTimeFormat))
+	case jobqueue.JobStateComplete:
+		fmt.Printf("Status: complete (started %s; ended %s)\n", job.StartTime.Format(shortTimeFormat), job.EndTime.Format(shortTimeFormat))
+	}
+
+	if job.FailReason != "" {
+		fmt.Printf("Previous problem: %s\n", job.FailReason)
+	}
+
+	var hostID string
+	if job.HostID != "" {
+		hostID = ", ID: " + job.HostID
+	}
+
+	if job.Exited {
+		prefix := "Stats"
+		if job.State != jobqueue.JobStateComplete {
+			prefix = "Stats of previous attempt"
+		}
+		fmt.Printf("%s: { Exit code: %d; Peak memory: %dMB; Peak disk: %dMB; Wall time: %s; CPU time: %s }\nHost: %s (IP: %s%s); Pid: %d\n", prefix, job.Exitcode, job.PeakRAM, job.PeakDisk, job.WallTime(), job.CPUtime, job.Host, job.HostIP, hostID, job.Pid)
+		if showextra && showStd && job.Exitcode != 0 {
+			stdout, errs := job.StdOut()
+			if errs != nil {
+				warn("problem reading the cmd's STDOUT: %s", errs)
+			} else if stdout != "" {
+				fmt.Printf("StdOut:\n%s\n", stdout)
+			} else {
+				fmt.Printf("StdOut: [none]\n")
+			}
+			stderr, errs := job.StdErr()
+			if errs != nil {
+				warn("problem reading the cmd's STDERR: %s", errs)
+			} else if stderr != "" {
+				fmt.Printf("StdErr:\n%s\n", stderr)
+			} else {
+				fmt.Printf("StdErr: [none]\n")
+			}
+		}
+	} else if job.State == jobqueue.JobStateRunning || job.State == jobqueue.JobStateLost {
+		fmt.Printf("Stats: { Wall time: %s }\nHost: %s (IP: %s%s); Pid: %d\n", job.WallTime(), job.Host, job.HostIP, hostID, job.Pid)
+		//*** we should be able to peek at STDOUT & STDERR, and see
+		// Peak memory during a run... but is that possible/ too
+		// expensive? Maybe we could communicate directly with the
+		// runner?...
+	} else if showextra && showStd {
+		// it's possible for jobs that got buried before they even
+		// ran to have details of the bury in their stderr
+		stderr, errs := job.StdErr()
+		if errs == nil && stderr != "" {
+			fmt.Printf("Details: %s\n", stderr)
+		}
+	}
+
+	if showextra && showEnv {
+		env, erre := job.Env()
+		if erre != nil {
+			warn("problem reading the cmd's Env: %s", erre)
+		} else {
+			fmt.Printf("Env: %s\n", env)
+		}
+	}
+
+	if job.Similar > 0 {
+		fr := ""
+		if job.FailReason != "" {
+			fr = " and problem"
+		}
+		er := ""
+		if job.Exited && job.Exitcode != 0 {
+			if fr != "" {
+				er = ", exit code"
+			} else {
+				er = " and exit code"
+			}
+		}
+		fmt.Printf("+ %d other commands with the same status%s%s\n", job.Similar, er, fr)
+	}
+}
+
 func getJobs(jq *jobqueue.Client, cmdState jobqueue.JobState, all bool, statusLimit int, showStd, showEnv bool) []*jobqueue.Job {
 	var jobs []*jobqueue.Job
 	var err error
@@ -497,7 +660,11 @@ func getJobs(jq *jobqueue.Client, cmdState jobqueue.JobState, all bool, statusLi
 		// get all jobs
 		jobs, err = jq.GetIncomplete(statusLimit, cmdState, showStd, showEnv)
 	case cmdIDStatus != "":
-		if cmdIDIsInternal {
+		if cmdIDIsArray {
+			// get the jobs in this array, or just the one at the given index
+			arrayID, index := parseArrayID(cmdIDStatus)
+			jobs, err = jq.GetByArray(arrayID, index, showStd, showEnv)
+		} else if cmdIDIsInternal {
 			// get the job with this internal id
 			var job *jobqueue.Job
 			job, err = jq.GetByEssence(&jobqueue.JobEssence{
@@ -541,6 +708,227 @@ func getJobs(jq *jobqueue.Client, cmdState jobqueue.JobState, all bool, statusLi
 	return jobs
 }
 
+// getArchivedJobs gets the jobs specified by -i from the manager's archive of
+// completed jobs.
+func getArchivedJobs(jq *jobqueue.Client, statusLimit int) []*jobqueue.Job {
+	var keys []string
+	repGroup := cmdIDStatus
+	if cmdIDIsInternal {
+		keys = []string{cmdIDStatus}
+		repGroup = ""
+	}
+
+	jobs, err := jq.GetArchived(keys, repGroup, cmdIDIsSubStr, statusLimit)
+	if err != nil {
+		die("failed to get archived jobs corresponding to your settings: %s", err)
+	}
+
+	return jobs
+}
+
+// statusPager gets the jobs desired by the user's status options, a page at a
+// time when the manager can do the paging for us.
+type statusPager struct {
+	jq      *jobqueue.Client
+	state   jobqueue.JobState
+	allJobs bool
+	query   *jobqueue.JobQuery
+	byQuery bool
+	done    bool
+	copied  int
+}
+
+// newStatusPager creates a statusPager based on the user's status options.
+func newStatusPager(cmd *cobra.Command, jq *jobqueue.Client, state jobqueue.JobState, all bool) *statusPager {
+	byQuery := all || (cmdIDStatus != "" && !cmdIDIsInternal && !cmdIDIsArray)
+	paged := byQuery && statusLimit == 0
+
+	if (statusSort != "" || statusDesc) && !paged {
+		die("--sort and --desc can only be used in default or -i mode (but not with -y or --array), and with --limit 0 in -o d and -o j modes")
+	}
+
+	query := &jobqueue.JobQuery{
+		Filter: statusFilter(cmd),
+		SortBy: jobqueue.JobSortKey(statusSort),
+		Desc:   statusDesc,
+	}
+	if paged {
+		query.PageSize = statusPageSize
+	}
+
+	return &statusPager{
+		jq:      jq,
+		state:   state,
+		allJobs: all,
+		query:   query,
+		byQuery: byQuery,
+	}
+}
+
+// next returns the next page of jobs, and false if there were no more pages.
+// Also downloads the copied files of the jobs if --copied was supplied.
+func (p *statusPager) next() ([]*jobqueue.Job, bool) {
+	if p.done {
+		return nil, false
+	}
+
+	var jobs []*jobqueue.Job
+	if p.byQuery {
+		var cursor string
+		var err error
+		jobs, cursor, err = p.jq.QueryJobs(cmdIDStatus, cmdIDIsSubStr, statusLimit, p.state, p.query, showStd, showEnv)
+		if err != nil {
+			die("failed to get jobs corresponding to your settings: %s", err)
+		}
+		p.query.Cursor = cursor
+		p.done = cursor == ""
+	} else {
+		jobs = filterJobs(getJobs(p.jq, p.state, p.allJobs, statusLimit, showStd, showEnv), p.query.Filter)
+		p.done = true
+	}
+
+	if p.done && showArchived && p.state == "" {
+		jobs = append(jobs, filterJobs(getArchivedJobs(p.jq, statusLimit), p.query.Filter)...)
+	}
+
+	if copiedDir != "" {
+		p.copied += downloadCopiedFiles(p.jq, jobs, copiedDir)
+	}
+
+	return jobs, true
+}
+
+// all returns the jobs of all remaining pages.
+func (p *statusPager) all() []*jobqueue.Job {
+	var all []*jobqueue.Job
+	for jobs, ok := p.next(); ok; jobs, ok = p.next() {
+		all = append(all, jobs...)
+	}
+	p.finish()
+
+	return all
+}
+
+// finish should be called after getting all pages, to report on any file
+// downloads.
+func (p *statusPager) finish() {
+	if copiedDir != "" {
+		info("downloaded %d copied files in to %s", p.copied, copiedDir)
+	}
+}
+
+// statusFilter creates a JobFilter from the user's filtering options, returning
+// nil if none were supplied.
+func statusFilter(cmd *cobra.Command) *jobqueue.JobFilter {
+	filter := &jobqueue.JobFilter{
+		Host:          fromHost,
+		FailReason:    statusFailRsn,
+		StartedAfter:  parseStatusTime(statusStartAft),
+		StartedBefore: parseStatusTime(statusStartBef),
+		EndedAfter:    parseStatusTime(statusEndAft),
+		EndedBefore:   parseStatusTime(statusEndBef),
+		LimitGroup:    statusLimitGrp,
+		DepGroup:      statusDepGrp,
+	}
+
+	if cmd.Flags().Changed("exit_code") {
+		exitCode := statusExitCode
+		filter.ExitCode = &exitCode
+	}
+
+	if *filter == (jobqueue.JobFilter{}) {
+		return nil
+	}
+
+	return filter
+}
+
+// parseStatusTime parses a time supplied to one of the --started_* or --ended_*
+// options, which can be a duration ago, an RFC3339 timestamp or a date.
+// Returns the zero time if value is blank.
+func parseStatusTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d)
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		die("'%s' is not a valid duration, RFC3339 timestamp or date", value)
+	}
+
+	return t
+}
+
+// filterJobs returns the subset of the given jobs that match the given filter.
+func filterJobs(jobs []*jobqueue.Job, filter *jobqueue.JobFilter) []*jobqueue.Job {
+	if filter == nil {
+		return jobs
+	}
+
+	var subset []*jobqueue.Job
+	for _, job := range jobs {
+		if filter.Matches(job) {
+			subset = append(subset, job)
+		}
+	}
+
+	return subset
+}
+
+// parseArrayID parses an array id optionally suffixed with :index, returning
+// the id and index, which is -1 if there was no suffix.
+func parseArrayID(id string) (string, int) {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) == 1 {
+		return id, -1
+	}
+
+	index, err := strconv.Atoi(parts[1])
+	if err != nil || index < 0 {
+		die("bad array index in '%s'", id)
+	}
+
+	return parts[0], index
+}
+
+// downloadCopiedFiles gets the files that the given jobs copied to the manager
+// using the copy_to_manager behaviour, and stores them in sub-directories of dir
+// named after the job keys. Returns the number of files downloaded.
+func downloadCopiedFiles(jq *jobqueue.Client, jobs []*jobqueue.Job, dir string) int {
+	downloaded := 0
+	for _, job := range jobs {
+		for _, path := range job.CopiedFiles {
+			data, err := jq.GetCopiedFile(job.Key(), path)
+			if err != nil {
+				warn("failed to get file %s copied by job %s: %s", path, job.Key(), err)
+				continue
+			}
+
+			dest := filepath.Join(dir, job.Key(), path)
+			err = os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+			if err != nil {
+				die("could not create directory for %s: %s", dest, err)
+			}
+
+			err = os.WriteFile(dest, data, 0o644)
+			if err != nil {
+				die("could not write %s: %s", dest, err)
+			}
+			downloaded++
+		}
+	}
+
+	return downloaded
+}
+
 func jobsToJobEssenses(jobs []*jobqueue.Job) []*jobqueue.JobEssence {
 	jes := make([]*jobqueue.JobEssence, 0, len(jobs))
 	for _, job := range jobs {
@@ -0,0 +1,211 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var (
+	userName      string
+	userAdmin     bool
+	userTokenFile string
+)
+
+// userCmd represents the user command
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users of the manager",
+	Long: `Manage the users of the manager.
+
+By default, only the person who started the manager can use it, because only
+they can read the manager's token file. An admin (such as the person who started
+the manager) can add other named users, who each get their own token.
+
+Users should write their token to a file that only they can read, and set the
+managertokenfile option in their own config file (or the
+WR_MANAGERTOKENFILE environment variable) to the path of that file. The manager
+will then identify them by name: they will own the commands they add, and can
+only modify, kill, remove and retry their own commands.
+
+Admin users can act on anyone's commands, and can also drain, pause, resume and
+stop the manager, take backups of its database, and manage users.
+
+Use the sub-commands to add, list and remove users, or to see who the manager
+thinks you are.`,
+}
+
+// add sub-command adds a new user
+var userAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a new user",
+	Long: `Add a new user of the manager, and get their token.
+
+Give the user a unique --name (letters, numbers, _, . and - only). Supply
+--admin if they should have the same rights as the person who started the
+manager.
+
+The user's token is printed to STDOUT, or written to the file given by --file,
+which will be readable only by you; you must pass the token on to the user
+securely. This is your only chance to get the token: if it is lost, remove the
+user and add them again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if userName == "" {
+			die("--name is required")
+		}
+
+		jq := userConnect()
+		defer userDisconnect(jq)
+
+		u, err := jq.AddUser(userName, userAdmin)
+		if err != nil {
+			die("%s", err)
+		}
+
+		if userTokenFile == "" {
+			fmt.Println(string(u.Token))
+			return
+		}
+
+		err = os.WriteFile(userTokenFile, u.Token, 0o600)
+		if err != nil {
+			die("could not write token file: %s", err)
+		}
+
+		info("Added user %s; their token is in %s", u.Name, userTokenFile)
+	},
+}
+
+// list sub-command lists the current users
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List users",
+	Long: `List the users of the manager.
+
+For each, you'll see their name, if they are an admin, and when they were added.
+The user with no added time is the person who started the manager. Only admins
+can list users.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := userConnect()
+		defer userDisconnect(jq)
+
+		users, err := jq.GetUsers()
+		if err != nil {
+			die("%s", err)
+		}
+
+		for _, u := range users {
+			printUser(u)
+		}
+	},
+}
+
+// remove sub-command removes a user
+var userRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Remove a user",
+	Long: `Remove a user of the manager, so that their token stops working.
+
+Specify the --name you gave to "wr user add". Commands they added are not
+affected. Only admins can remove users.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if userName == "" {
+			die("--name is required")
+		}
+
+		jq := userConnect()
+		defer userDisconnect(jq)
+
+		err := jq.RemoveUser(userName)
+		if err != nil {
+			die("%s", err)
+		}
+
+		info("Removed user %s", userName)
+	},
+}
+
+// whoami sub-command shows who the manager thinks you are
+var userWhoAmICmd = &cobra.Command{
+	Use:   "whoami",
+	Short: "Show which user you are",
+	Long: `Show which user the manager identifies you as, based on the token in your
+managertokenfile.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := userConnect()
+		defer userDisconnect(jq)
+
+		u, err := jq.WhoAmI()
+		if err != nil {
+			die("%s", err)
+		}
+
+		printUser(u)
+	},
+}
+
+// userConnect connects to the manager using the --timeout flag.
+func userConnect() *jobqueue.Client {
+	return connect(time.Duration(timeoutint) * time.Second)
+}
+
+// userDisconnect disconnects from the manager, warning on failure.
+func userDisconnect(jq *jobqueue.Client) {
+	err := jq.Disconnect()
+	if err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+}
+
+// printUser prints out the details of a user.
+func printUser(u *jobqueue.User) {
+	var admin, added string
+	if u.Admin {
+		admin = " (admin)"
+	}
+	if !u.Created.IsZero() {
+		added = "; added " + u.Created.Format(time.RFC1123)
+	}
+	fmt.Printf("%s%s%s\n", u.Name, admin, added)
+}
+
+func init() {
+	RootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userAddCmd)
+	userCmd.AddCommand(userListCmd)
+	userCmd.AddCommand(userRemoveCmd)
+	userCmd.AddCommand(userWhoAmICmd)
+
+	// flags specific to these sub-commands
+	userAddCmd.Flags().StringVarP(&userName, "name", "n", "", "unique name for the new user")
+	userAddCmd.Flags().BoolVar(&userAdmin, "admin", false, "the new user can manage the manager and act on anyone's commands")
+	userAddCmd.Flags().StringVarP(&userTokenFile, "file", "f", "", "write the new user's token to this file instead of STDOUT")
+	userRemoveCmd.Flags().StringVarP(&userName, "name", "n", "", "name of the user to remove")
+
+	userAddCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	userListCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	userRemoveCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	userWhoAmICmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -0,0 +1,398 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var (
+	workflowFile  string
+	workflowName  string
+	workflowRetry bool
+)
+
+// workflowStateOrder is the order we report the states of a workflow step's
+// commands in.
+var workflowStateOrder = []jobqueue.JobState{
+	jobqueue.JobStateComplete,
+	jobqueue.JobStateRunning,
+	jobqueue.JobStateLost,
+	jobqueue.JobStateReserved,
+	jobqueue.JobStateReady,
+	jobqueue.JobStateDelayed,
+	jobqueue.JobStateDependent,
+	jobqueue.JobStateBuried,
+}
+
+// workflowCmd represents the workflow command
+var workflowCmd = &cobra.Command{
+	Use:   "workflow",
+	Short: "Run workflows of dependent commands",
+	Long: `Run workflows of dependent commands.
+
+Rather than calling "wr add" multiple times with carefully chosen --dep_grps and
+--deps, you can describe a workflow in a YAML file and add all of its commands
+in one go with "wr workflow run". The file looks like:
+
+name: calling
+defaults:
+  memory: 2G
+  cwd: /data/calling
+steps:
+  - name: align
+    cmd: align {sample}.fq > {sample}.bam
+    for_each:
+      sample: [a, b, c]
+  - name: call
+    cmd: call {sample}.bam > {sample}.vcf
+    for_each:
+      sample: [a, b, c]
+    after: [align]
+  - name: merge
+    cmd: merge a.vcf b.vcf c.vcf > all.vcf
+    after: [call]
+
+The name (letters, numbers, _, . and -) must be unique amongst your workflows.
+Each step needs a unique name (letters, numbers, _ and -) and a cmd, and takes
+all the same properties as the JSON lines you can give "wr add", except for
+rep_grp, eg. memory, time, cpus, disk, retries, mounts, on_failure, dep_grps,
+deps and so on. Properties in defaults apply to every step that doesn't specify
+them itself.
+
+A step with for_each (or array_table or array_ranges) is run once for each of
+the given values, with {name} placeholders in its cmd replaced by the values.
+
+A step waits for all the commands of the steps it comes "after" to complete,
+except that when it and an earlier step are both given the same for_each, each
+of its commands only waits for the corresponding command of the earlier step.
+
+The commands of each step get the report group "wf.<workflow name>.<step name>",
+which you can use with the other wr commands, and are placed in a dependency
+group of the same name, which you can depend on from commands you add
+separately.
+
+Use the sub-commands to run workflows, see their status and cancel them.`,
+}
+
+// run sub-command adds the commands of a workflow
+var workflowRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run a workflow",
+	Long: `Run a workflow by adding all its commands to the queue.
+
+Provide the YAML file describing the workflow with --file (see "wr workflow -h"
+for the format).
+
+Running a workflow again resumes it: commands that already completed are not
+added again, and commands that are already in the queue are left alone. Use
+--retry to also retry any commands of the workflow that failed and became
+buried. If you have changed the file, new or changed commands are added, but
+the commands for steps you have removed are not; "wr workflow cancel" first if
+you want to start over.
+
+Commands will run in the cwd specified in the file, defaulting to the current
+directory if the manager is running locally, or /tmp otherwise.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		wf := workflowParse()
+
+		jq := workflowConnect()
+		defer workflowDisconnect(jq)
+
+		currentIP, err := internal.CurrentIP("")
+		if err != nil {
+			warn("Could not get current IP: %s", err)
+		}
+		isLocal := currentIP+":"+config.ManagerPort == jq.ServerInfo.Addr
+
+		jd := &jobqueue.JobDefaults{
+			Cwd:      "/tmp",
+			RTimeout: 1,
+			OnExit:   jobqueue.Behaviours{{When: jobqueue.OnExit, Do: jobqueue.Cleanup}},
+		}
+
+		var envVars []string
+		if isLocal {
+			envVars = os.Environ()
+
+			jd.Cwd, err = os.Getwd()
+			if err != nil {
+				die("%s", err)
+			}
+		}
+
+		jobs, err := wf.Jobs(jd)
+		if err != nil {
+			die("%s", err)
+		}
+
+		inserts, dups, err := jq.Add(jobs, envVars, true)
+		if err != nil {
+			die("%s", err)
+		}
+
+		info("Added %d new commands (%d were already in the queue or complete) for workflow %s", inserts, dups, wf.Name)
+
+		if !workflowRetry {
+			return
+		}
+
+		buried, err := jq.GetByRepGroup(wf.RepGroup(), true, 0, jobqueue.JobStateBuried, false, false)
+		if err != nil {
+			die("failed to get the workflow's commands: %s", err)
+		}
+
+		kicked, err := jq.Kick(jobsToJobEssenses(workflowJobs(wf.Name, buried)))
+		if err != nil {
+			die("failed to retry the workflow's buried commands: %s", err)
+		}
+
+		info("Retried %d buried commands", kicked)
+	},
+}
+
+// status sub-command shows the status of a workflow
+var workflowStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of a workflow",
+	Long: `Show the status of a workflow.
+
+Provide the YAML file you gave to "wr workflow run" with --file, or just the
+workflow's --name. For each step, you'll see how many of its commands are in
+each state. With --file you'll also see how many commands each step should
+have, and so whether any are missing.
+
+Finally, the overall state of the workflow is given: complete if all commands
+are complete, failed if any are buried, otherwise running.
+
+Use "wr status -z -i wf.<workflow name>." to see the details of the commands.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		wf, name := workflowParseOrName()
+
+		jq := workflowConnect()
+		defer workflowDisconnect(jq)
+
+		jobs := workflowGetJobs(jq, name)
+
+		var statuses []*jobqueue.WorkflowStepStatus
+		if wf != nil {
+			statuses = wf.Status(jobs)
+		} else {
+			if len(jobs) == 0 {
+				die("no commands found for workflow %s", name)
+			}
+			statuses = jobqueue.WorkflowStatus(name, jobs)
+		}
+
+		complete, buried := true, false
+		for _, status := range statuses {
+			fmt.Printf("%s: %s\n", status.Step, workflowStepSummary(status))
+
+			if status.Counts[jobqueue.JobStateBuried] > 0 {
+				buried = true
+			}
+
+			if status.Counts[jobqueue.JobStateComplete] < status.Expected ||
+				status.Counts[jobqueue.JobStateComplete] != status.Total() {
+				complete = false
+			}
+		}
+
+		switch {
+		case complete:
+			fmt.Printf("\nworkflow %s is complete\n", name)
+		case buried:
+			fmt.Printf("\nworkflow %s has failed commands; fix the problem and \"wr workflow run --retry\"\n", name)
+		default:
+			fmt.Printf("\nworkflow %s is running\n", name)
+		}
+	},
+}
+
+// cancel sub-command kills and removes the commands of a workflow
+var workflowCancelCmd = &cobra.Command{
+	Use:   "cancel",
+	Short: "Cancel a workflow",
+	Long: `Cancel a workflow, removing its incomplete commands from the queue.
+
+Provide the YAML file you gave to "wr workflow run" with --file, or just the
+workflow's --name.
+
+Commands that are currently running are killed. Once they have stopped running
+they become buried, and you can cancel again to remove them. Completed commands
+are left alone, so running the workflow again after a cancel will resume it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, name := workflowParseOrName()
+
+		jq := workflowConnect()
+		defer workflowDisconnect(jq)
+
+		var running, others []*jobqueue.Job
+		for _, job := range workflowGetJobs(jq, name) {
+			switch job.State {
+			case jobqueue.JobStateComplete:
+				continue
+			case jobqueue.JobStateRunning, jobqueue.JobStateLost:
+				running = append(running, job)
+			default:
+				others = append(others, job)
+			}
+		}
+
+		if len(running) == 0 && len(others) == 0 {
+			die("no incomplete commands found for workflow %s", name)
+		}
+
+		if len(running) > 0 {
+			killed, err := jq.Kill(jobsToJobEssenses(running))
+			if err != nil {
+				die("failed to kill the workflow's running commands: %s", err)
+			}
+			info("Initiated the termination of %d running commands", killed)
+		}
+
+		if len(others) > 0 {
+			removed, err := jq.Delete(jobsToJobEssenses(others))
+			if err != nil {
+				die("failed to remove the workflow's commands: %s", err)
+			}
+			info("Removed %d incomplete commands", removed)
+		}
+	},
+}
+
+// workflowParse parses the workflow file given by --file.
+func workflowParse() *jobqueue.Workflow {
+	if workflowFile == "" {
+		die("--file is required")
+	}
+
+	data, err := os.ReadFile(workflowFile)
+	if err != nil {
+		die("could not read file '%s': %s", workflowFile, err)
+	}
+
+	wf, err := jobqueue.ParseWorkflow(data)
+	if err != nil {
+		die("%s", err)
+	}
+
+	return wf
+}
+
+// workflowParseOrName returns the workflow given by --file (if any), and the
+// workflow's name from the file or --name.
+func workflowParseOrName() (*jobqueue.Workflow, string) {
+	if (workflowFile == "") == (workflowName == "") {
+		die("exactly one of --file or --name is required")
+	}
+
+	if workflowName != "" {
+		return nil, workflowName
+	}
+
+	wf := workflowParse()
+
+	return wf, wf.Name
+}
+
+// workflowGetJobs gets all the commands of the workflow with the given name.
+func workflowGetJobs(jq *jobqueue.Client, name string) []*jobqueue.Job {
+	jobs, err := jq.GetByRepGroup(jobqueue.WorkflowRepGroup(name), true, 0, "", false, false)
+	if err != nil {
+		die("failed to get the workflow's commands: %s", err)
+	}
+
+	return workflowJobs(name, jobs)
+}
+
+// workflowJobs filters the given jobs down to those of the workflow with the
+// given name, since getting jobs by report group substring could also get the
+// jobs of other workflows.
+func workflowJobs(name string, jobs []*jobqueue.Job) []*jobqueue.Job {
+	prefix := jobqueue.WorkflowRepGroup(name)
+
+	var filtered []*jobqueue.Job
+	for _, job := range jobs {
+		if strings.HasPrefix(job.RepGroup, prefix) {
+			filtered = append(filtered, job)
+		}
+	}
+
+	return filtered
+}
+
+// workflowStepSummary describes the counts of a step's commands in each state.
+func workflowStepSummary(status *jobqueue.WorkflowStepStatus) string {
+	var parts []string
+	for _, state := range workflowStateOrder {
+		if count := status.Counts[state]; count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count, state))
+		}
+	}
+
+	if missing := status.Expected - status.Total(); missing > 0 {
+		parts = append(parts, fmt.Sprintf("%d not added", missing))
+	}
+
+	if len(parts) == 0 {
+		return "no commands"
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// workflowConnect connects to the manager using the --timeout flag.
+func workflowConnect() *jobqueue.Client {
+	return connect(time.Duration(timeoutint) * time.Second)
+}
+
+// workflowDisconnect disconnects from the manager, warning on failure.
+func workflowDisconnect(jq *jobqueue.Client) {
+	err := jq.Disconnect()
+	if err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(workflowCmd)
+	workflowCmd.AddCommand(workflowRunCmd)
+	workflowCmd.AddCommand(workflowStatusCmd)
+	workflowCmd.AddCommand(workflowCancelCmd)
+
+	// flags specific to these sub-commands
+	workflowRunCmd.Flags().StringVarP(&workflowFile, "file", "f", "", "YAML file describing the workflow")
+	workflowRunCmd.Flags().BoolVar(&workflowRetry, "retry", false, "also retry the workflow's buried commands")
+	workflowStatusCmd.Flags().StringVarP(&workflowFile, "file", "f", "", "YAML file describing the workflow")
+	workflowStatusCmd.Flags().StringVarP(&workflowName, "name", "n", "", "name of the workflow")
+	workflowCancelCmd.Flags().StringVarP(&workflowFile, "file", "f", "", "YAML file describing the workflow")
+	workflowCancelCmd.Flags().StringVarP(&workflowName, "name", "n", "", "name of the workflow")
+	workflowRunCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	workflowStatusCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+	workflowCancelCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
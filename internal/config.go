@@ -94,26 +94,41 @@ type Config struct {
 	ManagerPort          string `default:""`
 	ManagerWeb           string `default:""`
 	ManagerHost          string `default:"localhost"`
+	ManagerStandbyHost   string `default:""`
 	ManagerDir           string `default:"~/.wr"`
 	ManagerPidFile       string `default:"pid"`
 	ManagerLogFile       string `default:"log"`
 	ManagerDBFile        string `default:"db"`
 	ManagerDBBkFile      string `default:"db_bk"`
+	ManagerDBBackend     string `default:"bolt"`
 	ManagerTokenFile     string `default:"client.token"`
 	ManagerUploadDir     string `default:"uploads"`
+	ManagerCopyDir       string `default:"copied"`
+	ManagerArchiveDir    string `default:"archive"`
+	ManagerJobLogDir     string `default:"joblogs"`
+	ManagerJobLogMaxMB   int    `default:"0"`
+	ManagerRetention     string `default:""`
+	ManagerFairShare     string `default:""`
+	ManagerWebhooks      string `default:""`
 	ManagerUmask         int    `default:"007"`
 	ManagerScheduler     string `default:"local"`
+	ManagerResources     string `default:""`
+	ManagerSSHHosts      string `default:""`
 	ManagerCAFile        string `default:"ca.pem"`
 	ManagerCertFile      string `default:"cert.pem"`
 	ManagerKeyFile       string `default:"key.pem"`
 	ManagerCertDomain    string `default:"localhost"`
 	ManagerSetDomainIP   bool   `default:"false"`
 	RunnerExecShell      string `default:"bash"`
+	RunnerCgroup         string `default:""`
+	RunnerStreamLogs     int    `default:"0"`
 	PrivateKeyPath       string `default:"~/.ssh/id_rsa"`
 	Deployment           string `default:"production"`
+	CloudProvider        string `default:"openstack"`
 	CloudFlavor          string `default:""`
 	CloudFlavorManager   string `default:""`
 	CloudFlavorSets      string `default:""`
+	CloudFlavorResources string `default:""`
 	CloudKeepAlive       int    `default:"120"`
 	CloudServers         int    `default:"-1"`
 	CloudCIDR            string `default:"192.168.64.0/18"`
@@ -431,7 +446,7 @@ func setSourceOnChangeProp(typeOfC reflect.Type, adrField reflect.Value,
 }
 
 // adjustConfigProperties adjusts the config properties for pid, log file,
-// upload dir paths, certs and db files.
+// upload and copy dir paths, certs and db files.
 func (c *Config) adjustConfigProperties(ctx context.Context, uid int, deployment string) {
 	c.Deployment = deployment
 
@@ -448,6 +463,9 @@ func (c *Config) convRelativeToAbsPaths() {
 	c.convRelativeToAbsPath(&c.ManagerPidFile)
 	c.convRelativeToAbsPath(&c.ManagerLogFile)
 	c.convRelativeToAbsPath(&c.ManagerUploadDir)
+	c.convRelativeToAbsPath(&c.ManagerCopyDir)
+	c.convRelativeToAbsPath(&c.ManagerArchiveDir)
+	c.convRelativeToAbsPath(&c.ManagerJobLogDir)
 
 	c.convRelativeToAbsPath(&c.ManagerCAFile)
 	c.convRelativeToAbsPath(&c.ManagerCertFile)
@@ -456,6 +456,9 @@ func TestConfig(t *testing.T) {
 			So(defConfig.ManagerTokenFile, ShouldEqual, "client.token")
 			So(defConfig.ManagerLogFile, ShouldEqual, "log")
 			So(defConfig.ManagerUploadDir, ShouldEqual, "uploads")
+			So(defConfig.ManagerCopyDir, ShouldEqual, "copied")
+			So(defConfig.ManagerArchiveDir, ShouldEqual, "archive")
+			So(defConfig.ManagerJobLogDir, ShouldEqual, "joblogs")
 
 			defConfig.convRelativeToAbsPaths()
 
@@ -467,6 +470,9 @@ func TestConfig(t *testing.T) {
 			So(defConfig.ManagerTokenFile, ShouldEqual, "~/.wr/client.token")
 			So(defConfig.ManagerLogFile, ShouldEqual, "~/.wr/log")
 			So(defConfig.ManagerUploadDir, ShouldEqual, "~/.wr/uploads")
+			So(defConfig.ManagerCopyDir, ShouldEqual, "~/.wr/copied")
+			So(defConfig.ManagerArchiveDir, ShouldEqual, "~/.wr/archive")
+			So(defConfig.ManagerJobLogDir, ShouldEqual, "~/.wr/joblogs")
 		})
 
 		Convey("it can convert the relative to an actual Abs path", func() {
@@ -134,6 +134,30 @@ func DedupSortStrings(s []string) []string {
 	return dedup
 }
 
+// ResourcesCanFit tells you how many of something that needs the given named
+// consumable resources could fit in to what remains of the total resources
+// after the given amount have been used. Returns -1 if nothing is needed,
+// meaning resources don't limit how many can fit.
+func ResourcesCanFit(total, used, needed map[string]int) int {
+	canFit := -1
+	for name, need := range needed {
+		if need <= 0 {
+			continue
+		}
+
+		n := (total[name] - used[name]) / need
+		if n < 0 {
+			n = 0
+		}
+
+		if canFit == -1 || n < canFit {
+			canFit = n
+		}
+	}
+
+	return canFit
+}
+
 // Username returns the username of the current user. This avoids problems
 // with static compilation as it avoids the use of os/user. It will only work
 // on linux-like systems where 'id -u -n' works.
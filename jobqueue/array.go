@@ -0,0 +1,430 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to job arrays: a single Job with a
+// templated Cmd and a table of parameters, that the server expands in to many
+// Jobs, a window of them at a time.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxArraySize is the maximum number of elements a JobArray can have. Only a
+// window of elements is in the queue at once, but the parameter table is held
+// in memory and every element eventually becomes a complete Job in the
+// database.
+const maxArraySize = 1000000
+
+// arrayRangeRegex matches the string form of an ArrayRange: name=start-end or
+// name=start-end:step.
+var arrayRangeRegex = regexp.MustCompile(`^([^={}\s]+)=(-?\d+)-(-?\d+)(?::(\d+))?$`)
+
+// ArrayRange describes a parameter of a JobArray that takes every integer value
+// from Start to End (inclusive), going up in increments of Step.
+type ArrayRange struct {
+	Name  string
+	Start int
+	End   int
+	Step  int
+}
+
+// ParseArrayRange parses a string in the form "name=start-end" or
+// "name=start-end:step" (where step defaults to 1) in to an ArrayRange.
+func ParseArrayRange(spec string) (*ArrayRange, error) {
+	matches := arrayRangeRegex.FindStringSubmatch(strings.TrimSpace(spec))
+	if matches == nil {
+		return nil, fmt.Errorf("array range '%s' is not in the form name=start-end[:step]", spec)
+	}
+
+	if matches[4] == "" {
+		matches[4] = "1"
+	}
+
+	nums := make([]int, 3)
+	for i, str := range matches[2:] {
+		num, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, fmt.Errorf("array range '%s' has a bad number: %w", spec, err)
+		}
+		nums[i] = num
+	}
+
+	ar := &ArrayRange{Name: matches[1], Start: nums[0], End: nums[1], Step: nums[2]}
+
+	return ar, ar.validate()
+}
+
+// validate checks the range will result in at least 1 value.
+func (ar *ArrayRange) validate() error {
+	if ar.Name == "" {
+		return fmt.Errorf("array range has no name")
+	}
+	if ar.Step < 1 {
+		return fmt.Errorf("array range %s has a step less than 1", ar.Name)
+	}
+	if ar.End < ar.Start {
+		return fmt.Errorf("array range %s ends before it starts", ar.Name)
+	}
+	return nil
+}
+
+// size returns the number of values in the range.
+func (ar *ArrayRange) size() int {
+	return (ar.End-ar.Start)/ar.Step + 1
+}
+
+// String returns the range in the form understood by ParseArrayRange().
+func (ar *ArrayRange) String() string {
+	return fmt.Sprintf("%s=%d-%d:%d", ar.Name, ar.Start, ar.End, ar.Step)
+}
+
+// JobArray describes the parameters of a job array. Set it as the Array of a
+// Job whose Cmd contains {name} placeholders, and when that Job is Add()ed the
+// server will create one Job per combination of parameter values, with the
+// placeholders replaced by those values.
+//
+// The combinations are every row of the table (Names and Rows) crossed with
+// every value of each of the Ranges. Either or both can be supplied.
+type JobArray struct {
+	// Names are the names of the columns of the parameter table.
+	Names []string
+
+	// Rows are the rows of the parameter table; each must have a value for
+	// every entry in Names.
+	Rows [][]string
+
+	// Ranges are additional integer parameters.
+	Ranges []*ArrayRange
+}
+
+// ParseArrayTable reads tab separated values from the given reader, where the
+// first line gives the parameter names and subsequent non-blank lines give the
+// values, returning a JobArray with that table.
+func ParseArrayTable(r io.Reader) (*JobArray, error) {
+	a := &JobArray{}
+	scanner := bufio.NewScanner(r)
+	buf := make([]byte, 1024*1024)
+	scanner.Buffer(buf, 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		cols := strings.Split(line, "\t")
+		if a.Names == nil {
+			a.Names = cols
+			continue
+		}
+
+		if len(cols) != len(a.Names) {
+			return nil, fmt.Errorf("array table line %d has %d columns, but the header has %d", lineNum, len(cols), len(a.Names))
+		}
+		a.Rows = append(a.Rows, cols)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(a.Rows) == 0 {
+		return nil, fmt.Errorf("array table has no rows of values")
+	}
+
+	return a, nil
+}
+
+// jobArray returns a JobArray based on the ArrayTable and ArrayRanges of this
+// JobViaJSON.
+func (jvj *JobViaJSON) jobArray() (*JobArray, error) {
+	a := &JobArray{}
+	if len(jvj.ArrayTable) > 0 {
+		a.Names = jvj.ArrayTable[0]
+		a.Rows = jvj.ArrayTable[1:]
+	}
+
+	for _, spec := range jvj.ArrayRanges {
+		ar, err := ParseArrayRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		a.Ranges = append(a.Ranges, ar)
+	}
+
+	return a, a.validate()
+}
+
+// Size returns the number of Jobs this JobArray will result in.
+func (a *JobArray) Size() int {
+	size := 1
+	if len(a.Names) > 0 {
+		size = len(a.Rows)
+	}
+	for _, ar := range a.Ranges {
+		size *= ar.size()
+	}
+	return size
+}
+
+// validate checks the JobArray has consistent parameters resulting in a
+// reasonable number of Jobs.
+func (a *JobArray) validate() error {
+	if len(a.Names) == 0 && len(a.Ranges) == 0 {
+		return fmt.Errorf("job array has no parameters")
+	}
+
+	if len(a.Names) > 0 && len(a.Rows) == 0 {
+		return fmt.Errorf("job array table has no rows of values")
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range a.Names {
+		if name == "" || seen[name] {
+			return fmt.Errorf("job array table has a blank or duplicate parameter name")
+		}
+		seen[name] = true
+	}
+
+	for i, row := range a.Rows {
+		if len(row) != len(a.Names) {
+			return fmt.Errorf("job array table row %d does not have %d values", i+1, len(a.Names))
+		}
+	}
+
+	size := 1
+	if len(a.Names) > 0 {
+		size = len(a.Rows)
+	}
+	for _, ar := range a.Ranges {
+		if err := ar.validate(); err != nil {
+			return err
+		}
+		if seen[ar.Name] {
+			return fmt.Errorf("job array has a duplicate parameter name %s", ar.Name)
+		}
+		seen[ar.Name] = true
+
+		size *= ar.size()
+		if size > maxArraySize {
+			return fmt.Errorf("job array would have more than %d elements", maxArraySize)
+		}
+	}
+
+	return nil
+}
+
+// params returns the parameter names and values for the element with the given
+// index. The table rows change slowest, and the last range changes fastest.
+func (a *JobArray) params(index int) map[string]string {
+	params := make(map[string]string, len(a.Names)+len(a.Ranges))
+	for i := len(a.Ranges) - 1; i >= 0; i-- {
+		ar := a.Ranges[i]
+		size := ar.size()
+		params[ar.Name] = strconv.Itoa(ar.Start + (index%size)*ar.Step)
+		index /= size
+	}
+
+	if len(a.Names) > 0 {
+		row := a.Rows[index]
+		for i, name := range a.Names {
+			params[name] = row[i]
+		}
+	}
+
+	return params
+}
+
+// expand replaces the {name} placeholders in the given template with the
+// parameter values of the element with the given index.
+func (a *JobArray) expand(template string, index int) string {
+	params := a.params(index)
+	oldnew := make([]string, 0, 2*len(params))
+	for name, val := range params {
+		oldnew = append(oldnew, "{"+name+"}", val)
+	}
+	return strings.NewReplacer(oldnew...).Replace(template)
+}
+
+// String returns a stable string form of the array, suitable for generating a
+// key.
+func (a *JobArray) String() string {
+	var b strings.Builder
+	b.WriteString(strings.Join(a.Names, "\t"))
+	for _, row := range a.Rows {
+		b.WriteString("\n")
+		b.WriteString(strings.Join(row, "\t"))
+	}
+	for _, ar := range a.Ranges {
+		b.WriteString("\n")
+		b.WriteString(ar.String())
+	}
+	return b.String()
+}
+
+// ArrayKey returns the ArrayID that elements of this Job's Array will have. You
+// must hold at least a read lock on the Job.
+func (j *Job) ArrayKey() string {
+	return byteKey([]byte(j.Key() + "." + j.Array.String()))
+}
+
+// arrayElement returns a new Job that is the element of this Job's Array with
+// the given index, which will have the same properties as this Job, except for
+// having an expanded Cmd and no Array. You must hold at least a read lock on
+// the Job.
+func (j *Job) arrayElement(arrayID string, index int) *Job {
+	var reqOrig = j.RequirementsOrig
+	if reqOrig != nil {
+		reqOrig = reqOrig.Clone()
+	}
+
+	return &Job{
+		Cmd:                   j.Array.expand(j.Cmd, index),
+		Cwd:                   j.Cwd,
+		CwdMatters:            j.CwdMatters,
+		ChangeHome:            j.ChangeHome,
+		RepGroup:              j.RepGroup,
+		ReqGroup:              j.ReqGroup,
+		Requirements:          j.Requirements.Clone(),
+		RequirementsOrig:      reqOrig,
+		Override:              j.Override,
+		Priority:              j.Priority,
+		Retries:               j.Retries,
+		NoRetriesOverWalltime: j.NoRetriesOverWalltime,
+		RetryPolicy:           j.RetryPolicy,
+		Checkpoint:            j.Checkpoint,
+		LimitGroups:           j.LimitGroups,
+		DepGroups:             j.DepGroups,
+		Dependencies:          j.Dependencies,
+		OnDepFailure:          j.OnDepFailure,
+		Behaviours:            j.Behaviours,
+		MountConfigs:          j.MountConfigs,
+		BsubMode:              j.BsubMode,
+		MonitorDocker:         j.MonitorDocker,
+		WithDocker:            j.WithDocker,
+		WithSingularity:       j.WithSingularity,
+		ContainerMounts:       j.ContainerMounts,
+		EnvOverride:           j.EnvOverride,
+		ArrayID:               arrayID,
+		ArrayIndex:            index,
+		ArraySize:             j.Array.Size(),
+		BsubID:                j.BsubID,
+		Owner:                 j.Owner,
+	}
+}
+
+// arrayElementKey returns the Key() that arrayElement() would give the element
+// with the given index, without the expense of fully creating that element.
+// This Job must have had its ArrayID set by splitJobArrays().
+func (j *Job) arrayElementKey(index int) string {
+	element := &Job{
+		Cmd:             j.Array.expand(j.Cmd, index),
+		Cwd:             j.Cwd,
+		CwdMatters:      j.CwdMatters,
+		MountConfigs:    j.MountConfigs,
+		WithDocker:      j.WithDocker,
+		WithSingularity: j.WithSingularity,
+		ContainerMounts: j.ContainerMounts,
+		ArrayID:         j.ArrayID,
+		ArrayIndex:      index,
+	}
+	return element.Key()
+}
+
+// splitJobArrays returns the given jobs that don't have an Array, and
+// separately the ones that do, after validating their Array and setting their
+// ArrayID and ArraySize.
+func splitJobArrays(jobs []*Job) (normal []*Job, templates []*Job, err error) {
+	normal = make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		job.Lock()
+		if job.Array == nil {
+			job.Unlock()
+			normal = append(normal, job)
+			continue
+		}
+
+		if err = job.Array.validate(); err != nil {
+			job.Unlock()
+			return nil, nil, err
+		}
+
+		job.ArrayID = job.ArrayKey()
+		job.ArraySize = job.Array.Size()
+		job.Unlock()
+
+		templates = append(templates, job)
+	}
+
+	return normal, templates, nil
+}
+
+// arrayFeed is what the server stores for a job array: its template Job (with
+// the Array parameters) and how far it has got in adding the elements to the
+// queue. Elements are added a window at a time, more being added as earlier
+// ones leave the queue, so that a large array doesn't need a Job per element
+// up front.
+type arrayFeed struct {
+	Template       *Job
+	Next           int // the index of the next element to add
+	IgnoreComplete bool
+
+	// live holds the keys of the elements that have been added and are
+	// thought to still be in the queue.
+	live map[string]bool
+}
+
+// newArrayFeed returns an arrayFeed for the given template, which must have had
+// its ArrayID set by splitJobArrays().
+func newArrayFeed(template *Job, ignoreComplete bool) *arrayFeed {
+	return &arrayFeed{Template: template, IgnoreComplete: ignoreComplete, live: make(map[string]bool)}
+}
+
+// done tells you if every element has been added.
+func (f *arrayFeed) done() bool {
+	return f.Next >= f.Template.ArraySize
+}
+
+// take returns the next elements, so that there will be no more than window of
+// them live, noting the returned elements as live.
+func (f *arrayFeed) take(window int) []*Job {
+	end := min(f.Next+window-len(f.live), f.Template.ArraySize)
+	if end <= f.Next {
+		return nil
+	}
+
+	f.Template.RLock()
+	defer f.Template.RUnlock()
+	elements := make([]*Job, 0, end-f.Next)
+	for i := f.Next; i < end; i++ {
+		element := f.Template.arrayElement(f.Template.ArrayID, i)
+		f.live[element.Key()] = true
+		elements = append(elements, element)
+	}
+	f.Next = end
+
+	return elements
+}
@@ -77,9 +77,12 @@ const (
 	Run
 
 	// CopyToManager is a BehaviourAction that copies the given files (specified
-	// as a slice of string paths Arg to the Behaviour) from the Job's actual
-	// cwd to a configured location on the machine that the jobqueue server is
-	// running on. *** not yet implemented!
+	// as a slice of string paths Arg to the Behaviour, relative to the Job's
+	// actual cwd) from the Job's actual cwd to a directory unique to the Job
+	// within the configured CopyDir on the machine that the jobqueue server is
+	// running on. The copied files are listed in the Job's CopiedFiles, and can
+	// be retrieved with Client.GetCopiedFile(). Only works when the Job is
+	// being run by Client.Execute(), and is only suitable for small files.
 	CopyToManager
 
 	// Nothing is a BehaviourAction that does nothing. It allows you to define
@@ -143,10 +146,8 @@ func (b *Behaviour) fillBVJM(bvjm *bvjMapping) {
 		}
 		bvj = BehaviourViaJSON{Run: arg}
 	case CopyToManager:
-		var arg []string
-		if files, wasStrSlice := b.Arg.([]string); wasStrSlice {
-			arg = files
-		} else {
+		arg, wasStrSlice := b.argStrings()
+		if !wasStrSlice {
 			arg = []string{"!invalid!"}
 		}
 		bvj = BehaviourViaJSON{CopyToManager: arg}
@@ -299,16 +300,41 @@ func (b *Behaviour) run(j *Job) error {
 }
 
 // copyToManager copies the files specified in the Arg slice to the configured
-// location on the manager's machine.
-func (b *Behaviour) copyToManager(*Job) error {
-	_, wasStrSlice := b.Arg.([]string)
+// location on the manager's machine, using the Client that is Execute()ing the
+// Job.
+func (b *Behaviour) copyToManager(j *Job) error {
+	files, wasStrSlice := b.argStrings()
 	if !wasStrSlice {
 		return fmt.Errorf("arg %s is type %T, not []string", b.Arg, b.Arg)
 	}
 
-	// *** not yet implemented
+	if j.client == nil {
+		return fmt.Errorf("copy_to_manager behaviour can only be carried out during Client.Execute()")
+	}
 
-	return nil
+	return j.client.copyToManager(j, files)
+}
+
+// argStrings returns our Arg as a []string. Since a Behaviour that has been
+// through the server will have had its []string Arg decoded as an
+// []interface{}, that is also accepted as long as all its elements are strings.
+func (b *Behaviour) argStrings() ([]string, bool) {
+	switch arg := b.Arg.(type) {
+	case []string:
+		return arg, true
+	case []interface{}:
+		strs := make([]string, len(arg))
+		for i, val := range arg {
+			str, wasStr := val.(string)
+			if !wasStr {
+				return nil, false
+			}
+			strs[i] = str
+		}
+		return strs, true
+	}
+
+	return nil, false
 }
 
 // Behaviours are a slice of Behaviour.
@@ -316,6 +342,8 @@ type Behaviours []*Behaviour
 
 // Trigger calls Trigger on each constituent Behaviour, first all those for
 // OnSuccess if success = true or OnFailure otherwise, then those for OnExit.
+// CopyToManager Behaviours are all triggered before any others, so that files
+// get copied before they could be deleted by a Cleanup Behaviour.
 func (bs Behaviours) Trigger(success bool, j *Job) error {
 	if len(bs) == 0 {
 		return nil
@@ -329,18 +357,18 @@ func (bs Behaviours) Trigger(success bool, j *Job) error {
 	}
 
 	var merr *multierror.Error
-	for _, b := range bs {
-		err := b.Trigger(status, j)
-		if err != nil {
-			merr = multierror.Append(merr, err)
-		}
-	}
+	for _, copying := range []bool{true, false} {
+		for _, when := range []BehaviourTrigger{status, OnExit} {
+			for _, b := range bs {
+				if (b.Do == CopyToManager) != copying {
+					continue
+				}
 
-	status = OnExit
-	for _, b := range bs {
-		err := b.Trigger(status, j)
-		if err != nil {
-			merr = multierror.Append(merr, err)
+				err := b.Trigger(when, j)
+				if err != nil {
+					merr = multierror.Append(merr, err)
+				}
+			}
 		}
 	}
 
@@ -72,6 +72,9 @@ func TestBehaviours(t *testing.T) {
 			So(b10.String(), ShouldEqual, "{}")
 			So(b11.String(), ShouldEqual, `{"on_failure":[{"remove":true}]}`)
 
+			b12 := &Behaviour{When: OnSuccess, Do: CopyToManager, Arg: []interface{}{"a.file", "b.file"}}
+			So(b12.String(), ShouldEqual, b7.String())
+
 			Convey("Behaviours can be nicely stringified", func() {
 				bs := Behaviours{b1, b4}
 				So(bs.String(), ShouldEqual, `{"on_success":[{"run":"touch ../../foo && true"}],"on_exit":[{"cleanup_all":true}]}`)
@@ -83,10 +86,10 @@ func TestBehaviours(t *testing.T) {
 
 		Convey("Individual Behaviour Trigger() correctly", func() {
 			err = b7.Trigger(OnSuccess, job1)
-			So(err, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Client.Execute()")
 			err = b8.Trigger(OnSuccess, job1)
 			So(err, ShouldNotBeNil)
-			//*** CopyToManager not yet implemented, so no proper tests for it yet
 
 			err = b6.Trigger(OnSuccess, job1)
 			So(err, ShouldNotBeNil)
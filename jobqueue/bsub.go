@@ -0,0 +1,634 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to LSF emulation: understanding the
+// options and dependency expressions given to bsub, and turning them in to the
+// properties of Jobs.
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// BsubCleanPeriod is how long after they complete that jobs added via bsub
+// emulation are still reported on, like LSF's CLEAN_PERIOD.
+const BsubCleanPeriod = 1 * time.Hour
+
+const (
+	bsubDepGroupPrefix = "bsub."
+	bsubIndexParam     = "LSB_JOBINDEX"
+	bsubIndexLine      = "export " + bsubIndexParam + "={" + bsubIndexParam + "}\n"
+)
+
+var (
+	bsubLineRegex      = regexp.MustCompile(`^#BSUB\s+(.+)$`)
+	bsubArrayRegex     = regexp.MustCompile(`^(.*)\[([^\]]+)\](?:%(\d+))?$`)
+	bsubIndexRegex     = regexp.MustCompile(`^export ` + bsubIndexParam + `=(\d+)\n`)
+	bsubRusageRegex    = regexp.MustCompile(`rusage\[([^\]]*)\]`)
+	bsubConditionRegex = regexp.MustCompile(`^(\w+)\(\s*(.+?)\s*\)$`)
+	bsubIDRegex        = regexp.MustCompile(`^\d+$`)
+)
+
+// bsubValueOptions are the bsub options that take a value, but that we accept
+// and ignore because they have no meaning in wr.
+var bsubValueOptions = map[string]bool{
+	"P": true, "G": true, "u": true, "m": true, "g": true, "sla": true,
+	"app": true, "We": true, "L": true, "E": true, "Ep": true, "U": true,
+	"b": true, "t": true, "sp": true, "Lp": true,
+}
+
+// bsubBoolOptions are the bsub options that don't take a value, and that we
+// accept and ignore.
+var bsubBoolOptions = map[string]bool{
+	"B": true, "N": true, "r": true, "rn": true, "x": true, "H": true,
+	"ti": true,
+}
+
+// BsubIDDepGroup returns the dependency group that jobs added via bsub
+// emulation are put in, based on their BsubID.
+func BsubIDDepGroup(id uint64) string {
+	return bsubDepGroupPrefix + "id." + strconv.FormatUint(id, 10)
+}
+
+// BsubNameDepGroup returns the dependency group that jobs added via bsub
+// emulation are put in, based on the job name given to bsub -J.
+func BsubNameDepGroup(name string) string {
+	return bsubDepGroupPrefix + "name." + name
+}
+
+// BsubArrayIndex returns the LSF array index (which is what $LSB_JOBINDEX will
+// be set to) of a Job that is an element of a job array added via bsub
+// emulation, or 0 if it isn't.
+func BsubArrayIndex(job *Job) int {
+	matches := bsubIndexRegex.FindStringSubmatch(job.Cmd)
+	if matches == nil {
+		return 0
+	}
+
+	i, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return 0
+	}
+
+	return i
+}
+
+// BsubOptions holds the bsub options that LSF emulation understands. The zero
+// value is ready to Parse() options in to.
+type BsubOptions struct {
+	// Name is the job name given with -J, minus any array specification.
+	Name string
+
+	// Array is set if -J specified a job array, eg. -J "name[1-10]".
+	Array *JobArray
+
+	// ArrayLimit is the maximum number of elements of Array that can run at
+	// once, as specified with -J "name[1-10]%limit".
+	ArrayLimit int
+
+	// Cores is the number of cores specified with -n.
+	Cores float64
+
+	// MemLimit is the memory limit in MB specified with -M.
+	MemLimit int
+
+	// MemReserve is the memory in MB reserved with -R "rusage[mem=n]".
+	MemReserve int
+
+	// Time is the run time limit specified with -W.
+	Time time.Duration
+
+	// Queue is the queue specified with -q.
+	Queue string
+
+	// Cwd is the working directory specified with -cwd.
+	Cwd string
+
+	// Input is the file specified with -i that will be the job's STDIN.
+	Input string
+
+	// Output is the file specified with -o (or -oo if OverwriteOutput is
+	// true) that the job's STDOUT will go to.
+	Output          string
+	OverwriteOutput bool
+
+	// Error is the file specified with -e (or -eo if OverwriteError is true)
+	// that the job's STDERR will go to.
+	Error          string
+	OverwriteError bool
+
+	// Dependencies are the dependencies specified with -w.
+	Dependencies Dependencies
+
+	// Wait is true if -K was specified.
+	Wait bool
+}
+
+// Parse parses bsub command line arguments in to our properties, overriding
+// any that were previously set. It stops at the first argument that isn't an
+// option, returning that and the remaining arguments, which make up the
+// command the job should run.
+func (o *BsubOptions) Parse(args []string) ([]string, error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return args[i:], nil
+		}
+
+		opt := strings.TrimPrefix(arg, "-")
+		if opt == "-" {
+			return args[i+1:], nil
+		}
+
+		switch opt {
+		case "K":
+			o.Wait = true
+			continue
+		case "I", "Ip", "Is":
+			return nil, fmt.Errorf("interactive jobs (-%s) are not supported", opt)
+		}
+
+		if bsubBoolOptions[opt] {
+			continue
+		}
+
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("option -%s requires a value", opt)
+		}
+		i++
+
+		if err := o.parseOption(opt, args[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// parseOption parses the value of a single bsub option that takes a value.
+func (o *BsubOptions) parseOption(opt, val string) error {
+	var err error
+
+	switch opt {
+	case "J":
+		err = o.parseName(val)
+	case "n":
+		min, _, _ := strings.Cut(val, ",")
+		o.Cores, err = strconv.ParseFloat(min, 64)
+		if err == nil && o.Cores < 0 {
+			err = fmt.Errorf("can't be negative")
+		}
+	case "M":
+		o.MemLimit, err = parseBsubMemory(val)
+	case "R":
+		err = o.parseResourceRequirement(val)
+	case "W":
+		o.Time, err = parseBsubTime(val)
+	case "q":
+		o.Queue = val
+	case "cwd":
+		o.Cwd = val
+	case "i":
+		o.Input = val
+	case "o", "oo":
+		o.Output = val
+		o.OverwriteOutput = opt == "oo"
+	case "e", "eo":
+		o.Error = val
+		o.OverwriteError = opt == "eo"
+	case "w":
+		o.Dependencies, err = ParseBsubDependencies(val)
+	default:
+		if !bsubValueOptions[opt] {
+			return fmt.Errorf("option -%s is not supported", opt)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("option -%s '%s' is not valid: %w", opt, val, err)
+	}
+
+	return nil
+}
+
+// parseName parses a job name, which might specify a job array in the form
+// name[indexes]%limit, where indexes is a comma separated list of single
+// indexes or ranges in the form start-end[:step].
+func (o *BsubOptions) parseName(name string) error {
+	o.Array = nil
+	o.ArrayLimit = 0
+
+	matches := bsubArrayRegex.FindStringSubmatch(name)
+	if matches == nil {
+		o.Name = name
+
+		return nil
+	}
+
+	o.Name = matches[1]
+
+	if matches[3] != "" {
+		limit, err := strconv.Atoi(matches[3])
+		if err != nil || limit < 1 {
+			return fmt.Errorf("array limit must be a positive integer")
+		}
+		o.ArrayLimit = limit
+	}
+
+	parts := strings.Split(matches[2], ",")
+	var rows [][]string
+
+	for _, part := range parts {
+		ar, err := ParseArrayRange(bsubIndexParam + "=" + part)
+		if err != nil {
+			i, erra := strconv.Atoi(part)
+			if erra != nil {
+				return fmt.Errorf("array index '%s' is not a number or range", part)
+			}
+			ar = &ArrayRange{Name: bsubIndexParam, Start: i, End: i, Step: 1}
+		}
+
+		if ar.Start < 1 {
+			return fmt.Errorf("array indexes must be positive")
+		}
+
+		if len(parts) == 1 {
+			o.Array = &JobArray{Ranges: []*ArrayRange{ar}}
+
+			return nil
+		}
+
+		for i := ar.Start; i <= ar.End; i += ar.Step {
+			rows = append(rows, []string{strconv.Itoa(i)})
+		}
+	}
+
+	o.Array = &JobArray{Names: []string{bsubIndexParam}, Rows: rows}
+
+	return o.Array.validate()
+}
+
+// parseResourceRequirement parses a -R resource requirement string, only
+// paying attention to a memory reservation in any rusage section.
+func (o *BsubOptions) parseResourceRequirement(req string) error {
+	for _, matches := range bsubRusageRegex.FindAllStringSubmatch(req, -1) {
+		for _, usage := range strings.FieldsFunc(matches[1], func(r rune) bool { return r == ',' || r == ':' }) {
+			name, val, found := strings.Cut(usage, "=")
+			if !found || strings.TrimSpace(name) != "mem" {
+				continue
+			}
+
+			mb, err := parseBsubMemory(strings.TrimSpace(val))
+			if err != nil {
+				return err
+			}
+			o.MemReserve = mb
+		}
+	}
+
+	return nil
+}
+
+// parseBsubMemory parses a memory amount that is a plain number of MB, or a
+// number with a unit suffix such as G.
+func parseBsubMemory(mem string) (int, error) {
+	if n, err := strconv.ParseFloat(mem, 64); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("memory can't be negative")
+		}
+
+		return int(math.Ceil(n)), nil
+	}
+
+	mb, err := bytefmt.ToMegabytes(mem)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(mb), nil
+}
+
+// parseBsubTime parses a run time limit in the form [hour:]minute[/host].
+func parseBsubTime(limit string) (time.Duration, error) {
+	limit, _, _ = strings.Cut(limit, "/")
+
+	var hours int
+	mins := limit
+	if h, m, found := strings.Cut(limit, ":"); found {
+		var err error
+		hours, err = strconv.Atoi(h)
+		if err != nil {
+			return 0, err
+		}
+		mins = m
+	}
+
+	m, err := strconv.Atoi(mins)
+	if err != nil {
+		return 0, err
+	}
+
+	if hours < 0 || m < 0 {
+		return 0, fmt.Errorf("time can't be negative")
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// ParseScriptLine parses a line of a job script, and if it is a "#BSUB" line,
+// parses the options on it in the same way as Parse(), returning true.
+func (o *BsubOptions) ParseScriptLine(line string) (bool, error) {
+	matches := bsubLineRegex.FindStringSubmatch(strings.TrimSpace(line))
+	if matches == nil {
+		return false, nil
+	}
+
+	words, err := splitShellWords(matches[1])
+	if err != nil {
+		return true, err
+	}
+
+	remaining, err := o.Parse(words)
+	if err != nil {
+		return true, err
+	}
+
+	if len(remaining) > 0 && !strings.HasPrefix(remaining[0], "#") {
+		return true, fmt.Errorf("unexpected '%s' in #BSUB line", strings.Join(remaining, " "))
+	}
+
+	return true, nil
+}
+
+// Apply sets properties of the given Job, which should have its Cmd and Cwd
+// already set, according to our options.
+//
+// The job is given our Name as its RepGroup, is placed in the
+// BsubNameDepGroup() of that name, and gets our Dependencies. Arrays use our
+// Array, with the job's Cmd being altered to set $LSB_JOBINDEX. The Cmd is
+// also altered to handle our Input, Output and Error files.
+func (o *BsubOptions) Apply(job *Job) {
+	if o.Name != "" {
+		job.RepGroup = o.Name
+		job.DepGroups = append(job.DepGroups, BsubNameDepGroup(o.Name))
+	}
+
+	if o.Cores > 0 {
+		job.Requirements.Cores = o.Cores
+	}
+
+	if o.MemLimit > 0 {
+		job.Requirements.RAM = o.MemLimit
+		job.Override = 2
+	} else if o.MemReserve > 0 {
+		job.Requirements.RAM = o.MemReserve
+		job.Override = 2
+	}
+
+	if o.Time > 0 {
+		job.Requirements.Time = o.Time
+		job.Override = 2
+	}
+
+	if o.Queue != "" {
+		if job.Requirements.Other == nil {
+			job.Requirements.Other = make(map[string]string)
+		}
+		job.Requirements.Other["scheduler_queue"] = o.Queue
+	}
+
+	if o.Cwd != "" {
+		if filepath.IsAbs(o.Cwd) {
+			job.Cwd = o.Cwd
+		} else {
+			job.Cwd = filepath.Join(job.Cwd, o.Cwd)
+		}
+	}
+
+	job.Dependencies = append(job.Dependencies, o.Dependencies...)
+
+	job.Cmd = o.cmdPrefix() + job.Cmd
+
+	if o.Array != nil {
+		job.Array = o.Array
+
+		if o.ArrayLimit > 0 {
+			job.LimitGroups = append(job.LimitGroups,
+				fmt.Sprintf("%sarray.%s:%d", bsubDepGroupPrefix, job.ArrayKey(), o.ArrayLimit))
+		}
+	}
+}
+
+// cmdPrefix returns the lines that should go before a job's Cmd to set
+// $LSB_JOBINDEX for array elements, and to redirect STDIN, STDOUT and STDERR.
+func (o *BsubOptions) cmdPrefix() string {
+	var prefix string
+	if o.Array != nil {
+		prefix = bsubIndexLine
+	}
+
+	if o.Input != "" {
+		prefix += "exec <" + bsubFilePath(o.Input) + "\n"
+	}
+
+	if o.Output != "" {
+		prefix += "exec " + bsubRedirect(o.OverwriteOutput) + bsubFilePath(o.Output)
+		if o.Error == "" {
+			prefix += " 2>&1"
+		}
+		prefix += "\n"
+	}
+
+	if o.Error != "" {
+		prefix += "exec 2" + bsubRedirect(o.OverwriteError) + bsubFilePath(o.Error) + "\n"
+	}
+
+	return prefix
+}
+
+// bsubRedirect returns the shell redirection operator to overwrite or append
+// to a file.
+func bsubRedirect(overwrite bool) string {
+	if overwrite {
+		return ">"
+	}
+
+	return ">>"
+}
+
+// bsubFilePath returns the given file path double quoted for use in a shell,
+// with LSF's %J and %I placeholders replaced with the job's ID and array index.
+func bsubFilePath(path string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+	placeholders := strings.NewReplacer("%J", "${LSB_JOBID}", "%I", "${LSB_JOBINDEX:-0}")
+
+	return `"` + placeholders.Replace(escaper.Replace(path)) + `"`
+}
+
+// ParseBsubDependencies parses an LSF dependency expression as given to bsub
+// -w, returning the equivalent Dependencies. The expression can consist of
+// done(), exit() and ended() conditions (or bare job names or IDs, which are
+// treated as done()) joined with &&. The conditions can refer to job names
+// (which become BsubNameDepGroup() dependencies) or IDs (which become
+// BsubIDDepGroup() dependencies).
+func ParseBsubDependencies(expr string) (Dependencies, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, nil
+	}
+
+	if strings.Contains(expr, "||") || strings.Contains(expr, "!") {
+		return nil, fmt.Errorf("only && is supported in dependency expressions")
+	}
+
+	var deps Dependencies
+
+	for _, term := range strings.Split(expr, "&&") {
+		term = strings.TrimSpace(term)
+		condition := "done"
+		target := term
+
+		if matches := bsubConditionRegex.FindStringSubmatch(term); matches != nil {
+			condition = matches[1]
+			target = matches[2]
+		}
+
+		var mode DependencyMode
+
+		switch condition {
+		case "done":
+			mode = DepModeSuccess
+		case "exit":
+			mode = DepModeFailure
+		case "ended":
+			mode = DepModeAny
+		default:
+			return nil, fmt.Errorf("dependency condition '%s' is not supported", condition)
+		}
+
+		target = strings.Trim(target, `"'`)
+		if target == "" || strings.ContainsAny(target, "()[]*, ") {
+			return nil, fmt.Errorf("dependency '%s' is not supported", term)
+		}
+
+		var dg string
+		if bsubIDRegex.MatchString(target) {
+			id, err := strconv.ParseUint(target, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			dg = BsubIDDepGroup(id)
+		} else {
+			dg = BsubNameDepGroup(target)
+		}
+
+		deps = append(deps, NewConditionalDependency(NewDepGroupDependency(dg), mode))
+	}
+
+	return deps, nil
+}
+
+// BsubDependencyStatus tells you if the given Dependency (as returned by
+// ParseBsubDependencies()) is satisfied, given the incomplete Jobs currently in
+// its DepGroup. It also tells you if the dependency can never be satisfied, eg.
+// because a job that had to complete successfully was buried.
+func BsubDependencyStatus(dep *Dependency, incomplete []*Job) (satisfied, unsatisfiable bool) {
+	var buried int
+	for _, job := range incomplete {
+		if job.State == JobStateBuried {
+			buried++
+		}
+	}
+
+	switch dep.mode() {
+	case DepModeFailure:
+		if len(incomplete) == 0 {
+			return false, true
+		}
+
+		return buried == len(incomplete), false
+	case DepModeAny:
+		return buried == len(incomplete), false
+	default:
+		if buried > 0 {
+			return false, true
+		}
+
+		return len(incomplete) == 0, false
+	}
+}
+
+// splitShellWords splits the given string on whitespace, like a shell would,
+// respecting single and double quotes and backslash escapes.
+func splitShellWords(str string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range str {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in '%s'", str)
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
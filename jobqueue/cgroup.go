@@ -0,0 +1,211 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions that let a Client run Cmds in their own
+// cgroup v2, so that the kernel enforces their memory and cpu Requirements.
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+const (
+	cgroupControllersFile = "cgroup.controllers"
+	cgroupSubtreeFile     = "cgroup.subtree_control"
+	cgroupProcsFile       = "cgroup.procs"
+	cgroupKillFile        = "cgroup.kill"
+	cgroupMemMaxFile      = "memory.max"
+	cgroupSwapMaxFile     = "memory.swap.max"
+	cgroupMemPeakFile     = "memory.peak"
+	cgroupMemCurrentFile  = "memory.current"
+	cgroupMemEventsFile   = "memory.events"
+	cgroupCPUMaxFile      = "cpu.max"
+	cgroupCPUPeriod       = 100000
+	cgroupPerm            = 0o755
+	cgroupFilePerm        = 0o644
+	bytesPerMB            = 1024 * 1024
+)
+
+// checkCgroupParent checks that the given directory is a cgroup v2 with the
+// memory controller available, and enables the memory and (if available) cpu
+// controllers for its children.
+func checkCgroupParent(parent string) error {
+	content, err := os.ReadFile(filepath.Join(parent, cgroupControllersFile))
+	if err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory: %w", parent, err)
+	}
+
+	available := make(map[string]bool)
+	for _, controller := range strings.Fields(string(content)) {
+		available[controller] = true
+	}
+	if !available["memory"] {
+		return fmt.Errorf("the memory controller is not available in cgroup %s", parent)
+	}
+
+	enable := "+memory"
+	if available["cpu"] {
+		enable += " +cpu"
+	}
+
+	err = os.WriteFile(filepath.Join(parent, cgroupSubtreeFile), []byte(enable), cgroupFilePerm)
+	if err != nil {
+		return fmt.Errorf("could not enable controllers in cgroup %s: %w", parent, err)
+	}
+
+	return nil
+}
+
+// cgroup represents a cgroup v2 that a single Cmd runs in.
+type cgroup struct {
+	path string
+}
+
+// newCgroup creates a cgroup with the given name beneath the given parent (which
+// should have passed checkCgroupParent()), limited to the RAM and Cores of the
+// given Requirements.
+func newCgroup(parent, name string, req *scheduler.Requirements) (*cgroup, error) {
+	cg := &cgroup{path: filepath.Join(parent, name)}
+
+	err := os.Mkdir(cg.path, cgroupPerm)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	if req.RAM > 0 {
+		if err = cg.write(cgroupMemMaxFile, strconv.Itoa(req.RAM*bytesPerMB)); err != nil {
+			return nil, cg.failedSetup(err)
+		}
+
+		// without this, going over memory.max would just result in swapping
+		if cg.has(cgroupSwapMaxFile) {
+			if err = cg.write(cgroupSwapMaxFile, "0"); err != nil {
+				return nil, cg.failedSetup(err)
+			}
+		}
+	}
+
+	if req.Cores > 0 && cg.has(cgroupCPUMaxFile) {
+		quota := int(math.Ceil(req.Cores * cgroupCPUPeriod))
+		if err = cg.write(cgroupCPUMaxFile, fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)); err != nil {
+			return nil, cg.failedSetup(err)
+		}
+	}
+
+	return cg, nil
+}
+
+// failedSetup removes our cgroup and returns the given error.
+func (cg *cgroup) failedSetup(err error) error {
+	if errr := cg.remove(); errr != nil {
+		return fmt.Errorf("%w (and removing the cgroup failed: %s)", err, errr)
+	}
+	return err
+}
+
+// has tells you if our cgroup has the given interface file.
+func (cg *cgroup) has(file string) bool {
+	_, err := os.Stat(filepath.Join(cg.path, file))
+	return err == nil
+}
+
+// write writes the given value to the given interface file of our cgroup.
+func (cg *cgroup) write(file, value string) error {
+	return os.WriteFile(filepath.Join(cg.path, file), []byte(value), cgroupFilePerm)
+}
+
+// readInt reads a single integer from the given interface file of our cgroup.
+func (cg *cgroup) readInt(file string) (int64, error) {
+	content, err := os.ReadFile(filepath.Join(cg.path, file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// shellPrefix returns a shell command line that moves the shell running it in
+// to our cgroup, exiting if that fails. Prefixing a Cmd with this ensures that
+// the Cmd and all its child processes start in the cgroup.
+func (cg *cgroup) shellPrefix() string {
+	return fmt.Sprintf("echo $$ > '%s' || exit 1; ", filepath.Join(cg.path, cgroupProcsFile))
+}
+
+// memory returns the current memory usage of our cgroup in MB.
+func (cg *cgroup) memory() (int, error) {
+	b, err := cg.readInt(cgroupMemCurrentFile)
+	return int(b / bytesPerMB), err
+}
+
+// peakMemory returns the peak memory usage of our cgroup in MB. On kernels that
+// don't record this, returns current usage instead.
+func (cg *cgroup) peakMemory() (int, error) {
+	if !cg.has(cgroupMemPeakFile) {
+		return cg.memory()
+	}
+
+	b, err := cg.readInt(cgroupMemPeakFile)
+	return int(b / bytesPerMB), err
+}
+
+// oomKilled tells you if the kernel killed any process in our cgroup because
+// it went over memory.max.
+func (cg *cgroup) oomKilled() bool {
+	f, err := os.Open(filepath.Join(cg.path, cgroupMemEventsFile))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, errp := strconv.Atoi(fields[1])
+			return errp == nil && n > 0
+		}
+	}
+
+	return false
+}
+
+// remove kills any processes still in our cgroup, then deletes it.
+func (cg *cgroup) remove() error {
+	if cg.has(cgroupKillFile) {
+		if err := cg.write(cgroupKillFile, "1"); err != nil {
+			return err
+		}
+	}
+
+	// interface files can't be deleted in a real cgroup, but rmdir works
+	// regardless of them
+	err := os.Remove(cg.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,353 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to checkpoints, which let Jobs that
+// have to be stopped before they complete resume from where they left off on
+// their next attempt.
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// checkpointDefaultGrace is the Grace of a Checkpoint if not specified.
+	checkpointDefaultGrace = 1 * time.Minute
+
+	// checkpointFileSuffix is appended to the hashed job key to give the file
+	// that the server stores a job's checkpoint in.
+	checkpointFileSuffix = ".checkpoint"
+)
+
+// checkpointSignals are the signals a Checkpoint can specify, by name.
+var checkpointSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// Checkpoint describes how a Job's Cmd saves its state so that it can resume
+// from there if it has to be stopped before it completes.
+//
+// When the runner executing the Job is asked to stop (eg. because the host it
+// is running on is being drained or shut down, or the job scheduler says it
+// has run out of time), or when it runs for longer than its Time Requirement
+// and the runner is enforcing limits with cgroups, the Cmd is sent Signal. It
+// then has Grace time to write its state to Dir and exit before it is killed.
+// After that, Dir is saved, and restored in to the working directory of the
+// next attempt at running the Job before its Cmd is run.
+//
+// If Dir is within a writable mount of the Job's MountConfigs, it is saved and
+// restored by that mount. Otherwise it is stored on the manager, so should not
+// be too large.
+type Checkpoint struct {
+	// Dir is the directory, relative to the Job's actual working directory,
+	// that the Cmd writes its state to.
+	Dir string
+
+	// Signal is the signal that tells the Cmd to write its state and exit.
+	// Defaults to SIGTERM.
+	Signal syscall.Signal
+
+	// Grace is how long the Cmd has to exit after being sent Signal, before
+	// it is killed. Defaults to 1 minute.
+	Grace time.Duration
+}
+
+// ParseCheckpoint parses a string specification of a checkpoint, in the form
+// of semi-colon separated settings, eg. "dir=ckpt;signal=USR1;grace=5m", and
+// returns the corresponding Checkpoint. Only dir is required. A blank spec
+// returns nil, meaning no checkpointing.
+func ParseCheckpoint(spec string) (*Checkpoint, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	cp := &Checkpoint{Signal: syscall.SIGTERM, Grace: checkpointDefaultGrace}
+	for _, setting := range strings.Split(spec, ";") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+
+		key, val, _ := strings.Cut(setting, "=")
+		key = strings.TrimSpace(key)
+		val = strings.TrimSpace(val)
+
+		var err error
+		switch key {
+		case "dir":
+			cp.Dir, err = checkpointDir(val)
+		case "signal":
+			sig, known := checkpointSignals[strings.TrimPrefix(strings.ToUpper(val), "SIG")]
+			if known {
+				cp.Signal = sig
+			} else {
+				err = fmt.Errorf("unsupported signal")
+			}
+		case "grace":
+			cp.Grace, err = time.ParseDuration(val)
+			if err == nil && cp.Grace < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint '%s' has a bad setting '%s': %w", spec, setting, err)
+		}
+	}
+
+	if cp.Dir == "" {
+		return nil, fmt.Errorf("checkpoint '%s' has no dir", spec)
+	}
+
+	return cp, nil
+}
+
+// checkpointDir cleans the given directory, which must be within the working
+// directory.
+func checkpointDir(dir string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("no dir given")
+	}
+
+	dir = filepath.Clean(dir)
+	if filepath.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", fmt.Errorf("must be a directory within the working directory")
+	}
+
+	return dir, nil
+}
+
+// String returns the checkpoint in the form taken by ParseCheckpoint().
+func (cp *Checkpoint) String() string {
+	if cp == nil {
+		return ""
+	}
+
+	signal := "TERM"
+	for name, sig := range checkpointSignals {
+		if sig == cp.Signal {
+			signal = name
+			break
+		}
+	}
+
+	return fmt.Sprintf("dir=%s;signal=%s;grace=%s", cp.Dir, signal, cp.Grace)
+}
+
+// checkpointPath returns the absolute path of our Checkpoint's Dir, or blank if
+// we don't have a Checkpoint.
+func (j *Job) checkpointPath() string {
+	j.RLock()
+	defer j.RUnlock()
+
+	if j.Checkpoint == nil {
+		return ""
+	}
+
+	cwd := j.ActualCwd
+	if cwd == "" {
+		cwd = j.Cwd
+	}
+
+	return filepath.Join(cwd, j.Checkpoint.Dir)
+}
+
+// checkpointInWritableMount tells you if our Checkpoint's Dir is within one of
+// our MountConfigs that has a writable Target, in which case that mount will
+// take care of saving and restoring it.
+func (j *Job) checkpointInWritableMount() bool {
+	path := j.checkpointPath()
+	if path == "" {
+		return false
+	}
+
+	j.RLock()
+	defer j.RUnlock()
+
+	cwd := j.ActualCwd
+	defaultMount := cwd
+	if cwd == "" {
+		cwd = j.Cwd
+		defaultMount = filepath.Join(j.Cwd, "mnt")
+	}
+
+	for _, mc := range j.MountConfigs {
+		writable := false
+		for _, mt := range mc.Targets {
+			if mt.Write {
+				writable = true
+				break
+			}
+		}
+		if !writable {
+			continue
+		}
+
+		mount := mc.Mount
+		switch {
+		case mount == "":
+			mount = defaultMount
+		case !filepath.IsAbs(mount):
+			mount = filepath.Join(cwd, mount)
+		}
+
+		if rel, err := filepath.Rel(mount, path); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tarDir creates a compressed tar archive of the contents of the given
+// directory. Since this happens in memory, only suitable for small
+// directories!
+func tarDir(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return compress(buf.Bytes())
+}
+
+// untarDir extracts an archive created by tarDir() in to the given directory,
+// which will be created if necessary.
+func untarDir(compressed []byte, dir string) error {
+	data, err := decompress(compressed)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("checkpoint archive contains bad path %s", header.Name)
+		}
+		path := filepath.Join(dir, rel)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, os.FileMode(header.Mode)|0o700)
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, path)
+		case tar.TypeReg:
+			err = untarFile(tr, path, os.FileMode(header.Mode))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// untarFile writes the current file of the given tar.Reader to the given path.
+func untarFile(tr *tar.Reader, path string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, tr); err != nil { // #nosec our own archives
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -34,6 +34,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -73,6 +74,7 @@ const (
 	FailReasonMount    = "mounting of remote file system(s) failed"
 	FailReasonUpload   = "failed to upload files to remote file system"
 	FailReasonKilled   = "killed by user request"
+	FailReasonDeps     = "dependencies can never be satisfied"
 )
 
 // lsfEmulationDir is the name of the directory we store our LSF emulation
@@ -135,6 +137,15 @@ type clientRequest struct {
 	ConfirmDeadCloudServers bool
 	DestroyCloudHost        string
 	ReturnIDs               bool // when adding jobs, return the IDs of the added jobs
+	EventFilter             *EventFilter
+	EventSeq                uint64
+	DBVersion               dbVersion
+	DBOffset                int64
+	Term                    uint64 // highest fencing term the client knows of
+	LogChunks               []*LogChunk
+	Cron                    *CronJob
+	Query                   *JobQuery
+	User                    *User
 }
 
 // Client represents the client side of the socket that the jobqueue server is
@@ -145,12 +156,17 @@ type Client struct {
 	hasReserved bool
 	sock        mangos.Socket
 	sync.Mutex
-	teMutex    sync.Mutex // to protect Touch() from other methods during Execute()
-	token      []byte
-	ServerInfo *ServerInfo
-	host       string
-	port       string
-	args       []string // allowing internal reconnects
+	teMutex     sync.Mutex // to protect Touch() from other methods during Execute()
+	token       []byte
+	ServerInfo  *ServerInfo
+	host        string
+	port        string
+	args        []string // allowing internal reconnects
+	timeout     time.Duration
+	standby     string        // addr of a standby server that may take over from the server
+	term        uint64        // highest fencing term of the servers we've connected to
+	cgroup      string        // parent cgroup for Execute() to run Cmds beneath
+	logInterval time.Duration // how often Execute() streams Cmd output to the server
 }
 
 // envStr holds the []string from os.Environ(), for codec compatibility.
@@ -233,6 +249,7 @@ func Connect(addr, caFile, certDomain string, token []byte, timeout time.Duratio
 		host:     addrParts[0],
 		port:     addrParts[1],
 		args:     []string{addr, caFile, certDomain},
+		timeout:  timeout,
 	}
 
 	// Dial succeeds even when there's no server up, so we test the connection
@@ -250,6 +267,8 @@ func Connect(addr, caFile, certDomain string, token []byte, timeout time.Duratio
 		return nil, Error{"Connect", "", msg}
 	}
 	c.ServerInfo = si
+	c.standby = si.Standby
+	c.term = si.Term
 
 	return c, err
 }
@@ -266,7 +285,91 @@ func ConnectUsingConfig(ctx context.Context, deployment string, timeout time.Dur
 		return nil, fmt.Errorf("could not read token file; has the manager been started? [%w]", err)
 	}
 
-	return Connect(config.ManagerHost+":"+config.ManagerPort, config.ManagerCAFile, config.ManagerCertDomain, token, timeout)
+	addr := config.ManagerHost + ":" + config.ManagerPort
+	c, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, timeout)
+	if config.ManagerStandbyHost == "" {
+		return c, err
+	}
+	standby := config.ManagerStandbyHost + ":" + config.ManagerPort
+
+	if err == nil {
+		if c.standby == "" {
+			c.standby = standby
+		}
+		return c, err
+	}
+
+	// the manager may have died and its standby taken over
+	sc, errs := Connect(standby, config.ManagerCAFile, config.ManagerCertDomain, token, timeout)
+	if errs != nil {
+		return c, err
+	}
+	if sc.standby == "" {
+		sc.standby = addr
+	}
+
+	return sc, nil
+}
+
+// reconnect replaces our connection to the server with a new one that uses the
+// given timeout. The server we originally connected to is tried first, then any
+// standby server that might have taken over from it. Servers with a lower term
+// than one we connected to before have been taken over from, so are told to
+// stop instead of being used. Our Reserve()d jobs are unaffected.
+func (c *Client) reconnect(timeout time.Duration) error {
+	c.Lock()
+	addrs := []string{c.args[0]}
+	if c.standby != "" && c.standby != c.args[0] {
+		addrs = append(addrs, c.standby)
+	}
+	term := c.term
+	c.Unlock()
+
+	var err error
+	for _, addr := range addrs {
+		var newC *Client
+		newC, err = Connect(addr, c.args[1], c.args[2], c.token, timeout)
+		if err != nil {
+			continue
+		}
+
+		if newC.term < term {
+			newC.fence(term)
+			newC.sock.Close() // we don't care if it was already closed
+			err = Error{"Connect", "", ErrFenced}
+			continue
+		}
+
+		c.Lock()
+		c.sock.Close() // we don't care if it was already closed
+		c.sock = newC.sock
+		c.ServerInfo = newC.ServerInfo
+		c.term = newC.term
+		if addr != c.args[0] {
+			// the standby took over; should it die in turn, the original
+			// server might be back
+			c.standby = c.args[0]
+			c.args[0] = addr
+			addrParts := strings.Split(addr, ":")
+			c.host = addrParts[0]
+			c.port = addrParts[1]
+		}
+		c.Unlock()
+
+		return nil
+	}
+
+	return err
+}
+
+// fence tells the server we're connected to that a server with the given higher
+// term has taken over from it, so that it stops.
+func (c *Client) fence(term uint64) {
+	c.Lock()
+	c.term = term
+	c.Unlock()
+
+	c.Ping(c.timeout) //nolint:errcheck // it responds with ErrFenced
 }
 
 // Disconnect closes the connection to the jobqueue server. It is CRITICAL that
@@ -486,6 +589,26 @@ func (c *Client) ReserveScheduled(timeout time.Duration, schedulerGroup string)
 	return resp.Job, err
 }
 
+// UseCgroups makes subsequent Execute() calls run each Cmd in its own cgroup v2
+// created beneath the given parent cgroup directory, which must be delegated to
+// the user we run as. The kernel will then enforce the RAM and Cores of each
+// Job's Requirements, and peak RAM will be taken from the cgroup's accounting.
+// We will also kill Cmds that run longer than their Time Requirement.
+//
+// Returns an error if parent is not a cgroup v2 with the memory controller
+// available, in which case Cmds will continue to run without cgroups.
+func (c *Client) UseCgroups(parent string) error {
+	if err := checkCgroupParent(parent); err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.cgroup = parent
+
+	return nil
+}
+
 // Execute runs the given Job's Cmd and blocks until it exits. Then any Job
 // Behaviours get triggered as appropriate for the exit status.
 //
@@ -529,7 +652,7 @@ func (c *Client) ReserveScheduled(timeout time.Duration, schedulerGroup string)
 //
 // You have to have been the one to Reserve() the supplied Job, or this will
 // immediately return an error. NB: the peak RAM tracking assumes we are running
-// on a modern linux system with /proc/*/smaps.
+// on a modern linux system with /proc/*/smaps, unless UseCgroups() was called.
 func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 	ctx = clog.ContextWithJobKey(ctx, job.Key())
 	// quickly check upfront that we Reserve()d the job; this isn't required
@@ -540,6 +663,9 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		return Error{"Execute", job.Key(), ErrMustReserve}
 	}
 
+	// our CopyToManager behaviour needs to send files to the server using us
+	job.client = c
+
 	// we have a convienience feature that can run Cmd in a container, so get
 	// possibly modified Cmd
 	jc, cmdLineCleanup, err := job.CmdLine(ctx)
@@ -553,6 +679,24 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 	if strings.Contains(jc, " | ") {
 		jc = "set -o pipefail; " + jc
 	}
+
+	// if we were asked to UseCgroups(), have the shell put itself in its own
+	// cgroup before running anything, so the kernel can enforce our limits
+	var cg *cgroup
+	if c.cgroup != "" {
+		cg, err = newCgroup(c.cgroup, "wr-"+job.Key(), job.Requirements)
+		if err != nil {
+			clog.Warn(ctx, "could not create cgroup, so limits won't be enforced", "err", err)
+		} else {
+			jc = cg.shellPrefix() + jc
+			defer func() {
+				if errr := cg.remove(); errr != nil {
+					clog.Warn(ctx, "failed to remove cgroup", "path", cg.path, "err", errr)
+				}
+			}()
+		}
+	}
+
 	cmd := exec.Command(shell, "-c", jc) // #nosec Our whole purpose is to allow users to run arbitrary commands via us...
 
 	// we'll filter STDERR/OUT of the cmd to keep only the first and last line
@@ -563,13 +707,24 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		return fmt.Errorf("failed to create a pipe for STDERR from cmd [%s]: %w", jc, err)
 	}
 	stderr := &prefixSuffixSaver{N: 4096}
-	stderrWait := stdFilter(errReader, stderr)
+	var stderrWriter io.Writer = stderr
 	outReader, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("failed to create a pipe for STDOUT from cmd [%s]: %w", jc, err)
 	}
 	stdout := &prefixSuffixSaver{N: 4096}
-	stdoutWait := stdFilter(outReader, stdout)
+	var stdoutWriter io.Writer = stdout
+
+	// if we were asked to StreamLogs(), we'll also send all the filtered
+	// output to the server as the cmd runs
+	var streamer *logStreamer
+	if c.logInterval > 0 {
+		streamer = newLogStreamer(c, job)
+		stderrWriter = io.MultiWriter(stderr, streamer.writer(LogStreamStderr))
+		stdoutWriter = io.MultiWriter(stdout, streamer.writer(LogStreamStdout))
+	}
+	stderrWait := stdFilter(errReader, stderrWriter)
+	stdoutWait := stdFilter(outReader, stdoutWriter)
 
 	// we'll run the command from the desired directory, which must exist or
 	// it will fail
@@ -636,6 +791,15 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 					// we may have lost contact with the manager; this is OK. We
 					// will keep trying to touch until it works
 					clog.Warn(ctx, "could not touch", "err", errf)
+
+					// if we got no response (or were told so) and the manager
+					// has a standby, the standby may have taken over
+					jqerr, isJQErr := errf.(Error)
+					if (!isJQErr || jqerr.Err == ErrFenced) && c.hasStandby() {
+						if errr := c.reconnect(c.timeout); errr == nil {
+							clog.Info(ctx, "reconnected to server")
+						}
+					}
 					continue
 				}
 			case <-stopTouching:
@@ -764,6 +928,14 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		}
 	}
 
+	// restore the state saved by a previous attempt that had to stop before it
+	// completed, unless a writable mount will already have done so
+	if job.Checkpoint != nil && job.CheckpointSaved && !job.checkpointInWritableMount() {
+		if errr := c.restoreCheckpoint(job); errr != nil {
+			clog.Warn(ctx, "could not restore checkpoint, so starting from scratch", "err", errr)
+		}
+	}
+
 	// and we'll run it with the environment variables that were present when
 	// the command was first added to the queue (or if none, current env vars,
 	// and in either case, including any overrides) *** we need a way for users
@@ -800,6 +972,12 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 			env = envOverride(env, []string{"HOME=" + actualCwd})
 		}
 	}
+	if job.ArrayID != "" {
+		env = envOverride(env, []string{
+			"WR_ARRAY_ID=" + job.ArrayID,
+			"WR_ARRAY_INDEX=" + strconv.Itoa(job.ArrayIndex),
+		})
+	}
 	if prependPath != "" {
 		// alter env PATH to have prependPath come first
 		override := []string{"PATH=" + prependPath}
@@ -845,6 +1023,13 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 			"LSF_BINDIR=" + prependPath,
 		})
 	}
+	if job.BsubID != 0 {
+		// jobs added via bsub can find out their own id, like in LSF
+		env = envOverride(env, []string{
+			"LSB_JOBID=" + strconv.FormatUint(job.BsubID, 10),
+			"LSB_JOBINDEX=0",
+		})
+	}
 	cmd.Env = env
 
 	// if docker monitoring has been requested, try and get the docker client
@@ -935,6 +1120,10 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		return fmt.Errorf("command [%s] started running, but I killed it due to a jobqueue server error: %w%s", job.Cmd, err, extra)
 	}
 
+	if streamer != nil {
+		streamer.start(ctx, c.logInterval)
+	}
+
 	// update peak mem and disk used by command, and check if we use too much
 	// resources, every second. Also check for signals
 	peakmem := 0
@@ -946,6 +1135,7 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 	ranoutTime := false
 	ranoutDisk := false
 	signalled := false
+	checkpointed := false
 	killCalled := false
 	var killErr error
 	var closeErr error
@@ -1026,6 +1216,35 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 			return errk
 		}
 
+		// if the cmd can checkpoint, ask it to save its state and exit,
+		// returning true if it does so within its grace time
+		checkpointCmd := func() bool {
+			if job.Checkpoint == nil {
+				return false
+			}
+
+			stateMutex.Lock()
+			checkpointed = true
+			stateMutex.Unlock()
+
+			children, _ := getChildProcesses(int32(cmd.Process.Pid)) //nolint:errcheck
+			errs := cmd.Process.Signal(job.Checkpoint.Signal)
+			for _, child := range children {
+				child.SendSignal(job.Checkpoint.Signal) //nolint:errcheck
+			}
+			if errs != nil {
+				return false
+			}
+			clog.Info(ctx, "asked cmd to checkpoint", "cmd", job.Cmd, "pid", cmd.Process.Pid)
+
+			select {
+			case <-stopChecking:
+				return true
+			case <-time.After(job.Checkpoint.Grace):
+				return false
+			}
+		}
+
 		closeReaders := func() {
 			errc := errReader.Close()
 			if errc != nil {
@@ -1055,7 +1274,9 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 			select {
 			case signal := <-sigs:
 				clog.Warn(ctx, "aborting due to signal", "sig", signal.String())
-				killErr = killCmd()
+				if !checkpointCmd() {
+					killErr = killCmd()
+				}
 				stateMutex.Lock()
 				if time.Now().After(endT) {
 					// we allow things to go over time, but if signalled, we now
@@ -1079,8 +1300,28 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 					break CHECKING
 				}
 
+				// when using a cgroup, the kernel kills the cmd if it uses
+				// too much memory, but we must kill it if it runs out of time
+				if cg != nil && job.Requirements.Time > 0 && time.Now().After(endT) {
+					clog.Warn(ctx, "aborting due to running out of time")
+					stateMutex.Lock()
+					ranoutTime = true
+					stateMutex.Unlock()
+					if !checkpointCmd() {
+						killErr = killCmd()
+					}
+					closeReaders()
+					break CHECKING
+				}
+
 				// get current memory usage
-				mem, errf := currentMemory(job.Pid)
+				var mem int
+				var errf error
+				if cg != nil {
+					mem, errf = cg.memory()
+				} else {
+					mem, errf = currentMemory(job.Pid)
+				}
 
 				// deal with docker monitoring
 				var cpuS int
@@ -1139,7 +1380,7 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 				if errf == nil && mem > peakmem {
 					peakmem = mem
 
-					if peakmem > job.Requirements.RAM {
+					if cg == nil && peakmem > job.Requirements.RAM {
 						// if we later fail we'll assume it's because we used
 						// too much memory, but won't kill the cmd unless...
 						ranoutMem = true
@@ -1178,6 +1419,9 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 	// wait for the command to exit
 	errsew := <-stderrWait
 	errsow := <-stdoutWait
+	if streamer != nil {
+		streamer.finish()
+	}
 	err = cmd.Wait()
 	resourceTicker.Stop()
 	stopChecking <- true
@@ -1207,6 +1451,15 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		peakmem = peakRSSMB
 	}
 
+	// a cgroup accounts for all the cmd's processes together, and knows if the
+	// kernel killed any of them for using too much memory
+	if cg != nil {
+		if cgPeak, errp := cg.peakMemory(); errp == nil && cgPeak > 0 {
+			peakmem = cgPeak
+		}
+		ranoutMem = cg.oomKilled()
+	}
+
 	// include our own memory usage in the peakmem of the command, since the
 	// peak memory is used to schedule us in the job scheduler, which may
 	// kill us for using more memory than expected: we need to allow for our
@@ -1253,8 +1506,18 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		}
 	}
 
+	// save the state of a cmd we asked to checkpoint, unless a writable mount
+	// will do so when we unmount
+	var cperr error
+	if checkpointed && !job.checkpointInWritableMount() {
+		cperr = c.saveCheckpoint(job)
+		if cperr != nil {
+			clog.Warn(ctx, "failed to save checkpoint", "err", cperr)
+		}
+	}
+
 	// run behaviours
-	berr := job.TriggerBehaviours(err == nil && myerr == nil)
+	berr := job.TriggerBehaviours(err == nil && myerr == nil && !checkpointed)
 	if berr != nil {
 		if myerr != nil {
 			myerr = fmt.Errorf("%v; behaviour(s) also had problem(s): %w", myerr, berr)
@@ -1297,6 +1560,11 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		finalStdErr = append(finalStdErr, berr.Error()...)
 	}
 
+	if cperr != nil {
+		finalStdErr = append(finalStdErr, "\n\nCheckpoint problems:\n"...)
+		finalStdErr = append(finalStdErr, cperr.Error()...)
+	}
+
 	if errsew != nil {
 		finalStdErr = append(finalStdErr, "\n\nSTDERR handling problems:\n"...)
 		finalStdErr = append(finalStdErr, errsew.Error()...)
@@ -1349,14 +1617,12 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 				case ranoutDisk:
 					failreason = FailReasonDisk
 					myerr = Error{"Execute", job.Key(), FailReasonDisk}
+				case ranoutTime:
+					failreason = FailReasonTime
+					myerr = Error{"Execute", job.Key(), FailReasonTime}
 				case signalled:
-					if ranoutTime {
-						failreason = FailReasonTime
-						myerr = Error{"Execute", job.Key(), FailReasonTime}
-					} else {
-						failreason = FailReasonSignal
-						myerr = Error{"Execute", job.Key(), FailReasonSignal}
-					}
+					failreason = FailReasonSignal
+					myerr = Error{"Execute", job.Key(), FailReasonSignal}
 				case killCalled:
 					dobury = true
 					failreason = FailReasonKilled
@@ -1365,6 +1631,10 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 					dobury = true
 					failreason = FailReasonExit
 					myerr = fmt.Errorf("command [%s] exited with code %d%s%s", job.Cmd, exitcode, ", after the noretries time, so will not be be tried again", cmdOut)
+				case job.UntilBuried > 1 && job.RetryPolicy.noRetry(exitcode):
+					dobury = true
+					failreason = FailReasonExit
+					myerr = fmt.Errorf("command [%s] exited with code %d%s%s", job.Cmd, exitcode, ", which its retry policy says not to retry", cmdOut)
 				default:
 					failreason = FailReasonExit
 					myerr = fmt.Errorf("command [%s] exited with code %d%s%s", job.Cmd, exitcode, mayBeTemp, cmdOut)
@@ -1377,6 +1647,15 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 			failreason = FailReasonAbnormal
 			myerr = fmt.Errorf("command [%s] failed to complete normally (%w)%s%s", job.Cmd, err, mayBeTemp, cmdOut)
 		}
+	} else if checkpointed {
+		// the command exited cleanly, but only because we asked it to stop
+		exitcode = cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+		dorelease = true
+		failreason = FailReasonSignal
+		if ranoutTime {
+			failreason = FailReasonTime
+		}
+		myerr = Error{"Execute", job.Key(), failreason}
 	} else {
 		// the command worked fine
 		exitcode = cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
@@ -1416,7 +1695,7 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		if disconnected {
 			// we've previously failed to contact the server; try a quick
 			// connect attempt
-			newC, errc := Connect(c.args[0], c.args[1], c.args[2], c.token, 1*time.Second)
+			errc := c.reconnect(1 * time.Second)
 			if errc != nil {
 				clog.Warn(ctx, "tried to reconnect to server but failed", "err", errc)
 
@@ -1430,9 +1709,6 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 			// timeout, but that should be good enough just to get through this)
 			clog.Info(ctx, "reconnected to server")
 			disconnected = false
-			c.Lock()
-			c.sock = newC.sock
-			c.Unlock()
 		}
 
 		// update the database with our final state
@@ -1489,8 +1765,8 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 	return myerr
 }
 
-// createLSFSymlinks creates symlinks of bsub, bjobs and bkill to own exe,
-// inside the given dir.
+// createLSFSymlinks creates symlinks of bsub, bjobs, bkill and bwait to own
+// exe, inside the given dir.
 func (c *Client) createLSFSymlinks(prependPath string, job *Job) error {
 	wr, erre := os.Executable()
 	if erre != nil {
@@ -1502,35 +1778,16 @@ func (c *Client) createLSFSymlinks(prependPath string, job *Job) error {
 		return fmt.Errorf("could not get path to wr: %s%s", erre, extra)
 	}
 
-	bsub := filepath.Join(prependPath, "bsub")
-	bjobs := filepath.Join(prependPath, "bjobs")
-	bkill := filepath.Join(prependPath, "bkill")
-	err := os.Symlink(wr, bsub)
-	if err != nil {
-		errb := c.Bury(job, nil, FailReasonCwd)
-		extra := ""
-		if errb != nil {
-			extra = fmt.Sprintf(" (and burying the job failed: %s)", errb)
-		}
-		return fmt.Errorf("could not create bsub symlink: %s%s", err, extra)
-	}
-	err = os.Symlink(wr, bjobs)
-	if err != nil {
-		errb := c.Bury(job, nil, FailReasonCwd)
-		extra := ""
-		if errb != nil {
-			extra = fmt.Sprintf(" (and burying the job failed: %s)", errb)
-		}
-		return fmt.Errorf("could not create bjobs symlink: %s%s", err, extra)
-	}
-	err = os.Symlink(wr, bkill)
-	if err != nil {
-		errb := c.Bury(job, nil, FailReasonCwd)
-		extra := ""
-		if errb != nil {
-			extra = fmt.Sprintf(" (and burying the job failed: %s)", errb)
+	for _, name := range []string{"bsub", "bjobs", "bkill", "bwait"} {
+		err := os.Symlink(wr, filepath.Join(prependPath, name))
+		if err != nil {
+			errb := c.Bury(job, nil, FailReasonCwd)
+			extra := ""
+			if errb != nil {
+				extra = fmt.Sprintf(" (and burying the job failed: %s)", errb)
+			}
+			return fmt.Errorf("could not create %s symlink: %s%s", name, err, extra)
 		}
-		return fmt.Errorf("could not create bkill symlink: %s%s", err, extra)
 	}
 
 	return nil
@@ -1576,9 +1833,24 @@ func (c *Client) Touch(job *Job) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+
+	if resp.Standby != "" {
+		c.Lock()
+		c.standby = resp.Standby
+		c.Unlock()
+	}
+
 	return resp.KillCalled, err
 }
 
+// hasStandby tells you if we know of a standby server that might take over from
+// the server we're connected to.
+func (c *Client) hasStandby() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.standby != ""
+}
+
 // JobEndState is used to describe the state of a job after it has (tried to)
 // execute it's Cmd. You supply these to Client.Bury(), Release() and Archive().
 // The cwd you supply should be the actual working directory used, which may be
@@ -1820,6 +2092,18 @@ func (c *Client) GetByRepGroup(repgroup string, subStr bool, limit int, state Jo
 	return resp.Jobs, err
 }
 
+// GetByArray gets the Jobs that were created by adding a Job with an Array, as
+// identified by the ArrayID they all share. If index is 0 or more, only gets
+// the Job with that ArrayIndex. 'getStd' and 'getEnv' are as for
+// GetByRepGroup().
+func (c *Client) GetByArray(arrayID string, index int, getStd bool, getEnv bool) ([]*Job, error) {
+	resp, err := c.request(&clientRequest{Method: "getba", Job: &Job{ArrayID: arrayID, ArrayIndex: index}, GetStd: getStd, GetEnv: getEnv})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, err
+}
+
 // GetIncomplete gets all Jobs that are currently in the jobqueue, ie. excluding
 // those that are complete and have been Archive()d. The args are as in
 // GetByRepGroup().
@@ -1831,12 +2115,49 @@ func (c *Client) GetIncomplete(limit int, state JobState, getStd bool, getEnv bo
 	return resp.Jobs, err
 }
 
+// QueryJobs gets Jobs in the given RepGroup (treated as a sub-string if subStr
+// is true), or all incomplete Jobs (as per GetIncomplete()) if repgroup is
+// blank, that match the Filter of the given query. A blank repgroup with subStr
+// true instead gets Jobs in all RepGroups, including complete ones, which can
+// be slow if there are many complete Jobs. 'limit', 'state', 'getStd'
+// and 'getEnv' are as for GetByRepGroup(), but 'limit' can't be used with a
+// query that sorts or pages.
+//
+// The results are sorted by the query's SortBy, and if its PageSize is set,
+// only that many Jobs are returned, along with a cursor string that you can set
+// as the Cursor of your query to get the next page. The cursor is blank when
+// there are no more pages.
+func (c *Client) QueryJobs(repgroup string, subStr bool, limit int, state JobState, query *JobQuery, getStd bool, getEnv bool) ([]*Job, string, error) {
+	if query == nil {
+		query = &JobQuery{}
+	}
+	resp, err := c.request(&clientRequest{Method: "getquery", Job: &Job{RepGroup: repgroup}, Search: subStr, Limit: limit, State: state, Query: query, GetStd: getStd, GetEnv: getEnv})
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Jobs, resp.Cursor, err
+}
+
+// GetArchived gets complete Jobs that the server moved out of its database and
+// in to archive files because of its retention policies. Supply the keys of
+// the Jobs you want, or the RepGroup of the Jobs you want, optionally with
+// subStr true to treat it as a sub-string to match against all RepGroups.
+// 'limit' is as for GetByRepGroup().
+func (c *Client) GetArchived(keys []string, repgroup string, subStr bool, limit int) ([]*Job, error) {
+	resp, err := c.request(&clientRequest{Method: "getarc", Keys: keys, Job: &Job{RepGroup: repgroup}, Search: subStr, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, err
+}
+
 // GetOrSetLimitGroup takes the name of a limit group and returns the current
 // limit for that group. If the group isn't known about, returns -1.
 //
 // If the name is suffixed with :n, where n is an integer, then the limit of
 // the group is set to n, and then n is returned. Setting n to -1 makes the
-// group forgotten about, effectively making it unlimited.
+// group forgotten about, effectively making it unlimited. Only admins can set
+// limits.
 func (c *Client) GetOrSetLimitGroup(group string) (int, error) {
 	resp, err := c.request(&clientRequest{Method: "getsetlg", LimitGroup: group})
 	if err != nil {
@@ -1856,6 +2177,92 @@ func (c *Client) GetLimitGroups() (map[string]int, error) {
 	return resp.LimitGroups, err
 }
 
+// AddCron adds a CronJob to the server, so that its Job will be added to the
+// queue at every tick of its Schedule (unless the Job from the previous tick is
+// still incomplete). The Job will run with the given environment variables, as
+// per Add(). The returned CronJob has its NextTick filled in.
+func (c *Client) AddCron(cj *CronJob, envVars []string) (*CronJob, error) {
+	compressed, err := c.CompressEnv(envVars)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.request(&clientRequest{Method: "cronadd", Cron: cj, Env: compressed})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Crons[0], err
+}
+
+// GetCrons returns all the CronJobs the server knows about, sorted by Name.
+func (c *Client) GetCrons() ([]*CronJob, error) {
+	resp, err := c.request(&clientRequest{Method: "crons"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Crons, err
+}
+
+// RemoveCron stops the CronJob with the given Name from adding any more Jobs
+// to the queue, and forgets about it. Jobs it already added are unaffected.
+func (c *Client) RemoveCron(name string) error {
+	_, err := c.request(&clientRequest{Method: "cronremove", Cron: &CronJob{Name: name}})
+	return err
+}
+
+// AddUser has the server create a new User with the given name, who will
+// own the Jobs they add. Admin users can act on anyone's Jobs and manage the
+// server. Only admins can add Users.
+//
+// The returned User has its Token set; this is the only time the token is
+// available, so you must give it to the person the User is for, who should
+// write it to a file and set their ManagerTokenFile config option to that
+// file.
+func (c *Client) AddUser(name string, admin bool) (*User, error) {
+	resp, err := c.request(&clientRequest{Method: "useradd", User: &User{Name: name, Admin: admin}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Users[0], err
+}
+
+// RemoveUser has the server forget about the User with the given name, so that
+// their token stops working. Jobs they own are unaffected. Only admins can
+// remove Users.
+func (c *Client) RemoveUser(name string) error {
+	_, err := c.request(&clientRequest{Method: "userdel", User: &User{Name: name}})
+	return err
+}
+
+// GetUsers returns all the Users the server knows about (without their
+// Tokens), sorted by Name. Only admins can get Users.
+func (c *Client) GetUsers() ([]*User, error) {
+	resp, err := c.request(&clientRequest{Method: "users"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Users, err
+}
+
+// WhoAmI returns the User (without their Token) that the server identifies
+// this client as, based on the token the client connected with.
+func (c *Client) WhoAmI() (*User, error) {
+	resp, err := c.request(&clientRequest{Method: "whoami"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Users[0], err
+}
+
+// GetFairShare returns the current fair-share state of every account, sorted
+// by Name. Returns an error if the server has no fair-share policy.
+func (c *Client) GetFairShare() ([]*FairShareAccount, error) {
+	resp, err := c.request(&clientRequest{Method: "fairshare"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.FairShare, err
+}
+
 // UploadFile uploads a local file to the machine where the server is running,
 // so you can add cloud jobs that need a script or config file on your local
 // machine to be copied over to created cloud instances.
@@ -1882,6 +2289,128 @@ func (c *Client) UploadFile(local, remote string) (string, error) {
 	return resp.Path, err
 }
 
+// copyToManager sends the given files (paths relative to the job's actual
+// working directory) to the server, which stores them under a directory unique
+// to the job. You have to have been the one to Reserve() the supplied Job, and
+// the job must still be running.
+//
+// NB: This is only suitable for transferring small files!
+func (c *Client) copyToManager(job *Job, paths []string) error {
+	c.teMutex.Lock()
+	defer c.teMutex.Unlock()
+	job.RLock()
+	defer job.RUnlock()
+
+	actualCwd := job.ActualCwd
+	if actualCwd == "" {
+		actualCwd = job.Cwd
+	}
+
+	for _, path := range paths {
+		relPath := filepath.Clean(path)
+		if filepath.IsAbs(relPath) {
+			var err error
+			relPath, err = filepath.Rel(actualCwd, relPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		if relPath == "." || relPath == ".." || strings.HasPrefix(relPath, "../") {
+			return fmt.Errorf("%s is not a file within the job's working directory", path)
+		}
+
+		compressed, err := compressFile(filepath.Join(actualCwd, relPath))
+		if err != nil {
+			return err
+		}
+
+		_, err = c.request(&clientRequest{Method: "jcopy", Job: job, File: compressed, Path: relPath})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveCheckpoint sends an archive of the job's Checkpoint Dir to the server, so
+// that it can be restored by restoreCheckpoint() before the next attempt at
+// running the job. Does nothing if the Dir doesn't exist. You have to have been
+// the one to Reserve() the supplied Job, and the job must still be running.
+//
+// NB: This is only suitable for small directories!
+func (c *Client) saveCheckpoint(job *Job) error {
+	path := job.checkpointPath()
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	archive, err := tarDir(path)
+	if err != nil {
+		return err
+	}
+
+	c.teMutex.Lock()
+	defer c.teMutex.Unlock()
+	_, err = c.request(&clientRequest{Method: "jcheckpoint", Job: job, File: archive})
+	return err
+}
+
+// restoreCheckpoint gets the archive stored by a previous saveCheckpoint() for
+// the given job, and extracts it to the job's Checkpoint Dir, unless that
+// already has content (because we're running in the same place as the previous
+// attempt).
+func (c *Client) restoreCheckpoint(job *Job) error {
+	path := job.checkpointPath()
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		return nil
+	}
+
+	c.teMutex.Lock()
+	resp, err := c.request(&clientRequest{Method: "getcheckpoint", Job: job})
+	c.teMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return untarDir(resp.File, path)
+}
+
+// GetCopiedFile gets the content of a file that was copied to the server by the
+// CopyToManager behaviour of the job with the given key. The path should be one
+// of the job's CopiedFiles. Only the job's owner and admins can get its files.
+func (c *Client) GetCopiedFile(jobKey, path string) ([]byte, error) {
+	resp, err := c.request(&clientRequest{Method: "getcopied", Keys: []string{jobKey}, Path: path})
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(resp.File)
+}
+
+// GetEvents gets JobEvents describing the state changes of jobs in the queue,
+// that happened after the event with the given Seq. Supply 0 to get all events
+// the server still remembers. If filter is non-nil, only events that pass the
+// filter are returned.
+//
+// If there are no such events, waits up to the given wait duration for some to
+// happen. This must be less than the timeout you supplied to Connect(). If
+// nothing happens during the wait, returns no events and no error.
+//
+// Also returns the Seq of the latest event, which you should supply to your
+// next call to get only events you haven't seen before.
+func (c *Client) GetEvents(filter *EventFilter, since uint64, wait time.Duration) ([]*JobEvent, uint64, error) {
+	resp, err := c.request(&clientRequest{Method: "getevents", EventFilter: filter, EventSeq: since, Timeout: wait})
+	if err != nil {
+		return nil, since, err
+	}
+	return resp.Events, resp.EventSeq, err
+}
+
 // GetBadCloudServers (if the server is running with a cloud scheduler) returns
 // servers that are currently non-responsive and might be dead.
 func (c *Client) GetBadCloudServers() ([]*BadServer, error) {
@@ -1905,7 +2434,8 @@ func (c *Client) GetBadCloudServers() ([]*BadServer, error) {
 // with a state of "running", but as soon as it would normally be marked as
 // lost, it will be instead be treated as if you confirmed it dead. The job's
 // UntilBuried is what it will be at that future time point, so if it is 0 you
-// know this currently running job will be buried.
+// know this currently running job will be buried. Only admins can confirm
+// servers dead.
 func (c *Client) ConfirmCloudServersDead(id string) ([]*BadServer, []*Job, error) {
 	resp, err := c.request(&clientRequest{Method: "getbcs", ConfirmDeadCloudServers: true, CloudServerID: id})
 	if err != nil {
@@ -1942,6 +2472,7 @@ func (c *Client) request(cr *clientRequest) (*serverResponse, error) {
 	enc := codec.NewEncoderBytes(&encoded, c.ch)
 	cr.Token = c.token
 	cr.ClientID = c.clientid
+	cr.Term = c.term
 	err := enc.Encode(cr)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,340 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to recurring jobs: a Job template
+// and a cron-style schedule, that the server uses to add a fresh Job to the
+// queue at each tick of the schedule.
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMaxSearch is how far in to the future CronSchedule.Next() will look for
+// a matching time before giving up.
+const cronMaxSearch = 5 * 366 * 24 * time.Hour
+
+// cronRepGroupPrefix is prefixed to the Name of a CronJob to form the RepGroup
+// of its Job, if that wasn't set.
+const cronRepGroupPrefix = "cron."
+
+// cronNameRegex matches valid CronJob Names.
+var cronNameRegex = regexp.MustCompile(`^[\w.-]+$`)
+
+// cronMacros are the @ shorthands we understand for common schedules.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronField describes the allowed values of one of the 5 fields of a cron
+// expression.
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names []string // names for values, starting at min
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: []string{
+		"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec",
+	}}
+	cronDow = cronField{name: "day of week", min: 0, max: 7, names: []string{
+		"sun", "mon", "tue", "wed", "thu", "fri", "sat",
+	}}
+)
+
+// value converts a single number or name to its integer value.
+func (f cronField) value(str string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(str, name) {
+			return f.min + i, nil
+		}
+	}
+
+	v, err := strconv.Atoi(str)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("'%s' is not a valid %s (%d-%d)", str, f.name, f.min, f.max)
+	}
+	return v, nil
+}
+
+// parse converts a comma separated list of *, n, n-m, */step or n-m/step in to
+// a bit set of the allowed values. Also returns true if the field was *.
+func (f cronField) parse(field string) (uint64, bool, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, false, fmt.Errorf("'%s' has an invalid %s step", part, f.name)
+			}
+			part = part[:i]
+		}
+
+		start, end := f.min, f.max
+		switch {
+		case part == "*":
+			if field == "*" {
+				return f.allBits(), true, nil
+			}
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			var err error
+			start, err = f.value(part[:i])
+			if err != nil {
+				return 0, false, err
+			}
+			end, err = f.value(part[i+1:])
+			if err != nil {
+				return 0, false, err
+			}
+			if end < start {
+				return 0, false, fmt.Errorf("'%s' is not a valid %s range", part, f.name)
+			}
+		default:
+			var err error
+			start, err = f.value(part)
+			if err != nil {
+				return 0, false, err
+			}
+			if step == 1 {
+				end = start
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, false, nil
+}
+
+// allBits returns a bit set with every allowed value of this field.
+func (f cronField) allBits() uint64 {
+	var bits uint64
+	for v := f.min; v <= f.max; v++ {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+// CronSchedule is a parsed cron expression, describing the times at which a
+// CronJob should add its Job to the queue.
+type CronSchedule struct {
+	spec    string
+	minutes uint64
+	hours   uint64
+	doms    uint64
+	months  uint64
+	dows    uint64
+	domStar bool
+	dowStar bool
+}
+
+// ParseCronSchedule parses a standard 5 field cron expression ("minute hour
+// day-of-month month day-of-week"), where each field can be *, a number, a
+// range like 1-5, a step like */15 or 0-30/10, or a comma separated list of
+// those. Months and days of the week can also be given as 3 letter names (jan,
+// mon etc.), and both 0 and 7 mean Sunday. As with cron, if both day of month
+// and day of week are restricted, a day matching either will do. The macros
+// @yearly, @monthly, @weekly, @daily and @hourly are also understood.
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	expr := strings.TrimSpace(spec)
+	if macro, exists := cronMacros[strings.ToLower(expr)]; exists {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron schedule '%s' does not have 5 fields", spec)
+	}
+
+	cs := &CronSchedule{spec: spec}
+	var err error
+	if cs.minutes, _, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if cs.hours, _, err = cronHour.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if cs.doms, cs.domStar, err = cronDom.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if cs.months, _, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if cs.dows, cs.dowStar, err = cronDow.parse(fields[4]); err != nil {
+		return nil, err
+	}
+
+	// treat 7 as Sunday
+	if cs.dows&(1<<7) != 0 {
+		cs.dows |= 1
+	}
+
+	if cs.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron schedule '%s' will never be triggered", spec)
+	}
+
+	return cs, nil
+}
+
+// String returns the expression this CronSchedule was parsed from.
+func (cs *CronSchedule) String() string {
+	return cs.spec
+}
+
+// Next returns the first time after t (to the minute) that matches this
+// schedule. Returns the zero time if there is no such time in the next 5 years.
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronMaxSearch)
+
+	for t.Before(limit) {
+		if cs.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if cs.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if cs.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// dayMatches tells you if the day of t matches our day of month and day of
+// week fields.
+func (cs *CronSchedule) dayMatches(t time.Time) bool {
+	dom := cs.doms&(1<<uint(t.Day())) != 0
+	dow := cs.dows&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case cs.domStar && cs.dowStar:
+		return true
+	case cs.domStar:
+		return dow
+	case cs.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// CronJob describes a Job that the server should add to the queue repeatedly,
+// at every tick of a cron Schedule (as understood by ParseCronSchedule()). If
+// the Job added at the previous tick is still incomplete (in the queue in any
+// state), the tick is skipped.
+//
+// Only Name, Schedule and Job need to be supplied when adding a CronJob; the
+// other properties are filled in by the server.
+type CronJob struct {
+	// Name uniquely identifies the CronJob, and can only contain letters,
+	// numbers, underscores, dots and dashes.
+	Name string
+
+	// Schedule is the cron expression describing when Job should be added.
+	Schedule string
+
+	// Job is the template for the Jobs that will be added. It can't be a job
+	// array. If it has no RepGroup, it will be given one of "cron.[Name]".
+	Job *Job
+
+	// Created is when the server first stored this CronJob.
+	Created time.Time
+
+	// LastTick is the time of the most recent tick of the Schedule.
+	LastTick time.Time
+
+	// LastAdded is the time the Job was last added to the queue.
+	LastAdded time.Time
+
+	// NextTick is when the Job will next be added to the queue.
+	NextTick time.Time
+
+	// Added is the number of times Job has been added to the queue.
+	Added int
+
+	// Skipped is the number of ticks that were skipped because the Job from
+	// an earlier tick was still incomplete.
+	Skipped int
+
+	schedule *CronSchedule
+}
+
+// validate checks that our Name is valid, that our Schedule parses, and that
+// we have a suitable Job, and stores the parsed Schedule.
+func (cj *CronJob) validate() error {
+	if !cronNameRegex.MatchString(cj.Name) {
+		return fmt.Errorf("cron name '%s' is not valid (use letters, numbers, _, . and - only)", cj.Name)
+	}
+
+	schedule, err := ParseCronSchedule(cj.Schedule)
+	if err != nil {
+		return err
+	}
+
+	if cj.Job == nil || cj.Job.Cmd == "" {
+		return fmt.Errorf("cron %s has no cmd", cj.Name)
+	}
+
+	if cj.Job.Array != nil {
+		return fmt.Errorf("cron %s can't have a job array as its job", cj.Name)
+	}
+
+	if err = cj.Job.validateDepGroups(); err != nil {
+		return err
+	}
+
+	if cj.Job.RepGroup == "" {
+		cj.Job.RepGroup = cronRepGroupPrefix + cj.Name
+	}
+
+	cj.schedule = schedule
+	return nil
+}
@@ -18,24 +18,24 @@
 
 package jobqueue
 
-// This file contains functions for interacting with our database, which is
-// boltdb, a simple key/val store with transactions and hot backup ability.
-// We don't use a generic ORM for boltdb like Storm, because we can do custom
-// queries that are multiple times faster than what Storm can do.
+// This file contains functions for interacting with our database. The actual
+// storage is done by a dbStore: by default boltdb, a simple key/val store with
+// transactions and hot backup ability (see dbBolt.go), or alternatively SQLite,
+// which has indexed tables that can be queried directly (see dbSQLite.go).
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/wtsi-ssg/wr/clog"
@@ -46,7 +46,6 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/sb10/waitgroup"
 	"github.com/ugorji/go/codec"
-	bolt "go.etcd.io/bbolt"
 )
 
 const (
@@ -55,26 +54,25 @@ const (
 	dbFilePermission              = 0o600
 	minimumTimeBetweenBackups     = 30 * time.Second
 	dbRunningTransactionsWaitTime = 1 * time.Minute
+	dbArchiveBatchSize            = 10000
+	dbCompactTxMaxSize            = 65536
+)
+
+// DBBackend* are the names of the storage backends a Server's database can use.
+const (
+	DBBackendBolt   = "bolt"
+	DBBackendSQLite = "sqlite"
 )
 
 var (
-	bucketJobsLive     = []byte("jobslive")
-	bucketJobsComplete = []byte("jobscomplete")
-	bucketRTK          = []byte("repgroupToKey")
-	bucketRGs          = []byte("repgroups")
-	bucketLGs          = []byte("limitgroups")
-	bucketDTK          = []byte("depgroupToKey")
-	bucketRDTK         = []byte("reverseDepgroupToKey")
-	bucketEnvs         = []byte("envs")
-	bucketStdO         = []byte("stdo")
-	bucketStdE         = []byte("stde")
-	bucketJobRAM       = []byte("jobRAM")
-	bucketJobDisk      = []byte("jobDisk")
-	bucketJobSecs      = []byte("jobSecs")
-	wipeDevDBOnInit    = true
-	forceBackups       = false
+	wipeDevDBOnInit = true
+	forceBackups    = false
 )
 
+// errStopIterating can be returned by the callbacks given to some dbStore
+// methods to make them stop calling it.
+var errStopIterating = errors.New("stop iterating")
+
 // Rec* variables are only exported for testing purposes (*** though they should
 // probably be user configurable somewhere...).
 var (
@@ -82,30 +80,272 @@ var (
 	RecSecRound = 1   // when we recommend time to reserve for a job, we round up to the nearest RecSecRound seconds
 )
 
-// sobsd ('slice of byte slice doublets') implements sort interface so we can
-// sort a slice of []byte doublets, sorting on the first byte slice, needed for
-// efficient Puts in to the database.
-type sobsd [][2][]byte
+// dbTable is one of the simple key/val tables of a dbStore.
+type dbTable int
+
+const (
+	dbTableEnvs dbTable = iota
+	dbTableArrays
+	dbTableCrons
+	dbTableUsers
+	dbTableMeta
+)
+
+// dbMeta* are the keys of the counters we keep in dbTableMeta.
+const (
+	// dbMetaGeneration is incremented every time the database is opened, which
+	// is when the numbering of the changes in our dbJournal starts again.
+	dbMetaGeneration = "generation"
+
+	// dbMetaTerm is the fencing token of the server using the database,
+	// incremented each time a standby server takes over.
+	dbMetaTerm = "term"
+)
 
-func (s sobsd) Len() int {
-	return len(s)
+// dbVersion is the version of a database's content, which changes whenever the
+// content does and never repeats for the same database.
+type dbVersion struct {
+	Generation uint64 // value of dbMetaGeneration
+	Seq        uint64 // number of the last change made in that generation
 }
 
-func (s sobsd) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
+// dbStatKind is a kind of resource usage stat that a dbStore keeps per
+// ReqGroup, used to make recommendations about resource requirements.
+type dbStatKind int
+
+const (
+	dbStatRAM dbStatKind = iota
+	dbStatDisk
+	dbStatSecs
+)
+
+// dbStat is a resource usage value of a particular kind.
+type dbStat struct {
+	kind  dbStatKind
+	value int
+}
+
+// dbJob is what a dbStore stores for a Job: its encoding, along with the
+// properties of it that a dbStore might want to look it up or index it by.
+type dbJob struct {
+	key              string
+	encoded          []byte
+	repGroup         string
+	reqGroup         string
+	depGroups        []string // the Job's non-blank DepGroups
+	dependencyGroups []string // the Job's Dependencies.DepGroups()
+	cmd              string
+	owner            string
+	exitcode         int
+	failReason       string
+	peakRAM          int
+	peakDisk         int
+	secs             int
+	startTime        time.Time
+	endTime          time.Time
+}
+
+// newDBJob encodes the given Job using the given codec, returning a dbJob
+// ready to be stored.
+func newDBJob(job *Job, ch codec.Handle) (*dbJob, error) {
+	dj := &dbJob{key: job.Key()}
+
+	enc := codec.NewEncoderBytes(&dj.encoded, ch)
+	job.RLock()
+	defer job.RUnlock()
+	err := enc.Encode(job)
+	if err != nil {
+		return nil, err
+	}
+
+	dj.repGroup = job.RepGroup
+	dj.reqGroup = job.ReqGroup
+	for _, depGroup := range job.DepGroups {
+		if depGroup != "" {
+			dj.depGroups = append(dj.depGroups, depGroup)
+		}
+	}
+	dj.dependencyGroups = job.Dependencies.DepGroups()
+	dj.cmd = job.Cmd
+	dj.owner = job.Owner
+	dj.exitcode = job.Exitcode
+	dj.failReason = job.FailReason
+	dj.peakRAM = job.PeakRAM
+	dj.peakDisk = int(job.PeakDisk)
+	dj.secs = int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
+	dj.startTime = job.StartTime
+	dj.endTime = job.EndTime
+
+	return dj, nil
 }
 
-func (s sobsd) Less(i, j int) bool {
-	cmp := bytes.Compare(s[i][0], s[j][0])
-	return cmp == -1
+// stats returns all the resource usage stats of the job.
+func (dj *dbJob) stats() []dbStat {
+	return []dbStat{{dbStatRAM, dj.peakRAM}, {dbStatDisk, dj.peakDisk}, {dbStatSecs, dj.secs}}
+}
+
+// failStats returns the resource usage stat of the job that relates to why it
+// failed, if it failed for using too much of a resource.
+func (dj *dbJob) failStats() []dbStat {
+	switch dj.failReason {
+	case FailReasonRAM:
+		return []dbStat{{dbStatRAM, dj.peakRAM}}
+	case FailReasonDisk:
+		return []dbStat{{dbStatDisk, dj.peakDisk}}
+	case FailReasonTime:
+		return []dbStat{{dbStatSecs, dj.secs}}
+	}
+
+	return nil
+}
+
+// dbDependentJob is an encoded Job found by dbStore.jobsDependingOn().
+type dbDependentJob struct {
+	key     string
+	encoded []byte // nil if the job is neither live nor complete
+	live    bool
+}
+
+// dbStore is the interface that a storage backend for our db must satisfy.
+// The "live" jobs are those in the queue, stored for disaster recovery, and the
+// "complete" jobs are those that have been archived. Any method that takes a
+// callback only calls it with values that are valid for the duration of the
+// call, and the callback must not call other methods of the store.
+type dbStore interface {
+	// storeLimitGroups stores the given limits. Groups with a limit less than
+	// 0 are removed. Returns the groups that were stored with a different
+	// value before, and the ones that were removed.
+	storeLimitGroups(limits map[string]int64) (changed, removed []string, err error)
+
+	// retrieveLimitGroup returns the limit stored for the given group, and
+	// false if there isn't one.
+	retrieveLimitGroup(group string) (int64, bool, error)
+
+	// storeLiveJobs stores the given jobs as live, along with lookups of them
+	// by their RepGroup, DepGroups and Dependencies' DepGroups, and the given
+	// RepGroups.
+	storeLiveJobs(jobs []*dbJob, repGroups []string) error
+
+	// isLive tells you if the job with the given key is live.
+	isLive(key string) (bool, error)
+
+	// isAdded tells you if the job with the given key is live or complete.
+	isAdded(key string) (bool, error)
+
+	// archiveJob makes the given job complete instead of live, deleting its
+	// std streams and storing its resource usage stats.
+	archiveJob(job *dbJob) error
+
+	// deleteLiveJobs deletes the live jobs with the given keys.
+	deleteLiveJobs(keys []string) error
+
+	// liveJobs calls fn with every live job.
+	liveJobs(fn func(encoded []byte) error) error
+
+	// completeJobs calls fn with each of the complete jobs with the given
+	// keys that exist.
+	completeJobs(keys []string, fn func(encoded []byte) error) error
+
+	// repGroups returns every RepGroup ever stored.
+	repGroups() ([]string, error)
+
+	// completeJobsByRepGroup calls fn with each complete job with the given
+	// RepGroup, that isn't also live, in order of key, starting after the given
+	// key (from the start if blank). If fn returns errStopIterating, stops
+	// without error.
+	completeJobsByRepGroup(repGroup, after string, fn func(key string, encoded []byte) error) error
+
+	// jobsDependingOn returns the jobs that had a dependency on one of the
+	// given DepGroups, in order of DepGroup then key. Live jobs are returned in
+	// preference to complete ones.
+	jobsDependingOn(depGroups []string) ([]*dbDependentJob, error)
+
+	// incompleteJobKeysByDepGroup returns the keys of live jobs with the given
+	// DepGroup.
+	incompleteJobKeysByDepGroup(depGroup string) ([]string, error)
+
+	// completeJobKeysByDepGroup returns the keys of complete jobs with the
+	// given DepGroup, that aren't also live.
+	completeJobKeysByDepGroup(depGroup string) ([]string, error)
+
+	// put stores a value in the given table.
+	put(table dbTable, key string, val []byte) error
+
+	// putAll stores many values in the given table.
+	putAll(table dbTable, keys []string, vals [][]byte) error
+
+	// get returns the value stored in the given table, or nil.
+	get(table dbTable, key string) ([]byte, error)
+
+	// all calls fn with every value stored in the given table.
+	all(table dbTable, fn func(val []byte) error) error
+
+	// delete removes a value from the given table.
+	delete(table dbTable, key string) error
+
+	// updateJobAfterExit rewrites the job if it is live, replaces its std
+	// streams with the given ones (just deleting them if keepStd is false),
+	// and stores the given resource usage stats.
+	updateJobAfterExit(job *dbJob, stdo, stde []byte, keepStd bool, stats []dbStat) error
+
+	// updateLiveJob rewrites the job with the given key, but only if it is
+	// still live.
+	updateLiveJob(key string, encoded []byte) error
+
+	// modifyLiveJobs deletes the live jobs with the given old keys and all
+	// their lookups, then stores the given jobs like storeLiveJobs(), with the
+	// std streams of oldKeys[i] now belonging to jobs[i], all in one
+	// transaction.
+	modifyLiveJobs(oldKeys []string, jobs []*dbJob, repGroups []string) error
+
+	// jobStd returns the std streams stored for the job with the given key.
+	jobStd(key string) (stdo, stde []byte, err error)
+
+	// reqGroupStats calls fn with each stat of the given kind stored for the
+	// given ReqGroup, in ascending order of value.
+	reqGroupStats(kind dbStatKind, reqGroup string, fn func(value int)) error
+
+	// completeJobsFrom calls fn with up to limit (all if 0) complete jobs, in
+	// order of key, starting after the given key (from the start if blank),
+	// skipping ones that are also live if skipLive is true. Returns the key to
+	// start after for the next call, which is blank if there are no more jobs.
+	completeJobsFrom(after string, limit int, skipLive bool, fn func(key string, encoded []byte) error) (string, error)
+
+	// deleteArchivedJobs removes the given complete jobs, their std streams
+	// and lookups, unless they are also live.
+	deleteArchivedJobs(jobs []*dbJob) error
+
+	// compact shrinks the database file by removing free space, returning
+	// its size before and after.
+	compact(ctx context.Context) (int64, int64, error)
+
+	// backupToFile writes a consistent copy of the database to the given
+	// path.
+	backupToFile(path string) error
+
+	// backup writes a consistent copy of the database to the given writer.
+	backup(w io.Writer) error
+
+	// close closes the database.
+	close() error
 }
 
-// sobsdStorer is the kind of function that stores the contents of a sobsd in
-// a particular bucket
-type sobsdStorer func(bucket []byte, encodes sobsd) (err error)
+// openDBStore opens (creating if necessary) the database file at the given
+// path using the given DBBackend* backend; blank means DBBackendBolt.
+func openDBStore(backend, path string) (dbStore, error) {
+	switch backend {
+	case "", DBBackendBolt:
+		return openBoltStore(path)
+	case DBBackendSQLite:
+		return openSQLiteStore(path)
+	}
+
+	return nil, fmt.Errorf("unknown database backend '%s' (must be %s or %s)", backend, DBBackendBolt, DBBackendSQLite)
+}
 
 type db struct {
 	backupLast           time.Time
+	backupDuration       time.Duration
 	backupPath           string
 	backupPathTmp        string
 	ch                   codec.Handle
@@ -113,7 +353,8 @@ type db struct {
 	backupMount          *muxfys.MuxFys
 	backupNotification   chan bool
 	backupWait           time.Duration
-	bolt                 *bolt.DB
+	store                dbStore
+	journal              *dbJournal // same as store, for replicating it
 	envcache             *lru.ARCCache
 	updatingAfterJobExit int
 	wg                   *waitgroup.WaitGroup
@@ -126,11 +367,13 @@ type db struct {
 	s3accessor     *muxfys.S3Accessor
 	closed         bool
 	slowBackups    bool // just for testing purposes
+	generation     atomic.Uint64
 }
 
 // initDB opens/creates our database and sets things up for use. If dbFile
 // doesn't exist or seems corrupted, we copy it from backup if that exists,
-// otherwise we start fresh.
+// otherwise we start fresh. backend is one of the DBBackend* values, with blank
+// meaning DBBackendBolt.
 //
 // dbBkFile can be an S3 url specified like: s3://[profile@]bucket/path/file
 // which will cause that s3 path to be mounted in the same directory as dbFile
@@ -138,7 +381,7 @@ type db struct {
 //
 // In development we delete any existing db and force a fresh start. Backups
 // are also not carried out, so dbBkFile is ignored.
-func initDB(ctx context.Context, dbFile string, dbBkFile string, deployment string) (*db, string, error) {
+func initDB(ctx context.Context, dbFile string, dbBkFile string, deployment string, backend string) (*db, string, error) {
 	var backupsEnabled bool
 
 	var accessor *muxfys.S3Accessor
@@ -208,22 +451,22 @@ func initDB(ctx context.Context, dbFile string, dbBkFile string, deployment stri
 		}
 	}
 
-	var boltdb *bolt.DB
+	var store dbStore
 	var err error
 	if _, err = os.Stat(dbFile); os.IsNotExist(err) {
 		if _, err = os.Stat(dbBkFile); os.IsNotExist(err) {
-			boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
+			store, err = openDBStore(backend, dbFile)
 			msg = "created new empty db file " + dbFile
 		} else {
 			err = copyFile(dbBkFile, dbFile)
 			if err != nil {
 				return nil, msg, err
 			}
-			boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
+			store, err = openDBStore(backend, dbFile)
 			msg = "recreated missing db file " + dbFile + " from backup file " + dbBkFile
 		}
 	} else {
-		boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
+		store, err = openDBStore(backend, dbFile)
 		if err != nil {
 			// try the backup
 			bkPath := dbBkFile
@@ -242,13 +485,17 @@ func initDB(ctx context.Context, dbFile string, dbBkFile string, deployment stri
 				defer func() {
 					errr := os.Remove(bkPath)
 					if errr != nil {
-						clog.Warn(ctx, "failed to remove temporary s3 download of database backup", "err", errr)
+						clog.Warn(ctx, "failed to remove temporary s3 download of database backup", "path", bkPath, "err", errr)
 					}
 				}()
 			}
 
 			if _, errbk := os.Stat(bkPath); errbk == nil {
-				boltdb, errbk = bolt.Open(bkPath, dbFilePermission, nil)
+				var bkStore dbStore
+				bkStore, errbk = openDBStore(backend, bkPath)
+				if errbk == nil {
+					errbk = bkStore.close()
+				}
 				if errbk == nil {
 					origerr := err
 					msg = fmt.Sprintf("tried to recreate corrupt (?) db file %s from backup file %s (error with original db file was: %s)", dbFile, dbBkFile, err)
@@ -260,7 +507,7 @@ func initDB(ctx context.Context, dbFile string, dbBkFile string, deployment stri
 					if err != nil {
 						return nil, msg, err
 					}
-					boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
+					store, err = openDBStore(backend, dbFile)
 					msg = fmt.Sprintf("recreated corrupt (?) db file %s from backup file %s (error with original db file was: %s)", dbFile, dbBkFile, origerr)
 				}
 			}
@@ -270,74 +517,16 @@ func initDB(ctx context.Context, dbFile string, dbBkFile string, deployment stri
 		return nil, msg, err
 	}
 
-	// ensure our buckets are in place
-	err = boltdb.Update(func(tx *bolt.Tx) error {
-		_, errf := tx.CreateBucketIfNotExists(bucketJobsLive)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobsLive, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketJobsComplete)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobsComplete, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketRTK)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketRTK, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketRGs)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketRGs, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketLGs)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketLGs, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketDTK)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketDTK, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketRDTK)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketRDTK, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketEnvs)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketEnvs, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketStdO)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketStdO, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketStdE)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketStdE, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketJobRAM)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobRAM, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketJobDisk)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobDisk, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketJobSecs)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobSecs, errf)
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, msg, err
-	}
-
 	// we will cache frequently used things to avoid actual db (disk) access
 	envcache, err := lru.NewARC(12) // we don't expect that many different ENVs to be in use at once
 	if err != nil {
 		return nil, msg, err
 	}
 
+	journal := newDBJournal(store, dbFile+".standby")
 	dbstruct := &db{
-		bolt:               boltdb,
+		store:              journal,
+		journal:            journal,
 		envcache:           envcache,
 		ch:                 new(codec.BincHandle),
 		backupsEnabled:     backupsEnabled,
@@ -350,9 +539,54 @@ func initDB(ctx context.Context, dbFile string, dbBkFile string, deployment stri
 		wg:                 waitgroup.New(),
 	}
 
+	if err = dbstruct.nextGeneration(); err != nil {
+		errc := store.close()
+		if errc != nil {
+			clog.Warn(ctx, "failed to close database", "err", errc)
+		}
+		return nil, msg, err
+	}
+
 	return dbstruct, msg, err
 }
 
+// retrieveMeta gets the value of the given dbMeta* counter, which is 0 if it
+// was never incremented.
+func (db *db) retrieveMeta(key string) (uint64, error) {
+	encoded, err := db.store.get(dbTableMeta, key)
+	if err != nil || len(encoded) != 8 {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(encoded), nil
+}
+
+// incrementMeta increments the given dbMeta* counter, returning its new value.
+func (db *db) incrementMeta(key string) (uint64, error) {
+	val, err := db.retrieveMeta(key)
+	if err != nil {
+		return 0, err
+	}
+	val++
+
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, val)
+
+	return val, db.store.put(dbTableMeta, key, encoded)
+}
+
+// nextGeneration increments our dbMetaGeneration, which must be done whenever
+// we start numbering our changes again.
+func (db *db) nextGeneration() error {
+	generation, err := db.incrementMeta(dbMetaGeneration)
+	if err != nil {
+		return err
+	}
+	db.generation.Store(generation)
+
+	return nil
+}
+
 // storeLimitGroups stores a mapping of group names to unsigned ints in a
 // dedicated bucket. If a group was already in the database, and it had a
 // different value, that group name will be returned in the changed slice. If
@@ -360,50 +594,20 @@ func initDB(ctx context.Context, dbFile string, dbBkFile string, deployment stri
 // database; any existing entry is removed and the name is returned in the
 // removed slice.
 func (db *db) storeLimitGroups(limitGroups map[string]*limiter.GroupData) (changed []string, removed []string, err error) {
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketLGs)
-
-		for group, limitG := range limitGroups {
-			if !limitG.IsCount() {
-				removed = append(removed, group)
-
-				continue
-			}
-
-			limit := limitG.Limit()
+	limits := make(map[string]int64, len(limitGroups))
+	for group, limitG := range limitGroups {
+		if !limitG.IsCount() {
+			removed = append(removed, group)
 
-			key := []byte(group)
-
-			v := b.Get(key)
-			if v != nil {
-				if limit < 0 {
-					errd := b.Delete(key)
-					if errd != nil {
-						return errd
-					}
-					removed = append(removed, group)
-					continue
-				}
+			continue
+		}
 
-				if binary.BigEndian.Uint64(v) == uint64(limit) {
-					continue
-				}
-				changed = append(changed, group)
-			} else if limit < 0 {
-				continue
-			}
+		limits[group] = limitG.Limit()
+	}
 
-			v = make([]byte, 8)
-			binary.BigEndian.PutUint64(v, uint64(limit))
-			errp := b.Put(key, v)
-			if errp != nil {
-				return errp
-			}
-		}
+	changed, storeRemoved, err := db.store.storeLimitGroups(limits)
 
-		return nil
-	})
-	return changed, removed, err
+	return changed, append(removed, storeRemoved...), err
 }
 
 // retrieveLimitGroup gets a value for a particular group from the db that was
@@ -414,12 +618,16 @@ func (db *db) retrieveLimitGroup(ctx context.Context, group string) *limiter.Gro
 		return gd
 	}
 
-	v := db.retrieve(ctx, bucketLGs, group)
-	if v == nil {
+	limit, found, err := db.store.retrieveLimitGroup(group)
+	if err != nil {
+		clog.Error(ctx, "Database retrieve failed", "err", err)
+	}
+
+	if !found {
 		return limiter.NewCountGroupData(-1)
 	}
 
-	return limiter.NewCountGroupData(int64(binary.BigEndian.Uint64(v))) //nolint:gosec
+	return limiter.NewCountGroupData(limit)
 }
 
 // storeNewJobs stores jobs in the live bucket, where they will only be used for
@@ -443,85 +651,18 @@ func (db *db) retrieveLimitGroup(ctx context.Context, group string) *limiter.Gro
 //
 // Finally, it triggers a background database backup.
 func (db *db) storeNewJobs(ctx context.Context, jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, jobsToUpdate []*Job, alreadyAdded int, err error) {
-	encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err := db.prepareNewJobs(jobs, ignoreAdded)
+	djobs, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err := db.prepareNewJobs(jobs, ignoreAdded)
 	if err != nil {
 		return jobsToQueue, jobsToUpdate, alreadyAdded, err
 	}
 
-	if len(encodedJobs) > 0 {
-		// now go ahead and store the lookups and jobs
-		numStores := 2
-		if len(rgs) > 0 {
-			numStores++
-		}
-		if len(dgLookups) > 0 {
-			numStores++
-		}
-		if len(rdgLookups) > 0 {
-			numStores++
-		}
-		errors := make(chan error, numStores)
-
+	if len(djobs) > 0 {
 		db.wgMutex.Lock()
 		wgk := db.wg.Add(1)
-		go func() {
-			defer internal.LogPanic(ctx, "jobqueue database storeNewJobs rglookups", true)
-			defer db.wg.Done(wgk)
-			sort.Sort(rgLookups)
-			errors <- db.storeBatched(bucketRTK, rgLookups, db.storeLookups)
-		}()
-
-		if len(rgs) > 0 {
-			wgk2 := db.wg.Add(1)
-			go func() {
-				defer internal.LogPanic(ctx, "jobqueue database storeNewJobs repGroups", true)
-				defer db.wg.Done(wgk2)
-				sort.Sort(rgs)
-				errors <- db.storeBatched(bucketRGs, rgs, db.storeLookups)
-			}()
-		}
-
-		if len(dgLookups) > 0 {
-			wgk3 := db.wg.Add(1)
-			go func() {
-				defer internal.LogPanic(ctx, "jobqueue database dgLookups", true)
-				defer db.wg.Done(wgk3)
-				sort.Sort(dgLookups)
-				errors <- db.storeBatched(bucketDTK, dgLookups, db.storeLookups)
-			}()
-		}
-
-		if len(rdgLookups) > 0 {
-			wgk4 := db.wg.Add(1)
-			go func() {
-				defer internal.LogPanic(ctx, "jobqueue database storeNewJobs rdgLookups", true)
-				defer db.wg.Done(wgk4)
-				sort.Sort(rdgLookups)
-				errors <- db.storeBatched(bucketRDTK, rdgLookups, db.storeLookups)
-			}()
-		}
-
-		wgk5 := db.wg.Add(1)
-		go func() {
-			defer internal.LogPanic(ctx, "jobqueue database storeNewJobs encodedJobs", true)
-			defer db.wg.Done(wgk5)
-			sort.Sort(encodedJobs)
-			errors <- db.storeBatched(bucketJobsLive, encodedJobs, db.storeEncodedJobs)
-		}()
 		db.wgMutex.Unlock()
 
-		seen := 0
-		for thisErr := range errors {
-			if thisErr != nil {
-				err = thisErr
-			}
-
-			seen++
-			if seen == numStores {
-				close(errors)
-				break
-			}
-		}
+		err = db.store.storeLiveJobs(djobs, rgs)
+		db.wg.Done(wgk)
 	}
 
 	// *** on error, because we were batching, and doing lookups separately to
@@ -539,21 +680,18 @@ func (db *db) storeNewJobs(ctx context.Context, jobs []*Job, ignoreAdded bool) (
 	return jobsToQueue, jobsToUpdate, alreadyAdded, err
 }
 
-func (db *db) prepareNewJobs(jobs []*Job, ignoreAdded bool) (encodedJobs, rgLookups, dgLookups, rdgLookups, rgs sobsd, jobsToQueue []*Job, jobsToUpdate []*Job, alreadyAdded int, err error) {
-	// turn the jobs in to sobsd and sort by their keys, likewise for the
-	// lookups
+func (db *db) prepareNewJobs(jobs []*Job, ignoreAdded bool) (djobs []*dbJob, rgs []string, jobsToQueue []*Job, jobsToUpdate []*Job, alreadyAdded int, err error) {
+	// encode the jobs, noting their lookups
 	repGroups := make(map[string]bool)
 	depGroups := make(map[string]bool)
 	newJobKeys := make(map[string]bool)
 	var keptJobs []*Job
 	for _, job := range jobs {
-		keyStr := job.Key()
-
 		if ignoreAdded {
 			var added bool
-			added, err = db.checkIfAdded(keyStr)
+			added, err = db.checkIfAdded(job.Key())
 			if err != nil {
-				return encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
+				return djobs, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
 			}
 			if added {
 				alreadyAdded++
@@ -562,37 +700,22 @@ func (db *db) prepareNewJobs(jobs []*Job, ignoreAdded bool) (encodedJobs, rgLook
 			keptJobs = append(keptJobs, job)
 		}
 
-		newJobKeys[keyStr] = true
-		key := []byte(keyStr)
-
-		job.RLock()
-		rgLookups = append(rgLookups, [2][]byte{db.generateLookupKey(job.RepGroup, key), nil})
-		repGroups[job.RepGroup] = true
-
-		for _, depGroup := range job.DepGroups {
-			if depGroup != "" {
-				dgLookups = append(dgLookups, [2][]byte{db.generateLookupKey(depGroup, key), nil})
-				depGroups[depGroup] = true
-			}
+		var dj *dbJob
+		dj, err = newDBJob(job, db.ch)
+		if err != nil {
+			return djobs, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
 		}
 
-		for _, depGroup := range job.Dependencies.DepGroups() {
-			rdgLookups = append(rdgLookups, [2][]byte{db.generateLookupKey(depGroup, key), nil})
+		newJobKeys[dj.key] = true
+		repGroups[dj.repGroup] = true
+		for _, depGroup := range dj.depGroups {
+			depGroups[depGroup] = true
 		}
-		job.RUnlock()
 
-		var encoded []byte
-		enc := codec.NewEncoderBytes(&encoded, db.ch)
-		job.RLock()
-		err = enc.Encode(job)
-		job.RUnlock()
-		if err != nil {
-			return encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
-		}
-		encodedJobs = append(encodedJobs, [2][]byte{key, encoded})
+		djobs = append(djobs, dj)
 	}
 
-	if len(encodedJobs) > 0 {
+	if len(djobs) > 0 {
 		if !ignoreAdded {
 			keptJobs = jobs
 		}
@@ -605,16 +728,12 @@ func (db *db) prepareNewJobs(jobs []*Job, ignoreAdded bool) (encodedJobs, rgLook
 			// arrange to have resurrected complete jobs stored in the live
 			// bucket again
 			for _, job := range jobsToQueue {
-				key := []byte(job.Key())
-				var encoded []byte
-				enc := codec.NewEncoderBytes(&encoded, db.ch)
-				job.RLock()
-				err = enc.Encode(job)
-				job.RUnlock()
+				var dj *dbJob
+				dj, err = newDBJob(job, db.ch)
 				if err != nil {
-					return encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
+					return djobs, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
 				}
-				encodedJobs = append(encodedJobs, [2][]byte{key, encoded})
+				djobs = append(djobs, dj)
 			}
 
 			if len(jobsToQueue) > 0 {
@@ -627,47 +746,24 @@ func (db *db) prepareNewJobs(jobs []*Job, ignoreAdded bool) (encodedJobs, rgLook
 		}
 
 		for rg := range repGroups {
-			rgs = append(rgs, [2][]byte{[]byte(rg), nil})
+			rgs = append(rgs, rg)
 		}
+		sort.Strings(rgs)
 	}
 
-	return encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
-}
-
-// generateLookupKey creates a lookup key understood by the retrieval methods,
-// concatenating prefix with a delimiter and the job key.
-func (db *db) generateLookupKey(prefix string, jobKey []byte) []byte {
-	key := append([]byte(prefix), []byte(dbDelimiter)...)
-	return append(key, jobKey...)
+	return djobs, rgs, jobsToQueue, jobsToUpdate, alreadyAdded, err
 }
 
 // checkIfLive tells you if a job with the given key is currently in the live
 // bucket.
 func (db *db) checkIfLive(key string) (bool, error) {
-	var isLive bool
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		if newJobBucket.Get([]byte(key)) != nil {
-			isLive = true
-		}
-		return nil
-	})
-	return isLive, err
+	return db.store.isLive(key)
 }
 
 // checkIfAdded tells you if a job with the given key is currently in the
 // complete bucket or the live bucket.
 func (db *db) checkIfAdded(key string) (bool, error) {
-	var isInDB bool
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		completeJobBucket := tx.Bucket(bucketJobsComplete)
-		if newJobBucket.Get([]byte(key)) != nil || completeJobBucket.Get([]byte(key)) != nil {
-			isInDB = true
-		}
-		return nil
-	})
-	return isInDB, err
+	return db.store.isAdded(key)
 }
 
 // archiveJob deletes a job from the live bucket, and adds a new version of it
@@ -679,54 +775,13 @@ func (db *db) checkIfAdded(key string) (bool, error) {
 // The key you supply must be the key of the job you supply, or bad things will
 // happen - no checking is done! A backgroundBackup() is triggered afterwards.
 func (db *db) archiveJob(ctx context.Context, key string, job *Job) error {
-	var encoded []byte
-	enc := codec.NewEncoderBytes(&encoded, db.ch)
-	job.RLock()
-	err := enc.Encode(job)
-	job.RUnlock()
+	dj, err := newDBJob(job, db.ch)
 	if err != nil {
 		return err
 	}
+	dj.key = key
 
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
-		bo := tx.Bucket(bucketStdO)
-		be := tx.Bucket(bucketStdE)
-		key := []byte(key)
-		errf := bo.Delete(key)
-		if errf != nil {
-			return errf
-		}
-		errf = be.Delete(key)
-		if errf != nil {
-			return errf
-		}
-
-		b := tx.Bucket(bucketJobsLive)
-		errf = b.Delete(key)
-		if errf != nil {
-			return errf
-		}
-
-		b = tx.Bucket(bucketJobsComplete)
-		errf = b.Put(key, encoded)
-		if errf != nil {
-			return errf
-		}
-
-		b = tx.Bucket(bucketJobRAM)
-		errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, job.PeakRAM)), []byte(strconv.Itoa(job.PeakRAM)))
-		if errf != nil {
-			return errf
-		}
-		b = tx.Bucket(bucketJobDisk)
-		errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, job.PeakDisk)), []byte(strconv.Itoa(int(job.PeakDisk))))
-		if errf != nil {
-			return errf
-		}
-		b = tx.Bucket(bucketJobSecs)
-		secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
-		return b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, secs)), []byte(strconv.Itoa(secs)))
-	})
+	err = db.store.archiveJob(dj)
 
 	db.backgroundBackup(ctx)
 
@@ -736,23 +791,14 @@ func (db *db) archiveJob(ctx context.Context, key string, job *Job) error {
 // deleteLiveJob remove a job from the live bucket, for use when jobs were
 // added in error.
 func (db *db) deleteLiveJob(ctx context.Context, key string) {
-	db.remove(ctx, bucketJobsLive, key)
+	db.remove(ctx, key)
 	db.backgroundBackup(ctx)
 	//*** we're not removing the lookup entries from the bucket*TK buckets...
 }
 
 // deleteLiveJobs remove multiple jobs from the live bucket.
 func (db *db) deleteLiveJobs(ctx context.Context, keys []string) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketJobsLive)
-		for _, key := range keys {
-			errd := b.Delete([]byte(key))
-			if errd != nil {
-				return errd
-			}
-		}
-		return nil
-	})
+	err := db.store.deleteLiveJobs(keys)
 	if err != nil {
 		return err
 	}
@@ -772,20 +818,13 @@ func (db *db) deleteLiveJobs(ctx context.Context, keys []string) error {
 // is kicked.
 func (db *db) recoverIncompleteJobs() ([]*Job, error) {
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketJobsLive)
-		return b.ForEach(func(key, encoded []byte) error {
-			if encoded != nil {
-				dec := codec.NewDecoderBytes(encoded, db.ch)
-				job := &Job{}
-				errf := dec.Decode(job)
-				if errf != nil {
-					return errf
-				}
-				jobs = append(jobs, job)
-			}
-			return nil
-		})
+	err := db.store.liveJobs(func(encoded []byte) error {
+		job, err := db.decodeJob(encoded)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+		return nil
 	})
 	return jobs, err
 }
@@ -794,18 +833,10 @@ func (db *db) recoverIncompleteJobs() ([]*Job, error) {
 // jobs bucket (ie. those that have gone through the queue and been Remove()d).
 func (db *db) retrieveCompleteJobsByKeys(keys []string) ([]*Job, error) {
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketJobsComplete)
-		for _, key := range keys {
-			encoded := b.Get([]byte(key))
-			if encoded != nil {
-				dec := codec.NewDecoderBytes(encoded, db.ch)
-				job := &Job{}
-				err := dec.Decode(job)
-				if err == nil {
-					jobs = append(jobs, job)
-				}
-			}
+	err := db.store.completeJobs(keys, func(encoded []byte) error {
+		job, err := db.decodeJob(encoded)
+		if err == nil {
+			jobs = append(jobs, job)
 		}
 		return nil
 	})
@@ -814,15 +845,7 @@ func (db *db) retrieveCompleteJobsByKeys(keys []string) ([]*Job, error) {
 
 // retrieveRepGroups gets the rep groups of all jobs that have ever been added.
 func (db *db) retrieveRepGroups() ([]string, error) {
-	var rgs []string
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketRGs)
-		return b.ForEach(func(k, v []byte) error {
-			rgs = append(rgs, string(k))
-			return nil
-		})
-	})
-	return rgs, err
+	return db.store.repGroups()
 }
 
 // retrieveCompleteJobsByRepGroup gets jobs with the given RepGroup from the
@@ -831,107 +854,101 @@ func (db *db) retrieveRepGroups() ([]string, error) {
 // re-run).
 func (db *db) retrieveCompleteJobsByRepGroup(repgroup string) ([]*Job, error) {
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		completeJobBucket := tx.Bucket(bucketJobsComplete)
-		lookupBucket := tx.Bucket(bucketRTK).Cursor()
-		prefix := []byte(repgroup + dbDelimiter)
-		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
-			key := bytes.TrimPrefix(k, prefix)
-			encoded := completeJobBucket.Get(key)
-			if len(encoded) > 0 && newJobBucket.Get(key) == nil {
-				dec := codec.NewDecoderBytes(encoded, db.ch)
-				job := &Job{}
-				err := dec.Decode(job)
-				if err != nil {
-					return err
-				}
-				jobs = append(jobs, job)
-			}
+	err := db.store.completeJobsByRepGroup(repgroup, "", func(_ string, encoded []byte) error {
+		job, err := db.decodeJob(encoded)
+		if err != nil {
+			return err
 		}
+		jobs = append(jobs, job)
 		return nil
 	})
 	return jobs, err
 }
 
+// pageCompleteJobsByRepGroup is like retrieveCompleteJobsByRepGroup(), but
+// offers the jobs to the given pager, only decoding the ones it might keep, and
+// stopping once it can't keep any more of them. The offered jobs have their
+// RepGroup set to the given one, since we're able to retrieve jobs based on any
+// of the RepGroups they ever had.
+func (db *db) pageCompleteJobsByRepGroup(repgroup string, pager *jobPager) error {
+	return db.store.completeJobsByRepGroup(repgroup, pager.startKey(), func(key string, encoded []byte) error {
+		if pager.doneAfter(key) {
+			return errStopIterating
+		}
+		if pager.skipKey(key) {
+			return nil
+		}
+
+		job, err := db.decodeJob(encoded)
+		if err != nil {
+			return err
+		}
+		job.RepGroup = repgroup
+		pager.offer(job, nil)
+		return nil
+	})
+}
+
 // retrieveDependentJobs gets previously stored jobs that had a dependency on
 // one for the input depGroups. If the job is found in the live bucket, then it
 // is returned in the jobsToUpdate return value. If it is found in the complete
 // bucket, and is not true in the supplied newJobKeys map, then it is returned
 // in the jobsToQueue return value.
 func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[string]bool) (jobsToQueue []*Job, jobsToUpdate []*Job, err error) {
-	// first convert the depGroups in to sorted prefixes, for linear searching
-	prefixes := make(sobsd, 0, len(depGroups))
+	current := make([]string, 0, len(depGroups))
 	for depGroup := range depGroups {
-		prefixes = append(prefixes, [2][]byte{[]byte(depGroup + dbDelimiter), nil})
-	}
-	sort.Sort(prefixes)
-
-	err = db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		completeJobBucket := tx.Bucket(bucketJobsComplete)
-		lookupBucket := tx.Bucket(bucketRDTK).Cursor()
-		doneKeys := make(map[string]bool)
-		for {
-			newDepGroups := make(map[string]bool)
-			for _, bsd := range prefixes {
-				for k, _ := lookupBucket.Seek(bsd[0]); bytes.HasPrefix(k, bsd[0]); k, _ = lookupBucket.Next() {
-					key := bytes.TrimPrefix(k, bsd[0])
-					keyStr := string(key)
-					if doneKeys[keyStr] {
-						continue
-					}
+		current = append(current, depGroup)
+	}
 
-					encoded := newJobBucket.Get(key)
-					live := false
-					if len(encoded) > 0 {
-						live = true
-					} else if !newJobKeys[keyStr] {
-						encoded = completeJobBucket.Get(key)
-					}
+	doneKeys := make(map[string]bool)
+	for len(current) > 0 {
+		sort.Strings(current)
 
-					if len(encoded) > 0 {
-						dec := codec.NewDecoderBytes(encoded, db.ch)
-						job := &Job{}
-						errf := dec.Decode(job)
-						if errf != nil {
-							return errf
-						}
-
-						// since we're going to add this job, we also need to
-						// check its DepGroups and repeat this loop on any new
-						// ones
-						for _, depGroup := range job.DepGroups {
-							if depGroup != "" && !depGroups[depGroup] {
-								newDepGroups[depGroup] = true
-							}
-						}
-
-						if live {
-							jobsToUpdate = append(jobsToUpdate, job)
-						} else {
-							jobsToQueue = append(jobsToQueue, job)
-						}
-					}
+		var djs []*dbDependentJob
+		djs, err = db.store.jobsDependingOn(current)
+		if err != nil {
+			return jobsToQueue, jobsToUpdate, err
+		}
 
-					doneKeys[keyStr] = true
-				}
+		newDepGroups := make(map[string]bool)
+		for _, dj := range djs {
+			if doneKeys[dj.key] {
+				continue
+			}
+			doneKeys[dj.key] = true
+
+			if len(dj.encoded) == 0 || (!dj.live && newJobKeys[dj.key]) {
+				continue
+			}
+
+			var job *Job
+			job, err = db.decodeJob(dj.encoded)
+			if err != nil {
+				return jobsToQueue, jobsToUpdate, err
 			}
 
-			if len(newDepGroups) > 0 {
-				var newPrefixes sobsd
-				for depGroup := range newDepGroups {
-					newPrefixes = append(newPrefixes, [2][]byte{[]byte(depGroup + dbDelimiter), nil})
-					depGroups[depGroup] = true
+			// since we're going to add this job, we also need to check its
+			// DepGroups and repeat this loop on any new ones
+			for _, depGroup := range job.DepGroups {
+				if depGroup != "" && !depGroups[depGroup] {
+					newDepGroups[depGroup] = true
 				}
-				sort.Sort(newPrefixes)
-				prefixes = newPrefixes
+			}
+
+			if dj.live {
+				jobsToUpdate = append(jobsToUpdate, job)
 			} else {
-				break
+				jobsToQueue = append(jobsToQueue, job)
 			}
 		}
-		return nil
-	})
+
+		current = current[:0]
+		for depGroup := range newDepGroups {
+			current = append(current, depGroup)
+			depGroups[depGroup] = true
+		}
+	}
+
 	return jobsToQueue, jobsToUpdate, err
 }
 
@@ -939,20 +956,14 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 // the live bucket (ie. those that have been added to the queue and not yet
 // Archive()d - even if they've been added and archived in the past).
 func (db *db) retrieveIncompleteJobKeysByDepGroup(depgroup string) ([]string, error) {
-	var jobKeys []string
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		lookupBucket := tx.Bucket(bucketDTK).Cursor()
-		prefix := []byte(depgroup + dbDelimiter)
-		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
-			key := bytes.TrimPrefix(k, prefix)
-			if newJobBucket.Get(key) != nil {
-				jobKeys = append(jobKeys, string(key))
-			}
-		}
-		return nil
-	})
-	return jobKeys, err
+	return db.store.incompleteJobKeysByDepGroup(depgroup)
+}
+
+// retrieveCompleteJobKeysByDepGroup gets the keys of jobs with the given
+// DepGroup from the complete bucket, excluding those that are also live (ie.
+// that are being re-run).
+func (db *db) retrieveCompleteJobKeysByDepGroup(depgroup string) ([]string, error) {
+	return db.store.completeJobKeysByDepGroup(depgroup)
 }
 
 // storeEnv stores a clientRequest.Env in db unless cached, which means it must
@@ -960,7 +971,7 @@ func (db *db) retrieveIncompleteJobKeysByDepGroup(depgroup string) ([]string, er
 func (db *db) storeEnv(env []byte) (string, error) {
 	envkey := byteKey(env)
 	if !db.envcache.Contains(envkey) {
-		err := db.store(bucketEnvs, envkey, env)
+		err := db.store.put(dbTableEnvs, envkey, env)
 		if err != nil {
 			return envkey, err
 		}
@@ -977,11 +988,178 @@ func (db *db) retrieveEnv(ctx context.Context, envkey string) []byte {
 		return cached.([]byte)
 	}
 
-	envc := db.retrieve(ctx, bucketEnvs, envkey)
+	envc := db.retrieve(ctx, dbTableEnvs, envkey)
 	db.envcache.Add(envkey, envc)
 	return envc
 }
 
+// storeArrayFeeds stores the given arrayFeeds, keyed on the ArrayID of their
+// template Job. Only the template (with its parameter table) and progress of
+// an array are stored here, which is enough to regenerate all its elements.
+func (db *db) storeArrayFeeds(feeds []*arrayFeed) error {
+	if len(feeds) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(feeds))
+	encodes := make([][]byte, 0, len(feeds))
+	for _, feed := range feeds {
+		var encoded []byte
+		enc := codec.NewEncoderBytes(&encoded, db.ch)
+		feed.Template.RLock()
+		err := enc.Encode(feed)
+		arrayID := feed.Template.ArrayID
+		feed.Template.RUnlock()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, arrayID)
+		encodes = append(encodes, encoded)
+	}
+
+	return db.store.putAll(dbTableArrays, keys, encodes)
+}
+
+// retrieveArrayFeed gets the arrayFeed of the job array with the given
+// ArrayID, as stored with storeArrayFeeds(). Returns nil if there is no such
+// array.
+func (db *db) retrieveArrayFeed(ctx context.Context, arrayID string) (*arrayFeed, error) {
+	encoded := db.retrieve(ctx, dbTableArrays, arrayID)
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	return db.decodeArrayFeed(encoded)
+}
+
+// retrieveIncompleteArrayFeeds gets the arrayFeeds stored with
+// storeArrayFeeds() that still have elements to add to the queue.
+func (db *db) retrieveIncompleteArrayFeeds() ([]*arrayFeed, error) {
+	var feeds []*arrayFeed
+	err := db.store.all(dbTableArrays, func(encoded []byte) error {
+		feed, errd := db.decodeArrayFeed(encoded)
+		if errd != nil {
+			return errd
+		}
+		if !feed.done() {
+			feeds = append(feeds, feed)
+		}
+		return nil
+	})
+	return feeds, err
+}
+
+// deleteArrayFeed removes the arrayFeed of the job array with the given ArrayID
+// from the database.
+func (db *db) deleteArrayFeed(arrayID string) error {
+	return db.store.delete(dbTableArrays, arrayID)
+}
+
+// decodeArrayFeed decodes an arrayFeed stored with storeArrayFeeds().
+func (db *db) decodeArrayFeed(encoded []byte) (*arrayFeed, error) {
+	dec := codec.NewDecoderBytes(encoded, db.ch)
+	feed := &arrayFeed{}
+	err := dec.Decode(feed)
+	if err != nil {
+		return nil, err
+	}
+	if feed.Template == nil {
+		return nil, fmt.Errorf("stored job array has no template")
+	}
+	feed.live = make(map[string]bool)
+
+	return feed, nil
+}
+
+// storeCronJob stores the given CronJob, keyed on its Name, replacing any
+// existing CronJob with the same Name.
+func (db *db) storeCronJob(cj *CronJob) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	err := enc.Encode(cj)
+	if err != nil {
+		return err
+	}
+
+	return db.store.put(dbTableCrons, cj.Name, encoded)
+}
+
+// retrieveCronJob gets the CronJob with the given Name, as stored with
+// storeCronJob(). Each call gets you a new CronJob with a new Job, so you can
+// add the Job to the queue without affecting any other copy. Returns nil if
+// there is no such CronJob.
+func (db *db) retrieveCronJob(ctx context.Context, name string) (*CronJob, error) {
+	encoded := db.retrieve(ctx, dbTableCrons, name)
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	dec := codec.NewDecoderBytes(encoded, db.ch)
+	cj := &CronJob{}
+	err := dec.Decode(cj)
+	if err != nil {
+		return nil, err
+	}
+
+	return cj, nil
+}
+
+// retrieveCronJobs gets all the CronJobs that were stored with
+// storeCronJob().
+func (db *db) retrieveCronJobs() ([]*CronJob, error) {
+	var cjs []*CronJob
+	err := db.store.all(dbTableCrons, func(encoded []byte) error {
+		dec := codec.NewDecoderBytes(encoded, db.ch)
+		cj := &CronJob{}
+		errd := dec.Decode(cj)
+		if errd != nil {
+			return errd
+		}
+		cjs = append(cjs, cj)
+		return nil
+	})
+	return cjs, err
+}
+
+// deleteCronJob removes the CronJob with the given Name from the database.
+func (db *db) deleteCronJob(name string) error {
+	return db.store.delete(dbTableCrons, name)
+}
+
+// storeUser stores the given User, keyed on its Name, replacing any existing
+// User with the same Name. The User's Token should already be hashed.
+func (db *db) storeUser(u *User) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	err := enc.Encode(u)
+	if err != nil {
+		return err
+	}
+
+	return db.store.put(dbTableUsers, u.Name, encoded)
+}
+
+// retrieveUsers gets all the Users that were stored with storeUser().
+func (db *db) retrieveUsers() ([]*User, error) {
+	var users []*User
+	err := db.store.all(dbTableUsers, func(encoded []byte) error {
+		dec := codec.NewDecoderBytes(encoded, db.ch)
+		u := &User{}
+		errd := dec.Decode(u)
+		if errd != nil {
+			return errd
+		}
+		users = append(users, u)
+		return nil
+	})
+	return users, err
+}
+
+// deleteUser removes the User with the given Name from the database.
+func (db *db) deleteUser(name string) error {
+	return db.store.delete(dbTableUsers, name)
+}
+
 // updateJobAfterExit stores the Job's peak RAM usage and wall time against the
 // Job's ReqGroup, but only if the job failed for using too much RAM or time,
 // allowing recommendedReqGroup*(ReqGroup) to work.
@@ -999,25 +1177,14 @@ func (db *db) retrieveEnv(ctx context.Context, envkey string) []byte {
 // By doing the deletion upfront, we also ensure we have the latest std, which
 // may be nil even on cmd failure. Since it is not critical to the running of
 // jobs and workflows that this works 100% of the time, we ignore errors and
-// write to bolt in a goroutine, giving us a significant speed boost.
+// write to the database in a goroutine, giving us a significant speed boost.
 func (db *db) updateJobAfterExit(ctx context.Context, job *Job, stdo []byte, stde []byte, forceStorage bool) {
-	var encoded []byte
-	enc := codec.NewEncoderBytes(&encoded, db.ch)
 	db.Lock()
 	defer db.Unlock()
 	if db.closed {
 		return
 	}
-	jobkey := job.Key()
-	job.RLock()
-	secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
-	jrg := job.ReqGroup
-	jpr := job.PeakRAM
-	jpd := job.PeakDisk
-	jec := job.Exitcode
-	jfr := job.FailReason
-	err := enc.Encode(job)
-	job.RUnlock()
+	dj, err := newDBJob(job, db.ch)
 	if err != nil {
 		clog.Error(ctx, "Database operation updateJobAfterExit failed due to Encode failure", "err", err)
 		return
@@ -1031,53 +1198,7 @@ func (db *db) updateJobAfterExit(ctx context.Context, job *Job, stdo []byte, std
 	go func() {
 		defer internal.LogPanic(ctx, "updateJobAfterExit", true)
 
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
-			key := []byte(jobkey)
-
-			bjl := tx.Bucket(bucketJobsLive)
-			if bjl.Get(key) != nil {
-				errf := bjl.Put(key, encoded)
-				if errf != nil {
-					return errf
-				}
-			}
-
-			bo := tx.Bucket(bucketStdO)
-			be := tx.Bucket(bucketStdE)
-			errf := bo.Delete(key)
-			if errf != nil {
-				return errf
-			}
-			errf = be.Delete(key)
-			if errf != nil {
-				return errf
-			}
-
-			if jec != 0 || forceStorage {
-				if len(stdo) > 0 {
-					errf = bo.Put(key, stdo)
-				}
-				if len(stde) > 0 {
-					errf = be.Put(key, stde)
-				}
-			}
-			if errf != nil {
-				return errf
-			}
-
-			switch jfr {
-			case FailReasonRAM:
-				b := tx.Bucket(bucketJobRAM)
-				errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, jpr)), []byte(strconv.Itoa(jpr)))
-			case FailReasonDisk:
-				b := tx.Bucket(bucketJobDisk)
-				errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, jpd)), []byte(strconv.Itoa(int(jpd))))
-			case FailReasonTime:
-				b := tx.Bucket(bucketJobSecs)
-				errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, secs)), []byte(strconv.Itoa(secs)))
-			}
-			return errf
-		})
+		err := db.store.updateJobAfterExit(dj, stdo, stde, dj.exitcode != 0 || forceStorage, dj.failStats())
 		db.wg.Done(wgk)
 		if err != nil {
 			clog.Error(ctx, "Database operation updateJobAfterExit failed", "err", err)
@@ -1099,7 +1220,7 @@ func (db *db) updateJobAfterChange(ctx context.Context, job *Job) {
 	if db.closed {
 		return
 	}
-	key := []byte(job.Key())
+	key := job.Key()
 	job.RLock()
 	err := enc.Encode(job)
 	job.RUnlock()
@@ -1114,24 +1235,16 @@ func (db *db) updateJobAfterChange(ctx context.Context, job *Job) {
 	go func() {
 		defer internal.LogPanic(ctx, "updateJobAfterChange", true)
 
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
-			bjl := tx.Bucket(bucketJobsLive)
-			if bjl.Get(key) == nil {
-				// it's possible for these batches to be interleaved with
-				// archiveJob batches, and for this batch to update that a job
-				// was started to actually execute after the batch that says the
-				// job completed, removing it from the live bucket. In that
-				// case, don't add it back to the live bucket here.
-				return nil
-			}
-			return bjl.Put(key, encoded)
-		})
+		// it's possible for these updates to be interleaved with archiveJob
+		// calls, and for this update that a job was started to actually
+		// execute after the archiving, which removed it from the live bucket.
+		// The store won't add it back to the live bucket in that case.
+		err := db.store.updateLiveJob(key, encoded)
 		db.wg.Done(wgk)
 		if err != nil {
 			clog.Error(ctx, "Database operation updateJobAfterChange failed", "err", err)
 			return
 		}
-
 		db.backgroundBackup(ctx)
 	}()
 }
@@ -1147,123 +1260,12 @@ func (db *db) updateJobAfterChange(ctx context.Context, job *Job) {
 // the old Key() of jobs[0]. This is so that any stdout/err of old jobs is
 // associated with the new jobs.
 func (db *db) modifyLiveJobs(ctx context.Context, oldKeys []string, jobs []*Job) error {
-	encodedJobs, rgLookups, dgLookups, rdgLookups, rgs, _, _, _, err := db.prepareNewJobs(jobs, false)
+	djobs, rgs, _, _, _, err := db.prepareNewJobs(jobs, false)
 	if err != nil {
 		return err
 	}
-	sort.Sort(rgLookups)
-	sort.Sort(rgs)
-	sort.Sort(dgLookups)
-	sort.Sort(rdgLookups)
-	sort.Sort(encodedJobs)
-
-	lookupBuckets := [][]byte{bucketRTK, bucketDTK, bucketRDTK}
-
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
-		// delete old jobs and their lookups
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		bo := tx.Bucket(bucketStdO)
-		be := tx.Bucket(bucketStdE)
-		os := make([][]byte, len(oldKeys))
-		es := make([][]byte, len(oldKeys))
-		var hadStd bool
-		for i, oldKey := range oldKeys {
-			suffix := []byte(dbDelimiter + oldKey)
-			for _, bucket := range lookupBuckets {
-				b := tx.Bucket(bucket)
-				// *** currently having to go through the the whole lookup
-				// buckets; if this is a noticeable performance issue, will have
-				// to implement a reverse lookup...
-				errf := b.ForEach(func(k, v []byte) error {
-					if bytes.HasSuffix(k, suffix) {
-						errd := b.Delete(k)
-						if errd != nil {
-							return errd
-						}
-					}
-					return nil
-				})
-				if errf != nil {
-					return errf
-				}
-			}
-
-			key := []byte(oldKey)
-			errd := newJobBucket.Delete(key)
-			if errd != nil {
-				return errd
-			}
-
-			o := bo.Get(key)
-			if o != nil {
-				os[i] = o
-				errd = bo.Delete(key)
-				if errd != nil {
-					return errd
-				}
-				hadStd = true
-			}
-
-			e := be.Get(key)
-			if e != nil {
-				es[i] = e
-				errd = be.Delete(key)
-				if errd != nil {
-					return errd
-				}
-				hadStd = true
-			}
-		}
-
-		if len(encodedJobs) > 0 {
-			// now go ahead and store the new lookups and jobs
-			errs := db.putLookups(tx, bucketRTK, rgLookups)
-			if errs != nil {
-				return errs
-			}
-
-			if len(rgs) > 0 {
-				errs = db.putLookups(tx, bucketRGs, rgs)
-				if errs != nil {
-					return errs
-				}
-			}
-
-			if len(dgLookups) > 0 {
-				errs = db.putLookups(tx, bucketDTK, dgLookups)
-				if errs != nil {
-					return errs
-				}
-			}
-
-			if len(rdgLookups) > 0 {
-				errs = db.putLookups(tx, bucketRDTK, rdgLookups)
-				if errs != nil {
-					return errs
-				}
-			}
 
-			if hadStd {
-				for i, job := range jobs {
-					if os[i] != nil {
-						errs = bo.Put([]byte(job.Key()), os[i])
-						if errs != nil {
-							return errs
-						}
-					}
-					if es[i] != nil {
-						errs = be.Put([]byte(job.Key()), es[i])
-						if errs != nil {
-							return errs
-						}
-					}
-				}
-			}
-
-			return db.putEncodedJobs(tx, bucketJobsLive, encodedJobs)
-		}
-		return nil
-	})
+	err = db.store.modifyLiveJobs(oldKeys, djobs, rgs)
 	if err != nil {
 		clog.Error(ctx, "Database error during modify", "err", err)
 	}
@@ -1289,25 +1291,8 @@ func (db *db) retrieveJobStd(ctx context.Context, jobkey string) (stdo []byte, s
 		<-time.After(10 * time.Millisecond)
 	}
 
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		bo := tx.Bucket(bucketStdO)
-		be := tx.Bucket(bucketStdE)
-		key := []byte(jobkey)
-		o := bo.Get(key)
-		if o != nil {
-			stdo = make([]byte, len(o))
-			copy(stdo, o)
-		}
-		e := be.Get(key)
-		if e != nil {
-			stde = make([]byte, len(e))
-			copy(stde, e)
-		}
-		return nil
-	})
+	stdo, stde, err := db.store.jobStd(jobkey)
 	if err != nil {
-		// impossible, but to keep the linter happy and incase things change in
-		// the future
 		clog.Error(ctx, "Database retrieve failed", "err", err)
 	}
 	return stdo, stde
@@ -1320,7 +1305,7 @@ func (db *db) retrieveJobStd(ctx context.Context, jobkey string) (stdo []byte, s
 // case, the true value is rounded up to the nearest 100 MB. Returns 0 if there
 // are no prior values.
 func (db *db) recommendedReqGroupMemory(reqGroup string) (int, error) {
-	return db.recommendedReqGroupStat(bucketJobRAM, reqGroup, RecMBRound)
+	return db.recommendedReqGroupStat(dbStatRAM, reqGroup, RecMBRound)
 }
 
 // recommendedReqGroupDisk returns the 95th percentile peak disk usage of
@@ -1330,7 +1315,7 @@ func (db *db) recommendedReqGroupMemory(reqGroup string) (int, error) {
 // case, the true value is rounded up to the nearest 100 MB. Returns 0 if there
 // are no prior values.
 func (db *db) recommendedReqGroupDisk(reqGroup string) (int, error) {
-	return db.recommendedReqGroupStat(bucketJobDisk, reqGroup, RecMBRound)
+	return db.recommendedReqGroupStat(dbStatDisk, reqGroup, RecMBRound)
 }
 
 // recommendReqGroupTime returns the 95th percentile wall time taken of all jobs
@@ -1340,44 +1325,34 @@ func (db *db) recommendedReqGroupDisk(reqGroup string) (int, error) {
 // case, the true value is rounded up to the nearest second. Returns 0 if there
 // are no prior values.
 func (db *db) recommendedReqGroupTime(reqGroup string) (int, error) {
-	return db.recommendedReqGroupStat(bucketJobSecs, reqGroup, RecSecRound)
+	return db.recommendedReqGroupStat(dbStatSecs, reqGroup, RecSecRound)
 }
 
 // recommendedReqGroupStat is the implementation for the other recommend*()
 // methods.
-func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, roundAmount int) (int, error) {
-	prefix := []byte(reqGroup)
+func (db *db) recommendedReqGroupStat(kind dbStatKind, reqGroup string, roundAmount int) (int, error) {
 	max := 0
 	var recommendation int
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket(statBucket).Cursor()
-
-		// we seek over the bucket, and to avoid having to do it twice (first to
-		// get the overall count, then to get the 95th percentile), we keep the
-		// previous 5%-sized window of values, updating recommendation as the
-		// window fills
-		count := 0
-		window := jobStatWindowPercent
-		var prev []int
-		var erra error
-		for k, v := c.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			max, erra = strconv.Atoi(string(v))
-			if erra != nil {
-				return erra
-			}
 
-			count++
-			if count > 100 {
-				window = (float32(count) / 100) * jobStatWindowPercent
-			}
+	// we go through the values in order, and to avoid having to do it twice
+	// (first to get the overall count, then to get the 95th percentile), we
+	// keep the previous 5%-sized window of values, updating recommendation as
+	// the window fills
+	count := 0
+	window := jobStatWindowPercent
+	var prev []int
+	err := db.store.reqGroupStats(kind, reqGroup, func(value int) {
+		max = value
 
-			prev = append(prev, max)
-			if float32(len(prev)) > window {
-				recommendation, prev = prev[0], prev[1:]
-			}
+		count++
+		if count > 100 {
+			window = (float32(count) / 100) * jobStatWindowPercent
 		}
 
-		return nil
+		prev = append(prev, max)
+		if float32(len(prev)) > window {
+			recommendation, prev = prev[0], prev[1:]
+		}
 	})
 	if err != nil {
 		return 0, err
@@ -1405,138 +1380,172 @@ func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, roundA
 	return recommendation, err
 }
 
-// store does a basic set of a key/val in a given bucket
-func (db *db) store(bucket []byte, key string, val []byte) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		err := b.Put([]byte(key), val)
-		return err
-	})
-	return err
+// decodeJob decodes a Job that was encoded by newDBJob().
+func (db *db) decodeJob(encoded []byte) (*Job, error) {
+	dec := codec.NewDecoderBytes(encoded, db.ch)
+	job := &Job{}
+	err := dec.Decode(job)
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
 }
 
-// retrieve does a basic get of a key from a given bucket. An error isn't
-// possible here.
-func (db *db) retrieve(ctx context.Context, bucket []byte, key string) []byte {
-	var val []byte
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		v := b.Get([]byte(key))
-		if v != nil {
-			val = make([]byte, len(v))
-			copy(val, v)
-		}
-		return nil
-	})
+// retrieve does a basic get of a key from a given table, logging any error.
+func (db *db) retrieve(ctx context.Context, table dbTable, key string) []byte {
+	val, err := db.store.get(table, key)
 	if err != nil {
-		// impossible, but to keep the linter happy and incase things change in
-		// the future
 		clog.Error(ctx, "Database retrieve failed", "err", err)
 	}
 	return val
 }
 
-// remove does a basic delete of a key from a given bucket. We don't care about
-// errors here.
-func (db *db) remove(ctx context.Context, bucket []byte, key string) {
+// remove does a basic delete of a key from the live bucket. We don't care
+// about errors here.
+func (db *db) remove(ctx context.Context, key string) {
 	db.wgMutex.Lock()
 	defer db.wgMutex.Unlock()
 	wgk := db.wg.Add(1)
 	go func() {
 		defer internal.LogPanic(ctx, "jobqueue database remove", true)
 		defer db.wg.Done(wgk)
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
-			b := tx.Bucket(bucket)
-			return b.Delete([]byte(key))
-		})
+		err := db.store.deleteLiveJobs([]string{key})
 		if err != nil {
 			clog.Error(ctx, "Database remove failed", "err", err)
 		}
 	}()
 }
 
-// storeBatched stores items in the db in batches for efficiency. bucket is the
-// name of the bucket to store in.
-func (db *db) storeBatched(bucket []byte, data sobsd, storer sobsdStorer) error {
-	// we want to add in batches of size data/10, minimum 1000, rounded to
-	// the nearest 1000
-	num := len(data)
-	batchSize := num / 10
-	rem := batchSize % 1000
-	if rem > 500 {
-		batchSize = batchSize - rem + 1000
-	} else {
-		batchSize -= rem
-	}
-	if batchSize < 1000 {
-		batchSize = 1000
-	}
+// archiveExpiredJobs moves complete jobs (that aren't also currently live)
+// whose EndTime is older than the MaxAge of the first of the given policies
+// that matches their RepGroup out of the database and in to a gzip compressed
+// JSON lines file in the given directory, along with their stored STDOUT/ERR.
+// Their lookups are also removed, so they will no longer be found by the
+// retrieveCompleteJobsBy*() methods, nor resurrected when new jobs they
+// depended on are added.
+//
+// The stats used by recommendedReqGroup*() are left intact, so resource usage
+// continues to be learned from archived jobs.
+//
+// Jobs are dealt with in batches, each batch being safely stored in the archive
+// before being deleted from the database. Returns the number of jobs archived.
+// You'll want to compact() afterwards to actually reduce the size of the
+// database file.
+func (db *db) archiveExpiredJobs(policies []*RetentionPolicy, now time.Time, dir string) (int, error) {
+	var archived int
+	var after string
+	for {
+		jobs, next, err := db.retrieveExpiredJobs(policies, now, after)
+		if err != nil {
+			return archived, err
+		}
 
-	// based on https://github.com/boltdb/bolt/issues/337#issue-64861745
-	if num < batchSize {
-		return storer(bucket, data)
-	}
+		if len(jobs) > 0 {
+			err = writeJobArchive(dir, now, jobs)
+			if err != nil {
+				return archived, err
+			}
 
-	batches := num / batchSize
-	offset := num - (num % batchSize)
+			err = db.deleteArchivedJobs(jobs)
+			if err != nil {
+				return archived, err
+			}
+			archived += len(jobs)
+		}
 
-	for i := 0; i < batches; i++ {
-		err := storer(bucket, data[i*batchSize:(i+1)*batchSize])
+		if next == "" {
+			return archived, nil
+		}
+		after = next
+	}
+}
+
+// retrieveExpiredJobs is used by archiveExpiredJobs() to get the expired jobs
+// amongst the next dbArchiveBatchSize jobs of the complete bucket, starting
+// after the given key (or from the start if blank), populated with their
+// stored STDOUT/ERR. Also returns the key to start after for the next batch,
+// which is blank if there are no more jobs to consider.
+func (db *db) retrieveExpiredJobs(policies []*RetentionPolicy, now time.Time, after string) ([]*Job, string, error) {
+	var jobs []*Job
+	next, err := db.store.completeJobsFrom(after, dbArchiveBatchSize, true, func(_ string, encoded []byte) error {
+		job, err := db.decodeJob(encoded)
 		if err != nil {
 			return err
 		}
+
+		maxAge, matched := retentionMaxAge(policies, job.RepGroup)
+		if !matched || job.EndTime.IsZero() || now.Sub(job.EndTime) < maxAge {
+			return nil
+		}
+
+		job.State = JobStateComplete
+		jobs = append(jobs, job)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
 	}
 
-	if offset != 0 {
-		err := storer(bucket, data[offset:])
+	for _, job := range jobs {
+		job.StdOutC, job.StdErrC, err = db.store.jobStd(job.Key())
 		if err != nil {
-			return err
+			return nil, "", err
 		}
 	}
-	return nil
-}
 
-// storeLookups is a sobsdStorer for storing Job.[somevalue]->Job.Key() lookups
-// in the db.
-func (db *db) storeLookups(bucket []byte, lookups sobsd) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
-		return db.putLookups(tx, bucket, lookups)
-	})
-	return err
+	return jobs, next, nil
 }
 
-// putLookups does the work of storeLookups(). You must be inside a bolt
-// transaction when calling this.
-func (db *db) putLookups(tx *bolt.Tx, bucket []byte, lookups sobsd) error {
-	lookup := tx.Bucket(bucket)
-	for _, doublet := range lookups {
-		err := lookup.Put(doublet[0], nil)
+// retrieveFairShareUsage returns the usage of each account of the given
+// FairSharePolicy by the complete Jobs in the database, decayed as of the given
+// time.
+func (db *db) retrieveFairShareUsage(policy *FairSharePolicy, now time.Time) (map[string]float64, error) {
+	usage := make(map[string]float64)
+	_, err := db.store.completeJobsFrom("", 0, false, func(_ string, encoded []byte) error {
+		job, err := db.decodeJob(encoded)
 		if err != nil {
 			return err
 		}
-	}
-	return nil
-}
 
-// storeEncodedJobs is a sobsdStorer for storing Jobs in the db.
-func (db *db) storeEncodedJobs(bucket []byte, encodes sobsd) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
-		return db.putEncodedJobs(tx, bucket, encodes)
+		if u := exitedJobUsage(job); u > 0 {
+			usage[policy.account(job)] += policy.decay(u, now.Sub(job.EndTime))
+		}
+		return nil
 	})
-	return err
+	return usage, err
 }
 
-// putEncodedJobs does the work of storeEncodedJobs(). You nust be inside a bolt
-// transaction when calling this.
-func (db *db) putEncodedJobs(tx *bolt.Tx, bucket []byte, encodes sobsd) error {
-	bjobs := tx.Bucket(bucket)
-	for _, doublet := range encodes {
-		err := bjobs.Put(doublet[0], doublet[1])
+// deleteArchivedJobs is used by archiveExpiredJobs() to remove the given
+// complete jobs, their stored STDOUT/ERR and their lookups from the database.
+// Jobs that have become live again in the meantime are left alone.
+func (db *db) deleteArchivedJobs(jobs []*Job) error {
+	djobs := make([]*dbJob, 0, len(jobs))
+	for _, job := range jobs {
+		dj, err := newDBJob(job, db.ch)
 		if err != nil {
 			return err
 		}
+		djobs = append(djobs, dj)
 	}
-	return nil
+
+	return db.store.deleteArchivedJobs(djobs)
+}
+
+// compact rewrites the database without the free space left behind by deleted
+// data, so that the file (and subsequent backups) actually shrink after eg.
+// archiveExpiredJobs(). This can be done while the database is in use; other
+// database operations wait until it completes. Returns the size of the database
+// file before and after.
+func (db *db) compact(ctx context.Context) (int64, int64, error) {
+	db.RLock()
+	closed := db.closed
+	db.RUnlock()
+	if closed {
+		return 0, 0, fmt.Errorf("database closed")
+	}
+
+	return db.store.compact(ctx)
 }
 
 // close shuts down the db, should be used prior to exiting. Ensures any
@@ -1573,7 +1582,7 @@ func (db *db) close(ctx context.Context) error {
 			db.backupToBackupFile(ctx, false)
 		}
 
-		err := db.bolt.Close()
+		err := db.store.close()
 		if db.backupMount != nil {
 			erru := db.backupMount.Unmount()
 			if erru != nil {
@@ -1638,6 +1647,7 @@ func (db *db) backgroundBackup(ctx context.Context) {
 		db.backingUp = false
 		db.backupLast = time.Now()
 		duration := time.Since(start)
+		db.backupDuration = duration
 		if duration > minimumTimeBetweenBackups {
 			db.backupWait = duration
 		}
@@ -1662,6 +1672,14 @@ func (db *db) backgroundBackup(ctx context.Context) {
 	}(db.backupLast, db.backupWait, db.backupFinal)
 }
 
+// backupStats tells you when the last backgroundBackup() completed and how long
+// it took. The returned time will be zero if no such backup has completed yet.
+func (db *db) backupStats() (time.Time, time.Duration) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.backupLast, db.backupDuration
+}
+
 // backupToBackupFile is used by backgroundBackup() and close() to do the actual
 // backup.
 func (db *db) backupToBackupFile(ctx context.Context, slowBackups bool) {
@@ -1678,9 +1696,7 @@ func (db *db) backupToBackupFile(ctx context.Context, slowBackups bool) {
 	// create the new backup file with temp name
 	tmpBackupPath := db.backupPathTmp
 
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		return tx.CopyFile(tmpBackupPath, dbFilePermission)
-	})
+	err := db.store.backupToFile(tmpBackupPath)
 
 	if slowBackups {
 		<-time.After(100 * time.Millisecond)
@@ -1731,10 +1747,7 @@ func (db *db) backup(w io.Writer) error {
 	}
 	db.RUnlock()
 
-	return db.bolt.View(func(tx *bolt.Tx) error {
-		_, txErr := tx.WriteTo(w)
-		return txErr
-	})
+	return db.store.backup(w)
 }
 
 // stripBucketFromS3Path removes the first directory from the given path. If
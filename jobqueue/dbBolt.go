@@ -0,0 +1,981 @@
+// Copyright © 2016-2021, 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the default dbStore implementation, which uses boltdb.
+// We don't use a generic ORM for boltdb like Storm, because we can do custom
+// queries that are multiple times faster than what Storm can do.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/wtsi-ssg/wr/clog"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketJobsLive     = []byte("jobslive")
+	bucketJobsComplete = []byte("jobscomplete")
+	bucketRTK          = []byte("repgroupToKey")
+	bucketRGs          = []byte("repgroups")
+	bucketLGs          = []byte("limitgroups")
+	bucketDTK          = []byte("depgroupToKey")
+	bucketRDTK         = []byte("reverseDepgroupToKey")
+	bucketEnvs         = []byte("envs")
+	bucketArrays       = []byte("arrays")
+	bucketCrons        = []byte("crons")
+	bucketUsers        = []byte("users")
+	bucketMeta         = []byte("meta")
+	bucketStdO         = []byte("stdo")
+	bucketStdE         = []byte("stde")
+	bucketJobRAM       = []byte("jobRAM")
+	bucketJobDisk      = []byte("jobDisk")
+	bucketJobSecs      = []byte("jobSecs")
+)
+
+// boltBuckets are all the buckets a boltStore uses.
+var boltBuckets = [][]byte{
+	bucketJobsLive, bucketJobsComplete, bucketRTK, bucketRGs, bucketLGs,
+	bucketDTK, bucketRDTK, bucketEnvs, bucketArrays, bucketCrons, bucketUsers,
+	bucketMeta, bucketStdO, bucketStdE, bucketJobRAM, bucketJobDisk,
+	bucketJobSecs,
+}
+
+// boltTableBuckets maps dbTables to the buckets they are stored in.
+var boltTableBuckets = map[dbTable][]byte{
+	dbTableEnvs:   bucketEnvs,
+	dbTableArrays: bucketArrays,
+	dbTableCrons:  bucketCrons,
+	dbTableUsers:  bucketUsers,
+	dbTableMeta:   bucketMeta,
+}
+
+// boltStatBuckets maps dbStatKinds to the buckets they are stored in.
+var boltStatBuckets = map[dbStatKind][]byte{
+	dbStatRAM:  bucketJobRAM,
+	dbStatDisk: bucketJobDisk,
+	dbStatSecs: bucketJobSecs,
+}
+
+// sobsd ('slice of byte slice doublets') implements sort interface so we can
+// sort a slice of []byte doublets, sorting on the first byte slice, needed for
+// efficient Puts in to the database.
+type sobsd [][2][]byte
+
+func (s sobsd) Len() int {
+	return len(s)
+}
+
+func (s sobsd) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sobsd) Less(i, j int) bool {
+	cmp := bytes.Compare(s[i][0], s[j][0])
+	return cmp == -1
+}
+
+// sobsdStorer is the kind of function that stores the contents of a sobsd in
+// a particular bucket
+type sobsdStorer func(bucket []byte, encodes sobsd) (err error)
+
+// boltStore is a dbStore that uses boltdb. Jobs are stored in buckets keyed on
+// their keys, and they are looked up by other properties using buckets with
+// keys made of the property, dbDelimiter and the job key.
+type boltStore struct {
+	bolt   *bolt.DB
+	mutex  sync.RWMutex // protects bolt, which compact() replaces
+	closed bool
+}
+
+// openBoltStore opens (creating if necessary) the bolt database at the given
+// path, and makes sure our buckets are in place.
+func openBoltStore(path string) (*boltStore, error) {
+	boltdb, err := bolt.Open(path, dbFilePermission, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = boltdb.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range boltBuckets {
+			_, errf := tx.CreateBucketIfNotExists(bucket)
+			if errf != nil {
+				return fmt.Errorf("create bucket %s: %s", bucket, errf)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errc := boltdb.Close()
+		if errc != nil {
+			err = fmt.Errorf("%w (and closing failed: %s)", err, errc)
+		}
+		return nil, err
+	}
+
+	return &boltStore{bolt: boltdb}, nil
+}
+
+// view is like bolt's View(), but is safe to call while compact() might be
+// replacing our bolt database.
+func (s *boltStore) view(fn func(*bolt.Tx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.bolt.View(fn)
+}
+
+// batch is like bolt's Batch(), but is safe to call while compact() might be
+// replacing our bolt database.
+func (s *boltStore) batch(fn func(*bolt.Tx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.bolt.Batch(fn)
+}
+
+// generateLookupKey creates a lookup key understood by the retrieval methods,
+// concatenating prefix with a delimiter and the job key.
+func (s *boltStore) generateLookupKey(prefix string, jobKey []byte) []byte {
+	key := append([]byte(prefix), []byte(dbDelimiter)...)
+	return append(key, jobKey...)
+}
+
+// statKey creates the key we store a stat under, such that a bucket's stats
+// for a ReqGroup are sorted by value.
+func (s *boltStore) statKey(reqGroup string, value int) []byte {
+	return []byte(fmt.Sprintf("%s%s%20d", reqGroup, dbDelimiter, value))
+}
+
+// putStats stores the given stats of a ReqGroup. You must be inside a bolt
+// transaction when calling this.
+func (s *boltStore) putStats(tx *bolt.Tx, reqGroup string, stats []dbStat) error {
+	for _, stat := range stats {
+		err := tx.Bucket(boltStatBuckets[stat.kind]).Put(s.statKey(reqGroup, stat.value), []byte(strconv.Itoa(stat.value)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) storeLimitGroups(limits map[string]int64) (changed []string, removed []string, err error) {
+	err = s.batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketLGs)
+
+		for group, limit := range limits {
+			key := []byte(group)
+
+			v := b.Get(key)
+			if v != nil {
+				if limit < 0 {
+					errd := b.Delete(key)
+					if errd != nil {
+						return errd
+					}
+					removed = append(removed, group)
+					continue
+				}
+
+				if binary.BigEndian.Uint64(v) == uint64(limit) {
+					continue
+				}
+				changed = append(changed, group)
+			} else if limit < 0 {
+				continue
+			}
+
+			v = make([]byte, 8)
+			binary.BigEndian.PutUint64(v, uint64(limit))
+			errp := b.Put(key, v)
+			if errp != nil {
+				return errp
+			}
+		}
+
+		return nil
+	})
+	return changed, removed, err
+}
+
+func (s *boltStore) retrieveLimitGroup(group string) (int64, bool, error) {
+	var limit int64
+	var found bool
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketLGs).Get([]byte(group))
+		if v != nil {
+			limit = int64(binary.BigEndian.Uint64(v)) //nolint:gosec
+			found = true
+		}
+		return nil
+	})
+	return limit, found, err
+}
+
+// lookups converts the given jobs and RepGroups in to sorted sobsds ready to
+// be stored in their buckets.
+func (s *boltStore) lookups(jobs []*dbJob, repGroups []string) (encodedJobs, rgLookups, dgLookups, rdgLookups, rgs sobsd) {
+	for _, dj := range jobs {
+		key := []byte(dj.key)
+		rgLookups = append(rgLookups, [2][]byte{s.generateLookupKey(dj.repGroup, key), nil})
+
+		for _, depGroup := range dj.depGroups {
+			dgLookups = append(dgLookups, [2][]byte{s.generateLookupKey(depGroup, key), nil})
+		}
+
+		for _, depGroup := range dj.dependencyGroups {
+			rdgLookups = append(rdgLookups, [2][]byte{s.generateLookupKey(depGroup, key), nil})
+		}
+
+		encodedJobs = append(encodedJobs, [2][]byte{key, dj.encoded})
+	}
+
+	for _, rg := range repGroups {
+		rgs = append(rgs, [2][]byte{[]byte(rg), nil})
+	}
+
+	sort.Sort(encodedJobs)
+	sort.Sort(rgLookups)
+	sort.Sort(dgLookups)
+	sort.Sort(rdgLookups)
+	sort.Sort(rgs)
+
+	return encodedJobs, rgLookups, dgLookups, rdgLookups, rgs
+}
+
+func (s *boltStore) storeLiveJobs(jobs []*dbJob, repGroups []string) error {
+	encodedJobs, rgLookups, dgLookups, rdgLookups, rgs := s.lookups(jobs, repGroups)
+
+	// store the lookups and jobs at the same time
+	stores := []struct {
+		bucket []byte
+		data   sobsd
+		storer sobsdStorer
+	}{
+		{bucketRTK, rgLookups, s.storeLookups},
+		{bucketRGs, rgs, s.storeLookups},
+		{bucketDTK, dgLookups, s.storeLookups},
+		{bucketRDTK, rdgLookups, s.storeLookups},
+		{bucketJobsLive, encodedJobs, s.storeEncodedJobs},
+	}
+
+	errors := make(chan error, len(stores))
+	numStores := 0
+	for _, store := range stores {
+		if len(store.data) == 0 {
+			continue
+		}
+
+		numStores++
+		go func(bucket []byte, data sobsd, storer sobsdStorer) {
+			errors <- s.storeBatched(bucket, data, storer)
+		}(store.bucket, store.data, store.storer)
+	}
+
+	var err error
+	for range numStores {
+		if thisErr := <-errors; thisErr != nil {
+			err = thisErr
+		}
+	}
+	return err
+}
+
+func (s *boltStore) isLive(key string) (bool, error) {
+	var isLive bool
+	err := s.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		if newJobBucket.Get([]byte(key)) != nil {
+			isLive = true
+		}
+		return nil
+	})
+	return isLive, err
+}
+
+func (s *boltStore) isAdded(key string) (bool, error) {
+	var isInDB bool
+	err := s.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		completeJobBucket := tx.Bucket(bucketJobsComplete)
+		if newJobBucket.Get([]byte(key)) != nil || completeJobBucket.Get([]byte(key)) != nil {
+			isInDB = true
+		}
+		return nil
+	})
+	return isInDB, err
+}
+
+func (s *boltStore) archiveJob(dj *dbJob) error {
+	return s.batch(func(tx *bolt.Tx) error {
+		key := []byte(dj.key)
+		for _, bucket := range [][]byte{bucketStdO, bucketStdE, bucketJobsLive} {
+			errf := tx.Bucket(bucket).Delete(key)
+			if errf != nil {
+				return errf
+			}
+		}
+
+		errf := tx.Bucket(bucketJobsComplete).Put(key, dj.encoded)
+		if errf != nil {
+			return errf
+		}
+
+		return s.putStats(tx, dj.reqGroup, dj.stats())
+	})
+}
+
+func (s *boltStore) deleteLiveJobs(keys []string) error {
+	return s.batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketJobsLive)
+		for _, key := range keys {
+			errd := b.Delete([]byte(key))
+			if errd != nil {
+				return errd
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) liveJobs(fn func(encoded []byte) error) error {
+	return s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJobsLive).ForEach(func(_, encoded []byte) error {
+			if encoded != nil {
+				return fn(encoded)
+			}
+			return nil
+		})
+	})
+}
+
+func (s *boltStore) completeJobs(keys []string, fn func(encoded []byte) error) error {
+	return s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketJobsComplete)
+		for _, key := range keys {
+			encoded := b.Get([]byte(key))
+			if encoded != nil {
+				if err := fn(encoded); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) repGroups() ([]string, error) {
+	var rgs []string
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRGs).ForEach(func(k, _ []byte) error {
+			rgs = append(rgs, string(k))
+			return nil
+		})
+	})
+	return rgs, err
+}
+
+func (s *boltStore) completeJobsByRepGroup(repGroup, after string, fn func(key string, encoded []byte) error) error {
+	err := s.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		completeJobBucket := tx.Bucket(bucketJobsComplete)
+		lookupBucket := tx.Bucket(bucketRTK).Cursor()
+		prefix := []byte(repGroup + dbDelimiter)
+		for k, _ := lookupBucket.Seek(append(prefix, after...)); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
+			key := bytes.TrimPrefix(k, prefix)
+			if after != "" && string(key) == after {
+				continue
+			}
+
+			encoded := completeJobBucket.Get(key)
+			if len(encoded) > 0 && newJobBucket.Get(key) == nil {
+				if err := fn(string(key), encoded); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errStopIterating) {
+		return nil
+	}
+	return err
+}
+
+func (s *boltStore) jobsDependingOn(depGroups []string) ([]*dbDependentJob, error) {
+	var djs []*dbDependentJob
+	err := s.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		completeJobBucket := tx.Bucket(bucketJobsComplete)
+		lookupBucket := tx.Bucket(bucketRDTK).Cursor()
+		for _, depGroup := range depGroups {
+			prefix := []byte(depGroup + dbDelimiter)
+			for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
+				key := bytes.TrimPrefix(k, prefix)
+				dj := &dbDependentJob{key: string(key)}
+
+				encoded := newJobBucket.Get(key)
+				if len(encoded) > 0 {
+					dj.live = true
+				} else {
+					encoded = completeJobBucket.Get(key)
+				}
+
+				if len(encoded) > 0 {
+					dj.encoded = make([]byte, len(encoded))
+					copy(dj.encoded, encoded)
+				}
+
+				djs = append(djs, dj)
+			}
+		}
+		return nil
+	})
+	return djs, err
+}
+
+func (s *boltStore) incompleteJobKeysByDepGroup(depGroup string) ([]string, error) {
+	var jobKeys []string
+	err := s.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		lookupBucket := tx.Bucket(bucketDTK).Cursor()
+		prefix := []byte(depGroup + dbDelimiter)
+		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
+			key := bytes.TrimPrefix(k, prefix)
+			if newJobBucket.Get(key) != nil {
+				jobKeys = append(jobKeys, string(key))
+			}
+		}
+		return nil
+	})
+	return jobKeys, err
+}
+
+func (s *boltStore) completeJobKeysByDepGroup(depGroup string) ([]string, error) {
+	var jobKeys []string
+	err := s.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		completeJobBucket := tx.Bucket(bucketJobsComplete)
+		lookupBucket := tx.Bucket(bucketDTK).Cursor()
+		prefix := []byte(depGroup + dbDelimiter)
+		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
+			key := bytes.TrimPrefix(k, prefix)
+			if newJobBucket.Get(key) == nil && completeJobBucket.Get(key) != nil {
+				jobKeys = append(jobKeys, string(key))
+			}
+		}
+		return nil
+	})
+	return jobKeys, err
+}
+
+func (s *boltStore) put(table dbTable, key string, val []byte) error {
+	return s.batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTableBuckets[table]).Put([]byte(key), val)
+	})
+}
+
+func (s *boltStore) putAll(table dbTable, keys []string, vals [][]byte) error {
+	encodes := make(sobsd, len(keys))
+	for i, key := range keys {
+		encodes[i] = [2][]byte{[]byte(key), vals[i]}
+	}
+
+	sort.Sort(encodes)
+	return s.storeBatched(boltTableBuckets[table], encodes, s.storeEncodedJobs)
+}
+
+func (s *boltStore) get(table dbTable, key string) ([]byte, error) {
+	var val []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltTableBuckets[table]).Get([]byte(key))
+		if v != nil {
+			val = make([]byte, len(v))
+			copy(val, v)
+		}
+		return nil
+	})
+	return val, err
+}
+
+func (s *boltStore) all(table dbTable, fn func(val []byte) error) error {
+	return s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTableBuckets[table]).ForEach(func(_, v []byte) error {
+			return fn(v)
+		})
+	})
+}
+
+func (s *boltStore) delete(table dbTable, key string) error {
+	return s.batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTableBuckets[table]).Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) updateJobAfterExit(dj *dbJob, stdo, stde []byte, keepStd bool, stats []dbStat) error {
+	return s.batch(func(tx *bolt.Tx) error {
+		key := []byte(dj.key)
+
+		bjl := tx.Bucket(bucketJobsLive)
+		if bjl.Get(key) != nil {
+			errf := bjl.Put(key, dj.encoded)
+			if errf != nil {
+				return errf
+			}
+		}
+
+		bo := tx.Bucket(bucketStdO)
+		be := tx.Bucket(bucketStdE)
+		errf := bo.Delete(key)
+		if errf != nil {
+			return errf
+		}
+		errf = be.Delete(key)
+		if errf != nil {
+			return errf
+		}
+
+		if keepStd {
+			if len(stdo) > 0 {
+				errf = bo.Put(key, stdo)
+			}
+			if len(stde) > 0 {
+				errf = be.Put(key, stde)
+			}
+		}
+		if errf != nil {
+			return errf
+		}
+
+		return s.putStats(tx, dj.reqGroup, stats)
+	})
+}
+
+func (s *boltStore) updateLiveJob(key string, encoded []byte) error {
+	return s.batch(func(tx *bolt.Tx) error {
+		bjl := tx.Bucket(bucketJobsLive)
+		if bjl.Get([]byte(key)) == nil {
+			return nil
+		}
+		return bjl.Put([]byte(key), encoded)
+	})
+}
+
+func (s *boltStore) modifyLiveJobs(oldKeys []string, jobs []*dbJob, repGroups []string) error {
+	encodedJobs, rgLookups, dgLookups, rdgLookups, rgs := s.lookups(jobs, repGroups)
+
+	lookupBuckets := [][]byte{bucketRTK, bucketDTK, bucketRDTK}
+
+	return s.batch(func(tx *bolt.Tx) error {
+		// delete old jobs and their lookups
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		bo := tx.Bucket(bucketStdO)
+		be := tx.Bucket(bucketStdE)
+		os := make([][]byte, len(oldKeys))
+		es := make([][]byte, len(oldKeys))
+		var hadStd bool
+		for i, oldKey := range oldKeys {
+			suffix := []byte(dbDelimiter + oldKey)
+			for _, bucket := range lookupBuckets {
+				b := tx.Bucket(bucket)
+				// *** currently having to go through the the whole lookup
+				// buckets; if this is a noticeable performance issue, will have
+				// to implement a reverse lookup...
+				errf := b.ForEach(func(k, v []byte) error {
+					if bytes.HasSuffix(k, suffix) {
+						errd := b.Delete(k)
+						if errd != nil {
+							return errd
+						}
+					}
+					return nil
+				})
+				if errf != nil {
+					return errf
+				}
+			}
+
+			key := []byte(oldKey)
+			errd := newJobBucket.Delete(key)
+			if errd != nil {
+				return errd
+			}
+
+			o := bo.Get(key)
+			if o != nil {
+				os[i] = o
+				errd = bo.Delete(key)
+				if errd != nil {
+					return errd
+				}
+				hadStd = true
+			}
+
+			e := be.Get(key)
+			if e != nil {
+				es[i] = e
+				errd = be.Delete(key)
+				if errd != nil {
+					return errd
+				}
+				hadStd = true
+			}
+		}
+
+		if len(encodedJobs) > 0 {
+			// now go ahead and store the new lookups and jobs
+			errs := s.putLookups(tx, bucketRTK, rgLookups)
+			if errs != nil {
+				return errs
+			}
+
+			if len(rgs) > 0 {
+				errs = s.putLookups(tx, bucketRGs, rgs)
+				if errs != nil {
+					return errs
+				}
+			}
+
+			if len(dgLookups) > 0 {
+				errs = s.putLookups(tx, bucketDTK, dgLookups)
+				if errs != nil {
+					return errs
+				}
+			}
+
+			if len(rdgLookups) > 0 {
+				errs = s.putLookups(tx, bucketRDTK, rdgLookups)
+				if errs != nil {
+					return errs
+				}
+			}
+
+			if hadStd {
+				for i, dj := range jobs {
+					if i >= len(oldKeys) {
+						break
+					}
+					if os[i] != nil {
+						errs = bo.Put([]byte(dj.key), os[i])
+						if errs != nil {
+							return errs
+						}
+					}
+					if es[i] != nil {
+						errs = be.Put([]byte(dj.key), es[i])
+						if errs != nil {
+							return errs
+						}
+					}
+				}
+			}
+
+			return s.putEncodedJobs(tx, bucketJobsLive, encodedJobs)
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) jobStd(jobkey string) (stdo []byte, stde []byte, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		bo := tx.Bucket(bucketStdO)
+		be := tx.Bucket(bucketStdE)
+		key := []byte(jobkey)
+		o := bo.Get(key)
+		if o != nil {
+			stdo = make([]byte, len(o))
+			copy(stdo, o)
+		}
+		e := be.Get(key)
+		if e != nil {
+			stde = make([]byte, len(e))
+			copy(stde, e)
+		}
+		return nil
+	})
+	return stdo, stde, err
+}
+
+func (s *boltStore) reqGroupStats(kind dbStatKind, reqGroup string, fn func(value int)) error {
+	prefix := []byte(reqGroup)
+	return s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltStatBuckets[kind]).Cursor()
+		for k, v := c.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			value, err := strconv.Atoi(string(v))
+			if err != nil {
+				return err
+			}
+			fn(value)
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) completeJobsFrom(after string, limit int, skipLive bool, fn func(key string, encoded []byte) error) (string, error) {
+	var next string
+	err := s.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		c := tx.Bucket(bucketJobsComplete).Cursor()
+
+		k, encoded := c.First()
+		if after != "" {
+			k, encoded = c.Seek([]byte(after))
+			if string(k) == after {
+				k, encoded = c.Next()
+			}
+		}
+
+		count := 0
+		for ; k != nil; k, encoded = c.Next() {
+			if skipLive && newJobBucket.Get(k) != nil {
+				continue
+			}
+
+			if err := fn(string(k), encoded); err != nil {
+				return err
+			}
+
+			count++
+			if count == limit {
+				next = string(k)
+				return nil
+			}
+		}
+		return nil
+	})
+	return next, err
+}
+
+func (s *boltStore) deleteArchivedJobs(jobs []*dbJob) error {
+	return s.batch(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		buckets := [][]byte{bucketJobsComplete, bucketStdO, bucketStdE}
+		for _, dj := range jobs {
+			key := []byte(dj.key)
+			if newJobBucket.Get(key) != nil {
+				continue
+			}
+
+			for _, bucket := range buckets {
+				if err := tx.Bucket(bucket).Delete(key); err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Bucket(bucketRTK).Delete(s.generateLookupKey(dj.repGroup, key)); err != nil {
+				return err
+			}
+
+			for _, depGroup := range dj.depGroups {
+				if err := tx.Bucket(bucketDTK).Delete(s.generateLookupKey(depGroup, key)); err != nil {
+					return err
+				}
+			}
+
+			for _, depGroup := range dj.dependencyGroups {
+				if err := tx.Bucket(bucketRDTK).Delete(s.generateLookupKey(depGroup, key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// compact rewrites the database in to a new file without the free space left
+// behind by deleted data, and swaps it in place of the current database file.
+func (s *boltStore) compact(ctx context.Context) (int64, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0, 0, fmt.Errorf("database closed")
+	}
+
+	path := s.bolt.Path()
+	tmpPath := path + ".compact_tmp"
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	before := info.Size()
+
+	err = os.Remove(tmpPath)
+	if err != nil && !os.IsNotExist(err) {
+		return before, before, err
+	}
+
+	dst, err := bolt.Open(tmpPath, dbFilePermission, nil)
+	if err != nil {
+		return before, before, err
+	}
+
+	err = bolt.Compact(dst, s.bolt, dbCompactTxMaxSize)
+	errc := dst.Close()
+	if err == nil {
+		err = errc
+	}
+	if err != nil {
+		errr := os.Remove(tmpPath)
+		if errr != nil {
+			clog.Warn(ctx, "failed to remove incomplete compacted database file", "path", tmpPath, "err", errr)
+		}
+		return before, before, err
+	}
+
+	err = s.bolt.Close()
+	if err != nil {
+		return before, before, err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		clog.Error(ctx, "failed to replace database file with compacted version", "path", path, "err", err)
+	}
+
+	boltdb, erro := bolt.Open(path, dbFilePermission, nil)
+	if erro != nil {
+		s.closed = true
+		return before, before, erro
+	}
+	s.bolt = boltdb
+
+	if err != nil {
+		return before, before, err
+	}
+
+	info, err = os.Stat(path)
+	if err != nil {
+		return before, before, err
+	}
+	return before, info.Size(), nil
+}
+
+func (s *boltStore) backupToFile(path string) error {
+	return s.view(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, dbFilePermission)
+	})
+}
+
+func (s *boltStore) backup(w io.Writer) error {
+	return s.view(func(tx *bolt.Tx) error {
+		_, txErr := tx.WriteTo(w)
+		return txErr
+	})
+}
+
+func (s *boltStore) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.bolt.Close()
+}
+
+// storeBatched stores items in the db in batches for efficiency. bucket is the
+// name of the bucket to store in.
+func (s *boltStore) storeBatched(bucket []byte, data sobsd, storer sobsdStorer) error {
+	// we want to add in batches of size data/10, minimum 1000, rounded to
+	// the nearest 1000
+	num := len(data)
+	batchSize := num / 10
+	rem := batchSize % 1000
+	if rem > 500 {
+		batchSize = batchSize - rem + 1000
+	} else {
+		batchSize -= rem
+	}
+	if batchSize < 1000 {
+		batchSize = 1000
+	}
+
+	// based on https://github.com/boltdb/bolt/issues/337#issue-64861745
+	if num < batchSize {
+		return storer(bucket, data)
+	}
+
+	batches := num / batchSize
+	offset := num - (num % batchSize)
+
+	for i := 0; i < batches; i++ {
+		err := storer(bucket, data[i*batchSize:(i+1)*batchSize])
+		if err != nil {
+			return err
+		}
+	}
+
+	if offset != 0 {
+		err := storer(bucket, data[offset:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeLookups is a sobsdStorer for storing Job.[somevalue]->Job.Key() lookups
+// in the db.
+func (s *boltStore) storeLookups(bucket []byte, lookups sobsd) error {
+	err := s.batch(func(tx *bolt.Tx) error {
+		return s.putLookups(tx, bucket, lookups)
+	})
+	return err
+}
+
+// putLookups does the work of storeLookups(). You must be inside a bolt
+// transaction when calling this.
+func (s *boltStore) putLookups(tx *bolt.Tx, bucket []byte, lookups sobsd) error {
+	lookup := tx.Bucket(bucket)
+	for _, doublet := range lookups {
+		err := lookup.Put(doublet[0], nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeEncodedJobs is a sobsdStorer for storing Jobs in the db.
+func (s *boltStore) storeEncodedJobs(bucket []byte, encodes sobsd) error {
+	err := s.batch(func(tx *bolt.Tx) error {
+		return s.putEncodedJobs(tx, bucket, encodes)
+	})
+	return err
+}
+
+// putEncodedJobs does the work of storeEncodedJobs(). You nust be inside a bolt
+// transaction when calling this.
+func (s *boltStore) putEncodedJobs(tx *bolt.Tx, bucket []byte, encodes sobsd) error {
+	bjobs := tx.Bucket(bucket)
+	for _, doublet := range encodes {
+		err := bjobs.Put(doublet[0], doublet[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for migrating a database between backends.
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go/codec"
+	bolt "go.etcd.io/bbolt"
+)
+
+// migrateOpenTimeout is how long MigrateDB() waits for a bolt database to be
+// released by any server using it.
+const migrateOpenTimeout = 5 * time.Second
+
+// MigrateDB copies everything in the bolt (DBBackendBolt) database file at
+// boltFile to a new SQLite (DBBackendSQLite) database file at sqliteFile,
+// which must not already exist. The server using boltFile must be stopped
+// first. Returns the number of jobs (live and complete) that were copied.
+//
+// Once done, you can start a server with a ServerConfig with a DBFile of
+// sqliteFile and a DBBackend of DBBackendSQLite.
+func MigrateDB(boltFile, sqliteFile string) (int, error) {
+	if _, err := os.Stat(boltFile); err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(sqliteFile); err == nil {
+		return 0, fmt.Errorf("%s already exists", sqliteFile)
+	}
+
+	boltdb, err := bolt.Open(boltFile, dbFilePermission, &bolt.Options{ReadOnly: true, Timeout: migrateOpenTimeout})
+	if err != nil {
+		return 0, fmt.Errorf("could not open %s (is the manager still running?): %w", boltFile, err)
+	}
+	src := &boltStore{bolt: boltdb}
+	defer src.close()
+
+	dst, err := openSQLiteStore(sqliteFile)
+	if err != nil {
+		return 0, err
+	}
+
+	var migrated int
+	err = src.view(func(btx *bolt.Tx) error {
+		return dst.update(func(tx *sql.Tx) error {
+			var errm error
+			migrated, errm = migrateBoltToSQLite(btx, tx)
+			return errm
+		})
+	})
+
+	errc := dst.close()
+	if err == nil {
+		err = errc
+	}
+
+	if err != nil {
+		errr := os.Remove(sqliteFile)
+		if errr != nil {
+			err = fmt.Errorf("%w (and removing %s failed: %s)", err, sqliteFile, errr)
+		}
+		return 0, err
+	}
+
+	return migrated, nil
+}
+
+// migrateBoltToSQLite does the work of MigrateDB() inside transactions of the
+// source and destination databases. Missing buckets are skipped, so older
+// databases can be migrated.
+func migrateBoltToSQLite(btx *bolt.Tx, tx *sql.Tx) (int, error) {
+	forEach := func(bucket []byte, fn func(k, v []byte) error) error {
+		b := btx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(fn)
+	}
+
+	migrated := 0
+	err := forEach(bucketJobsLive, func(k, v []byte) error {
+		migrated++
+		_, err := tx.Exec(`INSERT INTO jobs_live (key, job) VALUES (?, ?)`, string(k), v)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s := &sqliteStore{}
+	ch := new(codec.BincHandle)
+	err = forEach(bucketJobsComplete, func(k, v []byte) error {
+		job := &Job{}
+		if errd := codec.NewDecoderBytes(v, ch).Decode(job); errd != nil {
+			return errd
+		}
+
+		dj, errd := newDBJob(job, ch)
+		if errd != nil {
+			return errd
+		}
+		dj.key = string(k)
+		dj.encoded = v
+
+		migrated++
+		return s.insertCompleteJob(tx, dj)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	lookupTables := map[string][]byte{
+		"job_rep_groups":   bucketRTK,
+		"job_dep_groups":   bucketDTK,
+		"job_dependencies": bucketRDTK,
+	}
+	for table, bucket := range lookupTables {
+		err = forEach(bucket, func(k, _ []byte) error {
+			group, key, errs := splitBoltLookupKey(k)
+			if errs != nil {
+				return errs
+			}
+			_, erre := tx.Exec(`INSERT OR IGNORE INTO `+table+` VALUES (?, ?)`, group, key)
+			return erre
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = forEach(bucketRGs, func(k, _ []byte) error {
+		_, erre := tx.Exec(`INSERT INTO rep_groups (name) VALUES (?)`, string(k))
+		return erre
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = forEach(bucketLGs, func(k, v []byte) error {
+		_, erre := tx.Exec(`INSERT INTO limit_groups (name, lim) VALUES (?, ?)`,
+			string(k), int64(binary.BigEndian.Uint64(v))) //nolint:gosec
+		return erre
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for table, bucket := range boltTableBuckets {
+		err = forEach(bucket, func(k, v []byte) error {
+			_, erre := tx.Exec(`INSERT INTO `+sqliteTables[table]+` (key, value) VALUES (?, ?)`, string(k), v)
+			return erre
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	stdColumns := map[string][]byte{"stdout": bucketStdO, "stderr": bucketStdE}
+	for column, bucket := range stdColumns {
+		err = forEach(bucket, func(k, v []byte) error {
+			_, erre := tx.Exec(`INSERT INTO std (key, `+column+`) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET `+
+				column+` = excluded.`+column, string(k), v)
+			return erre
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for kind, bucket := range boltStatBuckets {
+		err = forEach(bucket, func(k, v []byte) error {
+			reqGroup, _, errs := splitBoltLookupKey(k)
+			if errs != nil {
+				return errs
+			}
+
+			value, errs := strconv.Atoi(string(v))
+			if errs != nil {
+				return errs
+			}
+
+			_, erre := tx.Exec(`INSERT OR IGNORE INTO req_group_stats (kind, req_group, value) VALUES (?, ?, ?)`,
+				kind, reqGroup, value)
+			return erre
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return migrated, nil
+}
+
+// splitBoltLookupKey splits a key made by boltStore.generateLookupKey() or
+// statKey() back in to its prefix and suffix.
+func splitBoltLookupKey(k []byte) (string, string, error) {
+	str := string(k)
+	i := strings.LastIndex(str, dbDelimiter)
+	if i == -1 {
+		return "", "", fmt.Errorf("bad lookup key %q", str)
+	}
+
+	return str[:i], str[i+len(dbDelimiter):], nil
+}
@@ -0,0 +1,558 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for replicating a database to a standby server:
+// a journal of the changes made to a dbStore that a standby can apply to its
+// own copy, and snapshots of the whole database for when it can't.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// dbJournalMaxSize is roughly how many bytes of changes a dbJournal keeps; a
+// standby that falls further behind than this has to download a snapshot.
+var dbJournalMaxSize = 64 * 1024 * 1024
+
+// dbChangeOp is the dbStore method that a dbChange was made with.
+type dbChangeOp int
+
+const (
+	dbChangeStoreLimitGroups dbChangeOp = iota
+	dbChangeStoreLiveJobs
+	dbChangeArchiveJob
+	dbChangeDeleteLiveJobs
+	dbChangePut
+	dbChangePutAll
+	dbChangeDelete
+	dbChangeUpdateJobAfterExit
+	dbChangeUpdateLiveJob
+	dbChangeModifyLiveJobs
+	dbChangeDeleteArchivedJobs
+)
+
+// dbChange is a change made to a dbStore, recorded so that the same change can
+// be made to a standby server's copy of the database. Only the fields relevant
+// to Op are set.
+type dbChange struct {
+	Op        dbChangeOp
+	Table     dbTable
+	Keys      []string
+	Vals      [][]byte
+	Limits    map[string]int64
+	Jobs      []*dbChangeJob
+	RepGroups []string
+	Stdo      []byte
+	Stde      []byte
+	KeepStd   bool
+	Stats     []dbChangeStat
+}
+
+// dbChangeJob is a dbJob in a form we can send over the network.
+type dbChangeJob struct {
+	Key              string
+	Encoded          []byte
+	RepGroup         string
+	ReqGroup         string
+	DepGroups        []string
+	DependencyGroups []string
+	Cmd              string
+	Owner            string
+	Exitcode         int
+	FailReason       string
+	PeakRAM          int
+	PeakDisk         int
+	Secs             int
+	StartTime        time.Time
+	EndTime          time.Time
+}
+
+// dbChangeStat is a dbStat in a form we can send over the network.
+type dbChangeStat struct {
+	Kind  dbStatKind
+	Value int
+}
+
+// newDBChangeJobs converts dbJobs to dbChangeJobs.
+func newDBChangeJobs(jobs []*dbJob) []*dbChangeJob {
+	cjs := make([]*dbChangeJob, len(jobs))
+	for i, dj := range jobs {
+		cjs[i] = &dbChangeJob{
+			Key:              dj.key,
+			Encoded:          dj.encoded,
+			RepGroup:         dj.repGroup,
+			ReqGroup:         dj.reqGroup,
+			DepGroups:        dj.depGroups,
+			DependencyGroups: dj.dependencyGroups,
+			Cmd:              dj.cmd,
+			Owner:            dj.owner,
+			Exitcode:         dj.exitcode,
+			FailReason:       dj.failReason,
+			PeakRAM:          dj.peakRAM,
+			PeakDisk:         dj.peakDisk,
+			Secs:             dj.secs,
+			StartTime:        dj.startTime,
+			EndTime:          dj.endTime,
+		}
+	}
+
+	return cjs
+}
+
+// dbJobs converts dbChangeJobs back to dbJobs.
+func (c *dbChange) dbJobs() []*dbJob {
+	djs := make([]*dbJob, len(c.Jobs))
+	for i, cj := range c.Jobs {
+		djs[i] = &dbJob{
+			key:              cj.Key,
+			encoded:          cj.Encoded,
+			repGroup:         cj.RepGroup,
+			reqGroup:         cj.ReqGroup,
+			depGroups:        cj.DepGroups,
+			dependencyGroups: cj.DependencyGroups,
+			cmd:              cj.Cmd,
+			owner:            cj.Owner,
+			exitcode:         cj.Exitcode,
+			failReason:       cj.FailReason,
+			peakRAM:          cj.PeakRAM,
+			peakDisk:         cj.PeakDisk,
+			secs:             cj.Secs,
+			startTime:        cj.StartTime,
+			endTime:          cj.EndTime,
+		}
+	}
+
+	return djs
+}
+
+// size returns roughly how many bytes the change takes up.
+func (c *dbChange) size() int {
+	size := len(c.Stdo) + len(c.Stde) + 16*(len(c.Limits)+len(c.Stats))
+	for _, key := range c.Keys {
+		size += len(key)
+	}
+	for _, val := range c.Vals {
+		size += len(val)
+	}
+	for _, rg := range c.RepGroups {
+		size += len(rg)
+	}
+	for _, cj := range c.Jobs {
+		size += len(cj.Key) + len(cj.Encoded) + len(cj.RepGroup) + len(cj.ReqGroup) + len(cj.Cmd)
+	}
+
+	return size
+}
+
+// apply makes the change to the given store.
+func (c *dbChange) apply(store dbStore) error {
+	switch c.Op {
+	case dbChangeStoreLimitGroups:
+		_, _, err := store.storeLimitGroups(c.Limits)
+		return err
+	case dbChangeStoreLiveJobs:
+		return store.storeLiveJobs(c.dbJobs(), c.RepGroups)
+	case dbChangeArchiveJob:
+		return store.archiveJob(c.dbJobs()[0])
+	case dbChangeDeleteLiveJobs:
+		return store.deleteLiveJobs(c.Keys)
+	case dbChangePut:
+		return store.put(c.Table, c.Keys[0], c.Vals[0])
+	case dbChangePutAll:
+		return store.putAll(c.Table, c.Keys, c.Vals)
+	case dbChangeDelete:
+		return store.delete(c.Table, c.Keys[0])
+	case dbChangeUpdateJobAfterExit:
+		stats := make([]dbStat, len(c.Stats))
+		for i, stat := range c.Stats {
+			stats[i] = dbStat{kind: stat.Kind, value: stat.Value}
+		}
+		return store.updateJobAfterExit(c.dbJobs()[0], c.Stdo, c.Stde, c.KeepStd, stats)
+	case dbChangeUpdateLiveJob:
+		return store.updateLiveJob(c.Keys[0], c.Vals[0])
+	case dbChangeModifyLiveJobs:
+		return store.modifyLiveJobs(c.Keys, c.dbJobs(), c.RepGroups)
+	case dbChangeDeleteArchivedJobs:
+		return store.deleteArchivedJobs(c.dbJobs())
+	}
+
+	return fmt.Errorf("unknown database change %d", c.Op)
+}
+
+// dbSnapshot is a copy of the whole database, written to a file for a standby
+// server to download.
+type dbSnapshot struct {
+	seq  uint64
+	size int64
+}
+
+// dbJournal is a dbStore that wraps another, numbering every change made to it
+// and, once a standby server has taken a snapshot, keeping the most recent
+// changes (up to dbJournalMaxSize bytes of them) so that the standby can
+// apply them to its copy of the database.
+type dbJournal struct {
+	dbStore
+	snapshotPath string
+	changes      []*dbChange
+	size         int
+	seq          uint64 // number of the last change made
+	enabled      bool
+	snapshot     *dbSnapshot
+	mutex        sync.Mutex
+}
+
+// newDBJournal wraps the given store in a dbJournal that writes snapshots to
+// the given path.
+func newDBJournal(store dbStore, snapshotPath string) *dbJournal {
+	return &dbJournal{dbStore: store, snapshotPath: snapshotPath}
+}
+
+// record calls fn, which should make the given change to our store, and if
+// that succeeds, records the change. If it fails, we can't know if the store
+// was partially changed, so we forget all our changes, forcing a standby to
+// take a new snapshot.
+func (j *dbJournal) record(change *dbChange, fn func() error) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.seq++
+	if err := fn(); err != nil {
+		j.changes = nil
+		j.size = 0
+		return err
+	}
+
+	if !j.enabled {
+		return nil
+	}
+
+	j.changes = append(j.changes, change)
+	j.size += change.size()
+	for j.size > dbJournalMaxSize && len(j.changes) > 1 {
+		j.size -= j.changes[0].size()
+		j.changes[0] = nil
+		j.changes = j.changes[1:]
+	}
+
+	return nil
+}
+
+// firstSeq returns the number of the oldest change we still have. You must
+// hold the mutex.
+func (j *dbJournal) firstSeq() uint64 {
+	return j.seq - uint64(len(j.changes)) + 1
+}
+
+// changesSince returns the changes made after the one numbered seq, up to
+// roughly maxBytes of them, along with the number of the last change returned
+// and whether there are more. ok is false if we don't have all the changes
+// made since seq, in which case you'll need a snapshot instead.
+//
+// If a snapshot was taken at or before seq, it is no longer needed and is
+// deleted.
+func (j *dbJournal) changesSince(seq uint64, maxBytes int) (changes []*dbChange, last uint64, more, ok bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if !j.enabled || seq > j.seq || seq+1 < j.firstSeq() {
+		return nil, j.seq, false, false
+	}
+
+	if j.snapshot != nil && seq >= j.snapshot.seq {
+		j.removeSnapshot()
+	}
+
+	last = seq
+	size := 0
+	for _, change := range j.changes[seq+1-j.firstSeq():] {
+		if size > 0 && size+change.size() > maxBytes {
+			return changes, last, true, true
+		}
+		changes = append(changes, change)
+		size += change.size()
+		last++
+	}
+
+	return changes, last, false, true
+}
+
+// takeSnapshot returns the snapshot a standby should download to be able to
+// use changesSince(), writing one if we don't have one that is still recent
+// enough. Changes to the store are blocked while a snapshot is being written.
+func (j *dbJournal) takeSnapshot() (*dbSnapshot, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.snapshot != nil && j.enabled && j.snapshot.seq+1 >= j.firstSeq() {
+		return j.snapshot, nil
+	}
+	j.removeSnapshot()
+
+	if err := j.dbStore.backupToFile(j.snapshotPath); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(j.snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+
+	j.snapshot = &dbSnapshot{seq: j.seq, size: info.Size()}
+	j.enabled = true
+
+	return j.snapshot, nil
+}
+
+// readSnapshot reads up to maxBytes of the snapshot taken at seq, starting at
+// the given offset.
+func (j *dbJournal) readSnapshot(seq uint64, offset int64, maxBytes int) ([]byte, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.snapshot == nil || j.snapshot.seq != seq {
+		return nil, fmt.Errorf("database snapshot %d no longer exists", seq)
+	}
+
+	f, err := os.Open(j.snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, maxBytes)
+	n, err := f.ReadAt(b, offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return b[:n], err
+}
+
+// removeSnapshot deletes any snapshot file. You must hold the mutex.
+func (j *dbJournal) removeSnapshot() {
+	j.snapshot = nil
+	os.Remove(j.snapshotPath)
+}
+
+func (j *dbJournal) storeLimitGroups(limits map[string]int64) (changed, removed []string, err error) {
+	err = j.record(&dbChange{Op: dbChangeStoreLimitGroups, Limits: limits}, func() error {
+		var errs error
+		changed, removed, errs = j.dbStore.storeLimitGroups(limits)
+		return errs
+	})
+
+	return changed, removed, err
+}
+
+func (j *dbJournal) storeLiveJobs(jobs []*dbJob, repGroups []string) error {
+	return j.record(&dbChange{Op: dbChangeStoreLiveJobs, Jobs: newDBChangeJobs(jobs), RepGroups: repGroups}, func() error {
+		return j.dbStore.storeLiveJobs(jobs, repGroups)
+	})
+}
+
+func (j *dbJournal) archiveJob(job *dbJob) error {
+	return j.record(&dbChange{Op: dbChangeArchiveJob, Jobs: newDBChangeJobs([]*dbJob{job})}, func() error {
+		return j.dbStore.archiveJob(job)
+	})
+}
+
+func (j *dbJournal) deleteLiveJobs(keys []string) error {
+	return j.record(&dbChange{Op: dbChangeDeleteLiveJobs, Keys: keys}, func() error {
+		return j.dbStore.deleteLiveJobs(keys)
+	})
+}
+
+func (j *dbJournal) put(table dbTable, key string, val []byte) error {
+	return j.record(&dbChange{Op: dbChangePut, Table: table, Keys: []string{key}, Vals: [][]byte{val}}, func() error {
+		return j.dbStore.put(table, key, val)
+	})
+}
+
+func (j *dbJournal) putAll(table dbTable, keys []string, vals [][]byte) error {
+	return j.record(&dbChange{Op: dbChangePutAll, Table: table, Keys: keys, Vals: vals}, func() error {
+		return j.dbStore.putAll(table, keys, vals)
+	})
+}
+
+func (j *dbJournal) delete(table dbTable, key string) error {
+	return j.record(&dbChange{Op: dbChangeDelete, Table: table, Keys: []string{key}}, func() error {
+		return j.dbStore.delete(table, key)
+	})
+}
+
+func (j *dbJournal) updateJobAfterExit(job *dbJob, stdo, stde []byte, keepStd bool, stats []dbStat) error {
+	change := &dbChange{
+		Op:      dbChangeUpdateJobAfterExit,
+		Jobs:    newDBChangeJobs([]*dbJob{job}),
+		Stdo:    stdo,
+		Stde:    stde,
+		KeepStd: keepStd,
+		Stats:   make([]dbChangeStat, len(stats)),
+	}
+	for i, stat := range stats {
+		change.Stats[i] = dbChangeStat{Kind: stat.kind, Value: stat.value}
+	}
+
+	return j.record(change, func() error {
+		return j.dbStore.updateJobAfterExit(job, stdo, stde, keepStd, stats)
+	})
+}
+
+func (j *dbJournal) updateLiveJob(key string, encoded []byte) error {
+	return j.record(&dbChange{Op: dbChangeUpdateLiveJob, Keys: []string{key}, Vals: [][]byte{encoded}}, func() error {
+		return j.dbStore.updateLiveJob(key, encoded)
+	})
+}
+
+func (j *dbJournal) modifyLiveJobs(oldKeys []string, jobs []*dbJob, repGroups []string) error {
+	return j.record(&dbChange{Op: dbChangeModifyLiveJobs, Keys: oldKeys, Jobs: newDBChangeJobs(jobs), RepGroups: repGroups}, func() error {
+		return j.dbStore.modifyLiveJobs(oldKeys, jobs, repGroups)
+	})
+}
+
+func (j *dbJournal) deleteArchivedJobs(jobs []*dbJob) error {
+	return j.record(&dbChange{Op: dbChangeDeleteArchivedJobs, Jobs: newDBChangeJobs(jobs)}, func() error {
+		return j.dbStore.deleteArchivedJobs(jobs)
+	})
+}
+
+func (j *dbJournal) close() error {
+	j.mutex.Lock()
+	j.removeSnapshot()
+	j.mutex.Unlock()
+
+	return j.dbStore.close()
+}
+
+// changesSince returns the changes made to the database since the given
+// version, up to roughly maxBytes of them, the version after those changes and
+// whether there are more. ok is false if the database can't provide those
+// changes, in which case you need to use snapshot() instead.
+func (db *db) changesSince(version dbVersion, maxBytes int) (changes []*dbChange, current dbVersion, more, ok bool) {
+	current.Generation = db.generation.Load()
+	if version.Generation != current.Generation {
+		return nil, current, false, false
+	}
+
+	changes, current.Seq, more, ok = db.journal.changesSince(version.Seq, maxBytes)
+
+	return changes, current, more, ok
+}
+
+// snapshot makes sure a copy of the database exists for a standby server to
+// download with readSnapshot(), returning its version and size in bytes.
+// Afterwards, changesSince() will be able to provide changes made since that
+// version, for as long as the standby keeps up.
+func (db *db) snapshot() (dbVersion, int64, error) {
+	db.RLock()
+	if db.closed {
+		db.RUnlock()
+		return dbVersion{}, 0, fmt.Errorf("database closed")
+	}
+	db.RUnlock()
+
+	snapshot, err := db.journal.takeSnapshot()
+	if err != nil {
+		return dbVersion{}, 0, err
+	}
+
+	return dbVersion{Generation: db.generation.Load(), Seq: snapshot.seq}, snapshot.size, nil
+}
+
+// readSnapshot returns up to maxBytes of the snapshot() with the given
+// version, starting at the given offset.
+func (db *db) readSnapshot(version dbVersion, offset int64, maxBytes int) ([]byte, error) {
+	if version.Generation != db.generation.Load() {
+		return nil, fmt.Errorf("database snapshot %d no longer exists", version.Seq)
+	}
+
+	return db.journal.readSnapshot(version.Seq, offset, maxBytes)
+}
+
+// dbReplica is a standby server's copy of its primary server's database.
+type dbReplica struct {
+	store   dbStore
+	path    string
+	backend string
+	version dbVersion
+}
+
+// open opens our database file, if we have one.
+func (r *dbReplica) open() error {
+	if r.store != nil {
+		return nil
+	}
+
+	if _, err := os.Stat(r.path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	store, err := openDBStore(r.backend, r.path)
+	if err != nil {
+		return err
+	}
+	r.store = store
+
+	return nil
+}
+
+// apply makes the given changes to our database, which bring it up to the
+// given version. If that fails, we forget our version, so that we'll get a
+// new snapshot.
+func (r *dbReplica) apply(changes []*dbChange, version dbVersion) error {
+	if err := r.open(); err != nil {
+		r.version = dbVersion{}
+		return err
+	}
+
+	if r.store == nil {
+		r.version = dbVersion{}
+		return fmt.Errorf("no replica database to apply changes to")
+	}
+
+	for _, change := range changes {
+		if err := change.apply(r.store); err != nil {
+			r.version = dbVersion{}
+			return err
+		}
+	}
+
+	r.version = version
+
+	return nil
+}
+
+// close closes our database.
+func (r *dbReplica) close() error {
+	if r.store == nil {
+		return nil
+	}
+
+	err := r.store.close()
+	r.store = nil
+
+	return err
+}
@@ -0,0 +1,740 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains a dbStore implementation that uses SQLite. Unlike boltdb,
+// the properties of complete jobs and their resource usage are stored in
+// indexed columns, so the job history can be queried with plain SQL, eg.
+//
+// SELECT cmd FROM jobs_complete WHERE peak_ram > 51200 AND end_time > ...
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+)
+
+const sqliteBusyTimeout = 5000 // ms
+
+// sqliteSchema creates our tables and indexes if they don't already exist.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS jobs_live (
+	key TEXT PRIMARY KEY,
+	job BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS jobs_complete (
+	key TEXT PRIMARY KEY,
+	job BLOB NOT NULL,
+	rep_group TEXT NOT NULL,
+	req_group TEXT NOT NULL,
+	cmd TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	exitcode INTEGER NOT NULL,
+	fail_reason TEXT NOT NULL,
+	peak_ram INTEGER NOT NULL,
+	peak_disk INTEGER NOT NULL,
+	secs INTEGER NOT NULL,
+	start_time INTEGER,
+	end_time INTEGER
+);
+CREATE INDEX IF NOT EXISTS jobs_complete_rep_group ON jobs_complete (rep_group);
+CREATE INDEX IF NOT EXISTS jobs_complete_req_group ON jobs_complete (req_group);
+CREATE INDEX IF NOT EXISTS jobs_complete_owner ON jobs_complete (owner);
+CREATE INDEX IF NOT EXISTS jobs_complete_end_time ON jobs_complete (end_time);
+CREATE INDEX IF NOT EXISTS jobs_complete_peak_ram ON jobs_complete (peak_ram);
+CREATE INDEX IF NOT EXISTS jobs_complete_peak_disk ON jobs_complete (peak_disk);
+CREATE TABLE IF NOT EXISTS rep_groups (
+	name TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS job_rep_groups (
+	rep_group TEXT NOT NULL,
+	key TEXT NOT NULL,
+	PRIMARY KEY (rep_group, key)
+);
+CREATE INDEX IF NOT EXISTS job_rep_groups_key ON job_rep_groups (key);
+CREATE TABLE IF NOT EXISTS job_dep_groups (
+	dep_group TEXT NOT NULL,
+	key TEXT NOT NULL,
+	PRIMARY KEY (dep_group, key)
+);
+CREATE INDEX IF NOT EXISTS job_dep_groups_key ON job_dep_groups (key);
+CREATE TABLE IF NOT EXISTS job_dependencies (
+	dep_group TEXT NOT NULL,
+	key TEXT NOT NULL,
+	PRIMARY KEY (dep_group, key)
+);
+CREATE INDEX IF NOT EXISTS job_dependencies_key ON job_dependencies (key);
+CREATE TABLE IF NOT EXISTS limit_groups (
+	name TEXT PRIMARY KEY,
+	lim INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS envs (
+	key TEXT PRIMARY KEY,
+	value BLOB
+);
+CREATE TABLE IF NOT EXISTS arrays (
+	key TEXT PRIMARY KEY,
+	value BLOB
+);
+CREATE TABLE IF NOT EXISTS crons (
+	key TEXT PRIMARY KEY,
+	value BLOB
+);
+CREATE TABLE IF NOT EXISTS users (
+	key TEXT PRIMARY KEY,
+	value BLOB
+);
+CREATE TABLE IF NOT EXISTS meta (
+	key TEXT PRIMARY KEY,
+	value BLOB
+);
+CREATE TABLE IF NOT EXISTS std (
+	key TEXT PRIMARY KEY,
+	stdout BLOB,
+	stderr BLOB
+);
+CREATE TABLE IF NOT EXISTS req_group_stats (
+	kind INTEGER NOT NULL,
+	req_group TEXT NOT NULL,
+	value INTEGER NOT NULL,
+	PRIMARY KEY (kind, req_group, value)
+);
+`
+
+// sqliteTables maps dbTables to the names of the tables they are stored in.
+var sqliteTables = map[dbTable]string{
+	dbTableEnvs:   "envs",
+	dbTableArrays: "arrays",
+	dbTableCrons:  "crons",
+	dbTableUsers:  "users",
+	dbTableMeta:   "meta",
+}
+
+// sqliteStore is a dbStore that uses SQLite. We use a single connection, so
+// all operations are serialized; callers of query() must not do any other
+// operation until they are done with the rows.
+type sqliteStore struct {
+	sql    *sql.DB
+	path   string
+	mutex  sync.Mutex // stops compact() and close() happening at once
+	closed bool
+}
+
+// openSQLiteStore opens (creating if necessary) the SQLite database at the
+// given path, and makes sure our tables are in place.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	sqldb, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)", path, sqliteBusyTimeout))
+	if err != nil {
+		return nil, err
+	}
+	sqldb.SetMaxOpenConns(1)
+
+	_, err = sqldb.Exec(sqliteSchema)
+	if err == nil {
+		err = os.Chmod(path, dbFilePermission)
+	}
+	if err != nil {
+		errc := sqldb.Close()
+		if errc != nil {
+			err = fmt.Errorf("%w (and closing failed: %s)", err, errc)
+		}
+		return nil, err
+	}
+
+	return &sqliteStore{sql: sqldb, path: path}, nil
+}
+
+// update runs fn inside a transaction, committing it if fn returns no error.
+func (s *sqliteStore) update(fn func(tx *sql.Tx) error) error {
+	tx, err := s.sql.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		if errr := tx.Rollback(); errr != nil {
+			err = fmt.Errorf("%w (and rollback failed: %s)", err, errr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// query calls fn with each row returned by the given query.
+func (s *sqliteStore) query(fn func(rows *sql.Rows) error, query string, args ...any) error {
+	rows, err := s.sql.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exists tells you if the given query returns any rows.
+func (s *sqliteStore) exists(query string, args ...any) (bool, error) {
+	var one int
+	err := s.sql.QueryRow(query, args...).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unixTime converts a time to a value for our time columns, which are NULL
+// for zero times.
+func unixTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Unix()
+}
+
+// insertLiveJobs stores jobs and their lookups as per storeLiveJobs().
+func (s *sqliteStore) insertLiveJobs(tx *sql.Tx, jobs []*dbJob, repGroups []string) error {
+	for _, rg := range repGroups {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO rep_groups (name) VALUES (?)`, rg); err != nil {
+			return err
+		}
+	}
+
+	for _, dj := range jobs {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO jobs_live (key, job) VALUES (?, ?)`, dj.key, dj.encoded); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO job_rep_groups (rep_group, key) VALUES (?, ?)`, dj.repGroup, dj.key); err != nil {
+			return err
+		}
+
+		for _, depGroup := range dj.depGroups {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO job_dep_groups (dep_group, key) VALUES (?, ?)`, depGroup, dj.key); err != nil {
+				return err
+			}
+		}
+
+		for _, depGroup := range dj.dependencyGroups {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO job_dependencies (dep_group, key) VALUES (?, ?)`, depGroup, dj.key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insertCompleteJob stores a complete job.
+func (s *sqliteStore) insertCompleteJob(tx *sql.Tx, dj *dbJob) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO jobs_complete (key, job, rep_group, req_group, cmd, owner, exitcode,
+		fail_reason, peak_ram, peak_disk, secs, start_time, end_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		dj.key, dj.encoded, dj.repGroup, dj.reqGroup, dj.cmd, dj.owner, dj.exitcode, dj.failReason,
+		dj.peakRAM, dj.peakDisk, dj.secs, unixTime(dj.startTime), unixTime(dj.endTime))
+	return err
+}
+
+// insertStats stores the given stats of a ReqGroup.
+func (s *sqliteStore) insertStats(tx *sql.Tx, reqGroup string, stats []dbStat) error {
+	for _, stat := range stats {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO req_group_stats (kind, req_group, value) VALUES (?, ?, ?)`,
+			stat.kind, reqGroup, stat.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertStd stores std streams, which are NULL when empty.
+func (s *sqliteStore) insertStd(tx *sql.Tx, key string, stdo, stde []byte) error {
+	if len(stdo) == 0 && len(stde) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`INSERT OR REPLACE INTO std (key, stdout, stderr) VALUES (?, ?, ?)`, key, nilIfEmpty(stdo), nilIfEmpty(stde))
+	return err
+}
+
+// nilIfEmpty returns nil for an empty byte slice, so that it is stored as
+// NULL.
+func nilIfEmpty(b []byte) any {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+func (s *sqliteStore) storeLimitGroups(limits map[string]int64) (changed []string, removed []string, err error) {
+	err = s.update(func(tx *sql.Tx) error {
+		changed, removed = nil, nil
+		for group, limit := range limits {
+			var current int64
+			errq := tx.QueryRow(`SELECT lim FROM limit_groups WHERE name = ?`, group).Scan(&current)
+			found := errq == nil
+			if errq != nil && !errors.Is(errq, sql.ErrNoRows) {
+				return errq
+			}
+
+			if limit < 0 {
+				if found {
+					if _, errd := tx.Exec(`DELETE FROM limit_groups WHERE name = ?`, group); errd != nil {
+						return errd
+					}
+					removed = append(removed, group)
+				}
+				continue
+			}
+
+			if found {
+				if current == limit {
+					continue
+				}
+				changed = append(changed, group)
+			}
+
+			if _, errp := tx.Exec(`INSERT OR REPLACE INTO limit_groups (name, lim) VALUES (?, ?)`, group, limit); errp != nil {
+				return errp
+			}
+		}
+		return nil
+	})
+	return changed, removed, err
+}
+
+func (s *sqliteStore) retrieveLimitGroup(group string) (int64, bool, error) {
+	var limit int64
+	err := s.sql.QueryRow(`SELECT lim FROM limit_groups WHERE name = ?`, group).Scan(&limit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return limit, err == nil, err
+}
+
+func (s *sqliteStore) storeLiveJobs(jobs []*dbJob, repGroups []string) error {
+	return s.update(func(tx *sql.Tx) error {
+		return s.insertLiveJobs(tx, jobs, repGroups)
+	})
+}
+
+func (s *sqliteStore) isLive(key string) (bool, error) {
+	return s.exists(`SELECT 1 FROM jobs_live WHERE key = ?`, key)
+}
+
+func (s *sqliteStore) isAdded(key string) (bool, error) {
+	return s.exists(`SELECT 1 FROM jobs_live WHERE key = ? UNION ALL SELECT 1 FROM jobs_complete WHERE key = ?`, key, key)
+}
+
+func (s *sqliteStore) archiveJob(dj *dbJob) error {
+	return s.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM std WHERE key = ?`, dj.key); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM jobs_live WHERE key = ?`, dj.key); err != nil {
+			return err
+		}
+
+		if err := s.insertCompleteJob(tx, dj); err != nil {
+			return err
+		}
+
+		return s.insertStats(tx, dj.reqGroup, dj.stats())
+	})
+}
+
+func (s *sqliteStore) deleteLiveJobs(keys []string) error {
+	return s.update(func(tx *sql.Tx) error {
+		for _, key := range keys {
+			if _, err := tx.Exec(`DELETE FROM jobs_live WHERE key = ?`, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// blobs calls fn with the blob in the first column of each row returned by
+// the given query.
+func (s *sqliteStore) blobs(fn func(b []byte) error, query string, args ...any) error {
+	return s.query(func(rows *sql.Rows) error {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return err
+		}
+		return fn(b)
+	}, query, args...)
+}
+
+func (s *sqliteStore) liveJobs(fn func(encoded []byte) error) error {
+	return s.blobs(fn, `SELECT job FROM jobs_live ORDER BY key`)
+}
+
+func (s *sqliteStore) completeJobs(keys []string, fn func(encoded []byte) error) error {
+	for _, key := range keys {
+		var encoded []byte
+		err := s.sql.QueryRow(`SELECT job FROM jobs_complete WHERE key = ?`, key).Scan(&encoded)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = fn(encoded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) repGroups() ([]string, error) {
+	var rgs []string
+	err := s.blobs(func(b []byte) error {
+		rgs = append(rgs, string(b))
+		return nil
+	}, `SELECT name FROM rep_groups ORDER BY name`)
+	return rgs, err
+}
+
+func (s *sqliteStore) completeJobsByRepGroup(repGroup, after string, fn func(key string, encoded []byte) error) error {
+	err := s.query(func(rows *sql.Rows) error {
+		var key string
+		var encoded []byte
+		if err := rows.Scan(&key, &encoded); err != nil {
+			return err
+		}
+		return fn(key, encoded)
+	}, `SELECT r.key, c.job FROM job_rep_groups r JOIN jobs_complete c ON c.key = r.key
+		WHERE r.rep_group = ? AND r.key > ? AND r.key NOT IN (SELECT key FROM jobs_live) ORDER BY r.key`, repGroup, after)
+	if errors.Is(err, errStopIterating) {
+		return nil
+	}
+	return err
+}
+
+func (s *sqliteStore) jobsDependingOn(depGroups []string) ([]*dbDependentJob, error) {
+	var djs []*dbDependentJob
+	for _, depGroup := range depGroups {
+		err := s.query(func(rows *sql.Rows) error {
+			dj := &dbDependentJob{}
+			var live, complete []byte
+			if err := rows.Scan(&dj.key, &live, &complete); err != nil {
+				return err
+			}
+
+			if len(live) > 0 {
+				dj.encoded = live
+				dj.live = true
+			} else if len(complete) > 0 {
+				dj.encoded = complete
+			}
+
+			djs = append(djs, dj)
+			return nil
+		}, `SELECT d.key, l.job, c.job FROM job_dependencies d LEFT JOIN jobs_live l ON l.key = d.key
+			LEFT JOIN jobs_complete c ON c.key = d.key WHERE d.dep_group = ? ORDER BY d.key`, depGroup)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return djs, nil
+}
+
+func (s *sqliteStore) incompleteJobKeysByDepGroup(depGroup string) ([]string, error) {
+	var keys []string
+	err := s.blobs(func(b []byte) error {
+		keys = append(keys, string(b))
+		return nil
+	}, `SELECT d.key FROM job_dep_groups d JOIN jobs_live l ON l.key = d.key WHERE d.dep_group = ? ORDER BY d.key`, depGroup)
+	return keys, err
+}
+
+func (s *sqliteStore) completeJobKeysByDepGroup(depGroup string) ([]string, error) {
+	var keys []string
+	err := s.blobs(func(b []byte) error {
+		keys = append(keys, string(b))
+		return nil
+	}, `SELECT d.key FROM job_dep_groups d JOIN jobs_complete c ON c.key = d.key
+		LEFT JOIN jobs_live l ON l.key = d.key WHERE d.dep_group = ? AND l.key IS NULL ORDER BY d.key`, depGroup)
+	return keys, err
+}
+
+func (s *sqliteStore) put(table dbTable, key string, val []byte) error {
+	return s.putAll(table, []string{key}, [][]byte{val})
+}
+
+func (s *sqliteStore) putAll(table dbTable, keys []string, vals [][]byte) error {
+	return s.update(func(tx *sql.Tx) error {
+		for i, key := range keys {
+			_, err := tx.Exec(`INSERT OR REPLACE INTO `+sqliteTables[table]+` (key, value) VALUES (?, ?)`, key, vals[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) get(table dbTable, key string) ([]byte, error) {
+	var val []byte
+	err := s.sql.QueryRow(`SELECT value FROM `+sqliteTables[table]+` WHERE key = ?`, key).Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return val, err
+}
+
+func (s *sqliteStore) all(table dbTable, fn func(val []byte) error) error {
+	return s.blobs(fn, `SELECT value FROM `+sqliteTables[table]+` ORDER BY key`)
+}
+
+func (s *sqliteStore) delete(table dbTable, key string) error {
+	return s.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM `+sqliteTables[table]+` WHERE key = ?`, key)
+		return err
+	})
+}
+
+func (s *sqliteStore) updateJobAfterExit(dj *dbJob, stdo, stde []byte, keepStd bool, stats []dbStat) error {
+	return s.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE jobs_live SET job = ? WHERE key = ?`, dj.encoded, dj.key); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM std WHERE key = ?`, dj.key); err != nil {
+			return err
+		}
+
+		if keepStd {
+			if err := s.insertStd(tx, dj.key, stdo, stde); err != nil {
+				return err
+			}
+		}
+
+		return s.insertStats(tx, dj.reqGroup, stats)
+	})
+}
+
+func (s *sqliteStore) updateLiveJob(key string, encoded []byte) error {
+	return s.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE jobs_live SET job = ? WHERE key = ?`, encoded, key)
+		return err
+	})
+}
+
+func (s *sqliteStore) modifyLiveJobs(oldKeys []string, jobs []*dbJob, repGroups []string) error {
+	return s.update(func(tx *sql.Tx) error {
+		// delete old jobs and their lookups, remembering their std
+		stdos := make([][]byte, len(oldKeys))
+		stdes := make([][]byte, len(oldKeys))
+		for i, oldKey := range oldKeys {
+			for _, table := range []string{"job_rep_groups", "job_dep_groups", "job_dependencies", "jobs_live"} {
+				if _, err := tx.Exec(`DELETE FROM `+table+` WHERE key = ?`, oldKey); err != nil {
+					return err
+				}
+			}
+
+			err := tx.QueryRow(`SELECT stdout, stderr FROM std WHERE key = ?`, oldKey).Scan(&stdos[i], &stdes[i])
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+
+			if _, err = tx.Exec(`DELETE FROM std WHERE key = ?`, oldKey); err != nil {
+				return err
+			}
+		}
+
+		if len(jobs) == 0 {
+			return nil
+		}
+
+		// now go ahead and store the new lookups and jobs
+		if err := s.insertLiveJobs(tx, jobs, repGroups); err != nil {
+			return err
+		}
+
+		for i, dj := range jobs {
+			if i >= len(oldKeys) {
+				break
+			}
+			if err := s.insertStd(tx, dj.key, stdos[i], stdes[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) jobStd(key string) (stdo []byte, stde []byte, err error) {
+	err = s.sql.QueryRow(`SELECT stdout, stderr FROM std WHERE key = ?`, key).Scan(&stdo, &stde)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, nil
+	}
+	return stdo, stde, err
+}
+
+func (s *sqliteStore) reqGroupStats(kind dbStatKind, reqGroup string, fn func(value int)) error {
+	return s.query(func(rows *sql.Rows) error {
+		var value int
+		if err := rows.Scan(&value); err != nil {
+			return err
+		}
+		fn(value)
+		return nil
+	}, `SELECT value FROM req_group_stats WHERE kind = ? AND req_group = ? ORDER BY value`, kind, reqGroup)
+}
+
+func (s *sqliteStore) completeJobsFrom(after string, limit int, skipLive bool, fn func(key string, encoded []byte) error) (string, error) {
+	query := `SELECT key, job FROM jobs_complete WHERE key > ?`
+	if skipLive {
+		query += ` AND key NOT IN (SELECT key FROM jobs_live)`
+	}
+	query += ` ORDER BY key`
+
+	args := []any{after}
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	var last string
+	count := 0
+	err := s.query(func(rows *sql.Rows) error {
+		var encoded []byte
+		if err := rows.Scan(&last, &encoded); err != nil {
+			return err
+		}
+		count++
+		return fn(last, encoded)
+	}, query, args...)
+	if err != nil || count < limit || limit == 0 {
+		return "", err
+	}
+	return last, nil
+}
+
+func (s *sqliteStore) deleteArchivedJobs(jobs []*dbJob) error {
+	return s.update(func(tx *sql.Tx) error {
+		for _, dj := range jobs {
+			var one int
+			err := tx.QueryRow(`SELECT 1 FROM jobs_live WHERE key = ?`, dj.key).Scan(&one)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+
+			for _, table := range []string{"jobs_complete", "std", "job_rep_groups", "job_dep_groups", "job_dependencies"} {
+				if _, err = tx.Exec(`DELETE FROM `+table+` WHERE key = ?`, dj.key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// compact VACUUMs the database.
+func (s *sqliteStore) compact(_ context.Context) (int64, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0, 0, fmt.Errorf("database closed")
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	before := info.Size()
+
+	if _, err = s.sql.Exec(`VACUUM`); err != nil {
+		return before, before, err
+	}
+
+	info, err = os.Stat(s.path)
+	if err != nil {
+		return before, before, err
+	}
+	return before, info.Size(), nil
+}
+
+// backupToFile uses VACUUM INTO, which needs the path to not exist.
+func (s *sqliteStore) backupToFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err = s.sql.Exec(`VACUUM INTO ?`, path); err != nil {
+		return err
+	}
+
+	return os.Chmod(path, dbFilePermission)
+}
+
+func (s *sqliteStore) backup(w io.Writer) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.backup_tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	err = tmp.Close()
+	if err == nil {
+		err = s.backupToFile(tmpPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (s *sqliteStore) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.sql.Close()
+}
@@ -20,32 +20,119 @@ package jobqueue
 
 // This file contains the dependency related code.
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// DependencyMode describes what must happen to the jobs a Dependency refers to
+// before the dependency is satisfied.
+type DependencyMode string
+
+// DepMode* constants are the possible DependencyModes. A Dependency with no
+// Mode is treated as DepModeSuccess.
+const (
+	// DepModeSuccess dependencies are satisfied when the jobs depended upon
+	// complete successfully.
+	DepModeSuccess DependencyMode = "success"
+
+	// DepModeFailure dependencies are satisfied when the jobs depended upon
+	// get buried, so are useful for clean-up or alerting jobs.
+	DepModeFailure DependencyMode = "failure"
+
+	// DepModeAny dependencies are satisfied when the jobs depended upon either
+	// complete successfully or get buried.
+	DepModeAny DependencyMode = "any"
+)
+
+// depModeSeparator separates a dependency from its mode in the string form of
+// dependencies understood by SplitDependencyMode(). DepGroups can't contain it,
+// so that "group:any" can only mean a DepModeAny dependency on "group".
+const depModeSeparator = ":"
+
+// DepFailureAction describes what should happen to a Job when one of its
+// dependencies can never be satisfied, such as when a job it has a
+// DepModeSuccess dependency on gets buried.
+type DepFailureAction string
+
+// DepFailure* constants are the possible DepFailureActions.
+const (
+	// DepFailureWait leaves the Job in the dependent state, so that it will
+	// still run if the user fixes and retries the job it depends upon.
+	DepFailureWait DepFailureAction = ""
+
+	// DepFailureBury buries the Job (which in turn affects its own dependants).
+	DepFailureBury DepFailureAction = "bury"
+
+	// DepFailureDelete deletes the Job, along with all jobs that depend on it.
+	DepFailureDelete DepFailureAction = "delete"
+)
+
+// ParseDepFailureAction converts the given string (bury, delete, or blank) to
+// a DepFailureAction.
+func ParseDepFailureAction(action string) (DepFailureAction, error) {
+	switch DepFailureAction(action) {
+	case DepFailureWait, DepFailureBury, DepFailureDelete:
+		return DepFailureAction(action), nil
+	}
+	return DepFailureWait, fmt.Errorf("'%s' is not a valid dependency failure action (bury or delete)", action)
+}
+
+// SplitDependencyMode takes a dependency in the form "dep:mode", where mode is
+// one of "success", "failure" or "any", and returns dep and the corresponding
+// DependencyMode. If there is no valid mode suffix, the input is returned as-is
+// along with DepModeSuccess (and if it is a DepGroup, will then be rejected by
+// the server for containing ":").
+func SplitDependencyMode(dep string) (string, DependencyMode) {
+	i := strings.LastIndex(dep, depModeSeparator)
+	if i != -1 {
+		switch mode := DependencyMode(dep[i+1:]); mode {
+		case DepModeSuccess, DepModeFailure, DepModeAny:
+			return dep[:i], mode
+		}
+	}
+	return dep, DepModeSuccess
+}
+
+// validateDepGroups checks that none of the given DepGroups contain
+// depModeSeparator.
+func validateDepGroups(depGroups []string) error {
+	for _, group := range depGroups {
+		if strings.Contains(group, depModeSeparator) {
+			return fmt.Errorf("dependency group '%s' is not valid (it can't contain '%s', which separates a dependency from its mode)", group, depModeSeparator)
+		}
+	}
+	return nil
+}
+
 // Dependencies is a slice of *Dependency, for use in Job.Dependencies. It
-// describes the jobs that must be complete before the Job you associate this
-// with will start.
+// describes the jobs that must be complete (or buried, depending on the Mode of
+// each Dependency) before the Job you associate this with will start.
 type Dependencies []*Dependency
 
-// incompleteJobKeys converts the constituent Dependency structs in to internal
-// job keys that uniquely identify the jobs we are dependent upon. Note that if
-// you have dependencies that are specified with DepGroups, then you should re-
-// call this and update every time a new Job is added with with one of our
-// DepGroups() in its *Job.DepGroups. It will only return keys for jobs that
-// are incomplete (they could have been Archive()d in the past if they are now
-// being re-run).
-func (d Dependencies) incompleteJobKeys(db *db) ([]string, error) {
+// incompleteJobKeys converts the constituent Dependency structs in to
+// queue.Dependency structs with the internal job keys that uniquely identify
+// the jobs we are dependent upon. Note that if you have dependencies that are
+// specified with DepGroups, then you should re-call this and update every time
+// a new Job is added with with one of our DepGroups() in its *Job.DepGroups. It
+// will only return keys for jobs that are incomplete (they could have been
+// Archive()d in the past if they are now being re-run).
+func (d Dependencies) incompleteJobKeys(db *db) ([]queue.Dependency, error) {
 	// we initially store in a map to avoid duplicates
-	jobKeys := make(map[string]bool)
+	jobKeys := make(map[queue.Dependency]bool)
 	for _, dep := range d {
 		keys, err := dep.incompleteJobKeys(db)
 		if err != nil {
-			return []string{}, err
+			return []queue.Dependency{}, err
 		}
 		for _, key := range keys {
 			jobKeys[key] = true
 		}
 	}
 
-	keys := make([]string, len(jobKeys))
+	keys := make([]queue.Dependency, len(jobKeys))
 	i := 0
 	for key := range jobKeys {
 		keys[i] = key
@@ -55,6 +142,27 @@ func (d Dependencies) incompleteJobKeys(db *db) ([]string, error) {
 	return keys, nil
 }
 
+// completeJobKeys returns the keys of the jobs that our DepModeFailure
+// Dependency structs refer to that have already completed, so that those
+// dependencies can never be satisfied.
+func (d Dependencies) completeJobKeys(db *db) ([]string, error) {
+	jobKeys := make(map[string]bool)
+	var keys []string
+	for _, dep := range d {
+		depKeys, err := dep.completeJobKeys(db)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range depKeys {
+			if !jobKeys[key] {
+				jobKeys[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
 // DepGroups returns all the DepGroups of our constituent Dependency structs.
 func (d Dependencies) DepGroups() []string {
 	var depGroups []string
@@ -67,25 +175,54 @@ func (d Dependencies) DepGroups() []string {
 }
 
 // Stringify converts our constituent Dependency structs in to a slice of
-// strings, each of which could be JobEssence or DepGroup based.
+// strings, each of which could be JobEssence or DepGroup based. Dependencies
+// with a Mode other than DepModeSuccess are suffixed with ":mode".
 func (d Dependencies) Stringify() []string {
-	var strings []string
+	var strs []string
 	for _, dep := range d {
+		var str string
 		if dep.DepGroup != "" {
-			strings = append(strings, dep.DepGroup)
+			str = dep.DepGroup
 		} else if dep.Essence != nil {
-			strings = append(strings, dep.Essence.Stringify())
+			str = dep.Essence.Stringify()
+		} else {
+			continue
 		}
+
+		if mode := dep.mode(); mode != DepModeSuccess {
+			str += depModeSeparator + string(mode)
+		}
+		strs = append(strs, str)
 	}
-	return strings
+	return strs
 }
 
 // Dependency is a struct that describes a Job purely in terms of a JobEssence,
 // or in terms of a Job's DepGroup, for use in Dependencies. If DepGroup is
-// specified, then Essence is ignored.
+// specified, then Essence is ignored. Mode defaults to DepModeSuccess.
 type Dependency struct {
 	Essence  *JobEssence
 	DepGroup string
+	Mode     DependencyMode
+}
+
+// mode returns our Mode, treating blank as DepModeSuccess.
+func (d *Dependency) mode() DependencyMode {
+	if d.Mode == "" {
+		return DepModeSuccess
+	}
+	return d.Mode
+}
+
+// condition returns the queue.DependencyCondition corresponding to our Mode.
+func (d *Dependency) condition() queue.DependencyCondition {
+	switch d.mode() {
+	case DepModeFailure:
+		return queue.DependencyOnBury
+	case DepModeAny:
+		return queue.DependencyOnRemovalOrBury
+	}
+	return queue.DependencyOnRemoval
 }
 
 // incompleteJobKeys calculates the job keys that this dependency refers to. For
@@ -93,23 +230,73 @@ type Dependency struct {
 // same key you'd get from *Job.key() on a Job made with the same essence.
 // For a Dependency made with a DepGroup, you will get the *Job.key()s of all
 // the jobs in the queue and database that have that DepGroup in their
-// DepGroups. You will only get keys for jobs that are currently in the queue.
-func (d *Dependency) incompleteJobKeys(db *db) ([]string, error) {
+// DepGroups. You will only get keys for jobs that are currently in the queue,
+// except for DepModeFailure, where you also get the keys of jobs that have
+// already completed (see completeJobKeys()), so that a Job with this dependency
+// stays dependent. The keys are returned in queue.Dependency structs with the
+// queue.DependencyCondition corresponding to our Mode.
+func (d *Dependency) incompleteJobKeys(db *db) ([]queue.Dependency, error) {
+	var keys []string
 	if d.DepGroup != "" {
-		keys, err := db.retrieveIncompleteJobKeysByDepGroup(d.DepGroup)
-		return keys, err
-	}
-	if d.Essence != nil {
+		var err error
+		keys, err = db.retrieveIncompleteJobKeysByDepGroup(d.DepGroup)
+		if err != nil {
+			return nil, err
+		}
+	} else if d.Essence != nil {
 		jobKey := d.Essence.Key()
 		live, err := db.checkIfLive(jobKey)
 		if err != nil {
-			return []string{}, err
+			return nil, err
 		}
 		if live {
-			return []string{jobKey}, nil
+			keys = []string{jobKey}
 		}
 	}
-	return []string{}, nil
+
+	completeKeys, err := d.completeJobKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, completeKeys...)
+
+	condition := d.condition()
+	deps := make([]queue.Dependency, len(keys))
+	for i, key := range keys {
+		deps[i] = queue.Dependency{Key: key, Condition: condition}
+	}
+	return deps, nil
+}
+
+// completeJobKeys returns the keys of the jobs this dependency refers to that
+// have already completed successfully (and aren't being re-run), if our Mode is
+// DepModeFailure. Since completed jobs can never be buried, such a dependency
+// can never be satisfied. For other Modes, returns nil.
+func (d *Dependency) completeJobKeys(db *db) ([]string, error) {
+	if d.mode() != DepModeFailure {
+		return nil, nil
+	}
+
+	if d.DepGroup != "" {
+		return db.retrieveCompleteJobKeysByDepGroup(d.DepGroup)
+	}
+
+	if d.Essence == nil {
+		return nil, nil
+	}
+
+	jobKey := d.Essence.Key()
+	live, err := db.checkIfLive(jobKey)
+	if err != nil || live {
+		return nil, err
+	}
+
+	added, err := db.checkIfAdded(jobKey)
+	if err != nil || !added {
+		return nil, err
+	}
+
+	return []string{jobKey}, nil
 }
 
 // NewEssenceDependency makes it a little easier to make a new *Dependency based
@@ -128,3 +315,13 @@ func NewDepGroupDependency(depgroup string) *Dependency {
 		DepGroup: depgroup,
 	}
 }
+
+// NewConditionalDependency returns a copy of the given *Dependency (as made by
+// NewEssenceDependency() or NewDepGroupDependency()) with the given Mode.
+func NewConditionalDependency(dep *Dependency, mode DependencyMode) *Dependency {
+	return &Dependency{
+		Essence:  dep.Essence,
+		DepGroup: dep.DepGroup,
+		Mode:     mode,
+	}
+}
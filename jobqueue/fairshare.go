@@ -0,0 +1,242 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to fair-share policies, which
+// determine the order that Jobs of equal priority are run in, based on how
+// much of their share of resources their owners have recently used.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FairShareBy describes how Jobs are grouped in to fair-share accounts.
+type FairShareBy string
+
+// FairShareBy* constants are the possible ways of grouping Jobs in to
+// fair-share accounts: by their Owner, or by the first part of their RepGroup
+// (up to the first dot).
+const (
+	FairShareByOwner    FairShareBy = "owner"
+	FairShareByRepGroup FairShareBy = "repgroup"
+)
+
+// fairShareDefaultHalfLife is the HalfLife of a FairSharePolicy if not
+// specified.
+const fairShareDefaultHalfLife = 7 * 24 * time.Hour
+
+// FairSharePolicy describes how the server should share out resources between
+// accounts. Each account's usage is the CPU time used by its Jobs plus their
+// peak RAM in GB multiplied by their wall time in seconds, decayed over time.
+type FairSharePolicy struct {
+	// By determines what account a Job belongs to.
+	By FairShareBy
+
+	// HalfLife is how long it takes for past usage to count half as much.
+	HalfLife time.Duration
+
+	// Shares are the relative shares of resources each account is entitled
+	// to. Accounts not listed have a share of 1.
+	Shares map[string]float64
+}
+
+// ParseFairSharePolicy parses a string specification of a fair-share policy,
+// in the form "by|halflife|account=share,account2=share2", where by is "owner"
+// or "repgroup", halflife is a duration like "24h" or a number of days like
+// "7d" (defaulting to 7d), and the shares (each a positive number) are
+// optional, returning the corresponding FairSharePolicy. A blank spec returns
+// nil, meaning no fair-share.
+func ParseFairSharePolicy(spec string) (*FairSharePolicy, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	parts := strings.Split(spec, "|")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("fair-share policy '%s' has too many parts", spec)
+	}
+
+	policy := &FairSharePolicy{
+		By:       FairShareBy(strings.TrimSpace(parts[0])),
+		HalfLife: fairShareDefaultHalfLife,
+		Shares:   make(map[string]float64),
+	}
+
+	switch policy.By {
+	case FairShareByOwner, FairShareByRepGroup:
+	default:
+		return nil, fmt.Errorf("fair-share policy '%s' must be by %s or %s", spec, FairShareByOwner, FairShareByRepGroup)
+	}
+
+	if len(parts) > 1 && strings.TrimSpace(parts[1]) != "" {
+		halfLife, err := parseRetentionAge(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("fair-share policy '%s' has a bad half-life: %w", spec, err)
+		}
+		policy.HalfLife = halfLife
+	}
+
+	if len(parts) > 2 {
+		for _, shareSpec := range strings.Split(parts[2], ",") {
+			shareSpec = strings.TrimSpace(shareSpec)
+			if shareSpec == "" {
+				continue
+			}
+
+			account, share, found := strings.Cut(shareSpec, "=")
+			if !found || account == "" {
+				return nil, fmt.Errorf("fair-share policy '%s' has a bad share '%s'", spec, shareSpec)
+			}
+
+			n, err := strconv.ParseFloat(share, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("fair-share policy '%s' has a bad share '%s'", spec, shareSpec)
+			}
+			policy.Shares[account] = n
+		}
+	}
+
+	return policy, nil
+}
+
+// account returns the fair-share account the given Job belongs to.
+func (p *FairSharePolicy) account(job *Job) string {
+	job.RLock()
+	defer job.RUnlock()
+
+	if p.By == FairShareByOwner {
+		return job.Owner
+	}
+
+	account, _, _ := strings.Cut(job.RepGroup, ".")
+	return account
+}
+
+// share returns the share of the given account.
+func (p *FairSharePolicy) share(account string) float64 {
+	if share, exists := p.Shares[account]; exists {
+		return share
+	}
+	return 1
+}
+
+// decay returns the given usage decayed over the given amount of time.
+func (p *FairSharePolicy) decay(usage float64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return usage
+	}
+	return usage * math.Pow(0.5, elapsed.Seconds()/p.HalfLife.Seconds())
+}
+
+// exitedJobUsage returns the resources the given Job used during its most
+// recent attempt, as CPU seconds plus GB·seconds of RAM. Returns 0 if the Job
+// has not exited.
+func exitedJobUsage(job *Job) float64 {
+	job.RLock()
+	defer job.RUnlock()
+
+	if !job.Exited || job.StartTime.IsZero() || job.EndTime.Before(job.StartTime) {
+		return 0
+	}
+
+	wall := job.EndTime.Sub(job.StartTime).Seconds()
+	return job.CPUtime.Seconds() + wall*float64(job.PeakRAM)/1024
+}
+
+// runningJobUsage is like exitedJobUsage(), but for a Job that is still
+// running as of the given time, using its reserved cores and RAM, since its
+// actual usage is not yet known.
+func runningJobUsage(job *Job, now time.Time) float64 {
+	job.RLock()
+	defer job.RUnlock()
+
+	if job.StartTime.IsZero() || job.Requirements == nil {
+		return 0
+	}
+
+	elapsed := now.Sub(job.StartTime).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return elapsed*job.Requirements.Cores + elapsed*float64(job.Requirements.RAM)/1024
+}
+
+// fairShareFactors calculates the fair-share factor for each of the given
+// accounts, based on their usage: the factor is 2^-(u/s), where u is the
+// account's fraction of the total usage and s is its fraction of the total
+// shares of the given accounts. Factors are between 0 and 1, with accounts that
+// have used less than their share having higher factors.
+func (p *FairSharePolicy) fairShareFactors(usage map[string]float64, accounts []string) map[string]float64 {
+	var totalUsage, totalShares float64
+	for _, account := range accounts {
+		totalUsage += usage[account]
+		totalShares += p.share(account)
+	}
+
+	factors := make(map[string]float64, len(accounts))
+	for _, account := range accounts {
+		if totalUsage == 0 {
+			factors[account] = 1
+			continue
+		}
+		u := usage[account] / totalUsage
+		s := p.share(account) / totalShares
+		factors[account] = math.Pow(2, -u/s)
+	}
+
+	return factors
+}
+
+// fairSharePriority combines a Job priority with a fair-share factor in to a
+// single priority, giving equal weight to each.
+func fairSharePriority(priority uint8, factor float64) uint8 {
+	return uint8(math.Round((float64(priority) + factor*math.MaxUint8) / 2))
+}
+
+// FairShareAccount describes the current fair-share state of an account.
+type FairShareAccount struct {
+	// Name is the Owner or RepGroup prefix of the account.
+	Name string
+
+	// Share is the account's fraction of the total shares of all the
+	// accounts.
+	Share float64
+
+	// Usage is the account's decayed usage, in CPU seconds plus GB·seconds
+	// of RAM, including the usage so far of its running Jobs.
+	Usage float64
+
+	// UsageFraction is the account's fraction of the total usage of all the
+	// accounts.
+	UsageFraction float64
+
+	// Factor is the account's fair-share factor: amongst Jobs of equal
+	// priority, those of the account with the highest factor run first.
+	Factor float64
+
+	// Ready and Running are the number of the account's Jobs in those
+	// states.
+	Ready   int
+	Running int
+}
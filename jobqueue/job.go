@@ -160,6 +160,17 @@ type Job struct {
 	// duration and fails, it will instead be immediately buried.
 	NoRetriesOverWalltime time.Duration
 
+	// RetryPolicy, if set, controls how long to wait before each retry, which
+	// exit codes should not be retried, and if retries should be on a
+	// different host. If nil, retries happen after an exponential backoff
+	// from ClientReleaseDelayMin to ClientReleaseDelayMax.
+	RetryPolicy *RetryPolicy
+
+	// Checkpoint, if set, says where Cmd saves its state when asked to, so
+	// that if it has to be stopped before it completes, the next attempt can
+	// resume from where it left off.
+	Checkpoint *Checkpoint
+
 	// LimitGroups are names of limit groups that this job belongs to. If any
 	// of these groups are defined (elsewhere) to have a limit, then if as many
 	// other jobs as the limit are currently running, this job will not start
@@ -170,10 +181,16 @@ type Job struct {
 	// can refer to in their Dependencies.
 	DepGroups []string
 
-	// Dependencies describe the jobs that must be complete before this job
-	// starts.
+	// Dependencies describe the jobs that must be complete (or buried,
+	// depending on the Mode of each Dependency) before this job starts.
 	Dependencies Dependencies
 
+	// OnDepFailure describes what should happen to this job if one of its
+	// Dependencies can never be satisfied, eg. because a job it has a
+	// DepModeSuccess dependency on gets buried. The default is to remain
+	// dependent, in case the buried job is fixed and retried.
+	OnDepFailure DepFailureAction
+
 	// Behaviours describe what should happen after Cmd is executed, depending
 	// on its success.
 	Behaviours Behaviours
@@ -243,6 +260,16 @@ type Job struct {
 	// inside paths in the cmd returned by CmdLine().
 	ContainerMounts string
 
+	// Array, if set when Add()ing a Job, turns this Job in to a template for a
+	// job array: instead of this Job being added, the server adds a Job for
+	// every combination of parameter values described by Array, with {name}
+	// placeholders in Cmd replaced by the values of the parameters with those
+	// names. Only ServerArrayWindow of these Jobs are in the queue at once,
+	// the rest being added as earlier ones leave it. When run, these Jobs will
+	// have the environment variables WR_ARRAY_ID and WR_ARRAY_INDEX set to
+	// their ArrayID and ArrayIndex.
+	Array *JobArray
+
 	// The remaining properties are used to record information about what
 	// happened when Cmd was executed, or otherwise provide its current state.
 	// It is meaningless to set these yourself.
@@ -304,6 +331,10 @@ type Job struct {
 	// permission to do other stuff to this Job; the server only ever sets this
 	// on Reserve(), so clients can't cheat by changing this on their end.
 	ReservedBy uuid.UUID
+	// name of the User that added the job, as identified by the token they
+	// connected with; the server sets this on Add(), so clients can't claim to
+	// be someone else. Non-admin Users can only change the jobs they own.
+	Owner string
 	// on the server we don't store EnvC with the job, but look it up in db via
 	// this key.
 	EnvKey string
@@ -317,6 +348,19 @@ type Job struct {
 	BsubID uint64
 	// delay is the duration we would next spend in the delay queue
 	DelayTime time.Duration
+	// for Jobs created from a job array, the id of the array (shared by all of
+	// its elements), the index of this Job in the array and the number of Jobs
+	// in the array.
+	ArrayID    string
+	ArrayIndex int
+	ArraySize  int
+	// paths (relative to ActualCwd) of files that were copied to the server
+	// by a CopyToManager behaviour; get their content with
+	// Client.GetCopiedFile().
+	CopiedFiles []string
+	// CheckpointSaved is true if a previous attempt at running the Job stored
+	// its Checkpoint Dir on the server, to be restored before the next attempt.
+	CheckpointSaved bool
 
 	// we add this internally to match up runners we spawn via the scheduler to
 	// the Jobs they're allowed to ReserveFiltered().
@@ -326,6 +370,10 @@ type Job struct {
 	// later; this is purely client side.
 	mountedFS []*muxfys.MuxFys
 
+	// client is set during Client.Execute(), so that CopyToManager behaviours
+	// can send files to the server; this is purely client side.
+	client *Client
+
 	// killCalled is set for running jobs if Kill() is called on them.
 	killCalled bool
 
@@ -856,9 +904,24 @@ func (j *Job) Key() string {
 		concat = fmt.Sprintf("%s.%s.%s", concat, image, j.ContainerMounts)
 	}
 
+	if j.ArrayID != "" {
+		concat = fmt.Sprintf("%s.array:%s:%d", concat, j.ArrayID, j.ArrayIndex)
+	}
+
 	return byteKey([]byte(concat))
 }
 
+// validateDepGroups checks that our DepGroups and those of our Dependencies
+// are valid.
+func (j *Job) validateDepGroups() error {
+	j.RLock()
+	defer j.RUnlock()
+	if err := validateDepGroups(j.DepGroups); err != nil {
+		return err
+	}
+	return validateDepGroups(j.Dependencies.DepGroups())
+}
+
 // generateSchedulerGroup returns a stringified form of the given requirements,
 // appended with a standard form of the current limit groups of this job. We
 // assume that LimitGroups was sorted and deduplicated when it was set on the
@@ -871,6 +934,19 @@ func (j *Job) generateSchedulerGroup(req *scheduler.Requirements) string {
 	return req.Stringify() + lgs
 }
 
+// noteCopiedFile records that a file with the given path (relative to
+// ActualCwd) was copied to the server by a CopyToManager behaviour.
+func (j *Job) noteCopiedFile(relPath string) {
+	j.Lock()
+	defer j.Unlock()
+	for _, path := range j.CopiedFiles {
+		if path == relPath {
+			return
+		}
+	}
+	j.CopiedFiles = append(j.CopiedFiles, relPath)
+}
+
 // getSchedulerGroup provides a thread-safe way of getting the schedulerGroup
 // property of a Job.
 func (j *Job) getSchedulerGroup() string {
@@ -923,6 +999,10 @@ func (j *Job) ToStatus() (JStatus, error) {
 	js := JStatus{
 		Key:             j.Key(),
 		RepGroup:        j.RepGroup,
+		Owner:           j.Owner,
+		ArrayID:         j.ArrayID,
+		ArrayIndex:      j.ArrayIndex,
+		ArraySize:       j.ArraySize,
 		LimitGroups:     j.LimitGroups,
 		DepGroups:       j.DepGroups,
 		Dependencies:    j.Dependencies.Stringify(),
@@ -932,6 +1012,7 @@ func (j *Job) ToStatus() (JStatus, error) {
 		Cwd:             cwdLeaf,
 		HomeChanged:     j.ChangeHome,
 		Behaviours:      j.Behaviours.String(),
+		CopiedFiles:     j.CopiedFiles,
 		Mounts:          j.MountConfigs.String(),
 		MonitorDocker:   j.MonitorDocker,
 		WithDocker:      j.WithDocker,
@@ -940,6 +1021,7 @@ func (j *Job) ToStatus() (JStatus, error) {
 		ExpectedRAM:     j.Requirements.RAM,
 		ExpectedTime:    j.Requirements.Time.Seconds(),
 		RequestedDisk:   j.Requirements.Disk,
+		Resources:       scheduler.ResourcesString(j.Requirements.Resources),
 		OtherRequests:   ot,
 		Cores:           j.Requirements.Cores,
 		PeakRAM:         j.PeakRAM,
@@ -1051,6 +1133,8 @@ type JobModifier struct {
 	RetriesSet               bool
 	NoRetriesOverWalltime    time.Duration
 	NoRetriesOverWalltimeSet bool
+	RetryPolicy              *RetryPolicy
+	RetryPolicySet           bool
 	EnvOverrideSet           bool
 	LimitGroupsSet           bool
 	DepGroupsSet             bool
@@ -1104,8 +1188,8 @@ func (j *JobModifier) SetReqGroup(new string) {
 // SetRequirements notes that you want to modify the Requirements of Jobs. You
 // can't modify to a nil Requirements, so if req is nil, no set is done.
 //
-// NB: If you want to change Cores, Disk or Other, you must set CoresSet,
-// DiskSet and OtherSet booleans to true, respectively.
+// NB: If you want to change Cores, Disk, Other or Resources, you must set
+// CoresSet, DiskSet, OtherSet and ResourcesSet booleans to true, respectively.
 func (j *JobModifier) SetRequirements(req *scheduler.Requirements) {
 	j.Requirements = req
 }
@@ -1135,6 +1219,13 @@ func (j *JobModifier) SetNoRetriesOverWalltime(new time.Duration) {
 	j.NoRetriesOverWalltimeSet = true
 }
 
+// SetRetryPolicy notes that you want to modify the RetryPolicy of Jobs. A nil
+// policy restores the default retry behaviour.
+func (j *JobModifier) SetRetryPolicy(new *RetryPolicy) {
+	j.RetryPolicy = new
+	j.RetryPolicySet = true
+}
+
 // SetEnvOverride notes that you want to modify the EnvOverride of Jobs. The
 // supplied string should be a comma separated list of key=value pairs. This can
 // generate an error if compression of the data fails.
@@ -1239,6 +1330,8 @@ func (j *JobModifier) Modify(jobs []*Job, server *Server) (map[string]string, er
 			WithDocker:      job.WithDocker,
 			WithSingularity: job.WithSingularity,
 			ContainerMounts: job.ContainerMounts,
+			ArrayID:         job.ArrayID,
+			ArrayIndex:      job.ArrayIndex,
 		}
 		if j.Cmd != "" {
 			new.Cmd = j.Cmd
@@ -1315,6 +1408,9 @@ func (j *JobModifier) Modify(jobs []*Job, server *Server) (map[string]string, er
 			if j.Requirements.OtherSet {
 				job.Requirements.Other = j.Requirements.Other
 			}
+			if j.Requirements.ResourcesSet {
+				job.Requirements.Resources = j.Requirements.Resources
+			}
 		}
 		if j.OverrideSet {
 			job.Override = j.Override
@@ -1328,6 +1424,9 @@ func (j *JobModifier) Modify(jobs []*Job, server *Server) (map[string]string, er
 		if j.NoRetriesOverWalltimeSet {
 			job.NoRetriesOverWalltime = j.NoRetriesOverWalltime
 		}
+		if j.RetryPolicySet {
+			job.RetryPolicy = j.RetryPolicy
+		}
 		if j.EnvOverrideSet {
 			job.EnvOverride = j.EnvOverride
 		}
@@ -32,6 +32,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -44,6 +45,7 @@ import (
 	"github.com/VertebrateResequencing/wr/cloud"
 	"github.com/VertebrateResequencing/wr/internal"
 	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/gofrs/uuid"
 	"github.com/shirou/gopsutil/process"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -240,6 +242,746 @@ func TestJobqueueUtils(t *testing.T) {
 		So(d, ShouldBeGreaterThanOrEqualTo, 30*time.Second)
 		So(d, ShouldBeLessThan, 60*time.Second)
 	})
+
+	Convey("ParseCronSchedule works", t, func() {
+		// a Wednesday
+		from := time.Date(2020, 7, 1, 12, 30, 45, 0, time.UTC)
+
+		cs, err := ParseCronSchedule("* * * * *")
+		So(err, ShouldBeNil)
+		So(cs.Next(from), ShouldEqual, time.Date(2020, 7, 1, 12, 31, 0, 0, time.UTC))
+
+		cs, err = ParseCronSchedule("*/15 2 * * *")
+		So(err, ShouldBeNil)
+		So(cs.Next(from), ShouldEqual, time.Date(2020, 7, 2, 2, 0, 0, 0, time.UTC))
+		So(cs.Next(time.Date(2020, 7, 2, 2, 0, 0, 0, time.UTC)), ShouldEqual, time.Date(2020, 7, 2, 2, 15, 0, 0, time.UTC))
+
+		cs, err = ParseCronSchedule("30 2 * * mon-fri")
+		So(err, ShouldBeNil)
+		So(cs.Next(time.Date(2020, 7, 3, 3, 0, 0, 0, time.UTC)), ShouldEqual, time.Date(2020, 7, 6, 2, 30, 0, 0, time.UTC))
+
+		cs, err = ParseCronSchedule("0 0 1,15 feb 7")
+		So(err, ShouldBeNil)
+		So(cs.Next(from), ShouldEqual, time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC))
+		So(cs.Next(time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)), ShouldEqual, time.Date(2021, 2, 7, 0, 0, 0, 0, time.UTC))
+
+		cs, err = ParseCronSchedule("@monthly")
+		So(err, ShouldBeNil)
+		So(cs.Next(from), ShouldEqual, time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC))
+		So(cs.String(), ShouldEqual, "@monthly")
+
+		for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *", "0 0 30 2 *"} {
+			_, err = ParseCronSchedule(bad)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("ParseRetentionPolicies works", t, func() {
+		policies, err := ParseRetentionPolicies("^scratch\\.|1d; 12h")
+		So(err, ShouldBeNil)
+		So(len(policies), ShouldEqual, 2)
+		So(policies[0].RepGroup.String(), ShouldEqual, "^scratch\\.")
+		So(policies[0].MaxAge, ShouldEqual, 24*time.Hour)
+		So(policies[1].RepGroup, ShouldBeNil)
+		So(policies[1].MaxAge, ShouldEqual, 12*time.Hour)
+
+		maxAge, matched := retentionMaxAge(policies, "scratch.foo")
+		So(matched, ShouldBeTrue)
+		So(maxAge, ShouldEqual, 24*time.Hour)
+		maxAge, matched = retentionMaxAge(policies, "scratchfoo")
+		So(matched, ShouldBeTrue)
+		So(maxAge, ShouldEqual, 12*time.Hour)
+		_, matched = retentionMaxAge(policies[:1], "foo")
+		So(matched, ShouldBeFalse)
+
+		policies, err = ParseRetentionPolicies("")
+		So(err, ShouldBeNil)
+		So(len(policies), ShouldEqual, 0)
+
+		for _, bad := range []string{"foo", "1x", "0d", "-1h", "(|1d"} {
+			_, err = ParseRetentionPolicies(bad)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("ParseRetryPolicy works", t, func() {
+		policy, err := ParseRetryPolicy("backoff=1m; max=1h;factor=3;jitter=0.25;no_retry=127,2;different_host")
+		So(err, ShouldBeNil)
+		So(policy.Backoff, ShouldEqual, time.Minute)
+		So(policy.MaxBackoff, ShouldEqual, time.Hour)
+		So(policy.Factor, ShouldEqual, 3)
+		So(policy.Jitter, ShouldEqual, 0.25)
+		So(policy.NoRetryExitCodes, ShouldResemble, []int{2, 127})
+		So(policy.DifferentHost, ShouldBeTrue)
+		So(policy.String(), ShouldEqual, "backoff=1m0s;max=1h0m0s;factor=3;jitter=0.25;no_retry=2,127;different_host")
+		So(policy.noRetry(127), ShouldBeTrue)
+		So(policy.noRetry(1), ShouldBeFalse)
+
+		for i, expected := range []time.Duration{time.Minute, 3 * time.Minute, 9 * time.Minute, 27 * time.Minute, time.Hour} {
+			d := policy.delay(i)
+			So(d, ShouldBeGreaterThanOrEqualTo, time.Duration(float64(expected)*0.75))
+			So(d, ShouldBeLessThanOrEqualTo, time.Duration(float64(expected)*1.25))
+			So(d, ShouldBeLessThanOrEqualTo, time.Hour)
+		}
+
+		policy, err = ParseRetryPolicy("no_retry=2")
+		So(err, ShouldBeNil)
+		So(policy.delay(0), ShouldEqual, ClientReleaseDelayMin)
+		So(policy.delay(100), ShouldEqual, ClientReleaseDelayMax)
+		So(policy.DifferentHost, ShouldBeFalse)
+
+		var nilPolicy *RetryPolicy
+		So(nilPolicy.noRetry(2), ShouldBeFalse)
+		So(nilPolicy.String(), ShouldBeBlank)
+
+		policy, err = ParseRetryPolicy("")
+		So(err, ShouldBeNil)
+		So(policy, ShouldBeNil)
+
+		for _, bad := range []string{"foo", "backoff=1x", "backoff=0s", "factor=0.5", "jitter=2", "no_retry=256", "no_retry=", "different_host=maybe", "backoff=1h;max=1m"} {
+			_, err = ParseRetryPolicy(bad)
+			So(err, ShouldNotBeNil)
+		}
+
+		req := &jqs.Requirements{RAM: 1, Other: map[string]string{"foo": "bar"}}
+		avoided := avoidHost(req, "hostB")
+		So(avoided.Other, ShouldResemble, map[string]string{"foo": "bar", jqs.AvoidHostsKey: "hostB"})
+		So(req.Other[jqs.AvoidHostsKey], ShouldBeBlank)
+		avoided = avoidHost(avoided, "hostA")
+		So(avoided.Other[jqs.AvoidHostsKey], ShouldEqual, "hostA,hostB")
+		So(avoidHost(avoided, "hostA"), ShouldBeNil)
+	})
+
+	Convey("Cgroups can be set up and read", t, func() {
+		parent, err := os.MkdirTemp("", "wr_jobqueue_cgroup_test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(parent)
+
+		err = checkCgroupParent(parent)
+		So(err, ShouldNotBeNil)
+
+		controllersFile := filepath.Join(parent, cgroupControllersFile)
+		err = os.WriteFile(controllersFile, []byte("cpuset io pids\n"), 0o600)
+		So(err, ShouldBeNil)
+		err = checkCgroupParent(parent)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "memory controller")
+
+		err = os.WriteFile(controllersFile, []byte("cpuset cpu io memory pids\n"), 0o600)
+		So(err, ShouldBeNil)
+		err = checkCgroupParent(parent)
+		So(err, ShouldBeNil)
+		content, err := os.ReadFile(filepath.Join(parent, cgroupSubtreeFile))
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "+memory +cpu")
+
+		child := filepath.Join(parent, "wr-test")
+		err = os.Mkdir(child, 0o700)
+		So(err, ShouldBeNil)
+		err = os.WriteFile(filepath.Join(child, cgroupSwapMaxFile), []byte("max\n"), 0o600)
+		So(err, ShouldBeNil)
+		err = os.WriteFile(filepath.Join(child, cgroupCPUMaxFile), []byte("max 100000\n"), 0o600)
+		So(err, ShouldBeNil)
+
+		cg, err := newCgroup(parent, "wr-test", &jqs.Requirements{RAM: 100, Cores: 1.5})
+		So(err, ShouldBeNil)
+		So(cg.path, ShouldEqual, child)
+
+		readChild := func(file string) string {
+			b, errr := os.ReadFile(filepath.Join(child, file))
+			So(errr, ShouldBeNil)
+			return string(b)
+		}
+		So(readChild(cgroupMemMaxFile), ShouldEqual, "104857600")
+		So(readChild(cgroupSwapMaxFile), ShouldEqual, "0")
+		So(readChild(cgroupCPUMaxFile), ShouldEqual, "150000 100000")
+		So(cg.shellPrefix(), ShouldEqual, "echo $$ > '"+filepath.Join(child, cgroupProcsFile)+"' || exit 1; ")
+
+		_, err = cg.peakMemory()
+		So(err, ShouldNotBeNil)
+		err = os.WriteFile(filepath.Join(child, cgroupMemCurrentFile), []byte("52428800\n"), 0o600)
+		So(err, ShouldBeNil)
+		mem, err := cg.peakMemory()
+		So(err, ShouldBeNil)
+		So(mem, ShouldEqual, 50)
+		err = os.WriteFile(filepath.Join(child, cgroupMemPeakFile), []byte("209715200\n"), 0o600)
+		So(err, ShouldBeNil)
+		mem, err = cg.peakMemory()
+		So(err, ShouldBeNil)
+		So(mem, ShouldEqual, 200)
+		mem, err = cg.memory()
+		So(err, ShouldBeNil)
+		So(mem, ShouldEqual, 50)
+
+		So(cg.oomKilled(), ShouldBeFalse)
+		eventsFile := filepath.Join(child, cgroupMemEventsFile)
+		err = os.WriteFile(eventsFile, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n"), 0o600)
+		So(err, ShouldBeNil)
+		So(cg.oomKilled(), ShouldBeFalse)
+		err = os.WriteFile(eventsFile, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0o600)
+		So(err, ShouldBeNil)
+		So(cg.oomKilled(), ShouldBeTrue)
+
+		for _, file := range []string{cgroupMemMaxFile, cgroupSwapMaxFile, cgroupCPUMaxFile, cgroupMemCurrentFile, cgroupMemPeakFile, cgroupMemEventsFile} {
+			err = os.Remove(filepath.Join(child, file))
+			So(err, ShouldBeNil)
+		}
+		err = cg.remove()
+		So(err, ShouldBeNil)
+		_, err = os.Stat(child)
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		cg, err = newCgroup(parent, "wr-test2", &jqs.Requirements{})
+		So(err, ShouldBeNil)
+		_, err = os.Stat(filepath.Join(cg.path, cgroupMemMaxFile))
+		So(os.IsNotExist(err), ShouldBeTrue)
+		err = cg.remove()
+		So(err, ShouldBeNil)
+	})
+
+	Convey("ParseCheckpoint works", t, func() {
+		cp, err := ParseCheckpoint("dir=./state/ckpt/; signal=SIGUSR1;grace=5m")
+		So(err, ShouldBeNil)
+		So(cp.Dir, ShouldEqual, "state/ckpt")
+		So(cp.Signal, ShouldEqual, syscall.SIGUSR1)
+		So(cp.Grace, ShouldEqual, 5*time.Minute)
+		So(cp.String(), ShouldEqual, "dir=state/ckpt;signal=USR1;grace=5m0s")
+
+		cp2, err := ParseCheckpoint(cp.String())
+		So(err, ShouldBeNil)
+		So(cp2, ShouldResemble, cp)
+
+		cp, err = ParseCheckpoint("dir=ckpt")
+		So(err, ShouldBeNil)
+		So(cp.Signal, ShouldEqual, syscall.SIGTERM)
+		So(cp.Grace, ShouldEqual, checkpointDefaultGrace)
+
+		cp, err = ParseCheckpoint(" ")
+		So(err, ShouldBeNil)
+		So(cp, ShouldBeNil)
+
+		for _, bad := range []string{"signal=USR1", "dir=/abs", "dir=../up", "dir=.", "dir=ckpt;signal=KILL", "dir=ckpt;grace=-1s", "dir=ckpt;foo=bar"} {
+			_, err = ParseCheckpoint(bad)
+			So(err, ShouldNotBeNil)
+		}
+
+		Convey("Checkpoint dirs can be archived and restored", func() {
+			src, err := os.MkdirTemp("", "wr_jobqueue_checkpoint_src")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(src)
+			dst, err := os.MkdirTemp("", "wr_jobqueue_checkpoint_dst")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dst)
+
+			err = os.MkdirAll(filepath.Join(src, "sub", "empty"), 0o700)
+			So(err, ShouldBeNil)
+			err = os.WriteFile(filepath.Join(src, "a"), []byte("a content"), 0o600)
+			So(err, ShouldBeNil)
+			err = os.WriteFile(filepath.Join(src, "sub", "b"), []byte("b content"), 0o640)
+			So(err, ShouldBeNil)
+			err = os.Symlink("sub/b", filepath.Join(src, "link"))
+			So(err, ShouldBeNil)
+
+			archive, err := tarDir(src)
+			So(err, ShouldBeNil)
+
+			restored := filepath.Join(dst, "ckpt")
+			err = untarDir(archive, restored)
+			So(err, ShouldBeNil)
+
+			content, err := os.ReadFile(filepath.Join(restored, "a"))
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "a content")
+			content, err = os.ReadFile(filepath.Join(restored, "link"))
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "b content")
+			info, err := os.Stat(filepath.Join(restored, "sub", "b"))
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0o640))
+			info, err = os.Stat(filepath.Join(restored, "sub", "empty"))
+			So(err, ShouldBeNil)
+			So(info.IsDir(), ShouldBeTrue)
+
+			err = untarDir([]byte("junk"), restored)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("You can tell if a checkpoint is in a writable mount", func() {
+			job := &Job{Cwd: "/cwd", ActualCwd: "/cwd/a/b", Checkpoint: &Checkpoint{Dir: "out/ckpt"}}
+			So(job.checkpointPath(), ShouldEqual, "/cwd/a/b/out/ckpt")
+			So(job.checkpointInWritableMount(), ShouldBeFalse)
+
+			job.MountConfigs = MountConfigs{{Mount: "out", Targets: []MountTarget{{Path: "bucket"}}}}
+			So(job.checkpointInWritableMount(), ShouldBeFalse)
+
+			job.MountConfigs[0].Targets = append(job.MountConfigs[0].Targets, MountTarget{Path: "bucket2", Write: true})
+			So(job.checkpointInWritableMount(), ShouldBeTrue)
+
+			job.MountConfigs[0].Mount = "other"
+			So(job.checkpointInWritableMount(), ShouldBeFalse)
+
+			job.MountConfigs[0].Mount = ""
+			So(job.checkpointInWritableMount(), ShouldBeTrue)
+
+			job.ActualCwd = ""
+			So(job.checkpointPath(), ShouldEqual, "/cwd/out/ckpt")
+			So(job.checkpointInWritableMount(), ShouldBeFalse)
+
+			job.Checkpoint.Dir = "mnt/ckpt"
+			So(job.checkpointInWritableMount(), ShouldBeTrue)
+
+			job.Checkpoint = nil
+			So(job.checkpointPath(), ShouldBeBlank)
+			So(job.checkpointInWritableMount(), ShouldBeFalse)
+		})
+	})
+
+	Convey("ParseFairSharePolicy works", t, func() {
+		policy, err := ParseFairSharePolicy("repgroup|1h|a=3, b=1")
+		So(err, ShouldBeNil)
+		So(policy.By, ShouldEqual, FairShareByRepGroup)
+		So(policy.HalfLife, ShouldEqual, time.Hour)
+		So(policy.share("a"), ShouldEqual, 3)
+		So(policy.share("b"), ShouldEqual, 1)
+		So(policy.share("c"), ShouldEqual, 1)
+		So(policy.account(&Job{RepGroup: "a.foo.bar", Owner: "bob"}), ShouldEqual, "a")
+		So(policy.decay(100, time.Hour), ShouldAlmostEqual, 50)
+		So(policy.decay(100, 2*time.Hour), ShouldAlmostEqual, 25)
+
+		factors := policy.fairShareFactors(map[string]float64{"a": 75, "b": 25}, []string{"a", "b"})
+		So(factors["a"], ShouldAlmostEqual, 0.5)
+		So(factors["b"], ShouldAlmostEqual, 0.5)
+
+		factors = policy.fairShareFactors(map[string]float64{"a": 75, "b": 25}, []string{"a", "b", "c"})
+		So(factors["a"], ShouldBeLessThan, 0.5)
+		So(factors["c"], ShouldEqual, 1)
+
+		factors = policy.fairShareFactors(map[string]float64{}, []string{"a", "b"})
+		So(factors["a"], ShouldEqual, 1)
+		So(factors["b"], ShouldEqual, 1)
+
+		So(fairSharePriority(255, 1), ShouldEqual, 255)
+		So(fairSharePriority(0, 0), ShouldEqual, 0)
+		So(fairSharePriority(100, 0.5), ShouldEqual, 114)
+
+		policy, err = ParseFairSharePolicy("owner")
+		So(err, ShouldBeNil)
+		So(policy.By, ShouldEqual, FairShareByOwner)
+		So(policy.HalfLife, ShouldEqual, fairShareDefaultHalfLife)
+		So(policy.account(&Job{RepGroup: "a.foo", Owner: "bob"}), ShouldEqual, "bob")
+
+		policy, err = ParseFairSharePolicy("")
+		So(err, ShouldBeNil)
+		So(policy, ShouldBeNil)
+
+		for _, bad := range []string{"foo", "owner|1x", "owner|1d|a", "owner|1d|a=0", "owner|1d|=1", "owner|1d|a=1|b"} {
+			_, err = ParseFairSharePolicy(bad)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Jobs can require named consumable resources", t, func() {
+		jd := &JobDefaults{Resources: map[string]int{"gpu": 1}}
+		job, err := (&JobViaJSON{Cmd: "foo"}).Convert(jd)
+		So(err, ShouldBeNil)
+		So(job.Requirements.Resources, ShouldResemble, map[string]int{"gpu": 1})
+		job.Requirements.Resources["gpu"] = 2
+		So(jd.Resources["gpu"], ShouldEqual, 1)
+
+		job, err = (&JobViaJSON{Cmd: "foo", Resources: "gpu=2,licence=1"}).Convert(jd)
+		So(err, ShouldBeNil)
+		So(job.Requirements.Resources, ShouldResemble, map[string]int{"gpu": 2, "licence": 1})
+		status, err := job.ToStatus()
+		So(err, ShouldBeNil)
+		So(status.Resources, ShouldEqual, "gpu=2,licence=1")
+
+		job, err = (&JobViaJSON{Cmd: "foo"}).Convert(&JobDefaults{})
+		So(err, ShouldBeNil)
+		So(job.Requirements.Resources, ShouldBeNil)
+
+		_, err = (&JobViaJSON{Cmd: "foo", Resources: "gpu=0"}).Convert(jd)
+		So(err, ShouldNotBeNil)
+
+		spec := "licence=1"
+		req, err := (&ModifierViaJSON{Resources: &spec}).requirements()
+		So(err, ShouldBeNil)
+		So(req.ResourcesSet, ShouldBeTrue)
+		So(req.Resources, ShouldResemble, map[string]int{"licence": 1})
+
+		spec = ""
+		req, err = (&ModifierViaJSON{Resources: &spec}).requirements()
+		So(err, ShouldBeNil)
+		So(req.ResourcesSet, ShouldBeTrue)
+		So(req.Resources, ShouldBeNil)
+	})
+
+	Convey("bsub options can be parsed and applied to jobs", t, func() {
+		opts := &BsubOptions{}
+		cmd, err := opts.Parse([]string{"-J", "myjob", "-n", "2,4", "-M", "4G", "-R", "select[mem>100] rusage[mem=2000]",
+			"-W", "1:30", "-q", "long", "-cwd", "sub", "-o", "out.%J.%I", "-w", "done(a) && ended(12)", "-P", "proj", "-K",
+			"echo", "-n", "hi"})
+		So(err, ShouldBeNil)
+		So(cmd, ShouldResemble, []string{"echo", "-n", "hi"})
+		So(opts.Name, ShouldEqual, "myjob")
+		So(opts.Array, ShouldBeNil)
+		So(opts.Cores, ShouldEqual, 2)
+		So(opts.MemLimit, ShouldEqual, 4096)
+		So(opts.MemReserve, ShouldEqual, 2000)
+		So(opts.Time, ShouldEqual, 90*time.Minute)
+		So(opts.Queue, ShouldEqual, "long")
+		So(opts.Wait, ShouldBeTrue)
+		So(len(opts.Dependencies), ShouldEqual, 2)
+
+		job := &Job{Cmd: "echo -n hi", Cwd: "/tmp", RepGroup: "bsub", Requirements: &jqs.Requirements{Cores: 1, RAM: 1000, Time: time.Hour}}
+		opts.Apply(job)
+		So(job.RepGroup, ShouldEqual, "myjob")
+		So(job.DepGroups, ShouldResemble, []string{BsubNameDepGroup("myjob")})
+		So(job.Requirements.Cores, ShouldEqual, 2)
+		So(job.Requirements.RAM, ShouldEqual, 4096)
+		So(job.Requirements.Time, ShouldEqual, 90*time.Minute)
+		So(job.Requirements.Other["scheduler_queue"], ShouldEqual, "long")
+		So(job.Override, ShouldEqual, 2)
+		So(job.Cwd, ShouldEqual, "/tmp/sub")
+		So(job.Dependencies.Stringify(), ShouldResemble, []string{"bsub.name.a", "bsub.id.12:any"})
+		So(job.Cmd, ShouldEqual, "exec >>\"out.${LSB_JOBID}.${LSB_JOBINDEX:-0}\" 2>&1\necho -n hi")
+
+		opts = &BsubOptions{}
+		_, err = opts.Parse([]string{"-oo", "o", "-e", "e", "-i", "in$"})
+		So(err, ShouldBeNil)
+		So(opts.cmdPrefix(), ShouldEqual, "exec <\"in\\$\"\nexec >\"o\"\nexec 2>>\"e\"\n")
+
+		Convey("Later options override earlier ones, and #BSUB lines are parsed", func() {
+			opts = &BsubOptions{}
+			isOpts, err := opts.ParseScriptLine(`#BSUB -J "first" -n 2`)
+			So(err, ShouldBeNil)
+			So(isOpts, ShouldBeTrue)
+			isOpts, err = opts.ParseScriptLine("#BSUB -n 3 # a comment")
+			So(err, ShouldBeNil)
+			So(isOpts, ShouldBeTrue)
+			isOpts, err = opts.ParseScriptLine("# not options")
+			So(err, ShouldBeNil)
+			So(isOpts, ShouldBeFalse)
+			isOpts, err = opts.ParseScriptLine("echo foo")
+			So(err, ShouldBeNil)
+			So(isOpts, ShouldBeFalse)
+			So(opts.Name, ShouldEqual, "first")
+			So(opts.Cores, ShouldEqual, 3)
+
+			_, err = opts.Parse([]string{"-J", "second"})
+			So(err, ShouldBeNil)
+			So(opts.Name, ShouldEqual, "second")
+			So(opts.Cores, ShouldEqual, 3)
+
+			_, err = opts.ParseScriptLine(`#BSUB -J "unterminated`)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Bad and unsupported options are rejected", func() {
+			_, err = (&BsubOptions{}).Parse([]string{"-Z", "foo"})
+			So(err, ShouldNotBeNil)
+			_, err = (&BsubOptions{}).Parse([]string{"-I", "foo"})
+			So(err, ShouldNotBeNil)
+			_, err = (&BsubOptions{}).Parse([]string{"-n"})
+			So(err, ShouldNotBeNil)
+			_, err = (&BsubOptions{}).Parse([]string{"-M", "lots"})
+			So(err, ShouldNotBeNil)
+			_, err = (&BsubOptions{}).Parse([]string{"-W", "1:xx"})
+			So(err, ShouldNotBeNil)
+			_, err = (&BsubOptions{}).Parse([]string{"-J", "a[0-3]"})
+			So(err, ShouldNotBeNil)
+			_, err = (&BsubOptions{}).Parse([]string{"-J", "a[x]"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Job arrays can be specified", func() {
+			opts = &BsubOptions{}
+			_, err = opts.Parse([]string{"-J", "arr[1-10:3]%2"})
+			So(err, ShouldBeNil)
+			So(opts.Name, ShouldEqual, "arr")
+			So(opts.ArrayLimit, ShouldEqual, 2)
+			So(opts.Array.Size(), ShouldEqual, 4)
+
+			job = &Job{Cmd: "echo $LSB_JOBINDEX", Cwd: "/tmp", Requirements: &jqs.Requirements{}}
+			opts.Apply(job)
+			So(job.Array, ShouldEqual, opts.Array)
+			So(job.LimitGroups, ShouldResemble, []string{"bsub.array." + job.ArrayKey() + ":2"})
+
+			_, templates, err := splitJobArrays([]*Job{job})
+			So(err, ShouldBeNil)
+			So(len(templates), ShouldEqual, 1)
+			expanded := newArrayFeed(templates[0], false).take(10)
+			So(len(expanded), ShouldEqual, 4)
+			So(expanded[0].Cmd, ShouldEqual, "export LSB_JOBINDEX=1\necho $LSB_JOBINDEX")
+			So(BsubArrayIndex(expanded[0]), ShouldEqual, 1)
+			So(BsubArrayIndex(expanded[3]), ShouldEqual, 10)
+			So(BsubArrayIndex(&Job{Cmd: "echo"}), ShouldEqual, 0)
+
+			opts = &BsubOptions{}
+			_, err = opts.Parse([]string{"-J", "list[2,5-6,9]"})
+			So(err, ShouldBeNil)
+			So(opts.ArrayLimit, ShouldEqual, 0)
+			So(opts.Array.Size(), ShouldEqual, 4)
+			So(opts.Array.Rows, ShouldResemble, [][]string{{"2"}, {"5"}, {"6"}, {"9"}})
+		})
+	})
+
+	Convey("bsub dependency expressions can be parsed and evaluated", t, func() {
+		deps, err := ParseBsubDependencies("  ")
+		So(err, ShouldBeNil)
+		So(deps, ShouldBeNil)
+
+		deps, err = ParseBsubDependencies(`done(a) && exit("b")&&ended(3) && c && 4`)
+		So(err, ShouldBeNil)
+		So(deps.Stringify(), ShouldResemble, []string{"bsub.name.a", "bsub.name.b:failure", "bsub.id.3:any", "bsub.name.c", "bsub.id.4"})
+
+		for _, bad := range []string{"done(a) || done(b)", "!done(a)", "started(a)", "done(a*)", "done(3[1])", "exit(a, 1)", "done()"} {
+			_, err = ParseBsubDependencies(bad)
+			So(err, ShouldNotBeNil)
+		}
+
+		running := &Job{State: JobStateRunning}
+		buried := &Job{State: JobStateBuried}
+		statuses := func(dep *Dependency, jobs []*Job) []bool {
+			satisfied, unsatisfiable := BsubDependencyStatus(dep, jobs)
+			return []bool{satisfied, unsatisfiable}
+		}
+
+		So(statuses(deps[0], nil), ShouldResemble, []bool{true, false})
+		So(statuses(deps[0], []*Job{running}), ShouldResemble, []bool{false, false})
+		So(statuses(deps[0], []*Job{running, buried}), ShouldResemble, []bool{false, true})
+		So(statuses(deps[1], nil), ShouldResemble, []bool{false, true})
+		So(statuses(deps[1], []*Job{running, buried}), ShouldResemble, []bool{false, false})
+		So(statuses(deps[1], []*Job{buried}), ShouldResemble, []bool{true, false})
+		So(statuses(deps[2], nil), ShouldResemble, []bool{true, false})
+		So(statuses(deps[2], []*Job{running}), ShouldResemble, []bool{false, false})
+		So(statuses(deps[2], []*Job{buried}), ShouldResemble, []bool{true, false})
+	})
+
+	Convey("ParseWorkflow works and creates dependent jobs", t, func() {
+		wf, err := ParseWorkflow([]byte(`
+name: wftest
+defaults:
+  memory: 2G
+  retries: 1
+steps:
+  - name: align
+    cmd: align {sample}
+    for_each:
+      sample: [a, b]
+  - name: call
+    cmd: call {sample}
+    memory: 1G
+    for_each:
+      sample: [a, b]
+    after: [align]
+  - name: merge
+    cmd: merge
+    after: [call]
+`))
+		So(err, ShouldBeNil)
+		So(wf.Name, ShouldEqual, "wftest")
+		So(len(wf.Steps), ShouldEqual, 3)
+		So(wf.RepGroup(), ShouldEqual, "wf.wftest.")
+
+		jobs, err := wf.Jobs(&JobDefaults{Cwd: "/tmp", DepGroups: []string{"extra"}})
+		So(err, ShouldBeNil)
+		So(len(jobs), ShouldEqual, 5)
+
+		So(jobs[0].Cmd, ShouldEqual, "align a")
+		So(jobs[0].RepGroup, ShouldEqual, "wf.wftest.align")
+		So(jobs[0].Requirements.RAM, ShouldEqual, 2048)
+		So(jobs[0].Retries, ShouldEqual, 1)
+		So(jobs[0].Array, ShouldBeNil)
+		So(jobs[0].ArrayID, ShouldBeBlank)
+		So(jobs[0].DepGroups, ShouldResemble, []string{"extra", "wf.wftest.align", "wf.wftest.align.0"})
+		So(jobs[0].Dependencies, ShouldBeEmpty)
+		So(jobs[1].Cmd, ShouldEqual, "align b")
+		So(jobs[1].DepGroups, ShouldResemble, []string{"extra", "wf.wftest.align", "wf.wftest.align.1"})
+
+		So(jobs[3].Cmd, ShouldEqual, "call b")
+		So(jobs[3].Requirements.RAM, ShouldEqual, 1024)
+		So(jobs[3].Dependencies.DepGroups(), ShouldResemble, []string{"wf.wftest.align.1"})
+
+		So(jobs[4].Cmd, ShouldEqual, "merge")
+		So(jobs[4].DepGroups, ShouldResemble, []string{"extra", "wf.wftest.merge"})
+		So(jobs[4].Dependencies.DepGroups(), ShouldResemble, []string{"wf.wftest.call"})
+
+		jobs[1].State = JobStateComplete
+		jobs[3].State = JobStateBuried
+		other := &Job{RepGroup: "wf.wftest.other.align", State: JobStateComplete}
+		statuses := wf.Status(append(jobs[1:4], other))
+		So(len(statuses), ShouldEqual, 3)
+		So(statuses[0].Step, ShouldEqual, "align")
+		So(statuses[0].Expected, ShouldEqual, 2)
+		So(statuses[0].Total(), ShouldEqual, 1)
+		So(statuses[0].Counts[JobStateComplete], ShouldEqual, 1)
+		So(statuses[1].Counts[JobStateBuried], ShouldEqual, 1)
+		So(statuses[2].Step, ShouldEqual, "merge")
+		So(statuses[2].Expected, ShouldEqual, 1)
+		So(statuses[2].Total(), ShouldEqual, 0)
+
+		statuses = WorkflowStatus("wftest", append(jobs[1:4], other))
+		So(len(statuses), ShouldEqual, 2)
+		So(statuses[0].Step, ShouldEqual, "align")
+		So(statuses[0].Expected, ShouldEqual, 0)
+		So(statuses[1].Step, ShouldEqual, "call")
+		So(statuses[1].Total(), ShouldEqual, 2)
+
+		Convey("Steps with different arrays depend on the whole step", func() {
+			wf, err = ParseWorkflow([]byte(`{"name": "wf2", "steps": [` +
+				`{"name": "a", "cmd": "a {i}", "array_ranges": ["i=1-3"]},` +
+				`{"name": "b", "cmd": "b {s}", "for_each": {"s": ["x", "y"]}, "after": ["a"]}]}`))
+			So(err, ShouldBeNil)
+
+			jobs, err = wf.Jobs(&JobDefaults{})
+			So(err, ShouldBeNil)
+			So(len(jobs), ShouldEqual, 5)
+			So(jobs[2].Cmd, ShouldEqual, "a 3")
+			So(jobs[4].Cmd, ShouldEqual, "b y")
+			So(jobs[4].Dependencies.DepGroups(), ShouldResemble, []string{"wf.wf2.a"})
+		})
+
+		Convey("Invalid workflows are rejected", func() {
+			for _, bad := range []string{
+				"steps: [{name: a, cmd: a}]",
+				"name: bad name\nsteps: [{name: a, cmd: a}]",
+				"name: w",
+				"name: w\nsteps: [{name: a.b, cmd: a}]",
+				"name: w\nsteps: [{name: a, cmd: a}, {name: a, cmd: b}]",
+				"name: w\nsteps: [{name: a, cmd: a, after: [b]}]",
+				"name: w\nsteps: [{name: a, cmd: a, after: [b]}, {name: b, cmd: b, after: [a]}]",
+				"name: w\nsteps: [{name: a, cmd: a, rep_grp: foo}]",
+				"name: w\nsteps: [{name: a, cmd: a, for_each: {s: [x]}}]",
+				"name: w\nsteps: [{name: a, cmd: a {s} {t}, for_each: {s: [x], t: [y, z]}}]",
+				"name: w\nsteps: [{name: a, cmd: a, unknown: x}]",
+			} {
+				_, err = ParseWorkflow([]byte(bad))
+				So(err, ShouldNotBeNil)
+			}
+
+			wf, err = ParseWorkflow([]byte("name: w\nsteps: [{name: a}]"))
+			So(err, ShouldBeNil)
+			_, err = wf.Jobs(&JobDefaults{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Both database backends store jobs, and bolt databases can be migrated to sqlite", t, func() {
+		ctx := context.Background()
+		dir, err := os.MkdirTemp("", "wr_jobqueue_db_test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		newJobs := func() (parents []*Job, dependent *Job) {
+			for i := 0; i < 3; i++ {
+				parents = append(parents, &Job{Cmd: fmt.Sprintf("echo %d", i), Cwd: "/tmp", RepGroup: "rg", ReqGroup: "req", DepGroups: []string{"dg"}})
+			}
+			dependent = &Job{Cmd: "echo dependent", Cwd: "/tmp", RepGroup: "rg2", ReqGroup: "req", Dependencies: Dependencies{NewDepGroupDependency("dg")}}
+			return parents, dependent
+		}
+
+		for _, backend := range []string{DBBackendBolt, DBBackendSQLite} {
+			dbFile := filepath.Join(dir, backend+".db")
+			db, _, err := initDB(ctx, dbFile, dbFile+".bk", internal.Production, backend)
+			So(err, ShouldBeNil)
+
+			parents, dependent := newJobs()
+			_, _, _, err = db.storeNewJobs(ctx, append(parents, dependent), false)
+			So(err, ShouldBeNil)
+
+			live, err := db.checkIfLive(parents[0].Key())
+			So(err, ShouldBeNil)
+			So(live, ShouldBeTrue)
+
+			parents[0].PeakRAM = 150
+			parents[0].StartTime = time.Now().Add(-time.Minute)
+			parents[0].EndTime = time.Now()
+			err = db.archiveJob(ctx, parents[0].Key(), parents[0])
+			So(err, ShouldBeNil)
+
+			live, err = db.checkIfLive(parents[0].Key())
+			So(err, ShouldBeNil)
+			So(live, ShouldBeFalse)
+			added, err := db.checkIfAdded(parents[0].Key())
+			So(err, ShouldBeNil)
+			So(added, ShouldBeTrue)
+
+			complete, err := db.retrieveCompleteJobsByRepGroup("rg")
+			So(err, ShouldBeNil)
+			So(len(complete), ShouldEqual, 1)
+			So(complete[0].Cmd, ShouldEqual, "echo 0")
+
+			keys, err := db.retrieveIncompleteJobKeysByDepGroup("dg")
+			So(err, ShouldBeNil)
+			So(len(keys), ShouldEqual, 2)
+
+			rgs, err := db.retrieveRepGroups()
+			So(err, ShouldBeNil)
+			So(rgs, ShouldResemble, []string{"rg", "rg2"})
+
+			mem, err := db.recommendedReqGroupMemory("req")
+			So(err, ShouldBeNil)
+			So(mem, ShouldEqual, 200)
+
+			parents[1].Exitcode = 1
+			db.updateJobAfterExit(ctx, parents[1], []byte("out"), []byte("err"), false)
+			stdo, stde := db.retrieveJobStd(ctx, parents[1].Key())
+			So(string(stdo), ShouldEqual, "out")
+			So(string(stde), ShouldEqual, "err")
+
+			toQueue, toUpdate, _, err := db.storeNewJobs(ctx, []*Job{parents[0]}, false)
+			So(err, ShouldBeNil)
+			So(len(toQueue), ShouldEqual, 1)
+			So(len(toUpdate), ShouldEqual, 1)
+			So(toUpdate[0].Cmd, ShouldEqual, "echo dependent")
+
+			recovered, err := db.recoverIncompleteJobs()
+			So(err, ShouldBeNil)
+			So(len(recovered), ShouldEqual, 4)
+
+			err = db.close(ctx)
+			So(err, ShouldBeNil)
+		}
+
+		boltFile := filepath.Join(dir, DBBackendBolt+".db")
+		sqliteFile := filepath.Join(dir, "migrated.db")
+		migrated, err := MigrateDB(boltFile, sqliteFile)
+		So(err, ShouldBeNil)
+		So(migrated, ShouldEqual, 5)
+
+		_, err = MigrateDB(boltFile, sqliteFile)
+		So(err, ShouldNotBeNil)
+
+		db, _, err := initDB(ctx, sqliteFile, sqliteFile+".bk", internal.Production, DBBackendSQLite)
+		So(err, ShouldBeNil)
+		defer db.close(ctx)
+
+		parents, _ := newJobs()
+		complete, err := db.retrieveCompleteJobsByKeys([]string{parents[0].Key()})
+		So(err, ShouldBeNil)
+		So(len(complete), ShouldEqual, 1)
+
+		recovered, err := db.recoverIncompleteJobs()
+		So(err, ShouldBeNil)
+		So(len(recovered), ShouldEqual, 4)
+
+		mem, err := db.recommendedReqGroupMemory("req")
+		So(err, ShouldBeNil)
+		So(mem, ShouldEqual, 200)
+
+		stdo, stde := db.retrieveJobStd(ctx, parents[1].Key())
+		So(string(stdo), ShouldEqual, "out")
+		So(string(stde), ShouldEqual, "err")
+
+		keys, err := db.retrieveIncompleteJobKeysByDepGroup("dg")
+		So(err, ShouldBeNil)
+		So(len(keys), ShouldEqual, 3)
+
+		var bigJobs int
+		err = db.journal.dbStore.(*sqliteStore).sql.QueryRow(`SELECT COUNT(*) FROM jobs_complete WHERE peak_ram > 100`).Scan(&bigJobs)
+		So(err, ShouldBeNil)
+		So(bigJobs, ShouldEqual, 1)
+	})
 }
 
 func jobqueueTestInit(shortTTR bool) (internal.Config, ServerConfig, string, *jqs.Requirements, time.Duration) {
@@ -866,87 +1608,1313 @@ func TestJobqueueSignal(t *testing.T) {
 			So(job2.Cmd, ShouldEqual, cmd2)
 			So(job2.State, ShouldEqual, JobStateLost)
 
-			// now allow 2 secs for job3 to start and complete
-			var job3 *Job
-			for i := 0; i < 8; i++ {
-				job3, err = jq2.GetByEssence(&JobEssence{Cmd: cmd3}, false, false)
-				if job3 != nil && job3.State == JobStateComplete {
-					break
-				}
-				<-time.After(250 * time.Millisecond)
-			}
-			So(err, ShouldBeNil)
-			So(job3, ShouldNotBeNil)
-			So(job3.Cmd, ShouldEqual, cmd3)
-			So(job3.State, ShouldEqual, JobStateComplete)
-			So(job3.StartTime, ShouldHappenAfter, job.EndTime)
+			// now allow 2 secs for job3 to start and complete
+			var job3 *Job
+			for i := 0; i < 8; i++ {
+				job3, err = jq2.GetByEssence(&JobEssence{Cmd: cmd3}, false, false)
+				if job3 != nil && job3.State == JobStateComplete {
+					break
+				}
+				<-time.After(250 * time.Millisecond)
+			}
+			So(err, ShouldBeNil)
+			So(job3, ShouldNotBeNil)
+			So(job3.Cmd, ShouldEqual, cmd3)
+			So(job3.State, ShouldEqual, JobStateComplete)
+			So(job3.StartTime, ShouldHappenAfter, job.EndTime)
+
+			// for subsequent tests to work, we need to wait for the server to
+			// really be gone
+			killServer(jq, serverPid, serverCmd)
+			So(waitUntilPidsAreGone(map[int]bool{serverPid: true}, 5), ShouldBeTrue)
+		})
+
+		Reset(func() {
+			killServer(jq, serverPid, serverCmd)
+		})
+	})
+}
+
+func TestJobqueueBasics(t *testing.T) {
+	ctx := context.Background()
+
+	if runnermode || servermode {
+		return
+	}
+	config, serverConfig, addr, standardReqs, clientConnectTime := jobqueueTestInit(true)
+
+	defer os.RemoveAll(filepath.Join(os.TempDir(), AppName+"_cwd"))
+
+	var server *Server
+	var token []byte
+	var errs error
+	Convey("Without the jobserver being up, clients can't connect and time out", t, func() {
+		os.Remove(config.ManagerTokenFile)
+
+		_, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+		So(err, ShouldNotBeNil)
+		jqerr, ok := err.(Error)
+		So(ok, ShouldBeTrue)
+		So(jqerr.Err, ShouldEqual, ErrNoServer)
+
+		jq, err := ConnectUsingConfig(ctx, "development", clientConnectTime)
+		So(jq, ShouldBeNil)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "could not read token file")
+	})
+
+	Convey("Once the jobqueue server is up", t, func() {
+		server, _, token, errs = serve(ctx, serverConfig)
+		So(errs, ShouldBeNil)
+
+		server.rc = serverRC // ReserveScheduled() only works if we have an rc
+
+		Convey("You can connect to the server using config", func() {
+			jq, err := ConnectUsingConfig(ctx, "development", clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+		})
+
+		Convey("You can connect to the server and add jobs and get back their IDs", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			var jobs []*Job
+			req := &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}
+			jobs = append(jobs, &Job{Cmd: "echo 1", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: req, Retries: uint8(0), RepGroup: "test"})
+			jobs = append(jobs, &Job{Cmd: "echo 2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: req, Retries: uint8(0), RepGroup: "test"})
+			ids, err := jq.AddAndReturnIDs(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(len(ids), ShouldEqual, 2)
+			So(ids[0], ShouldEqual, "9a456dee1e351f82e3d562769c27d803")
+			So(ids[1], ShouldEqual, "2bb7055e49e21ea85066899a5ba38d8e")
+		})
+
+		Convey("You can't add jobs with dependency groups that contain the dependency mode separator", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			group, mode := SplitDependencyMode("x:any")
+			So(group, ShouldEqual, "x")
+			So(mode, ShouldEqual, DepModeAny)
+
+			bad := []*Job{
+				{Cmd: "echo dg 1", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dg", DepGroups: []string{"x:any"}},
+				{Cmd: "echo dg 2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dg", Dependencies: Dependencies{NewDepGroupDependency("x:y")}},
+			}
+			for _, job := range bad {
+				_, _, err = jq.Add([]*Job{job}, envVars, true)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrBadRequest)
+			}
+
+			_, _, err = jq.Add([]*Job{{Cmd: "echo dg 3", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dg", Dependencies: Dependencies{NewConditionalDependency(NewDepGroupDependency(group), mode)}}}, envVars, true)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("You can connect to the server and add a job array", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			table, err := ParseArrayTable(strings.NewReader("sample\tref\nA\tr1\nB\tr2\n"))
+			So(err, ShouldBeNil)
+			chr, err := ParseArrayRange("chr=1-5:2")
+			So(err, ShouldBeNil)
+			table.Ranges = []*ArrayRange{chr}
+			So(table.Size(), ShouldEqual, 6)
+
+			_, err = ParseArrayRange("chr=5-1")
+			So(err, ShouldNotBeNil)
+			_, err = ParseArrayTable(strings.NewReader("sample\tref\nA\n"))
+			So(err, ShouldNotBeNil)
+
+			template := &Job{
+				Cmd:          "echo {sample}.{ref}.{chr} $WR_ARRAY_INDEX",
+				Cwd:          "/tmp",
+				ReqGroup:     "array_group",
+				Requirements: standardReqs,
+				Retries:      uint8(0),
+				RepGroup:     "array",
+				Array:        table,
+			}
+			arrayID := template.ArrayKey()
+
+			inserts, already, err := jq.Add([]*Job{template}, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 6)
+			So(already, ShouldEqual, 0)
+
+			jobs, err := jq.GetByArray(arrayID, -1, false, false)
+			So(err, ShouldBeNil)
+			So(len(jobs), ShouldEqual, 6)
+			cmds := make([]string, len(jobs))
+			for i, job := range jobs {
+				So(job.ArrayID, ShouldEqual, arrayID)
+				So(job.ArraySize, ShouldEqual, 6)
+				cmds[i] = job.Cmd
+			}
+			sort.Strings(cmds)
+			So(cmds, ShouldResemble, []string{
+				"echo A.r1.1 $WR_ARRAY_INDEX",
+				"echo A.r1.3 $WR_ARRAY_INDEX",
+				"echo A.r1.5 $WR_ARRAY_INDEX",
+				"echo B.r2.1 $WR_ARRAY_INDEX",
+				"echo B.r2.3 $WR_ARRAY_INDEX",
+				"echo B.r2.5 $WR_ARRAY_INDEX",
+			})
+
+			jobs, err = jq.GetByArray(arrayID, 4, false, false)
+			So(err, ShouldBeNil)
+			So(len(jobs), ShouldEqual, 1)
+			So(jobs[0].Cmd, ShouldEqual, "echo B.r2.3 $WR_ARRAY_INDEX")
+			So(jobs[0].ArrayIndex, ShouldEqual, 4)
+
+			jobs, err = jq.GetByArray(arrayID, 6, false, false)
+			So(err, ShouldBeNil)
+			So(len(jobs), ShouldEqual, 0)
+
+			jobs, err = jq.GetByArray("foo", -1, false, false)
+			So(err, ShouldBeNil)
+			So(len(jobs), ShouldEqual, 0)
+
+			Convey("You can't add the same array again, or a bad array", func() {
+				inserts, already, err = jq.Add([]*Job{template}, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 0)
+				So(already, ShouldEqual, 6)
+
+				template.Array = &JobArray{Names: []string{"sample"}}
+				_, _, err = jq.Add([]*Job{template}, envVars, true)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Elements of the array know their index when executed", func() {
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.ArrayID, ShouldEqual, arrayID)
+
+				err = jq.Execute(ctx, job, config.RunnerExecShell)
+				So(err, ShouldBeNil)
+				stdout, err := job.StdOut()
+				So(err, ShouldBeNil)
+				So(stdout, ShouldEqual, strings.TrimSuffix(strings.TrimPrefix(job.Cmd, "echo "), "$WR_ARRAY_INDEX")+strconv.Itoa(job.ArrayIndex))
+			})
+
+			Convey("Only a window of a large array's elements are in the queue at once", func() {
+				ServerArrayWindow = 2
+				defer func() {
+					ServerArrayWindow = 1000
+				}()
+
+				big := &Job{
+					Cmd:          "echo big {n}",
+					Cwd:          "/tmp",
+					ReqGroup:     "array_group",
+					Requirements: standardReqs,
+					Retries:      uint8(0),
+					RepGroup:     "bigarray",
+					Array:        &JobArray{Ranges: []*ArrayRange{{Name: "n", Start: 1, End: 5, Step: 1}}},
+				}
+				bigID := big.ArrayKey()
+
+				inserts, already, err = jq.Add([]*Job{big}, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 5)
+				So(already, ShouldEqual, 0)
+
+				jobs, err = jq.GetByArray(bigID, -1, false, false)
+				So(err, ShouldBeNil)
+				So(len(jobs), ShouldEqual, 2)
+
+				var job *Job
+				for i := 0; i < 8; i++ {
+					job, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					if job.ArrayID == bigID {
+						break
+					}
+				}
+				So(job.ArrayID, ShouldEqual, bigID)
+				err = jq.Execute(ctx, job, config.RunnerExecShell)
+				So(err, ShouldBeNil)
+
+				jobs, err = jq.GetByArray(bigID, -1, false, false)
+				So(err, ShouldBeNil)
+				So(len(jobs), ShouldEqual, 3)
+
+				incomplete, err := jq.GetByRepGroup("bigarray", false, 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(len(incomplete), ShouldEqual, 3)
+				var jes []*JobEssence
+				for _, j := range incomplete {
+					if j.State != JobStateComplete {
+						jes = append(jes, j.ToEssense())
+					}
+				}
+				So(len(jes), ShouldEqual, 2)
+
+				Convey("Deleting all its elements in the queue cancels the rest", func() {
+					removed, err := jq.Delete(jes)
+					So(err, ShouldBeNil)
+					So(removed, ShouldEqual, 2)
+
+					jobs, err = jq.GetByArray(bigID, -1, false, false)
+					So(err, ShouldBeNil)
+					So(len(jobs), ShouldEqual, 1)
+					So(jobs[0].State, ShouldEqual, JobStateComplete)
+				})
+			})
+		})
+
+		Convey("You can connect to the server and add bsub jobs and arrays", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			opts := &BsubOptions{}
+			_, err = opts.Parse([]string{"-J", "barr[1-3]"})
+			So(err, ShouldBeNil)
+			template := &Job{Cmd: "echo $LSB_JOBINDEX", Cwd: "/tmp", ReqGroup: "bsub_group", Requirements: standardReqs, Retries: uint8(0), BsubMode: "development"}
+			opts.Apply(template)
+			arrayID := template.ArrayKey()
+
+			opts = &BsubOptions{}
+			_, err = opts.Parse([]string{"-J", "after", "-w", "done(barr)"})
+			So(err, ShouldBeNil)
+			dependent := &Job{Cmd: "echo after", Cwd: "/tmp", ReqGroup: "bsub_group", Requirements: standardReqs, Retries: uint8(0), BsubMode: "development"}
+			opts.Apply(dependent)
+
+			inserts, _, err := jq.Add([]*Job{template, dependent}, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 4)
+
+			elements, err := jq.GetByArray(arrayID, -1, false, false)
+			So(err, ShouldBeNil)
+			So(len(elements), ShouldEqual, 3)
+			bsubID := elements[0].BsubID
+			So(bsubID, ShouldNotEqual, 0)
+			for _, element := range elements {
+				So(element.BsubID, ShouldEqual, bsubID)
+				So(element.DepGroups, ShouldResemble, []string{BsubNameDepGroup("barr"), BsubIDDepGroup(bsubID)})
+			}
+
+			after, err := jq.GetByEssence(&JobEssence{Cmd: "echo after"}, false, false)
+			So(err, ShouldBeNil)
+			So(after.BsubID, ShouldNotEqual, bsubID)
+			So(after.State, ShouldEqual, JobStateDependent)
+
+			query := &JobQuery{Filter: &JobFilter{DepGroup: BsubIDDepGroup(bsubID)}}
+			jobs, _, err := jq.QueryJobs("", false, 0, "", query, false, false)
+			So(err, ShouldBeNil)
+			So(len(jobs), ShouldEqual, 3)
+
+			Convey("Elements know their bsub id and index when executed", func() {
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.ArrayID, ShouldEqual, arrayID)
+
+				err = jq.Execute(ctx, job, config.RunnerExecShell)
+				So(err, ShouldBeNil)
+				stdout, err := job.StdOut()
+				So(err, ShouldBeNil)
+				So(stdout, ShouldEqual, strconv.Itoa(BsubArrayIndex(job)))
+			})
+		})
+
+		Convey("You can connect to the server and add crons", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			job := &Job{Cmd: "echo cron", Cwd: "/tmp", ReqGroup: "cron_group", Requirements: standardReqs, Retries: uint8(0)}
+			cj, err := jq.AddCron(&CronJob{Name: "nightly", Schedule: "0 2 * * *", Job: job}, envVars)
+			So(err, ShouldBeNil)
+			So(cj.Job.RepGroup, ShouldEqual, "cron.nightly")
+			So(cj.NextTick.Hour(), ShouldEqual, 2)
+			So(cj.NextTick.Minute(), ShouldEqual, 0)
+			So(cj.NextTick, ShouldHappenAfter, time.Now())
+
+			_, err = jq.AddCron(&CronJob{Name: "nightly", Schedule: "0 3 * * *", Job: job}, envVars)
+			So(err, ShouldNotBeNil)
+			jqerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrCronExists)
+
+			_, err = jq.AddCron(&CronJob{Name: "bad", Schedule: "0 25 * * *", Job: job}, envVars)
+			So(err, ShouldNotBeNil)
+			jqerr, ok = err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrBadRequest)
+
+			_, err = jq.AddCron(&CronJob{Name: "bad name", Schedule: "0 2 * * *", Job: job}, envVars)
+			So(err, ShouldNotBeNil)
+
+			err = jq.RemoveCron("foo")
+			So(err, ShouldNotBeNil)
+			jqerr, ok = err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrMissingCron)
+
+			cjs, err := jq.GetCrons()
+			So(err, ShouldBeNil)
+			So(len(cjs), ShouldEqual, 1)
+			So(cjs[0].Name, ShouldEqual, "nightly")
+			So(cjs[0].Schedule, ShouldEqual, "0 2 * * *")
+
+			Convey("Crons add their job at each tick, unless still incomplete", func() {
+				tick := cj.NextTick
+				server.checkCronJobs(ctx, tick.Add(-1*time.Minute))
+				jobs, err := jq.GetByRepGroup("cron.nightly", false, 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(len(jobs), ShouldEqual, 0)
+
+				server.checkCronJobs(ctx, tick)
+				jobs, err = jq.GetByRepGroup("cron.nightly", false, 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(len(jobs), ShouldEqual, 1)
+				So(jobs[0].State, ShouldEqual, JobStateReady)
+
+				server.checkCronJobs(ctx, tick.AddDate(0, 0, 1))
+				cjs, err = jq.GetCrons()
+				So(err, ShouldBeNil)
+				So(cjs[0].Added, ShouldEqual, 1)
+				So(cjs[0].Skipped, ShouldEqual, 1)
+				So(cjs[0].LastTick, ShouldEqual, tick.AddDate(0, 0, 1))
+				So(cjs[0].NextTick, ShouldEqual, tick.AddDate(0, 0, 2))
+
+				reserved, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(reserved, ShouldNotBeNil)
+				So(reserved.Cmd, ShouldEqual, "echo cron")
+				err = jq.Execute(ctx, reserved, config.RunnerExecShell)
+				So(err, ShouldBeNil)
+
+				server.checkCronJobs(ctx, tick.AddDate(0, 0, 2))
+				jobs, err = jq.GetByRepGroup("cron.nightly", false, 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(len(jobs), ShouldEqual, 1)
+				So(jobs[0].State, ShouldEqual, JobStateReady)
+
+				stored, err := server.db.retrieveCronJobs()
+				So(err, ShouldBeNil)
+				So(len(stored), ShouldEqual, 1)
+				So(stored[0].Added, ShouldEqual, 2)
+				So(stored[0].Skipped, ShouldEqual, 1)
+
+				Convey("And you can remove them", func() {
+					err = jq.RemoveCron("nightly")
+					So(err, ShouldBeNil)
+
+					cjs, err = jq.GetCrons()
+					So(err, ShouldBeNil)
+					So(len(cjs), ShouldEqual, 0)
+
+					stored, err = server.db.retrieveCronJobs()
+					So(err, ShouldBeNil)
+					So(len(stored), ShouldEqual, 0)
+
+					jobs, err = jq.GetByRepGroup("cron.nightly", false, 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(jobs), ShouldEqual, 1)
+				})
+			})
+		})
+
+		Convey("You can archive expired complete jobs and still find them", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			archiveDir, err := os.MkdirTemp("", "wr_jobqueue_test_archive_")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(archiveDir)
+			server.archiveDir = archiveDir
+
+			policies, err := ParseRetentionPolicies("^old$|1h")
+			So(err, ShouldBeNil)
+			server.retention.Lock()
+			server.retention.policies = policies
+			server.retention.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			jobs := []*Job{
+				{Cmd: "echo old", Cwd: "/tmp", ReqGroup: "archive_group", Requirements: standardReqs, Retries: uint8(0), RepGroup: "old"},
+				{Cmd: "echo keep", Cwd: "/tmp", ReqGroup: "archive_group", Requirements: standardReqs, Retries: uint8(0), RepGroup: "keep"},
+			}
+			inserts, _, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 2)
+
+			for range jobs {
+				job, errr := jq.Reserve(50 * time.Millisecond)
+				So(errr, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				errr = jq.Execute(ctx, job, config.RunnerExecShell)
+				So(errr, ShouldBeNil)
+			}
+
+			recMem, err := server.db.recommendedReqGroupMemory("archive_group")
+			So(err, ShouldBeNil)
+			So(recMem, ShouldBeGreaterThan, 0)
+
+			archived, err := server.enforceRetention(ctx, time.Now())
+			So(err, ShouldBeNil)
+			So(archived, ShouldEqual, 0)
+
+			archived, err = server.enforceRetention(ctx, time.Now().Add(2*time.Hour))
+			So(err, ShouldBeNil)
+			So(archived, ShouldEqual, 1)
+
+			got, err := jq.GetByRepGroup("old", false, 0, "", false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 0)
+			got, err = jq.GetByRepGroup("keep", false, 0, "", false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+
+			rec, err := server.db.recommendedReqGroupMemory("archive_group")
+			So(err, ShouldBeNil)
+			So(rec, ShouldEqual, recMem)
+
+			paths, err := filepath.Glob(filepath.Join(archiveDir, "*"))
+			So(err, ShouldBeNil)
+			So(len(paths), ShouldEqual, 1)
+			So(paths[0], ShouldEndWith, ".jsonl.gz")
+
+			got, err = jq.GetArchived(nil, "old", false, 0)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+			So(got[0].Cmd, ShouldEqual, "echo old")
+			So(got[0].State, ShouldEqual, JobStateComplete)
+			So(got[0].Exited, ShouldBeTrue)
+			So(got[0].Exitcode, ShouldEqual, 0)
+
+			got, err = jq.GetArchived(nil, "ol", true, 0)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+
+			got, err = jq.GetArchived([]string{jobs[0].Key()}, "", false, 0)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+
+			got, err = jq.GetArchived(nil, "keep", false, 0)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 0)
+
+			inserts, _, err = jq.Add(jobs[:1], envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 1)
+		})
+
+		Convey("You can query jobs with filters, sorting and paging", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			jobs := []*Job{
+				{Cmd: "echo q1", Cwd: "/tmp", ReqGroup: "query_group", Requirements: standardReqs, Retries: uint8(0), RepGroup: "query"},
+				{Cmd: "echo q2", Cwd: "/tmp", ReqGroup: "query_group", Requirements: standardReqs, Retries: uint8(0), RepGroup: "query", DepGroups: []string{"qdep"}},
+				{Cmd: "echo q3", Cwd: "/tmp", ReqGroup: "query_group", Requirements: standardReqs, Retries: uint8(0), RepGroup: "query"},
+				{Cmd: "exit 2", Cwd: "/tmp", ReqGroup: "query_group", Requirements: standardReqs, Retries: uint8(0), RepGroup: "query"},
+			}
+			inserts, _, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 4)
+
+			for range jobs {
+				job, errr := jq.Reserve(50 * time.Millisecond)
+				So(errr, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				errr = jq.Execute(ctx, job, config.RunnerExecShell)
+				if job.Cmd == "exit 2" {
+					So(errr, ShouldNotBeNil)
+				} else {
+					So(errr, ShouldBeNil)
+				}
+			}
+
+			inserts, _, err = jq.Add([]*Job{{Cmd: "echo q5", Cwd: "/tmp", ReqGroup: "query_group", Requirements: standardReqs, RepGroup: "query"}}, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 1)
+
+			got, cursor, err := jq.QueryJobs("query", false, 0, "", nil, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 5)
+			So(cursor, ShouldBeBlank)
+
+			exitCode := 2
+			got, _, err = jq.QueryJobs("query", false, 0, "", &JobQuery{Filter: &JobFilter{ExitCode: &exitCode}}, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+			So(got[0].Cmd, ShouldEqual, "exit 2")
+
+			got, _, err = jq.QueryJobs("", false, 0, "", &JobQuery{Filter: &JobFilter{ExitCode: &exitCode}}, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+			So(got[0].State, ShouldEqual, JobStateBuried)
+
+			exitCode = 0
+			got, _, err = jq.QueryJobs("query", false, 0, "", &JobQuery{Filter: &JobFilter{ExitCode: &exitCode}}, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 3)
+
+			got, _, err = jq.QueryJobs("que", true, 0, "", &JobQuery{Filter: &JobFilter{FailReason: "non-zero"}}, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+			So(got[0].FailReason, ShouldEqual, FailReasonExit)
+
+			got, _, err = jq.QueryJobs("query", false, 0, "", &JobQuery{Filter: &JobFilter{DepGroup: "qdep"}}, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+			So(got[0].Cmd, ShouldEqual, "echo q2")
+
+			got, _, err = jq.QueryJobs("query", false, 0, "", &JobQuery{Filter: &JobFilter{StartedAfter: time.Now().Add(time.Hour)}}, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 0)
+
+			got, _, err = jq.QueryJobs("query", false, 0, "", &JobQuery{Filter: &JobFilter{EndedBefore: time.Now().Add(time.Hour)}}, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 4)
+
+			query := &JobQuery{PageSize: 2}
+			var keys []string
+			for i := 0; i < 3; i++ {
+				got, cursor, err = jq.QueryJobs("query", false, 0, "", query, false, false)
+				So(err, ShouldBeNil)
+				for _, job := range got {
+					keys = append(keys, job.Key())
+				}
+				if i < 2 {
+					So(len(got), ShouldEqual, 2)
+					So(cursor, ShouldNotBeBlank)
+				} else {
+					So(len(got), ShouldEqual, 1)
+					So(cursor, ShouldBeBlank)
+				}
+				query.Cursor = cursor
+			}
+			So(len(keys), ShouldEqual, 5)
+			So(sort.StringsAreSorted(keys), ShouldBeTrue)
+
+			got, _, err = jq.QueryJobs("query", false, 0, "", &JobQuery{SortBy: JobSortByStart, Desc: true}, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 5)
+			for i := 1; i < 4; i++ {
+				So(got[i].StartTime, ShouldHappenOnOrBefore, got[i-1].StartTime)
+			}
+			So(got[4].Cmd, ShouldEqual, "echo q5")
+			So(got[4].StartTime.IsZero(), ShouldBeTrue)
+
+			got, _, err = jq.QueryJobs("query", false, 0, "", &JobQuery{SortBy: JobSortByExitCode, Desc: true, PageSize: 1}, false, false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+			So(got[0].Cmd, ShouldEqual, "exit 2")
+
+			_, _, err = jq.QueryJobs("query", false, 1, "", &JobQuery{SortBy: JobSortByEnd}, false, false)
+			So(err, ShouldNotBeNil)
+			_, _, err = jq.QueryJobs("query", false, 0, "", &JobQuery{SortBy: "foo"}, false, false)
+			So(err, ShouldNotBeNil)
+			_, _, err = jq.QueryJobs("query", false, 0, "", &JobQuery{SortBy: JobSortByEnd, Cursor: query.Cursor + "foo"}, false, false)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("You can control how failed jobs are retried", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			policy, err := ParseRetryPolicy("backoff=200ms;max=300ms;no_retry=3;different_host")
+			So(err, ShouldBeNil)
+
+			jobs := []*Job{
+				{Cmd: "exit 3", Cwd: "/tmp", ReqGroup: "retry_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "retry", RetryPolicy: policy},
+				{Cmd: "exit 4", Cwd: "/tmp", ReqGroup: "retry_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "retry", RetryPolicy: policy},
+			}
+			inserts, _, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 2)
+
+			for range jobs {
+				job, errr := jq.Reserve(50 * time.Millisecond)
+				So(errr, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.RetryPolicy, ShouldResemble, policy)
+				So(job.DelayTime, ShouldEqual, 200*time.Millisecond)
+
+				errr = jq.Execute(ctx, job, config.RunnerExecShell)
+				So(errr, ShouldNotBeNil)
+				if job.Cmd == "exit 3" {
+					So(job.State, ShouldEqual, JobStateBuried)
+					So(errr.Error(), ShouldContainSubstring, "retry policy")
+				} else {
+					So(job.State, ShouldEqual, JobStateDelayed)
+				}
+			}
+
+			job, err := jq.GetByEssence(&JobEssence{Cmd: "exit 4"}, false, false)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Host, ShouldNotBeBlank)
+			So(job.Requirements.Other[jqs.AvoidHostsKey], ShouldEqual, job.Host)
+			So(standardReqs.Other[jqs.AvoidHostsKey], ShouldBeBlank)
+
+			<-time.After(200 * time.Millisecond)
+			job, err = jq.Reserve(100 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Cmd, ShouldEqual, "exit 4")
+			So(job.DelayTime, ShouldEqual, 300*time.Millisecond)
+
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldNotBeNil)
+			So(job.State, ShouldEqual, JobStateDelayed)
+
+			job, err = jq.GetByEssence(&JobEssence{Cmd: "exit 4"}, false, false)
+			So(err, ShouldBeNil)
+			So(job.Requirements.Other[jqs.AvoidHostsKey], ShouldEqual, job.Host)
+
+			Convey("And change the policy with a JobModifier", func() {
+				<-time.After(300 * time.Millisecond)
+				jm := NewJobModifer()
+				jm.SetRetryPolicy(nil)
+				modified, err := jq.Modify([]*JobEssence{{Cmd: "exit 4"}}, jm)
+				So(err, ShouldBeNil)
+				So(len(modified), ShouldEqual, 1)
+
+				job, err = jq.GetByEssence(&JobEssence{Cmd: "exit 4"}, false, false)
+				So(err, ShouldBeNil)
+				So(job.RetryPolicy, ShouldBeNil)
+			})
+		})
+
+		Convey("You can Execute() jobs in cgroups", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			parent, err := os.MkdirTemp("", "wr_jobqueue_cgroup_test")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(parent)
+
+			err = jq.UseCgroups(parent)
+			So(err, ShouldNotBeNil)
+			err = os.WriteFile(filepath.Join(parent, cgroupControllersFile), []byte("memory\n"), 0o600)
+			So(err, ShouldBeNil)
+			err = jq.UseCgroups(parent)
+			So(err, ShouldBeNil)
+
+			timeReqs := &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1, Other: make(map[string]string)}
+			jobs := []*Job{
+				{Cmd: "echo cgroup", Cwd: "/tmp", ReqGroup: "cgroup_ok", Requirements: standardReqs, Retries: uint8(3), RepGroup: "cgroup"},
+				{Cmd: "exit 137", Cwd: "/tmp", ReqGroup: "cgroup_ram", Requirements: standardReqs, Retries: uint8(3), RepGroup: "cgroup"},
+				{Cmd: "sleep 5", Cwd: "/tmp", ReqGroup: "cgroup_time", Requirements: timeReqs, Retries: uint8(3), RepGroup: "cgroup"},
+			}
+			inserts, _, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 3)
+
+			reserve := func(cmd string) (*Job, string) {
+				job, errr := jq.Reserve(50 * time.Millisecond)
+				So(errr, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.Cmd, ShouldEqual, cmd)
+				return job, filepath.Join(parent, "wr-"+job.Key())
+			}
+
+			job, child := reserve("echo cgroup")
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldBeNil)
+			So(job.State, ShouldEqual, JobStateComplete)
+
+			content, err := os.ReadFile(filepath.Join(child, cgroupProcsFile))
+			So(err, ShouldBeNil)
+			pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+			So(err, ShouldBeNil)
+			So(pid, ShouldEqual, job.Pid)
+			content, err = os.ReadFile(filepath.Join(child, cgroupMemMaxFile))
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "10485760")
+
+			job, child = reserve("exit 137")
+			err = os.Mkdir(child, 0o700)
+			So(err, ShouldBeNil)
+			err = os.WriteFile(filepath.Join(child, cgroupMemPeakFile), []byte("20971520\n"), 0o600)
+			So(err, ShouldBeNil)
+			err = os.WriteFile(filepath.Join(child, cgroupMemEventsFile), []byte("max 1\noom 1\noom_kill 1\n"), 0o600)
+			So(err, ShouldBeNil)
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldNotBeNil)
+			jqerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, FailReasonRAM)
+			So(job.FailReason, ShouldEqual, FailReasonRAM)
+			So(job.PeakRAM, ShouldBeGreaterThanOrEqualTo, 20)
+
+			job, _ = reserve("sleep 5")
+			start := time.Now()
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, 4*time.Second)
+			jqerr, ok = err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, FailReasonTime)
+			So(job.FailReason, ShouldEqual, FailReasonTime)
+		})
+
+		Convey("You can checkpoint jobs that have to stop, and resume them", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			cwd, err := os.MkdirTemp("", "wr_jobqueue_checkpoint_test")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(cwd)
+
+			cp, err := ParseCheckpoint("dir=ckpt;signal=USR1;grace=5s")
+			So(err, ShouldBeNil)
+
+			cmd := "mkdir -p ckpt && if [ -f ckpt/state ]; then cat ckpt/state; else " +
+				"trap 'echo saved > ckpt/state; exit 0' USR1; sleep 20 & wait; fi"
+			jobs := []*Job{{
+				Cmd: cmd, Cwd: cwd, ReqGroup: "checkpoint", Requirements: standardReqs, Retries: uint8(3),
+				RepGroup: "checkpoint", Checkpoint: cp, RetryPolicy: &RetryPolicy{Backoff: 100 * time.Millisecond},
+			}}
+			inserts, _, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 1)
+
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Checkpoint, ShouldResemble, cp)
+			So(job.CheckpointSaved, ShouldBeFalse)
+
+			signalErrCh := make(chan error, 1)
+			go func() {
+				limit := time.After(10 * time.Second)
+				ticker := time.NewTicker(50 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						got, errg := jq.GetByEssence(&JobEssence{JobKey: job.Key()}, false, false)
+						if errg != nil || got == nil || got.State != JobStateRunning {
+							continue
+						}
+						<-time.After(500 * time.Millisecond)
+						signalErrCh <- syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+						return
+					case <-limit:
+						signalErrCh <- fmt.Errorf("job never started running")
+						return
+					}
+				}
+			}()
+
+			start := time.Now()
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(<-signalErrCh, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, 10*time.Second)
+			jqerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, FailReasonSignal)
+
+			job, err = jq.GetByEssence(&JobEssence{JobKey: job.Key()}, false, false)
+			So(err, ShouldBeNil)
+			So(job.State, ShouldEqual, JobStateDelayed)
+			So(job.CheckpointSaved, ShouldBeTrue)
+			cpFile, err := server.checkpointFilePath(job.Key())
+			So(err, ShouldBeNil)
+			_, err = os.Stat(cpFile)
+			So(err, ShouldBeNil)
+
+			<-time.After(150 * time.Millisecond)
+			job, err = jq.Reserve(100 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.CheckpointSaved, ShouldBeTrue)
+
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldBeNil)
+			So(job.State, ShouldEqual, JobStateComplete)
+			stdout, err := job.StdOut()
+			So(err, ShouldBeNil)
+			So(stdout, ShouldEqual, "saved")
+
+			job, err = jq.GetByEssence(&JobEssence{JobKey: job.Key()}, false, false)
+			So(err, ShouldBeNil)
+			So(job.CheckpointSaved, ShouldBeFalse)
+			_, err = os.Stat(cpFile)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("You can stream the output of running jobs and tail it", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			logDir, err := os.MkdirTemp("", "wr_jobqueue_logs_test")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(logDir)
+			server.logs = newJobLogs(logDir, 8)
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+			jq.StreamLogs(100 * time.Millisecond)
+
+			jq2, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq2)
+
+			jobs := []*Job{{
+				Cmd: "echo one && sleep 1 && echo two >&2 && sleep 1 && echo three", Cwd: "/tmp",
+				ReqGroup: "logs", Requirements: standardReqs, Retries: uint8(3), RepGroup: "logs",
+			}}
+			inserts, _, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 1)
+
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			key := job.Key()
+
+			chunks, _, live, err := jq2.GetLogs(key, 0, 0)
+			So(err, ShouldBeNil)
+			So(chunks, ShouldBeEmpty)
+			So(live, ShouldBeTrue)
+
+			followed := make(chan []*LogChunk)
+			go func() {
+				var all []*LogChunk
+				var seq uint64
+				for {
+					got, latest, more, errg := jq2.GetLogs(key, seq, 1*time.Second)
+					if errg != nil {
+						break
+					}
+					all = append(all, got...)
+					seq = latest
+					if !more {
+						break
+					}
+				}
+				followed <- all
+			}()
+
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldBeNil)
+			So(job.State, ShouldEqual, JobStateComplete)
+
+			all := <-followed
+			So(len(all), ShouldBeGreaterThanOrEqualTo, 3)
+			streams := make(map[string]string)
+			for i, chunk := range all {
+				So(chunk.Seq, ShouldEqual, uint64(i+1))
+				streams[chunk.Stream] += chunk.Data
+			}
+			So(streams[LogStreamStdout], ShouldEqual, "one\nthree\n")
+			So(streams[LogStreamStderr], ShouldEqual, "two\n")
+
+			chunks, _, live, err = jq2.GetLogs(key, 0, 0)
+			So(err, ShouldBeNil)
+			So(live, ShouldBeFalse)
+			So(len(chunks), ShouldEqual, 2)
+			So(chunks[0].Stream, ShouldEqual, LogStreamStdout)
+			So(chunks[0].Data, ShouldStartWith, "one\nthre")
+			So(chunks[0].Data, ShouldContainSubstring, "truncated at 8 bytes")
+			So(chunks[1].Stream, ShouldEqual, LogStreamStderr)
+			So(chunks[1].Data, ShouldEqual, "two\n")
+
+			stdout, err := job.StdOut()
+			So(err, ShouldBeNil)
+			So(stdout, ShouldEqual, "one\nthree")
+		})
+
+		Convey("You can add a workflow, and resume it by adding it again", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			wf, err := ParseWorkflow([]byte(`
+name: wfbasics
+defaults:
+  memory: 10M
+  time: 1m
+steps:
+  - name: one
+    cmd: echo one {s}
+    for_each:
+      s: [a, b]
+  - name: two
+    cmd: echo two {s}
+    for_each:
+      s: [a, b]
+    after: [one]
+  - name: three
+    cmd: echo three
+    after: [two]
+`))
+			So(err, ShouldBeNil)
+
+			jobs, err := wf.Jobs(&JobDefaults{Cwd: "/tmp"})
+			So(err, ShouldBeNil)
+			inserts, _, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 5)
+
+			stepState := func(step string, state JobState) int {
+				got, errg := jq.GetByRepGroup(wf.RepGroup()+step, false, 0, state, false, false)
+				So(errg, ShouldBeNil)
+				return len(got)
+			}
+			So(stepState("one", JobStateReady), ShouldEqual, 2)
+			So(stepState("two", JobStateDependent), ShouldEqual, 2)
+			So(stepState("three", JobStateDependent), ShouldEqual, 1)
+
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Cmd, ShouldStartWith, "echo one ")
+			n := strings.TrimPrefix(job.Cmd, "echo one ")
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldBeNil)
+			So(job.State, ShouldEqual, JobStateComplete)
+
+			So(stepState("two", JobStateReady), ShouldEqual, 1)
+			So(stepState("two", JobStateDependent), ShouldEqual, 1)
+			ready, err := jq.GetByRepGroup(wf.RepGroup()+"two", false, 0, JobStateReady, false, false)
+			So(err, ShouldBeNil)
+			So(ready[0].Cmd, ShouldEqual, "echo two "+n)
+
+			got, err := jq.GetByRepGroup(wf.RepGroup(), true, 0, "", false, false)
+			So(err, ShouldBeNil)
+			statuses := wf.Status(got)
+			So(statuses[0].Counts[JobStateComplete], ShouldEqual, 1)
+			So(statuses[0].Counts[JobStateReady], ShouldEqual, 1)
+			So(statuses[2].Counts[JobStateDependent], ShouldEqual, 1)
+
+			jobs, err = wf.Jobs(&JobDefaults{Cwd: "/tmp"})
+			So(err, ShouldBeNil)
+			inserts, dups, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 0)
+			So(dups, ShouldEqual, 5)
+			So(stepState("one", JobStateComplete), ShouldEqual, 1)
+			So(stepState("two", JobStateReady), ShouldEqual, 1)
+		})
+
+		Convey("You can share resources fairly between report groups", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			_, err = jq.GetFairShare()
+			So(err, ShouldNotBeNil)
+			jqerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrNoFairShare)
+
+			policy, err := ParseFairSharePolicy("repgroup|1d|heavy=1,light=1")
+			So(err, ShouldBeNil)
+			disabled := server.fairShare
+			server.fairShare = newFairShare(policy)
+			defer func() {
+				server.fairShare = disabled
+			}()
+
+			server.fairShare.usage["heavy"] = 1000
+			server.updateFairShare(ctx, time.Now())
+
+			jobs := []*Job{
+				{Cmd: "echo heavy", Cwd: "/tmp", ReqGroup: "fs_group", Requirements: standardReqs, Retries: uint8(0), RepGroup: "heavy.1"},
+				{Cmd: "echo light", Cwd: "/tmp", ReqGroup: "fs_group", Requirements: standardReqs, Retries: uint8(0), RepGroup: "light.1"},
+			}
+			inserts, _, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 2)
+
+			report, err := jq.GetFairShare()
+			So(err, ShouldBeNil)
+			So(len(report), ShouldEqual, 2)
+			So(report[0].Name, ShouldEqual, "heavy")
+			So(report[0].Share, ShouldEqual, 0.5)
+			So(report[0].UsageFraction, ShouldAlmostEqual, 1)
+			So(report[0].Factor, ShouldAlmostEqual, 0.25)
+			So(report[0].Ready, ShouldEqual, 1)
+			So(report[1].Name, ShouldEqual, "light")
+			So(report[1].Factor, ShouldEqual, 1)
+			So(report[1].Ready, ShouldEqual, 1)
+
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Cmd, ShouldEqual, "echo light")
+
+			report, err = jq.GetFairShare()
+			So(err, ShouldBeNil)
+			So(report[1].Ready, ShouldEqual, 0)
+			So(report[1].Running, ShouldEqual, 1)
+
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldBeNil)
+			So(server.fairShare.usage["light"], ShouldBeGreaterThan, 0)
+
+			job, err = jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Cmd, ShouldEqual, "echo heavy")
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("You can add users who own the jobs they add", func() {
+			server.racmutex.Lock()
+			server.rc = ""
+			server.racmutex.Unlock()
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			me, err := jq.WhoAmI()
+			So(err, ShouldBeNil)
+			So(me.Admin, ShouldBeTrue)
+			So(me.Token, ShouldBeNil)
+
+			alice, err := jq.AddUser("alice", false)
+			So(err, ShouldBeNil)
+			So(alice.Name, ShouldEqual, "alice")
+			So(alice.Admin, ShouldBeFalse)
+			So(len(alice.Token), ShouldEqual, tokenLength)
+
+			bob, err := jq.AddUser("bob", false)
+			So(err, ShouldBeNil)
+
+			_, err = jq.AddUser("alice", true)
+			So(err, ShouldNotBeNil)
+			jqerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrUserExists)
+
+			_, err = jq.AddUser("bad name", false)
+			So(err, ShouldNotBeNil)
+
+			users, err := jq.GetUsers()
+			So(err, ShouldBeNil)
+			So(len(users), ShouldEqual, 3)
+			for _, u := range users {
+				So(u.Token, ShouldBeNil)
+			}
+
+			ajq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, alice.Token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(ajq)
+
+			bjq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, bob.Token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(bjq)
+
+			me, err = ajq.WhoAmI()
+			So(err, ShouldBeNil)
+			So(me.Name, ShouldEqual, "alice")
+			So(me.Admin, ShouldBeFalse)
+
+			jobs := []*Job{{Cmd: "echo alice", Cwd: "/tmp", ReqGroup: "user_group", Requirements: standardReqs, RepGroup: "users"}}
+			inserts, _, err := ajq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 1)
+
+			job, err := ajq.GetByEssence(&JobEssence{Cmd: "echo alice"}, false, false)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Owner, ShouldEqual, "alice")
+
+			Convey("Other users can't act on them, but the owner and admins can", func() {
+				removed, err := bjq.Delete([]*JobEssence{job.ToEssense()})
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 0)
+
+				job, err = bjq.GetByEssence(&JobEssence{Cmd: "echo alice"}, false, true)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				env, err := job.Env()
+				So(err, ShouldBeNil)
+				So(env, ShouldBeNil)
+
+				ajob, err := ajq.GetByEssence(&JobEssence{Cmd: "echo alice"}, false, true)
+				So(err, ShouldBeNil)
+				env, err = ajob.Env()
+				So(err, ShouldBeNil)
+				So(env, ShouldNotBeEmpty)
+
+				_, err = bjq.Reserve(50 * time.Millisecond)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNotAdmin)
+
+				removed, err = ajq.Delete([]*JobEssence{job.ToEssense()})
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 1)
+
+				inserts, _, err = bjq.Add(jobs, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+
+				removed, err = jq.Delete([]*JobEssence{job.ToEssense()})
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 1)
+			})
+
+			Convey("Other users can't act as the runner of them or see their output", func() {
+				rjob, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(rjob, ShouldNotBeNil)
+				So(rjob.Cmd, ShouldEqual, "echo alice")
+				So(rjob.ReservedBy, ShouldNotEqual, uuid.Nil)
+
+				bjob, err := bjq.GetByEssence(&JobEssence{Cmd: "echo alice"}, false, false)
+				So(err, ShouldBeNil)
+				So(bjob.ReservedBy, ShouldEqual, uuid.Nil)
+
+				ajob, err := ajq.GetByEssence(&JobEssence{Cmd: "echo alice"}, false, false)
+				So(err, ShouldBeNil)
+				So(ajob.ReservedBy, ShouldEqual, rjob.ReservedBy)
+
+				bjq.clientid = rjob.ReservedBy
+				err = bjq.Release(rjob, &JobEndState{}, "stolen")
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNotOwner)
+
+				_, err = bjq.GetCopiedFile(rjob.Key(), "file")
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNotOwner)
+
+				_, _, _, err = bjq.GetLogs(rjob.Key(), 0, 0)
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNotOwner)
+
+				_, _, _, err = ajq.GetLogs(rjob.Key(), 0, 0)
+				So(err, ShouldBeNil)
 
-			// for subsequent tests to work, we need to wait for the server to
-			// really be gone
-			killServer(jq, serverPid, serverCmd)
-			So(waitUntilPidsAreGone(map[int]bool{serverPid: true}, 5), ShouldBeTrue)
-		})
+				err = jq.Release(rjob, &JobEndState{}, "released")
+				So(err, ShouldBeNil)
 
-		Reset(func() {
-			killServer(jq, serverPid, serverCmd)
-		})
-	})
-}
+				removed, err := ajq.Delete([]*JobEssence{rjob.ToEssense()})
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 1)
+			})
 
-func TestJobqueueBasics(t *testing.T) {
-	ctx := context.Background()
+			Convey("Only admins can manage users and the server", func() {
+				_, err = ajq.AddUser("carol", false)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNotAdmin)
 
-	if runnermode || servermode {
-		return
-	}
-	config, serverConfig, addr, standardReqs, clientConnectTime := jobqueueTestInit(true)
+				_, err = ajq.GetUsers()
+				So(err, ShouldNotBeNil)
 
-	defer os.RemoveAll(filepath.Join(os.TempDir(), AppName+"_cwd"))
+				_, _, err = ajq.PauseServer()
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNotAdmin)
 
-	var server *Server
-	var token []byte
-	var errs error
-	Convey("Without the jobserver being up, clients can't connect and time out", t, func() {
-		os.Remove(config.ManagerTokenFile)
+				_, _, err = ajq.ConfirmCloudServersDead("")
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNotAdmin)
 
-		_, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-		So(err, ShouldNotBeNil)
-		jqerr, ok := err.(Error)
-		So(ok, ShouldBeTrue)
-		So(jqerr.Err, ShouldEqual, ErrNoServer)
+				_, err = ajq.GetBadCloudServers()
+				So(err, ShouldBeNil)
 
-		jq, err := ConnectUsingConfig(ctx, "development", clientConnectTime)
-		So(jq, ShouldBeNil)
-		So(err, ShouldNotBeNil)
-		So(err.Error(), ShouldContainSubstring, "could not read token file")
-	})
+				_, err = ajq.GetOrSetLimitGroup("alice_lg:2")
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNotAdmin)
 
-	Convey("Once the jobqueue server is up", t, func() {
-		server, _, token, errs = serve(ctx, serverConfig)
-		So(errs, ShouldBeNil)
+				limit, err := jq.GetOrSetLimitGroup("alice_lg:2")
+				So(err, ShouldBeNil)
+				So(limit, ShouldEqual, 2)
 
-		server.rc = serverRC // ReserveScheduled() only works if we have an rc
+				limit, err = ajq.GetOrSetLimitGroup("alice_lg")
+				So(err, ShouldBeNil)
+				So(limit, ShouldEqual, 2)
 
-		Convey("You can connect to the server using config", func() {
-			jq, err := ConnectUsingConfig(ctx, "development", clientConnectTime)
-			So(err, ShouldBeNil)
-			defer disconnect(jq)
-		})
+				err = jq.RemoveUser("alice")
+				So(err, ShouldBeNil)
 
-		Convey("You can connect to the server and add jobs and get back their IDs", func() {
-			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-			So(err, ShouldBeNil)
-			defer disconnect(jq)
+				_, err = ajq.WhoAmI()
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrPermissionDenied)
 
-			var jobs []*Job
-			req := &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}
-			jobs = append(jobs, &Job{Cmd: "echo 1", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: req, Retries: uint8(0), RepGroup: "test"})
-			jobs = append(jobs, &Job{Cmd: "echo 2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: req, Retries: uint8(0), RepGroup: "test"})
-			ids, err := jq.AddAndReturnIDs(jobs, envVars, true)
-			So(err, ShouldBeNil)
-			So(len(ids), ShouldEqual, 2)
-			So(ids[0], ShouldEqual, "9a456dee1e351f82e3d562769c27d803")
-			So(ids[1], ShouldEqual, "2bb7055e49e21ea85066899a5ba38d8e")
+				err = jq.RemoveUser("alice")
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrMissingUser)
+			})
 		})
 
 		Convey("You can connect to the server and add jobs to the queue", func() {
@@ -1012,6 +2980,55 @@ func TestJobqueueBasics(t *testing.T) {
 				So(len(jobs), ShouldEqual, 0)
 			})
 
+			Convey("You can get events describing their state changes", func() {
+				events, seq, err := jq.GetEvents(nil, 0, 0)
+				So(err, ShouldBeNil)
+				So(len(events), ShouldEqual, 10)
+				So(seq, ShouldEqual, events[9].Seq)
+				for _, event := range events {
+					So(event.RepGroup, ShouldEqual, "manually_added")
+					So(event.FromState, ShouldEqual, JobStateNew)
+					So(event.ToState, ShouldEqual, JobStateReady)
+				}
+
+				events, seq2, err := jq.GetEvents(nil, seq, 10*time.Millisecond)
+				So(err, ShouldBeNil)
+				So(len(events), ShouldEqual, 0)
+				So(seq2, ShouldEqual, seq)
+
+				events, _, err = jq.GetEvents(&EventFilter{RepGroupPrefix: "manually"}, 0, 0)
+				So(err, ShouldBeNil)
+				So(len(events), ShouldEqual, 10)
+
+				events, _, err = jq.GetEvents(&EventFilter{RepGroupPrefix: "foo"}, 0, 10*time.Millisecond)
+				So(err, ShouldBeNil)
+				So(len(events), ShouldEqual, 0)
+
+				_, _, err = jq.GetEvents(&EventFilter{States: []JobState{JobStateReserved}}, 0, 0)
+				So(err, ShouldNotBeNil)
+
+				job, err := jq.ReserveScheduled(50*time.Millisecond, "1024:240:1:0")
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+
+				events, seq, err = jq.GetEvents(&EventFilter{States: []JobState{JobStateRunning}}, seq, 1*time.Second)
+				So(err, ShouldBeNil)
+				So(len(events), ShouldEqual, 1)
+				So(events[0].Key, ShouldEqual, job.Key())
+				So(events[0].FromState, ShouldEqual, JobStateReady)
+				So(events[0].ToState, ShouldEqual, JobStateRunning)
+
+				err = jq.Bury(job, nil, "test")
+				So(err, ShouldBeNil)
+
+				events, _, err = jq.GetEvents(nil, seq, 1*time.Second)
+				So(err, ShouldBeNil)
+				So(len(events), ShouldEqual, 1)
+				So(events[0].FromState, ShouldEqual, JobStateRunning)
+				So(events[0].ToState, ShouldEqual, JobStateBuried)
+				So(events[0].FailReason, ShouldEqual, "test")
+			})
+
 			Convey("You can store their (fake) runtime stats and get recommendations", func() {
 				// these are ignored by the learning system unless the job
 				// failed due to running out of a resource
@@ -1357,6 +3374,145 @@ func TestJobqueueBasics(t *testing.T) {
 		})
 	})
 
+	Convey("A standby server replicates the server, and takes over when it dies", t, func() {
+		server, _, token, errs = serve(ctx, serverConfig)
+		So(errs, ShouldBeNil)
+
+		jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+		So(err, ShouldBeNil)
+		defer disconnect(jq)
+
+		var jobs []*Job
+		jobs = append(jobs, &Job{Cmd: "echo standby", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "standby"})
+		inserts, _, err := jq.Add(jobs, envVars, true)
+		So(err, ShouldBeNil)
+		So(inserts, ShouldEqual, 1)
+
+		origInterval := StandbyInterval
+		StandbyInterval = 100 * time.Millisecond
+		defer func() {
+			StandbyInterval = origInterval
+		}()
+
+		// (development dbs are normally wiped when a server starts)
+		wipeDevDBOnInit = false
+		defer func() {
+			wipeDevDBOnInit = true
+		}()
+
+		standbyServerConfig := serverConfig
+		standbyServerConfig.DBFile = config.ManagerDBFile + ".standby_test"
+		replica := standbyServerConfig.DBFile + ".replica"
+		defer os.Remove(standbyServerConfig.DBFile)
+		defer os.Remove(replica)
+
+		standbyCh := make(chan *Server, 1)
+		errCh := make(chan error, 1)
+		go func() {
+			s, _, _, errs := Standby(ctx, StandbyConfig{PrimaryAddr: addr, Addr: addr, ReplicaFile: replica}, standbyServerConfig)
+			standbyCh <- s
+			errCh <- errs
+		}()
+
+		replicated := false
+		limit := time.After(5 * time.Second)
+	WAIT:
+		for {
+			select {
+			case <-time.After(50 * time.Millisecond):
+				if _, errs := os.Stat(replica); errs == nil {
+					replicated = true
+					break WAIT
+				}
+			case <-limit:
+				break WAIT
+			}
+		}
+		So(replicated, ShouldBeTrue)
+
+		// once the standby has the snapshot it asks for the changes since, so
+		// the primary deletes the snapshot
+		snapshot := config.ManagerDBFile + ".standby"
+		caughtUp := false
+		limit = time.After(5 * time.Second)
+	CAUGHTUP:
+		for {
+			select {
+			case <-time.After(50 * time.Millisecond):
+				if _, errs := os.Stat(snapshot); errs != nil {
+					caughtUp = true
+					break CAUGHTUP
+				}
+			case <-limit:
+				break CAUGHTUP
+			}
+		}
+		So(caughtUp, ShouldBeTrue)
+
+		// later changes are replicated without another snapshot
+		jobs = []*Job{{Cmd: "echo standby 2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "standby"}}
+		inserts, _, err = jq.Add(jobs, envVars, true)
+		So(err, ShouldBeNil)
+		So(inserts, ShouldEqual, 1)
+
+		<-time.After(5 * StandbyInterval)
+		_, err = os.Stat(snapshot)
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		si, err := jq.Ping(clientConnectTime)
+		So(err, ShouldBeNil)
+		So(si.Standby, ShouldEqual, addr)
+
+		server.Stop(ctx, true)
+
+		var standbyServer *Server
+		select {
+		case standbyServer = <-standbyCh:
+			So(<-errCh, ShouldBeNil)
+		case <-time.After(10 * time.Second):
+		}
+		So(standbyServer, ShouldNotBeNil)
+		defer standbyServer.Stop(ctx, true)
+
+		err = jq.reconnect(clientConnectTime)
+		So(err, ShouldBeNil)
+
+		got, err := jq.GetByRepGroup("standby", false, 0, JobStateReady, false, false)
+		So(err, ShouldBeNil)
+		So(len(got), ShouldEqual, 2)
+		cmds := []string{got[0].Cmd, got[1].Cmd}
+		sort.Strings(cmds)
+		So(cmds, ShouldResemble, []string{"echo standby", "echo standby 2"})
+		So(jq.ServerInfo.Term, ShouldEqual, si.Term+1)
+
+		// a server that hears of a higher term than its own must have been
+		// taken over from, so stops
+		jq.term++
+		_, err = jq.Ping(clientConnectTime)
+		So(err, ShouldNotBeNil)
+		jqerr, ok := err.(Error)
+		So(ok, ShouldBeTrue)
+		So(jqerr.Err, ShouldEqual, ErrFenced)
+
+		stopped := false
+		limit = time.After(10 * time.Second)
+	STOPPED:
+		for {
+			select {
+			case <-time.After(50 * time.Millisecond):
+				if c, errc := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime); errc != nil {
+					stopped = true
+					break STOPPED
+				} else {
+					disconnect(c)
+				}
+			case <-limit:
+				break STOPPED
+			}
+		}
+		So(stopped, ShouldBeTrue)
+	})
+
 	if server != nil {
 		server.Stop(ctx, true)
 	}
@@ -2244,6 +4400,73 @@ func TestJobqueueMedium(t *testing.T) {
 					So(len(jobs), ShouldEqual, 0)
 				})
 
+				Convey("CopyToManager behaviours copy files to the server", func() {
+					jobs = nil
+					cwd, err := os.MkdirTemp("", "wr_jobqueue_test_runner_dir_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(cwd)
+					copyDir, err := os.MkdirTemp("", "wr_jobqueue_test_copy_dir_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(copyDir)
+					server.copyDir = copyDir
+
+					b1 := &Behaviour{When: OnSuccess, Do: CleanupAll}
+					b2 := &Behaviour{When: OnExit, Do: CopyToManager, Arg: []string{"qc.txt", "sub/qc2.txt"}}
+					b3 := &Behaviour{When: OnSuccess, Do: CopyToManager, Arg: []string{"../escape.txt"}}
+					jobs = append(jobs, &Job{Cmd: "echo a > qc.txt && mkdir sub && echo b > sub/qc2.txt", Cwd: cwd, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "copies", Behaviours: Behaviours{b1, b2}})
+					jobs = append(jobs, &Job{Cmd: "echo c > qc.txt", Cwd: cwd, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "escapes", Behaviours: Behaviours{b3}})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.RepGroup, ShouldEqual, "copies")
+					err = jq.Execute(ctx, job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					So(job.State, ShouldEqual, JobStateComplete)
+
+					// copying happened before the cleanup
+					entries, err := os.ReadDir(cwd)
+					So(err, ShouldBeNil)
+					So(len(entries), ShouldEqual, 0)
+
+					job, err = jq.GetByEssence(&JobEssence{JobKey: job.Key()}, false, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.CopiedFiles, ShouldResemble, []string{"qc.txt", "sub/qc2.txt"})
+
+					content, err := jq.GetCopiedFile(job.Key(), "qc.txt")
+					So(err, ShouldBeNil)
+					So(string(content), ShouldEqual, "a\n")
+					content, err = jq.GetCopiedFile(job.Key(), "sub/qc2.txt")
+					So(err, ShouldBeNil)
+					So(string(content), ShouldEqual, "b\n")
+
+					_, err = jq.GetCopiedFile(job.Key(), "foo.txt")
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrMissingFile)
+
+					_, err = jq.GetCopiedFile(job.Key(), "../../../../etc/passwd")
+					So(err, ShouldNotBeNil)
+					jqerr, ok = err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrBadRequest)
+
+					job, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.RepGroup, ShouldEqual, "escapes")
+					err = jq.Execute(ctx, job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+
+					job, err = jq.GetByEssence(&JobEssence{JobKey: job.Key()}, false, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.CopiedFiles, ShouldBeEmpty)
+				})
+
 				Convey("Jobs that take longer than the ttr can execute successfully, even if clienttouchinterval is > ttr", func() {
 					jobs = nil
 					cmd := "perl -e 'for (1..3) { sleep(1) }'"
@@ -3033,6 +5256,98 @@ func TestJobqueueMedium(t *testing.T) {
 			})
 		})
 
+		Convey("You can add jobs with dependency modes and failure actions", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			dA := NewDepGroupDependency("dm_a")
+			dF := NewDepGroupDependency("dm_f")
+			var jobs []*Job
+			jobs = append(jobs, &Job{Cmd: "echo depmode a", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_a", DepGroups: []string{"dm_a"}})
+			jobs = append(jobs, &Job{Cmd: "echo depmode b", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_b", DepGroups: []string{"dm_b"}, Dependencies: Dependencies{dA}, OnDepFailure: DepFailureBury})
+			jobs = append(jobs, &Job{Cmd: "echo depmode c", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_c", Dependencies: Dependencies{NewConditionalDependency(dA, DepModeFailure)}, OnDepFailure: DepFailureDelete})
+			jobs = append(jobs, &Job{Cmd: "echo depmode d", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_d", Dependencies: Dependencies{NewConditionalDependency(dA, DepModeAny)}})
+			jobs = append(jobs, &Job{Cmd: "echo depmode e", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_e", Dependencies: Dependencies{NewDepGroupDependency("dm_b")}})
+			jobs = append(jobs, &Job{Cmd: "echo depmode f", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_f", DepGroups: []string{"dm_f"}, Dependencies: Dependencies{dA}, OnDepFailure: DepFailureDelete})
+			jobs = append(jobs, &Job{Cmd: "echo depmode g", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_g", Dependencies: Dependencies{dF}})
+			inserts, already, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 7)
+			So(already, ShouldEqual, 0)
+
+			So(jobs[2].Dependencies.Stringify(), ShouldResemble, []string{"dm_a:failure"})
+
+			stateOf := func(repGroup string) JobState {
+				gottenJobs, errg := jq.GetByRepGroup(repGroup, false, 0, "", false, false)
+				So(errg, ShouldBeNil)
+				if len(gottenJobs) == 0 {
+					return JobStateDeleted
+				}
+				So(len(gottenJobs), ShouldEqual, 1)
+				return gottenJobs[0].State
+			}
+
+			jA, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(jA.RepGroup, ShouldEqual, "dm_a")
+			jNil, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(jNil, ShouldBeNil)
+
+			Convey("Burying the upstream job triggers failure modes and actions", func() {
+				err = jq.Bury(jA, nil, "test")
+				So(err, ShouldBeNil)
+
+				<-time.After(100 * time.Millisecond)
+
+				So(stateOf("dm_c"), ShouldEqual, JobStateReady)
+				So(stateOf("dm_d"), ShouldEqual, JobStateReady)
+				So(stateOf("dm_b"), ShouldEqual, JobStateBuried)
+				So(stateOf("dm_e"), ShouldEqual, JobStateDependent)
+				So(stateOf("dm_f"), ShouldEqual, JobStateDeleted)
+				So(stateOf("dm_g"), ShouldEqual, JobStateDeleted)
+
+				gottenJobs, err := jq.GetByRepGroup("dm_b", false, 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(gottenJobs[0].FailReason, ShouldEqual, FailReasonDeps)
+			})
+
+			Convey("Completing the upstream job triggers success modes and actions", func() {
+				err = jq.Execute(ctx, jA, config.RunnerExecShell)
+				So(err, ShouldBeNil)
+
+				<-time.After(100 * time.Millisecond)
+
+				So(stateOf("dm_b"), ShouldEqual, JobStateReady)
+				So(stateOf("dm_d"), ShouldEqual, JobStateReady)
+				So(stateOf("dm_f"), ShouldEqual, JobStateReady)
+				So(stateOf("dm_c"), ShouldEqual, JobStateDeleted)
+				So(stateOf("dm_e"), ShouldEqual, JobStateDependent)
+				So(stateOf("dm_g"), ShouldEqual, JobStateDependent)
+
+				Convey("Failure mode dependents added afterwards can't be satisfied", func() {
+					dAEssence := NewEssenceDependency("echo depmode a", "")
+					var later []*Job
+					later = append(later, &Job{Cmd: "echo depmode h", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_h", Dependencies: Dependencies{NewConditionalDependency(dA, DepModeFailure)}, OnDepFailure: DepFailureBury})
+					later = append(later, &Job{Cmd: "echo depmode i", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_i", Dependencies: Dependencies{NewConditionalDependency(dAEssence, DepModeFailure)}, OnDepFailure: DepFailureDelete})
+					later = append(later, &Job{Cmd: "echo depmode j", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_j", Dependencies: Dependencies{NewConditionalDependency(dA, DepModeFailure)}})
+					later = append(later, &Job{Cmd: "echo depmode k", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dm_k", Dependencies: Dependencies{NewConditionalDependency(dAEssence, DepModeAny)}})
+					inserts, already, err = jq.Add(later, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 4)
+					So(already, ShouldEqual, 0)
+
+					<-time.After(100 * time.Millisecond)
+
+					So(stateOf("dm_h"), ShouldEqual, JobStateBuried)
+					So(stateOf("dm_i"), ShouldEqual, JobStateDeleted)
+					So(stateOf("dm_j"), ShouldEqual, JobStateDependent)
+					So(stateOf("dm_k"), ShouldEqual, JobStateReady)
+				})
+			})
+		})
+
 		Reset(func() {
 			server.Stop(ctx, true)
 		})
@@ -5641,7 +7956,7 @@ func TestJobqueueWithOpenStack(t *testing.T) {
 	}
 
 	resourceName := "wr-testing-" + localUser
-	cloudConfig := &jqs.ConfigOpenStack{
+	cloudConfig := &jqs.ConfigCloud{
 		ResourceName:         resourceName,
 		OSPrefix:             osPrefix,
 		OSUser:               osUser,
@@ -7152,7 +9467,7 @@ func TestJobqueueSpeed(t *testing.T) {
 
 		// ... Instead we bypass the client interface and directly add to
 		// bolt db
-		err = server.db.bolt.Batch(func(tx *bolt.Tx) error {
+		err = server.db.journal.dbStore.(*boltStore).batch(func(tx *bolt.Tx) error {
 			bl := tx.Bucket(bucketJobsLive)
 			b := tx.Bucket(bucketJobsComplete)
 
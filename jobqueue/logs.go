@@ -0,0 +1,252 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for runners to stream the output of the Cmds
+// they Execute() to the server.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+const (
+	// logStreamPendingLimit is the maximum number of bytes of output a
+	// logStreamer holds on to while it is unable to send it to the server.
+	// Older output is discarded beyond this.
+	logStreamPendingLimit = 1024 * 1024
+
+	// logStreamMergeLimit is the size beyond which a logStreamer stops adding
+	// output to its last pending chunk and starts a new one.
+	logStreamMergeLimit = 64 * 1024
+)
+
+// logPart is output pending being sent to the server.
+type logPart struct {
+	stream string
+	data   []byte
+}
+
+// logStreamer collects output written to the io.Writers it provides, and
+// regularly sends it to the server.
+type logStreamer struct {
+	client  *Client
+	job     *Job
+	pending []*logPart
+	size    int
+	skipped int
+	stop    chan struct{}
+	done    chan struct{}
+	sync.Mutex
+}
+
+// newLogStreamer creates a logStreamer that will send output for the given Job
+// using the given Client, once start()ed.
+func newLogStreamer(c *Client, job *Job) *logStreamer {
+	return &logStreamer{
+		client: c,
+		job:    job,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// writer returns an io.Writer that adds everything written to it to the given
+// stream (LogStreamStdout or LogStreamStderr). It never returns an error.
+func (ls *logStreamer) writer(stream string) io.Writer {
+	return &logStreamWriter{ls: ls, stream: stream}
+}
+
+// add stores a copy of the given output as pending for the given stream,
+// discarding the oldest pending output if we're holding on to too much.
+func (ls *logStreamer) add(stream string, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	ls.Lock()
+	defer ls.Unlock()
+
+	if n := len(ls.pending); n > 0 {
+		if last := ls.pending[n-1]; last.stream == stream && len(last.data) < logStreamMergeLimit {
+			last.data = append(last.data, p...)
+			ls.size += len(p)
+			ls.limit()
+
+			return
+		}
+	}
+
+	ls.pending = append(ls.pending, &logPart{stream: stream, data: append([]byte(nil), p...)})
+	ls.size += len(p)
+	ls.limit()
+}
+
+// limit discards the oldest pending output until we're under
+// logStreamPendingLimit, always keeping the latest. You must hold the lock.
+func (ls *logStreamer) limit() {
+	drop := 0
+	for ls.size > logStreamPendingLimit && drop < len(ls.pending)-1 {
+		ls.size -= len(ls.pending[drop].data)
+		ls.skipped += len(ls.pending[drop].data)
+		drop++
+	}
+
+	if drop > 0 {
+		ls.pending = append([]*logPart(nil), ls.pending[drop:]...)
+	}
+}
+
+// start begins sending pending output to the server every interval, until
+// finish() is called.
+func (ls *logStreamer) start(ctx context.Context, interval time.Duration) {
+	go func() {
+		defer close(ls.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ls.flush(ctx)
+			case <-ls.stop:
+				ls.flush(ctx)
+
+				return
+			}
+		}
+	}()
+}
+
+// finish stops regular sending, and sends any remaining pending output to the
+// server, returning once that has been attempted.
+func (ls *logStreamer) finish() {
+	close(ls.stop)
+	<-ls.done
+}
+
+// flush sends all pending output to the server. If this fails, the output is
+// kept to be sent next time.
+func (ls *logStreamer) flush(ctx context.Context) {
+	ls.Lock()
+	parts, skipped := ls.pending, ls.skipped
+	ls.pending, ls.size, ls.skipped = nil, 0, 0
+	ls.Unlock()
+
+	if len(parts) == 0 {
+		return
+	}
+
+	chunks := make([]*LogChunk, 0, len(parts)+1)
+	if skipped > 0 {
+		chunks = append(chunks, &LogChunk{
+			Stream: LogStreamStderr,
+			Data:   fmt.Sprintf("[wr: %d bytes of output could not be sent]\n", skipped),
+		})
+	}
+
+	for _, part := range parts {
+		chunks = append(chunks, &LogChunk{Stream: part.stream, Data: string(part.data)})
+	}
+
+	err := ls.client.sendLogs(ls.job, chunks)
+	if err == nil {
+		return
+	}
+
+	clog.Warn(ctx, "could not stream output", "err", err)
+
+	ls.Lock()
+	defer ls.Unlock()
+
+	for _, part := range parts {
+		ls.size += len(part.data)
+	}
+
+	ls.pending = append(parts, ls.pending...)
+	ls.skipped += skipped
+	ls.limit()
+}
+
+// logStreamWriter is the io.Writer returned by logStreamer.writer().
+type logStreamWriter struct {
+	ls     *logStreamer
+	stream string
+}
+
+// Write adds p to our logStreamer's pending output.
+func (w *logStreamWriter) Write(p []byte) (int, error) {
+	w.ls.add(w.stream, p)
+
+	return len(p), nil
+}
+
+// StreamLogs makes subsequent Execute() calls send the output of each Cmd to
+// the server every interval while it runs, so that it can be tailed with
+// GetLogs(). Supply an interval of 0 to stop streaming.
+//
+// Regardless, only the first and last 4KB of output are stored in the Job's
+// StdOut and StdErr once it exits.
+func (c *Client) StreamLogs(interval time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.logInterval = interval
+}
+
+// sendLogs sends the given output of the given Job's Cmd to the server.
+func (c *Client) sendLogs(job *Job, chunks []*LogChunk) error {
+	job.RLock()
+	defer job.RUnlock()
+
+	_, err := c.request(&clientRequest{Method: "jlog", Job: job, LogChunks: chunks})
+
+	return err
+}
+
+// GetLogs gets the output of the Cmd of the Job with the given key, streamed to
+// the server after the LogChunk with the given Seq by a runner that was told to
+// StreamLogs(). Supply 0 to get all the output the server still remembers,
+// which is only the most recent output if the Cmd is still running. If the Cmd
+// is not running and the server persisted its output (see
+// ServerConfig.JobLogMaxSize), you instead get the full output, one chunk each
+// for STDOUT and STDERR.
+//
+// If there is no such output and the Cmd is running, waits up to the given
+// wait duration for some to arrive. This must be less than the timeout you
+// supplied to Connect(). If wait is 0, returns immediately.
+//
+// Also returns the Seq of the latest chunk, which you should supply to your
+// next call to get only output you haven't seen before, and whether more
+// output may arrive (because the Job is running).
+//
+// Only the Job's owner and admins can get its output.
+func (c *Client) GetLogs(key string, since uint64, wait time.Duration) ([]*LogChunk, uint64, bool, error) {
+	resp, err := c.request(&clientRequest{Method: "getlogs", Keys: []string{key}, EventSeq: since, Timeout: wait})
+	if err != nil {
+		return nil, since, false, err
+	}
+
+	return resp.LogChunks, resp.EventSeq, resp.LogsLive, err
+}
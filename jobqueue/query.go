@@ -0,0 +1,433 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to filtering, sorting and paging
+// through the results of job queries.
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// JobSortKey describes what property of Jobs to sort query results by.
+type JobSortKey string
+
+// JobSortKey* constants are the properties Jobs can be sorted by. JobSortByKey
+// is the default, and is also used to order Jobs that are otherwise equal.
+const (
+	JobSortByKey      JobSortKey = "key"
+	JobSortByStart    JobSortKey = "start"
+	JobSortByEnd      JobSortKey = "end"
+	JobSortByPeakRAM  JobSortKey = "peakram"
+	JobSortByExitCode JobSortKey = "exitcode"
+)
+
+// JobFilter describes the properties Jobs must have to be returned by a query.
+// Jobs must match all the properties that are set.
+type JobFilter struct {
+	// Host matches the Host, HostID or HostIP of the Job.
+	Host string
+
+	// ExitCode, if set, matches Jobs that exited with this exit code.
+	ExitCode *int
+
+	// FailReason matches Jobs with a FailReason that contains this sub-string.
+	FailReason string
+
+	// StartedAfter and StartedBefore match Jobs that started (most recently)
+	// within this time range.
+	StartedAfter  time.Time
+	StartedBefore time.Time
+
+	// EndedAfter and EndedBefore match Jobs that ended (most recently) within
+	// this time range.
+	EndedAfter  time.Time
+	EndedBefore time.Time
+
+	// LimitGroup matches Jobs that are in this limit group.
+	LimitGroup string
+
+	// DepGroup matches Jobs that are in this dependency group.
+	DepGroup string
+}
+
+// Matches tells you if the given Job has all the properties specified by this
+// filter.
+func (f *JobFilter) Matches(job *Job) bool {
+	if f == nil {
+		return true
+	}
+
+	job.RLock()
+	defer job.RUnlock()
+
+	switch {
+	case f.Host != "" && job.Host != f.Host && job.HostID != f.Host && job.HostIP != f.Host:
+		return false
+	case f.ExitCode != nil && (!job.Exited || job.Exitcode != *f.ExitCode):
+		return false
+	case f.FailReason != "" && !strings.Contains(job.FailReason, f.FailReason):
+		return false
+	case !timeInRange(job.StartTime, f.StartedAfter, f.StartedBefore):
+		return false
+	case !timeInRange(job.EndTime, f.EndedAfter, f.EndedBefore):
+		return false
+	case f.LimitGroup != "" && !stringInSlice(f.LimitGroup, job.LimitGroups):
+		return false
+	case f.DepGroup != "" && !stringInSlice(f.DepGroup, job.DepGroups):
+		return false
+	}
+
+	return true
+}
+
+// timeInRange tells you if t is not before after and not after before, where
+// the latter two are ignored if zero. Zero t is never in a range.
+func timeInRange(t, after, before time.Time) bool {
+	if after.IsZero() && before.IsZero() {
+		return true
+	}
+	if t.IsZero() {
+		return false
+	}
+	return !t.Before(after) && (before.IsZero() || !t.After(before))
+}
+
+// stringInSlice tells you if str is one of the strings in slice.
+func stringInSlice(str string, slice []string) bool {
+	for _, s := range slice {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// JobQuery describes how to filter, sort and page through the results of
+// getting Jobs. See Client.QueryJobs().
+type JobQuery struct {
+	// Filter, if set, restricts results to matching Jobs.
+	Filter *JobFilter
+
+	// SortBy is the property to sort results by, defaulting to JobSortByKey.
+	SortBy JobSortKey
+
+	// Desc reverses the sort order.
+	Desc bool
+
+	// PageSize, if greater than 0, is the maximum number of Jobs to return.
+	PageSize int
+
+	// Cursor is the cursor returned alongside the previous page of results, to
+	// get the next page. Leave blank to get the first page.
+	Cursor string
+}
+
+// validate checks that the SortBy and Cursor of this query are valid.
+func (q *JobQuery) validate() error {
+	switch q.SortBy {
+	case "", JobSortByKey, JobSortByStart, JobSortByEnd, JobSortByPeakRAM, JobSortByExitCode:
+	default:
+		return fmt.Errorf("invalid sort key '%s'", q.SortBy)
+	}
+
+	if q.PageSize < 0 {
+		return fmt.Errorf("page size can't be negative")
+	}
+
+	_, err := q.decodeCursor()
+	return err
+}
+
+// sorted tells you if this query needs its results to be sorted.
+func (q *JobQuery) sorted() bool {
+	return q.SortBy != "" || q.Desc || q.PageSize > 0 || q.Cursor != ""
+}
+
+// jobSortValue is the value of a Job we sort by, with the Job's key used to
+// break ties.
+type jobSortValue struct {
+	value int64
+	key   string
+}
+
+// less tells you if v sorts before o.
+func (v jobSortValue) less(o jobSortValue) bool {
+	if v.value != o.value {
+		return v.value < o.value
+	}
+	return v.key < o.key
+}
+
+// sortValue returns the value of the given Job we sort by.
+func (q *JobQuery) sortValue(job *Job) jobSortValue {
+	job.RLock()
+	defer job.RUnlock()
+
+	var value int64
+	switch q.SortBy {
+	case JobSortByStart:
+		value = unixNanoOrZero(job.StartTime)
+	case JobSortByEnd:
+		value = unixNanoOrZero(job.EndTime)
+	case JobSortByPeakRAM:
+		value = int64(job.PeakRAM)
+	case JobSortByExitCode:
+		value = int64(job.Exitcode)
+	}
+
+	return jobSortValue{value: value, key: job.Key()}
+}
+
+// unixNanoOrZero returns t as nanoseconds since the Unix epoch, or 0 if t is
+// zero.
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// encodeCursor creates an opaque cursor string for the given sort value.
+func (q *JobQuery) encodeCursor(v jobSortValue) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s.%d.%s", q.sortKey(), v.value, v.key)))
+}
+
+// decodeCursor parses our Cursor, returning nil if it is blank.
+func (q *JobQuery) decodeCursor() (*jobSortValue, error) {
+	if q.Cursor == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	parts := strings.SplitN(string(b), ".", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	if JobSortKey(parts[0]) != q.sortKey() {
+		return nil, fmt.Errorf("cursor was for sorting by %s, not %s", parts[0], q.sortKey())
+	}
+
+	value, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	return &jobSortValue{value: value, key: parts[2]}, nil
+}
+
+// sortKey returns our SortBy, defaulting to JobSortByKey.
+func (q *JobQuery) sortKey() JobSortKey {
+	if q.SortBy == "" {
+		return JobSortByKey
+	}
+	return q.SortBy
+}
+
+// before tells you if v comes before o in the order this query sorts Jobs.
+func (q *JobQuery) before(v, o jobSortValue) bool {
+	if q.Desc {
+		return o.less(v)
+	}
+	return v.less(o)
+}
+
+// jobPager finds the page of Jobs that a JobQuery asks for from the candidate
+// Jobs offered to it one at a time, so that the server never has to hold on to
+// every Job that matches. When paging, no more than PageSize+1 candidates are
+// kept (the extra one telling us if there is another page). Candidates can be
+// offered as the Job stored in a queue item, in which case a copy of the Job is
+// only made for the client if it ends up in the page.
+type jobPager struct {
+	query   *JobQuery
+	after   *jobSortValue
+	entries pageEntries
+	keys    map[string]bool
+}
+
+// pageEntry is a candidate for a page of results.
+type pageEntry struct {
+	value jobSortValue
+	job   *Job
+	item  *queue.Item
+}
+
+// newJobPager returns a jobPager for the given (already validated) query.
+func newJobPager(query *JobQuery) *jobPager {
+	after, _ := query.decodeCursor() //nolint:errcheck
+	return &jobPager{
+		query:   query,
+		after:   after,
+		entries: pageEntries{query: query},
+		keys:    make(map[string]bool),
+	}
+}
+
+// paged tells you if we only keep a page of candidates.
+func (p *jobPager) paged() bool {
+	return p.query.sorted() && p.query.PageSize > 0
+}
+
+// full tells you if we already have enough candidates for a page and to know
+// that there is a next page.
+func (p *jobPager) full() bool {
+	return p.paged() && len(p.entries.entries) > p.query.PageSize
+}
+
+// wants tells you if a Job with the given sort value would currently be kept.
+func (p *jobPager) wants(v jobSortValue) bool {
+	if !p.query.sorted() {
+		return true
+	}
+
+	switch {
+	case p.keys[v.key]:
+		return false
+	case p.after != nil && !p.query.before(*p.after, v):
+		return false
+	case p.full() && !p.query.before(v, p.entries.entries[0].value):
+		return false
+	}
+
+	return true
+}
+
+// skipKey tells you if a Job with the given key would not be kept, when that
+// can be determined from the key alone (ie. when sorting by key), so that you
+// can avoid decoding or examining the Job.
+func (p *jobPager) skipKey(key string) bool {
+	if p.query.sortKey() != JobSortByKey {
+		return false
+	}
+	return !p.wants(jobSortValue{key: key})
+}
+
+// startKey returns the key that a source of Jobs offered in ascending key
+// order could start after, skipping Jobs that would not be kept.
+func (p *jobPager) startKey() string {
+	if p.after == nil || p.query.sortKey() != JobSortByKey || p.query.Desc {
+		return ""
+	}
+	return p.after.key
+}
+
+// doneAfter tells you if, when offering Jobs in ascending key order, no Job
+// with the given key or a later one could be kept, so you can stop.
+func (p *jobPager) doneAfter(key string) bool {
+	if p.query.sortKey() != JobSortByKey || p.query.Desc {
+		return false
+	}
+	return p.full() && !p.query.before(jobSortValue{key: key}, p.entries.entries[0].value)
+}
+
+// offer considers the given Job (which must be the Job in the given queue item,
+// if item is not nil), keeping it if it matches the query's filter and belongs
+// in the page.
+func (p *jobPager) offer(job *Job, item *queue.Item) {
+	if !p.query.Filter.Matches(job) {
+		return
+	}
+
+	var v jobSortValue
+	if p.query.sorted() {
+		v = p.query.sortValue(job)
+		if !p.wants(v) {
+			return
+		}
+		p.keys[v.key] = true
+	}
+
+	entry := &pageEntry{value: v, job: job, item: item}
+	if !p.paged() {
+		p.entries.entries = append(p.entries.entries, entry)
+		return
+	}
+
+	heap.Push(&p.entries, entry)
+	if len(p.entries.entries) > p.query.PageSize+1 {
+		worst := heap.Pop(&p.entries).(*pageEntry) //nolint:forcetypeassert
+		delete(p.keys, worst.value.key)
+	}
+}
+
+// page returns the kept candidates in sorted order, along with the cursor that
+// can be used to get the next page of results, which will be blank if there
+// are no more pages.
+func (p *jobPager) page() ([]*pageEntry, string) {
+	entries := p.entries.entries
+	if !p.query.sorted() {
+		return entries, ""
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return p.query.before(entries[i].value, entries[j].value)
+	})
+
+	var cursor string
+	if p.paged() && len(entries) > p.query.PageSize {
+		entries = entries[:p.query.PageSize]
+		cursor = p.query.encodeCursor(entries[len(entries)-1].value)
+	}
+
+	return entries, cursor
+}
+
+// pageEntries implements heap.Interface, with the entry that sorts last
+// according to the query at the top, so it can be dropped when we have too
+// many.
+type pageEntries struct {
+	query   *JobQuery
+	entries []*pageEntry
+}
+
+func (e pageEntries) Len() int {
+	return len(e.entries)
+}
+
+func (e pageEntries) Swap(a, b int) {
+	e.entries[a], e.entries[b] = e.entries[b], e.entries[a]
+}
+
+func (e pageEntries) Less(a, b int) bool {
+	return e.query.before(e.entries[b].value, e.entries[a].value)
+}
+
+func (e *pageEntries) Push(x any) {
+	e.entries = append(e.entries, x.(*pageEntry)) //nolint:forcetypeassert
+}
+
+func (e *pageEntries) Pop() any {
+	n := len(e.entries)
+	entry := e.entries[n-1]
+	e.entries = e.entries[:n-1]
+	return entry
+}
@@ -19,6 +19,7 @@
 package jobqueue
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
@@ -28,17 +29,24 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/cloud"
 	"github.com/VertebrateResequencing/wr/internal"
 	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/limiter"
 	"github.com/inconshreveable/log15"
 	. "github.com/smartystreets/goconvey/convey"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestREST(t *testing.T) {
@@ -82,6 +90,16 @@ func TestREST(t *testing.T) {
 	uploadEndPoint := baseURL + "/rest/v1/upload"
 	warningsEndPoint := baseURL + "/rest/v1/warnings/"
 	serversEndPoint := baseURL + "/rest/v1/servers/"
+	copiedEndPoint := baseURL + "/rest/v1/copied/"
+	metricsEndPoint := baseURL + "/metrics"
+	eventsEndPoint := baseURL + "/rest/v1/events/"
+	logsEndPoint := baseURL + "/rest/v1/logs/"
+	cronsEndPoint := baseURL + "/rest/v1/crons/"
+	limitsEndPoint := baseURL + "/rest/v1/limits/"
+	managerEndPoint := baseURL + "/rest/v1/manager/"
+	backupEndPoint := baseURL + "/rest/v1/backup/"
+	usersEndPoint := baseURL + "/rest/v1/users/"
+	openAPIEndPoint := baseURL + "/rest/v1/openapi.json"
 
 	setDomainIP(config.ManagerCertDomain)
 
@@ -136,6 +154,351 @@ func TestREST(t *testing.T) {
 			response, err = client.Do(req)
 			So(err, ShouldBeNil)
 			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+			req, err = http.NewRequest(http.MethodGet, copiedEndPoint, nil)
+			So(err, ShouldBeNil)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+			req, err = http.NewRequest(http.MethodGet, metricsEndPoint, nil)
+			So(err, ShouldBeNil)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+			req, err = http.NewRequest(http.MethodGet, eventsEndPoint, nil)
+			So(err, ShouldBeNil)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+			req, err = http.NewRequest(http.MethodGet, logsEndPoint+"de6d167c58701e55f5b9f9e1e91d7807", nil)
+			So(err, ShouldBeNil)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+			req, err = http.NewRequest(http.MethodGet, cronsEndPoint, nil)
+			So(err, ShouldBeNil)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+			for _, endpoint := range []string{limitsEndPoint, managerEndPoint, backupEndPoint, usersEndPoint} {
+				req, err = http.NewRequest(http.MethodGet, endpoint, nil)
+				So(err, ShouldBeNil)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+			}
+
+			req, err = http.NewRequest(http.MethodPost, managerEndPoint+"pause", nil)
+			So(err, ShouldBeNil)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("You can GET the OpenAPI document without authorisation", func() {
+			req, err := http.NewRequest(http.MethodGet, openAPIEndPoint, nil)
+			So(err, ShouldBeNil)
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+
+			var doc struct {
+				OpenAPI string                 `json:"openapi"`
+				Paths   map[string]interface{} `json:"paths"`
+			}
+			err = json.Unmarshal(responseData, &doc)
+			So(err, ShouldBeNil)
+			So(doc.OpenAPI, ShouldStartWith, "3.")
+			for _, path := range []string{restJobsEndpoint, restLimitsEndpoint + "{name}", restManagerEndpoint + "{action}", restBackupEndpoint, restCronsEndpoint} {
+				So(doc.Paths, ShouldContainKey, path)
+			}
+		})
+
+		Convey("You can GET and PUT limit groups", func() {
+			req, err := http.NewRequest(http.MethodPut, limitsEndPoint+"lg1?limit=3", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var limits map[string]int
+			err = json.Unmarshal(responseData, &limits)
+			So(err, ShouldBeNil)
+			So(limits, ShouldResemble, map[string]int{"lg1": 3})
+
+			limit, err := jq.GetOrSetLimitGroup("lg1")
+			So(err, ShouldBeNil)
+			So(limit, ShouldEqual, 3)
+
+			req, err = http.NewRequest(http.MethodGet, limitsEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err = io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			limits = nil
+			err = json.Unmarshal(responseData, &limits)
+			So(err, ShouldBeNil)
+			So(limits["lg1"], ShouldEqual, 3)
+
+			req, err = http.NewRequest(http.MethodGet, limitsEndPoint+"unknown", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err = io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			limits = nil
+			err = json.Unmarshal(responseData, &limits)
+			So(err, ShouldBeNil)
+			So(limits, ShouldResemble, map[string]int{"unknown": -1})
+
+			req, err = http.NewRequest(http.MethodGet, limitsEndPoint+"lg1:5", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			for _, bad := range []string{"lg1", "lg1?limit=foo", "?limit=1"} {
+				req, err = http.NewRequest(http.MethodPut, limitsEndPoint+bad, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+			}
+		})
+
+		Convey("You can POST to pause and resume the manager", func() {
+			req, err := http.NewRequest(http.MethodPost, managerEndPoint+"pause", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var stats ServerStats
+			err = json.Unmarshal(responseData, &stats)
+			So(err, ShouldBeNil)
+			So(stats.Running, ShouldEqual, 0)
+
+			server.ssmutex.RLock()
+			So(server.ServerInfo.Mode, ShouldEqual, ServerModePause)
+			server.ssmutex.RUnlock()
+
+			req, err = http.NewRequest(http.MethodPost, managerEndPoint+"resume", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+
+			server.ssmutex.RLock()
+			So(server.ServerInfo.Mode, ShouldEqual, ServerModeNormal)
+			server.ssmutex.RUnlock()
+
+			req, err = http.NewRequest(http.MethodPost, managerEndPoint+"foo", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			req, err = http.NewRequest(http.MethodGet, managerEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("You can GET a backup of the database", func() {
+			req, err := http.NewRequest(http.MethodGet, backupEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			So(len(responseData), ShouldBeGreaterThan, 0)
+
+			path := filepath.Join(dir, "rest.db")
+			err = os.WriteFile(path, responseData, 0600)
+			So(err, ShouldBeNil)
+			db, err := bolt.Open(path, dbFilePermission, nil)
+			So(err, ShouldBeNil)
+			err = db.Close()
+			So(err, ShouldBeNil)
+		})
+
+		Convey("You can have job events POSTed to webhooks", func() {
+			hooks, err := ParseWebhooks("http://localhost/a|rp|ready,buried; https://localhost/b")
+			So(err, ShouldBeNil)
+			So(len(hooks), ShouldEqual, 2)
+			So(hooks[0].URL, ShouldEqual, "http://localhost/a")
+			So(hooks[0].Filter.RepGroupPrefix, ShouldEqual, "rp")
+			So(hooks[0].Filter.States, ShouldResemble, []JobState{JobStateReady, JobStateBuried})
+			So(hooks[1].URL, ShouldEqual, "https://localhost/b")
+			So(hooks[1].Filter, ShouldBeNil)
+
+			_, err = ParseWebhooks("localhost/a")
+			So(err, ShouldNotBeNil)
+			_, err = ParseWebhooks("http://localhost/a|rp|foo")
+			So(err, ShouldNotBeNil)
+
+			origWait := ServerWebhookRetryWait
+			ServerWebhookRetryWait = 10 * time.Millisecond
+			defer func() {
+				ServerWebhookRetryWait = origWait
+			}()
+
+			var mu sync.Mutex
+			calls := 0
+			received := make(chan []*JobEvent, 1)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				calls++
+				first := calls == 1
+				mu.Unlock()
+				if first {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				var events []*JobEvent
+				errd := json.NewDecoder(r.Body).Decode(&events)
+				if errd == nil {
+					received <- events
+				}
+			}))
+			defer ts.Close()
+
+			go server.runWebhook(ctx, &Webhook{URL: ts.URL, Filter: &EventFilter{RepGroupPrefix: "hook"}})
+			<-time.After(50 * time.Millisecond)
+
+			_, _, err = jq.Add([]*Job{
+				{Cmd: "echo hook", Cwd: "/tmp", RepGroup: "hooked", Requirements: &jqs.Requirements{RAM: 1, Time: 1 * time.Second}},
+				{Cmd: "echo other", Cwd: "/tmp", RepGroup: "other", Requirements: &jqs.Requirements{RAM: 1, Time: 1 * time.Second}},
+			}, envVars, true)
+			So(err, ShouldBeNil)
+
+			select {
+			case events := <-received:
+				So(len(events), ShouldEqual, 1)
+				So(events[0].RepGroup, ShouldEqual, "hooked")
+				So(events[0].FromState, ShouldEqual, JobStateNew)
+				So(events[0].ToState, ShouldEqual, JobStateReady)
+			case <-time.After(2 * time.Second):
+				So(false, ShouldBeTrue)
+			}
+
+			mu.Lock()
+			So(calls, ShouldEqual, 2)
+			mu.Unlock()
+		})
+
+		Convey("You can GET files copied to the server by jobs", func() {
+			key := "de6d167c58701e55f5b9f9e1e91d7807"
+			err := server.storeCopiedFile(ctx, key, "sub/qc.txt", bytes.NewBufferString("qc data"))
+			So(err, ShouldBeNil)
+
+			req, err := http.NewRequest(http.MethodGet, copiedEndPoint+key+"/sub/qc.txt", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			So(string(responseData), ShouldEqual, "qc data")
+
+			req, err = http.NewRequest(http.MethodGet, copiedEndPoint+key+"/missing.txt", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			req, err = http.NewRequest(http.MethodGet, copiedEndPoint+key, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("You can GET the output of jobs as server-sent events", func() {
+			key := "de6d167c58701e55f5b9f9e1e91d7807"
+			server.logs.append(ctx, key, []*LogChunk{
+				{Stream: LogStreamStdout, Data: "out\n"},
+				{Stream: LogStreamStderr, Data: "err\n"},
+			})
+			defer server.logs.finish(ctx, key)
+
+			getChunks := func(query string) ([]*LogChunk, []string) {
+				req, err := http.NewRequest(http.MethodGet, logsEndPoint+key+query, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				defer response.Body.Close()
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+				So(response.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+
+				reader := bufio.NewReader(response.Body)
+				var chunks []*LogChunk
+				var ids []string
+				for {
+					line, errr := reader.ReadString('\n')
+					So(errr, ShouldBeNil)
+					if line == "event: end\n" {
+						break
+					}
+					switch {
+					case strings.HasPrefix(line, "id: "):
+						ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+					case strings.HasPrefix(line, "data: "):
+						chunk := &LogChunk{}
+						err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), chunk)
+						So(err, ShouldBeNil)
+						chunks = append(chunks, chunk)
+					}
+				}
+
+				return chunks, ids
+			}
+
+			chunks, ids := getChunks("")
+			So(len(chunks), ShouldEqual, 2)
+			So(chunks[0].Stream, ShouldEqual, LogStreamStdout)
+			So(chunks[0].Data, ShouldEqual, "out\n")
+			So(chunks[1].Stream, ShouldEqual, LogStreamStderr)
+			So(chunks[1].Data, ShouldEqual, "err\n")
+			So(ids, ShouldResemble, []string{"1", "2"})
+
+			chunks, _ = getChunks("?since=1")
+			So(len(chunks), ShouldEqual, 1)
+			So(chunks[0].Data, ShouldEqual, "err\n")
+
+			req, err := http.NewRequest(http.MethodGet, logsEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
 		})
 
 		Convey("Initial GET queries return nothing", func() {
@@ -156,7 +519,7 @@ func TestREST(t *testing.T) {
 		Convey("You can POST to add jobs to the queue", func() {
 			var inputJobs []*JobViaJSON
 			pri := 2
-			inputJobs = append(inputJobs, &JobViaJSON{Cmd: "echo 1 && true", RepGrp: "rp1", Retries: &pri, NoRetriesOverWalltime: "5m"})
+			inputJobs = append(inputJobs, &JobViaJSON{Cmd: "echo 1 && true", RepGrp: "rp1", Retries: &pri, NoRetriesOverWalltime: "5m", RetryPolicy: "backoff=1m;no_retry=2", Checkpoint: "dir=ckpt;grace=10s"})
 			inputJobs = append(inputJobs, &JobViaJSON{Cmd: "echo 2 && true", RepGrp: "rp2", Cwd: "/tmp/foo"})
 			cpus := float64(2)
 			inputJobs = append(inputJobs, &JobViaJSON{Cmd: "echo 3 && false", CwdMatters: true, RepGrp: "rp1", Memory: "50M", CPUs: &cpus, Time: "2m", Priority: &pri, Env: []string{"foo=bar", "test=case"}})
@@ -201,11 +564,14 @@ func TestREST(t *testing.T) {
 			So(job, ShouldNotBeNil)
 			So(job.Retries, ShouldEqual, 2)
 			So(job.NoRetriesOverWalltime, ShouldEqual, 5*time.Minute)
+			So(job.RetryPolicy, ShouldResemble, &RetryPolicy{Backoff: time.Minute, NoRetryExitCodes: []int{2}})
+			So(job.Checkpoint, ShouldResemble, &Checkpoint{Dir: "ckpt", Signal: syscall.SIGTERM, Grace: 10 * time.Second})
 			job, err = jq.GetByEssence(&JobEssence{Cmd: "echo 3 && false", Cwd: "/tmp"}, false, false)
 			So(err, ShouldBeNil)
 			So(job, ShouldNotBeNil)
 			So(job.Retries, ShouldEqual, 0)
 			So(job.NoRetriesOverWalltime, ShouldEqual, 0)
+			So(job.RetryPolicy, ShouldBeNil)
 
 			Convey("You can GET the current status of all jobs", func() {
 				req, err := http.NewRequest(http.MethodGet, jobsEndPoint, nil)
@@ -222,6 +588,72 @@ func TestREST(t *testing.T) {
 				So(len(jstati), ShouldEqual, 3)
 			})
 
+			Convey("You can GET metrics about the queue", func() {
+				server.limiter.SetLimit("lg1", *limiter.NewCountGroupData(5))
+
+				req, err := http.NewRequest(http.MethodGet, metricsEndPoint, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+				So(response.Header.Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+				responseData, err = io.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+
+				metrics := string(responseData)
+				So(metrics, ShouldContainSubstring, "# TYPE wr_queue_items gauge\nwr_queue_items 3\n")
+				So(metrics, ShouldContainSubstring, "wr_queue_subqueue_items{subqueue=\"ready\"} 3\n")
+				So(metrics, ShouldContainSubstring, "wr_queue_subqueue_items{subqueue=\"buried\"} 0\n")
+				So(metrics, ShouldContainSubstring, "wr_jobs{rep_group=\"rp1\",state=\"ready\"} 2\n")
+				So(metrics, ShouldContainSubstring, "wr_jobs{rep_group=\"rp2\",state=\"ready\"} 1\n")
+				So(metrics, ShouldContainSubstring, "wr_limit_group_limit{limit_group=\"lg1\"} 5\n")
+				So(metrics, ShouldContainSubstring, "wr_limit_group_usage{limit_group=\"lg1\"} 0\n")
+				So(metrics, ShouldContainSubstring, "wr_scheduler_issues 0\n")
+				So(metrics, ShouldContainSubstring, "wr_cloud_bad_servers 0\n")
+				So(metrics, ShouldNotContainSubstring, "wr_cloud_servers ")
+			})
+
+			Convey("You can GET job events as server-sent events", func() {
+				req, err := http.NewRequest(http.MethodGet, eventsEndPoint+"?since=0&rep_grp=rp1&state=ready", nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				defer response.Body.Close()
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+				So(response.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+
+				reader := bufio.NewReader(response.Body)
+				var events []*JobEvent
+				var ids []string
+				for len(events) < 2 {
+					line, errr := reader.ReadString('\n')
+					So(errr, ShouldBeNil)
+					switch {
+					case strings.HasPrefix(line, "id: "):
+						ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+					case strings.HasPrefix(line, "data: "):
+						event := &JobEvent{}
+						err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event)
+						So(err, ShouldBeNil)
+						events = append(events, event)
+					}
+				}
+
+				So(events[0].Key, ShouldEqual, "de6d167c58701e55f5b9f9e1e91d7807")
+				So(events[0].ToState, ShouldEqual, JobStateReady)
+				So(ids[0], ShouldEqual, strconv.FormatUint(events[0].Seq, 10))
+				So(events[1].Key, ShouldEqual, "db1e7d99becace3306c1c2470331c78e")
+
+				req, err = http.NewRequest(http.MethodGet, eventsEndPoint+"?state=foo", nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+
 			Convey("You can GET the status of particular jobs using their ids", func() {
 				req, err := http.NewRequest(http.MethodGet, jobsEndPoint+"/de6d167c58701e55f5b9f9e1e91d7807", nil)
 				So(err, ShouldBeNil)
@@ -289,6 +721,108 @@ func TestREST(t *testing.T) {
 				})
 			})
 
+			Convey("You can GET pages of jobs in sorted order", func() {
+				getPage := func(query string) ([]JStatus, string, int) {
+					req, err := http.NewRequest(http.MethodGet, jobsEndPoint+"/?"+query, nil)
+					So(err, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err := client.Do(req)
+					So(err, ShouldBeNil)
+					defer response.Body.Close()
+					if response.StatusCode != http.StatusOK {
+						return nil, "", response.StatusCode
+					}
+					responseData, err := io.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+
+					var jstati []JStatus
+					err = json.Unmarshal(responseData, &jstati)
+					So(err, ShouldBeNil)
+					return jstati, response.Header.Get(restNextCursorHeader), response.StatusCode
+				}
+
+				jstati, cursor, status := getPage("page_size=2")
+				So(status, ShouldEqual, http.StatusOK)
+				So(len(jstati), ShouldEqual, 2)
+				So(jstati[0].Key, ShouldEqual, "db1e7d99becace3306c1c2470331c78e")
+				So(jstati[1].Key, ShouldEqual, "de6d167c58701e55f5b9f9e1e91d7807")
+				So(cursor, ShouldNotBeBlank)
+
+				jstati, cursor, status = getPage("page_size=2&cursor=" + cursor)
+				So(status, ShouldEqual, http.StatusOK)
+				So(len(jstati), ShouldEqual, 1)
+				So(jstati[0].Key, ShouldEqual, "f5c0d6240167a6e0b803e23f74e3a085")
+				So(cursor, ShouldBeBlank)
+
+				jstati, _, status = getPage("sort=key&desc=true")
+				So(status, ShouldEqual, http.StatusOK)
+				So(len(jstati), ShouldEqual, 3)
+				So(jstati[0].Key, ShouldEqual, "f5c0d6240167a6e0b803e23f74e3a085")
+
+				_, _, status = getPage("sort=foo")
+				So(status, ShouldEqual, http.StatusBadRequest)
+				_, _, status = getPage("sort=start&limit=1")
+				So(status, ShouldEqual, http.StatusBadRequest)
+				_, _, status = getPage("page_size=2&cursor=foo")
+				So(status, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("You can PATCH jobs to modify them", func() {
+				mem := "2G"
+				pri := 5
+				mvj := &ModifierViaJSON{Memory: &mem, Priority: &pri}
+				jsonValue, err := json.Marshal(mvj)
+				So(err, ShouldBeNil)
+
+				req, err := http.NewRequest(http.MethodPatch, jobsEndPoint+"/rp2", bytes.NewBuffer(jsonValue))
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				req.Header.Add("Content-Type", "application/json")
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+				responseData, err = io.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+
+				var jstati []JStatus
+				err = json.Unmarshal(responseData, &jstati)
+				So(err, ShouldBeNil)
+				So(len(jstati), ShouldEqual, 1)
+				So(jstati[0].Key, ShouldEqual, "f5c0d6240167a6e0b803e23f74e3a085")
+				So(jstati[0].ExpectedRAM, ShouldEqual, 2048)
+
+				job, err := jq.GetByEssence(&JobEssence{Cmd: "echo 2 && true"}, false, false)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.Priority, ShouldEqual, 5)
+				So(job.Requirements.RAM, ShouldEqual, 2048)
+
+				newCmd := "echo 2 && false"
+				mvj = &ModifierViaJSON{Cmd: &newCmd}
+				jsonValue, err = json.Marshal(mvj)
+				So(err, ShouldBeNil)
+				req, err = http.NewRequest(http.MethodPatch, jobsEndPoint+"/rp1", bytes.NewBuffer(jsonValue))
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+				req, err = http.NewRequest(http.MethodPatch, jobsEndPoint+"/rp2", bytes.NewBuffer(jsonValue))
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				responseData, err = io.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+				jstati = nil
+				err = json.Unmarshal(responseData, &jstati)
+				So(err, ShouldBeNil)
+				So(len(jstati), ShouldEqual, 1)
+				So(jstati[0].Cmd, ShouldEqual, "echo 2 && false")
+				So(jstati[0].Key, ShouldNotEqual, "f5c0d6240167a6e0b803e23f74e3a085")
+			})
+
 			Convey("You can DELETE jobs by RepGroup", func() {
 				req, err := http.NewRequest(http.MethodDelete, jobsEndPoint+"/rp1", nil)
 				So(err, ShouldBeNil)
@@ -383,6 +917,22 @@ func TestREST(t *testing.T) {
 					So(jstati[0].State, ShouldEqual, JobStateBuried)
 					So(jstati[0].Started, ShouldNotBeNil)
 					So(jstati[0].Ended, ShouldBeNil)
+
+					req, err = http.NewRequest(http.MethodPut, jobsEndPoint+"/rp1", nil)
+					So(err, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err = client.Do(req)
+					So(err, ShouldBeNil)
+					So(response.StatusCode, ShouldEqual, http.StatusOK)
+					responseData, err = io.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+
+					jstati = []JStatus{}
+					err = json.Unmarshal(responseData, &jstati)
+					So(err, ShouldBeNil)
+					So(len(jstati), ShouldEqual, 1)
+					So(jstati[0].Key, ShouldEqual, "db1e7d99becace3306c1c2470331c78e")
+					So(jstati[0].State, ShouldEqual, JobStateReady)
 				})
 
 				Convey("You can DELETE lost jobs to bury them", func() {
@@ -490,6 +1040,35 @@ func TestREST(t *testing.T) {
 						So(jstati3[0].StdOut, ShouldEqual, "")
 					})
 
+					Convey("You can GET jobs filtered by exit code and start time", func() {
+						req, err := http.NewRequest(http.MethodGet, jobsEndPoint+"/rp1?exit_code=1", nil)
+						So(err, ShouldBeNil)
+						req.Header.Add("Authorization", bearer)
+						response, err := client.Do(req)
+						So(err, ShouldBeNil)
+						responseData, err := io.ReadAll(response.Body)
+						So(err, ShouldBeNil)
+
+						var jstati []JStatus
+						err = json.Unmarshal(responseData, &jstati)
+						So(err, ShouldBeNil)
+						So(len(jstati), ShouldEqual, 1)
+						So(jstati[0].Key, ShouldEqual, "db1e7d99becace3306c1c2470331c78e")
+
+						req, err = http.NewRequest(http.MethodGet, jobsEndPoint+"/?started_after="+strconv.FormatInt(t.Add(time.Hour).Unix(), 10), nil)
+						So(err, ShouldBeNil)
+						req.Header.Add("Authorization", bearer)
+						response, err = client.Do(req)
+						So(err, ShouldBeNil)
+						responseData, err = io.ReadAll(response.Body)
+						So(err, ShouldBeNil)
+
+						var jstati2 []JStatus
+						err = json.Unmarshal(responseData, &jstati2)
+						So(err, ShouldBeNil)
+						So(len(jstati2), ShouldEqual, 0)
+					})
+
 					Convey("You can GET all jobs by state and RepGroup", func() {
 						req, err := http.NewRequest(http.MethodGet, jobsEndPoint+"/rp1?state=ready", nil)
 						So(err, ShouldBeNil)
@@ -553,6 +1132,273 @@ func TestREST(t *testing.T) {
 			})
 		})
 
+		Convey("You can POST to add a job array to the queue", func() {
+			inputJobs := []*JobViaJSON{{
+				Cmd:         "echo {sample} {n}",
+				RepGrp:      "rpa",
+				ArrayTable:  [][]string{{"sample"}, {"a"}, {"b"}},
+				ArrayRanges: []string{"n=1-3"},
+			}}
+			jsonValue, err := json.Marshal(inputJobs)
+			So(err, ShouldBeNil)
+
+			req, err := http.NewRequest(http.MethodPost, jobsEndPoint+"/", bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			req.Header.Add("Content-Type", "application/json")
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var jstati []JStatus
+			err = json.Unmarshal(responseData, &jstati)
+			So(err, ShouldBeNil)
+			So(len(jstati), ShouldEqual, 6)
+
+			arrayID := jstati[0].ArrayID
+			So(len(arrayID), ShouldEqual, 32)
+			cmds := make(map[string]int)
+			for _, status := range jstati {
+				So(status.ArrayID, ShouldEqual, arrayID)
+				So(status.ArraySize, ShouldEqual, 6)
+				cmds[status.Cmd] = status.ArrayIndex
+			}
+			So(cmds, ShouldResemble, map[string]int{
+				"echo a 1": 0, "echo a 2": 1, "echo a 3": 2,
+				"echo b 1": 3, "echo b 2": 4, "echo b 3": 5,
+			})
+
+			Convey("You can GET the elements of the array using its id", func() {
+				req, err := http.NewRequest(http.MethodGet, jobsEndPoint+"/"+arrayID, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				responseData, err := io.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+
+				var jstati []JStatus
+				err = json.Unmarshal(responseData, &jstati)
+				So(err, ShouldBeNil)
+				So(len(jstati), ShouldEqual, 6)
+				for _, status := range jstati {
+					So(status.ArrayID, ShouldEqual, arrayID)
+				}
+			})
+
+			Convey("You can't POST a job array with bad parameters", func() {
+				inputJobs[0].ArrayRanges = []string{"n=3-1"}
+				jsonValue, err := json.Marshal(inputJobs)
+				So(err, ShouldBeNil)
+				req, err := http.NewRequest(http.MethodPost, jobsEndPoint+"/", bytes.NewBuffer(jsonValue))
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				req.Header.Add("Content-Type", "application/json")
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, 400)
+			})
+		})
+
+		Convey("You can POST, GET and DELETE crons", func() {
+			cvj := &CronViaJSON{Name: "rest", Schedule: "@daily", Job: &JobViaJSON{Cmd: "echo rest cron"}}
+			jsonValue, err := json.Marshal(cvj)
+			So(err, ShouldBeNil)
+
+			req, err := http.NewRequest(http.MethodPost, cronsEndPoint, bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			req.Header.Add("Content-Type", "application/json")
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusCreated)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var statuses []CronStatus
+			err = json.Unmarshal(responseData, &statuses)
+			So(err, ShouldBeNil)
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].Name, ShouldEqual, "rest")
+			So(statuses[0].Cmd, ShouldEqual, "echo rest cron")
+			So(statuses[0].RepGroup, ShouldEqual, "cron.rest")
+			So(statuses[0].NextTick, ShouldBeGreaterThan, time.Now().Unix())
+			So(statuses[0].LastAdded, ShouldEqual, 0)
+
+			req, err = http.NewRequest(http.MethodPost, cronsEndPoint, bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusConflict)
+
+			req, err = http.NewRequest(http.MethodGet, cronsEndPoint+"rest", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err = io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			err = json.Unmarshal(responseData, &statuses)
+			So(err, ShouldBeNil)
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].Schedule, ShouldEqual, "@daily")
+
+			req, err = http.NewRequest(http.MethodDelete, cronsEndPoint+"rest", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+
+			for _, method := range []string{http.MethodGet, http.MethodDelete} {
+				req, err = http.NewRequest(method, cronsEndPoint+"rest", nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusNotFound)
+			}
+
+			cvj.Schedule = "* * *"
+			jsonValue, err = json.Marshal(cvj)
+			So(err, ShouldBeNil)
+			req, err = http.NewRequest(http.MethodPost, cronsEndPoint, bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("You can POST, GET and DELETE users, and they only have user rights", func() {
+			jsonValue, err := json.Marshal(&UserViaJSON{Name: "rest"})
+			So(err, ShouldBeNil)
+
+			req, err := http.NewRequest(http.MethodPost, usersEndPoint, bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			req.Header.Add("Content-Type", "application/json")
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusCreated)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var statuses []UserStatus
+			err = json.Unmarshal(responseData, &statuses)
+			So(err, ShouldBeNil)
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].Name, ShouldEqual, "rest")
+			So(statuses[0].Admin, ShouldBeFalse)
+			So(statuses[0].Created, ShouldBeGreaterThan, 0)
+			So(len(statuses[0].Token), ShouldEqual, tokenLength)
+			userBearer := "Bearer " + statuses[0].Token
+
+			req, err = http.NewRequest(http.MethodPost, usersEndPoint, bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusConflict)
+
+			req, err = http.NewRequest(http.MethodGet, usersEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err = io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			statuses = nil
+			err = json.Unmarshal(responseData, &statuses)
+			So(err, ShouldBeNil)
+			So(len(statuses), ShouldEqual, 2)
+			for _, status := range statuses {
+				So(status.Token, ShouldBeBlank)
+			}
+
+			req, err = http.NewRequest(http.MethodGet, usersEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", userBearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err = io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			err = json.Unmarshal(responseData, &statuses)
+			So(err, ShouldBeNil)
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].Name, ShouldEqual, "rest")
+
+			inputJobs := []*JobViaJSON{{Cmd: "echo rest user", RepGrp: "rest_user"}}
+			jsonValue, err = json.Marshal(inputJobs)
+			So(err, ShouldBeNil)
+			req, err = http.NewRequest(http.MethodPost, jobsEndPoint, bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", userBearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusCreated)
+			responseData, err = io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var jstatuses []JStatus
+			err = json.Unmarshal(responseData, &jstatuses)
+			So(err, ShouldBeNil)
+			So(len(jstatuses), ShouldEqual, 1)
+			So(jstatuses[0].Owner, ShouldEqual, "rest")
+
+			for _, endpoint := range []string{managerEndPoint + "pause", usersEndPoint} {
+				req, err = http.NewRequest(http.MethodPost, endpoint, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", userBearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusForbidden)
+			}
+
+			req, err = http.NewRequest(http.MethodGet, backupEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", userBearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusForbidden)
+
+			req, err = http.NewRequest(http.MethodPut, limitsEndPoint+"lg_rest?limit=3", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", userBearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusForbidden)
+
+			req, err = http.NewRequest(http.MethodGet, limitsEndPoint+"lg_rest", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", userBearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+
+			req, err = http.NewRequest(http.MethodDelete, usersEndPoint+"rest", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+
+			req, err = http.NewRequest(http.MethodDelete, usersEndPoint+"rest", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			req, err = http.NewRequest(http.MethodGet, usersEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", userBearer)
+			response, err = client.Do(req)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+
 		Convey("You must supply certain properties when adding jobs", func() {
 			inputJobs := []*JobViaJSON{{RepGrp: "foo"}}
 			jsonValue, err := json.Marshal(inputJobs)
@@ -0,0 +1,263 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to retention policies, which
+// determine when complete Jobs get moved out of the database in to archive
+// files, and to reading and writing those archive files.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	archiveFilePrefix     = "jobs."
+	archiveFileSuffix     = ".jsonl.gz"
+	archiveFileTimeFormat = "20060102T150405Z"
+	archiveDirPermission  = 0o700
+)
+
+// archiveHandle is used to encode Jobs as JSON in archive files.
+var archiveHandle = new(codec.JsonHandle)
+
+// RetentionPolicy describes how long complete Jobs are kept in the database
+// before being archived.
+type RetentionPolicy struct {
+	// RepGroup, if set, limits the policy to Jobs with RepGroups that match
+	// this regular expression.
+	RepGroup *regexp.Regexp
+
+	// MaxAge is the time since a Job completed after which it is archived.
+	MaxAge time.Duration
+}
+
+// matches tells you if this policy applies to Jobs with the given RepGroup.
+func (p *RetentionPolicy) matches(repGroup string) bool {
+	return p.RepGroup == nil || p.RepGroup.MatchString(repGroup)
+}
+
+// ParseRetentionPolicies parses a string specification of retention policies,
+// in the form "regex|age;regex2|age2;age3", where each age is a duration like
+// "720h", or a number of days like "30d", and the regex (which is matched
+// against RepGroups) is optional, returning the corresponding
+// RetentionPolicies. When deciding the policy for a Job, the first one that
+// matches is used; Jobs that match none are never archived.
+func ParseRetentionPolicies(spec string) ([]*RetentionPolicy, error) {
+	var policies []*RetentionPolicy
+
+	for _, policySpec := range strings.Split(spec, ";") {
+		policySpec = strings.TrimSpace(policySpec)
+		if policySpec == "" {
+			continue
+		}
+
+		policy := &RetentionPolicy{}
+		age := policySpec
+		if i := strings.LastIndex(policySpec, "|"); i != -1 {
+			re, err := regexp.Compile(policySpec[:i])
+			if err != nil {
+				return nil, fmt.Errorf("retention policy '%s' has a bad regular expression: %w", policySpec, err)
+			}
+			policy.RepGroup = re
+			age = policySpec[i+1:]
+		}
+
+		maxAge, err := parseRetentionAge(age)
+		if err != nil {
+			return nil, fmt.Errorf("retention policy '%s' has a bad age: %w", policySpec, err)
+		}
+		policy.MaxAge = maxAge
+
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+// parseRetentionAge parses a positive duration that can also be given as a
+// whole number of days with a "d" suffix.
+func parseRetentionAge(age string) (time.Duration, error) {
+	var d time.Duration
+	if days := strings.TrimSuffix(age, "d"); days != age {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		d, err = time.ParseDuration(age)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("age must be greater than 0")
+	}
+
+	return d, nil
+}
+
+// retentionMaxAge returns the MaxAge of the first of the given policies that
+// matches the given RepGroup, and false if none matched.
+func retentionMaxAge(policies []*RetentionPolicy, repGroup string) (time.Duration, bool) {
+	for _, p := range policies {
+		if p.matches(repGroup) {
+			return p.MaxAge, true
+		}
+	}
+	return 0, false
+}
+
+// writeJobArchive appends the given Jobs to the archive file in the given
+// directory for the given time, as lines of JSON, gzip compressed. The file is
+// synced to disk before returning.
+func writeJobArchive(dir string, t time.Time, jobs []*Job) error {
+	err := os.MkdirAll(dir, archiveDirPermission)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, archiveFilePrefix+t.UTC().Format(archiveFileTimeFormat)+archiveFileSuffix)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, dbFilePermission)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(f)
+	err = encodeJobLines(gz, jobs)
+
+	if errc := gz.Close(); err == nil {
+		err = errc
+	}
+	if errs := f.Sync(); err == nil {
+		err = errs
+	}
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+
+	return err
+}
+
+// encodeJobLines writes the given Jobs to w as lines of JSON.
+func encodeJobLines(w io.Writer, jobs []*Job) error {
+	newline := []byte("\n")
+	for _, job := range jobs {
+		var encoded []byte
+		enc := codec.NewEncoderBytes(&encoded, archiveHandle)
+		job.RLock()
+		err := enc.Encode(job)
+		job.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.Write(encoded); err != nil {
+			return err
+		}
+		if _, err = w.Write(newline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchJobArchives reads all the archive files in the given directory, from
+// the most recent to the oldest, and returns the Jobs for which match returns
+// true. If a Job was archived more than once, only the most recently archived
+// version is considered.
+func searchJobArchives(dir string, match func(*Job) bool) ([]*Job, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, archiveFilePrefix+"*"+archiveFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	var jobs []*Job
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		err = readJobArchive(path, func(job *Job) {
+			key := job.Key()
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+
+			if match(job) {
+				jobs = append(jobs, job)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return jobs, nil
+}
+
+// readJobArchive decodes each Job in the given archive file and passes it to
+// the given function.
+func readJobArchive(path string, fn func(*Job)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("archive file %s could not be read: %w", path, err)
+	}
+	defer gz.Close()
+
+	r := bufio.NewReader(gz)
+	for {
+		line, errr := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			job := &Job{}
+			dec := codec.NewDecoderBytes(line, archiveHandle)
+			if err = dec.Decode(job); err != nil {
+				return fmt.Errorf("archive file %s has a bad entry: %w", path, err)
+			}
+			fn(job)
+		}
+
+		if errr == io.EOF {
+			return nil
+		}
+		if errr != nil {
+			return fmt.Errorf("archive file %s could not be read: %w", path, errr)
+		}
+	}
+}
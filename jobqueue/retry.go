@@ -0,0 +1,273 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to retry policies, which control
+// how failed Jobs are retried.
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/jpillora/backoff"
+)
+
+// RetryPolicy describes how a Job should be retried when it fails, within the
+// limit of its Retries.
+type RetryPolicy struct {
+	// Backoff is how long to wait before the first retry. Defaults to
+	// ClientReleaseDelayMin.
+	Backoff time.Duration
+
+	// MaxBackoff is the most we'll wait before any retry. Defaults to
+	// ClientReleaseDelayMax, or Backoff if that is greater.
+	MaxBackoff time.Duration
+
+	// Factor is what the wait is multiplied by after each failure. Defaults
+	// to ClientReleaseDelayStepFactor.
+	Factor float64
+
+	// Jitter is the fraction (0..1) by which each wait is randomly increased
+	// or decreased, so that jobs that fail together don't all retry together.
+	Jitter float64
+
+	// NoRetryExitCodes are the exit codes that indicate a permanent failure:
+	// if the Job's Cmd exits with one of these, it will be buried instead of
+	// retried.
+	NoRetryExitCodes []int
+
+	// DifferentHost, if true, means that when the Job is retried it should
+	// not be run on any host it previously failed on. This is only honoured
+	// by schedulers that can choose hosts (currently lsf, slurm, sge and
+	// sshpool).
+	DifferentHost bool
+}
+
+// ParseRetryPolicy parses a string specification of a retry policy, in the form
+// of semi-colon separated settings, eg.
+// "backoff=1m;max=1h;factor=2;jitter=0.25;no_retry=2,127;different_host", and
+// returns the corresponding RetryPolicy. All settings are optional. A blank
+// spec returns nil, meaning the default behaviour.
+func ParseRetryPolicy(spec string) (*RetryPolicy, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	p := &RetryPolicy{}
+	for _, setting := range strings.Split(spec, ";") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+
+		key, val, _ := strings.Cut(setting, "=")
+		key = strings.TrimSpace(key)
+		val = strings.TrimSpace(val)
+
+		var err error
+		switch key {
+		case "backoff":
+			p.Backoff, err = time.ParseDuration(val)
+			if err == nil && p.Backoff <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "max":
+			p.MaxBackoff, err = time.ParseDuration(val)
+			if err == nil && p.MaxBackoff <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "factor":
+			p.Factor, err = strconv.ParseFloat(val, 64)
+			if err == nil && p.Factor < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "jitter":
+			p.Jitter, err = strconv.ParseFloat(val, 64)
+			if err == nil && (p.Jitter < 0 || p.Jitter > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "no_retry":
+			p.NoRetryExitCodes, err = parseExitCodes(val)
+		case "different_host":
+			if val != "" {
+				p.DifferentHost, err = strconv.ParseBool(val)
+			} else {
+				p.DifferentHost = true
+			}
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("retry policy '%s' has a bad setting '%s': %w", spec, setting, err)
+		}
+	}
+
+	if p.MaxBackoff > 0 && p.MaxBackoff < p.Backoff {
+		return nil, fmt.Errorf("retry policy '%s' has a max less than its backoff", spec)
+	}
+
+	return p, nil
+}
+
+// parseExitCodes parses a comma separated list of exit codes.
+func parseExitCodes(list string) ([]int, error) {
+	var codes []int
+	for _, code := range strings.Split(list, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > 255 {
+			return nil, fmt.Errorf("exit code %d is not in the range 0..255", n)
+		}
+		codes = append(codes, n)
+	}
+
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("no exit codes given")
+	}
+	sort.Ints(codes)
+
+	return codes, nil
+}
+
+// String returns the policy in the form taken by ParseRetryPolicy(), with
+// unset settings omitted.
+func (p *RetryPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+
+	var settings []string
+	if p.Backoff > 0 {
+		settings = append(settings, "backoff="+p.Backoff.String())
+	}
+	if p.MaxBackoff > 0 {
+		settings = append(settings, "max="+p.MaxBackoff.String())
+	}
+	if p.Factor > 0 {
+		settings = append(settings, "factor="+strconv.FormatFloat(p.Factor, 'g', -1, 64))
+	}
+	if p.Jitter > 0 {
+		settings = append(settings, "jitter="+strconv.FormatFloat(p.Jitter, 'g', -1, 64))
+	}
+	if len(p.NoRetryExitCodes) > 0 {
+		codes := make([]string, len(p.NoRetryExitCodes))
+		for i, code := range p.NoRetryExitCodes {
+			codes[i] = strconv.Itoa(code)
+		}
+		settings = append(settings, "no_retry="+strings.Join(codes, ","))
+	}
+	if p.DifferentHost {
+		settings = append(settings, "different_host")
+	}
+
+	return strings.Join(settings, ";")
+}
+
+// delay returns how long to wait before retrying, given the number of previous
+// delays. A nil policy gives the default backoff.
+func (p *RetryPolicy) delay(numPreviousDelays int) time.Duration {
+	if p == nil {
+		return calculateItemDelay(numPreviousDelays)
+	}
+
+	minDelay := p.Backoff
+	if minDelay <= 0 {
+		minDelay = ClientReleaseDelayMin
+	}
+	maxDelay := p.MaxBackoff
+	if maxDelay <= 0 {
+		maxDelay = ClientReleaseDelayMax
+		if maxDelay < minDelay {
+			maxDelay = minDelay
+		}
+	}
+	factor := p.Factor
+	if factor <= 0 {
+		factor = ClientReleaseDelayStepFactor
+	}
+
+	b := &backoff.Backoff{
+		Min:    minDelay,
+		Max:    maxDelay,
+		Factor: factor,
+	}
+	d := b.ForAttempt(float64(numPreviousDelays))
+
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d)) // #nosec
+		if d > maxDelay {
+			d = maxDelay
+		}
+	}
+
+	return d
+}
+
+// noRetry tells you if the given exit code is one of our NoRetryExitCodes.
+func (p *RetryPolicy) noRetry(exitcode int) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, code := range p.NoRetryExitCodes {
+		if code == exitcode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// avoidHost returns a clone of the given Requirements with the given host added
+// to the hosts to avoid, or nil if that host was already being avoided.
+func avoidHost(req *scheduler.Requirements, host string) *scheduler.Requirements {
+	var hosts []string
+	if val := req.Other[scheduler.AvoidHostsKey]; val != "" {
+		hosts = strings.Split(val, ",")
+	}
+	for _, h := range hosts {
+		if h == host {
+			return nil
+		}
+	}
+	hosts = append(hosts, host)
+	sort.Strings(hosts)
+
+	clone := req.Clone()
+	if clone.Other == nil {
+		clone.Other = make(map[string]string)
+	}
+	clone.Other[scheduler.AvoidHostsKey] = strings.Join(hosts, ",")
+
+	return clone
+}
@@ -18,8 +18,10 @@
 
 package scheduler
 
-// This file contains a scheduleri implementation for 'openstack': running jobs
-// on servers spawned on demand.
+// This file contains a scheduleri implementation for 'cloud': running jobs on
+// servers spawned on demand in any cloud.Provider (eg. OpenStack or AWS), since
+// all cloud-specific details are handled by the cloud package. 'openstack',
+// 'aws' and 'fake' are aliases for 'cloud' with that provider.
 
 import (
 	"context"
@@ -50,18 +52,27 @@ const (
 	flavorDeterminedCacheCleanup = 10 * time.Minute
 )
 
+// defaultCloudProvider is the cloud.Provider used by the "cloud" scheduler if
+// ConfigCloud.Provider isn't set.
+const defaultCloudProvider = "openstack"
+
+// cloudDisplayNames are the names of the clouds we support, as used in messages
+// to the user.
+var cloudDisplayNames = map[string]string{"openstack": "OpenStack", "aws": "AWS", "fake": "Fake cloud"}
+
 // debugCounter and debugEffect are used by tests to prove some bugs
 var (
 	debugCounter int
 	debugEffect  string
 )
 
-// opst is our implementer of scheduleri. It takes much of its implementation
-// from the local scheduler.
-type opst struct {
+// cloudScheduler is our implementer of scheduleri. It takes much of its
+// implementation from the local scheduler.
+type cloudScheduler struct {
 	local
+	providerName      string
 	flavorSets        [][]string
-	config            *ConfigOpenStack
+	config            *ConfigCloud
 	provider          *cloud.Provider
 	quotaMaxInstances int
 	quotaMaxCores     int
@@ -90,10 +101,16 @@ type opst struct {
 	updatingState     bool
 }
 
-// ConfigOpenStack represents the configuration options required by the
-// OpenStack scheduler. All are required with no usable defaults, unless
-// otherwise noted. This struct implements the CloudConfig interface.
-type ConfigOpenStack struct {
+// ConfigCloud represents the configuration options required by the cloud
+// scheduler. All are required with no usable defaults, unless otherwise noted.
+// This struct implements the CloudConfig interface.
+type ConfigCloud struct {
+	// Provider is the name of the cloud.Provider that servers will be spawned
+	// with: "openstack", "aws" or "fake" (which runs everything on the local
+	// machine, for testing purposes). Defaults to the scheduler name passed to
+	// New() if that was one of those, otherwise "openstack".
+	Provider string
+
 	// ResourceName is the resource name prefix used to name any resources (such
 	// as keys, security groups and servers) that need to be created.
 	ResourceName string
@@ -128,7 +145,7 @@ type ConfigOpenStack struct {
 
 	// FlavorSets is used to describe sets of flavors that will only run on
 	// certain subsets of your available hardware. If a flavor in set 1 is
-	// chosen, but OpenStack reports it isn't possible to create a server with
+	// chosen, but the cloud reports it isn't possible to create a server with
 	// that flavor because there is no more available hardware to back it, then
 	// the next best flavor in a different flavor set will be attempted. The
 	// value here is a string in the form f1,f2;f3,f4 where f1 and f2 are in the
@@ -137,6 +154,13 @@ type ConfigOpenStack struct {
 	// the flavors in a set with a single entry.
 	FlavorSets string
 
+	// FlavorResources describes the named consumable resources (such as GPUs)
+	// that servers of certain flavors have, in the form
+	// regex:name=count,name=count;regex:name=count. See
+	// ParseFlavorResources(). Commands that require resources will only be
+	// run on servers with enough of them.
+	FlavorResources string
+
 	// PostCreationScript is the []byte content of a script you want executed
 	// after a server is Spawn()ed. (Overridden during Schedule() by a
 	// Requirements.Other["cloud_script"] value.)
@@ -202,6 +226,11 @@ type ConfigOpenStack struct {
 	// reference to an int.
 	MaxLocalRAM *int
 
+	// LocalResources are the named consumable resources (such as GPUs) that
+	// the instance the manager is running on has available for running
+	// commands.
+	LocalResources map[string]int
+
 	// Shell is the shell to use to run your commands with; 'bash' is
 	// recommended.
 	Shell string
@@ -219,12 +248,12 @@ type ConfigOpenStack struct {
 	UseConfigDrive bool
 
 	// CIDR describes the range of network ips that can be used to spawn
-	// OpenStack servers on which to run our commands. The default is
-	// "192.168.64.0/18", which allows for 16384 servers to be spawned. This
-	// range ends at 192.168.127.255. If already in OpenStack, this chooses
-	// which existing network (that the current host is attached to) to use.
-	// Otherwise, this results in the creation of an appropriately configured
-	// network and subnet.
+	// servers on which to run our commands. The default is "192.168.64.0/18",
+	// which allows for 16384 servers to be spawned. This range ends at
+	// 192.168.127.255. If already in the cloud, this chooses which existing
+	// network (that the current host is attached to) to use. Otherwise, this
+	// results in the creation of an appropriately configured network and
+	// subnet.
 	CIDR string
 
 	// GatewayIP is the gateway ip address for the subnet that will be created
@@ -236,7 +265,7 @@ type ConfigOpenStack struct {
 	DNSNameServers []string
 
 	// Umask is an optional umask to run remote commands under, to control the
-	// permissions of files created on spawned OpenStack servers. If not
+	// permissions of files created on spawned servers. If not
 	// supplied (0), the umask used will be the default umask of the OSUser
 	// user. Note that setting this will result in scheduled commands being
 	// executed like `(umask Umask && cmd)`, which may present cross-platform
@@ -244,9 +273,15 @@ type ConfigOpenStack struct {
 	Umask int
 }
 
+// ConfigOpenStack is the old name of ConfigCloud, from when the cloud scheduler
+// only supported OpenStack.
+//
+// Deprecated: use ConfigCloud.
+type ConfigOpenStack = ConfigCloud
+
 // AddConfigFile takes a value as per the ConfigFiles property, and appends it
 // to the existing ConfigFiles value (or sets it if unset).
-func (c *ConfigOpenStack) AddConfigFile(configFile string) {
+func (c *ConfigCloud) AddConfigFile(configFile string) {
 	if c.ConfigFiles == "" {
 		c.ConfigFiles = configFile
 	} else {
@@ -255,18 +290,24 @@ func (c *ConfigOpenStack) AddConfigFile(configFile string) {
 }
 
 // GetOSUser returns OSUser, to meet the CloudConfig interface.
-func (c *ConfigOpenStack) GetOSUser() string {
+func (c *ConfigCloud) GetOSUser() string {
 	return c.OSUser
 }
 
 // GetServerKeepTime returns ServerKeepTime, to meet the CloudConfig interface.
-func (c *ConfigOpenStack) GetServerKeepTime() time.Duration {
+func (c *ConfigCloud) GetServerKeepTime() time.Duration {
 	return c.ServerKeepTime
 }
 
 // initialize sets up an openstack scheduler.
-func (s *opst) initialize(ctx context.Context, config interface{}) error {
-	s.config = config.(*ConfigOpenStack)
+func (s *cloudScheduler) initialize(ctx context.Context, config interface{}) error {
+	s.config = config.(*ConfigCloud)
+	if s.config.Provider != "" {
+		s.providerName = s.config.Provider
+	}
+	if s.providerName == "" {
+		s.providerName = defaultCloudProvider
+	}
 	if s.config.OSRAM == 0 {
 		s.config.OSRAM = 2048
 	}
@@ -274,9 +315,9 @@ func (s *opst) initialize(ctx context.Context, config interface{}) error {
 		s.config.OSDisk = 1
 	}
 
-	// create a cloud provider for openstack, that we'll use to interact with
-	// openstack
-	provider, err := cloud.New(ctx, "openstack", s.config.ResourceName, s.config.SavePath)
+	// create a cloud provider for our cloud, that we'll use to interact with
+	// it
+	provider, err := cloud.New(ctx, s.providerName, s.config.ResourceName, s.config.SavePath)
 	if err != nil {
 		return err
 	}
@@ -351,6 +392,9 @@ func (s *opst) initialize(ctx context.Context, config interface{}) error {
 			localhost.Flavor.RAM = *s.config.MaxLocalRAM
 		}
 	}
+	if len(s.config.LocalResources) > 0 {
+		localhost.Flavor.Resources = CopyResources(s.config.LocalResources)
+	}
 	s.servers[localhostName] = localhost
 
 	// set our functions for use in schedule() and processQueue()
@@ -386,6 +430,14 @@ func (s *opst) initialize(ctx context.Context, config interface{}) error {
 		}
 	}
 
+	frs, err := ParseFlavorResources(s.config.FlavorResources)
+	if err != nil {
+		return err
+	}
+	if err = provider.SetFlavorResources(frs); err != nil {
+		return err
+	}
+
 	s.ffCache = cache.New(flavorFailedCacheExpiry, flavorFailedCacheCleanup)
 	s.dfCache = cache.New(flavorDeterminedCacheExpiry, flavorDeterminedCacheCleanup)
 
@@ -395,7 +447,7 @@ func (s *opst) initialize(ctx context.Context, config interface{}) error {
 // reqCheck gives an ErrImpossible if the given Requirements can not be met,
 // based on our quota and the available server flavours. Also based on the
 // specific flavor the user has specified, if any.
-func (s *opst) reqCheck(ctx context.Context, req *Requirements) error {
+func (s *cloudScheduler) reqCheck(ctx context.Context, req *Requirements) error {
 	reqForSpawn := s.reqForSpawn(req)
 
 	// check if possible vs quota
@@ -403,8 +455,8 @@ func (s *opst) reqCheck(ctx context.Context, req *Requirements) error {
 		clog.Warn(ctx, "Requested resources are greater than max quota", "quotaCores", s.quotaMaxCores, "requiredCores",
 			reqForSpawn.Cores, "quotaRAM", s.quotaMaxRAM, "requiredRAM", reqForSpawn.RAM, "quotaDisk", s.quotaMaxVolume,
 			"requiredDisk", reqForSpawn.Disk)
-		s.notifyMessage(fmt.Sprintf("OpenStack: not enough quota for the job needing %f cores, %d RAM and %d Disk", reqForSpawn.Cores, reqForSpawn.RAM, reqForSpawn.Disk))
-		return Error{"openstack", "schedule", ErrImpossible}
+		s.notifyMessage(fmt.Sprintf("not enough quota for the job needing %f cores, %d RAM and %d Disk", reqForSpawn.Cores, reqForSpawn.RAM, reqForSpawn.Disk))
+		return Error{s.providerName, "schedule", ErrImpossible}
 	}
 
 	if name, defined := req.Other["cloud_flavor"]; defined {
@@ -415,12 +467,13 @@ func (s *opst) reqCheck(ctx context.Context, req *Requirements) error {
 
 		// check that the user hasn't requested a flavor that isn't actually big
 		// enough to run their job
-		if requestedFlavor.Cores < int(math.Ceil(reqForSpawn.Cores)) || requestedFlavor.RAM < reqForSpawn.RAM {
+		if requestedFlavor.Cores < int(math.Ceil(reqForSpawn.Cores)) || requestedFlavor.RAM < reqForSpawn.RAM ||
+			internal.ResourcesCanFit(requestedFlavor.Resources, nil, reqForSpawn.Resources) == 0 {
 			clog.Warn(ctx, "Requested flavor is too small for the job", "flavor", requestedFlavor.Name, "flavorCores",
 				requestedFlavor.Cores, "requiredCores", reqForSpawn.Cores, "flavorRAM", requestedFlavor.RAM, "requiredRAM",
 				reqForSpawn.RAM)
-			s.notifyMessage(fmt.Sprintf("OpenStack: requested flavor %s is too small for the job needing %f cores and %d RAM", requestedFlavor.Name, reqForSpawn.Cores, reqForSpawn.RAM))
-			return Error{"openstack", "schedule", ErrImpossible}
+			s.notifyMessage(fmt.Sprintf("requested flavor %s is too small for the job needing %f cores and %d RAM", requestedFlavor.Name, reqForSpawn.Cores, reqForSpawn.RAM))
+			return Error{s.providerName, "schedule", ErrImpossible}
 		}
 	} else {
 		// check if possible vs flavors
@@ -431,12 +484,12 @@ func (s *opst) reqCheck(ctx context.Context, req *Requirements) error {
 }
 
 // maxMem returns the maximum memory available in quota.
-func (s *opst) maxMem() int {
+func (s *cloudScheduler) maxMem() int {
 	return s.quotaMaxRAM
 }
 
 // maxCPU returns the maximum number of CPU cores available quota.
-func (s *opst) maxCPU() int {
+func (s *cloudScheduler) maxCPU() int {
 	return s.quotaMaxCores
 }
 
@@ -454,7 +507,7 @@ func (s *opst) maxCPU() int {
 // "can", we want the return value to be the same for that set of calls, so we
 // cache based on the "call" argument that processQueue sent in to canCount and
 // runCmd, which in turn pass through to here.
-func (s *opst) determineFlavor(ctx context.Context, req *Requirements, call string) (*cloud.Flavor, error) {
+func (s *cloudScheduler) determineFlavor(ctx context.Context, req *Requirements, call string) (*cloud.Flavor, error) {
 	ctx = clog.ContextWithCallValue(ctx, call)
 	if call != "" {
 		if flavor, cached := s.dfCache.Get(call); cached {
@@ -463,7 +516,7 @@ func (s *opst) determineFlavor(ctx context.Context, req *Requirements, call stri
 	}
 
 	flavors, err := s.provider.CheapestServerFlavors(ctx, int(math.Ceil(req.Cores)), req.RAM,
-		s.config.FlavorRegex, s.flavorSets)
+		s.config.FlavorRegex, s.flavorSets, req.Resources)
 	if err != nil {
 		return nil, err
 	}
@@ -475,10 +528,10 @@ func (s *opst) determineFlavor(ctx context.Context, req *Requirements, call stri
 		}
 	}
 	if !hasFlavors {
-		err = Error{"openstack", "determineFlavor", ErrImpossible}
+		err = Error{s.providerName, "determineFlavor", ErrImpossible}
 	} else if err != nil {
 		if perr, ok := err.(cloud.Error); ok && perr.Err == cloud.ErrNoFlavor {
-			err = Error{"openstack", "determineFlavor", ErrImpossible}
+			err = Error{s.providerName, "determineFlavor", ErrImpossible}
 		}
 	}
 	if err != nil {
@@ -525,11 +578,11 @@ func (s *opst) determineFlavor(ctx context.Context, req *Requirements, call stri
 
 // getFlavor returns a flavor with the given name or id. Returns an error
 // if no matching flavor exists.
-func (s *opst) getFlavor(ctx context.Context, name string) (*cloud.Flavor, error) {
+func (s *cloudScheduler) getFlavor(ctx context.Context, name string) (*cloud.Flavor, error) {
 	flavor, err := s.provider.GetServerFlavor(ctx, name)
 	if err != nil {
 		if perr, ok := err.(cloud.Error); ok && perr.Err == cloud.ErrNoFlavor {
-			err = Error{"openstack", "getFlavorByName", ErrBadFlavor}
+			err = Error{s.providerName, "getFlavorByName", ErrBadFlavor}
 		}
 	}
 	return flavor, err
@@ -539,7 +592,7 @@ func (s *opst) getFlavor(ctx context.Context, name string) (*cloud.Flavor, error
 // of server has been requested. If not specified, the returned os defaults to
 // the configured OSPrefix, script defaults to PostCreationScript, config files
 // defaults to ConfigFiles and flavor will be nil.
-func (s *opst) serverReqs(ctx context.Context, req *Requirements) (osPrefix string, osScript []byte,
+func (s *cloudScheduler) serverReqs(ctx context.Context, req *Requirements) (osPrefix string, osScript []byte,
 	osConfigFiles string, flavor *cloud.Flavor, sharedDisk bool, err error,
 ) {
 	if val, defined := req.Other["cloud_os"]; defined {
@@ -585,7 +638,7 @@ func (s *opst) serverReqs(ctx context.Context, req *Requirements) (osPrefix stri
 
 // canCount tells you how many jobs with the given RAM and core requirements it
 // is possible to run, given remaining resources in existing servers.
-func (s *opst) canCount(ctx context.Context, cmd string, req *Requirements, call string) int {
+func (s *cloudScheduler) canCount(ctx context.Context, cmd string, req *Requirements, call string) int {
 	ctx = clog.ContextWithCallValue(ctx, call)
 	if s.cleanedUp() {
 		return 0
@@ -608,7 +661,7 @@ func (s *opst) canCount(ctx context.Context, cmd string, req *Requirements, call
 	s.serversMutex.RLock()
 	for _, server := range s.servers {
 		if !server.IsBad() && server.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor, needsSharedDisk) {
-			space := server.HasSpaceFor(req.Cores, req.RAM, req.Disk)
+			space := server.HasSpaceFor(req.Cores, req.RAM, req.Disk, req.Resources)
 			canCount += space
 		}
 	}
@@ -622,7 +675,7 @@ func (s *opst) canCount(ctx context.Context, cmd string, req *Requirements, call
 //
 // If there is enough quota to spawn new servers, and we are not already in the
 // middle of spawning too many servers, we spawn instances in the background.
-func (s *opst) spawnMultiple(ctx context.Context, desired int, cmd string, req *Requirements, call string) {
+func (s *cloudScheduler) spawnMultiple(ctx context.Context, desired int, cmd string, req *Requirements, call string) {
 	ctx = clog.ContextWithCallValue(ctx, call)
 	s.spawnMutex.Lock()
 	defer s.spawnMutex.Unlock()
@@ -652,7 +705,7 @@ func (s *opst) spawnMultiple(ctx context.Context, desired int, cmd string, req *
 		clog.Debug(ctx, "spawnMultiple can't spawn due to lack of quota")
 		return
 	}
-	perServer := flavor.HasSpaceFor(reqForSpawn.Cores, reqForSpawn.RAM, 0) // servers we spawn can have more disk than in the flavor, so we don't consider reqForSpawn.Disk here
+	perServer := flavor.HasSpaceFor(reqForSpawn.Cores, reqForSpawn.RAM, 0, reqForSpawn.Resources) // servers we spawn can have more disk than in the flavor, so we don't consider reqForSpawn.Disk here
 	if perServer == 0 {
 		clog.Error(ctx, "determined flavor doesn't have space for req", "flavor", flavor, "req", reqForSpawn)
 		return
@@ -708,7 +761,7 @@ func (s *opst) spawnMultiple(ctx context.Context, desired int, cmd string, req *
 //
 // Returns the number of servers that can be spawned, and the flavor that should
 // be spawned (if number greater than 0). Errors are simply Warn()ed.
-func (s *opst) checkQuota(ctx context.Context, req *Requirements, requestedFlavor *cloud.Flavor, call string) (int, *cloud.Flavor) {
+func (s *cloudScheduler) checkQuota(ctx context.Context, req *Requirements, requestedFlavor *cloud.Flavor, call string) (int, *cloud.Flavor) {
 	ctx = clog.ContextWithCallValue(ctx, call)
 	s.resourceMutex.RLock()
 	defer s.resourceMutex.RUnlock()
@@ -734,7 +787,7 @@ func (s *opst) checkQuota(ctx context.Context, req *Requirements, requestedFlavo
 		if remainingInstances < 1 {
 			clog.Debug(ctx, "lack of instance quota", "remaining", remainingInstances, "max", quota.MaxInstances,
 				"used", quota.UsedInstances, "reserved", s.reservedInstances)
-			s.notifyMessage("OpenStack: Not enough instance quota to create another server")
+			s.notifyMessage("Not enough instance quota to create another server")
 		}
 	}
 	if remainingInstances > 0 && s.quotaMaxInstances > -1 && s.quotaMaxInstances < quota.MaxInstances {
@@ -758,7 +811,7 @@ func (s *opst) checkQuota(ctx context.Context, req *Requirements, requestedFlavo
 		if remainingRAM < flavor.RAM {
 			clog.Debug(ctx, "lack of ram quota", "remaining", remainingRAM, "max", quota.MaxRAM, "used", quota.UsedRAM,
 				"reserved", s.reservedRAM)
-			s.notifyMessage(fmt.Sprintf("OpenStack: Not enough RAM quota to create another server (need %d, have %d)", flavor.RAM, remainingRAM))
+			s.notifyMessage(fmt.Sprintf("Not enough RAM quota to create another server (need %d, have %d)", flavor.RAM, remainingRAM))
 		}
 	}
 	remainingCores := unquotadVal
@@ -767,7 +820,7 @@ func (s *opst) checkQuota(ctx context.Context, req *Requirements, requestedFlavo
 		if remainingCores < flavor.Cores {
 			clog.Debug(ctx, "lack of cores quota", "remaining", remainingCores, "max", quota.MaxCores, "used", quota.UsedCores,
 				"reserved", s.reservedCores)
-			s.notifyMessage(fmt.Sprintf("OpenStack: Not enough cores quota to create another server (need %d, have %d)", flavor.Cores, remainingCores))
+			s.notifyMessage(fmt.Sprintf("Not enough cores quota to create another server (need %d, have %d)", flavor.Cores, remainingCores))
 		}
 	}
 	remainingVolume := unquotadVal
@@ -777,7 +830,7 @@ func (s *opst) checkQuota(ctx context.Context, req *Requirements, requestedFlavo
 		if remainingVolume < req.Disk {
 			clog.Debug(ctx, "lack of volume quota", "remaining", remainingVolume, "max", quota.MaxVolume, "used",
 				quota.UsedVolume, "reserved", s.reservedVolume)
-			s.notifyMessage(fmt.Sprintf("OpenStack: Not enough volume quota to create another server (need %d, have %d)", flavor.Disk, remainingVolume))
+			s.notifyMessage(fmt.Sprintf("Not enough volume quota to create another server (need %d, have %d)", flavor.Disk, remainingVolume))
 		}
 	}
 	if remainingInstances < 1 || remainingRAM < flavor.RAM || remainingCores < flavor.Cores || remainingVolume < req.Disk {
@@ -811,7 +864,7 @@ func (s *opst) checkQuota(ctx context.Context, req *Requirements, requestedFlavo
 // Requirements.RAM, or Requirements.Disk is not set and OSDisk is configured,
 // returns a new Requirements with the higher RAM/ configured Disk value.
 // Otherwise returns the input.
-func (s *opst) reqForSpawn(req *Requirements) *Requirements {
+func (s *cloudScheduler) reqForSpawn(req *Requirements) *Requirements {
 	reqForSpawn := req
 
 	var osRAM int
@@ -828,11 +881,12 @@ func (s *opst) reqForSpawn(req *Requirements) *Requirements {
 
 	if req.RAM < osRAM {
 		reqForSpawn = &Requirements{
-			RAM:   osRAM,
-			Time:  req.Time,
-			Cores: req.Cores,
-			Disk:  req.Disk,
-			Other: req.Other,
+			RAM:       osRAM,
+			Time:      req.Time,
+			Cores:     req.Cores,
+			Disk:      req.Disk,
+			Other:     req.Other,
+			Resources: req.Resources,
 		}
 	}
 
@@ -842,20 +896,21 @@ func (s *opst) reqForSpawn(req *Requirements) *Requirements {
 	}
 	if req.Disk < disk {
 		reqForSpawn = &Requirements{
-			RAM:   reqForSpawn.RAM,
-			Time:  reqForSpawn.Time,
-			Cores: reqForSpawn.Cores,
-			Disk:  disk,
-			Other: reqForSpawn.Other,
+			RAM:       reqForSpawn.RAM,
+			Time:      reqForSpawn.Time,
+			Cores:     reqForSpawn.Cores,
+			Disk:      disk,
+			Other:     reqForSpawn.Other,
+			Resources: reqForSpawn.Resources,
 		}
 	}
 
 	return reqForSpawn
 }
 
-// spawn creates a new instance in OpenStack. Errors are not returned but are
+// spawn creates a new instance in our cloud. Errors are not returned but are
 // logged, and problematic servers are terminated.
-func (s *opst) spawn(ctx context.Context, req *Requirements, flavor *cloud.Flavor, requestedOS string, requestedScript []byte,
+func (s *cloudScheduler) spawn(ctx context.Context, req *Requirements, flavor *cloud.Flavor, requestedOS string, requestedScript []byte,
 	requestedConfigFiles string, needsSharedDisk bool, cmd string,
 ) {
 	ctx = clog.ContextWithServerFlavor(ctx, flavor.Name)
@@ -1036,7 +1091,7 @@ func (s *opst) spawn(ctx context.Context, req *Requirements, flavor *cloud.Flavo
 			clog.Warn(ctx, "server failed to spawn due to lack of hardware")
 		}
 		if err.Error() != serverNotNeededErrStr {
-			s.notifyMessage(fmt.Sprintf("OpenStack: Failed to create a usable server: %s", err))
+			s.notifyMessage(fmt.Sprintf("Failed to create a usable server: %s", err))
 		}
 		return
 	}
@@ -1056,7 +1111,7 @@ func (s *opst) spawn(ctx context.Context, req *Requirements, flavor *cloud.Flavo
 // cmd no longer needs to be run, in which case an error is returned instead.
 // It will also periodiclly check if the cmd still needs to be run, and return
 // early with an error if not, even while the given code is still running.
-func (s *opst) actOnServerIfNeeded(server *cloud.Server, cmd string, code func(ctx context.Context) error) error {
+func (s *cloudScheduler) actOnServerIfNeeded(server *cloud.Server, cmd string, code func(ctx context.Context) error) error {
 	if s.cleanedUp() {
 		return errors.New(serverNotNeededErrStr)
 	}
@@ -1099,7 +1154,7 @@ func (s *opst) actOnServerIfNeeded(server *cloud.Server, cmd string, code func(c
 }
 
 // cmdNotNeeded cancels the context set by actOnServerIfNeeded(), if any.
-func (s *opst) cmdNotNeeded(cmd string) {
+func (s *cloudScheduler) cmdNotNeeded(cmd string) {
 	s.scMutex.Lock()
 	defer s.scMutex.Unlock()
 	if serverMap, exists := s.spawnCanceller[cmd]; exists {
@@ -1114,7 +1169,7 @@ func (s *opst) cmdNotNeeded(cmd string) {
 // if we can't start the cmd, not if the command fails (schedule() only
 // guarantees that the cmds are run count times, not that they are /successful/
 // that many times).
-func (s *opst) runCmd(ctx context.Context, cmd string, req *Requirements, reservedCh chan bool) error {
+func (s *cloudScheduler) runCmd(ctx context.Context, cmd string, req *Requirements, reservedCh chan bool) error {
 	requestedOS, requestedScript, requestedConfigFiles, requestedFlavor, needsSharedDisk, err := s.serverReqs(ctx, req)
 	if err != nil {
 		return err
@@ -1131,7 +1186,7 @@ func (s *opst) runCmd(ctx context.Context, cmd string, req *Requirements, reserv
 	var server *cloud.Server
 	for sid, thisServer := range s.servers {
 		if !thisServer.IsBad() && thisServer.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor,
-			needsSharedDisk) && thisServer.Allocate(ctx, req.Cores, req.RAM, req.Disk) {
+			needsSharedDisk) && thisServer.Allocate(ctx, req.Cores, req.RAM, req.Disk, req.Resources) {
 			server = thisServer
 
 			// *** reservedCh is buffered and sending on it should never
@@ -1173,7 +1228,7 @@ func (s *opst) runCmd(ctx context.Context, cmd string, req *Requirements, reserv
 	// processQueue() call
 	defer func() {
 		if !server.Destroyed() && server.PermanentProblem() == "" {
-			server.Release(ctx, req.Cores, req.RAM, req.Disk)
+			server.Release(ctx, req.Cores, req.RAM, req.Disk, req.Resources)
 		}
 	}()
 
@@ -1215,7 +1270,7 @@ func (s *opst) runCmd(ctx context.Context, cmd string, req *Requirements, reserv
 
 // stateUpdate checks all our servers are really alive, and adds newly spawned
 // servers to the map that runCmd will check.
-func (s *opst) stateUpdate(ctx context.Context) {
+func (s *cloudScheduler) stateUpdate(ctx context.Context) {
 	s.stateMutex.Lock()
 	defer s.stateMutex.Unlock()
 
@@ -1286,13 +1341,13 @@ func (s *opst) stateUpdate(ctx context.Context) {
 
 // postProcess checks that all our newly spawned servers have been used, and if
 // not, initiates the countdown to their destruction
-func (s *opst) postProcess(ctx context.Context) {
+func (s *cloudScheduler) postProcess(ctx context.Context) {
 	s.serversMutex.Lock()
 	for _, server := range s.servers {
 		if server.Name != localhostName && !server.Used() {
 			clog.Debug(ctx, "placing unused server on deathrow", "server", server.ID)
-			server.Allocate(ctx, 0, 1, 1)
-			server.Release(ctx, 0, 1, 1)
+			server.Allocate(ctx, 0, 1, 1, nil)
+			server.Release(ctx, 0, 1, 1, nil)
 		}
 	}
 	s.serversMutex.Unlock()
@@ -1304,7 +1359,7 @@ func (s *opst) postProcess(ctx context.Context) {
 // is wrong, or we otherwise can't ssh to it, the host will be destroyed
 // immediately. NB: the host checking only works on machines with the 'pgrep'
 // command, such as linux etc.
-func (s *opst) recover(ctx context.Context, cmd string, req *Requirements, host *RecoveredHostDetails) error {
+func (s *cloudScheduler) recover(ctx context.Context, cmd string, req *Requirements, host *RecoveredHostDetails) error {
 	server := s.provider.GetServerByName(host.Host)
 	if server == nil {
 		clog.Warn(ctx, "recover called for non-existent server", "host", host)
@@ -1375,7 +1430,7 @@ func (s *opst) recover(ctx context.Context, cmd string, req *Requirements, host
 						clog.Debug(ctx, "recovered server was destroyed after going idle", "server", server.ID)
 					}
 
-					errp := s.processQueue(ctx, "openstack recover")
+					errp := s.processQueue(ctx, s.providerName+" recover")
 					if errp != nil {
 						clog.Error(ctx, "processQueue call after recovery failed", "err", errp)
 					}
@@ -1394,7 +1449,7 @@ func (s *opst) recover(ctx context.Context, cmd string, req *Requirements, host
 }
 
 // hostToID does the necessary lookup to convert hostname to instance id.
-func (s *opst) hostToID(host string) string {
+func (s *cloudScheduler) hostToID(host string) string {
 	server := s.provider.GetServerByName(host)
 	if server == nil {
 		return ""
@@ -1402,8 +1457,20 @@ func (s *opst) hostToID(host string) string {
 	return server.ID
 }
 
+// serverCount tells you how many servers we have spawned and are still using,
+// not counting the localhost.
+func (s *cloudScheduler) serverCount() int {
+	s.serversMutex.RLock()
+	defer s.serversMutex.RUnlock()
+	count := len(s.servers)
+	if _, exists := s.servers[localhostName]; exists {
+		count--
+	}
+	return count
+}
+
 // getHost returns a cloud.Server for the given host.
-func (s *opst) getHost(host string) (Host, bool) {
+func (s *cloudScheduler) getHost(host string) (Host, bool) {
 	server := s.provider.GetServerByName(host)
 	if server == nil {
 		return nil, false
@@ -1413,24 +1480,28 @@ func (s *opst) getHost(host string) (Host, bool) {
 }
 
 // setMessageCallBack sets the given callback.
-func (s *opst) setMessageCallBack(ctx context.Context, cb MessageCallBack) {
+func (s *cloudScheduler) setMessageCallBack(ctx context.Context, cb MessageCallBack) {
 	s.cbmutex.Lock()
 	defer s.cbmutex.Unlock()
 	s.msgCB = cb
 }
 
-// notifyMessage calls the message callback with the given message in a
-// goroutine, if that callback has been set.
-func (s *opst) notifyMessage(msg string) {
+// notifyMessage calls the message callback with the given message, prefixed
+// with the name of our cloud, in a goroutine, if that callback has been set.
+func (s *cloudScheduler) notifyMessage(msg string) {
 	s.cbmutex.RLock()
 	defer s.cbmutex.RUnlock()
 	if s.msgCB != nil {
-		go s.msgCB(msg)
+		name, known := cloudDisplayNames[s.providerName]
+		if !known {
+			name = s.providerName
+		}
+		go s.msgCB(name + ": " + msg)
 	}
 }
 
 // setBadServerCallBack sets the given callback.
-func (s *opst) setBadServerCallBack(ctx context.Context, cb BadServerCallBack) {
+func (s *cloudScheduler) setBadServerCallBack(ctx context.Context, cb BadServerCallBack) {
 	s.cbmutex.Lock()
 	defer s.cbmutex.Unlock()
 	s.badServerCB = cb
@@ -1438,7 +1509,7 @@ func (s *opst) setBadServerCallBack(ctx context.Context, cb BadServerCallBack) {
 
 // notifyBadServer calls the bad server callback with the given server in a
 // goroutine, if that callback has been set.
-func (s *opst) notifyBadServer(server *cloud.Server) {
+func (s *cloudScheduler) notifyBadServer(server *cloud.Server) {
 	s.cbmutex.RLock()
 	defer s.cbmutex.RUnlock()
 	if s.badServerCB != nil {
@@ -1447,7 +1518,7 @@ func (s *opst) notifyBadServer(server *cloud.Server) {
 }
 
 // cleanup destroys our internal queues and brings down our servers.
-func (s *opst) cleanup(ctx context.Context) {
+func (s *cloudScheduler) cleanup(ctx context.Context) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.runMutex.Lock()
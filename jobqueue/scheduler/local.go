@@ -112,6 +112,7 @@ type local struct {
 	ram               int
 	zeroCores         int
 	cores             float64
+	usedResources     map[string]int
 	rcount            int
 	queue             *queue.Queue
 	running           map[string]int
@@ -162,6 +163,12 @@ type ConfigLocal struct {
 	// The unit is in MB, and defaults to all available memory. Specifying more
 	// than this uses the default amount. Values below 1 are treated as default.
 	MaxRAM int
+
+	// Resources are the named consumable resources (such as GPUs or software
+	// licences) that the machine has available for running jobs, eg.
+	// map[string]int{"gpu": 2}. Jobs that require resources not listed here
+	// can't be run.
+	Resources map[string]int
 }
 
 // jobs are what we store in our queue.
@@ -441,6 +448,7 @@ func (s *local) recover(ctx context.Context, cmd string, req *Requirements, host
 			} else {
 				s.cores += req.Cores
 			}
+			s.useResources(req.Resources, 1)
 			s.resourceMutex.Unlock()
 
 			go func() {
@@ -473,6 +481,7 @@ func (s *local) recover(ctx context.Context, cmd string, req *Requirements, host
 							} else {
 								s.cores -= req.Cores
 							}
+							s.useResources(req.Resources, -1)
 							s.resourceMutex.Unlock()
 
 							errp := s.processQueue(ctx, "recover")
@@ -498,7 +507,8 @@ func (s *local) recover(ctx context.Context, cmd string, req *Requirements, host
 
 // reqCheck gives an ErrImpossible if the given Requirements can not be met.
 func (s *local) reqCheck(ctx context.Context, req *Requirements) error {
-	if req.RAM > s.maxRAM || int(math.Ceil(req.Cores)) > s.maxCores {
+	if req.RAM > s.maxRAM || int(math.Ceil(req.Cores)) > s.maxCores ||
+		internal.ResourcesCanFit(s.config.Resources, nil, req.Resources) == 0 {
 		return Error{"local", "schedule", ErrImpossible}
 	}
 	return nil
@@ -773,9 +783,29 @@ func (s *local) canCount(ctx context.Context, cmd string, req *Requirements, cal
 			}
 		}
 	}
+	if canCount >= 1 {
+		if canCount3 := internal.ResourcesCanFit(s.config.Resources, s.usedResources, req.Resources); canCount3 >= 0 && canCount3 < canCount {
+			canCount = canCount3
+		}
+	}
 	return canCount
 }
 
+// useResources adjusts our tracking of the named consumable resources in use
+// by adding (sign 1) or removing (sign -1) the given resources. You must hold
+// the resourceMutex lock when calling this.
+func (s *local) useResources(resources map[string]int, sign int) {
+	if len(resources) == 0 {
+		return
+	}
+	if s.usedResources == nil {
+		s.usedResources = make(map[string]int)
+	}
+	for name, count := range resources {
+		s.usedResources[name] += sign * count
+	}
+}
+
 // cant is our cantFunc, which in the local case does nothing, since we can't
 // increase available resources.
 func (s *local) cant(ctx context.Context, desired int, cmd string, req *Requirements, call string) {}
@@ -830,6 +860,7 @@ func (s *local) runCmd(ctx context.Context, cmd string, req *Requirements, reser
 	} else {
 		s.cores += req.Cores
 	}
+	s.useResources(req.Resources, 1)
 	sr(true)
 	s.resourceMutex.Unlock()
 
@@ -855,6 +886,7 @@ func (s *local) runCmd(ctx context.Context, cmd string, req *Requirements, reser
 	} else {
 		s.cores -= req.Cores
 	}
+	s.useResources(req.Resources, -1)
 	s.resourceMutex.Unlock()
 
 	return nil // do not return error running the command
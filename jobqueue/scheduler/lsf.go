@@ -351,36 +351,12 @@ func (s *lsf) initialize(ctx context.Context, config interface{}) error {
 		}
 	}
 
-	// sort the queues, those most likely to run jobs sooner coming first
-	ranking := make(map[string]int)
-
-	// instead of range over criteriaHandling, because max_user must come first
-	for _, criterion := range []string{
+	// sort the queues, those most likely to run jobs sooner coming first;
+	// max_user must come first
+	s.sortedqs = rankQueues(s.queues, []string{
 		"max_user", "max", "hosts",
 		"prio", "chunk_size", "num_users", "runlimit", "memlimit",
-	} {
-		// sort queues by this criterion
-		sorted := internal.SortMapKeysByMapIntValue(s.queues, criterion, criteriaHandling[criterion][1] == 1)
-
-		weight := criteriaHandling[criterion][0]
-		prevVal := -1
-		rank := 0
-		for _, queue := range sorted {
-			val := s.queues[queue][criterion]
-			if prevVal != -1 {
-				diff := int(math.Abs(float64(val) - float64(prevVal)))
-				if diff >= 1 {
-					rank++
-				}
-			}
-
-			ranking[queue] += rank * weight
-
-			prevVal = val
-		}
-	}
-
-	s.sortedqs = internal.SortMapKeysByIntValue(ranking, false)
+	}, criteriaHandling)
 
 	// now s.sortedqs has [0] containing our default preferred order or queues,
 	// and other numbers which can be tested against any global maximum number
@@ -548,7 +524,11 @@ func (s *lsf) generateBsubArgs(ctx context.Context, queue string, req *Requireme
 	var bsubArgs []string
 	megabytes := req.RAM
 	m := float32(megabytes) * s.memLimitMultiplier
-	bsubArgs = append(bsubArgs, "-q", queue, "-M", fmt.Sprintf("%0.0f", m), "-R", fmt.Sprintf("'select[mem>%d] rusage[mem=%d] span[hosts=1]'", megabytes, megabytes))
+	var avoid string
+	for _, host := range avoidedHosts(ctx, req) {
+		avoid += fmt.Sprintf(" && hname!=%s", host)
+	}
+	bsubArgs = append(bsubArgs, "-q", queue, "-M", fmt.Sprintf("%0.0f", m), "-R", fmt.Sprintf("'select[mem>%d%s] rusage[mem=%d] span[hosts=1]'", megabytes, avoid, megabytes))
 
 	if val, ok := req.Other["scheduler_misc"]; ok {
 		if strings.Contains(val, `'`) {
@@ -0,0 +1,600 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains a scheduleri implementation for 'pbs': running jobs
+// via Altair PBS Pro (or OpenPBS) or Adaptive Computing's Torque.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+const (
+	// defaultPBSMaxArraySize is the max_array_size that PBS Pro uses if not
+	// otherwise configured.
+	defaultPBSMaxArraySize = 10000
+
+	// pbsInfiniteRunlimit is the runlimit in seconds we treat queues without
+	// a maximum walltime as having.
+	pbsInfiniteRunlimit = 31536000
+)
+
+// pbsFinishedStates are the qstat job states that mean a job is no longer
+// pending or running.
+var pbsFinishedStates = map[string]bool{
+	"C": true, // Torque completed
+	"F": true, // PBS Pro finished
+	"X": true, // PBS Pro subjob expired
+}
+
+// pbs is our implementer of scheduleri
+type pbs struct {
+	config       *ConfigPBS
+	queues       map[string]map[string]int
+	sortedqs     []string
+	qsubRegex    *regexp.Regexp
+	maxArraySize int
+	torque       bool
+	username     string
+	shellPath    string
+	qsubExe      string
+	qstatExe     string
+	qdelExe      string
+	privateKey   string
+}
+
+// ConfigPBS represents the configuration options required by the PBS
+// scheduler. All are required with no usable defaults.
+type ConfigPBS struct {
+	// Deployment is one of "development" or "production".
+	Deployment string
+
+	// Shell is the shell to use to run the commands to interact with your job
+	// scheduler; 'bash' is recommended.
+	Shell string
+
+	// PrivateKeyPath is the path to your private key that can be used to ssh
+	// to PBS nodes to check on jobs if they become non-responsive.
+	PrivateKeyPath string
+}
+
+// initialize finds out about pbs's flavour, queues and configuration
+func (s *pbs) initialize(ctx context.Context, config interface{}) error {
+	s.config = config.(*ConfigPBS)
+
+	s.qsubExe = internal.Which("qsub")
+	s.qstatExe = internal.Which("qstat")
+	s.qdelExe = internal.Which("qdel")
+
+	s.shellPath = internal.Which(s.config.Shell)
+
+	s.qsubRegex = regexp.MustCompile(`^\d+(\[\])?\.\S*`)
+
+	var err error
+	s.username, err = internal.Username()
+	if err != nil {
+		return Error{"pbs", "initialize", fmt.Sprintf("could not get current user: %s", err)}
+	}
+
+	// Torque and PBS Pro share command names but differ in how resources and
+	// arrays are requested; only PBS Pro reports a pbs_version
+	vout, err := exec.Command(s.config.Shell, "-c", s.qstatExe+" --version").CombinedOutput() // #nosec
+	if err != nil {
+		return Error{"pbs", "initialize", fmt.Sprintf("failed to run [qstat --version]: %s", err)}
+	}
+	s.torque = !strings.Contains(string(vout), "pbs_version")
+
+	s.maxArraySize = s.determineMaxArraySize()
+
+	err = s.parseQueues()
+	if err != nil {
+		return err
+	}
+
+	s.sortQueues()
+
+	// if a job becomes lost, scheduler needs to ssh to the host to check on the
+	// process, so we store our private key
+	if content, err := os.ReadFile(internal.TildaToHome(s.config.PrivateKeyPath)); err == nil {
+		s.privateKey = string(content)
+	}
+
+	return nil
+}
+
+// determineMaxArraySize uses qstat to find out the server's maximum number of
+// subjobs in an array job, defaulting to PBS Pro's own default if that isn't
+// possible.
+func (s *pbs) determineMaxArraySize() int {
+	cmdout, err := exec.Command(s.config.Shell, "-c", s.qstatExe+" -Bf").Output() // #nosec
+	if err != nil {
+		return defaultPBSMaxArraySize
+	}
+
+	re := regexp.MustCompile(`(?m)^\s*max_(?:job_)?array_size\s*=\s*(\d+)`)
+	if matches := re.FindStringSubmatch(string(cmdout)); len(matches) == 2 {
+		size, err := strconv.Atoi(matches[1])
+		if err == nil && size > 0 {
+			return size
+		}
+	}
+
+	return defaultPBSMaxArraySize
+}
+
+// parseQueues uses qstat to find out what enabled and started execution queues
+// we have and their limits.
+func (s *pbs) parseQueues() error {
+	out, err := exec.Command(s.config.Shell, "-c", s.qstatExe+" -Qf").Output() // #nosec
+	if err != nil {
+		return Error{"pbs", "initialize", fmt.Sprintf("failed to run [qstat -Qf]: %s", err)}
+	}
+
+	s.queues = make(map[string]map[string]int)
+	blocks, err := parsePBSBlocks(out, "Queue:")
+	if err != nil {
+		return Error{"pbs", "initialize", fmt.Sprintf("failed to read everything from [qstat -Qf]: %s", err)}
+	}
+
+	for queue, attrs := range blocks {
+		if !strings.EqualFold(attrs["queue_type"], "Execution") ||
+			!strings.EqualFold(attrs["enabled"], "True") || !strings.EqualFold(attrs["started"], "True") {
+			continue
+		}
+
+		vals := map[string]int{"runlimit": 0, "memlimit": 0, "cpus": 0, "prio": 0}
+
+		if val := attrs["resources_max.walltime"]; val != "" {
+			vals["runlimit"], err = parseClockTime(val)
+			if err != nil {
+				return Error{"pbs", "initialize", fmt.Sprintf("failed to parse [qstat -Qf] walltime: %s", err)}
+			}
+		}
+
+		if val := attrs["resources_max.mem"]; val != "" {
+			vals["memlimit"], err = parsePBSMemory(val)
+			if err != nil {
+				return Error{"pbs", "initialize", fmt.Sprintf("failed to parse [qstat -Qf] mem: %s", err)}
+			}
+		}
+
+		for criterion, attr := range map[string]string{"cpus": "resources_max.ncpus", "prio": "Priority"} {
+			if val := attrs[attr]; val != "" {
+				vals[criterion], err = strconv.Atoi(val)
+				if err != nil {
+					return Error{"pbs", "initialize", fmt.Sprintf("failed to parse [qstat -Qf] %s: %s", attr, err)}
+				}
+			}
+		}
+
+		s.queues[queue] = vals
+	}
+
+	return nil
+}
+
+// parsePBSBlocks parses the full-format output of qstat, which consists of
+// blocks starting with a line like "Queue: name" or "Job Id: id" (where the
+// part before the name is the supplied header), followed by indented
+// "key = value" lines. It returns the attributes of each block keyed on the
+// name. Long values that qstat wraps on to further lines are rejoined.
+func parsePBSBlocks(out []byte, header string) (map[string]map[string]string, error) {
+	blocks := make(map[string]map[string]string)
+	var current map[string]string
+	var lastKey string
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer([]byte{}, scanBufferSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, header) {
+			current = make(map[string]string)
+			blocks[strings.TrimSpace(strings.TrimPrefix(line, header))] = current
+			lastKey = ""
+			continue
+		}
+
+		if current == nil || strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if i := strings.Index(line, " = "); i != -1 {
+			lastKey = strings.TrimSpace(line[:i])
+			current[lastKey] = strings.TrimSpace(line[i+3:])
+			continue
+		}
+
+		if lastKey != "" && strings.HasPrefix(line, "\t") {
+			current[lastKey] += strings.TrimSpace(line)
+		}
+	}
+
+	return blocks, scanner.Err()
+}
+
+// parsePBSMemory parses a PBS size value, which is a number of bytes
+// optionally suffixed with b, kb, mb, gb, tb or pb (multiples of 1024),
+// returning the number of MB.
+func parsePBSMemory(mem string) (int, error) {
+	mem = strings.ToLower(mem)
+
+	multiplier := 1.0
+	for i, unit := range []string{"kb", "mb", "gb", "tb", "pb"} {
+		if strings.HasSuffix(mem, unit) {
+			multiplier = math.Pow(1024, float64(i+1))
+			mem = strings.TrimSuffix(mem, unit)
+			break
+		}
+	}
+	mem = strings.TrimSuffix(mem, "b")
+
+	num, err := strconv.ParseFloat(mem, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(num * multiplier / (1024 * 1024)), nil
+}
+
+// sortQueues fills in default values for unlimited criteria, then sorts the
+// queues so that those most likely to run jobs sooner come first.
+func (s *pbs) sortQueues() {
+	for _, qmap := range s.queues {
+		if qmap["runlimit"] == 0 {
+			qmap["runlimit"] = pbsInfiniteRunlimit
+		}
+	}
+
+	// for each criteria we're going to sort the queues on, hard-code
+	// [weight, sort-order]. qstat doesn't tell us how big each queue is, so
+	// we go mostly on the admin-assigned priority
+	criteriaHandling := map[string][]int{
+		"prio":     {10, 1}, // weight, sort order
+		"runlimit": {5, 0},
+		"memlimit": {1, 0},
+	}
+
+	s.sortedqs = rankQueues(s.queues, []string{"prio", "runlimit", "memlimit"}, criteriaHandling)
+}
+
+// reserveTimeout achieves the aims of ReserveTimeout().
+func (s *pbs) reserveTimeout(ctx context.Context, req *Requirements) int {
+	if val, defined := req.Other["rtimeout"]; defined {
+		timeout, err := strconv.Atoi(val)
+		if err != nil {
+			clog.Error(ctx, fmt.Sprintf("Failed to convert timeout to integer: %s", err))
+			return defaultReserveTimeout
+		}
+		return timeout
+	}
+	return defaultReserveTimeout
+}
+
+// maxQueueTime achieves the aims of MaxQueueTime().
+func (s *pbs) maxQueueTime(req *Requirements) time.Duration {
+	queue, err := s.determineQueue(req)
+	if err == nil {
+		return s.queueRunlimit(queue)
+	}
+	return infiniteQueueTime
+}
+
+// queueRunlimit returns the runlimit of the given queue, or infiniteQueueTime
+// if we don't know about the queue.
+func (s *pbs) queueRunlimit(queue string) time.Duration {
+	if qmap, known := s.queues[queue]; known {
+		return time.Duration(qmap["runlimit"]) * time.Second
+	}
+	return infiniteQueueTime
+}
+
+// schedule achieves the aims of Schedule(). Note that if rescheduling a cmd
+// at a lower count, we cannot guarantee that only that number get run; it may
+// end up being a few more.
+func (s *pbs) schedule(ctx context.Context, cmd string, req *Requirements, priority uint8, count int) error {
+	// use the given queue or find the best queue for these resource
+	// requirements
+	queue, err := s.determineQueue(req)
+	if err != nil {
+		return err // impossible to run cmd with these reqs
+	}
+
+	// get the details of everything already in the scheduler for this cmd,
+	// deleting anything not currently running when we're over the desired
+	// count
+	scheduledCount, err := s.checkCmd(ctx, cmd, count)
+	if err != nil {
+		return err
+	}
+	stillNeeded := count - scheduledCount
+
+	for stillNeeded > 0 {
+		needed := stillNeeded
+		if needed > s.maxArraySize {
+			needed = s.maxArraySize
+		}
+
+		qsubArgs := s.generateQsubArgs(ctx, queue, req, cmd, needed)
+
+		// we supply the cmd as the job script on STDIN
+		qsubcmd := exec.Command(s.qsubExe, qsubArgs...) // #nosec
+		qsubcmd.Stdin = strings.NewReader(cmd + "\n")
+		qsubout, errs := qsubcmd.Output()
+		if errs != nil {
+			return Error{"pbs", "schedule", fmt.Sprintf("failed to run %s %s: %s", s.qsubExe, qsubArgs, errs)}
+		}
+
+		if !s.qsubRegex.Match(qsubout) {
+			return Error{"pbs", "schedule", fmt.Sprintf("qsub %s returned unexpected output: %s", qsubArgs, qsubout)}
+		}
+
+		stillNeeded -= needed
+	}
+
+	return nil
+}
+
+// scheduled achieves the aims of Scheduled().
+func (s *pbs) scheduled(ctx context.Context, cmd string) (int, error) {
+	return s.checkCmd(ctx, cmd, -1)
+}
+
+// generateQsubArgs generates the appropriate qsub args for the given req and
+// queue, using PBS Pro's select syntax or Torque's nodes syntax as
+// appropriate.
+func (s *pbs) generateQsubArgs(ctx context.Context, queue string, req *Requirements, cmd string, needed int) []string {
+	cores := int(math.Ceil(req.Cores))
+	if cores < 1 {
+		cores = 1
+	}
+
+	qsubArgs := []string{"-V", "-q", queue}
+
+	if s.shellPath != "" {
+		qsubArgs = append(qsubArgs, "-S", s.shellPath)
+	}
+
+	if s.torque {
+		qsubArgs = append(qsubArgs, "-l", fmt.Sprintf("nodes=1:ppn=%d", cores), "-l", fmt.Sprintf("mem=%dmb", req.RAM))
+	} else {
+		qsubArgs = append(qsubArgs, "-l", fmt.Sprintf("select=1:ncpus=%d:mem=%dmb", cores, req.RAM))
+	}
+
+	if runlimit := s.queueRunlimit(queue); runlimit > 0 && runlimit < pbsInfiniteRunlimit*time.Second {
+		secs := int(runlimit.Seconds())
+		qsubArgs = append(qsubArgs, "-l", fmt.Sprintf("walltime=%02d:%02d:%02d", secs/3600, (secs%3600)/60, secs%60))
+	}
+
+	if val, ok := req.Other["scheduler_misc"]; ok {
+		r := csv.NewReader(strings.NewReader(val))
+		r.Comma = ' '
+		fields, err := r.Read()
+		if err != nil {
+			clog.Warn(ctx, "scheduler misc option ignored", "misc", val, "err", err)
+		} else {
+			qsubArgs = append(qsubArgs, fields...)
+		}
+	}
+
+	// for checkCmd() to work efficiently we must always set a job name that
+	// corresponds to the cmd
+	if needed > 1 {
+		arrayOpt := "-J"
+		if s.torque {
+			arrayOpt = "-t"
+		}
+		qsubArgs = append(qsubArgs, arrayOpt, fmt.Sprintf("0-%d", needed-1))
+	}
+	qsubArgs = append(qsubArgs, "-N", jobName(cmd, s.config.Deployment, true),
+		"-o", "/dev/null", "-e", "/dev/null")
+
+	return qsubArgs
+}
+
+// recover achieves the aims of Recover(). We don't have to do anything, since
+// when the cmd finishes running, PBS itself will clean up.
+func (s *pbs) recover(ctx context.Context, cmd string, req *Requirements, host *RecoveredHostDetails) error {
+	return nil
+}
+
+// busy returns true if there are any jobs with our jobName() prefix in any
+// queue.
+func (s *pbs) busy(ctx context.Context) bool {
+	count, err := s.checkCmd(ctx, "", -1)
+	if err != nil {
+		// busy() doesn't return an error, so just assume we're busy
+		return true
+	}
+	return count > 0
+}
+
+// determineQueue picks a queue, preferring ones that are more likely to run
+// our job the soonest (amongst those that are capable of running it). If
+// req.Other contains a scheduler_queue value, returns that instead.
+func (s *pbs) determineQueue(req *Requirements) (string, error) {
+	if queue, ok := req.Other["scheduler_queue"]; ok {
+		return queue, nil
+	}
+
+	seconds := req.Time.Seconds() + minimumQueueTime.Seconds()
+
+	var queuesToAvoid []string
+	if req.Other["scheduler_queues_avoid"] != "" {
+		queuesToAvoid = strings.Split(req.Other["scheduler_queues_avoid"], ",")
+	}
+
+	for _, queue := range s.sortedqs {
+		if queueShouldBeAvoided(queue, queuesToAvoid) {
+			continue
+		}
+
+		qmap := s.queues[queue]
+
+		if qmap["memlimit"] > 0 && qmap["memlimit"] < req.RAM {
+			continue
+		}
+
+		if float64(qmap["runlimit"]) < seconds {
+			continue
+		}
+
+		if qmap["cpus"] > 0 && float64(qmap["cpus"]) < req.Cores {
+			continue
+		}
+
+		return queue, nil
+	}
+
+	return "", Error{"pbs", "determineQueue", ErrImpossible}
+}
+
+// checkCmd asks PBS how many of the supplied cmd are pending or running, and if
+// max >= 0 is supplied, deletes any extraneous queued jobs for the cmd. If the
+// supplied cmd is the empty string, it will report/act on all cmds submitted
+// by schedule() for this deployment.
+func (s *pbs) checkCmd(ctx context.Context, cmd string, max int) (count int, err error) {
+	var jobPrefix string
+	if cmd == "" {
+		jobPrefix = fmt.Sprintf("wr%s_", s.config.Deployment[0:1])
+	} else {
+		jobPrefix = jobName(cmd, s.config.Deployment, false)
+	}
+
+	var queued []string
+	cb := func(jobID, state, jobName string) {
+		count++
+		if state == "Q" {
+			queued = append(queued, jobID)
+		}
+	}
+	err = s.parseQstat(jobPrefix, cb)
+
+	// qstat doesn't list jobs in any particular order, so we only decide what
+	// to delete once we've seen everything
+	var toDelete []string
+	if max >= 0 && count > max {
+		n := count - max
+		if n > len(queued) {
+			n = len(queued)
+		}
+		toDelete = queued[len(queued)-n:]
+		count -= n
+	}
+
+	if len(toDelete) > 0 {
+		delcmd := exec.Command(s.qdelExe, toDelete...) // #nosec
+		out, errd := delcmd.CombinedOutput()
+		if errd != nil {
+			clog.Warn(ctx, "checkCmd qdel failed", "cmd", s.qdelExe, "toDelete", toDelete, "err", errd, "out", string(out))
+		}
+	}
+
+	return count, err
+}
+
+type pbsQstatCB func(jobID, state, jobName string)
+
+// parseQstat runs qstat with full output and array subjobs expanded, filters
+// on our user and a job name prefix, excludes finished jobs and array parents,
+// and gives the job id, state and job name to your callback for each remaining
+// job.
+func (s *pbs) parseQstat(jobPrefix string, callback pbsQstatCB) error {
+	out, err := exec.Command(s.qstatExe, "-f", "-t").Output() // #nosec
+	if err != nil {
+		return Error{"pbs", "parseQstat", fmt.Sprintf("failed to run [qstat]: %s", err)}
+	}
+
+	blocks, err := parsePBSBlocks(out, "Job Id:")
+	if err != nil {
+		return Error{"pbs", "parseQstat", fmt.Sprintf("failed to read everything from [qstat]: %s", err)}
+	}
+
+	for jobID, attrs := range blocks {
+		if strings.Contains(jobID, "[]") || pbsFinishedStates[attrs["job_state"]] ||
+			!strings.HasPrefix(attrs["Job_Owner"], s.username+"@") || !strings.HasPrefix(attrs["Job_Name"], jobPrefix) {
+			continue
+		}
+		callback(jobID, attrs["job_state"], attrs["Job_Name"])
+	}
+
+	return nil
+}
+
+// hostToID always returns an empty string, since we're not in the cloud.
+func (s *pbs) hostToID(host string) string {
+	return ""
+}
+
+// getHost returns a cloud.Server for the given host.
+func (s *pbs) getHost(host string) (Host, bool) {
+	name := "unknown"
+	if user, err := user.Current(); err == nil {
+		name = user.Username
+	}
+
+	server := cloud.NewServer(name, host, s.privateKey)
+	if server == nil {
+		return nil, false
+	}
+
+	return server, true
+}
+
+// setMessageCallBack does nothing at the moment, since we don't generate any
+// messages for the user.
+func (s *pbs) setMessageCallBack(ctx context.Context, cb MessageCallBack) {}
+
+// setBadServerCallBack does nothing, since we're not a cloud-based scheduler.
+func (s *pbs) setBadServerCallBack(ctx context.Context, cb BadServerCallBack) {}
+
+// cleanup qdels any remaining jobs we created
+func (s *pbs) cleanup(ctx context.Context) {
+	var toDelete []string
+	cb := func(jobID, state, jobName string) {
+		toDelete = append(toDelete, jobID)
+	}
+	err := s.parseQstat(fmt.Sprintf("wr%s_", s.config.Deployment[0:1]), cb)
+	if err != nil {
+		clog.Error(ctx, "cleanup parse qstat failed", "err", err)
+	}
+	if len(toDelete) > 0 {
+		delcmd := exec.Command(s.qdelExe, toDelete...) // #nosec
+		err = delcmd.Run()
+		if err != nil {
+			clog.Warn(ctx, "cleanup qdel failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains the functions related to named consumable resources, such
+// as GPUs or software licences, that hosts have a certain number of and that
+// commands can require.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+)
+
+// resourceNameRegex matches valid resource names.
+var resourceNameRegex = regexp.MustCompile(`^[\w.-]+$`)
+
+// ParseResources parses a spec describing named consumable resources, in the
+// form "name=count,name=count", eg. "gpu=2,matlab_licence=1". Names may contain
+// letters, numbers, _, . and -, and counts must be positive integers. A blank
+// spec results in a nil map.
+func ParseResources(spec string) (map[string]int, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	resources := make(map[string]int)
+
+	for _, part := range strings.Split(spec, ",") {
+		name, count, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found || !resourceNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("resource '%s' is not in the form name=count", part)
+		}
+
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("resource %s does not have a positive integer count", name)
+		}
+
+		if _, exists := resources[name]; exists {
+			return nil, fmt.Errorf("resource %s was specified more than once", name)
+		}
+
+		resources[name] = n
+	}
+
+	return resources, nil
+}
+
+// ResourcesString is the inverse of ParseResources(), returning resources in
+// the form "name=count,name=count", sorted by name.
+func ResourcesString(resources map[string]int) string {
+	names := sortedResourceNames(resources)
+	parts := make([]string, len(names))
+
+	for i, name := range names {
+		parts[i] = name + "=" + strconv.Itoa(resources[name])
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// CopyResources returns a copy of the given resources, or nil if there are
+// none.
+func CopyResources(resources map[string]int) map[string]int {
+	if len(resources) == 0 {
+		return nil
+	}
+
+	cp := make(map[string]int, len(resources))
+	for name, count := range resources {
+		cp[name] = count
+	}
+
+	return cp
+}
+
+// sortedResourceNames returns the names of the given resources, sorted.
+func sortedResourceNames(resources map[string]int) []string {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// ParseFlavorResources parses a spec describing the named consumable resources
+// that servers of certain flavors have, in the form
+// "regex:name=count,name=count;regex:name=count", eg. "gpu.*:gpu=2;.*:scratch=1".
+// The regexes are matched against flavor names, and the first that matches a
+// flavor gives the resources of that flavor. A blank spec results in no
+// FlavorResources.
+func ParseFlavorResources(spec string) ([]*cloud.FlavorResources, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var frs []*cloud.FlavorResources
+
+	for _, part := range strings.Split(spec, ";") {
+		regex, rspec, found := strings.Cut(part, ":")
+		if !found || regex == "" {
+			return nil, fmt.Errorf("flavor resources '%s' is not in the form regex:name=count", part)
+		}
+
+		if _, err := regexp.Compile(regex); err != nil {
+			return nil, fmt.Errorf("flavor resources regex '%s' is not valid: %w", regex, err)
+		}
+
+		resources, err := ParseResources(rspec)
+		if err != nil {
+			return nil, err
+		}
+
+		frs = append(frs, &cloud.FlavorResources{Regex: regex, Resources: resources})
+	}
+
+	return frs, nil
+}
@@ -21,8 +21,10 @@ Package scheduler lets the jobqueue server interact with the configured job
 scheduler (if any) to submit jobqueue runner clients and have them run on a
 compute cluster (or local machine).
 
-Currently implemented schedulers are local, LSF, OpenStack and Kubernetes. The
-implementation of each supported scheduler type is in its own .go file.
+Currently implemented schedulers are local, LSF, Slurm, SGE, PBS, sshpool,
+OpenStack, AWS and Kubernetes, along with a fake cloud scheduler for testing.
+The implementation of each supported scheduler type is in its own .go file,
+except that all the cloud schedulers share the one in openstack.go.
 
 It's a pseudo plug-in system in that it is designed so that you can easily add a
 go file that implements the methods of the scheduleri interface, to support a
@@ -43,8 +45,10 @@ import (
 	"context"
 	"crypto/md5" // #nosec - not used for cryptographic purposes here
 	"fmt"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -61,6 +65,15 @@ const (
 	minimumQueueTime      time.Duration = 1 * time.Minute
 )
 
+// AvoidHostsKey is the key of Requirements.Other that holds the comma separated
+// names of hosts that the Cmd should not be run on. Schedulers that can choose
+// hosts will honour it.
+const AvoidHostsKey = "avoid_hosts"
+
+// validHostname matches the host names we're willing to pass on to a batch
+// system's command line.
+var validHostname = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?$`)
+
 // Err* constants are found in the returned Errors under err.Err, so you can
 // cast and check if it's a certain type of error.
 var (
@@ -84,21 +97,29 @@ func (e Error) Error() string {
 // run, so that when provided to a scheduler it will be able to schedule things
 // appropriately.
 type Requirements struct {
-	RAM      int               // the expected peak RAM in MB Cmd will use while running
-	Time     time.Duration     // the expected time Cmd will take to run
-	Cores    float64           // how many processor cores the Cmd will use
-	Disk     int               // the required local disk space in GB the Cmd needs to run
-	Other    map[string]string // a map that will be passed through to the job scheduler, defining further arbitrary resource requirements
-	CoresSet bool              // to distinguish between you specifying 0 Cores and not specifying Cores at all
-	DiskSet  bool              // to distinguish between you specifying 0 Disk and not specifying Disk at all
-	OtherSet bool
+	RAM          int               // the expected peak RAM in MB Cmd will use while running
+	Time         time.Duration     // the expected time Cmd will take to run
+	Cores        float64           // how many processor cores the Cmd will use
+	Disk         int               // the required local disk space in GB the Cmd needs to run
+	Other        map[string]string // a map that will be passed through to the job scheduler, defining further arbitrary resource requirements
+	Resources    map[string]int    // how many of each named consumable resource (eg. "gpu") the Cmd will use; only hosts with enough of them will run it
+	CoresSet     bool              // to distinguish between you specifying 0 Cores and not specifying Cores at all
+	DiskSet      bool              // to distinguish between you specifying 0 Disk and not specifying Disk at all
+	OtherSet     bool
+	ResourcesSet bool
 }
 
 // Stringify represents the contents of the Requirements as a string, sorting
-// the keys of Other to ensure the same result is returned for the same content
-// every time. Note that the data in Other undergoes a 1-way transformation,
-// so you cannot recreate the Requirements from the the output of this method.
+// the keys of Resources and Other to ensure the same result is returned for the
+// same content every time. Note that the data in Other undergoes a 1-way
+// transformation, so you cannot recreate the Requirements from the the output
+// of this method.
 func (req *Requirements) Stringify() string {
+	var resources string
+	for _, name := range sortedResourceNames(req.Resources) {
+		resources += fmt.Sprintf(":%s=%d", name, req.Resources[name])
+	}
+
 	var other string
 	if len(req.Other) > 0 {
 		otherKeys := make([]string, 0, len(req.Other))
@@ -116,19 +137,20 @@ func (req *Requirements) Stringify() string {
 		other = fmt.Sprintf(":%x", md5.Sum([]byte(other))) // #nosec
 	}
 
-	return fmt.Sprintf("%d:%.0f:%s:%d%s", req.RAM, req.Time.Minutes(), strconv.FormatFloat(req.Cores, 'f', -1, 64), req.Disk, other)
+	return fmt.Sprintf("%d:%.0f:%s:%d%s%s", req.RAM, req.Time.Minutes(), strconv.FormatFloat(req.Cores, 'f', -1, 64), req.Disk, resources, other)
 }
 
 // Clone creates a copy of the Requirements.
 func (req *Requirements) Clone() *Requirements {
 	new := &Requirements{
-		RAM:      req.RAM,
-		Time:     req.Time,
-		Cores:    req.Cores,
-		CoresSet: req.CoresSet,
-		Disk:     req.Disk,
-		DiskSet:  req.DiskSet,
-		OtherSet: req.OtherSet,
+		RAM:          req.RAM,
+		Time:         req.Time,
+		Cores:        req.Cores,
+		CoresSet:     req.CoresSet,
+		Disk:         req.Disk,
+		DiskSet:      req.DiskSet,
+		OtherSet:     req.OtherSet,
+		ResourcesSet: req.ResourcesSet,
 	}
 	if req.OtherSet || len(req.Other) > 0 {
 		newOther := make(map[string]string, len(req.Other))
@@ -137,6 +159,9 @@ func (req *Requirements) Clone() *Requirements {
 		}
 		new.Other = newOther
 	}
+	if req.ResourcesSet || len(req.Resources) > 0 {
+		new.Resources = CopyResources(req.Resources)
+	}
 	return new
 }
 
@@ -198,6 +223,12 @@ type scheduleri interface {
 	cleanup(ctx context.Context)                                                                  // do any clean up once you've finished using the job scheduler
 }
 
+// cloudServerCounter interface can be satisfied by cloud schedulers that are
+// able to say how many servers they have spawned.
+type cloudServerCounter interface {
+	serverCount() int // achieve the aims of CloudServers()
+}
+
 // CloudConfig interface could be satisfied by the config option taken by cloud
 // schedulers which have a ConfigFiles property, a property for configuring a
 // default ssh login username, and a property for determining how long to keep
@@ -225,9 +256,14 @@ type Scheduler struct {
 }
 
 // New creates a new Scheduler to interact with the given job scheduler.
-// Possible names so far are "lsf", "local", "openstack" and "kubernetes". You
-// must also provide a config struct appropriate for your chosen scheduler, eg.
-// for the local scheduler you will provide a ConfigLocal.
+// Possible names so far are "lsf", "slurm", "sge", "pbs", "local", "sshpool",
+// "cloud" and "kubernetes". You must also provide a config struct appropriate
+// for your chosen scheduler, eg. for the local scheduler you will provide a
+// ConfigLocal, and for the cloud scheduler you will provide a ConfigCloud.
+//
+// "openstack", "aws" and "fake" (which runs everything on the local machine for
+// testing purposes) are aliases for "cloud" that use that provider if the
+// ConfigCloud's Provider isn't set.
 //
 // Providing a logger allows for debug messages to be logged somewhere, along
 // with any "harmless" or unreturnable errors. If not supplied, we use a default
@@ -237,10 +273,20 @@ func New(ctx context.Context, name string, config interface{}) (*Scheduler, erro
 	switch name {
 	case "lsf":
 		s = &Scheduler{impl: new(lsf)}
+	case "slurm":
+		s = &Scheduler{impl: new(slurm)}
+	case "sge":
+		s = &Scheduler{impl: new(sge)}
+	case "pbs":
+		s = &Scheduler{impl: new(pbs)}
 	case "local":
 		s = &Scheduler{impl: new(local)}
-	case "openstack":
-		s = &Scheduler{impl: new(opst)}
+	case "sshpool":
+		s = &Scheduler{impl: new(sshpool)}
+	case "cloud":
+		s = &Scheduler{impl: new(cloudScheduler)}
+	case "openstack", "aws", "fake":
+		s = &Scheduler{impl: &cloudScheduler{providerName: name}}
 	case "kubernetes":
 		s = &Scheduler{impl: new(k8s)}
 	default:
@@ -393,6 +439,16 @@ func (s *Scheduler) GetHost(hostName string) Host {
 	return host
 }
 
+// CloudServers returns the number of servers that a cloud scheduler has spawned
+// and is still using, not counting the server we are running on. For
+// schedulers that don't spawn servers, returns -1.
+func (s *Scheduler) CloudServers() int {
+	if counter, ok := s.impl.(cloudServerCounter); ok {
+		return counter.serverCount()
+	}
+	return -1
+}
+
 // ProcessNotRunningOnHost will ssh to the given host and check if the given
 // process id is still running. Returns true if it isn't. Returns false if it is
 // running, or if the ssh wasn't possible. This is to find out if a process is
@@ -431,3 +487,72 @@ func jobName(cmd string, deployment string, unique bool) string {
 
 	return name
 }
+
+// rankQueues could be useful to a scheduleri implementer for a batch system
+// with multiple queues. It sorts the given queues (as a map of queue name to
+// values for various criteria) so that those most likely to run jobs sooner
+// come first, returning the sorted queue names. For each criterion to sort on,
+// handling gives [weight, sort-order], where a sort-order of 1 means queues with
+// higher values are better.
+func rankQueues(queues map[string]map[string]int, criteria []string, handling map[string][]int) []string {
+	ranking := make(map[string]int)
+	for _, criterion := range criteria {
+		sorted := internal.SortMapKeysByMapIntValue(queues, criterion, handling[criterion][1] == 1)
+
+		weight := handling[criterion][0]
+		rank := 0
+		for i, queue := range sorted {
+			val := queues[queue][criterion]
+			if i > 0 && val != queues[sorted[i-1]][criterion] {
+				rank++
+			}
+
+			ranking[queue] += rank * weight
+		}
+	}
+
+	return internal.SortMapKeysByIntValue(ranking, false)
+}
+
+// avoidedHosts returns the host names in the given Requirements' AvoidHostsKey
+// Other value. Any that are not valid host names are skipped with a warning, so
+// that they can be safely passed to a batch system.
+func avoidedHosts(ctx context.Context, req *Requirements) []string {
+	val := req.Other[AvoidHostsKey]
+	if val == "" {
+		return nil
+	}
+
+	var hosts []string
+	for _, host := range strings.Split(val, ",") {
+		if !validHostname.MatchString(host) {
+			clog.Warn(ctx, "ignoring invalid host name to avoid", "host", host)
+
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts
+}
+
+// parseClockTime parses a time limit in the form "seconds", "minutes:seconds"
+// or "hours:minutes:seconds", as used by various batch systems, returning the
+// number of seconds.
+func parseClockTime(limit string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(limit), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("time limit %s has too many parts", limit)
+	}
+
+	seconds := 0
+	for _, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + num
+	}
+
+	return seconds, nil
+}
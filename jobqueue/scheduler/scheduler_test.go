@@ -19,10 +19,15 @@
 package scheduler
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
@@ -36,11 +41,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/VertebrateResequencing/wr/cloud"
 	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/wtsi-ssg/wr/clog"
 
 	"github.com/inconshreveable/log15"
+	"github.com/pkg/sftp"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
 )
 
 const devHost = "farm22-hgi01"
@@ -62,12 +70,12 @@ func TestLocal(t *testing.T) {
 	Convey("You can get a new local scheduler", t, func() {
 		otherReqs := make(map[string]string)
 
-		s, err := New(ctx, "local", &ConfigLocal{"bash", 1 * time.Second, 0, 0})
+		s, err := New(ctx, "local", &ConfigLocal{"bash", 1 * time.Second, 0, 0, nil})
 		So(err, ShouldBeNil)
 		So(s, ShouldNotBeNil)
 
-		possibleReq := &Requirements{1, 1 * time.Second, 1, 20, otherReqs, true, true, true}
-		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs, true, true, true}
+		possibleReq := &Requirements{1, 1 * time.Second, 1, 20, otherReqs, nil, true, true, true, false}
+		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs, nil, true, true, true, false}
 
 		Convey("Debug log contains context based on scheduler type", func() {
 			ctx = s.typeContext(ctx)
@@ -105,6 +113,45 @@ func TestLocal(t *testing.T) {
 			other["goo"] = "lar"
 			testReq.Other = other
 			So(testReq.Stringify(), ShouldEqual, "300:120:2:0:f88250fdf9c81d47c18d63354b85f26e")
+			testReq.Resources = map[string]int{"licence": 1, "gpu": 2}
+			So(testReq.Stringify(), ShouldEqual, "300:120:2:0:gpu=2:licence=1:f88250fdf9c81d47c18d63354b85f26e")
+		})
+
+		Convey("ParseResources() works", func() {
+			resources, err := ParseResources("")
+			So(err, ShouldBeNil)
+			So(resources, ShouldBeNil)
+
+			resources, err = ParseResources("gpu=2, matlab_licence=1")
+			So(err, ShouldBeNil)
+			So(resources, ShouldResemble, map[string]int{"gpu": 2, "matlab_licence": 1})
+			So(ResourcesString(resources), ShouldEqual, "gpu=2,matlab_licence=1")
+
+			for _, bad := range []string{"gpu", "gpu=0", "gpu=-1", "gpu=a", "g pu=1", "gpu=1,gpu=2"} {
+				_, err = ParseResources(bad)
+				So(err, ShouldNotBeNil)
+			}
+
+			frs, err := ParseFlavorResources("gpu.*:gpu=2;.*:scratch=1")
+			So(err, ShouldBeNil)
+			So(len(frs), ShouldEqual, 2)
+			So(frs[0].Regex, ShouldEqual, "gpu.*")
+			So(frs[0].Resources, ShouldResemble, map[string]int{"gpu": 2})
+			So(frs[1].Regex, ShouldEqual, ".*")
+			So(frs[1].Resources, ShouldResemble, map[string]int{"scratch": 1})
+
+			for _, bad := range []string{"gpu=2", ":gpu=2", "[:gpu=2", "gpu.*:gpu"} {
+				_, err = ParseFlavorResources(bad)
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("Schedule() gives impossible error when given reqs for resources the machine lacks", func() {
+			err := s.Schedule(ctx, "foo", &Requirements{RAM: 1, Time: 1 * time.Second, Cores: 1, Resources: map[string]int{"gpu": 1}}, 0, 1)
+			So(err, ShouldNotBeNil)
+			serr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(serr.Err, ShouldEqual, ErrImpossible)
 		})
 
 		Convey("Schedule() gives impossible error when given impossible reqs", func() {
@@ -301,11 +348,11 @@ func TestLocal(t *testing.T) {
 				defer os.RemoveAll(bigTmpdir)
 
 				blockCmd := "sleep 0.25"
-				blockReq := &Requirements{1, 1 * time.Second, float64(maxCPU), 0, otherReqs, true, true, true}
+				blockReq := &Requirements{1, 1 * time.Second, float64(maxCPU), 0, otherReqs, nil, true, true, true, false}
 				smallCmd := fmt.Sprintf("mktemp --tmpdir=%s tmp.XXXXXX && sleep 0.75", smallTmpdir)
-				smallReq := &Requirements{1, 1 * time.Second, 1, 0, otherReqs, true, true, true}
+				smallReq := &Requirements{1, 1 * time.Second, 1, 0, otherReqs, nil, true, true, true, false}
 				bigCmd := fmt.Sprintf("mktemp --tmpdir=%s tmp.XXXXXX && sleep 0.75", bigTmpdir)
-				bigReq := &Requirements{1, 1 * time.Second, float64(maxCPU - 1), 0, otherReqs, true, true, true}
+				bigReq := &Requirements{1, 1 * time.Second, float64(maxCPU - 1), 0, otherReqs, nil, true, true, true, false}
 
 				// schedule 2 big cmds and then a small one to prove the small
 				// one fits the gap and runs before the second big one
@@ -378,9 +425,9 @@ func TestLocal(t *testing.T) {
 				defer os.RemoveAll(bigTmpdir)
 
 				smallCmd := fmt.Sprintf("mktemp --tmpdir=%s tmp.XXXXXX && sleep 0.75", smallTmpdir)
-				smallReq := &Requirements{1, 1 * time.Second, 1, 0, otherReqs, true, true, true}
+				smallReq := &Requirements{1, 1 * time.Second, 1, 0, otherReqs, nil, true, true, true, false}
 				bigCmd := fmt.Sprintf("mktemp --tmpdir=%s tmp.XXXXXX && sleep 0.75", bigTmpdir)
-				bigReq := &Requirements{1, 1 * time.Second, float64(maxCPU / 2), 0, otherReqs, true, true, true}
+				bigReq := &Requirements{1, 1 * time.Second, float64(maxCPU / 2), 0, otherReqs, nil, true, true, true, false}
 
 				// schedule 3 big cmds (where 2 can run at once, filling the
 				// whole machine) and then a small one to prove the small
@@ -417,7 +464,7 @@ func TestLocal(t *testing.T) {
 		Convey("You can get a new local scheduler that uses less than all CPUs", t, func() {
 			otherReqs := make(map[string]string)
 
-			s, err := New(ctx, "local", &ConfigLocal{"bash", 1 * time.Second, 1, 0})
+			s, err := New(ctx, "local", &ConfigLocal{"bash", 1 * time.Second, 1, 0, nil})
 			So(err, ShouldBeNil)
 			So(s, ShouldNotBeNil)
 
@@ -427,7 +474,7 @@ func TestLocal(t *testing.T) {
 			}
 
 			cmd := fmt.Sprintf("mktemp --tmpdir=%s tmp.XXXXXX && sleep 0.5", tmpDir)
-			sleepReq := &Requirements{1, 1 * time.Second, 1, 0, otherReqs, true, true, true}
+			sleepReq := &Requirements{1, 1 * time.Second, 1, 0, otherReqs, nil, true, true, true, false}
 
 			err = s.Schedule(ctx, cmd, sleepReq, 0, 2)
 			So(err, ShouldBeNil)
@@ -451,6 +498,46 @@ func TestLocal(t *testing.T) {
 			So(first, ShouldHappenBefore, second.Add(-400*time.Millisecond))
 		})
 	}
+
+	Convey("You can get a new local scheduler with consumable resources", t, func() {
+		s, err := New(ctx, "local", &ConfigLocal{"bash", 1 * time.Second, 0, 0, map[string]int{"gpu": 1}})
+		So(err, ShouldBeNil)
+		So(s, ShouldNotBeNil)
+
+		gpuReq := &Requirements{RAM: 1, Time: 1 * time.Second, Cores: 0, Resources: map[string]int{"gpu": 1}}
+		So(s.impl.(*local).canCount(ctx, "", gpuReq, ""), ShouldEqual, 1)
+		So(s.impl.(*local).canCount(ctx, "", &Requirements{RAM: 1, Time: 1 * time.Second, Cores: 0}, ""), ShouldBeGreaterThan, 1)
+
+		tmpDir, err := os.MkdirTemp("", "wr_schedulers_local_test_resources_output_dir_")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		cmd := fmt.Sprintf("mktemp --tmpdir=%s tmp.XXXXXX && sleep 0.5", tmpDir)
+		err = s.Schedule(ctx, cmd, gpuReq, 0, 2)
+		So(err, ShouldBeNil)
+
+		Convey("Commands needing the resource run one at a time", func() {
+			for {
+				if !s.Busy(ctx) {
+					break
+				}
+				<-time.After(1 * time.Millisecond)
+			}
+
+			times := mtimesOfFilesInDir(tmpDir, 2)
+			So(len(times), ShouldEqual, 2)
+			first := times[0]
+			second := times[1]
+			if second.Before(first) {
+				first = times[1]
+				second = times[0]
+			}
+			So(first, ShouldHappenBefore, second.Add(-400*time.Millisecond))
+			So(s.impl.(*local).canCount(ctx, "", gpuReq, ""), ShouldEqual, 1)
+		})
+	})
 }
 
 func TestLSF(t *testing.T) {
@@ -479,9 +566,9 @@ func TestLSF(t *testing.T) {
 		specifiedOther := make(map[string]string)
 		specifiedOther["scheduler_queue"] = "yesterday"
 		specifiedOther["scheduler_misc"] = "-R avx"
-		possibleReq := &Requirements{100, 1 * time.Minute, 1, 20, otherReqs, true, true, true}
-		specifiedReq := &Requirements{100, 1 * time.Minute, 1, 20, specifiedOther, true, true, true}
-		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs, true, true, true}
+		possibleReq := &Requirements{100, 1 * time.Minute, 1, 20, otherReqs, nil, true, true, true, false}
+		specifiedReq := &Requirements{100, 1 * time.Minute, 1, 20, specifiedOther, nil, true, true, true, false}
+		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs, nil, true, true, true, false}
 
 		host, err := os.Hostname()
 		if err != nil {
@@ -512,22 +599,22 @@ func TestLSF(t *testing.T) {
 		// mock some textual input instead of taking it from lsadmin...
 		if host == devHost {
 			Convey("determineQueue() picks the best queue depending on given queues to avoid or select", func() {
-				queue, err := s.impl.(*lsf).determineQueue(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs, true, true, true})
+				queue, err := s.impl.(*lsf).determineQueue(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "long-chkpt")
 
 				otherReqs["scheduler_queues_avoid"] = "-chkpt"
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs, true, true, true})
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "long")
 
 				otherReqs["scheduler_queues_avoid"] = "-chkpt,parallel"
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 100 * time.Hour, 1, 20, otherReqs, true, true, true})
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 100 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "week")
 
 				otherReqs["scheduler_queue"] = "long"
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 49 * time.Hour, 1, 20, otherReqs, true, true, true})
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 49 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "long")
 			})
@@ -537,34 +624,34 @@ func TestLSF(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "normal")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 5 * time.Minute, 1, 20, otherReqs, true, true, true})
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 5 * time.Minute, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "normal")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{37000, 1 * time.Hour, 1, 20, otherReqs, true, true, true})
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{37000, 1 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "normal")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1000000, 1 * time.Hour, 1, 20, otherReqs, true, true, true})
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1000000, 1 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "hugemem")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs, true, true, true})
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "long-chkpt")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 169 * time.Hour, 1, 20, otherReqs, true, true, true})
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 169 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "hugemem")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 361 * time.Hour, 1, 20, otherReqs, true, true, true})
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 361 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "basement-chkpt")
 			})
 
 			Convey("MaxQueueTime() returns appropriate times depending on the requirements", func() {
 				So(s.MaxQueueTime(possibleReq).Minutes(), ShouldEqual, 720)
-				So(s.MaxQueueTime(&Requirements{1, 49 * time.Hour, 1, 20, otherReqs, true, true, true}).Minutes(),
+				So(s.MaxQueueTime(&Requirements{1, 49 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false}).Minutes(),
 					ShouldEqual, 10080)
 			})
 
@@ -606,130 +693,1318 @@ func TestLSF(t *testing.T) {
 			bsubArgs[9] = "random3"
 			So(bsubArgs, ShouldResemble, []string{"-q", "yesterday", "-M", "100", "-R", "'select[mem>100] rusage[mem=100] span[hosts=1]'", "-E", "'also supported'", "-J", "random3", "-o", "/dev/null", "-e", "/dev/null", "mycmd"})
 
-			specifiedOther["scheduler_misc"] = `-E "'not supported'"`
-			bsubArgs = s.impl.(*lsf).generateBsubArgs(ctx, "yesterday", specifiedReq, "mycmd", 2)
-			bsubArgs[7] = "random3"
-			So(bsubArgs, ShouldResemble, []string{"-q", "yesterday", "-M", "100", "-R", "'select[mem>100] rusage[mem=100] span[hosts=1]'", "-J", "random3", "-o", "/dev/null", "-e", "/dev/null", "mycmd"})
+			specifiedOther["scheduler_misc"] = `-E "'not supported'"`
+			bsubArgs = s.impl.(*lsf).generateBsubArgs(ctx, "yesterday", specifiedReq, "mycmd", 2)
+			bsubArgs[7] = "random3"
+			So(bsubArgs, ShouldResemble, []string{"-q", "yesterday", "-M", "100", "-R", "'select[mem>100] rusage[mem=100] span[hosts=1]'", "-J", "random3", "-o", "/dev/null", "-e", "/dev/null", "mycmd"})
+
+			delete(specifiedOther, "scheduler_misc")
+			specifiedOther[AvoidHostsKey] = "hostA,hostB"
+			bsubArgs = s.impl.(*lsf).generateBsubArgs(ctx, "yesterday", specifiedReq, "mycmd", 2)
+			bsubArgs[7] = "random4"
+			So(bsubArgs, ShouldResemble, []string{"-q", "yesterday", "-M", "100", "-R", "'select[mem>100 && hname!=hostA && hname!=hostB] rusage[mem=100] span[hosts=1]'", "-J", "random4", "-o", "/dev/null", "-e", "/dev/null", "mycmd"})
+
+			specifiedOther[AvoidHostsKey] = "hostA,host]' rusage[mem=1,hostB"
+			bsubArgs = s.impl.(*lsf).generateBsubArgs(ctx, "yesterday", specifiedReq, "mycmd", 2)
+			bsubArgs[7] = "random5"
+			So(bsubArgs, ShouldResemble, []string{"-q", "yesterday", "-M", "100", "-R", "'select[mem>100 && hname!=hostA && hname!=hostB] rusage[mem=100] span[hosts=1]'", "-J", "random5", "-o", "/dev/null", "-e", "/dev/null", "mycmd"})
+		})
+
+		Convey("Busy() starts off false", func() {
+			So(s.Busy(ctx), ShouldBeFalse)
+		})
+
+		Convey("Schedule() gives impossible error when given impossible reqs", func() {
+			err := s.Schedule(ctx, "foo", impossibleReq, 0, 1)
+			So(err, ShouldNotBeNil)
+			serr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(serr.Err, ShouldEqual, ErrImpossible)
+		})
+
+		// following tests are unreliable due to needing LSF nodes to be all
+		// working well and for there to be capacity to run jobs
+		if os.Getenv("WR_DISABLE_UNRELIABLE_LSF_TESTS") == "true" {
+			SkipConvey("Further LSF tests disabled since WR_DISABLE_UNRELIABLE_LSF_TESTS is set", func() {})
+
+			return
+		}
+
+		Convey("Given a cmd running on a host", func() {
+			testProcessNotRunning(ctx, s, possibleReq)
+		})
+
+		Convey("Schedule() lets you schedule more jobs than localhost CPUs", func() {
+			// tmpdir, err := os.MkdirTemp("", "wr_schedulers_lsf_test_output_dir_")
+			// if err != nil {
+			// 	log.Fatal(err)
+			// }
+			// defer os.RemoveAll(tmpdir)
+
+			// cmd := fmt.Sprintf("ssh %s 'perl -MFile::Temp=tempfile -e '\"'\"'$sleep = rand(60); select(undef, undef, undef, $sleep); @a = tempfile(DIR => q[%s]); select(undef, undef, undef, 5 - $sleep); exit(0);'\"'\"", host, tmpdir) // sleep for a random amount of time so that ssh does not fail due to too many run at once, then ssh back to us and create a file in our tmp dir
+
+			// the above wouldn't work due to some issue with all the ssh's not
+			// working and some high proportion of the LSF jobs immediately
+			// failing; instead we assume, since this is LSF, that our current
+			// directory is on a shared disk, and just have all the jobs write
+			// their files here directly
+			tmpdir, err := os.MkdirTemp("./", "wr_schedulers_lsf_test_output_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+
+			cmd := fmt.Sprintf("perl -MFile::Temp=tempfile -e '@a = tempfile(DIR => q[%s]); sleep(5); exit(0);'", tmpdir)
+
+			count := maxCPU * 2
+			err = s.Schedule(ctx, cmd, possibleReq, 0, count)
+			So(err, ShouldBeNil)
+			So(s.Busy(ctx), ShouldBeTrue)
+
+			Convey("It eventually runs them all", func() {
+				So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
+				numfiles := testDirForFiles(tmpdir, count)
+				So(numfiles, ShouldEqual, count)
+			})
+
+			// *** no idea how to reliably test dropping the count, since I
+			// don't have any way of ensuring some jobs are still pending by the
+			// time I try and drop the count... unless I did something like
+			// have a count of 1000000?...
+
+			Convey("You can Schedule() again to increase the count", func() {
+				newcount := count + 5
+				err = s.Schedule(ctx, cmd, possibleReq, 0, newcount)
+				So(err, ShouldBeNil)
+				So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
+				numfiles := testDirForFiles(tmpdir, newcount)
+				So(numfiles, ShouldEqual, newcount)
+			})
+
+			Convey("You can Schedule() a new job and have it run while the first is still running", func() {
+				<-time.After(6 * time.Second) // *** if the following test fails, it probably just because LSF didn't get any previous jobs running yet; not sure what to do about that
+				numfiles := testDirForFiles(tmpdir, 1)
+				So(numfiles, ShouldBeBetweenOrEqual, 1, count)
+				So(s.Busy(ctx), ShouldBeTrue)
+
+				newcmd := fmt.Sprintf("perl -MFile::Temp=tempfile -e '@a = tempfile(DIR => q[%s]); sleep(1); exit(0);'", tmpdir)
+				err = s.Schedule(ctx, newcmd, possibleReq, 0, 1)
+				So(err, ShouldBeNil)
+
+				So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
+				numfiles = testDirForFiles(tmpdir, count+1)
+				So(numfiles, ShouldEqual, count+1)
+			})
+		})
+
+		Convey("Schedule() lets you schedule more jobs than could reasonably start all at once", func() {
+			tmpdir, err := os.MkdirTemp("./", "wr_schedulers_lsf_test_output_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+
+			cmd := fmt.Sprintf("perl -MFile::Temp=tempfile -e '@a = tempfile(DIR => q[%s]); sleep(2); exit(0);'", tmpdir)
+
+			count := 10000 // 1,000,000 just errors out, and 100,000 could be bad for LSF in some way
+			err = s.Schedule(ctx, cmd, possibleReq, 0, count)
+			So(err, ShouldBeNil)
+			So(s.Busy(ctx), ShouldBeTrue)
+
+			Convey("It runs some of them and you can Schedule() again to drop the count", func() {
+				So(waitToFinish(ctx, s, 6, 1000), ShouldBeFalse)
+				numfiles := testDirForFiles(tmpdir, 1)
+				So(numfiles, ShouldBeBetween, 1, count-(maxCPU*2)-2)
+
+				newcount := numfiles + maxCPU
+				err = s.Schedule(ctx, cmd, possibleReq, 0, newcount)
+				So(err, ShouldBeNil)
+
+				So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
+				numfiles = testDirForFiles(tmpdir, newcount)
+				So(numfiles, ShouldBeBetweenOrEqual, newcount, numfiles*2) // we must allow it to run a few extra due to the implementation
+			})
+		})
+
+		// wait a while for any remaining jobs to finish
+		So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
+	})
+}
+
+func TestSlurm(t *testing.T) {
+	ctx := context.Background()
+
+	// we test against stub slurm commands that pretend to have some partitions
+	// and keep track of submitted jobs in a file
+	stubDir, err := os.MkdirTemp("", "wr_schedulers_slurm_test_stubs_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(stubDir)
+
+	err = createSlurmStubs(stubDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	origPath := os.Getenv("PATH")
+	err = os.Setenv("PATH", stubDir+string(os.PathListSeparator)+origPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		err = os.Setenv("PATH", origPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	jobsFile := filepath.Join(stubDir, "jobs")
+
+	Convey("You can get a new slurm scheduler", t, func() {
+		otherReqs := make(map[string]string)
+
+		specifiedOther := make(map[string]string)
+		specifiedOther["scheduler_queue"] = "yesterday"
+		specifiedOther["scheduler_misc"] = "-C avx"
+		possibleReq := &Requirements{100, 1 * time.Minute, 1, 20, otherReqs, nil, true, true, true, false}
+		specifiedReq := &Requirements{100, 1 * time.Minute, 1, 20, specifiedOther, nil, true, true, true, false}
+		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs, nil, true, true, true, false}
+
+		s, err := New(ctx, "slurm", &ConfigSlurm{"development", "bash", "~/.ssh/id_rsa"})
+		So(err, ShouldBeNil)
+		So(s, ShouldNotBeNil)
+		impl := s.impl.(*slurm)
+
+		Convey("It parses the partitions and config", func() {
+			So(impl.maxArraySize, ShouldEqual, 3)
+			So(len(impl.partitions), ShouldEqual, 3)
+			So(impl.partitions["short"], ShouldResemble, map[string]int{
+				"runlimit": 3600, "memlimit": 128000, "cpus": 32, "hosts": 10, "tmp": 0, "prio": 1,
+			})
+			So(impl.partitions["long"]["runlimit"], ShouldEqual, 604800)
+			So(impl.partitions["hugemem"]["runlimit"], ShouldEqual, slurmInfiniteRunlimit)
+			So(impl.sortedps, ShouldResemble, []string{"short", "long", "hugemem"})
+		})
+
+		Convey("ReserveTimeout() returns 1 second", func() {
+			So(s.ReserveTimeout(ctx, possibleReq), ShouldEqual, 1)
+		})
+
+		Convey("determineQueue() picks the best partition depending on given resource requirements", func() {
+			partition, err := impl.determineQueue(possibleReq)
+			So(err, ShouldBeNil)
+			So(partition, ShouldEqual, "short")
+
+			partition, err = impl.determineQueue(&Requirements{100, 2 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(partition, ShouldEqual, "long")
+
+			partition, err = impl.determineQueue(&Requirements{300000, 1 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(partition, ShouldEqual, "hugemem")
+
+			partition, err = impl.determineQueue(&Requirements{100, 8 * 24 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(partition, ShouldEqual, "hugemem")
+
+			partition, err = impl.determineQueue(&Requirements{100, 1 * time.Hour, 48, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(partition, ShouldEqual, "hugemem")
+
+			_, err = impl.determineQueue(&Requirements{100, 1 * time.Hour, 100, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("determineQueue() picks the best partition depending on given partitions to avoid or select", func() {
+			otherReqs["scheduler_queues_avoid"] = "sho"
+			partition, err := impl.determineQueue(possibleReq)
+			So(err, ShouldBeNil)
+			So(partition, ShouldEqual, "long")
+
+			partition, err = impl.determineQueue(specifiedReq)
+			So(err, ShouldBeNil)
+			So(partition, ShouldEqual, "yesterday")
+		})
+
+		Convey("MaxQueueTime() returns appropriate times depending on the requirements", func() {
+			So(s.MaxQueueTime(possibleReq).Minutes(), ShouldEqual, 60)
+			So(s.MaxQueueTime(&Requirements{100, 2 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false}).Minutes(),
+				ShouldEqual, 10080)
+		})
+
+		Convey("generateSbatchArgs() maps requirements and adds in user-specified options", func() {
+			sbatchArgs := impl.generateSbatchArgs(ctx, "short", specifiedReq, "mycmd", 2)
+			So(sbatchArgs[16], ShouldStartWith, "wrd_")
+			sbatchArgs[16] = "random1"
+			So(sbatchArgs, ShouldResemble, []string{"--parsable", "-p", "short", "-N", "1", "--mem", "100M",
+				"-t", "60", "--tmp", "20G", "-C", "avx", "--array", "0-1", "-J", "random1",
+				"-o", "/dev/null", "-e", "/dev/null", "--wrap", "mycmd"})
+
+			specifiedOther["scheduler_misc"] = `--constraint "avx foo"`
+			sbatchArgs = impl.generateSbatchArgs(ctx, "yesterday", &Requirements{2000, 1 * time.Minute, 2.5, 0,
+				specifiedOther, nil, true, true, true, false}, "mycmd", 1)
+			sbatchArgs[12] = "random2"
+			So(sbatchArgs, ShouldResemble, []string{"--parsable", "-p", "yesterday", "-N", "1", "--mem", "2000M",
+				"-c", "3", "--constraint", "avx foo", "-J", "random2",
+				"-o", "/dev/null", "-e", "/dev/null", "--wrap", "mycmd"})
+
+			delete(specifiedOther, "scheduler_misc")
+			specifiedOther[AvoidHostsKey] = "hostA,hostB"
+			sbatchArgs = impl.generateSbatchArgs(ctx, "yesterday", &Requirements{2000, 1 * time.Minute, 2.5, 0,
+				specifiedOther, nil, true, true, true, false}, "mycmd", 1)
+			sbatchArgs[12] = "random3"
+			So(sbatchArgs, ShouldResemble, []string{"--parsable", "-p", "yesterday", "-N", "1", "--mem", "2000M",
+				"-c", "3", "--exclude", "hostA,hostB", "-J", "random3",
+				"-o", "/dev/null", "-e", "/dev/null", "--wrap", "mycmd"})
+		})
+
+		Convey("Busy() starts off false", func() {
+			So(s.Busy(ctx), ShouldBeFalse)
+		})
+
+		Convey("Schedule() gives impossible error when given impossible reqs", func() {
+			err := s.Schedule(ctx, "foo", impossibleReq, 0, 1)
+			So(err, ShouldNotBeNil)
+			serr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(serr.Err, ShouldEqual, ErrImpossible)
+		})
+
+		Convey("Schedule() submits job arrays no larger than MaxArraySize", func() {
+			err := s.Schedule(ctx, "mycmd", possibleReq, 0, 5)
+			So(err, ShouldBeNil)
+			So(s.Busy(ctx), ShouldBeTrue)
+
+			count, err := s.Scheduled(ctx, "mycmd")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 5)
+
+			content, err := os.ReadFile(filepath.Join(stubDir, "sbatch.args"))
+			So(err, ShouldBeNil)
+			submissions := strings.Split(strings.TrimSpace(string(content)), "\n")
+			So(len(submissions), ShouldEqual, 2)
+			So(submissions[0], ShouldContainSubstring, "--array 0-2 ")
+			So(submissions[1], ShouldContainSubstring, "--array 0-1 ")
+
+			Convey("You can Schedule() again to drop the count, which only cancels pending jobs", func() {
+				content, err := os.ReadFile(jobsFile)
+				So(err, ShouldBeNil)
+				jobs := strings.Replace(string(content), "|PENDING|", "|RUNNING|", 2)
+				err = os.WriteFile(jobsFile, []byte(jobs), 0o600)
+				So(err, ShouldBeNil)
+
+				err = s.Schedule(ctx, "mycmd", possibleReq, 0, 3)
+				So(err, ShouldBeNil)
+				count, err := s.Scheduled(ctx, "mycmd")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+
+				err = s.Schedule(ctx, "mycmd", possibleReq, 0, 0)
+				So(err, ShouldBeNil)
+				count, err = s.Scheduled(ctx, "mycmd")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 2)
+				So(s.Busy(ctx), ShouldBeTrue)
+
+				Convey("Cleanup() cancels everything", func() {
+					s.Cleanup(ctx)
+					So(s.Busy(ctx), ShouldBeFalse)
+				})
+			})
+		})
+
+		Reset(func() {
+			os.Remove(jobsFile)
+			os.Remove(filepath.Join(stubDir, "sbatch.args"))
+			delete(otherReqs, "scheduler_queues_avoid")
+		})
+	})
+}
+
+func TestSGE(t *testing.T) {
+	ctx := context.Background()
+
+	// we test against stub grid engine commands that pretend to have some
+	// queues and keep track of submitted jobs in a file
+	stubDir, err := os.MkdirTemp("", "wr_schedulers_sge_test_stubs_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(stubDir)
+
+	err = createSGEStubs(stubDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	origPath := os.Getenv("PATH")
+	err = os.Setenv("PATH", stubDir+string(os.PathListSeparator)+origPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		err = os.Setenv("PATH", origPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	jobsFile := filepath.Join(stubDir, "jobs")
+
+	Convey("parseSGETasks() expands array task ranges", t, func() {
+		tasks, err := parseSGETasks("4")
+		So(err, ShouldBeNil)
+		So(tasks, ShouldResemble, []int{4})
+
+		tasks, err = parseSGETasks("1-3:1,7,10-14:2")
+		So(err, ShouldBeNil)
+		So(tasks, ShouldResemble, []int{1, 2, 3, 7, 10, 12, 14})
+
+		_, err = parseSGETasks("1-a")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("parseSGEMemory() and parseSGETime() understand grid engine values", t, func() {
+		mb, err := parseSGEMemory("8G")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 8192)
+
+		mb, err = parseSGEMemory("2000m")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 1907)
+
+		mb, err = parseSGEMemory("INFINITY")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 0)
+
+		secs, err := parseSGETime("1:30:00")
+		So(err, ShouldBeNil)
+		So(secs, ShouldEqual, 5400)
+
+		secs, err = parseSGETime("90")
+		So(err, ShouldBeNil)
+		So(secs, ShouldEqual, 90)
+
+		secs, err = parseSGETime("INFINITY")
+		So(err, ShouldBeNil)
+		So(secs, ShouldEqual, 0)
+
+		_, err = parseSGETime("1:2:3:4")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("You can get a new sge scheduler", t, func() {
+		otherReqs := make(map[string]string)
+
+		specifiedOther := make(map[string]string)
+		specifiedOther["scheduler_queue"] = "yesterday.q"
+		specifiedOther["scheduler_misc"] = "-l avx"
+		possibleReq := &Requirements{100, 1 * time.Minute, 1, 20, otherReqs, nil, true, true, true, false}
+		specifiedReq := &Requirements{100, 1 * time.Minute, 1, 20, specifiedOther, nil, true, true, true, false}
+		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs, nil, true, true, true, false}
+
+		s, err := New(ctx, "sge", &ConfigSGE{"development", "bash", "~/.ssh/id_rsa"})
+		So(err, ShouldBeNil)
+		So(s, ShouldNotBeNil)
+		impl := s.impl.(*sge)
+
+		Convey("It parses the queues and config", func() {
+			So(impl.maxArraySize, ShouldEqual, 3)
+			So(len(impl.queues), ShouldEqual, 3)
+			So(impl.queues["short.q"], ShouldResemble, map[string]int{
+				"runlimit": 3600, "memlimit": 8192, "cpus": 16, "slots": 100, "prio": 0,
+			})
+			So(impl.queues["long.q"]["runlimit"], ShouldEqual, 604800)
+			So(impl.queues["big.q"]["runlimit"], ShouldEqual, sgeInfiniteRunlimit)
+			So(impl.queues["big.q"]["memlimit"], ShouldEqual, 0)
+			So(impl.queues["big.q"]["prio"], ShouldEqual, -5)
+			So(impl.sortedqs, ShouldResemble, []string{"short.q", "long.q", "big.q"})
+		})
+
+		Convey("determineQueue() picks the best queue depending on given resource requirements", func() {
+			queue, err := impl.determineQueue(possibleReq)
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "short.q")
+
+			queue, err = impl.determineQueue(&Requirements{100, 2 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "long.q")
+
+			queue, err = impl.determineQueue(&Requirements{20000, 1 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "big.q")
+
+			queue, err = impl.determineQueue(&Requirements{20000, 1 * time.Minute, 4, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "short.q")
+
+			queue, err = impl.determineQueue(&Requirements{100, 1 * time.Hour, 48, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "big.q")
+
+			_, err = impl.determineQueue(&Requirements{100, 1 * time.Hour, 100, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("determineQueue() picks the best queue depending on given queues to avoid or select", func() {
+			otherReqs["scheduler_queues_avoid"] = "sho"
+			queue, err := impl.determineQueue(possibleReq)
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "long.q")
+
+			queue, err = impl.determineQueue(specifiedReq)
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "yesterday.q")
+		})
+
+		Convey("MaxQueueTime() returns appropriate times depending on the requirements", func() {
+			So(s.MaxQueueTime(possibleReq).Minutes(), ShouldEqual, 60)
+			So(s.MaxQueueTime(&Requirements{100, 2 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false}).Minutes(),
+				ShouldEqual, 10080)
+		})
+
+		Convey("generateQsubArgs() maps requirements and adds in user-specified options", func() {
+			So(impl.shellPath, ShouldNotBeBlank)
+			impl.shellPath = "/bin/bash"
+
+			qsubArgs := impl.generateQsubArgs(ctx, "short.q", specifiedReq, "mycmd", 2)
+			So(qsubArgs[15], ShouldStartWith, "wrd_")
+			qsubArgs[15] = "random1"
+			So(qsubArgs, ShouldResemble, []string{"-terse", "-V", "-q", "short.q", "-l", "h_vmem=100M",
+				"-S", "/bin/bash", "-l", "h_rt=3600", "-l", "avx", "-t", "1-2", "-N", "random1",
+				"-o", "/dev/null", "-e", "/dev/null"})
+
+			specifiedOther["scheduler_misc"] = `-l "avx=true"`
+			qsubArgs = impl.generateQsubArgs(ctx, "yesterday.q", &Requirements{2000, 1 * time.Minute, 2.5, 0,
+				specifiedOther, nil, true, true, true, false}, "mycmd", 1)
+			qsubArgs[14] = "random2"
+			So(qsubArgs, ShouldResemble, []string{"-terse", "-V", "-q", "yesterday.q", "-l", "h_vmem=667M",
+				"-S", "/bin/bash", "-pe", "smp", "3", "-l", "avx=true", "-N", "random2",
+				"-o", "/dev/null", "-e", "/dev/null"})
+
+			delete(specifiedOther, "scheduler_misc")
+			specifiedOther[AvoidHostsKey] = "hostA,hostB"
+			qsubArgs = impl.generateQsubArgs(ctx, "yesterday.q", &Requirements{2000, 1 * time.Minute, 1, 0,
+				specifiedOther, nil, true, true, true, false}, "mycmd", 1)
+			qsubArgs[11] = "random3"
+			So(qsubArgs, ShouldResemble, []string{"-terse", "-V", "-q", "yesterday.q", "-l", "h_vmem=2000M",
+				"-S", "/bin/bash", "-l", "h=!(hostA|hostB)", "-N", "random3",
+				"-o", "/dev/null", "-e", "/dev/null"})
+		})
+
+		Convey("Busy() starts off false", func() {
+			So(s.Busy(ctx), ShouldBeFalse)
+		})
+
+		Convey("Schedule() gives impossible error when given impossible reqs", func() {
+			err := s.Schedule(ctx, "foo", impossibleReq, 0, 1)
+			So(err, ShouldNotBeNil)
+			serr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(serr.Err, ShouldEqual, ErrImpossible)
+		})
+
+		Convey("Schedule() submits array jobs no larger than max_aj_tasks", func() {
+			err := s.Schedule(ctx, "mycmd", possibleReq, 0, 5)
+			So(err, ShouldBeNil)
+			So(s.Busy(ctx), ShouldBeTrue)
+
+			count, err := s.Scheduled(ctx, "mycmd")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 5)
+
+			content, err := os.ReadFile(filepath.Join(stubDir, "qsub.args"))
+			So(err, ShouldBeNil)
+			submissions := strings.Split(strings.TrimSpace(string(content)), "\n")
+			So(len(submissions), ShouldEqual, 2)
+			So(submissions[0], ShouldContainSubstring, "-t 1-3 ")
+			So(submissions[1], ShouldContainSubstring, "-t 1-2 ")
+
+			content, err = os.ReadFile(filepath.Join(stubDir, "qsub.stdin"))
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "mycmd\nmycmd\n")
+
+			Convey("You can Schedule() again to drop the count, which only deletes pending tasks", func() {
+				content, err := os.ReadFile(jobsFile)
+				So(err, ShouldBeNil)
+				jobs := strings.Replace(string(content), "|qw|", "|r|", 2)
+				err = os.WriteFile(jobsFile, []byte(jobs), 0o600)
+				So(err, ShouldBeNil)
+
+				err = s.Schedule(ctx, "mycmd", possibleReq, 0, 3)
+				So(err, ShouldBeNil)
+				count, err := s.Scheduled(ctx, "mycmd")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+
+				err = s.Schedule(ctx, "mycmd", possibleReq, 0, 0)
+				So(err, ShouldBeNil)
+				count, err = s.Scheduled(ctx, "mycmd")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 2)
+				So(s.Busy(ctx), ShouldBeTrue)
+
+				Convey("Tasks in an error state are not counted", func() {
+					content, err := os.ReadFile(jobsFile)
+					So(err, ShouldBeNil)
+					jobs := strings.Replace(string(content), "|r|", "|Eqw|", 1)
+					err = os.WriteFile(jobsFile, []byte(jobs), 0o600)
+					So(err, ShouldBeNil)
+
+					count, err = s.Scheduled(ctx, "mycmd")
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 1)
+				})
+
+				Convey("Cleanup() deletes everything", func() {
+					s.Cleanup(ctx)
+					So(s.Busy(ctx), ShouldBeFalse)
+				})
+			})
+		})
+
+		Reset(func() {
+			os.Remove(jobsFile)
+			os.Remove(filepath.Join(stubDir, "qsub.args"))
+			os.Remove(filepath.Join(stubDir, "qsub.stdin"))
+			delete(otherReqs, "scheduler_queues_avoid")
+		})
+	})
+}
+
+func TestPBS(t *testing.T) {
+	ctx := context.Background()
+
+	// we test against stub PBS commands that pretend to have some queues and
+	// keep track of submitted jobs in a file
+	stubDir, err := os.MkdirTemp("", "wr_schedulers_pbs_test_stubs_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(stubDir)
+
+	err = createPBSStubs(stubDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	origPath := os.Getenv("PATH")
+	err = os.Setenv("PATH", stubDir+string(os.PathListSeparator)+origPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		err = os.Setenv("PATH", origPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	jobsFile := filepath.Join(stubDir, "jobs")
+
+	Convey("parsePBSMemory() understands PBS sizes", t, func() {
+		mb, err := parsePBSMemory("64gb")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 65536)
+
+		mb, err = parsePBSMemory("2048MB")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 2048)
+
+		mb, err = parsePBSMemory("1048576kb")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 1024)
+
+		mb, err = parsePBSMemory("2097152b")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 2)
+
+		_, err = parsePBSMemory("lots")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("You can get a new pbs scheduler", t, func() {
+		otherReqs := make(map[string]string)
+
+		specifiedOther := make(map[string]string)
+		specifiedOther["scheduler_queue"] = "yesterday"
+		specifiedOther["scheduler_misc"] = "-l place=excl"
+		possibleReq := &Requirements{100, 1 * time.Minute, 1, 20, otherReqs, nil, true, true, true, false}
+		specifiedReq := &Requirements{100, 1 * time.Minute, 1, 20, specifiedOther, nil, true, true, true, false}
+		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs, nil, true, true, true, false}
+
+		s, err := New(ctx, "pbs", &ConfigPBS{"development", "bash", "~/.ssh/id_rsa"})
+		So(err, ShouldBeNil)
+		So(s, ShouldNotBeNil)
+		impl := s.impl.(*pbs)
+
+		Convey("It parses the queues and config", func() {
+			So(impl.torque, ShouldBeFalse)
+			So(impl.maxArraySize, ShouldEqual, 3)
+			So(len(impl.queues), ShouldEqual, 3)
+			So(impl.queues["short"], ShouldResemble, map[string]int{
+				"runlimit": 3600, "memlimit": 65536, "cpus": 16, "prio": 100,
+			})
+			So(impl.queues["long"]["runlimit"], ShouldEqual, 604800)
+			So(impl.queues["hugemem"]["runlimit"], ShouldEqual, pbsInfiniteRunlimit)
+			So(impl.queues["hugemem"]["memlimit"], ShouldEqual, 2097152)
+			So(impl.sortedqs, ShouldResemble, []string{"short", "long", "hugemem"})
+		})
+
+		Convey("determineQueue() picks the best queue depending on given resource requirements", func() {
+			queue, err := impl.determineQueue(possibleReq)
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "short")
+
+			queue, err = impl.determineQueue(&Requirements{100, 2 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "long")
+
+			queue, err = impl.determineQueue(&Requirements{300000, 1 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "hugemem")
+
+			queue, err = impl.determineQueue(&Requirements{100, 8 * 24 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "hugemem")
+
+			queue, err = impl.determineQueue(&Requirements{100, 1 * time.Hour, 48, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "hugemem")
+
+			_, err = impl.determineQueue(&Requirements{100, 1 * time.Hour, 100, 20, otherReqs, nil, true, true, true, false})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("determineQueue() picks the best queue depending on given queues to avoid or select", func() {
+			otherReqs["scheduler_queues_avoid"] = "sho"
+			queue, err := impl.determineQueue(possibleReq)
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "long")
+
+			queue, err = impl.determineQueue(specifiedReq)
+			So(err, ShouldBeNil)
+			So(queue, ShouldEqual, "yesterday")
+		})
+
+		Convey("MaxQueueTime() returns appropriate times depending on the requirements", func() {
+			So(s.MaxQueueTime(possibleReq).Minutes(), ShouldEqual, 60)
+			So(s.MaxQueueTime(&Requirements{100, 2 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false}).Minutes(),
+				ShouldEqual, 10080)
+		})
+
+		Convey("generateQsubArgs() maps requirements and adds in user-specified options", func() {
+			So(impl.shellPath, ShouldNotBeBlank)
+			impl.shellPath = "/bin/bash"
+
+			qsubArgs := impl.generateQsubArgs(ctx, "short", specifiedReq, "mycmd", 2)
+			So(qsubArgs[14], ShouldStartWith, "wrd_")
+			qsubArgs[14] = "random1"
+			So(qsubArgs, ShouldResemble, []string{"-V", "-q", "short", "-S", "/bin/bash",
+				"-l", "select=1:ncpus=1:mem=100mb", "-l", "walltime=01:00:00", "-l", "place=excl",
+				"-J", "0-1", "-N", "random1", "-o", "/dev/null", "-e", "/dev/null"})
+
+			delete(specifiedOther, "scheduler_misc")
+			qsubArgs = impl.generateQsubArgs(ctx, "yesterday", &Requirements{2000, 1 * time.Minute, 2.5, 0,
+				specifiedOther, nil, true, true, true, false}, "mycmd", 1)
+			qsubArgs[8] = "random2"
+			So(qsubArgs, ShouldResemble, []string{"-V", "-q", "yesterday", "-S", "/bin/bash",
+				"-l", "select=1:ncpus=3:mem=2000mb", "-N", "random2", "-o", "/dev/null", "-e", "/dev/null"})
+
+			impl.torque = true
+			qsubArgs = impl.generateQsubArgs(ctx, "long", &Requirements{2000, 1 * time.Minute, 2.5, 0,
+				specifiedOther, nil, true, true, true, false}, "mycmd", 3)
+			qsubArgs[14] = "random3"
+			So(qsubArgs, ShouldResemble, []string{"-V", "-q", "long", "-S", "/bin/bash",
+				"-l", "nodes=1:ppn=3", "-l", "mem=2000mb", "-l", "walltime=168:00:00",
+				"-t", "0-2", "-N", "random3", "-o", "/dev/null", "-e", "/dev/null"})
+		})
+
+		Convey("Busy() starts off false", func() {
+			So(s.Busy(ctx), ShouldBeFalse)
+		})
+
+		Convey("Schedule() gives impossible error when given impossible reqs", func() {
+			err := s.Schedule(ctx, "foo", impossibleReq, 0, 1)
+			So(err, ShouldNotBeNil)
+			serr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(serr.Err, ShouldEqual, ErrImpossible)
+		})
+
+		Convey("Schedule() submits array jobs no larger than max_array_size", func() {
+			err := s.Schedule(ctx, "mycmd", possibleReq, 0, 5)
+			So(err, ShouldBeNil)
+			So(s.Busy(ctx), ShouldBeTrue)
+
+			count, err := s.Scheduled(ctx, "mycmd")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 5)
+
+			content, err := os.ReadFile(filepath.Join(stubDir, "qsub.args"))
+			So(err, ShouldBeNil)
+			submissions := strings.Split(strings.TrimSpace(string(content)), "\n")
+			So(len(submissions), ShouldEqual, 2)
+			So(submissions[0], ShouldContainSubstring, "-J 0-2 ")
+			So(submissions[1], ShouldContainSubstring, "-J 0-1 ")
+
+			Convey("Other users' jobs are not counted", func() {
+				content, err := os.ReadFile(jobsFile)
+				So(err, ShouldBeNil)
+				line := strings.SplitN(string(content), "\n", 2)[0]
+				fields := strings.Split(line, "|")
+				foreign := "99.pbs1|Q|" + fields[2] + "|someoneelse@host\n"
+				err = os.WriteFile(jobsFile, append(content, []byte(foreign)...), 0o600)
+				So(err, ShouldBeNil)
+
+				count, err := s.Scheduled(ctx, "mycmd")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 5)
+			})
+
+			Convey("You can Schedule() again to drop the count, which only deletes queued jobs", func() {
+				content, err := os.ReadFile(jobsFile)
+				So(err, ShouldBeNil)
+				jobs := strings.Replace(string(content), "|Q|", "|R|", 2)
+				err = os.WriteFile(jobsFile, []byte(jobs), 0o600)
+				So(err, ShouldBeNil)
+
+				err = s.Schedule(ctx, "mycmd", possibleReq, 0, 3)
+				So(err, ShouldBeNil)
+				count, err := s.Scheduled(ctx, "mycmd")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+
+				err = s.Schedule(ctx, "mycmd", possibleReq, 0, 0)
+				So(err, ShouldBeNil)
+				count, err = s.Scheduled(ctx, "mycmd")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 2)
+				So(s.Busy(ctx), ShouldBeTrue)
+
+				Convey("Cleanup() deletes everything", func() {
+					s.Cleanup(ctx)
+					So(s.Busy(ctx), ShouldBeFalse)
+				})
+			})
+		})
+
+		Reset(func() {
+			os.Remove(jobsFile)
+			os.Remove(filepath.Join(stubDir, "qsub.args"))
+			delete(otherReqs, "scheduler_queues_avoid")
+		})
+	})
+}
+
+func TestSSHPool(t *testing.T) {
+	ctx := context.Background()
+
+	Convey("ParseSSHPoolHosts() understands host specs", t, func() {
+		hosts, err := ParseSSHPoolHosts("node1:cores=16,ram=64000; bob@node2.example.com:cores=8,ram=32000,disk=500,gpu=2")
+		So(err, ShouldBeNil)
+		So(len(hosts), ShouldEqual, 2)
+		So(hosts[0].Name, ShouldEqual, "node1")
+		So(hosts[0].UserName, ShouldBeBlank)
+		So(hosts[0].Cores, ShouldEqual, 16)
+		So(hosts[0].RAM, ShouldEqual, 64000)
+		So(hosts[0].Disk, ShouldEqual, 0)
+		So(hosts[0].Resources, ShouldBeNil)
+		So(hosts[1].Name, ShouldEqual, "node2.example.com")
+		So(hosts[1].UserName, ShouldEqual, "bob")
+		So(hosts[1].Cores, ShouldEqual, 8)
+		So(hosts[1].RAM, ShouldEqual, 32000)
+		So(hosts[1].Disk, ShouldEqual, 500)
+		So(hosts[1].Resources, ShouldResemble, map[string]int{"gpu": 2})
+
+		for _, bad := range []string{"", "node1", "node1:cores=16", "node1:ram=100", "node1:cores=x,ram=100",
+			"node1:cores=1,ram=100,gpu=x", "node1:cores=1,ram=100;node1:cores=2,ram=200"} {
+			_, err = ParseSSHPoolHosts(bad)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	keyFile, err := os.CreateTemp("", "wr_schedulers_sshpool_test_key_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.Close()
+
+	config := &ConfigSSHPool{
+		Hosts:          "node1.example.com:cores=4,ram=8000,disk=100;node2:cores=2,ram=4000,gpu=1;node3:cores=1,ram=16000",
+		UserName:       "wr",
+		PrivateKeyPath: keyFile.Name(),
+		Shell:          "bash",
+	}
+
+	Convey("You can't get a new sshpool scheduler without valid hosts and key", t, func() {
+		_, err := New(ctx, "sshpool", &ConfigSSHPool{Hosts: "", PrivateKeyPath: keyFile.Name()})
+		So(err, ShouldNotBeNil)
+
+		_, err = New(ctx, "sshpool", &ConfigSSHPool{Hosts: config.Hosts, PrivateKeyPath: keyFile.Name() + ".missing"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("You can get a new sshpool scheduler", t, func() {
+		s, err := New(ctx, "sshpool", config)
+		So(err, ShouldBeNil)
+		So(s, ShouldNotBeNil)
+		defer s.Cleanup(ctx)
+
+		ss := s.impl.(*sshpool)
+		So(len(ss.hosts), ShouldEqual, 3)
+		So(ss.hosts["node1.example.com"].UserName, ShouldEqual, "wr")
+		So(ss.hosts["node2"].Disk, ShouldEqual, sshPoolUncheckedDisk)
+
+		Convey("It knows the biggest host resources", func() {
+			So(ss.maxCPU(), ShouldEqual, 4)
+			So(ss.maxMem(), ShouldEqual, 16000)
+		})
+
+		Convey("reqCheck() only allows requirements some host can meet", func() {
+			So(ss.reqCheck(ctx, &Requirements{RAM: 16000, Time: 1 * time.Minute, Cores: 1}), ShouldBeNil)
+			So(ss.reqCheck(ctx, &Requirements{RAM: 1000, Time: 1 * time.Minute, Cores: 2, Resources: map[string]int{"gpu": 1}}), ShouldBeNil)
+			So(ss.reqCheck(ctx, &Requirements{RAM: 16000, Time: 1 * time.Minute, Cores: 2}), ShouldNotBeNil)
+			So(ss.reqCheck(ctx, &Requirements{RAM: 1000, Time: 1 * time.Minute, Cores: 4, Resources: map[string]int{"gpu": 1}}), ShouldNotBeNil)
+			So(ss.reqCheck(ctx, &Requirements{RAM: 1000, Time: 1 * time.Minute, Cores: 1, Disk: 200}), ShouldBeNil)
+			So(ss.reqCheck(ctx, &Requirements{RAM: 1000, Time: 1 * time.Minute, Cores: 4, Disk: 200}), ShouldNotBeNil)
+		})
+
+		req := &Requirements{RAM: 1000, Time: 1 * time.Minute, Cores: 1}
+
+		Convey("canCount() sums the space on all usable hosts", func() {
+			So(ss.canCount(ctx, "cmd", req, ""), ShouldEqual, 7)
+
+			avoidReq := &Requirements{RAM: 1000, Time: 1 * time.Minute, Cores: 1, Other: map[string]string{"avoid_hosts": "node1,node3"}}
+			So(ss.canCount(ctx, "cmd", avoidReq, ""), ShouldEqual, 2)
+
+			ss.hosts["node2"].GoneBad()
+			So(ss.canCount(ctx, "cmd", req, ""), ShouldEqual, 5)
+			So(ss.canCount(ctx, "cmd", avoidReq, ""), ShouldEqual, 0)
+		})
+
+		Convey("pickHost() bin-packs on to the fullest host with space", func() {
+			server := ss.pickHost(ctx, req)
+			So(server, ShouldNotBeNil)
+			So(server.Name, ShouldEqual, "node3")
+
+			server = ss.pickHost(ctx, req)
+			So(server.Name, ShouldEqual, "node2")
+			server = ss.pickHost(ctx, req)
+			So(server.Name, ShouldEqual, "node2")
+
+			for i := 0; i < 4; i++ {
+				server = ss.pickHost(ctx, req)
+				So(server.Name, ShouldEqual, "node1.example.com")
+			}
+
+			So(ss.pickHost(ctx, req), ShouldBeNil)
+			So(ss.canCount(ctx, "cmd", req, ""), ShouldEqual, 0)
+
+			ss.hosts["node2"].Release(ctx, req.Cores, req.RAM, req.Disk, req.Resources)
+			So(ss.canCount(ctx, "cmd", req, ""), ShouldEqual, 1)
+			server = ss.pickHost(ctx, req)
+			So(server.Name, ShouldEqual, "node2")
+		})
+
+		Convey("getHost() and hostToID() find hosts by full or short name", func() {
+			So(s.HostToID("node2"), ShouldEqual, "node2")
+			So(s.HostToID("node2.example.com"), ShouldEqual, "node2")
+			So(s.HostToID("node1"), ShouldEqual, "node1.example.com")
+			So(s.HostToID("node4"), ShouldBeBlank)
+
+			host, ok := ss.getHost("node1")
+			So(ok, ShouldBeTrue)
+			So(host, ShouldEqual, ss.hosts["node1.example.com"])
+
+			_, ok = ss.getHost("node4")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Destroyed hosts are replaced by bad ones during state updates", func() {
+			err := ss.hosts["node3"].Destroy(ctx)
+			So(err, ShouldBeNil)
+			So(ss.canCount(ctx, "cmd", req, ""), ShouldEqual, 6)
+
+			ss.stateUpdate(ctx)
+			So(ss.hosts["node3"].Destroyed(), ShouldBeFalse)
+			So(ss.hosts["node3"].IsBad(), ShouldBeTrue)
+			So(ss.hosts["node3"].Flavor.RAM, ShouldEqual, 16000)
+		})
+	})
+
+	// for the remaining tests we need to be able to ssh to localhost without a
+	// password using the key in WR_SSHPOOL_TEST_KEY
+	key := os.Getenv("WR_SSHPOOL_TEST_KEY")
+	if key == "" {
+		SkipConvey("Without WR_SSHPOOL_TEST_KEY set, we'll skip the remaining sshpool tests", t, func() {})
+		return
+	}
+
+	Convey("You can run cmds on an ssh pool", t, func() {
+		tmpdir, err := os.MkdirTemp("", "wr_schedulers_sshpool_test_output_dir_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+
+		s, err := New(ctx, "sshpool", &ConfigSSHPool{
+			Hosts:                "localhost:cores=2,ram=1000;unreachable.invalid:cores=8,ram=8000",
+			PrivateKeyPath:       key,
+			Shell:                "bash",
+			StateUpdateFrequency: 1 * time.Second,
+		})
+		So(err, ShouldBeNil)
+		defer s.Cleanup(ctx)
+
+		badServers := make(chan string, 10)
+		s.SetBadServerCallBack(ctx, func(server *cloud.Server) {
+			if server.IsBad() {
+				badServers <- server.Name
+			}
+		})
+
+		cmd := "sleep 1 && mktemp -p " + tmpdir + " ssh.XXXXXX"
+		err = s.Schedule(ctx, cmd, &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}, 0, 4)
+		So(err, ShouldBeNil)
+
+		So(<-badServers, ShouldEqual, "unreachable.invalid")
+
+		So(waitToFinish(ctx, s, 30, 100), ShouldBeTrue)
+		files, err := os.ReadDir(tmpdir)
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 4)
+
+		host, ok := s.impl.getHost("localhost")
+		So(ok, ShouldBeTrue)
+		So(host.(*cloud.Server).IsBad(), ShouldBeFalse)
+	})
+}
+
+func TestFakeCloud(t *testing.T) {
+	ctx := context.Background()
+
+	tmpdir, err := os.MkdirTemp("", "wr_schedulers_fake_test_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	localUser, err := internal.Username()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// our fake servers are this machine, reached over ssh to a server we run
+	// ourselves, which lets in the keys the fake cloud authorizes
+	authorizedKeys := filepath.Join(tmpdir, "authorized_keys")
+	sshPort, stopSSH := startTestSSHServer(t, filepath.Join(tmpdir, "shims"), authorizedKeys)
+	defer stopSSH()
+
+	for key, val := range map[string]string{
+		"WR_FAKE_CLOUD_DIR":             filepath.Join(tmpdir, "cloud"),
+		"WR_FAKE_CLOUD_SSH_PORT":        strconv.Itoa(sshPort),
+		"WR_FAKE_CLOUD_AUTHORIZED_KEYS": authorizedKeys,
+		"WR_FAKE_CLOUD_QUOTA":           "instances=2",
+		"WR_FAKE_CLOUD_FAILURES":        "",
+	} {
+		orig, set := os.LookupEnv(key)
+		os.Setenv(key, val)
+		if set {
+			defer os.Setenv(key, orig)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	noLocal := 0
+	config := &ConfigCloud{
+		ResourceName:         "wr-testing-fake",
+		SavePath:             filepath.Join(tmpdir, "fake_resources"),
+		OSPrefix:             "fake",
+		OSUser:               localUser,
+		OSRAM:                1000,
+		ServerPorts:          []int{22},
+		ServerKeepTime:       1 * time.Second,
+		StateUpdateFrequency: 1 * time.Second,
+		Shell:                "bash",
+		MaxInstances:         -1,
+		SimultaneousSpawns:   1,
+		MaxLocalCores:        &noLocal,
+		MaxLocalRAM:          &noLocal,
+	}
+
+	Convey("The cloud scheduler uses the provider in its config", t, func() {
+		cloudConfig := *config
+		cloudConfig.Provider = "fake"
+		s, err := New(ctx, "cloud", &cloudConfig)
+		So(err, ShouldBeNil)
+		So(s, ShouldNotBeNil)
+		defer s.Cleanup(ctx)
+		oss := s.impl.(*cloudScheduler) //nolint:forcetypeassert
+		So(oss.providerName, ShouldEqual, "fake")
+	})
+
+	Convey("You can get a new fake cloud scheduler", t, func() {
+		s, err := New(ctx, "fake", config)
+		So(err, ShouldBeNil)
+		So(s, ShouldNotBeNil)
+		defer s.Cleanup(ctx)
+		oss := s.impl.(*cloudScheduler) //nolint:forcetypeassert
+		So(oss.providerName, ShouldEqual, "fake")
+
+		Convey("determineFlavor() picks the best fake flavor", func() {
+			flavor, err := oss.determineFlavor(ctx, &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}, "a")
+			So(err, ShouldBeNil)
+			So(flavor.ID, ShouldEqual, "fake1")
+
+			flavor, err = oss.determineFlavor(ctx, &Requirements{RAM: 5000, Time: 1 * time.Minute, Cores: 3}, "b")
+			So(err, ShouldBeNil)
+			So(flavor.ID, ShouldEqual, "fake4")
+		})
+
+		Convey("Impossible requirements are rejected", func() {
+			err := s.Schedule(ctx, "echo impossible", &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 99}, 0, 1)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, cloud.ErrNoFlavor)
+		})
+	})
+
+	Convey("Failures to spawn fake servers are reported", t, func() {
+		os.Setenv("WR_FAKE_CLOUD_FAILURES", "spawn=1000")
+		defer os.Setenv("WR_FAKE_CLOUD_FAILURES", "")
+
+		s, err := New(ctx, "fake", config)
+		So(err, ShouldBeNil)
+
+		msgs := make(chan string, 100)
+		s.SetMessageCallBack(ctx, func(msg string) {
+			msgs <- msg
+		})
+
+		err = s.Schedule(ctx, "echo fail", &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}, 0, 1)
+		So(err, ShouldBeNil)
+
+		select {
+		case msg := <-msgs:
+			So(msg, ShouldEqual, "Fake cloud: Failed to create a usable server: fake server creation failed")
+		case <-time.After(10 * time.Second):
+			So(false, ShouldBeTrue)
+		}
+		So(s.Busy(ctx), ShouldBeTrue)
+
+		s.Cleanup(ctx)
+	})
+
+	Convey("You can run cmds on fake cloud servers", t, func() {
+		s, err := New(ctx, "fake", config)
+		So(err, ShouldBeNil)
+		defer s.Cleanup(ctx)
+		oss := s.impl.(*cloudScheduler) //nolint:forcetypeassert
+
+		outdir := filepath.Join(tmpdir, "out")
+		So(os.MkdirAll(outdir, 0o700), ShouldBeNil)
+
+		cmd := "sleep 1 && mktemp -p " + outdir + " fake.XXXXXX"
+		err = s.Schedule(ctx, cmd, &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}, 0, 3)
+		So(err, ShouldBeNil)
+
+		So(waitToFinish(ctx, s, 120, 100), ShouldBeTrue)
+		files, err := os.ReadDir(outdir)
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 3)
+
+		// after the keep time, our servers get destroyed
+		destroyed := false
+		for i := 0; i < 100; i++ {
+			q, errq := oss.provider.GetQuota(ctx)
+			So(errq, ShouldBeNil)
+			if q.UsedInstances == 0 {
+				destroyed = true
+
+				break
+			}
+			<-time.After(100 * time.Millisecond)
+		}
+		So(destroyed, ShouldBeTrue)
+	})
+
+	Convey("Fake cloud quota limits how many servers are spawned", t, func() {
+		os.Setenv("WR_FAKE_CLOUD_QUOTA", "instances=1")
+		defer os.Setenv("WR_FAKE_CLOUD_QUOTA", "instances=2")
+
+		s, err := New(ctx, "fake", config)
+		So(err, ShouldBeNil)
+		defer s.Cleanup(ctx)
+		oss := s.impl.(*cloudScheduler) //nolint:forcetypeassert
+
+		msgs := make(chan string, 1000)
+		s.SetMessageCallBack(ctx, func(msg string) {
+			msgs <- msg
 		})
 
-		Convey("Busy() starts off false", func() {
-			So(s.Busy(ctx), ShouldBeFalse)
-		})
+		outdir := filepath.Join(tmpdir, "out_quota")
+		So(os.MkdirAll(outdir, 0o700), ShouldBeNil)
 
-		Convey("Schedule() gives impossible error when given impossible reqs", func() {
-			err := s.Schedule(ctx, "foo", impossibleReq, 0, 1)
-			So(err, ShouldNotBeNil)
-			serr, ok := err.(Error)
-			So(ok, ShouldBeTrue)
-			So(serr.Err, ShouldEqual, ErrImpossible)
-		})
+		cmd := "sleep 2 && mktemp -p " + outdir + " fake.XXXXXX"
+		err = s.Schedule(ctx, cmd, &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}, 0, 2)
+		So(err, ShouldBeNil)
 
-		// following tests are unreliable due to needing LSF nodes to be all
-		// working well and for there to be capacity to run jobs
-		if os.Getenv("WR_DISABLE_UNRELIABLE_LSF_TESTS") == "true" {
-			SkipConvey("Further LSF tests disabled since WR_DISABLE_UNRELIABLE_LSF_TESTS is set", func() {})
+		maxUsed := 0
+		finished := false
+		for i := 0; i < 1200; i++ {
+			q, errq := oss.provider.GetQuota(ctx)
+			So(errq, ShouldBeNil)
+			if q.UsedInstances > maxUsed {
+				maxUsed = q.UsedInstances
+			}
+			if !s.Busy(ctx) {
+				finished = true
 
-			return
+				break
+			}
+			<-time.After(100 * time.Millisecond)
 		}
+		So(finished, ShouldBeTrue)
+		So(maxUsed, ShouldEqual, 1)
 
-		Convey("Given a cmd running on a host", func() {
-			testProcessNotRunning(ctx, s, possibleReq)
-		})
+		files, err := os.ReadDir(outdir)
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 2)
 
-		Convey("Schedule() lets you schedule more jobs than localhost CPUs", func() {
-			// tmpdir, err := os.MkdirTemp("", "wr_schedulers_lsf_test_output_dir_")
-			// if err != nil {
-			// 	log.Fatal(err)
-			// }
-			// defer os.RemoveAll(tmpdir)
+		So(receivedMessage(msgs, "Fake cloud: Not enough instance quota to create another server"), ShouldBeTrue)
+	})
 
-			// cmd := fmt.Sprintf("ssh %s 'perl -MFile::Temp=tempfile -e '\"'\"'$sleep = rand(60); select(undef, undef, undef, $sleep); @a = tempfile(DIR => q[%s]); select(undef, undef, undef, 5 - $sleep); exit(0);'\"'\"", host, tmpdir) // sleep for a random amount of time so that ssh does not fail due to too many run at once, then ssh back to us and create a file in our tmp dir
+	Convey("Fake cloud servers are reused within their keep time", t, func() {
+		keepConfig := *config
+		keepConfig.ServerKeepTime = 1 * time.Minute
 
-			// the above wouldn't work due to some issue with all the ssh's not
-			// working and some high proportion of the LSF jobs immediately
-			// failing; instead we assume, since this is LSF, that our current
-			// directory is on a shared disk, and just have all the jobs write
-			// their files here directly
-			tmpdir, err := os.MkdirTemp("./", "wr_schedulers_lsf_test_output_dir_")
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer os.RemoveAll(tmpdir)
+		s, err := New(ctx, "fake", &keepConfig)
+		So(err, ShouldBeNil)
+		defer s.Cleanup(ctx)
+		oss := s.impl.(*cloudScheduler) //nolint:forcetypeassert
 
-			cmd := fmt.Sprintf("perl -MFile::Temp=tempfile -e '@a = tempfile(DIR => q[%s]); sleep(5); exit(0);'", tmpdir)
+		outdir := filepath.Join(tmpdir, "out_reuse")
+		So(os.MkdirAll(outdir, 0o700), ShouldBeNil)
 
-			count := maxCPU * 2
-			err = s.Schedule(ctx, cmd, possibleReq, 0, count)
-			So(err, ShouldBeNil)
-			So(s.Busy(ctx), ShouldBeTrue)
+		req := &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}
+		cmd := "mktemp -p " + outdir + " fake.XXXXXX"
+		err = s.Schedule(ctx, cmd, req, 0, 1)
+		So(err, ShouldBeNil)
+		So(waitToFinish(ctx, s, 120, 100), ShouldBeTrue)
 
-			Convey("It eventually runs them all", func() {
-				So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
-				numfiles := testDirForFiles(tmpdir, count)
-				So(numfiles, ShouldEqual, count)
-			})
+		ids := fakeCloudServerIDs(oss)
+		So(len(ids), ShouldEqual, 1)
 
-			// *** no idea how to reliably test dropping the count, since I
-			// don't have any way of ensuring some jobs are still pending by the
-			// time I try and drop the count... unless I did something like
-			// have a count of 1000000?...
+		cmd = "mktemp -p " + outdir + " fake2.XXXXXX"
+		err = s.Schedule(ctx, cmd, req, 0, 1)
+		So(err, ShouldBeNil)
+		So(waitToFinish(ctx, s, 120, 100), ShouldBeTrue)
 
-			Convey("You can Schedule() again to increase the count", func() {
-				newcount := count + 5
-				err = s.Schedule(ctx, cmd, possibleReq, 0, newcount)
-				So(err, ShouldBeNil)
-				So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
-				numfiles := testDirForFiles(tmpdir, newcount)
-				So(numfiles, ShouldEqual, newcount)
-			})
+		files, err := os.ReadDir(outdir)
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 2)
+		So(fakeCloudServerIDs(oss), ShouldResemble, ids)
 
-			Convey("You can Schedule() a new job and have it run while the first is still running", func() {
-				<-time.After(6 * time.Second) // *** if the following test fails, it probably just because LSF didn't get any previous jobs running yet; not sure what to do about that
-				numfiles := testDirForFiles(tmpdir, 1)
-				So(numfiles, ShouldBeBetweenOrEqual, 1, count)
-				So(s.Busy(ctx), ShouldBeTrue)
+		q, err := oss.provider.GetQuota(ctx)
+		So(err, ShouldBeNil)
+		So(q.UsedInstances, ShouldEqual, 1)
+	})
 
-				newcmd := fmt.Sprintf("perl -MFile::Temp=tempfile -e '@a = tempfile(DIR => q[%s]); sleep(1); exit(0);'", tmpdir)
-				err = s.Schedule(ctx, newcmd, possibleReq, 0, 1)
-				So(err, ShouldBeNil)
+	Convey("Fake cloud servers that die are reported as bad", t, func() {
+		os.Setenv("WR_FAKE_CLOUD_FAILURES", "dead=1")
+		defer os.Setenv("WR_FAKE_CLOUD_FAILURES", "")
 
-				So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
-				numfiles = testDirForFiles(tmpdir, count+1)
-				So(numfiles, ShouldEqual, count+1)
-			})
+		s, err := New(ctx, "fake", config)
+		So(err, ShouldBeNil)
+		defer s.Cleanup(ctx)
+
+		badServers := make(chan *cloud.Server, 10)
+		s.SetBadServerCallBack(ctx, func(server *cloud.Server) {
+			badServers <- server
 		})
 
-		Convey("Schedule() lets you schedule more jobs than could reasonably start all at once", func() {
-			tmpdir, err := os.MkdirTemp("./", "wr_schedulers_lsf_test_output_dir_")
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer os.RemoveAll(tmpdir)
+		err = s.Schedule(ctx, "sleep 5", &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}, 0, 1)
+		So(err, ShouldBeNil)
 
-			cmd := fmt.Sprintf("perl -MFile::Temp=tempfile -e '@a = tempfile(DIR => q[%s]); sleep(2); exit(0);'", tmpdir)
+		select {
+		case server := <-badServers:
+			So(server.IsBad(), ShouldBeTrue)
+			So(server.Name, ShouldStartWith, "wr-testing-fake")
+		case <-time.After(60 * time.Second):
+			So(false, ShouldBeTrue)
+		}
+	})
 
-			count := 10000 // 1,000,000 just errors out, and 100,000 could be bad for LSF in some way
-			err = s.Schedule(ctx, cmd, possibleReq, 0, count)
-			So(err, ShouldBeNil)
-			So(s.Busy(ctx), ShouldBeTrue)
+	Convey("Fake cloud servers that fail to spawn or build are retried", t, func() {
+		os.Setenv("WR_FAKE_CLOUD_FAILURES", "nohardware=1,build=1")
+		defer os.Setenv("WR_FAKE_CLOUD_FAILURES", "")
 
-			Convey("It runs some of them and you can Schedule() again to drop the count", func() {
-				So(waitToFinish(ctx, s, 6, 1000), ShouldBeFalse)
-				numfiles := testDirForFiles(tmpdir, 1)
-				So(numfiles, ShouldBeBetween, 1, count-(maxCPU*2)-2)
+		setsConfig := *config
+		setsConfig.FlavorSets = "fake1;fake2"
 
-				newcount := numfiles + maxCPU
-				err = s.Schedule(ctx, cmd, possibleReq, 0, newcount)
-				So(err, ShouldBeNil)
+		s, err := New(ctx, "fake", &setsConfig)
+		So(err, ShouldBeNil)
+		defer s.Cleanup(ctx)
+		oss := s.impl.(*cloudScheduler) //nolint:forcetypeassert
 
-				So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
-				numfiles = testDirForFiles(tmpdir, newcount)
-				So(numfiles, ShouldBeBetweenOrEqual, newcount, numfiles*2) // we must allow it to run a few extra due to the implementation
-			})
+		msgs := make(chan string, 1000)
+		s.SetMessageCallBack(ctx, func(msg string) {
+			msgs <- msg
 		})
 
-		// wait a while for any remaining jobs to finish
-		So(waitToFinish(ctx, s, 300, 1000), ShouldBeTrue)
+		outdir := filepath.Join(tmpdir, "out_retry")
+		So(os.MkdirAll(outdir, 0o700), ShouldBeNil)
+
+		err = s.Schedule(ctx, "mktemp -p "+outdir+" fake.XXXXXX", &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}, 0, 1)
+		So(err, ShouldBeNil)
+		So(waitToFinish(ctx, s, 120, 100), ShouldBeTrue)
+
+		files, err := os.ReadDir(outdir)
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 1)
+
+		// the flavor with no hardware is avoided for a while, in favour of
+		// one from another set
+		_, failed := oss.ffCache.Get("fake1")
+		So(failed, ShouldBeTrue)
+
+		So(receivedMessage(msgs, "Fake cloud: Failed to create a usable server: not enough hardware available to create a server of that flavor"), ShouldBeTrue)
+		So(receivedMessage(msgs, "Fake cloud: Failed to create a usable server: fake server failed to build"), ShouldBeTrue)
+	})
+
+	Convey("Fake cloud servers that fail to be destroyed are cleaned up later", t, func() {
+		os.Setenv("WR_FAKE_CLOUD_FAILURES", "destroy=1")
+		defer os.Setenv("WR_FAKE_CLOUD_FAILURES", "")
+
+		s, err := New(ctx, "fake", config)
+		So(err, ShouldBeNil)
+		oss := s.impl.(*cloudScheduler) //nolint:forcetypeassert
+
+		err = s.Schedule(ctx, "true", &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}, 0, 1)
+		So(err, ShouldBeNil)
+		So(waitToFinish(ctx, s, 120, 100), ShouldBeTrue)
+
+		// the keep time passes, but our attempt to destroy the server fails
+		for i := 0; i < 100; i++ {
+			if len(fakeCloudServerIDs(oss)) == 0 {
+				break
+			}
+			<-time.After(100 * time.Millisecond)
+		}
+		So(len(fakeCloudServerIDs(oss)), ShouldEqual, 0)
+
+		q, err := oss.provider.GetQuota(ctx)
+		So(err, ShouldBeNil)
+		So(q.UsedInstances, ShouldEqual, 1)
+
+		s.Cleanup(ctx)
+
+		p, err := cloud.New(ctx, "fake", "wr-testing-fake", filepath.Join(tmpdir, "fake_check_resources"))
+		So(err, ShouldBeNil)
+		q, err = p.GetQuota(ctx)
+		So(err, ShouldBeNil)
+		So(q.UsedInstances, ShouldEqual, 0)
 	})
 }
 
@@ -742,7 +2017,7 @@ func TestOpenstack(t *testing.T) {
 	flavorRegex := os.Getenv("OS_FLAVOR_REGEX")
 	rName := "wr-testing-" + localUser
 	keepTime := 5 * time.Second
-	config := &ConfigOpenStack{
+	config := &ConfigCloud{
 		ResourceName:              rName,
 		OSPrefix:                  osPrefix,
 		OSUser:                    osUser,
@@ -795,10 +2070,10 @@ func TestOpenstack(t *testing.T) {
 		So(errn, ShouldBeNil)
 		So(s, ShouldNotBeNil)
 		defer s.Cleanup(ctx)
-		oss := s.impl.(*opst)
+		oss := s.impl.(*cloudScheduler)
 
-		possibleReq := &Requirements{100, 1 * time.Minute, 1, 1, otherReqs, true, true, true}
-		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs, true, true, true}
+		possibleReq := &Requirements{100, 1 * time.Minute, 1, 1, otherReqs, nil, true, true, true, false}
+		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs, nil, true, true, true, false}
 
 		Convey("ReserveTimeout() returns 25 seconds", func() {
 			So(s.ReserveTimeout(ctx, possibleReq), ShouldEqual, 1)
@@ -817,8 +2092,8 @@ func TestOpenstack(t *testing.T) {
 				So(flavor.Cores, ShouldEqual, 1)
 
 				flavor, err = oss.determineFlavor(ctx, &Requirements{
-					100, 1 * time.Minute, 1, 30, otherReqs,
-					true, true, true,
+					100, 1 * time.Minute, 1, 30, otherReqs, nil,
+					true, true, true, false,
 				}, "l")
 				So(err, ShouldBeNil)
 				So(flavor.ID, ShouldEqual, "2100")
@@ -828,8 +2103,8 @@ func TestOpenstack(t *testing.T) {
 				So(flavor.ID, ShouldEqual, "2100")
 
 				flavor, err = oss.determineFlavor(ctx, &Requirements{
-					100, 1 * time.Minute, 2, 1, otherReqs,
-					true, true, true,
+					100, 1 * time.Minute, 2, 1, otherReqs, nil,
+					true, true, true, false,
 				}, "n")
 				So(err, ShouldBeNil)
 				So(flavor.ID, ShouldEqual, "2101")
@@ -838,8 +2113,8 @@ func TestOpenstack(t *testing.T) {
 				So(flavor.Cores, ShouldEqual, 2)
 
 				flavor, err = oss.determineFlavor(ctx, &Requirements{
-					30000, 1 * time.Minute, 1, 1, otherReqs,
-					true, true, true,
+					30000, 1 * time.Minute, 1, 1, otherReqs, nil,
+					true, true, true, false,
 				}, "o")
 				So(err, ShouldBeNil)
 				So(flavor.ID, ShouldEqual, "2102")
@@ -848,8 +2123,8 @@ func TestOpenstack(t *testing.T) {
 				So(flavor.Cores, ShouldEqual, 4)
 
 				flavor, err = oss.determineFlavor(ctx, &Requirements{
-					64000, 1 * time.Minute, 1, 1, otherReqs,
-					true, true, true,
+					64000, 1 * time.Minute, 1, 1, otherReqs, nil,
+					true, true, true, false,
 				}, "p")
 				So(err, ShouldBeNil)
 				So(flavor.ID, ShouldEqual, "2103")
@@ -857,18 +2132,18 @@ func TestOpenstack(t *testing.T) {
 				So(flavor.Disk, ShouldEqual, 213)
 				So(flavor.Cores, ShouldEqual, 8)
 
-				flavor, err = oss.determineFlavor(ctx, &Requirements{100, 1 * time.Minute, 3, 1, otherReqs, true, true, true}, "r")
+				flavor, err = oss.determineFlavor(ctx, &Requirements{100, 1 * time.Minute, 3, 1, otherReqs, nil, true, true, true, false}, "r")
 				So(err, ShouldBeNil)
 				So(flavor.ID, ShouldEqual, "2102")
 
-				flavor, err = oss.determineFlavor(ctx, &Requirements{100, 1 * time.Minute, 5, 1, otherReqs, true, true, true}, "s")
+				flavor, err = oss.determineFlavor(ctx, &Requirements{100, 1 * time.Minute, 5, 1, otherReqs, nil, true, true, true, false}, "s")
 				So(err, ShouldBeNil)
 				So(flavor.ID, ShouldEqual, "2103")
 			})
 
 			Convey("MaxQueueTime() always returns enough time to complete 1 job, plus a minute leeway", func() {
 				So(s.MaxQueueTime(possibleReq).Minutes(), ShouldEqual, 2)
-				So(s.MaxQueueTime(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs, true, true, true}).Minutes(), ShouldEqual, 781)
+				So(s.MaxQueueTime(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs, nil, true, true, true, false}).Minutes(), ShouldEqual, 781)
 			})
 		}
 
@@ -890,7 +2165,7 @@ func TestOpenstack(t *testing.T) {
 				So(err, ShouldBeNil)
 				other := make(map[string]string)
 				other["cloud_flavor"] = flavor.Name
-				brokenReq := &Requirements{flavor.RAM + 1, 1 * time.Minute, 1, 1, other, true, true, true}
+				brokenReq := &Requirements{flavor.RAM + 1, 1 * time.Minute, 1, 1, other, nil, true, true, true, false}
 				err = s.Schedule(ctx, "foo", brokenReq, 0, 1)
 				So(err, ShouldNotBeNil)
 				serr, ok := err.(Error)
@@ -911,7 +2186,7 @@ func TestOpenstack(t *testing.T) {
 					eta := 200
 					oReqs := make(map[string]string)
 					oReqs["cloud_script"] = "touch /tmp/foo" // force a server to be spawned
-					thisReq := &Requirements{1, 1 * time.Minute, 0, 0, oReqs, true, true, true}
+					thisReq := &Requirements{1, 1 * time.Minute, 0, 0, oReqs, nil, true, true, true, false}
 					err := s.Schedule(ctx, "echo first", thisReq, 0, 1)
 					So(err, ShouldBeNil)
 					So(s.Busy(ctx), ShouldBeTrue)
@@ -938,7 +2213,7 @@ func TestOpenstack(t *testing.T) {
 					cmd := "touch /shared/test1"
 					other := make(map[string]string)
 					other["cloud_shared"] = "true"
-					localReq := &Requirements{100, 1 * time.Minute, 1, 1, other, true, true, true}
+					localReq := &Requirements{100, 1 * time.Minute, 1, 1, other, nil, true, true, true, false}
 					err := s.Schedule(ctx, cmd, localReq, 0, 1)
 					So(err, ShouldBeNil)
 
@@ -987,7 +2262,7 @@ func TestOpenstack(t *testing.T) {
 						cmd := "sleep 10"
 						other := make(map[string]string)
 						other["cloud_flavor"] = "o2.small"
-						thisReq := &Requirements{100, 1 * time.Minute, 1, 1, other, true, true, true}
+						thisReq := &Requirements{100, 1 * time.Minute, 1, 1, other, nil, true, true, true, false}
 						err := s.Schedule(ctx, cmd, thisReq, 0, 1)
 						So(err, ShouldBeNil)
 						So(s.Busy(ctx), ShouldBeTrue)
@@ -1033,7 +2308,7 @@ func TestOpenstack(t *testing.T) {
 					eta := 200
 					cmd := "sleep 10"
 					oReqs := make(map[string]string)
-					thisReq := &Requirements{100, 1 * time.Minute, 16, 1, oReqs, true, true, true}
+					thisReq := &Requirements{100, 1 * time.Minute, 16, 1, oReqs, nil, true, true, true, false}
 					err := s.Schedule(ctx, cmd, thisReq, 0, count)
 					So(err, ShouldBeNil)
 					So(s.Busy(ctx), ShouldBeTrue)
@@ -1084,7 +2359,7 @@ func TestOpenstack(t *testing.T) {
 					debugCounter = 0
 					debugEffect = "failFirstSpawn"
 					oReqs := make(map[string]string)
-					newReq := &Requirements{100, 1 * time.Minute, 1, 1, oReqs, true, true, true}
+					newReq := &Requirements{100, 1 * time.Minute, 1, 1, oReqs, nil, true, true, true, false}
 					newCount := 3
 					eta := 120
 					cmd := "sleep 10"
@@ -1098,7 +2373,7 @@ func TestOpenstack(t *testing.T) {
 					debugCounter = 0
 					debugEffect = "slowSecondSpawn"
 					oReqs := make(map[string]string)
-					newReq := &Requirements{100, 1 * time.Minute, 1, 1, oReqs, true, true, true}
+					newReq := &Requirements{100, 1 * time.Minute, 1, 1, oReqs, nil, true, true, true, false}
 					newCount := 3
 					eta := 120
 					cmd := "sleep 10"
@@ -1124,7 +2399,7 @@ func TestOpenstack(t *testing.T) {
 					oReqs["cloud_os_ram"] = "4096"
 
 					Convey("Override the default os image and ram", func() {
-						newReq := &Requirements{100, 1 * time.Minute, 1, 1, oReqs, true, true, true}
+						newReq := &Requirements{100, 1 * time.Minute, 1, 1, oReqs, nil, true, true, true, false}
 						newCount := 3
 						eta := 120
 						cmd := "sleep 10 && (echo override > " + oFile + ") || true"
@@ -1176,18 +2451,18 @@ func TestOpenstack(t *testing.T) {
 				numCores := 5
 				oReqsm := make(map[string]string)
 				multiCoreFlavor, err := oss.determineFlavor(ctx, &Requirements{
-					1024, 1 * time.Minute, float64(numCores), 0, oReqsm,
-					true, true, true,
+					1024, 1 * time.Minute, float64(numCores), 0, oReqsm, nil,
+					true, true, true, false,
 				}, "u")
 				if err == nil && multiCoreFlavor.Cores >= numCores {
 					oReqs := make(map[string]string)
 					oReqs["cloud_os_ram"] = strconv.Itoa(multiCoreFlavor.RAM)
-					jobReq := &Requirements{multiCoreFlavor.RAM / numCores, 1 * time.Minute, 1, 0, oReqs, true, true, true}
+					jobReq := &Requirements{multiCoreFlavor.RAM / numCores, 1 * time.Minute, 1, 0, oReqs, nil, true, true, true, false}
 					confirmFlavor, err := oss.determineFlavor(ctx, oss.reqForSpawn(jobReq), "v")
 					if err == nil && confirmFlavor.Cores >= numCores {
 						Convey("Run multiple jobs at once on multi-core servers", func() {
 							cmd := "sleep 30"
-							jobReq := &Requirements{multiCoreFlavor.RAM / numCores, 1 * time.Minute, 1, 0, oReqs, true, true, true}
+							jobReq := &Requirements{multiCoreFlavor.RAM / numCores, 1 * time.Minute, 1, 0, oReqs, nil, true, true, true, false}
 							err = s.Schedule(ctx, cmd, jobReq, 0, numCores)
 							So(err, ShouldBeNil)
 							So(s.Busy(ctx), ShouldBeTrue)
@@ -1258,7 +2533,7 @@ func TestOpenstack(t *testing.T) {
 			defer func() {
 				s.Cleanup(ctx)
 			}()
-			oss := s.impl.(*opst)
+			oss := s.impl.(*cloudScheduler)
 
 			if oss.provider.InCloud() {
 				ignoreServers := make(map[string]bool)
@@ -1331,7 +2606,7 @@ func TestOpenstack(t *testing.T) {
 
 				Convey("You can Schedule many cmds and a bunch run right away", func() {
 					smallCmd := "sleep 30"
-					smallReq := &Requirements{100, 1 * time.Minute, 2, 1, other, true, true, true}
+					smallReq := &Requirements{100, 1 * time.Minute, 2, 1, other, nil, true, true, true, false}
 					err := s.Schedule(ctx, smallCmd, smallReq, 0, config.SimultaneousSpawns*2)
 					So(err, ShouldBeNil)
 
@@ -1348,12 +2623,12 @@ func TestOpenstack(t *testing.T) {
 
 				Convey("You can Schedule many small cmds and then a higher priority large cmd and the large runs asap", func() {
 					smallCmd := "sleep 60"
-					smallReq := &Requirements{100, 1 * time.Minute, 2, 1, other, true, true, true}
+					smallReq := &Requirements{100, 1 * time.Minute, 2, 1, other, nil, true, true, true, false}
 					err := s.Schedule(ctx, smallCmd, smallReq, 0, config.SimultaneousSpawns*3)
 					So(err, ShouldBeNil)
 
 					bigCmd := "sleep 2"
-					bigReq := &Requirements{100, 1 * time.Minute, 4, 1, other, true, true, true}
+					bigReq := &Requirements{100, 1 * time.Minute, 4, 1, other, nil, true, true, true, false}
 					err = s.Schedule(ctx, bigCmd, bigReq, 1, 1)
 					So(err, ShouldBeNil)
 
@@ -1373,12 +2648,12 @@ func TestOpenstack(t *testing.T) {
 
 				Convey("You can Schedule a large command and then a small cmd and get both running and sharing servers", func() {
 					bigCmd := "sleep 15"
-					bigReq := &Requirements{100, 1 * time.Minute, 6, 1, other, true, true, true}
+					bigReq := &Requirements{100, 1 * time.Minute, 6, 1, other, nil, true, true, true, false}
 					err := s.Schedule(ctx, bigCmd, bigReq, 0, config.SimultaneousSpawns-1)
 					So(err, ShouldBeNil)
 
 					smallCmd := "sleep 16"
-					smallReq := &Requirements{100, 1 * time.Minute, 2, 1, other, true, true, true}
+					smallReq := &Requirements{100, 1 * time.Minute, 2, 1, other, nil, true, true, true, false}
 					err = s.Schedule(ctx, smallCmd, smallReq, 0, config.SimultaneousSpawns)
 					So(err, ShouldBeNil)
 
@@ -1394,7 +2669,7 @@ func TestOpenstack(t *testing.T) {
 					for _, server := range oss.servers {
 						if server.Flavor.Cores == 8 {
 							eightcores++
-							thisSpace := server.HasSpaceFor(2, 1, 1)
+							thisSpace := server.HasSpaceFor(2, 1, 1, nil)
 							space += thisSpace
 						} else {
 							twocores++
@@ -1640,3 +2915,441 @@ func parsePidHostFile(path string) (int, string, bool) {
 	host := <-hostCh
 	return pid, host, ok
 }
+
+// createSlurmStubs creates fake sinfo, scontrol, sbatch, squeue and scancel
+// executables in the given directory. Submitted jobs are recorded in a "jobs"
+// file in the squeue output format, and sbatch args in "sbatch.args".
+func createSlurmStubs(dir string) error {
+	stubs := map[string]string{
+		"sinfo": `cat <<'EOF'
+short|up|1:00:00|64000|16|5|0|1
+short|up|1:00:00|128000+|32|5|0|1
+long|up|7-00:00:00|256000|32|10|0|1
+hugemem|up|infinite|2048000|64|2|0|1
+maint|down|infinite|9999999|128|100|0|1
+EOF`,
+		"scontrol": `echo "MaxArraySize            = 3"`,
+		"sbatch": `echo "$@" >> DIR/sbatch.args
+id=$(( $(cat DIR/counter 2>/dev/null || echo 0) + 1 ))
+echo $id > DIR/counter
+name=""
+array=""
+while [ $# -gt 0 ]; do
+    case "$1" in
+        -J) name="$2"; shift;;
+        --array) array="$2"; shift;;
+    esac
+    shift
+done
+if [ -z "$array" ]; then
+    echo "$id|PENDING|$name" >> DIR/jobs
+else
+    for i in $(seq ${array%-*} ${array#*-}); do
+        echo "${id}_$i|PENDING|$name" >> DIR/jobs
+    done
+fi
+echo $id`,
+		"squeue": `cat DIR/jobs 2>/dev/null
+exit 0`,
+		"scancel": `for id in "$@"; do
+    grep -v "^$id|" DIR/jobs > DIR/jobs.tmp
+    mv DIR/jobs.tmp DIR/jobs
+done`,
+	}
+
+	return writeStubs(dir, stubs)
+}
+
+// createSGEStubs creates fake qconf, qstat, qsub and qdel executables in the
+// given directory. Submitted array tasks are recorded one per line in a "jobs"
+// file as "id|task|state|name", qsub args in "qsub.args" and the job scripts
+// qsub received on STDIN in "qsub.stdin".
+func createSGEStubs(dir string) error {
+	stubs := map[string]string{
+		"qconf": `case "$1" in
+    -sconf) echo "max_aj_tasks                 3";;
+    -sql) printf "short.q\nlong.q\nbig.q\n";;
+    -sq)
+        case "$2" in
+            short.q) printf "qname short.q\npriority 0\nslots 1,[node1=16],[node2=8]\nh_rt 1:00:00\nh_vmem 8G\n";;
+            long.q) printf "qname long.q\npriority 0\nslots 32\nh_rt 604800\nh_vmem 16G\n";;
+            big.q) printf "qname big.q\npriority 5\nslots 64\nh_rt INFINITY\nh_vmem INFINITY\n";;
+            *) exit 1;;
+        esac;;
+esac`,
+		"qstat": `if [ "$1" = "-g" ]; then
+    cat <<'EOF'
+CLUSTER QUEUE                   CQLOAD   USED    RES  AVAIL  TOTAL aoACDS  cdsuE
+--------------------------------------------------------------------------------
+short.q                           0.10     10      0     90    100      0      0
+long.q                            0.50     25      0     25     50      0      0
+big.q                             0.00      0      0     10     10      0      0
+EOF
+    exit 0
+fi
+joblist() {
+    [ -f DIR/jobs ] || return 0
+    while IFS='|' read -r id task state name; do
+        if [ "$1" = running ] && [ "$state" != r ]; then continue; fi
+        if [ "$1" = pending ] && [ "$state" = r ]; then continue; fi
+        echo "<job_list state=\"x\"><JB_job_number>$id</JB_job_number><JB_name>$name</JB_name><state>$state</state>"
+        if [ -n "$task" ]; then echo "<tasks>$task</tasks>"; fi
+        echo "</job_list>"
+    done < DIR/jobs
+}
+echo '<?xml version="1.0"?>'
+echo '<job_info>'
+echo '<queue_info>'
+joblist running
+echo '</queue_info>'
+echo '<job_info>'
+joblist pending
+echo '</job_info>'
+echo '</job_info>'`,
+		"qsub": `echo "$@" >> DIR/qsub.args
+cat >> DIR/qsub.stdin
+id=$(( $(cat DIR/counter 2>/dev/null || echo 0) + 1 ))
+echo $id > DIR/counter
+name=""
+array=""
+while [ $# -gt 0 ]; do
+    case "$1" in
+        -N) name="$2"; shift;;
+        -t) array="$2"; shift;;
+    esac
+    shift
+done
+if [ -z "$array" ]; then
+    echo "$id||qw|$name" >> DIR/jobs
+    echo $id
+else
+    for i in $(seq ${array%-*} ${array#*-}); do
+        echo "$id|$i|qw|$name" >> DIR/jobs
+    done
+    echo "$id.$array:1"
+fi`,
+		"qdel": `for id in "$@"; do
+    case "$id" in
+        *.*) pattern="^${id%.*}|${id#*.}|";;
+        *) pattern="^$id|";;
+    esac
+    grep -v "$pattern" DIR/jobs > DIR/jobs.tmp
+    mv DIR/jobs.tmp DIR/jobs
+done`,
+	}
+
+	return writeStubs(dir, stubs)
+}
+
+// createPBSStubs creates fake PBS Pro qstat, qsub and qdel executables in the
+// given directory. Submitted jobs (including array parents) are recorded in a
+// "jobs" file as "id|state|name|owner", and qsub args in "qsub.args".
+func createPBSStubs(dir string) error {
+	stubs := map[string]string{
+		"qstat": `case "$1" in
+    --version) echo "pbs_version = 19.1.3";;
+    -Bf) printf "Server: pbs1\n    server_state = Active\n    max_array_size = 3\n";;
+    -Qf) cat <<'EOF'
+Queue: short
+    queue_type = Execution
+    Priority = 100
+    resources_max.mem = 64gb
+    resources_max.ncpus = 16
+    resources_max.walltime = 01:00:00
+    enabled = True
+    started = True
+
+Queue: long
+    queue_type = Execution
+    Priority = 50
+    resources_max.mem = 256gb
+    resources_max.ncpus = 32
+    resources_max.walltime = 168:00:00
+    enabled = True
+    started = True
+
+Queue: hugemem
+    queue_type = Execution
+    Priority = 10
+    resources_max.mem = 2tb
+    resources_max.ncpus = 64
+    enabled = True
+    started = True
+
+Queue: maint
+    queue_type = Execution
+    Priority = 1000
+    enabled = False
+    started = True
+
+Queue: workq
+    queue_type = Route
+    route_destinations = short,long
+    enabled = True
+    started = True
+EOF
+    ;;
+    -f)
+        [ -f DIR/jobs ] || exit 0
+        while IFS='|' read -r id state name owner; do
+            printf "Job Id: %s\n    Job_Name = %s\n    Job_Owner = %s\n    job_state = %s\n\n" "$id" "$name" "$owner" "$state"
+        done < DIR/jobs;;
+esac`,
+		"qsub": `echo "$@" >> DIR/qsub.args
+cat > /dev/null
+id=$(( $(cat DIR/counter 2>/dev/null || echo 0) + 1 ))
+echo $id > DIR/counter
+owner="$(id -u -n)@submithost"
+name=""
+array=""
+while [ $# -gt 0 ]; do
+    case "$1" in
+        -N) name="$2"; shift;;
+        -J) array="$2"; shift;;
+    esac
+    shift
+done
+if [ -z "$array" ]; then
+    echo "$id.pbs1|Q|$name|$owner" >> DIR/jobs
+    echo "$id.pbs1"
+else
+    echo "$id[].pbs1|B|$name|$owner" >> DIR/jobs
+    for i in $(seq ${array%-*} ${array#*-}); do
+        echo "$id[$i].pbs1|Q|$name|$owner" >> DIR/jobs
+    done
+    echo "$id[].pbs1"
+fi`,
+		"qdel": `for id in "$@"; do
+    grep -v -F "$id|" DIR/jobs > DIR/jobs.tmp
+    mv DIR/jobs.tmp DIR/jobs
+done`,
+	}
+
+	return writeStubs(dir, stubs)
+}
+
+// writeStubs writes out the given bash scripts as executables named after
+// their keys in the given directory, replacing DIR in them with the directory.
+func writeStubs(dir string, stubs map[string]string) error {
+	for name, script := range stubs {
+		content := "#!/bin/bash\n" + strings.ReplaceAll(script, "DIR", dir) + "\n"
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o700); err != nil { //nolint:gosec
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fakeCloudServerIDs returns the sorted IDs of the cloud servers the given
+// scheduler is currently using, ignoring localhost and destroyed servers.
+func fakeCloudServerIDs(s *cloudScheduler) []string {
+	s.serversMutex.RLock()
+	defer s.serversMutex.RUnlock()
+
+	var ids []string
+	for id, server := range s.servers {
+		if id == localhostName || server.Destroyed() {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// receivedMessage drains the given channel of messages sent to a scheduler
+// message callback, returning true if one of them was the expected message.
+func receivedMessage(msgs chan string, expected string) bool {
+	for {
+		select {
+		case msg := <-msgs:
+			if msg == expected {
+				return true
+			}
+		case <-time.After(1 * time.Second):
+			return false
+		}
+	}
+}
+
+// startTestSSHServer starts an ssh server on localhost that lets in anyone
+// with a key in the given authorized_keys file, running their commands and
+// sftp sessions as us. This lets us test cloud servers that are really this
+// machine without needing sshd. If the file or sudo commands that cloud servers
+// are expected to have aren't installed, simple versions are put in shimDir.
+// Returns the port the server listens on and a function to stop it.
+func startTestSSHServer(t *testing.T, shimDir, authorizedKeys string) (int, func()) {
+	t.Helper()
+
+	if err := createSSHShims(shimDir); err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			content, errr := os.ReadFile(authorizedKeys)
+			if errr != nil {
+				return nil, errr
+			}
+
+			for len(content) > 0 {
+				authorized, _, _, rest, errp := ssh.ParseAuthorizedKey(content)
+				if errp != nil {
+					break
+				}
+
+				if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+					return &ssh.Permissions{}, nil
+				}
+
+				content = rest
+			}
+
+			return nil, errors.New("unauthorized key")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, erra := ln.Accept()
+			if erra != nil {
+				return
+			}
+
+			go serveTestSSHConn(conn, config, shimDir)
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port, func() { ln.Close() } //nolint:forcetypeassert,errcheck
+}
+
+// createSSHShims creates file and sudo scripts in the given directory if those
+// commands aren't installed.
+func createSSHShims(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	shims := map[string]string{
+		"file": `[ -e "$1" ] && echo "$1: empty" || echo "$1: cannot open (No such file or directory)"`,
+		"sudo": `exec "$@"`,
+	}
+
+	for name, script := range shims {
+		if _, err := exec.LookPath(name); err == nil {
+			continue
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0o700); err != nil { //nolint:gosec
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serveTestSSHConn handles the sessions of a connection to our test ssh server.
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig, shimDir string) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+
+		return
+	}
+	defer sconn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported") //nolint:errcheck
+
+			continue
+		}
+
+		ch, chReqs, erra := newCh.Accept()
+		if erra != nil {
+			continue
+		}
+
+		go serveTestSSHSession(ch, chReqs, shimDir)
+	}
+}
+
+// serveTestSSHSession runs the command or sftp subsystem requested in a
+// session on our test ssh server.
+func serveTestSSHSession(ch ssh.Channel, reqs <-chan *ssh.Request, shimDir string) {
+	defer ch.Close()
+
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil) //nolint:errcheck
+
+				continue
+			}
+			req.Reply(true, nil) //nolint:errcheck
+
+			cmd := exec.Command("sh", "-c", payload.Command) // #nosec
+			cmd.Env = append(os.Environ(), "PATH="+shimDir+":"+os.Getenv("PATH"))
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+
+			var status uint32
+			if err := cmd.Run(); err != nil {
+				status = 1
+
+				var exitErr *exec.ExitError
+				if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+					status = uint32(exitErr.ExitCode()) //nolint:gosec
+				}
+			}
+
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status})) //nolint:errcheck
+
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil) //nolint:errcheck
+
+				continue
+			}
+			req.Reply(true, nil) //nolint:errcheck
+
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+
+			server.Serve() //nolint:errcheck
+			server.Close()
+
+			return
+		default:
+			if req.WantReply {
+				req.Reply(req.Type == "env" || req.Type == "pty-req", nil) //nolint:errcheck
+			}
+		}
+	}
+}
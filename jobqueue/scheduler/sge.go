@@ -0,0 +1,699 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains a scheduleri implementation for 'sge': running jobs
+// via Sun/Son of/Univa Grid Engine.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+const (
+	// defaultSGEMaxArraySize is the max_aj_tasks that Grid Engine uses if not
+	// otherwise configured.
+	defaultSGEMaxArraySize = 75000
+
+	// sgeInfiniteRunlimit is the runlimit in seconds we treat queues without
+	// a time limit as having.
+	sgeInfiniteRunlimit = 31536000
+
+	// sgeParallelEnvironment is the parallel environment we request for jobs
+	// that need more than 1 core, which must allocate all slots on 1 host.
+	sgeParallelEnvironment = "smp"
+)
+
+// sge is our implementer of scheduleri
+type sge struct {
+	config       *ConfigSGE
+	queues       map[string]map[string]int
+	sortedqs     []string
+	qsubRegex    *regexp.Regexp
+	maxArraySize int
+	username     string
+	shellPath    string
+	qsubExe      string
+	qstatExe     string
+	qdelExe      string
+	qconfExe     string
+	privateKey   string
+}
+
+// ConfigSGE represents the configuration options required by the SGE
+// scheduler. All are required with no usable defaults.
+type ConfigSGE struct {
+	// Deployment is one of "development" or "production".
+	Deployment string
+
+	// Shell is the shell to use to run the commands to interact with your job
+	// scheduler; 'bash' is recommended.
+	Shell string
+
+	// PrivateKeyPath is the path to your private key that can be used to ssh
+	// to Grid Engine nodes to check on jobs if they become non-responsive.
+	PrivateKeyPath string
+}
+
+// sgeQstat is used to parse the XML output of qstat.
+type sgeQstat struct {
+	Running []sgeQstatJob `xml:"queue_info>job_list"`
+	Pending []sgeQstatJob `xml:"job_info>job_list"`
+}
+
+// sgeQstatJob describes a job (or some tasks of an array job) in qstat's XML
+// output.
+type sgeQstatJob struct {
+	Number string `xml:"JB_job_number"`
+	Name   string `xml:"JB_name"`
+	State  string `xml:"state"`
+	Tasks  string `xml:"tasks"`
+}
+
+// initialize finds out about sge's queues and configuration
+func (s *sge) initialize(ctx context.Context, config interface{}) error {
+	s.config = config.(*ConfigSGE)
+
+	s.qsubExe = internal.Which("qsub")
+	s.qstatExe = internal.Which("qstat")
+	s.qdelExe = internal.Which("qdel")
+	s.qconfExe = internal.Which("qconf")
+
+	// jobs are run with the queue's configured shell by default, which may
+	// well be csh, so we ask for our own
+	s.shellPath = internal.Which(s.config.Shell)
+
+	s.qsubRegex = regexp.MustCompile(`^(\d+)`)
+
+	var err error
+	s.username, err = internal.Username()
+	if err != nil {
+		return Error{"sge", "initialize", fmt.Sprintf("could not get current user: %s", err)}
+	}
+
+	s.maxArraySize = s.determineMaxArraySize()
+
+	err = s.parseQueues()
+	if err != nil {
+		return err
+	}
+
+	s.sortQueues()
+
+	// if a job becomes lost, scheduler needs to ssh to the host to check on the
+	// process, so we store our private key
+	if content, err := os.ReadFile(internal.TildaToHome(s.config.PrivateKeyPath)); err == nil {
+		s.privateKey = string(content)
+	}
+
+	return nil
+}
+
+// determineMaxArraySize uses qconf to find out the maximum number of tasks we
+// can have in an array job, defaulting to Grid Engine's own default if that
+// isn't possible.
+func (s *sge) determineMaxArraySize() int {
+	cmdout, err := exec.Command(s.config.Shell, "-c", s.qconfExe+" -sconf").Output() // #nosec
+	if err != nil {
+		return defaultSGEMaxArraySize
+	}
+
+	re := regexp.MustCompile(`(?m)^max_aj_tasks\s+(\d+)`)
+	if matches := re.FindStringSubmatch(string(cmdout)); len(matches) == 2 {
+		size, err := strconv.Atoi(matches[1])
+		if err == nil && size > 0 {
+			return size
+		}
+	}
+
+	return defaultSGEMaxArraySize
+}
+
+// parseQueues uses qconf to find out what cluster queues we have and their
+// limits, and qstat to find out how many slots each has in total.
+func (s *sge) parseQueues() error {
+	out, err := exec.Command(s.config.Shell, "-c", s.qconfExe+" -sql").Output() // #nosec
+	if err != nil {
+		return Error{"sge", "initialize", fmt.Sprintf("failed to run [qconf -sql]: %s", err)}
+	}
+
+	s.queues = make(map[string]map[string]int)
+	for _, queue := range strings.Fields(string(out)) {
+		qout, errq := exec.Command(s.qconfExe, "-sq", queue).Output() // #nosec
+		if errq != nil {
+			return Error{"sge", "initialize", fmt.Sprintf("failed to run [qconf -sq %s]: %s", queue, errq)}
+		}
+
+		vals, errp := parseSGEQueueConfig(string(qout))
+		if errp != nil {
+			return Error{"sge", "initialize", fmt.Sprintf("failed to parse [qconf -sq %s]: %s", queue, errp)}
+		}
+
+		s.queues[queue] = vals
+	}
+
+	out, err = exec.Command(s.config.Shell, "-c", s.qstatExe+" -g c").Output() // #nosec
+	if err != nil {
+		return Error{"sge", "initialize", fmt.Sprintf("failed to run [qstat -g c]: %s", err)}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+
+		vals, known := s.queues[fields[0]]
+		if !known {
+			continue
+		}
+
+		if total, errc := strconv.Atoi(fields[5]); errc == nil {
+			vals["slots"] = total
+		}
+	}
+
+	return nil
+}
+
+// parseSGEQueueConfig parses the output of qconf -sq for a queue, returning its
+// runlimit (h_rt, in seconds), memlimit (h_vmem per slot, in MB), cpus (the
+// most slots on any host) and prio (the negated nice value). Unlimited values
+// are returned as 0.
+func parseSGEQueueConfig(config string) (map[string]int, error) {
+	vals := map[string]int{"runlimit": 0, "memlimit": 0, "cpus": 0, "slots": 0, "prio": 0}
+
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		var err error
+		switch fields[0] {
+		case "h_rt":
+			vals["runlimit"], err = parseSGETime(fields[1])
+		case "h_vmem":
+			vals["memlimit"], err = parseSGEMemory(fields[1])
+		case "slots":
+			vals["cpus"], err = parseSGESlots(fields[1])
+		case "priority":
+			var nice int
+			nice, err = strconv.Atoi(fields[1])
+			vals["prio"] = -nice
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return vals, scanner.Err()
+}
+
+// parseSGETime parses a Grid Engine time value, in the form "seconds" or
+// "hours:minutes:seconds", returning the number of seconds. INFINITY is
+// returned as 0.
+func parseSGETime(limit string) (int, error) {
+	if strings.EqualFold(limit, "INFINITY") {
+		return 0, nil
+	}
+
+	return parseClockTime(limit)
+}
+
+// parseSGEMemory parses a Grid Engine memory value, which is a number of bytes
+// optionally suffixed with K, M, G or T (multiples of 1024) or k, m, g or t
+// (multiples of 1000), returning the number of MB. INFINITY is returned as 0.
+func parseSGEMemory(mem string) (int, error) {
+	if strings.EqualFold(mem, "INFINITY") {
+		return 0, nil
+	}
+
+	multipliers := map[byte]float64{
+		'K': 1024, 'M': 1024 * 1024, 'G': 1024 * 1024 * 1024, 'T': 1024 * 1024 * 1024 * 1024,
+		'k': 1000, 'm': 1000 * 1000, 'g': 1000 * 1000 * 1000, 't': 1000 * 1000 * 1000 * 1000,
+	}
+
+	multiplier := 1.0
+	if m, found := multipliers[mem[len(mem)-1]]; found {
+		multiplier = m
+		mem = mem[:len(mem)-1]
+	}
+
+	num, err := strconv.ParseFloat(mem, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(num * multiplier / (1024 * 1024)), nil
+}
+
+// parseSGESlots parses the slots value of a queue's config, which can be a
+// number followed by host-specific overrides, eg. "1,[node1=4],[node2=8]",
+// returning the largest number.
+func parseSGESlots(slots string) (int, error) {
+	max := 0
+	for _, part := range strings.Split(slots, ",") {
+		part = strings.Trim(part, "[]")
+		if i := strings.Index(part, "="); i != -1 {
+			part = part[i+1:]
+		}
+
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, err
+		}
+
+		if num > max {
+			max = num
+		}
+	}
+
+	return max, nil
+}
+
+// sortQueues fills in default values for unlimited criteria, then sorts the
+// queues so that those most likely to run jobs sooner come first, the same way
+// lsf sorts its queues.
+func (s *sge) sortQueues() {
+	for _, qmap := range s.queues {
+		if qmap["runlimit"] == 0 {
+			qmap["runlimit"] = sgeInfiniteRunlimit
+		}
+	}
+
+	// for each criteria we're going to sort the queues on, hard-code
+	// [weight, sort-order]. For time and memory, prefer the queue that is more
+	// limited, since we suppose they might be less busy or will at least
+	// become free sooner
+	criteriaHandling := map[string][]int{
+		"slots":    {18, 1}, // weight, sort order
+		"prio":     {10, 1},
+		"runlimit": {5, 0},
+		"memlimit": {1, 0},
+	}
+
+	s.sortedqs = rankQueues(s.queues, []string{"slots", "prio", "runlimit", "memlimit"}, criteriaHandling)
+}
+
+// reserveTimeout achieves the aims of ReserveTimeout().
+func (s *sge) reserveTimeout(ctx context.Context, req *Requirements) int {
+	if val, defined := req.Other["rtimeout"]; defined {
+		timeout, err := strconv.Atoi(val)
+		if err != nil {
+			clog.Error(ctx, fmt.Sprintf("Failed to convert timeout to integer: %s", err))
+			return defaultReserveTimeout
+		}
+		return timeout
+	}
+	return defaultReserveTimeout
+}
+
+// maxQueueTime achieves the aims of MaxQueueTime().
+func (s *sge) maxQueueTime(req *Requirements) time.Duration {
+	queue, err := s.determineQueue(req)
+	if err == nil {
+		return s.queueRunlimit(queue)
+	}
+	return infiniteQueueTime
+}
+
+// queueRunlimit returns the runlimit of the given queue, or infiniteQueueTime
+// if we don't know about the queue.
+func (s *sge) queueRunlimit(queue string) time.Duration {
+	if qmap, known := s.queues[queue]; known {
+		return time.Duration(qmap["runlimit"]) * time.Second
+	}
+	return infiniteQueueTime
+}
+
+// schedule achieves the aims of Schedule(). Note that if rescheduling a cmd
+// at a lower count, we cannot guarantee that only that number get run; it may
+// end up being a few more.
+func (s *sge) schedule(ctx context.Context, cmd string, req *Requirements, priority uint8, count int) error {
+	// use the given queue or find the best queue for these resource
+	// requirements
+	queue, err := s.determineQueue(req)
+	if err != nil {
+		return err // impossible to run cmd with these reqs
+	}
+
+	// get the details of everything already in the scheduler for this cmd,
+	// deleting anything not currently running when we're over the desired
+	// count
+	scheduledCount, err := s.checkCmd(ctx, cmd, count)
+	if err != nil {
+		return err
+	}
+	stillNeeded := count - scheduledCount
+
+	// like sbatch, qsub only returns once the job has been accepted, but we
+	// have to split large requests in to multiple array jobs
+	for stillNeeded > 0 {
+		needed := stillNeeded
+		if needed > s.maxArraySize {
+			needed = s.maxArraySize
+		}
+
+		qsubArgs := s.generateQsubArgs(ctx, queue, req, cmd, needed)
+
+		// we supply the cmd as the job script on STDIN
+		qsubcmd := exec.Command(s.qsubExe, qsubArgs...) // #nosec
+		qsubcmd.Stdin = strings.NewReader(cmd + "\n")
+		qsubout, errs := qsubcmd.Output()
+		if errs != nil {
+			return Error{"sge", "schedule", fmt.Sprintf("failed to run %s %s: %s", s.qsubExe, qsubArgs, errs)}
+		}
+
+		if !s.qsubRegex.Match(qsubout) {
+			return Error{"sge", "schedule", fmt.Sprintf("qsub %s returned unexpected output: %s", qsubArgs, qsubout)}
+		}
+
+		stillNeeded -= needed
+	}
+
+	return nil
+}
+
+// scheduled achieves the aims of Scheduled().
+func (s *sge) scheduled(ctx context.Context, cmd string) (int, error) {
+	return s.checkCmd(ctx, cmd, -1)
+}
+
+// generateQsubArgs generates the appropriate qsub args for the given req and
+// queue. h_vmem is a per-slot limit, so we divide the required memory amongst
+// the cores.
+func (s *sge) generateQsubArgs(ctx context.Context, queue string, req *Requirements, cmd string, needed int) []string {
+	cores := int(math.Ceil(req.Cores))
+	if cores < 1 {
+		cores = 1
+	}
+
+	qsubArgs := []string{"-terse", "-V", "-q", queue, "-l",
+		fmt.Sprintf("h_vmem=%dM", int(math.Ceil(float64(req.RAM)/float64(cores))))}
+
+	if s.shellPath != "" {
+		qsubArgs = append(qsubArgs, "-S", s.shellPath)
+	}
+
+	if runlimit := s.queueRunlimit(queue); runlimit > 0 && runlimit < sgeInfiniteRunlimit*time.Second {
+		qsubArgs = append(qsubArgs, "-l", fmt.Sprintf("h_rt=%d", int(runlimit.Seconds())))
+	}
+
+	if cores > 1 {
+		qsubArgs = append(qsubArgs, "-pe", sgeParallelEnvironment, strconv.Itoa(cores))
+	}
+
+	if hosts := avoidedHosts(ctx, req); len(hosts) > 0 {
+		qsubArgs = append(qsubArgs, "-l", "h=!("+strings.Join(hosts, "|")+")")
+	}
+
+	if val, ok := req.Other["scheduler_misc"]; ok {
+		r := csv.NewReader(strings.NewReader(val))
+		r.Comma = ' '
+		fields, err := r.Read()
+		if err != nil {
+			clog.Warn(ctx, "scheduler misc option ignored", "misc", val, "err", err)
+		} else {
+			qsubArgs = append(qsubArgs, fields...)
+		}
+	}
+
+	// for checkCmd() to work efficiently we must always set a job name that
+	// corresponds to the cmd
+	if needed > 1 {
+		qsubArgs = append(qsubArgs, "-t", fmt.Sprintf("1-%d", needed))
+	}
+	qsubArgs = append(qsubArgs, "-N", jobName(cmd, s.config.Deployment, true),
+		"-o", "/dev/null", "-e", "/dev/null")
+
+	return qsubArgs
+}
+
+// recover achieves the aims of Recover(). We don't have to do anything, since
+// when the cmd finishes running, Grid Engine itself will clean up.
+func (s *sge) recover(ctx context.Context, cmd string, req *Requirements, host *RecoveredHostDetails) error {
+	return nil
+}
+
+// busy returns true if there are any jobs with our jobName() prefix in any
+// queue.
+func (s *sge) busy(ctx context.Context) bool {
+	count, err := s.checkCmd(ctx, "", -1)
+	if err != nil {
+		// busy() doesn't return an error, so just assume we're busy
+		return true
+	}
+	return count > 0
+}
+
+// determineQueue picks a queue, preferring ones that are more likely to run
+// our job the soonest (amongst those that are capable of running it). If
+// req.Other contains a scheduler_queue value, returns that instead.
+func (s *sge) determineQueue(req *Requirements) (string, error) {
+	if queue, ok := req.Other["scheduler_queue"]; ok {
+		return queue, nil
+	}
+
+	seconds := req.Time.Seconds() + minimumQueueTime.Seconds()
+	cores := math.Max(math.Ceil(req.Cores), 1)
+
+	var queuesToAvoid []string
+	if req.Other["scheduler_queues_avoid"] != "" {
+		queuesToAvoid = strings.Split(req.Other["scheduler_queues_avoid"], ",")
+	}
+
+	for _, queue := range s.sortedqs {
+		if queueShouldBeAvoided(queue, queuesToAvoid) {
+			continue
+		}
+
+		qmap := s.queues[queue]
+
+		if qmap["memlimit"] > 0 && float64(qmap["memlimit"]) < math.Ceil(float64(req.RAM)/cores) {
+			continue
+		}
+
+		if float64(qmap["runlimit"]) < seconds {
+			continue
+		}
+
+		if qmap["cpus"] > 0 && float64(qmap["cpus"]) < req.Cores {
+			continue
+		}
+
+		return queue, nil
+	}
+
+	return "", Error{"sge", "determineQueue", ErrImpossible}
+}
+
+// checkCmd asks Grid Engine how many of the supplied cmd are pending or
+// running, and if max >= 0 is supplied, deletes any extraneous pending jobs for
+// the cmd. If the supplied cmd is the empty string, it will report/act on all
+// cmds submitted by schedule() for this deployment. Tasks in an error state
+// will never run, so are not counted.
+func (s *sge) checkCmd(ctx context.Context, cmd string, max int) (count int, err error) {
+	// as with slurm, we arranged that the job name be jobName(cmd, ..., true)
+	// when submitting, so we can find all the jobs for the cmd with a single
+	// qstat call, regardless of how many arrays we submitted them in
+	var jobPrefix string
+	if cmd == "" {
+		jobPrefix = fmt.Sprintf("wr%s_", s.config.Deployment[0:1])
+	} else {
+		jobPrefix = jobName(cmd, s.config.Deployment, false)
+	}
+
+	var pending []string
+	cb := func(jobID, state, jobName string) {
+		if strings.ContainsAny(state, "Ed") {
+			return
+		}
+
+		count++
+		if strings.Contains(state, "qw") {
+			pending = append(pending, jobID)
+		}
+	}
+	err = s.parseQstat(jobPrefix, cb)
+
+	// qstat lists running tasks before pending ones, so we only decide what to
+	// delete once we've seen everything
+	var toDelete []string
+	if max >= 0 && count > max {
+		n := count - max
+		if n > len(pending) {
+			n = len(pending)
+		}
+		toDelete = pending[len(pending)-n:]
+		count -= n
+	}
+
+	if len(toDelete) > 0 {
+		delcmd := exec.Command(s.qdelExe, toDelete...) // #nosec
+		out, errd := delcmd.CombinedOutput()
+		if errd != nil {
+			clog.Warn(ctx, "checkCmd qdel failed", "cmd", s.qdelExe, "toDelete", toDelete, "err", errd, "out", string(out))
+		}
+	}
+
+	return count, err
+}
+
+type sgeQstatCB func(jobID, state, jobName string)
+
+// parseQstat runs qstat for our user with XML output, filters on a job name
+// prefix, and gives the job id (with any array task id, in the form
+// "job.task"), state and job name to your callback for each matching task.
+func (s *sge) parseQstat(jobPrefix string, callback sgeQstatCB) error {
+	out, err := exec.Command(s.qstatExe, "-xml", "-u", s.username).Output() // #nosec
+	if err != nil {
+		return Error{"sge", "parseQstat", fmt.Sprintf("failed to run [qstat]: %s", err)}
+	}
+
+	var qstat sgeQstat
+	if err = xml.Unmarshal(out, &qstat); err != nil {
+		return Error{"sge", "parseQstat", fmt.Sprintf("failed to parse [qstat] output: %s", err)}
+	}
+
+	for _, job := range append(qstat.Running, qstat.Pending...) {
+		if !strings.HasPrefix(job.Name, jobPrefix) {
+			continue
+		}
+
+		if job.Tasks == "" {
+			callback(job.Number, job.State, job.Name)
+			continue
+		}
+
+		tasks, errt := parseSGETasks(job.Tasks)
+		if errt != nil {
+			return Error{"sge", "parseQstat", fmt.Sprintf("failed to parse [qstat] tasks: %s", errt)}
+		}
+
+		for _, task := range tasks {
+			callback(job.Number+"."+strconv.Itoa(task), job.State, job.Name)
+		}
+	}
+
+	return nil
+}
+
+// parseSGETasks parses the tasks of an array job as reported by qstat, which
+// is a comma separated list of task ids or ranges in the form start-end:step,
+// returning all the individual task ids.
+func parseSGETasks(tasks string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(tasks, ",") {
+		step := 1
+		if i := strings.Index(part, ":"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("bad task step in %s", part)
+			}
+			part = part[:i]
+		}
+
+		start, end := part, part
+		if i := strings.Index(part, "-"); i != -1 {
+			start, end = part[:i], part[i+1:]
+		}
+
+		first, err := strconv.Atoi(start)
+		if err != nil {
+			return nil, err
+		}
+		last, err := strconv.Atoi(end)
+		if err != nil {
+			return nil, err
+		}
+
+		for id := first; id <= last; id += step {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// hostToID always returns an empty string, since we're not in the cloud.
+func (s *sge) hostToID(host string) string {
+	return ""
+}
+
+// getHost returns a cloud.Server for the given host.
+func (s *sge) getHost(host string) (Host, bool) {
+	name := "unknown"
+	if user, err := user.Current(); err == nil {
+		name = user.Username
+	}
+
+	server := cloud.NewServer(name, host, s.privateKey)
+	if server == nil {
+		return nil, false
+	}
+
+	return server, true
+}
+
+// setMessageCallBack does nothing at the moment, since we don't generate any
+// messages for the user.
+func (s *sge) setMessageCallBack(ctx context.Context, cb MessageCallBack) {}
+
+// setBadServerCallBack does nothing, since we're not a cloud-based scheduler.
+func (s *sge) setBadServerCallBack(ctx context.Context, cb BadServerCallBack) {}
+
+// cleanup qdels any remaining jobs we created
+func (s *sge) cleanup(ctx context.Context) {
+	var toDelete []string
+	cb := func(jobID, state, jobName string) {
+		toDelete = append(toDelete, jobID)
+	}
+	err := s.parseQstat(fmt.Sprintf("wr%s_", s.config.Deployment[0:1]), cb)
+	if err != nil {
+		clog.Error(ctx, "cleanup parse qstat failed", "err", err)
+	}
+	if len(toDelete) > 0 {
+		delcmd := exec.Command(s.qdelExe, toDelete...) // #nosec
+		err = delcmd.Run()
+		if err != nil {
+			clog.Warn(ctx, "cleanup qdel failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,607 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains a scheduleri implementation for 'slurm': running jobs
+// via SchedMD's Slurm Workload Manager.
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+const (
+	// defaultSlurmMaxArraySize is the MaxArraySize that Slurm uses if not
+	// otherwise configured.
+	defaultSlurmMaxArraySize = 1001
+
+	// slurmInfiniteRunlimit is the runlimit in seconds we treat partitions
+	// without a time limit as having.
+	slurmInfiniteRunlimit = 31536000
+
+	// slurmSqueueFormat is the output format we ask squeue for: job id
+	// (including array index), long state name, and job name.
+	slurmSqueueFormat = "%i|%T|%j"
+)
+
+// slurmFinishedStates are the squeue states that mean a job is no longer
+// pending or running.
+var slurmFinishedStates = map[string]bool{
+	"BOOT_FAIL":     true,
+	"CANCELLED":     true,
+	"COMPLETED":     true,
+	"DEADLINE":      true,
+	"FAILED":        true,
+	"NODE_FAIL":     true,
+	"OUT_OF_MEMORY": true,
+	"PREEMPTED":     true,
+	"REVOKED":       true,
+	"TIMEOUT":       true,
+}
+
+// slurm is our implementer of scheduleri
+type slurm struct {
+	config       *ConfigSlurm
+	partitions   map[string]map[string]int
+	sortedps     []string
+	sbatchRegex  *regexp.Regexp
+	maxArraySize int
+	username     string
+	sbatchExe    string
+	squeueExe    string
+	scancelExe   string
+	sinfoExe     string
+	scontrolExe  string
+	privateKey   string
+}
+
+// ConfigSlurm represents the configuration options required by the Slurm
+// scheduler. All are required with no usable defaults.
+type ConfigSlurm struct {
+	// Deployment is one of "development" or "production".
+	Deployment string
+
+	// Shell is the shell to use to run the commands to interact with your job
+	// scheduler; 'bash' is recommended.
+	Shell string
+
+	// PrivateKeyPath is the path to your private key that can be used to ssh
+	// to Slurm nodes to check on jobs if they become non-responsive.
+	PrivateKeyPath string
+}
+
+// initialize finds out about slurm's partitions and configuration
+func (s *slurm) initialize(ctx context.Context, config interface{}) error {
+	s.config = config.(*ConfigSlurm)
+
+	s.sbatchExe = internal.Which("sbatch")
+	s.squeueExe = internal.Which("squeue")
+	s.scancelExe = internal.Which("scancel")
+	s.sinfoExe = internal.Which("sinfo")
+	s.scontrolExe = internal.Which("scontrol")
+
+	s.sbatchRegex = regexp.MustCompile(`^(\d+)`)
+
+	var err error
+	s.username, err = internal.Username()
+	if err != nil {
+		return Error{"slurm", "initialize", fmt.Sprintf("could not get current user: %s", err)}
+	}
+
+	s.maxArraySize = s.determineMaxArraySize()
+
+	err = s.parseSinfo()
+	if err != nil {
+		return err
+	}
+
+	s.sortPartitions()
+
+	// if a job becomes lost, scheduler needs to ssh to the host to check on the
+	// process, so we store our private key
+	if content, err := os.ReadFile(internal.TildaToHome(s.config.PrivateKeyPath)); err == nil {
+		s.privateKey = string(content)
+	}
+
+	return nil
+}
+
+// determineMaxArraySize uses scontrol to find out the maximum number of
+// elements we can have in a job array, defaulting to Slurm's own default if
+// that isn't possible.
+func (s *slurm) determineMaxArraySize() int {
+	cmdout, err := exec.Command(s.config.Shell, "-c", s.scontrolExe+" show config").Output() // #nosec
+	if err != nil {
+		return defaultSlurmMaxArraySize
+	}
+
+	re := regexp.MustCompile(`(?m)^MaxArraySize\s*=\s*(\d+)`)
+	if matches := re.FindStringSubmatch(string(cmdout)); len(matches) == 2 {
+		size, err := strconv.Atoi(matches[1])
+		if err == nil && size > 0 {
+			return size
+		}
+	}
+
+	return defaultSlurmMaxArraySize
+}
+
+// parseSinfo parses sinfo to figure out what usable partitions we have and
+// their limits. Partitions made up of nodes with differing configurations are
+// reported on multiple lines; we take the largest memory, cpu and temporary
+// disk limits and sum the hosts.
+func (s *slurm) parseSinfo() error {
+	sicmd := exec.Command(s.config.Shell, "-c", s.sinfoExe+" -h -o '%R|%a|%l|%m|%c|%D|%d|%p'") // #nosec
+	siout, err := sicmd.StdoutPipe()
+	if err != nil {
+		return Error{"slurm", "initialize", fmt.Sprintf("failed to create pipe for [sinfo]: %s", err)}
+	}
+	if err = sicmd.Start(); err != nil {
+		return Error{"slurm", "initialize", fmt.Sprintf("failed to start [sinfo]: %s", err)}
+	}
+
+	s.partitions = make(map[string]map[string]int)
+	siScanner := bufio.NewScanner(siout)
+	for siScanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(siScanner.Text()), "|")
+		if len(fields) != 8 || fields[1] != "up" {
+			continue
+		}
+
+		vals := make(map[string]int)
+		vals["runlimit"], err = parseSlurmTime(fields[2])
+		if err != nil {
+			return Error{"slurm", "initialize", fmt.Sprintf("failed to parse [sinfo]: %s", err)}
+		}
+		for i, criterion := range []string{"memlimit", "cpus", "hosts", "tmp", "prio"} {
+			vals[criterion], err = strconv.Atoi(strings.TrimSuffix(fields[i+3], "+"))
+			if err != nil {
+				return Error{"slurm", "initialize", fmt.Sprintf("failed to parse [sinfo]: %s", err)}
+			}
+		}
+
+		partition := fields[0]
+		existing, seen := s.partitions[partition]
+		if !seen {
+			s.partitions[partition] = vals
+			continue
+		}
+
+		existing["hosts"] += vals["hosts"]
+		for _, criterion := range []string{"memlimit", "cpus", "tmp"} {
+			if vals[criterion] > existing[criterion] {
+				existing[criterion] = vals[criterion]
+			}
+		}
+	}
+
+	if serr := siScanner.Err(); serr != nil {
+		return Error{"slurm", "initialize", fmt.Sprintf("failed to read everything from [sinfo]: %s", serr)}
+	}
+	if err := sicmd.Wait(); err != nil {
+		return Error{"slurm", "initialize", fmt.Sprintf("failed to finish running [sinfo]: %s", err)}
+	}
+
+	return nil
+}
+
+// parseSlurmTime parses a Slurm time limit, in any of the forms "minutes",
+// "minutes:seconds", "hours:minutes:seconds", "days-hours",
+// "days-hours:minutes" or "days-hours:minutes:seconds", returning the number
+// of seconds. Unlimited time limits are returned as 0.
+func parseSlurmTime(limit string) (int, error) {
+	switch strings.ToLower(limit) {
+	case "infinite", "unlimited", "n/a", "":
+		return 0, nil
+	}
+
+	days := 0
+	hms := limit
+	i := strings.Index(limit, "-")
+	hasDays := i != -1
+	if hasDays {
+		var err error
+		days, err = strconv.Atoi(limit[:i])
+		if err != nil {
+			return 0, err
+		}
+		hms = limit[i+1:]
+	}
+
+	parts := strings.Split(hms, ":")
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, err
+		}
+		nums[i] = num
+	}
+
+	var h, m, sec int
+	switch {
+	case hasDays:
+		h = nums[0]
+		if len(nums) > 1 {
+			m = nums[1]
+		}
+		if len(nums) > 2 {
+			sec = nums[2]
+		}
+	case len(nums) == 1:
+		m = nums[0]
+	case len(nums) == 2:
+		m, sec = nums[0], nums[1]
+	default:
+		h, m, sec = nums[0], nums[1], nums[2]
+	}
+
+	return days*86400 + h*3600 + m*60 + sec, nil
+}
+
+// sortPartitions fills in default values for unlimited criteria, then sorts
+// the partitions so that those most likely to run jobs sooner come first, the
+// same way lsf sorts its queues.
+func (s *slurm) sortPartitions() {
+	for _, pmap := range s.partitions {
+		if pmap["runlimit"] == 0 {
+			pmap["runlimit"] = slurmInfiniteRunlimit
+		}
+	}
+
+	// for each criteria we're going to sort the partitions on, hard-code
+	// [weight, sort-order]. For time and memory, prefer the partition that is
+	// more limited, since we suppose they might be less busy or will at least
+	// become free sooner
+	criteriaHandling := map[string][]int{
+		"hosts":    {18, 1}, // weight, sort order
+		"prio":     {10, 1},
+		"runlimit": {5, 0},
+		"memlimit": {1, 0},
+	}
+
+	s.sortedps = rankQueues(s.partitions, []string{"hosts", "prio", "runlimit", "memlimit"}, criteriaHandling)
+}
+
+// reserveTimeout achieves the aims of ReserveTimeout().
+func (s *slurm) reserveTimeout(ctx context.Context, req *Requirements) int {
+	if val, defined := req.Other["rtimeout"]; defined {
+		timeout, err := strconv.Atoi(val)
+		if err != nil {
+			clog.Error(ctx, fmt.Sprintf("Failed to convert timeout to integer: %s", err))
+			return defaultReserveTimeout
+		}
+		return timeout
+	}
+	return defaultReserveTimeout
+}
+
+// maxQueueTime achieves the aims of MaxQueueTime().
+func (s *slurm) maxQueueTime(req *Requirements) time.Duration {
+	partition, err := s.determineQueue(req)
+	if err == nil {
+		return s.partitionRunlimit(partition)
+	}
+	return infiniteQueueTime
+}
+
+// partitionRunlimit returns the runlimit of the given partition, or
+// infiniteQueueTime if we don't know about the partition.
+func (s *slurm) partitionRunlimit(partition string) time.Duration {
+	if pmap, known := s.partitions[partition]; known {
+		return time.Duration(pmap["runlimit"]) * time.Second
+	}
+	return infiniteQueueTime
+}
+
+// schedule achieves the aims of Schedule(). Note that if rescheduling a cmd
+// at a lower count, we cannot guarantee that only that number get run; it may
+// end up being a few more.
+func (s *slurm) schedule(ctx context.Context, cmd string, req *Requirements, priority uint8, count int) error {
+	// use the given partition or find the best partition for these resource
+	// requirements
+	partition, err := s.determineQueue(req)
+	if err != nil {
+		return err // impossible to run cmd with these reqs
+	}
+
+	// get the details of everything already in the scheduler for this cmd,
+	// cancelling anything not currently running when we're over the desired
+	// count
+	scheduledCount, err := s.checkCmd(ctx, cmd, count)
+	if err != nil {
+		return err
+	}
+	stillNeeded := count - scheduledCount
+
+	// unlike bsub, sbatch only returns once the controller has accepted the
+	// job, so there is no need to wait for it to appear in squeue. We do,
+	// however, have to split large requests in to multiple job arrays
+	for stillNeeded > 0 {
+		needed := stillNeeded
+		if needed > s.maxArraySize {
+			needed = s.maxArraySize
+		}
+
+		sbatchArgs := s.generateSbatchArgs(ctx, partition, req, cmd, needed)
+
+		sbatchcmd := exec.Command(s.sbatchExe, sbatchArgs...) // #nosec
+		sbatchout, errs := sbatchcmd.Output()
+		if errs != nil {
+			return Error{"slurm", "schedule", fmt.Sprintf("failed to run %s %s: %s", s.sbatchExe, sbatchArgs, errs)}
+		}
+
+		if !s.sbatchRegex.Match(sbatchout) {
+			return Error{"slurm", "schedule", fmt.Sprintf("sbatch %s returned unexpected output: %s", sbatchArgs, sbatchout)}
+		}
+
+		stillNeeded -= needed
+	}
+
+	return nil
+}
+
+// scheduled achieves the aims of Scheduled().
+func (s *slurm) scheduled(ctx context.Context, cmd string) (int, error) {
+	return s.checkCmd(ctx, cmd, -1)
+}
+
+// generateSbatchArgs generates the appropriate sbatch args for the given req
+// and cmd and partition.
+func (s *slurm) generateSbatchArgs(ctx context.Context, partition string, req *Requirements, cmd string, needed int) []string {
+	sbatchArgs := []string{"--parsable", "-p", partition, "-N", "1", "--mem", fmt.Sprintf("%dM", req.RAM)}
+
+	if runlimit := s.partitionRunlimit(partition); runlimit > 0 && runlimit < slurmInfiniteRunlimit*time.Second {
+		sbatchArgs = append(sbatchArgs, "-t", strconv.Itoa(int(runlimit.Minutes())))
+	}
+
+	if req.Cores > 1 {
+		sbatchArgs = append(sbatchArgs, "-c", fmt.Sprintf("%d", int(math.Ceil(req.Cores))))
+	}
+
+	if req.Disk > 0 {
+		sbatchArgs = append(sbatchArgs, "--tmp", fmt.Sprintf("%dG", req.Disk))
+	}
+
+	if hosts := avoidedHosts(ctx, req); len(hosts) > 0 {
+		sbatchArgs = append(sbatchArgs, "--exclude", strings.Join(hosts, ","))
+	}
+
+	if val, ok := req.Other["scheduler_misc"]; ok {
+		r := csv.NewReader(strings.NewReader(val))
+		r.Comma = ' '
+		fields, err := r.Read()
+		if err != nil {
+			clog.Warn(ctx, "scheduler misc option ignored", "misc", val, "err", err)
+		} else {
+			sbatchArgs = append(sbatchArgs, fields...)
+		}
+	}
+
+	// for checkCmd() to work efficiently we must always set a job name that
+	// corresponds to the cmd
+	if needed > 1 {
+		sbatchArgs = append(sbatchArgs, "--array", fmt.Sprintf("0-%d", needed-1))
+	}
+	sbatchArgs = append(sbatchArgs, "-J", jobName(cmd, s.config.Deployment, true),
+		"-o", "/dev/null", "-e", "/dev/null", "--wrap", cmd)
+
+	return sbatchArgs
+}
+
+// recover achieves the aims of Recover(). We don't have to do anything, since
+// when the cmd finishes running, Slurm itself will clean up.
+func (s *slurm) recover(ctx context.Context, cmd string, req *Requirements, host *RecoveredHostDetails) error {
+	return nil
+}
+
+// busy returns true if there are any jobs with our jobName() prefix in any
+// partition.
+func (s *slurm) busy(ctx context.Context) bool {
+	count, err := s.checkCmd(ctx, "", -1)
+	if err != nil {
+		// busy() doesn't return an error, so just assume we're busy
+		return true
+	}
+	return count > 0
+}
+
+// determineQueue picks a partition, preferring ones that are more likely to run
+// our job the soonest (amongst those that are capable of running it). If
+// req.Other contains a scheduler_queue value, returns that instead.
+func (s *slurm) determineQueue(req *Requirements) (string, error) {
+	if partition, ok := req.Other["scheduler_queue"]; ok {
+		return partition, nil
+	}
+
+	seconds := req.Time.Seconds() + minimumQueueTime.Seconds()
+
+	var partitionsToAvoid []string
+	if req.Other["scheduler_queues_avoid"] != "" {
+		partitionsToAvoid = strings.Split(req.Other["scheduler_queues_avoid"], ",")
+	}
+
+	for _, partition := range s.sortedps {
+		if queueShouldBeAvoided(partition, partitionsToAvoid) {
+			continue
+		}
+
+		pmap := s.partitions[partition]
+
+		if pmap["memlimit"] > 0 && pmap["memlimit"] < req.RAM {
+			continue
+		}
+
+		if float64(pmap["runlimit"]) < seconds {
+			continue
+		}
+
+		if pmap["cpus"] > 0 && float64(pmap["cpus"]) < req.Cores {
+			continue
+		}
+
+		if pmap["tmp"] > 0 && pmap["tmp"] < req.Disk*1000 {
+			continue
+		}
+
+		return partition, nil
+	}
+
+	return "", Error{"slurm", "determineQueue", ErrImpossible}
+}
+
+// checkCmd asks Slurm how many of the supplied cmd are pending or running, and
+// if max >= 0 is supplied, cancels any extraneous pending jobs for the cmd. If
+// the supplied cmd is the empty string, it will report/act on all cmds
+// submitted by schedule() for this deployment.
+func (s *slurm) checkCmd(ctx context.Context, cmd string, max int) (count int, err error) {
+	// as with lsf, we arranged that the job name be jobName(cmd, ..., true)
+	// when submitting, so we can find all the jobs for the cmd with a single
+	// squeue call, regardless of how many arrays we submitted them in
+	var jobPrefix string
+	if cmd == "" {
+		jobPrefix = fmt.Sprintf("wr%s_", s.config.Deployment[0:1])
+	} else {
+		jobPrefix = jobName(cmd, s.config.Deployment, false)
+	}
+
+	if max >= 0 {
+		var toCancel []string
+		cb := func(jobID, state, jobName string) {
+			count++
+			if count > max && state == "PENDING" {
+				toCancel = append(toCancel, jobID)
+				count--
+			}
+		}
+		err = s.parseSqueue(jobPrefix, cb)
+
+		if len(toCancel) > 0 {
+			cancelcmd := exec.Command(s.scancelExe, toCancel...) // #nosec
+			out, errc := cancelcmd.CombinedOutput()
+			if errc != nil {
+				clog.Warn(ctx, "checkCmd scancel failed", "cmd", s.scancelExe, "toCancel", toCancel, "err", errc, "out", string(out))
+			}
+		}
+	} else {
+		cb := func(jobID, state, jobName string) {
+			count++
+		}
+		err = s.parseSqueue(jobPrefix, cb)
+	}
+
+	return count, err
+}
+
+type squeueCB func(jobID, state, jobName string)
+
+// parseSqueue runs squeue for our user with one job array element per line,
+// filters on a job name prefix, excludes finished jobs and gives the job id
+// (with any array index), state and job name to your callback for each
+// remaining job.
+func (s *slurm) parseSqueue(jobPrefix string, callback squeueCB) error {
+	sqcmd := exec.Command(s.config.Shell, "-c", s.squeueExe+" -h -r -u "+s.username+" -o '"+slurmSqueueFormat+"'") // #nosec
+	sqout, err := sqcmd.StdoutPipe()
+	if err != nil {
+		return Error{"slurm", "parseSqueue", fmt.Sprintf("failed to create pipe for [squeue]: %s", err)}
+	}
+	err = sqcmd.Start()
+	if err != nil {
+		return Error{"slurm", "parseSqueue", fmt.Sprintf("failed to start [squeue]: %s", err)}
+	}
+	sqScanner := bufio.NewScanner(sqout)
+	sqScanner.Buffer([]byte{}, scanBufferSize)
+
+	for sqScanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(sqScanner.Text()), "|", 3)
+		if len(fields) != 3 || slurmFinishedStates[fields[1]] || !strings.HasPrefix(fields[2], jobPrefix) {
+			continue
+		}
+		callback(fields[0], fields[1], fields[2])
+	}
+
+	if err = sqScanner.Err(); err != nil {
+		return Error{"slurm", "parseSqueue", fmt.Sprintf("failed to read everything from [squeue]: %s", err)}
+	}
+	err = sqcmd.Wait()
+	if err != nil {
+		err = Error{"slurm", "parseSqueue", fmt.Sprintf("failed to finish running [squeue]: %s", err)}
+	}
+	return err
+}
+
+// hostToID always returns an empty string, since we're not in the cloud.
+func (s *slurm) hostToID(host string) string {
+	return ""
+}
+
+// getHost returns a cloud.Server for the given host.
+func (s *slurm) getHost(host string) (Host, bool) {
+	name := "unknown"
+	if user, err := user.Current(); err == nil {
+		name = user.Username
+	}
+
+	server := cloud.NewServer(name, host, s.privateKey)
+	if server == nil {
+		return nil, false
+	}
+
+	return server, true
+}
+
+// setMessageCallBack does nothing at the moment, since we don't generate any
+// messages for the user.
+func (s *slurm) setMessageCallBack(ctx context.Context, cb MessageCallBack) {}
+
+// setBadServerCallBack does nothing, since we're not a cloud-based scheduler.
+func (s *slurm) setBadServerCallBack(ctx context.Context, cb BadServerCallBack) {}
+
+// cleanup scancels any remaining jobs we created
+func (s *slurm) cleanup(ctx context.Context) {
+	var toCancel []string
+	cb := func(jobID, state, jobName string) {
+		toCancel = append(toCancel, jobID)
+	}
+	err := s.parseSqueue(fmt.Sprintf("wr%s_", s.config.Deployment[0:1]), cb)
+	if err != nil {
+		clog.Error(ctx, "cleanup parse squeue failed", "err", err)
+	}
+	if len(toCancel) > 0 {
+		cancelcmd := exec.Command(s.scancelExe, toCancel...) // #nosec
+		err = cancelcmd.Run()
+		if err != nil {
+			clog.Warn(ctx, "cleanup scancel failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,806 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains a scheduleri implementation for 'sshpool': running jobs
+// over ssh on a fixed set of hosts that aren't managed by any other job
+// scheduler.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+const (
+	// sshPoolAliveTimeout is how long we wait for a host to respond over ssh
+	// before considering it unreachable.
+	sshPoolAliveTimeout = 30 * time.Second
+
+	// sshPoolUncheckedDisk is the disk space in GB we treat hosts as having
+	// when they weren't configured with a disk size.
+	sshPoolUncheckedDisk = unquotadVal
+)
+
+// sshpool is our implementer of scheduleri. It takes much of its
+// implementation from the local scheduler, bin-packing cmds on to a fixed set
+// of hosts instead of the local machine.
+type sshpool struct {
+	local
+	config           *ConfigSSHPool
+	hosts            map[string]*cloud.Server
+	hostNames        []string
+	userName         string
+	privateKey       string
+	preparedHosts    map[string]bool
+	recoveredPids    map[string]map[int]bool
+	msgCB            MessageCallBack
+	badServerCB      BadServerCallBack
+	stopRSMonitoring chan struct{}
+	hostsMutex       sync.RWMutex
+	prepMutex        sync.Mutex
+	rsMutex          sync.Mutex
+	cbmutex          sync.RWMutex
+	stateMutex       sync.Mutex
+	updatingState    bool
+}
+
+// ConfigSSHPool represents the configuration options required by the sshpool
+// scheduler. All are required with no usable defaults, unless otherwise noted.
+type ConfigSSHPool struct {
+	// Hosts describes the hosts that cmds can be run on, and their resources.
+	// See ParseSSHPoolHosts() for the format.
+	Hosts string
+
+	// UserName is the username to ssh to the hosts as, unless overridden for a
+	// particular host in Hosts. Defaults to the current user.
+	UserName string
+
+	// PrivateKeyPath is the path to your private key that can be used to ssh
+	// to the hosts without a password.
+	PrivateKeyPath string
+
+	// ConfigFiles is a comma separated list of paths to config files that
+	// should be copied over to each host before it is first used, in the
+	// format taken by cloud.Server.CopyOver().
+	ConfigFiles string
+
+	// Shell is the shell to use to run your commands with; 'bash' is
+	// recommended.
+	Shell string
+
+	// StateUpdateFrequency is the frequency at which to check that the hosts
+	// can still be reached. 0 (default) is treated as 1 minute.
+	StateUpdateFrequency time.Duration
+
+	// Umask is an optional umask to run remote commands under, as per
+	// ConfigCloud.Umask.
+	Umask int
+}
+
+// AddConfigFile takes a value as per the ConfigFiles property, and appends it
+// to the existing ConfigFiles value (or sets it if unset).
+func (c *ConfigSSHPool) AddConfigFile(configFile string) {
+	if c.ConfigFiles == "" {
+		c.ConfigFiles = configFile
+	} else {
+		c.ConfigFiles += "," + configFile
+	}
+}
+
+// SSHPoolHost describes one of the hosts of the sshpool scheduler.
+type SSHPoolHost struct {
+	Name      string // hostname or ip address to ssh to
+	UserName  string // username to ssh as; blank means the configured default
+	Cores     int
+	RAM       int            // MB
+	Disk      int            // GB; 0 means disk isn't checked
+	Resources map[string]int // named consumable resources
+}
+
+// ParseSSHPoolHosts parses a spec describing the hosts of an sshpool, in the
+// form "[user@]host:cores=N,ram=MB[,disk=GB][,name=count...];[user@]host:...",
+// eg. "ws1:cores=16,ram=64000;bob@ws2:cores=8,ram=32000,disk=500,gpu=1". cores
+// and ram are required; other names are treated as named consumable resources,
+// as per ParseResources().
+func ParseSSHPoolHosts(spec string) ([]*SSHPoolHost, error) {
+	var hosts []*SSHPoolHost
+
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(strings.TrimSpace(spec), ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, hspec, found := strings.Cut(part, ":")
+		if !found || name == "" {
+			return nil, fmt.Errorf("ssh host '%s' is not in the form host:cores=N,ram=MB", part)
+		}
+
+		host := &SSHPoolHost{Name: name}
+		if user, hostName, hasUser := strings.Cut(name, "@"); hasUser {
+			host.UserName = user
+			host.Name = hostName
+		}
+
+		if seen[host.Name] {
+			return nil, fmt.Errorf("ssh host %s was specified more than once", host.Name)
+		}
+		seen[host.Name] = true
+
+		var rspecs []string
+		for _, kv := range strings.Split(hspec, ",") {
+			key, val, _ := strings.Cut(strings.TrimSpace(kv), "=")
+
+			var dest *int
+			switch key {
+			case "cores":
+				dest = &host.Cores
+			case "ram":
+				dest = &host.RAM
+			case "disk":
+				dest = &host.Disk
+			default:
+				rspecs = append(rspecs, kv)
+				continue
+			}
+
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("ssh host %s does not have a positive integer %s", host.Name, key)
+			}
+			*dest = n
+		}
+
+		if host.Cores == 0 || host.RAM == 0 {
+			return nil, fmt.Errorf("ssh host %s must have both cores and ram specified", host.Name)
+		}
+
+		resources, err := ParseResources(strings.Join(rspecs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("ssh host %s: %w", host.Name, err)
+		}
+		host.Resources = resources
+
+		hosts = append(hosts, host)
+	}
+
+	if len(hosts) == 0 {
+		return nil, errors.New("no ssh hosts were specified")
+	}
+
+	return hosts, nil
+}
+
+// initialize parses our configured hosts and sets up the local scheduler we
+// embed.
+func (s *sshpool) initialize(ctx context.Context, config interface{}) error {
+	s.config = config.(*ConfigSSHPool)
+
+	hosts, err := ParseSSHPoolHosts(s.config.Hosts)
+	if err != nil {
+		return Error{"sshpool", "initialize", err.Error()}
+	}
+
+	content, err := os.ReadFile(internal.TildaToHome(s.config.PrivateKeyPath))
+	if err != nil {
+		return Error{"sshpool", "initialize", fmt.Sprintf("could not read private key: %s", err)}
+	}
+	s.privateKey = string(content)
+
+	s.userName = s.config.UserName
+	if s.userName == "" {
+		s.userName, err = internal.Username()
+		if err != nil {
+			return Error{"sshpool", "initialize", fmt.Sprintf("could not get current user: %s", err)}
+		}
+	}
+
+	s.hosts = make(map[string]*cloud.Server)
+	for _, host := range hosts {
+		s.hosts[host.Name] = s.newHostServer(host)
+		s.hostNames = append(s.hostNames, host.Name)
+	}
+	sort.Strings(s.hostNames)
+
+	// initialize our job queue and other trackers
+	s.queue = queue.New(ctx, localPlace)
+	s.running = make(map[string]int)
+	s.preparedHosts = make(map[string]bool)
+	s.recoveredPids = make(map[string]map[int]bool)
+	s.stopRSMonitoring = make(chan struct{})
+
+	// set our functions for use in schedule() and processQueue()
+	s.reqCheckFunc = s.reqCheck
+	s.maxMemFunc = s.maxMem
+	s.maxCPUFunc = s.maxCPU
+	s.canCountFunc = s.canCount
+	s.cantFunc = s.cant
+	s.runCmdFunc = s.runCmd
+	s.stateUpdateFunc = s.stateUpdate
+	s.stateUpdateFreq = s.config.StateUpdateFrequency
+	if s.stateUpdateFreq == 0 {
+		s.stateUpdateFreq = 1 * time.Minute
+	}
+	s.postProcessFunc = s.postProcess
+	s.cmdNotNeededFunc = s.cmdNotNeeded
+
+	// pass through our shell config to our local embed, as well as creating
+	// its stopAuto channel
+	s.local.config = &ConfigLocal{Shell: s.config.Shell}
+	s.local.stopAuto = make(chan bool)
+
+	return nil
+}
+
+// newHostServer returns a cloud.Server that can be used to ssh to the given
+// host and keep track of the resources used on it.
+func (s *sshpool) newHostServer(host *SSHPoolHost) *cloud.Server {
+	user := host.UserName
+	if user == "" {
+		user = s.userName
+	}
+
+	disk := host.Disk
+	if disk == 0 {
+		disk = sshPoolUncheckedDisk
+	}
+
+	server := cloud.NewServer(user, host.Name, s.privateKey)
+	server.ID = host.Name
+	server.Name = host.Name
+	server.Disk = disk
+	server.Unowned = true
+	server.Flavor = &cloud.Flavor{
+		ID:        host.Name,
+		Name:      host.Name,
+		Cores:     host.Cores,
+		RAM:       host.RAM,
+		Disk:      disk,
+		Resources: CopyResources(host.Resources),
+	}
+
+	return server
+}
+
+// reqCheck gives an ErrImpossible if the given Requirements can not be met by
+// any of our hosts, even when they are running nothing else.
+func (s *sshpool) reqCheck(ctx context.Context, req *Requirements) error {
+	s.hostsMutex.RLock()
+	defer s.hostsMutex.RUnlock()
+
+	for _, server := range s.hosts {
+		if server.Flavor.HasSpaceFor(req.Cores, req.RAM, req.Disk, req.Resources) > 0 {
+			return nil
+		}
+	}
+
+	s.notifyMessage(fmt.Sprintf("sshpool: no host is big enough for the job needing %f cores, %d RAM and %d Disk",
+		req.Cores, req.RAM, req.Disk))
+
+	return Error{"sshpool", "schedule", ErrImpossible}
+}
+
+// maxMem returns the memory of our largest host in MB.
+func (s *sshpool) maxMem() int {
+	s.hostsMutex.RLock()
+	defer s.hostsMutex.RUnlock()
+
+	var max int
+	for _, server := range s.hosts {
+		if server.Flavor.RAM > max {
+			max = server.Flavor.RAM
+		}
+	}
+
+	return max
+}
+
+// maxCPU returns the number of cores of our largest host.
+func (s *sshpool) maxCPU() int {
+	s.hostsMutex.RLock()
+	defer s.hostsMutex.RUnlock()
+
+	var max int
+	for _, server := range s.hosts {
+		if server.Flavor.Cores > max {
+			max = server.Flavor.Cores
+		}
+	}
+
+	return max
+}
+
+// usableHosts returns the hosts that are not bad and that the given
+// Requirements don't ask us to avoid, in name order. You must hold at least a
+// read lock on hostsMutex.
+func (s *sshpool) usableHosts(req *Requirements) []*cloud.Server {
+	var avoid []string
+	if val := req.Other[AvoidHostsKey]; val != "" {
+		avoid = strings.Split(val, ",")
+	}
+
+	servers := make([]*cloud.Server, 0, len(s.hostNames))
+
+HOSTS:
+	for _, name := range s.hostNames {
+		server := s.hosts[name]
+		if server.IsBad() || server.Destroyed() {
+			continue
+		}
+
+		for _, host := range avoid {
+			if hostMatches(name, host) {
+				continue HOSTS
+			}
+		}
+
+		servers = append(servers, server)
+	}
+
+	return servers
+}
+
+// hostMatches tells you if the given name of one of our hosts refers to the
+// same machine as the given host name, which may be the host's own idea of its
+// hostname. We treat names as matching if they're the same, or if one is the
+// short form of the other.
+func hostMatches(name, host string) bool {
+	if name == host {
+		return true
+	}
+
+	short := func(h string) string {
+		s, _, _ := strings.Cut(h, ".")
+		return s
+	}
+
+	return (short(name) == host || short(host) == name) && !isIPAddress(name) && !isIPAddress(host)
+}
+
+// isIPAddress tells you if the given host looks like an IPv4 address.
+func isIPAddress(host string) bool {
+	return strings.Trim(host, "0123456789.") == ""
+}
+
+// canCount tells you how many jobs with the given requirements it is possible
+// to run, given remaining resources on our usable hosts.
+func (s *sshpool) canCount(ctx context.Context, cmd string, req *Requirements, call string) int {
+	if s.cleanedUp() {
+		return 0
+	}
+
+	s.hostsMutex.RLock()
+	defer s.hostsMutex.RUnlock()
+
+	var canCount int
+	for _, server := range s.usableHosts(req) {
+		canCount += server.HasSpaceFor(req.Cores, req.RAM, req.Disk, req.Resources)
+	}
+
+	return canCount
+}
+
+// pickHost finds the usable host with the least space left that can still run
+// a cmd with the given requirements (so that larger gaps are left for larger
+// cmds), and allocates the requirements on it. Returns nil if no host has
+// space.
+func (s *sshpool) pickHost(ctx context.Context, req *Requirements) *cloud.Server {
+	s.hostsMutex.RLock()
+	defer s.hostsMutex.RUnlock()
+
+	var best *cloud.Server
+	bestSpace := 0
+	for _, server := range s.usableHosts(req) {
+		space := server.HasSpaceFor(req.Cores, req.RAM, req.Disk, req.Resources)
+		if space > 0 && (best == nil || space < bestSpace) {
+			best = server
+			bestSpace = space
+		}
+	}
+
+	if best == nil || !best.Allocate(ctx, req.Cores, req.RAM, req.Disk, req.Resources) {
+		return nil
+	}
+
+	return best
+}
+
+// runCmd runs the command on the best host for it. NB: we only return an error
+// if we can't start the cmd, not if the command fails (schedule() only
+// guarantees that the cmds are run count times, not that they are /successful/
+// that many times).
+func (s *sshpool) runCmd(ctx context.Context, cmd string, req *Requirements, reservedCh chan bool) error {
+	if s.cleanedUp() {
+		reservedCh <- false
+		return nil
+	}
+
+	server := s.pickHost(ctx, req)
+	if server == nil {
+		reservedCh <- false
+		return errors.New("no available host")
+	}
+
+	// *** reservedCh is buffered and sending on it should never block, but
+	// somehow we have gotten stuck here before; make sure we don't get stuck
+	// on this send
+	select {
+	case reservedCh <- true:
+	case <-time.After(reserveChTimeout):
+		clog.Warn(ctx, "failed to send on reservedCh", "host", server.Name)
+	}
+
+	// later, after we've run the command, this host will be available for
+	// another; release resources, and local scheduler will trigger a new
+	// processQueue() call
+	defer server.Release(ctx, req.Cores, req.RAM, req.Disk, req.Resources)
+
+	err := s.prepareHost(ctx, server, cmd)
+	if err != nil {
+		s.hostGoneBad(ctx, server, err)
+		return err
+	}
+
+	if s.config.Umask > 0 {
+		cmd = fmt.Sprintf("(umask %d && %s)", s.config.Umask, cmd)
+	}
+
+	clog.Debug(ctx, "running command remotely", "cmd", cmd, "host", server.Name)
+	_, _, err = server.RunCmd(ctx, cmd, false)
+	if err != nil {
+		// the cmd itself may have failed, which isn't the host's fault, so only
+		// stop using the host if we can no longer reach it
+		if !s.hostAlive(ctx, server) {
+			s.hostGoneBad(ctx, server, err)
+		}
+		clog.Warn(ctx, "failed to run command", "cmd", cmd, "host", server.Name, "err", err)
+
+		return err
+	}
+
+	clog.Debug(ctx, "ran command", "cmd", cmd, "host", server.Name)
+
+	return nil
+}
+
+// prepareHost copies over our config files and the exe of the given cmd to the
+// given host, if that hasn't already been done.
+func (s *sshpool) prepareHost(ctx context.Context, server *cloud.Server, cmd string) error {
+	s.prepMutex.Lock()
+	defer s.prepMutex.Unlock()
+
+	if s.preparedHosts[server.Name] {
+		return nil
+	}
+
+	if s.config.ConfigFiles != "" {
+		if err := server.CopyOver(ctx, s.config.ConfigFiles); err != nil {
+			return fmt.Errorf("could not copy config files: %w", err)
+		}
+	}
+
+	// like the openstack scheduler, we make sure the exe of the cmd we're
+	// supposed to run exists on the host, copying it over if not
+	exe := strings.Split(cmd, " ")[0]
+
+	exePath, err := exec.LookPath(exe)
+	if err != nil {
+		return fmt.Errorf("could not look for exe [%s]: %w", exe, err)
+	}
+
+	if _, _, err = server.RunCmd(ctx, "test -x "+exePath, false); err != nil {
+		if err = server.UploadFile(ctx, exePath, exePath); err != nil {
+			return fmt.Errorf("could not upload exe [%s]: %w", exePath, err)
+		}
+
+		if _, _, err = server.RunCmd(ctx, "chmod u+x "+exePath, false); err != nil {
+			return err
+		}
+	}
+
+	s.preparedHosts[server.Name] = true
+
+	return nil
+}
+
+// hostAlive tells you if we can currently run commands on the given host over
+// ssh.
+func (s *sshpool) hostAlive(ctx context.Context, server *cloud.Server) bool {
+	ctx, cancel := context.WithTimeout(ctx, sshPoolAliveTimeout)
+	defer cancel()
+
+	_, _, err := server.RunCmd(ctx, "true", false)
+
+	return err == nil
+}
+
+// hostGoneBad marks the given host as bad so that we stop using it, and lets
+// the user know.
+func (s *sshpool) hostGoneBad(ctx context.Context, server *cloud.Server, err error) {
+	if server.IsBad() {
+		return
+	}
+
+	server.GoneBad()
+	s.notifyBadServer(server)
+	clog.Warn(ctx, "host went bad, won't be used until it can be reached again", "host", server.Name, "err", err)
+}
+
+// stateUpdate checks all our hosts can still be reached, marking unreachable
+// ones as bad, and bad ones that can be reached again as good.
+func (s *sshpool) stateUpdate(ctx context.Context) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	// a host the user confirmed dead will have been "destroyed", which for us
+	// only means we stopped using it; replace it so that we can use it again
+	// once it's back
+	s.hostsMutex.Lock()
+	servers := make([]*cloud.Server, 0, len(s.hostNames))
+	for _, name := range s.hostNames {
+		server := s.hosts[name]
+		if server.Destroyed() {
+			replacement := cloud.NewServer(server.UserName, server.IP, s.privateKey)
+			replacement.ID = server.ID
+			replacement.Name = server.Name
+			replacement.Disk = server.Disk
+			replacement.Flavor = server.Flavor
+			replacement.GoneBad()
+			s.hosts[name] = replacement
+			server = replacement
+
+			s.prepMutex.Lock()
+			delete(s.preparedHosts, name)
+			s.prepMutex.Unlock()
+		}
+		servers = append(servers, server)
+	}
+	s.hostsMutex.Unlock()
+
+	if s.updatingState {
+		return
+	}
+	s.updatingState = true
+
+	// stateUpdate must return quickly, but checking on the hosts can take too
+	// long, so we do the rest in a goroutine
+	go func() {
+		defer internal.LogPanic(ctx, "sshpool stateUpdate", true)
+
+		recovered := false
+		for _, server := range servers {
+			if s.cleanedUp() {
+				break
+			}
+
+			alive := s.hostAlive(ctx, server)
+			if server.IsBad() {
+				if alive && server.NotBad() {
+					s.notifyBadServer(server)
+					clog.Debug(ctx, "host became good", "host", server.Name)
+					recovered = true
+				}
+			} else if !alive {
+				s.hostGoneBad(ctx, server, errors.New("could not be reached over ssh"))
+			}
+		}
+
+		s.stateMutex.Lock()
+		s.updatingState = false
+		s.stateMutex.Unlock()
+
+		if recovered {
+			err := s.processQueue(ctx, "host recovered")
+			if err != nil {
+				clog.Error(ctx, "processQueue call after host recovery failed", "err", err)
+			}
+		}
+	}()
+}
+
+// findHost returns our server for the given host name (which may be the host's
+// own idea of its hostname), or nil if it isn't one of our hosts.
+func (s *sshpool) findHost(host string) *cloud.Server {
+	s.hostsMutex.RLock()
+	defer s.hostsMutex.RUnlock()
+
+	if server, exists := s.hosts[host]; exists {
+		return server
+	}
+
+	for _, name := range s.hostNames {
+		if hostMatches(name, host) {
+			return s.hosts[name]
+		}
+	}
+
+	return nil
+}
+
+// recover achieves the aims of Recover(). Here we find the process of the
+// given cmd on the given host, note that its resources are in use, and start
+// monitoring it to know when it exits to release those resources. NB: the
+// process checking only works on hosts with 'ps', such as linux etc.
+func (s *sshpool) recover(ctx context.Context, cmd string, req *Requirements, host *RecoveredHostDetails) error {
+	server := s.findHost(host.Host)
+	if server == nil {
+		clog.Warn(ctx, "recover called for a host not in the pool", "host", host.Host)
+		return nil
+	}
+
+	stdout, _, err := server.RunCmd(ctx, "ps -eo pid=,args=", false)
+	if err != nil {
+		return err
+	}
+
+	cmd = cmdProcessSanitiser.Replace(cmd)
+
+	s.rsMutex.Lock()
+	defer s.rsMutex.Unlock()
+
+	if s.recoveredPids[server.Name] == nil {
+		s.recoveredPids[server.Name] = make(map[int]bool)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	for scanner.Scan() {
+		pidStr, args, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !found || strings.TrimSpace(args) != cmd {
+			continue
+		}
+
+		pid, errc := strconv.Atoi(pidStr)
+		if errc != nil || s.recoveredPids[server.Name][pid] {
+			continue
+		}
+
+		server.Allocate(ctx, req.Cores, req.RAM, req.Disk, req.Resources)
+		s.recoveredPids[server.Name][pid] = true
+
+		go s.monitorRecoveredPid(ctx, server, pid, req)
+
+		return nil
+	}
+
+	clog.Warn(ctx, "recover called for a cmd no longer running on the host", "host", server.Name)
+
+	return nil
+}
+
+// monitorRecoveredPid periodically checks if the given pid is still running on
+// the given host, and when it isn't, releases the given resources.
+func (s *sshpool) monitorRecoveredPid(ctx context.Context, server *cloud.Server, pid int, req *Requirements) {
+	defer internal.LogPanic(ctx, "sshpool recover", true)
+
+	ticker := time.NewTicker(s.stateUpdateFreq)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, _, err := server.RunCmd(ctx, "kill -0 "+strconv.Itoa(pid), false); err == nil {
+				continue
+			}
+
+			server.Release(ctx, req.Cores, req.RAM, req.Disk, req.Resources)
+
+			s.rsMutex.Lock()
+			delete(s.recoveredPids[server.Name], pid)
+			s.rsMutex.Unlock()
+
+			err := s.processQueue(ctx, "sshpool recover")
+			if err != nil {
+				clog.Error(ctx, "processQueue call after recovery failed", "err", err)
+			}
+
+			return
+		case <-s.stopRSMonitoring:
+			return
+		}
+	}
+}
+
+// hostToID returns the name of the host in our pool that corresponds to the
+// given host name, or an empty string if it isn't one of ours.
+func (s *sshpool) hostToID(host string) string {
+	server := s.findHost(host)
+	if server == nil {
+		return ""
+	}
+
+	return server.ID
+}
+
+// getHost returns a cloud.Server for the given host.
+func (s *sshpool) getHost(host string) (Host, bool) {
+	server := s.findHost(host)
+	if server == nil {
+		return nil, false
+	}
+
+	return server, true
+}
+
+// setMessageCallBack sets the given callback.
+func (s *sshpool) setMessageCallBack(ctx context.Context, cb MessageCallBack) {
+	s.cbmutex.Lock()
+	defer s.cbmutex.Unlock()
+	s.msgCB = cb
+}
+
+// notifyMessage calls the message callback with the given message in a
+// goroutine, if that callback has been set.
+func (s *sshpool) notifyMessage(msg string) {
+	s.cbmutex.RLock()
+	defer s.cbmutex.RUnlock()
+	if s.msgCB != nil {
+		go s.msgCB(msg)
+	}
+}
+
+// setBadServerCallBack sets the given callback.
+func (s *sshpool) setBadServerCallBack(ctx context.Context, cb BadServerCallBack) {
+	s.cbmutex.Lock()
+	defer s.cbmutex.Unlock()
+	s.badServerCB = cb
+}
+
+// notifyBadServer calls the bad server callback with the given server in a
+// goroutine, if that callback has been set.
+func (s *sshpool) notifyBadServer(server *cloud.Server) {
+	s.cbmutex.RLock()
+	defer s.cbmutex.RUnlock()
+	if s.badServerCB != nil {
+		go s.badServerCB(server)
+	}
+}
+
+// cleanup destroys our internal queue and stops monitoring recovered cmds. The
+// hosts themselves are left alone.
+func (s *sshpool) cleanup(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	s.stopAutoProcessing()
+	s.cleanMutex.Lock()
+	defer s.cleanMutex.Unlock()
+	close(s.stopRSMonitoring)
+	s.cleaned = true
+	err := s.queue.Destroy()
+	if err != nil {
+		clog.Warn(ctx, "sshpool scheduler cleanup failed", "err", err)
+	}
+}
@@ -68,11 +68,20 @@ const (
 	ErrBadRequest       = "bad request (missing arguments?)"
 	ErrBadJob           = "bad job (not in queue or correct sub-queue)"
 	ErrMissingJob       = "corresponding job not found"
+	ErrMissingFile      = "corresponding file not found"
+	ErrMissingCron      = "corresponding cron not found"
+	ErrCronExists       = "a cron with that name already exists"
+	ErrMissingUser      = "corresponding user not found"
+	ErrUserExists       = "a user with that name already exists"
+	ErrNotAdmin         = "permission denied: only admin users can do that"
+	ErrNotOwner         = "permission denied: you do not own that job"
+	ErrNoFairShare      = "fair-share scheduling is not enabled"
 	ErrUnknown          = "unknown error"
 	ErrClosedInt        = "queues closed due to SIGINT"
 	ErrClosedTerm       = "queues closed due to SIGTERM"
 	ErrClosedCert       = "queues closed due to certificate expiry"
 	ErrClosedStop       = "queues closed due to manual Stop()"
+	ErrClosedFenced     = "queues closed because a standby server took over"
 	ErrQueueClosed      = "queue closed"
 	ErrNoHost           = "could not determine the non-loopback ip address of this host"
 	ErrNoServer         = "could not reach the server"
@@ -82,6 +91,8 @@ const (
 	ErrPermissionDenied = "bad token: permission denied"
 	ErrBeingDrained     = "server is being drained"
 	ErrStopReserving    = "recovered on a new server; you should stop reserving"
+	ErrStandbyNoToken   = "standby stopped because the token file was deleted"
+	ErrFenced           = "server was taken over by a standby server"
 	ServerModeNormal    = "started"
 	ServerModePause     = "paused"
 	ServerModeDrain     = "draining"
@@ -105,6 +116,13 @@ var (
 	ServerMaximumRunForResourceRecommendation       = 100
 	ServerMinimumScheduledForResourceRecommendation = 10
 	ServerLogClientErrors                           = true
+	ServerWebhookRetries                            = 5
+	ServerWebhookRetryWait                          = 1 * time.Second
+	ServerWebhookTimeout                            = 10 * time.Second
+	ServerCronCheckInterval                         = 1 * time.Second
+	ServerRetentionCheckInterval                    = 1 * time.Hour
+	ServerFairShareInterval                         = 30 * time.Second
+	ServerArrayWindow                               = 1000
 	serverShutdownRunnerTickerTime                  = 50 * time.Millisecond
 
 	// httpServerShutdownTime is the time we'll wait before forcing
@@ -144,8 +162,22 @@ type serverResponse struct {
 	SInfo       *ServerInfo
 	SStats      *ServerStats
 	DB          []byte
+	File        []byte // compressed bytes of file content
 	Path        string
 	BadServers  []*BadServer
+	Events      []*JobEvent
+	EventSeq    uint64
+	DBVersion   dbVersion
+	DBChanges   []*dbChange
+	DBMore      bool
+	DBSize      int64 // size of the snapshot a standby must download
+	LogChunks   []*LogChunk
+	LogsLive    bool
+	Crons       []*CronJob
+	Cursor      string
+	Users       []*User
+	FairShare   []*FairShareAccount
+	Standby     string
 }
 
 // ServerInfo holds basic addressing info about the server.
@@ -158,6 +190,8 @@ type ServerInfo struct {
 	Deployment string // deployment the server is running under
 	Scheduler  string // the name of the scheduler that jobs are being submitted to
 	Mode       string // ServerModeNormal if the server is running normally, or ServerModeDrain|Paused if draining or paused
+	Standby    string // ip:port of the standby server that will take over if this one dies, if any
+	Term       uint64 // fencing token, incremented each time a standby server takes over
 }
 
 // ServerVersions holds the server version (git tag) and API version supported.
@@ -287,6 +321,8 @@ func (s *sgroup) hasSkips() bool {
 type Server struct {
 	token                     []byte
 	uploadDir                 string
+	copyDir                   string
+	archiveDir                string
 	sock                      mangos.Socket
 	ch                        codec.Handle
 	rc                        string // runner command string compatible with fmt.Sprintf(..., schedulerGroup, deployment, serverAddr, reserveTimeout, maxMinsAllowed)
@@ -306,6 +342,13 @@ type Server struct {
 	statusCaster              *bcast.Group
 	badServerCaster           *bcast.Group
 	schedCaster               *bcast.Group
+	events                    *jobEvents
+	logs                      *jobLogs
+	crons                     *cronJobs
+	arrays                    *jobArrays
+	users                     *serverUsers
+	retention                 *retention
+	fairShare                 *fairShare
 	racCheckTimer             *time.Timer
 	pauseRequests             int
 	wsconns                   map[string]*websocket.Conn
@@ -368,6 +411,11 @@ type ServerConfig struct {
 	// Absolute path to where the database file should be backed up to.
 	DBFileBackup string
 
+	// DBBackend is the storage backend used for DBFile (and its backup): one of
+	// the DBBackend* values. The default of empty string means DBBackendBolt.
+	// Use MigrateDB() to switch an existing bolt database to SQLite.
+	DBBackend string
+
 	// Absolute path to where the server will store the authorization token
 	// needed by clients to communicate with the server. Storing it in a file
 	// could make using any CLI clients more convenient. The file will be
@@ -433,6 +481,42 @@ type ServerConfig struct {
 	// uploaded. Defaults to /tmp.
 	UploadDir string
 
+	// CopyDir is the directory where files copied to the Server by jobs with
+	// the CopyToManager behaviour will be stored, in a unique sub-directory
+	// per job. Defaults to a directory called "copied" inside UploadDir.
+	CopyDir string
+
+	// JobLogDir is the directory where the output that runners stream to the
+	// Server (see Client.StreamLogs()) will be persisted, in a file per job
+	// per stream, so that it can still be retrieved after the jobs stop
+	// running. Defaults to a directory called "joblogs" inside UploadDir.
+	JobLogDir string
+
+	// JobLogMaxSize is the maximum number of bytes of each stream (STDOUT and
+	// STDERR) of each job that will be persisted to JobLogDir. Defaults to 0,
+	// meaning streamed output is not persisted at all.
+	JobLogMaxSize int64
+
+	// Webhooks are URLs that will be sent JobEvents as jobs change state.
+	// Optional.
+	Webhooks []*Webhook
+
+	// Retention are the policies that determine when complete Jobs are moved
+	// out of the database and in to archive files. Optional; by default
+	// complete Jobs are kept in the database forever.
+	Retention []*RetentionPolicy
+
+	// ArchiveDir is the directory where complete Jobs that expire according to
+	// Retention will be archived. Defaults to a directory called "archive" in
+	// the same directory as DBFile.
+	ArchiveDir string
+
+	// FairShare is the policy that determines the order that Jobs of equal
+	// priority run in, based on how much of their share of resources their
+	// owners have recently used. Optional; by default Jobs of equal priority
+	// run in the order they were added.
+	FairShare *FairSharePolicy
+
 	// Logger is a logger object that will be used to log uncaught errors and
 	// debug statements. "Uncought" errors are all errors generated during
 	// operation that either shouldn't affect the success of operations, and can
@@ -449,6 +533,10 @@ type ServerConfig struct {
 	// If this is unset, nothing is logged (defaults to a logger using a
 	// log15.DiscardHandler()).
 	Logger log15.Logger
+
+	// takingOver is set by Standby() so that we increment the fencing term
+	// stored in the database before we start listening.
+	takingOver bool
 }
 
 // Serve is for use by a server executable and makes it start listening on
@@ -523,7 +611,7 @@ func Serve(ctx context.Context, config ServerConfig) (s *Server, msg string, tok
 	}
 
 	// we need to persist stuff to disk, and we do so using boltdb
-	db, msg, err := initDB(ctx, config.DBFile, config.DBFileBackup, config.Deployment)
+	db, msg, err := initDB(ctx, config.DBFile, config.DBFileBackup, config.Deployment, config.DBBackend)
 	if certMsg != "" {
 		if msg == "" {
 			msg = certMsg
@@ -543,6 +631,17 @@ func Serve(ctx context.Context, config ServerConfig) (s *Server, msg string, tok
 		}
 	}()
 
+	// our term is our fencing token: a standby that takes over from us
+	// increments it, and a server that hears of a higher term than its own
+	// stops, since it must have been taken over from
+	term, err := db.retrieveMeta(dbMetaTerm)
+	if err == nil && config.takingOver {
+		term, err = db.incrementMeta(dbMetaTerm)
+	}
+	if err != nil {
+		return s, msg, token, err
+	}
+
 	sock, err := rep.NewSocket()
 	if err != nil {
 		return s, msg, token, err
@@ -655,14 +754,31 @@ func Serve(ctx context.Context, config ServerConfig) (s *Server, msg string, tok
 		uploadDir = "/tmp"
 	}
 
+	copyDir := config.CopyDir
+	if copyDir == "" {
+		copyDir = filepath.Join(uploadDir, "copied")
+	}
+
+	jobLogDir := config.JobLogDir
+	if jobLogDir == "" {
+		jobLogDir = filepath.Join(uploadDir, "joblogs")
+	}
+
+	archiveDir := config.ArchiveDir
+	if archiveDir == "" {
+		archiveDir = filepath.Join(filepath.Dir(config.DBFile), "archive")
+	}
+
 	// our limiter will use a callback that gets group limits from our database
 	l := limiter.New(db.retrieveLimitGroup)
 
 	s = &Server{
-		ServerInfo:                &ServerInfo{Addr: ip + ":" + config.Port, Host: certDomain, Port: config.Port, WebPort: config.WebPort, PID: os.Getpid(), Deployment: config.Deployment, Scheduler: config.SchedulerName, Mode: ServerModeNormal},
+		ServerInfo:                &ServerInfo{Addr: ip + ":" + config.Port, Host: certDomain, Port: config.Port, WebPort: config.WebPort, PID: os.Getpid(), Deployment: config.Deployment, Scheduler: config.SchedulerName, Mode: ServerModeNormal, Term: term},
 		ServerVersions:            &ServerVersions{Version: ServerVersion, API: restAPIVersion},
 		token:                     token,
 		uploadDir:                 uploadDir,
+		copyDir:                   copyDir,
+		archiveDir:                archiveDir,
 		sock:                      sock,
 		ch:                        new(codec.BincHandle),
 		rpl:                       &rgToKeys{lookup: make(map[string]map[string]bool)},
@@ -681,8 +797,11 @@ func Serve(ctx context.Context, config ServerConfig) (s *Server, msg string, tok
 		badServerCaster:           bcast.NewGroup(),
 		badServers:                make(map[string]*cloud.Server),
 		schedCaster:               bcast.NewGroup(),
+		events:                    newJobEvents(),
+		logs:                      newJobLogs(jobLogDir, config.JobLogMaxSize),
 		schedIssues:               make(map[string]*schedulerIssue),
 		recoveredRunningJobs:      make(map[string]bool),
+		fairShare:                 newFairShare(config.FairShare),
 	}
 
 	// if we're restarting from a state where there were incomplete jobs, we
@@ -705,14 +824,15 @@ func Serve(ctx context.Context, config ServerConfig) (s *Server, msg string, tok
 		}
 
 		var itemdefs []*queue.ItemDef
+		var itemdeps [][]queue.Dependency
 		for _, job := range priorJobs {
-			var deps []string
+			var deps []queue.Dependency
 			deps, err = job.Dependencies.incompleteJobKeys(s.db)
 			if err != nil {
 				return nil, msg, token, err
 			}
 
-			itemdef := &queue.ItemDef{Key: job.Key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: 0 * time.Second, TTR: ServerItemTTR, Dependencies: deps}
+			itemdef := &queue.ItemDef{Key: job.Key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: 0 * time.Second, TTR: ServerItemTTR}
 
 			switch job.State {
 			case JobStateRunning:
@@ -737,14 +857,41 @@ func Serve(ctx context.Context, config ServerConfig) (s *Server, msg string, tok
 			}
 
 			itemdefs = append(itemdefs, itemdef)
+			itemdeps = append(itemdeps, deps)
 		}
 
-		_, _, err = s.enqueueItems(ctx, itemdefs)
+		_, _, err = s.enqueueItems(ctx, itemdefs, itemdeps)
 		if err != nil {
 			return nil, msg, token, err
 		}
+
+		s.handleCompleteFailureDependencies(ctx, priorJobs)
+	}
+
+	// load the named users that can authenticate with their own tokens
+	err = s.loadUsers(ctx)
+	if err != nil {
+		return nil, msg, token, err
+	}
+
+	// carry on adding the elements of any job arrays
+	err = s.loadJobArrays(ctx)
+	if err != nil {
+		return nil, msg, token, err
 	}
 
+	// start adding the jobs of any recurring cron jobs
+	err = s.startCronJobs(ctx)
+	if err != nil {
+		return nil, msg, token, err
+	}
+
+	// start archiving expired complete jobs
+	s.startRetention(ctx, config.Retention)
+
+	// start recalculating fair-share factors
+	s.startFairShare(ctx)
+
 	// wait for signal or s.Stop() and call s.shutdown(). (We don't use the
 	// waitgroup here since we call shutdown, which waits on the group)
 	certExpired := time.After(time.Until(expiry))
@@ -790,8 +937,18 @@ func Serve(ctx context.Context, config ServerConfig) (s *Server, msg string, tok
 		mux.HandleFunc(restWarningsEndpoint, restWarnings(ctx, s))
 		mux.HandleFunc(restBadServersEndpoint, restBadServers(ctx, s))
 		mux.HandleFunc(restFileUploadEndpoint, restFileUpload(ctx, s))
+		mux.HandleFunc(restCopiedEndpoint, restCopied(ctx, s))
 		mux.HandleFunc(restInfoEndpoint, restInfo(ctx, s))
 		mux.HandleFunc(restVersionEndpoint, restVersion(ctx, s))
+		mux.HandleFunc(restEventsEndpoint, restEvents(ctx, s))
+		mux.HandleFunc(restLogsEndpoint, restLogs(ctx, s))
+		mux.HandleFunc(restCronsEndpoint, restCrons(ctx, s))
+		mux.HandleFunc(restUsersEndpoint, restUsers(ctx, s))
+		mux.HandleFunc(restLimitsEndpoint, restLimits(ctx, s))
+		mux.HandleFunc(restManagerEndpoint, restManager(ctx, s))
+		mux.HandleFunc(restBackupEndpoint, restBackup(ctx, s))
+		mux.HandleFunc(restOpenAPIEndpoint, restOpenAPI(ctx))
+		mux.HandleFunc(metricsEndpoint, webMetrics(ctx, s))
 		srv := &http.Server{Addr: httpAddr, Handler: mux}
 		wgk2 := wg.Add(1)
 		go func() {
@@ -823,6 +980,14 @@ func Serve(ctx context.Context, config ServerConfig) (s *Server, msg string, tok
 			s.schedCaster.Broadcasting(0)
 		}()
 
+		for _, hook := range config.Webhooks {
+			wgk6 := wg.Add(1)
+			go func(hook *Webhook) {
+				defer wg.Done(wgk6)
+				s.runWebhook(ctx, hook)
+			}(hook)
+		}
+
 		badServerCB := func(server *cloud.Server) {
 			s.bsmutex.Lock()
 			skip := false
@@ -983,6 +1148,14 @@ func (s *Server) Stop(ctx context.Context, wait ...bool) {
 	s.shutdown(ctx, ErrClosedStop, len(wait) == 1 && wait[0], true)
 }
 
+// fence stops us because a standby server took over from us. Unlike Stop(), we
+// don't kill our runners or clean up the resources they're running on, since
+// they now belong to the standby, which they'll reconnect to.
+func (s *Server) fence(ctx context.Context) {
+	clog.Warn(ctx, "a standby server took over from us; stopping")
+	s.shutdown(ctx, ErrClosedFenced, false, true)
+}
+
 // Drain will stop the server spawning new runners and stop Reserve*() from
 // returning any more Jobs. Once all current runners exit, we Stop().
 func (s *Server) Drain(ctx context.Context) error {
@@ -1039,6 +1212,32 @@ func (s *Server) Pause() (bool, error) {
 	return s.pauseRequests == 1, nil
 }
 
+// requestPause is like Pause(), but is for handling pause requests from clients.
+// Clients are allowed to request a pause as many times as they like, but a
+// single resume request later should work, so this keeps the internal pause
+// counter at 1.
+func (s *Server) requestPause(ctx context.Context) error {
+	paused, err := s.Pause()
+	if err != nil {
+		return err
+	}
+
+	if paused {
+		clog.Info(ctx, "paused by request")
+
+		return nil
+	}
+
+	resumed, err := s.Resume(ctx)
+	if err != nil {
+		clog.Error(ctx, "resume following an extraneous pause failed", "error", err)
+	} else if resumed {
+		clog.Error(ctx, "resumed incorrectly succeeded following a pause that did not")
+	}
+
+	return nil
+}
+
 // Resume undoes Pause(). Does not return an error if we were not paused.
 // If multiple pauses have been requested at once, actually does nothing until
 // the number of resume requests matches the number of pauses.
@@ -1210,12 +1409,149 @@ func (s *Server) uploadFile(ctx context.Context, source io.Reader, savePath stri
 	return savePath, nil
 }
 
+// copiedFilePath returns the absolute path on the machine where the server
+// process is running that a file copied by the job with the given key (via the
+// CopyToManager behaviour) will be stored at. relPath must be the path of the
+// file relative to the job's actual working directory, and may not reach
+// outside of it.
+func (s *Server) copiedFilePath(jobKey, relPath string) (string, error) {
+	if len(jobKey) != 32 || strings.ContainsAny(jobKey, "./") {
+		return "", fmt.Errorf("invalid job key %s", jobKey)
+	}
+
+	relPath = filepath.Clean(relPath)
+	if relPath == "." || filepath.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", fmt.Errorf("invalid copied file path %s", relPath)
+	}
+
+	dir, leaf := calculateHashedDir(s.copyDir, jobKey)
+
+	return filepath.Join(dir, leaf, relPath), nil
+}
+
+// storeCopiedFile stores the given file data sent by the job with the given
+// key (via the CopyToManager behaviour) under a directory unique to that job,
+// at the path returned by copiedFilePath(). Any existing file at that path
+// (copied during a previous attempt at running the job) is overwritten.
+//
+// Files stored will only be readable by the user that started the server.
+func (s *Server) storeCopiedFile(ctx context.Context, jobKey, relPath string, source io.Reader) error {
+	savePath, err := s.copiedFilePath(jobKey, relPath)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(savePath), os.ModePerm)
+	if err != nil {
+		clog.Error(ctx, "storeCopiedFile create directory error", "err", err)
+		return err
+	}
+
+	file, err := os.OpenFile(savePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		clog.Error(ctx, "storeCopiedFile create file error", "err", err)
+		return err
+	}
+
+	_, err = io.Copy(file, source)
+	if err != nil {
+		clog.Error(ctx, "storeCopiedFile store file error", "err", err)
+		errc := file.Close()
+		if errc != nil {
+			clog.Warn(ctx, "storeCopiedFile close file error", "err", errc)
+		}
+		return err
+	}
+
+	return file.Close()
+}
+
+// readCopiedFile returns the content of a file previously stored with
+// storeCopiedFile(). If no such file was stored, the returned error will
+// satisfy os.IsNotExist().
+func (s *Server) readCopiedFile(jobKey, relPath string) ([]byte, error) {
+	path, err := s.copiedFilePath(jobKey, relPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(path)
+}
+
+// checkpointFilePath returns the absolute path on the machine where the server
+// process is running that the checkpoint of the job with the given key will be
+// stored at.
+func (s *Server) checkpointFilePath(jobKey string) (string, error) {
+	if len(jobKey) != 32 || strings.ContainsAny(jobKey, "./") {
+		return "", fmt.Errorf("invalid job key %s", jobKey)
+	}
+
+	dir, leaf := calculateHashedDir(s.copyDir, jobKey)
+
+	return filepath.Join(dir, leaf+checkpointFileSuffix), nil
+}
+
+// storeCheckpoint stores the given compressed archive of the Checkpoint Dir of
+// the job with the given key, replacing any previously stored checkpoint.
+//
+// Files stored will only be readable by the user that started the server.
+func (s *Server) storeCheckpoint(ctx context.Context, jobKey string, archive []byte) error {
+	savePath, err := s.checkpointFilePath(jobKey)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(savePath), os.ModePerm)
+	if err != nil {
+		clog.Error(ctx, "storeCheckpoint create directory error", "err", err)
+		return err
+	}
+
+	err = os.WriteFile(savePath, archive, 0o600)
+	if err != nil {
+		clog.Error(ctx, "storeCheckpoint store file error", "err", err)
+	}
+
+	return err
+}
+
+// readCheckpoint returns the archive previously stored with storeCheckpoint().
+// If none was stored, the returned error will satisfy os.IsNotExist().
+func (s *Server) readCheckpoint(jobKey string) ([]byte, error) {
+	path, err := s.checkpointFilePath(jobKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(path)
+}
+
+// removeCheckpoint deletes any archive previously stored with
+// storeCheckpoint(), for when it is no longer needed.
+func (s *Server) removeCheckpoint(ctx context.Context, jobKey string) {
+	path, err := s.checkpointFilePath(jobKey)
+	if err != nil {
+		return
+	}
+
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		clog.Warn(ctx, "removeCheckpoint failed", "err", err)
+	}
+}
+
 // createQueue creates and stores a queue.Queue on the Server and sets up its
 // callbacks.
 func (s *Server) createQueue(ctx context.Context) {
 	q := queue.New(ctx, "cmds")
 	s.q = q
 
+	// when fair-share scheduling is enabled, ready jobs are reserved fairly
+	// between the accounts they belong to
+	q.SetAccountCallback(func(data interface{}) string {
+		return s.fairShare.account(data.(*Job))
+	})
+
 	// we set a callback for things entering this queue's ready sub-queue.
 	// This function will be called in a go routine and receives a slice of
 	// all the ready jobs. Based on the requirements, we add to each job a
@@ -1437,8 +1773,8 @@ func (s *Server) createQueue(ctx context.Context) {
 
 				group.count++
 
-				if job.Priority > group.priority {
-					group.priority = job.Priority
+				if priority := s.fairShare.schedulerPriority(job); priority > group.priority {
+					group.priority = priority
 				}
 			}
 		}
@@ -1627,6 +1963,23 @@ func (s *Server) createQueue(ctx context.Context) {
 				s.statusCaster.Send(&jstateCount{group, JobStateLost, to, count})
 			}
 		}
+
+		s.publishJobEvents(data, from, to)
+
+		// jobs that stopped running won't stream any more output
+		if from == JobStateRunning {
+			for _, inter := range data {
+				s.logs.finish(ctx, inter.(*Job).Key())
+			}
+		}
+
+		// jobs that just got buried or completed may mean that the
+		// dependencies of other jobs can now never be satisfied
+		if to == JobStateBuried || to == JobStateComplete {
+			for _, inter := range data {
+				s.handleUnsatisfiableDependents(ctx, inter.(*Job), to == JobStateBuried)
+			}
+		}
 	})
 
 	// we set a callback for running items that hit their ttr because the
@@ -1676,6 +2029,7 @@ func (s *Server) createQueue(ctx context.Context) {
 			// transition from running to lost state
 			defer s.statusCaster.Send(&jstateCount{"+all+", JobStateRunning, JobStateLost, 1})
 			defer s.statusCaster.Send(&jstateCount{job.RepGroup, JobStateRunning, JobStateLost, 1})
+			defer s.events.publish(newJobEvent(job, JobStateRunning, JobStateLost))
 
 			return queue.SubQueueRun
 		}
@@ -1687,11 +2041,12 @@ func (s *Server) createQueue(ctx context.Context) {
 }
 
 // enqueueItems adds new items to a queue, for when we have new jobs to handle.
-func (s *Server) enqueueItems(ctx context.Context, itemdefs []*queue.ItemDef) (added, dups int, err error) {
+// deps[i] are the dependencies of itemdefs[i].
+func (s *Server) enqueueItems(ctx context.Context, itemdefs []*queue.ItemDef, deps [][]queue.Dependency) (added, dups int, err error) {
 	s.rpmutex.Lock()
 	s.racPending = true
 	s.rpmutex.Unlock()
-	added, dups, err = s.q.AddMany(ctx, itemdefs)
+	added, dups, err = s.q.AddManyWithDependencies(ctx, itemdefs, deps)
 	if err != nil {
 		s.rpmutex.Lock()
 		s.racPending = false
@@ -1721,6 +2076,12 @@ func (s *Server) createJobs(ctx context.Context, inputJobs []*Job, envkey string
 	rcSet := s.rc != ""
 	s.racmutex.RUnlock()
 
+	for _, job := range inputJobs {
+		if err := job.validateDepGroups(); err != nil {
+			return added, dups, alreadyComplete, ErrBadRequest, err
+		}
+	}
+
 	// create itemdefs for the jobs
 	limitGroups := make(map[string]*limiter.GroupData)
 	for _, job := range inputJobs {
@@ -1730,8 +2091,8 @@ func (s *Server) createJobs(ctx context.Context, inputJobs []*Job, envkey string
 		if rcSet {
 			job.schedulerGroup = job.generateSchedulerGroup(job.Requirements)
 		}
-		if job.BsubMode != "" {
-			job.BsubID = atomic.AddUint64(&BsubID, 1)
+		if job.BsubMode != "" && job.BsubID == 0 {
+			s.assignBsubID(job)
 		}
 
 		if len(job.LimitGroups) > 0 {
@@ -1767,6 +2128,7 @@ func (s *Server) createJobs(ctx context.Context, inputJobs []*Job, envkey string
 		// previously Archive()d jobs that were resurrected because of one of
 		// their DepGroup dependencies being in cr.Jobs
 		var itemdefs []*queue.ItemDef
+		var itemdeps [][]queue.Dependency
 		for _, job := range jobsToQueue {
 			deps, err := job.Dependencies.incompleteJobKeys(s.db)
 			if err != nil {
@@ -1774,7 +2136,8 @@ func (s *Server) createJobs(ctx context.Context, inputJobs []*Job, envkey string
 				qerr = err
 				break
 			}
-			itemdefs = append(itemdefs, &queue.ItemDef{Key: job.Key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: 0 * time.Second, TTR: ServerItemTTR, Dependencies: deps})
+			itemdefs = append(itemdefs, &queue.ItemDef{Key: job.Key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: 0 * time.Second, TTR: ServerItemTTR})
+			itemdeps = append(itemdeps, deps)
 		}
 
 		srerr, qerr = s.updateJobDependencies(ctx, jobsToUpdate)
@@ -1783,15 +2146,27 @@ func (s *Server) createJobs(ctx context.Context, inputJobs []*Job, envkey string
 			srerr = ErrInternalError
 		} else {
 			// add the jobs to the in-memory job queue
-			added, dups, qerr = s.enqueueItems(ctx, itemdefs)
+			added, dups, qerr = s.enqueueItems(ctx, itemdefs, itemdeps)
 			if qerr != nil {
 				srerr = ErrInternalError
+			} else {
+				s.handleCompleteFailureDependencies(ctx, append(jobsToQueue, jobsToUpdate...))
 			}
 		}
 	}
 	return added, dups, alreadyComplete, srerr, qerr
 }
 
+// assignBsubID gives a job added in BsubMode a new BsubID, and puts it in the
+// corresponding dependency group so that other bsub jobs can depend on it by
+// id. All the elements of a job array share the same BsubID, like they would in
+// LSF, by being given the BsubID of the array's template. You should hold the
+// lock on the Job before calling this.
+func (s *Server) assignBsubID(job *Job) {
+	job.BsubID = atomic.AddUint64(&BsubID, 1)
+	job.DepGroups = append(job.DepGroups, BsubIDDepGroup(job.BsubID))
+}
+
 // handleUserSpecifiedJobLimitGroups takes limit groups on a job that may have
 // been specified like name:limit, and fixes them to remove the limit suffix,
 // dedup and sort the groups, and fill in your supplied limitGroups map with the
@@ -1847,7 +2222,7 @@ func (s *Server) updateJobDependencies(ctx context.Context, jobs []*Job) (srerr
 			break
 		}
 
-		thisErr := s.q.Update(ctx, job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, ServerItemTTR, deps)
+		thisErr := s.q.UpdateWithDependencies(ctx, job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, ServerItemTTR, deps)
 		if thisErr != nil {
 			qerr = thisErr
 			break
@@ -1946,7 +2321,7 @@ func (s *Server) releaseJob(ctx context.Context, job *Job, endState *JobEndState
 				return nil
 			}
 		} else {
-			errq = s.q.Bury(key)
+			errq = s.q.BuryRunning(ctx, key)
 			if errq == nil {
 				s.deleteJobIfRequested(ctx, job)
 			}
@@ -1964,6 +2339,7 @@ func (s *Server) releaseJob(ctx context.Context, job *Job, endState *JobEndState
 	}
 
 	job.updateAfterExit(endState, s.limiter)
+	s.fairShare.record(job)
 
 	job.Lock()
 	if forceBury {
@@ -1982,6 +2358,14 @@ func (s *Server) releaseJob(ctx context.Context, job *Job, endState *JobEndState
 	} else {
 		job.State = JobStateDelayed
 		msg = "released job"
+
+		// if desired, make sure we retry on a different host; the scheduler
+		// group will change accordingly when the job next becomes ready
+		if job.RetryPolicy != nil && job.RetryPolicy.DifferentHost && job.Host != "" {
+			if req := avoidHost(job.Requirements, job.Host); req != nil {
+				job.Requirements = req
+			}
+		}
 	}
 	job.FailReason = failReason
 	job.Unlock()
@@ -2048,6 +2432,7 @@ func (s *Server) killJob(ctx context.Context, jobkey string) (bool, error) {
 // time (in any order). Returns the keys of jobs actually deleted.
 func (s *Server) deleteJobs(ctx context.Context, jobs []*Job) []string {
 	var deleted []string
+	var deletedJobs []*Job
 	for {
 		var skippedDeps []*Job
 		var toDelete []string
@@ -2070,6 +2455,7 @@ func (s *Server) deleteJobs(ctx context.Context, jobs []*Job) []string {
 			err = s.q.Remove(ctx, jobkey)
 			if err == nil {
 				deleted = append(deleted, jobkey)
+				deletedJobs = append(deletedJobs, job)
 				toDelete = append(toDelete, jobkey)
 
 				schedGroups[job.getSchedulerGroup()]++
@@ -2108,6 +2494,8 @@ func (s *Server) deleteJobs(ctx context.Context, jobs []*Job) []string {
 		break
 	}
 
+	s.jobArrayElementsDeleted(ctx, deletedJobs)
+
 	return deleted
 }
 
@@ -2119,6 +2507,148 @@ func (s *Server) deleteJobIfRequested(ctx context.Context, job *Job) {
 	}
 }
 
+// handleUnsatisfiableDependents carries out the OnDepFailure action of jobs
+// with a dependency on the given job that can now never be satisfied, because
+// the given job was just buried (or completed, if buried is false).
+func (s *Server) handleUnsatisfiableDependents(ctx context.Context, job *Job, buried bool) {
+	job.RLock()
+	key := job.Key()
+	state := job.State
+	job.RUnlock()
+
+	if buried {
+		// make sure it wasn't kicked in the meantime
+		item, err := s.q.Get(key)
+		if err != nil || item.Stats().State != queue.ItemStateBury {
+			return
+		}
+	} else if state != JobStateComplete {
+		return
+	}
+
+	items, err := s.q.Dependents(key)
+	if err != nil {
+		clog.Warn(ctx, "failed to get dependent jobs", "err", err)
+		return
+	}
+
+	var toDelete []*Job
+	for _, item := range items {
+		if item.Stats().State != queue.ItemStateDependent {
+			continue
+		}
+
+		dependent := item.Data().(*Job)
+		dependent.RLock()
+		action := dependent.OnDepFailure
+		dependent.RUnlock()
+
+		switch action {
+		case DepFailureBury:
+			s.buryDependentJob(ctx, dependent)
+		case DepFailureDelete:
+			toDelete = append(toDelete, dependent)
+		}
+	}
+
+	if len(toDelete) > 0 {
+		deleted := s.deleteJobs(ctx, s.withDependentJobs(toDelete))
+		clog.Debug(ctx, "deleted jobs with unsatisfiable dependencies", "count", len(deleted))
+	}
+}
+
+// handleCompleteFailureDependencies carries out the OnDepFailure action of the
+// given jobs if they have a DepModeFailure dependency on a job that has already
+// completed, since such a dependency can never be satisfied. Call this once the
+// jobs are in the queue.
+func (s *Server) handleCompleteFailureDependencies(ctx context.Context, jobs []*Job) {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, job := range jobs {
+		job.RLock()
+		deps := job.Dependencies
+		job.RUnlock()
+
+		depKeys, err := deps.completeJobKeys(s.db)
+		if err != nil {
+			clog.Warn(ctx, "failed to get complete dependencies", "err", err)
+			continue
+		}
+
+		for _, key := range depKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	completeJobs, err := s.db.retrieveCompleteJobsByKeys(keys)
+	if err != nil {
+		clog.Warn(ctx, "failed to get complete jobs", "err", err)
+		return
+	}
+
+	for _, job := range completeJobs {
+		s.handleUnsatisfiableDependents(ctx, job, false)
+	}
+}
+
+// buryDependentJob buries a job in the dependent state, because its
+// dependencies can never be satisfied.
+func (s *Server) buryDependentJob(ctx context.Context, job *Job) {
+	job.Lock()
+	err := s.q.BuryDependent(ctx, job.Key())
+	if err == nil {
+		job.State = JobStateBuried
+		job.FailReason = FailReasonDeps
+		job.UntilBuried = 0
+	}
+	job.Unlock()
+
+	if err != nil {
+		clog.Warn(ctx, "failed to bury a job with unsatisfiable dependencies", "err", err)
+		return
+	}
+
+	clog.Debug(ctx, "buried job with unsatisfiable dependencies", "cmd", job.Cmd)
+	s.db.updateJobAfterChange(ctx, job)
+}
+
+// withDependentJobs returns the given jobs along with all the jobs in the queue
+// that depend on them, recursively.
+func (s *Server) withDependentJobs(jobs []*Job) []*Job {
+	seen := make(map[string]bool)
+	all := make([]*Job, 0, len(jobs))
+	for len(jobs) > 0 {
+		job := jobs[0]
+		jobs = jobs[1:]
+
+		job.RLock()
+		key := job.Key()
+		job.RUnlock()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		all = append(all, job)
+
+		items, err := s.q.Dependents(key)
+		if err != nil {
+			continue
+		}
+		for _, item := range items {
+			jobs = append(jobs, item.Data().(*Job))
+		}
+	}
+
+	return all
+}
+
 // killJobsOnServers kills running and confirms lost jobs that were running on
 // hosts with the given IDs. Returns the affected jobs.
 func (s *Server) killJobsOnServers(ctx context.Context, serverIDs map[string]bool) []*Job {
@@ -2181,6 +2711,158 @@ func (s *Server) kickJobs(ctx context.Context, jobs []*Job) (kicked int) {
 	return kicked
 }
 
+// modifyJobs modifies the incomplete, non-running Jobs with the given keys
+// according to the given JobModifier, updating the queue and database. Returns
+// a REVERSE mapping of new to old Job keys for the Jobs that were modified. On
+// error, the string return value is one of our Err* constants.
+func (s *Server) modifyJobs(ctx context.Context, keys []string, modifier *JobModifier) (map[string]string, string, error) {
+	err := validateDepGroups(modifier.DepGroups)
+	if err == nil {
+		err = validateDepGroups(modifier.Dependencies.DepGroups())
+	}
+	if err != nil {
+		return nil, ErrBadRequest, err
+	}
+
+	// to avoid race conditions with jobs that are currently pending, but become
+	// running in the middle of us trying to modify them, we first pause the
+	// server, and resume it afterwards
+	paused, err := s.Pause()
+	if err != nil {
+		return nil, serverErrString(err), err
+	}
+	if paused {
+		clog.Debug(ctx, "modify requested, paused server")
+	} else {
+		clog.Debug(ctx, "modify requested")
+	}
+
+	modified, serr, err := s.modifyQueuedJobs(ctx, keys, modifier)
+
+	// now resume the server again
+	resumed, errr := s.Resume(ctx)
+	if errr != nil {
+		clog.Error(ctx, errr.Error())
+	} else if resumed {
+		clog.Debug(ctx, "modify completed, resumed server", "count", len(modified))
+	} else {
+		clog.Debug(ctx, "modify completed", "count", len(modified))
+	}
+
+	return modified, serr, err
+}
+
+// modifyQueuedJobs does the work of modifyJobs() while the server is paused.
+func (s *Server) modifyQueuedJobs(ctx context.Context, keys []string, modifier *JobModifier) (map[string]string, string, error) {
+	var toModifyJobs []*Job
+	toModifyKeys := make(map[string]*Job)
+	for _, jobkey := range keys {
+		item, err := s.q.Get(jobkey)
+		if err != nil || item == nil {
+			continue
+		}
+		iState := item.Stats().State
+		if iState == queue.ItemStateRun {
+			continue
+		}
+		toModifyJobs = append(toModifyJobs, item.Data().(*Job))
+		toModifyKeys[jobkey] = item.Data().(*Job)
+	}
+
+	modified, err := modifier.Modify(toModifyJobs, s)
+	if err != nil {
+		return modified, serverErrString(err), err
+	}
+	if len(modified) == 0 {
+		return modified, "", nil
+	}
+
+	var toModify []*Job
+	for _, old := range modified {
+		job := toModifyKeys[old]
+		if job != nil {
+			toModify = append(toModify, job)
+		}
+	}
+
+	// additional handling of changed limit groups
+	if modifier.LimitGroupsSet {
+		limitGroups := make(map[string]*limiter.GroupData)
+		for _, job := range toModify {
+			s.handleUserSpecifiedJobLimitGroups(job, limitGroups)
+		}
+		errs := s.storeLimitGroups(limitGroups)
+		if errs != nil {
+			clog.Error(ctx, "failed to store limit groups", "err", errs)
+		}
+	}
+
+	// update changed keys in the queue and in our rpl lookup
+	keyToRP := make(map[string]string)
+	for _, job := range toModify {
+		keyToRP[job.Key()] = job.RepGroup
+	}
+	s.rpl.Lock()
+	for new, old := range modified {
+		if old == new {
+			continue
+		}
+		errc := s.q.ChangeKey(old, new)
+		if errc != nil {
+			clog.Error(ctx, "failed to change a job key in the queue", "err", errc)
+		}
+
+		rp := keyToRP[new]
+		if _, exists := s.rpl.lookup[rp]; !exists {
+			s.rpl.lookup[rp] = make(map[string]bool)
+		}
+		delete(s.rpl.lookup[rp], old)
+		s.rpl.lookup[rp][new] = true
+	}
+	s.rpl.Unlock()
+
+	// update db live bucket and dep lookups
+	if len(toModify) == 0 {
+		return modified, "", nil
+	}
+	oldKeys := make([]string, len(toModify))
+	for i, job := range toModify {
+		oldKeys[i] = modified[job.Key()]
+	}
+	errm := s.db.modifyLiveJobs(ctx, oldKeys, toModify)
+	if errm != nil {
+		clog.Error(ctx, "job modification in database failed", "err", errm)
+	} else if modifier.DependenciesSet || modifier.PrioritySet {
+		// if we're changing the jobs these jobs are dependant upon or their
+		// priority, that must be reflected in the queue as well
+		for _, job := range toModify {
+			deps, errd := job.Dependencies.incompleteJobKeys(s.db)
+			if errd != nil {
+				clog.Error(ctx, "failed to get job dependencies", "err", errd)
+			}
+			errd = s.q.UpdateWithDependencies(ctx, job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, ServerItemTTR, deps)
+			if errd != nil {
+				clog.Error(ctx, "failed to modify a job in the queue", "err", errd)
+			}
+		}
+
+		if modifier.DependenciesSet {
+			s.handleCompleteFailureDependencies(ctx, toModify)
+		}
+	}
+
+	return modified, "", nil
+}
+
+// serverErrString returns the Err* constant of the given error if it is one of
+// our Errors, otherwise ErrInternalError.
+func serverErrString(err error) string {
+	if jqerr, ok := err.(Error); ok {
+		return jqerr.Err
+	}
+	return ErrInternalError
+}
+
 // getJobsByKeys gets jobs with the given keys (current and complete).
 func (s *Server) getJobsByKeys(ctx context.Context, keys []string, getStd bool, getEnv bool) (jobs []*Job, srerr string, qerr string) {
 	var notfound []string
@@ -2218,6 +2900,37 @@ func (s *Server) getJobsByKeys(ctx context.Context, keys []string, getStd bool,
 	return jobs, srerr, qerr
 }
 
+// getJobsByArray gets the elements of the job array with the given ArrayID
+// (current and complete). If index is 0 or more, only gets the element with
+// that index.
+func (s *Server) getJobsByArray(ctx context.Context, arrayID string, index int, getStd bool, getEnv bool) (jobs []*Job, srerr string, qerr string) {
+	feed, err := s.db.retrieveArrayFeed(ctx, arrayID)
+	if err != nil {
+		return nil, ErrDBError, err.Error()
+	}
+	if feed == nil {
+		return nil, "", ""
+	}
+
+	next := s.jobArrayNext(feed)
+	if index >= next {
+		return nil, "", ""
+	}
+
+	template := feed.Template
+	var keys []string
+	if index >= 0 {
+		keys = []string{template.arrayElementKey(index)}
+	} else {
+		keys = make([]string, next)
+		for i := range keys {
+			keys[i] = template.arrayElementKey(i)
+		}
+	}
+
+	return s.getJobsByKeys(ctx, keys, getStd, getEnv)
+}
+
 // checkJobByKey checks to see if the given key corresponds to a job currently
 // in the queue, or complete in the database.
 func (s *Server) checkJobByKey(key string) (bool, error) {
@@ -2326,6 +3039,121 @@ func (s *Server) getJobsCurrent(ctx context.Context, limit int, state JobState,
 	return jobs
 }
 
+// queryJobs gets jobs in the given group (current and complete), or all current
+// jobs if repgroup is blank (unless searching, when blank matches all groups),
+// filtered, sorted and paged according to the given query. The limit argument
+// groups similar jobs as per getJobsByRepGroup(), and can't be used with a
+// query that sorts or pages. Returns the jobs and the cursor for the next page
+// of results.
+func (s *Server) queryJobs(ctx context.Context, repgroup string, search bool, limit int, state JobState, query *JobQuery, getStd bool, getEnv bool) ([]*Job, string, string, string) {
+	if err := query.validate(); err != nil {
+		return nil, "", ErrBadRequest, err.Error()
+	}
+	if limit > 0 && query.sorted() {
+		return nil, "", ErrBadRequest, "limit can't be used when sorting or paging"
+	}
+
+	pager := newJobPager(query)
+	if repgroup == "" && !search {
+		s.pageJobsCurrent(pager, state)
+	} else if srerr, qerr := s.pageJobsByRepGroup(pager, repgroup, search, state); srerr != "" {
+		return nil, "", srerr, qerr
+	}
+
+	jobs, cursor := s.pagedJobs(ctx, pager, limit, getStd, getEnv)
+
+	return jobs, cursor, "", ""
+}
+
+// pageJobsCurrent offers all current (incomplete) jobs in the given state (any
+// state if blank) to the given pager.
+func (s *Server) pageJobsCurrent(pager *jobPager, state JobState) {
+	for _, item := range s.q.AllItems() {
+		s.pageItem(pager, item, state)
+	}
+}
+
+// pageJobsByRepGroup is like getJobsByRepGroup(), but offers the jobs in the
+// given state (any state if blank) to the given pager.
+func (s *Server) pageJobsByRepGroup(pager *jobPager, repgroup string, search bool, state JobState) (srerr string, qerr string) {
+	var rgs []string
+	if search {
+		var errs error
+		rgs, errs = s.searchRepGroups(repgroup)
+		if errs != nil {
+			return ErrDBError, errs.Error()
+		}
+	} else {
+		rgs = append(rgs, repgroup)
+	}
+
+	for _, rg := range rgs {
+		s.rpl.RLock()
+		for key := range s.rpl.lookup[rg] {
+			item, err := s.q.Get(key)
+			if err == nil && item != nil {
+				s.pageItem(pager, item, state)
+			}
+		}
+		s.rpl.RUnlock()
+
+		if state == "" || state == JobStateComplete {
+			if err := s.db.pageCompleteJobsByRepGroup(rg, pager); err != nil {
+				return ErrDBError, err.Error()
+			}
+		}
+	}
+
+	return "", ""
+}
+
+// pageItem offers the job in the given queue item to the given pager, if it is
+// in the given state (any state if blank).
+func (s *Server) pageItem(pager *jobPager, item *queue.Item, state JobState) {
+	if pager.skipKey(item.Key) {
+		return
+	}
+
+	sjob := item.Data().(*Job) //nolint:forcetypeassert
+	if state != "" {
+		sjob.RLock()
+		lost := sjob.Lost
+		jState := s.itemStateToJobState(item.Stats().State, lost)
+		if jState == JobStateReserved && !sjob.StartTime.IsZero() {
+			jState = JobStateRunning
+		}
+		sjob.RUnlock()
+
+		if !jobStateMatches(jState, lost, state) {
+			return
+		}
+	}
+
+	pager.offer(sjob, item)
+}
+
+// pagedJobs returns the page of jobs found by the given pager, copying the
+// jobs that were in the queue for the client, then grouping them if limit is
+// greater than 0 and populating their std and env as requested. Also returns
+// the cursor for the next page of results.
+func (s *Server) pagedJobs(ctx context.Context, pager *jobPager, limit int, getStd bool, getEnv bool) ([]*Job, string) {
+	entries, cursor := pager.page()
+	jobs := make([]*Job, len(entries))
+	for i, entry := range entries {
+		if entry.item != nil {
+			jobs[i] = s.itemToJob(ctx, entry.item, false, false)
+		} else {
+			jobs[i] = entry.job
+		}
+	}
+
+	if limit > 0 || getStd || getEnv {
+		jobs = s.limitJobs(ctx, jobs, limit, "", getStd, getEnv)
+	}
+
+	return jobs, cursor
+}
+
 // limitJobs handles the limiting of jobs for getJobsByRepGroup() and
 // getJobsCurrent(). States 'reserved' and 'running' are treated as the same
 // state.
@@ -2339,26 +3167,11 @@ func (s *Server) limitJobs(ctx context.Context, jobs []*Job, limit int, state Jo
 		jFailReason := job.FailReason
 		jLost := job.Lost
 		job.RUnlock()
-		if jState == JobStateRunning {
-			if jLost {
-				jState = JobStateLost
-			} else {
-				jState = JobStateReserved
-			}
-		}
 
-		if state != "" {
-			if state == JobStateRunning {
-				state = JobStateReserved
-			}
-			if state == JobStateDeletable {
-				if jState == JobStateRunning || jState == JobStateComplete {
-					continue
-				}
-			} else if jState != state {
-				continue
-			}
+		if state != "" && !jobStateMatches(jState, jLost, state) {
+			continue
 		}
+		jState = normaliseJobState(jState, jLost)
 
 		if limit == 0 {
 			limited = append(limited, job)
@@ -2395,6 +3208,33 @@ func (s *Server) limitJobs(ctx context.Context, jobs []*Job, limit int, state Jo
 	return limited
 }
 
+// normaliseJobState treats the running state as reserved, or lost if lost is
+// true.
+func normaliseJobState(jState JobState, lost bool) JobState {
+	if jState != JobStateRunning {
+		return jState
+	}
+	if lost {
+		return JobStateLost
+	}
+	return JobStateReserved
+}
+
+// jobStateMatches tells you if a job in state jState (which is lost if lost is
+// true) should be returned when asking for jobs in the given state. States
+// 'reserved' and 'running' are treated as the same state, and 'deletable'
+// matches anything that isn't running or complete.
+func jobStateMatches(jState JobState, lost bool, state JobState) bool {
+	jState = normaliseJobState(jState, lost)
+	if state == JobStateRunning {
+		state = JobStateReserved
+	}
+	if state == JobStateDeletable {
+		return jState != JobStateRunning && jState != JobStateComplete
+	}
+	return jState == state
+}
+
 // schedulerGroupDetails is used for debugging purposes to see how many jobs are
 // associated with which scheduler groups.
 func (s *Server) schedulerGroupDetails() []string {
@@ -2443,7 +3283,7 @@ func (s *Server) scheduleRunners(ctx context.Context, group *sgroup) {
 				job.Lock()
 				job.FailReason = FailReasonResource
 				job.Unlock()
-				errb := s.q.Bury(item.Key)
+				errb := s.q.BuryRunning(ctx, item.Key)
 				if errb != nil {
 					clog.Warn(ctx, "scheduleRunners failed to bury an item", "err", errb)
 				} else {
@@ -2700,6 +3540,12 @@ func (s *Server) closeWebSocketConnection(ctx context.Context, unique string) {
 // For now it also kills all currently running jobs so that their runners don't
 // stay alive uselessly. *** This adds 15s to our shutdown time...
 func (s *Server) shutdown(ctx context.Context, reason string, wait bool, stopSigHandling bool) {
+	// stop adding jobs from crons (before taking ssmutex, which cron ticks
+	// need), and stop archiving jobs
+	s.stopCronJobs()
+	s.stopRetention()
+	s.stopFairShare()
+
 	s.ssmutex.Lock()
 
 	if !s.up {
@@ -2717,18 +3563,22 @@ func (s *Server) shutdown(ctx context.Context, reason string, wait bool, stopSig
 	}
 	s.psgmutex.Unlock()
 
-	// change touch to always return a kill signal
 	s.up = false
 	s.drain = true
 	s.ServerInfo.Mode = ServerModeDrain
 	s.ssmutex.Unlock()
-	s.krmutex.Lock()
-	s.killRunners = true
-	s.krmutex.Unlock()
 
-	if s.HasRunners(ctx) {
-		// wait until everything must have attempted a touch
-		<-time.After(ClientTouchInterval)
+	fenced := reason == ErrClosedFenced
+	if !fenced {
+		// change touch to always return a kill signal
+		s.krmutex.Lock()
+		s.killRunners = true
+		s.krmutex.Unlock()
+
+		if s.HasRunners(ctx) {
+			// wait until everything must have attempted a touch
+			<-time.After(ClientTouchInterval)
+		}
 	}
 
 	// wait for the runners to actually die
@@ -2743,12 +3593,16 @@ func (s *Server) shutdown(ctx context.Context, reason string, wait bool, stopSig
 	}
 
 	// stop the scheduler
-	s.scheduler.Cleanup(ctx)
+	if !fenced {
+		s.scheduler.Cleanup(ctx)
+	}
 
 	// graceful shutdown of all websocket-related goroutines and connections
 	s.statusCaster.Close()
 	s.badServerCaster.Close()
 	s.schedCaster.Close()
+	s.events.close()
+	s.logs.close(ctx)
 	s.wsmutex.Lock()
 	for unique, conn := range s.wsconns {
 		errc := conn.Close()
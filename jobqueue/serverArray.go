@@ -0,0 +1,316 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the server to add the elements of job arrays
+// to the queue, a window of them at a time.
+
+import (
+	"context"
+	"sync"
+
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+// jobArrays holds the job arrays that still have elements to add to the queue.
+type jobArrays struct {
+	feeds map[string]*arrayFeed
+	sync.Mutex
+}
+
+// loadJobArrays loads the job arrays stored in the database that still have
+// elements to add to the queue, and tops up their elements in the queue. Call
+// this after recovering incomplete jobs in to the queue.
+func (s *Server) loadJobArrays(ctx context.Context) error {
+	feeds, err := s.db.retrieveIncompleteArrayFeeds()
+	if err != nil {
+		return err
+	}
+
+	s.arrays = &jobArrays{feeds: make(map[string]*arrayFeed)}
+	if len(feeds) == 0 {
+		return nil
+	}
+
+	for _, feed := range feeds {
+		s.arrays.feeds[feed.Template.ArrayID] = feed
+	}
+
+	for _, item := range s.q.AllItems() {
+		job := item.Data().(*Job) //nolint:forcetypeassert
+		job.RLock()
+		arrayID := job.ArrayID
+		job.RUnlock()
+
+		if feed, exists := s.arrays.feeds[arrayID]; exists {
+			feed.live[item.Key] = true
+		}
+	}
+
+	for _, feed := range feeds {
+		s.feedJobArray(ctx, feed.Template.ArrayID)
+	}
+
+	return nil
+}
+
+// expandJobArrays replaces any of the given jobs that have an Array with the
+// first ServerArrayWindow elements of that array, storing the array so that
+// its remaining elements can be added to the queue as earlier ones leave it,
+// to be run in the environment stored under the given envkey. Arrays that are
+// still being added to the queue, or that were added before if ignoreComplete
+// is true, are skipped.
+//
+// Returns the resulting jobs, the elements of each array being added (which
+// should be passed to settleJobArrays() after creating the jobs), the number of
+// elements that will be added later and the number of elements in skipped
+// arrays, or an Err* and error.
+func (s *Server) expandJobArrays(ctx context.Context, inputJobs []*Job, envkey string, ignoreComplete bool) ([]*Job, map[string][]*Job, int, int, string, error) {
+	jobs, templates, err := splitJobArrays(inputJobs)
+	if err != nil {
+		return nil, nil, 0, 0, ErrBadRequest, err
+	}
+	if len(templates) == 0 {
+		return jobs, nil, 0, 0, "", nil
+	}
+
+	s.arrays.Lock()
+	defer s.arrays.Unlock()
+
+	elements := make(map[string][]*Job)
+	feeds := make([]*arrayFeed, 0, len(templates))
+	var later, skipped int
+	for _, template := range templates {
+		arrayID := template.ArrayID
+		if _, exists := elements[arrayID]; exists {
+			skipped += template.ArraySize
+			continue
+		}
+
+		existing, errr := s.db.retrieveArrayFeed(ctx, arrayID)
+		if errr != nil {
+			return nil, nil, 0, 0, ErrDBError, errr
+		}
+		if _, feeding := s.arrays.feeds[arrayID]; feeding || (existing != nil && ignoreComplete) {
+			skipped += template.ArraySize
+			continue
+		}
+
+		template.Lock()
+		template.EnvKey = envkey
+		if template.BsubMode != "" {
+			s.assignBsubID(template)
+		}
+		template.Unlock()
+
+		feed := newArrayFeed(template, ignoreComplete)
+		elements[arrayID] = feed.take(ServerArrayWindow)
+		later += template.ArraySize - len(elements[arrayID])
+		jobs = append(jobs, elements[arrayID]...)
+		feeds = append(feeds, feed)
+	}
+
+	if err = s.db.storeArrayFeeds(feeds); err != nil {
+		return nil, nil, 0, 0, ErrDBError, err
+	}
+
+	for _, feed := range feeds {
+		if !feed.done() {
+			s.arrays.feeds[feed.Template.ArrayID] = feed
+		}
+	}
+
+	return jobs, elements, later, skipped, "", nil
+}
+
+// settleJobArrays should be called with the elements returned by
+// expandJobArrays() once createJobs() has successfully been called on them. It
+// makes sure that each array has as many elements in the queue as it should.
+func (s *Server) settleJobArrays(ctx context.Context, elements map[string][]*Job) {
+	for arrayID, added := range elements {
+		if s.settleJobArray(ctx, arrayID, added) {
+			s.feedJobArray(ctx, arrayID)
+		}
+	}
+}
+
+// settleJobArray stops tracking elements of the given array that were just
+// created but aren't in the queue (because they were already complete, or
+// creating them failed), and stores how far the array has got. Returns true if
+// more elements should be added in their place.
+func (s *Server) settleJobArray(ctx context.Context, arrayID string, added []*Job) bool {
+	s.arrays.Lock()
+	defer s.arrays.Unlock()
+	feed, exists := s.arrays.feeds[arrayID]
+	if !exists {
+		return false
+	}
+
+	var missing int
+	for _, element := range added {
+		key := element.Key()
+		if !feed.live[key] {
+			continue
+		}
+		if _, err := s.q.Get(key); err != nil {
+			delete(feed.live, key)
+			missing++
+		}
+	}
+
+	return s.storeArrayFeed(ctx, feed) && missing > 0
+}
+
+// storeArrayFeed stores the given feed, and stops tracking it if all its
+// elements have been added. Returns false if it was not stored or is done. You
+// must hold the arrays lock.
+func (s *Server) storeArrayFeed(ctx context.Context, feed *arrayFeed) bool {
+	if err := s.db.storeArrayFeeds([]*arrayFeed{feed}); err != nil {
+		clog.Error(ctx, "failed to store job array", "array", feed.Template.ArrayID, "err", err)
+		return false
+	}
+
+	if feed.done() {
+		delete(s.arrays.feeds, feed.Template.ArrayID)
+		return false
+	}
+
+	return true
+}
+
+// feedJobArray adds the next elements of the job array with the given ArrayID
+// to the queue, until ServerArrayWindow of its elements are in the queue or
+// they have all been added.
+func (s *Server) feedJobArray(ctx context.Context, arrayID string) {
+	for {
+		s.arrays.Lock()
+		feed, exists := s.arrays.feeds[arrayID]
+		if !exists {
+			s.arrays.Unlock()
+			return
+		}
+		elements := feed.take(ServerArrayWindow)
+		envkey, ignoreComplete := feed.Template.EnvKey, feed.IgnoreComplete
+		s.arrays.Unlock()
+
+		if len(elements) == 0 {
+			return
+		}
+
+		_, _, _, _, err := s.createJobs(ctx, elements, envkey, ignoreComplete)
+		if err != nil {
+			clog.Error(ctx, "failed to add job array elements", "array", arrayID, "err", err)
+			s.settleJobArray(ctx, arrayID, elements)
+			return
+		}
+
+		if !s.settleJobArray(ctx, arrayID, elements) {
+			return
+		}
+	}
+}
+
+// jobArrayElementLeaving should be called when the given Job is about to
+// complete and be removed from the queue. If it is an element of a job array
+// that still has elements to add, the next element is added in its place. This
+// must happen before the Job is removed, so that Jobs depending on the array
+// don't see all its elements complete while there are more to come.
+func (s *Server) jobArrayElementLeaving(ctx context.Context, job *Job) {
+	job.RLock()
+	arrayID := job.ArrayID
+	key := job.Key()
+	job.RUnlock()
+	if arrayID == "" {
+		return
+	}
+
+	s.arrays.Lock()
+	feed, exists := s.arrays.feeds[arrayID]
+	if exists {
+		delete(feed.live, key)
+	}
+	s.arrays.Unlock()
+
+	if exists {
+		s.feedJobArray(ctx, arrayID)
+	}
+}
+
+// jobArrayElementsDeleted should be called after the given Jobs were deleted
+// from the queue. If that leaves a job array that still has elements to add
+// with none of its elements in the queue, its remaining elements are cancelled,
+// so that deleting all of an array's current elements deletes the array.
+// Otherwise more elements are added in place of the deleted ones.
+func (s *Server) jobArrayElementsDeleted(ctx context.Context, jobs []*Job) {
+	arrayIDs := make(map[string]bool)
+	s.arrays.Lock()
+	for _, job := range jobs {
+		job.RLock()
+		arrayID := job.ArrayID
+		key := job.Key()
+		job.RUnlock()
+
+		if feed, exists := s.arrays.feeds[arrayID]; exists {
+			delete(feed.live, key)
+			arrayIDs[arrayID] = true
+		}
+	}
+
+	var toFeed []string
+	for arrayID := range arrayIDs {
+		feed := s.arrays.feeds[arrayID]
+		if len(feed.live) == 0 {
+			clog.Debug(ctx, "cancelled job array", "array", arrayID, "cancelled", feed.Template.ArraySize-feed.Next)
+			feed.Next = feed.Template.ArraySize
+			s.storeArrayFeed(ctx, feed)
+			continue
+		}
+		toFeed = append(toFeed, arrayID)
+	}
+	s.arrays.Unlock()
+
+	for _, arrayID := range toFeed {
+		s.feedJobArray(ctx, arrayID)
+	}
+}
+
+// abandonJobArrays should be called with the elements returned by
+// expandJobArrays() if createJobs() failed to create them, to forget about
+// their arrays.
+func (s *Server) abandonJobArrays(ctx context.Context, elements map[string][]*Job) {
+	s.arrays.Lock()
+	defer s.arrays.Unlock()
+	for arrayID := range elements {
+		delete(s.arrays.feeds, arrayID)
+		if err := s.db.deleteArrayFeed(arrayID); err != nil {
+			clog.Error(ctx, "failed to delete job array", "array", arrayID, "err", err)
+		}
+	}
+}
+
+// jobArrayNext returns the number of elements of the job array with the given
+// stored feed that have been added to the queue so far.
+func (s *Server) jobArrayNext(feed *arrayFeed) int {
+	s.arrays.Lock()
+	defer s.arrays.Unlock()
+	if current, exists := s.arrays.feeds[feed.Template.ArrayID]; exists {
+		return current.Next
+	}
+	return feed.Next
+}
@@ -23,11 +23,12 @@ package jobqueue
 import (
 	"bytes"
 	"context"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
-	"github.com/VertebrateResequencing/wr/limiter"
 	"github.com/VertebrateResequencing/wr/queue"
 	"github.com/ugorji/go/codec"
 	"github.com/wtsi-ssg/wr/clog"
@@ -52,18 +53,35 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 	s.ssmutex.RLock()
 	up := s.up
 	drain := s.drain
+	term := s.ServerInfo.Term
 	s.ssmutex.RUnlock()
 
+	// check that the client making the request has a token we know about,
+	// and work out who they are
+	user := s.authenticate(cr.Token)
+
 	switch {
-	// check that the client making the request has the expected token
-	case (len(cr.Token) != tokenLength || !tokenMatches(cr.Token, s.token)) && cr.Method != "ping":
+	case user == nil && cr.Method != "ping":
 		srerr = ErrPermissionDenied
 		qerr = "Client presented the wrong token"
+	case user != nil && cr.Term > term:
+		// the client has talked to a standby that took over from us
+		srerr = ErrFenced
+		qerr = "A standby server has taken over from this one"
+		go s.fence(ctx)
+	case requiresAdmin(cr) && !user.Admin:
+		srerr = ErrNotAdmin
+		qerr = "User " + user.Name + " is not an admin"
 	case s.q == nil || (!up && !drain):
 		// the server just got shutdown
 		srerr = ErrClosedStop
 		qerr = "The server has been stopped"
 	default:
+		if ownedMethods[cr.Method] && cr.Keys != nil {
+			// users can only act on the jobs they own
+			cr.Keys = s.ownedKeys(ctx, user, cr.Keys)
+		}
+
 		switch cr.Method {
 		case "ping":
 			// avoid a later race condition when we try to encode ServerInfo by
@@ -85,41 +103,50 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 			} else {
 				sr = &serverResponse{DB: b.Bytes()}
 			}
+		case "standby":
+			// a standby server is telling us where it is, and wants the
+			// changes made to the db since the version it has, or if we
+			// can't provide those, the size of a snapshot to download
+			s.ssmutex.Lock()
+			s.ServerInfo.Standby = cr.Path
+			s.ssmutex.Unlock()
+
+			changes, version, more, ok := s.db.changesSince(cr.DBVersion, standbyMaxMessageSize)
+			if ok {
+				sr = &serverResponse{DBChanges: changes, DBVersion: version, DBMore: more}
+				break
+			}
+
+			version, size, err := s.db.snapshot()
+			if err != nil {
+				srerr = ErrInternalError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{DBVersion: version, DBSize: size}
+			}
+		case "standbysnap":
+			// a standby server is downloading a snapshot of the db in chunks
+			chunk, err := s.db.readSnapshot(cr.DBVersion, cr.DBOffset, standbyMaxMessageSize)
+			if err != nil {
+				srerr = ErrMissingFile
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{DB: chunk}
+			}
 		case "pause":
 			clog.Debug(ctx, "pause requested")
-			paused, err := s.Pause()
+			err := s.requestPause(ctx)
 			if err != nil {
-				if jqerr, ok := err.(Error); ok {
-					srerr = jqerr.Err
-				} else {
-					srerr = ErrInternalError
-				}
+				srerr = serverErrString(err)
 				qerr = err.Error()
 			} else {
-				if paused {
-					clog.Info(ctx, "paused by request")
-				} else {
-					// clients are allowed to call pause as many times as they
-					// like, but a single resume call later should work, so we
-					// resume now to keep the internal pause counter at 1
-					resumed, err := s.Resume(ctx)
-					if err != nil {
-						clog.Error(ctx, "resume following an extraneous pause failed", "error", err)
-					} else if resumed {
-						clog.Error(ctx, "resumed incorrectly succeeded following a pause that did not")
-					}
-				}
 				sr = &serverResponse{SStats: s.GetServerStats()}
 			}
 		case "resume":
 			clog.Debug(ctx, "resume requested")
 			resumed, err := s.Resume(ctx)
 			if err != nil {
-				if jqerr, ok := err.(Error); ok {
-					srerr = jqerr.Err
-				} else {
-					srerr = ErrInternalError
-				}
+				srerr = serverErrString(err)
 				qerr = err.Error()
 			} else if resumed {
 				clog.Info(ctx, "resumed on request")
@@ -162,21 +189,42 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 			if cr.Env == nil || cr.Jobs == nil {
 				srerr = ErrBadRequest
 			} else {
+				setJobsOwner(cr.Jobs, user)
+
 				// Store Env
 				envkey, err := s.db.storeEnv(cr.Env)
 				if err != nil {
 					srerr = ErrDBError
 					qerr = err.Error()
-				} else if srerr == "" {
+				}
+
+				// expand any job arrays in to their first elements
+				var jobs []*Job
+				var arrays map[string][]*Job
+				var later, skipped int
+				if srerr == "" {
+					var thisSrerr string
+					jobs, arrays, later, skipped, thisSrerr, err = s.expandJobArrays(ctx, cr.Jobs, envkey, cr.IgnoreComplete)
+					if err != nil {
+						srerr = thisSrerr
+						qerr = err.Error()
+					}
+				}
+
+				if srerr == "" {
 					// create the jobs server-side
-					added, dups, alreadyComplete, thisSrerr, err := s.createJobs(ctx, cr.Jobs, envkey, cr.IgnoreComplete)
+					added, dups, alreadyComplete, thisSrerr, err := s.createJobs(ctx, jobs, envkey, cr.IgnoreComplete)
 					if err != nil {
+						s.abandonJobArrays(ctx, arrays)
 						srerr = thisSrerr
 						qerr = err.Error()
 					} else {
+						s.settleJobArrays(ctx, arrays)
+						added += later
+						dups += skipped
 						clog.Debug(ctx, "added jobs", "new", added, "dups", dups, "complete", alreadyComplete)
 						if cr.ReturnIDs {
-							jobs := s.inputToQueuedJobs(ctx, cr.Jobs)
+							jobs := s.inputToQueuedJobs(ctx, jobs)
 							var ids []string
 							for _, job := range jobs {
 								ids = append(ids, job.Key())
@@ -257,9 +305,10 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 					sgroup := sjob.schedulerGroup
 					retries := sjob.Retries
 					ub := sjob.UntilBuried
+					policy := sjob.RetryPolicy
 					sjob.Unlock()
 
-					delay := s.setItemDelay(ctx, item.Key, retries, ub)
+					delay := s.setItemDelay(ctx, item.Key, retries, ub, policy)
 					sjob.Lock()
 					sjob.DelayTime = delay
 					sjob.Unlock()
@@ -274,7 +323,7 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 		case "jstart":
 			// update the job's cmd-started-related properties
 			var job *Job
-			_, job, srerr = s.getij(cr, true)
+			_, job, srerr = s.getij(cr, user, true)
 			if srerr == "" {
 				job.Lock()
 				if cr.Job.Pid <= 0 || cr.Job.Host == "" {
@@ -297,6 +346,9 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 
 					job.Unlock()
 
+					// any output the cmd streams to us is for this new run
+					s.logs.start(ctx, job.Key())
+
 					// we'll save-to-disk that we started running this job, so
 					// recovery is possible after a crash
 					s.db.updateJobAfterChange(ctx, job)
@@ -305,7 +357,7 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 		case "jtouch":
 			var job *Job
 			var item *queue.Item
-			item, job, srerr = s.getij(cr, true)
+			item, job, srerr = s.getij(cr, user, true)
 			if srerr == "" {
 				// if kill has been called for this job, just return KillCalled
 				job.RLock()
@@ -331,22 +383,92 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 						job.Lock()
 						job.Lost = false
 						job.EndTime = time.Time{}
+						event := newJobEvent(job, JobStateLost, JobStateRunning)
 						job.Unlock()
 
 						// since our changed callback won't be called, send out
 						// this transition from lost to running state
 						s.statusCaster.Send(&jstateCount{"+all+", JobStateLost, JobStateRunning, 1})
 						s.statusCaster.Send(&jstateCount{job.RepGroup, JobStateLost, JobStateRunning, 1})
+						s.events.publish(event)
+					}
+				}
+				// let the client know where to go should we die
+				s.ssmutex.RLock()
+				standby := s.ServerInfo.Standby
+				s.ssmutex.RUnlock()
+
+				sr = &serverResponse{KillCalled: killCalled, Standby: standby}
+			}
+		case "jcopy":
+			// store a file sent to us by a job's CopyToManager behaviour
+			var job *Job
+			_, job, srerr = s.getij(cr, user, true)
+			if srerr == "" {
+				if cr.File == nil || cr.Path == "" {
+					srerr = ErrBadRequest
+				} else {
+					data, err := decompress(cr.File)
+					if err != nil {
+						srerr = ErrInternalError
+						qerr = err.Error()
+					} else {
+						err = s.storeCopiedFile(ctx, job.Key(), cr.Path, bytes.NewReader(data))
+						if err != nil {
+							srerr = ErrInternalError
+							qerr = err.Error()
+						} else {
+							job.noteCopiedFile(filepath.Clean(cr.Path))
+							s.db.updateJobAfterChange(ctx, job)
+						}
+					}
+				}
+			}
+		case "jcheckpoint":
+			// store the archived Checkpoint Dir of a job that had to stop
+			// before it completed
+			var job *Job
+			_, job, srerr = s.getij(cr, user, true)
+			if srerr == "" {
+				if cr.File == nil {
+					srerr = ErrBadRequest
+				} else {
+					err := s.storeCheckpoint(ctx, job.Key(), cr.File)
+					if err != nil {
+						srerr = ErrInternalError
+						qerr = err.Error()
+					} else {
+						job.Lock()
+						job.CheckpointSaved = true
+						job.Unlock()
+						s.db.updateJobAfterChange(ctx, job)
 					}
 				}
-				sr = &serverResponse{KillCalled: killCalled}
+			}
+		case "getcheckpoint":
+			// get the checkpoint stored by a previous attempt at running a job,
+			// so it can be restored before this attempt
+			var job *Job
+			_, job, srerr = s.getij(cr, user, true)
+			if srerr == "" {
+				data, err := s.readCheckpoint(job.Key())
+				if err != nil {
+					if os.IsNotExist(err) {
+						srerr = ErrMissingFile
+					} else {
+						srerr = ErrInternalError
+					}
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{File: data}
+				}
 			}
 		case "jarchive":
 			// remove the job from the queue, rpl and live bucket and add to
 			// complete bucket
 			var item *queue.Item
 			var job *Job
-			item, job, srerr = s.getij(cr, true)
+			item, job, srerr = s.getij(cr, user, true)
 			if srerr == "" {
 				// first check the item is still in the run queue (eg. the job
 				// wasn't released by another process; unlike the other methods,
@@ -366,6 +488,8 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 					key := job.Key()
 					job.State = JobStateComplete
 					job.FailReason = ""
+					checkpointSaved := job.CheckpointSaved
+					job.CheckpointSaved = false
 					sgroup := job.schedulerGroup
 					rgroup := job.RepGroup
 					job.Unlock()
@@ -374,6 +498,7 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 						srerr = ErrDBError
 						qerr = err.Error()
 					} else {
+						s.jobArrayElementLeaving(ctx, job)
 						err = s.q.Remove(ctx, key)
 						if err != nil {
 							srerr = ErrInternalError
@@ -386,6 +511,10 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 							s.rpl.Unlock()
 							clog.Debug(ctx, "completed job", "cmd", job.Cmd, "schedGrp", sgroup)
 							s.decrementGroupCount(ctx, sgroup, 1)
+							s.fairShare.record(job)
+							if checkpointSaved {
+								s.removeCheckpoint(ctx, key)
+							}
 						}
 					}
 				}
@@ -394,7 +523,7 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 			// move the job from the run queue to the delay queue, unless it has
 			// failed too many times, in which case bury
 			var job *Job
-			_, job, srerr = s.getij(cr, false)
+			_, job, srerr = s.getij(cr, user, false)
 			if srerr == "" {
 				if cr.JobEndState == nil {
 					cr.JobEndState = &JobEndState{}
@@ -412,7 +541,7 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 		case "jbury":
 			// move the job from the run queue to the bury queue
 			var job *Job
-			_, job, srerr = s.getij(cr, false)
+			_, job, srerr = s.getij(cr, user, false)
 			if srerr == "" {
 				if cr.JobEndState == nil {
 					cr.JobEndState = &JobEndState{}
@@ -477,133 +606,12 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 			if cr.Keys == nil || cr.Modifier == nil {
 				srerr = ErrBadRequest
 			} else {
-				// to avoid race conditions with jobs that are currently
-				// pending, but become running in the middle of us trying to
-				// modify them, we first pause the server, and resume it
-				// afterwards
-				paused, err := s.Pause()
+				modified, serr, err := s.modifyJobs(ctx, cr.Keys, cr.Modifier)
 				if err != nil {
-					if jqerr, ok := err.(Error); ok {
-						srerr = jqerr.Err
-					} else {
-						srerr = ErrInternalError
-					}
+					srerr = serr
 					qerr = err.Error()
-				} else if paused {
-					clog.Debug(ctx, "modify requested, paused server")
 				} else {
-					clog.Debug(ctx, "modify requested")
-				}
-
-				if err == nil {
-					var toModifyJobs []*Job
-					toModifyKeys := make(map[string]*Job)
-					for _, jobkey := range cr.Keys {
-						item, err := s.q.Get(jobkey)
-						if err != nil || item == nil {
-							continue
-						}
-						iState := item.Stats().State
-						if iState == queue.ItemStateRun {
-							continue
-						}
-						toModifyJobs = append(toModifyJobs, item.Data().(*Job))
-						toModifyKeys[jobkey] = item.Data().(*Job)
-					}
-
-					modified, err := cr.Modifier.Modify(toModifyJobs, s)
-					if err != nil {
-						if jqerr, ok := err.(Error); ok {
-							srerr = jqerr.Err
-						} else {
-							srerr = ErrInternalError
-						}
-						qerr = err.Error()
-					}
-
-					if err == nil && len(modified) > 0 {
-						var toModify []*Job
-						for _, old := range modified {
-							job := toModifyKeys[old]
-							if job != nil {
-								toModify = append(toModify, job)
-							}
-						}
-
-						// additional handling of changed limit groups
-						if cr.Modifier.LimitGroupsSet {
-							limitGroups := make(map[string]*limiter.GroupData)
-							for _, job := range toModify {
-								s.handleUserSpecifiedJobLimitGroups(job, limitGroups)
-							}
-							err := s.storeLimitGroups(limitGroups)
-							if err != nil {
-								clog.Error(ctx, "failed to store limit groups", "err", err)
-							}
-						}
-
-						// update changed keys in the queue and in our rpl lookup
-						keyToRP := make(map[string]string)
-						for _, job := range toModify {
-							keyToRP[job.Key()] = job.RepGroup
-						}
-						s.rpl.Lock()
-						for new, old := range modified {
-							if old == new {
-								continue
-							}
-							errc := s.q.ChangeKey(old, new)
-							if errc != nil {
-								clog.Error(ctx, "failed to change a job key in the queue", "err", errc)
-							}
-
-							rp := keyToRP[new]
-							if _, exists := s.rpl.lookup[rp]; !exists {
-								s.rpl.lookup[rp] = make(map[string]bool)
-							}
-							delete(s.rpl.lookup[rp], old)
-							s.rpl.lookup[rp][new] = true
-						}
-						s.rpl.Unlock()
-
-						// update db live bucket and dep lookups
-						if len(toModify) > 0 {
-							oldKeys := make([]string, len(toModify))
-							for i, job := range toModify {
-								oldKeys[i] = modified[job.Key()]
-							}
-							errm := s.db.modifyLiveJobs(ctx, oldKeys, toModify)
-							if errm != nil {
-								clog.Error(ctx, "job modification in database failed", "err", errm)
-							} else if cr.Modifier.DependenciesSet || cr.Modifier.PrioritySet {
-								// if we're changing the jobs these jobs are
-								// dependant upon or their priority, that must be
-								// reflected in the queue as well
-								for _, job := range toModify {
-									deps, err := job.Dependencies.incompleteJobKeys(s.db)
-									if err != nil {
-										clog.Error(ctx, "failed to get job dependencies", "err", err)
-									}
-									err = s.q.Update(ctx, job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, ServerItemTTR, deps)
-									if err != nil {
-										clog.Error(ctx, "failed to modify a job in the queue", "err", err)
-									}
-								}
-							}
-						}
-					}
-
 					sr = &serverResponse{Modified: modified}
-
-					// now resume the server again
-					resumed, err := s.Resume(ctx)
-					if err != nil {
-						clog.Error(ctx, err.Error())
-					} else if resumed {
-						clog.Debug(ctx, "modify completed, resumed server", "count", len(modified))
-					} else {
-						clog.Debug(ctx, "modify completed", "count", len(modified))
-					}
 				}
 			}
 		case "jkill":
@@ -639,6 +647,76 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 					sr = &serverResponse{Jobs: jobs}
 				}
 			}
+		case "getcopied":
+			// get a file that a job copied to us with its CopyToManager
+			// behaviour
+			switch {
+			case len(cr.Keys) != 1 || cr.Path == "":
+				srerr = ErrBadRequest
+			case !s.ownsJobKey(user, cr.Keys[0]):
+				srerr = ErrNotOwner
+			default:
+				data, err := s.readCopiedFile(cr.Keys[0], cr.Path)
+				if err != nil {
+					if os.IsNotExist(err) {
+						srerr = ErrMissingFile
+					} else {
+						srerr = ErrBadRequest
+					}
+					qerr = err.Error()
+				} else {
+					compressed, err := compress(data)
+					if err != nil {
+						srerr = ErrInternalError
+						qerr = err.Error()
+					} else {
+						sr = &serverResponse{File: compressed}
+					}
+				}
+			}
+		case "getevents":
+			// get job events, waiting for some if necessary
+			if err := cr.EventFilter.validate(); err != nil {
+				srerr = ErrBadRequest
+				qerr = err.Error()
+			} else {
+				events, seq := s.events.wait(ctx, cr.EventSeq, cr.EventFilter, cr.Timeout)
+				sr = &serverResponse{Events: events, EventSeq: seq}
+			}
+		case "jlog":
+			// store output streamed to us by the runner of a running job
+			_, _, srerr = s.getij(cr, user, true)
+			if srerr == "" {
+				s.logs.append(ctx, cr.Job.Key(), cr.LogChunks)
+			}
+		case "getlogs":
+			// get the output of a job's cmd, waiting for more if necessary
+			switch {
+			case len(cr.Keys) != 1:
+				srerr = ErrBadRequest
+			case !s.ownsJobKey(user, cr.Keys[0]):
+				srerr = ErrNotOwner
+			default:
+				chunks, seq, live, err := s.getJobLogs(ctx, cr.Keys[0], cr.EventSeq, cr.Timeout)
+				if err != nil {
+					srerr = ErrInternalError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{LogChunks: chunks, EventSeq: seq, LogsLive: live}
+				}
+			}
+		case "getba":
+			// get jobs by their ArrayID, optionally just the one at a
+			// particular index
+			if cr.Job == nil || cr.Job.ArrayID == "" {
+				srerr = ErrBadRequest
+			} else {
+				var jobs []*Job
+				jobs, srerr, qerr = s.getJobsByArray(ctx, cr.Job.ArrayID, cr.Job.ArrayIndex, cr.GetStd, cr.GetEnv)
+				if len(jobs) > 0 {
+					sr = &serverResponse{Jobs: jobs}
+				}
+			}
 		case "getbr":
 			// get jobs by their RepGroup
 			if cr.Job == nil || cr.Job.RepGroup == "" {
@@ -650,6 +728,45 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 					sr = &serverResponse{Jobs: jobs}
 				}
 			}
+		case "getarc":
+			// get jobs that were archived due to our retention policies
+			if len(cr.Keys) == 0 && (cr.Job == nil || cr.Job.RepGroup == "") {
+				srerr = ErrBadRequest
+			} else {
+				var repGroup string
+				if cr.Job != nil {
+					repGroup = cr.Job.RepGroup
+				}
+				jobs, err := s.getArchivedJobs(cr.Keys, repGroup, cr.Search)
+				if err != nil {
+					srerr = ErrInternalError
+					qerr = err.Error()
+				} else {
+					if cr.Limit > 0 {
+						jobs = s.limitJobs(ctx, jobs, cr.Limit, "", false, false)
+					}
+					if len(jobs) > 0 {
+						sr = &serverResponse{Jobs: jobs}
+					}
+				}
+			}
+		case "getquery":
+			// get jobs by their RepGroup, or all current jobs, filtered,
+			// sorted and paged
+			if cr.Query == nil {
+				srerr = ErrBadRequest
+			} else {
+				var repGroup string
+				if cr.Job != nil {
+					repGroup = cr.Job.RepGroup
+				}
+				var jobs []*Job
+				var cursor string
+				jobs, cursor, srerr, qerr = s.queryJobs(ctx, repGroup, cr.Search, cr.Limit, cr.State, cr.Query, cr.GetStd, cr.GetEnv)
+				if srerr == "" {
+					sr = &serverResponse{Jobs: jobs, Cursor: cursor}
+				}
+			}
 		case "getin":
 			// get all jobs in the jobqueue
 			jobs := s.getJobsCurrent(ctx, cr.Limit, cr.State, cr.GetStd, cr.GetEnv)
@@ -688,6 +805,70 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 			}
 		case "getlgs":
 			sr = &serverResponse{LimitGroups: s.limiter.GetLimits()}
+		case "cronadd":
+			if cr.Cron == nil || cr.Env == nil {
+				srerr = ErrBadRequest
+			} else {
+				setJobsOwner([]*Job{cr.Cron.Job}, user)
+				cj, serr, err := s.addCronJob(ctx, cr.Cron, cr.Env)
+				if err != nil {
+					srerr = serr
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Crons: []*CronJob{cj}}
+				}
+			}
+		case "cronremove":
+			if cr.Cron == nil {
+				srerr = ErrBadRequest
+			} else {
+				serr, err := s.removeCronJob(ctx, cr.Cron.Name, user)
+				if err != nil {
+					srerr = serr
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{}
+				}
+			}
+		case "crons":
+			sr = &serverResponse{Crons: s.getCronJobs()}
+		case "whoami":
+			u := *user
+			u.Token = nil
+			sr = &serverResponse{Users: []*User{&u}}
+		case "useradd":
+			if cr.User == nil {
+				srerr = ErrBadRequest
+			} else {
+				u, serr, err := s.addUser(ctx, cr.User.Name, cr.User.Admin)
+				if err != nil {
+					srerr = serr
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Users: []*User{u}}
+				}
+			}
+		case "userdel":
+			if cr.User == nil {
+				srerr = ErrBadRequest
+			} else {
+				serr, err := s.removeUser(ctx, cr.User.Name)
+				if err != nil {
+					srerr = serr
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{}
+				}
+			}
+		case "users":
+			sr = &serverResponse{Users: s.getUsers()}
+		case "fairshare":
+			report := s.fairShareReport()
+			if report == nil {
+				srerr = ErrNoFairShare
+			} else {
+				sr = &serverResponse{FairShare: report}
+			}
 		default:
 			srerr = ErrUnknownCommand
 		}
@@ -715,13 +896,16 @@ func (s *Server) handleRequest(ctx context.Context, m *mangos.Message) error {
 		sr = &serverResponse{}
 	}
 
+	hideSecrets(user, sr.Jobs)
+
 	// send reply to client
 	return s.reply(m, sr) // *** log failure to reply?
 }
 
 // for the many j* methods in handleRequest, we do this common stuff to get
-// the desired item and job. The returned string is one of our Err* constants.
-func (s *Server) getij(cr *clientRequest, checkRunning bool) (*queue.Item, *Job, string) {
+// the desired item and job, checking that the given user owns the job. The
+// returned string is one of our Err* constants.
+func (s *Server) getij(cr *clientRequest, user *User, checkRunning bool) (*queue.Item, *Job, string) {
 	// clientRequest must have a Job
 	if cr.Job == nil {
 		return nil, nil, ErrBadRequest
@@ -733,6 +917,10 @@ func (s *Server) getij(cr *clientRequest, checkRunning bool) (*queue.Item, *Job,
 	}
 	job := item.Data().(*Job)
 
+	if !user.owns(job) {
+		return item, nil, ErrNotOwner
+	}
+
 	if cr.ClientID != job.ReservedBy {
 		return item, job, ErrMustReserve
 	}
@@ -751,9 +939,10 @@ func (s *Server) itemStateToJobState(itemState queue.ItemState, lost bool) JobSt
 }
 
 // setItemDelay is called when a job is reserved, and sets the item's delay to
-// a value based on a backoff. Returns the delay that was set.
-func (s *Server) setItemDelay(ctx context.Context, key string, maxRetries, untilBuried uint8) time.Duration {
-	delay := calculateItemDelay(int(maxRetries) - int(untilBuried) + 1)
+// a value based on the backoff of the given policy. Returns the delay that was
+// set.
+func (s *Server) setItemDelay(ctx context.Context, key string, maxRetries, untilBuried uint8, policy *RetryPolicy) time.Duration {
+	delay := policy.delay(int(maxRetries) - int(untilBuried) + 1)
 
 	errd := s.q.SetDelay(key, delay)
 	if errd != nil {
@@ -793,6 +982,8 @@ func (s *Server) itemToJob(ctx context.Context, item *queue.Item, getStd bool, g
 		Retries:               sjob.Retries,
 		DelayTime:             sjob.DelayTime,
 		NoRetriesOverWalltime: sjob.NoRetriesOverWalltime,
+		RetryPolicy:           sjob.RetryPolicy,
+		Checkpoint:            sjob.Checkpoint,
 		PeakRAM:               sjob.PeakRAM,
 		PeakDisk:              sjob.PeakDisk,
 		Exited:                sjob.Exited,
@@ -812,6 +1003,7 @@ func (s *Server) itemToJob(ctx context.Context, item *queue.Item, getStd bool, g
 		EnvKey:                sjob.EnvKey,
 		EnvOverride:           sjob.EnvOverride,
 		Dependencies:          sjob.Dependencies,
+		OnDepFailure:          sjob.OnDepFailure,
 		Behaviours:            sjob.Behaviours,
 		MountConfigs:          sjob.MountConfigs,
 		MonitorDocker:         sjob.MonitorDocker,
@@ -820,6 +1012,12 @@ func (s *Server) itemToJob(ctx context.Context, item *queue.Item, getStd bool, g
 		ContainerMounts:       sjob.ContainerMounts,
 		BsubMode:              sjob.BsubMode,
 		BsubID:                sjob.BsubID,
+		ArrayID:               sjob.ArrayID,
+		ArrayIndex:            sjob.ArrayIndex,
+		ArraySize:             sjob.ArraySize,
+		CopiedFiles:           sjob.CopiedFiles,
+		CheckpointSaved:       sjob.CheckpointSaved,
+		Owner:                 sjob.Owner,
 	}
 
 	if state == JobStateReserved && !sjob.StartTime.IsZero() {
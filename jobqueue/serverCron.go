@@ -0,0 +1,371 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the server to add the Jobs of CronJobs to
+// the queue according to their schedules.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+// cronJobs holds the CronJobs the server knows about.
+type cronJobs struct {
+	jobs    map[string]*CronJob
+	stop    chan struct{}
+	stopped bool
+	sync.Mutex
+}
+
+// startCronJobs loads any CronJobs stored in the database and starts checking
+// every ServerCronCheckInterval if any of them are due to add their Job to the
+// queue. Ticks that were missed while the server wasn't running are not caught
+// up on.
+func (s *Server) startCronJobs(ctx context.Context) error {
+	cjs, err := s.db.retrieveCronJobs()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.crons = &cronJobs{jobs: make(map[string]*CronJob), stop: make(chan struct{})}
+	for _, cj := range cjs {
+		if err = cj.validate(); err != nil {
+			clog.Warn(ctx, "ignoring invalid stored cron", "name", cj.Name, "err", err)
+			continue
+		}
+		cj.NextTick = cj.schedule.Next(now)
+		s.crons.jobs[cj.Name] = cj
+	}
+
+	go func() {
+		defer internal.LogPanic(ctx, "jobqueue cron", true)
+
+		ticker := time.NewTicker(ServerCronCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.checkCronJobs(ctx, now)
+			case <-s.crons.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// stopCronJobs stops CronJobs from adding any more Jobs to the queue.
+func (s *Server) stopCronJobs() {
+	if s.crons == nil {
+		return
+	}
+
+	s.crons.Lock()
+	defer s.crons.Unlock()
+	if !s.crons.stopped {
+		close(s.crons.stop)
+		s.crons.stopped = true
+	}
+}
+
+// checkCronJobs adds the Jobs of any CronJobs whose NextTick has passed.
+func (s *Server) checkCronJobs(ctx context.Context, now time.Time) {
+	s.crons.Lock()
+	defer s.crons.Unlock()
+	if s.crons.stopped {
+		return
+	}
+
+	for _, cj := range s.crons.jobs {
+		if now.Before(cj.NextTick) {
+			continue
+		}
+
+		cj.LastTick = cj.NextTick
+		cj.NextTick = cj.schedule.Next(now)
+		s.tickCronJob(ctx, cj)
+	}
+}
+
+// tickCronJob adds the Job of the given CronJob to the queue, unless the Job
+// added at a previous tick is still in the queue. You must hold the crons lock.
+func (s *Server) tickCronJob(ctx context.Context, cj *CronJob) {
+	s.ssmutex.RLock()
+	draining := s.drain
+	s.ssmutex.RUnlock()
+	if draining {
+		clog.Debug(ctx, "cron tick ignored while draining", "name", cj.Name)
+		return
+	}
+
+	// get a fresh copy of the template Job that we can add to the queue
+	fresh, err := s.db.retrieveCronJob(ctx, cj.Name)
+	if err != nil || fresh == nil {
+		clog.Warn(ctx, "cron tick failed to retrieve the job", "name", cj.Name, "err", err)
+		return
+	}
+	job := fresh.Job
+
+	if _, err = s.q.Get(job.Key()); err == nil {
+		cj.Skipped++
+		clog.Debug(ctx, "cron tick skipped since previous job is incomplete", "name", cj.Name)
+	} else {
+		added, _, _, _, errc := s.createJobs(ctx, []*Job{job}, job.EnvKey, false)
+		if errc != nil {
+			clog.Warn(ctx, "cron tick failed to add the job", "name", cj.Name, "err", errc)
+			return
+		}
+		if added > 0 {
+			cj.Added++
+			cj.LastAdded = time.Now()
+		}
+	}
+
+	if err = s.db.storeCronJob(cj); err != nil {
+		clog.Warn(ctx, "cron tick failed to store cron", "name", cj.Name, "err", err)
+	}
+}
+
+// addCronJob validates and stores the given CronJob, so that it will start
+// adding its Job to the queue at its next tick. The Job will be run with the
+// given (compressed) environment. Returns a copy of the stored CronJob, or a
+// server error string and an error if the CronJob was invalid or has the Name
+// of an existing CronJob.
+func (s *Server) addCronJob(ctx context.Context, cj *CronJob, env []byte) (*CronJob, string, error) {
+	if err := cj.validate(); err != nil {
+		return nil, ErrBadRequest, err
+	}
+
+	s.crons.Lock()
+	defer s.crons.Unlock()
+	if _, exists := s.crons.jobs[cj.Name]; exists {
+		return nil, ErrCronExists, fmt.Errorf("cron %s already exists", cj.Name)
+	}
+
+	envkey, err := s.db.storeEnv(env)
+	if err != nil {
+		return nil, ErrDBError, err
+	}
+
+	now := time.Now()
+	cj.Job.EnvKey = envkey
+	cj.Created = now
+	cj.LastTick = time.Time{}
+	cj.LastAdded = time.Time{}
+	cj.NextTick = cj.schedule.Next(now)
+	cj.Added = 0
+	cj.Skipped = 0
+
+	if err = s.db.storeCronJob(cj); err != nil {
+		return nil, ErrDBError, err
+	}
+	s.crons.jobs[cj.Name] = cj
+	clog.Debug(ctx, "added cron", "name", cj.Name, "schedule", cj.Schedule, "cmd", cj.Job.Cmd)
+
+	c := *cj
+	return &c, "", nil
+}
+
+// removeCronJob stops the CronJob with the given Name from adding its Job to
+// the queue in the future, and forgets about it. Any Job it already added is
+// unaffected. Only the owner of the CronJob's Job, or an admin, can remove it.
+func (s *Server) removeCronJob(ctx context.Context, name string, u *User) (string, error) {
+	s.crons.Lock()
+	defer s.crons.Unlock()
+	cj, exists := s.crons.jobs[name]
+	if !exists {
+		return ErrMissingCron, fmt.Errorf("cron %s does not exist", name)
+	}
+
+	if !u.owns(cj.Job) {
+		return ErrPermissionDenied, fmt.Errorf("cron %s is not owned by %s", name, u.Name)
+	}
+
+	if err := s.db.deleteCronJob(name); err != nil {
+		return ErrDBError, err
+	}
+	delete(s.crons.jobs, name)
+	clog.Debug(ctx, "removed cron", "name", name)
+
+	return "", nil
+}
+
+// getCronJobs returns copies of all the current CronJobs, sorted by Name.
+func (s *Server) getCronJobs() []*CronJob {
+	s.crons.Lock()
+	defer s.crons.Unlock()
+
+	cjs := make([]*CronJob, 0, len(s.crons.jobs))
+	for _, cj := range s.crons.jobs {
+		c := *cj
+		cjs = append(cjs, &c)
+	}
+	sort.Slice(cjs, func(i, j int) bool {
+		return cjs[i].Name < cjs[j].Name
+	})
+
+	return cjs
+}
+
+// CronViaJSON describes a CronJob that a user wishes to add, convenient if
+// they are supplying JSON.
+type CronViaJSON struct {
+	Name     string      `json:"name"`
+	Schedule string      `json:"schedule"`
+	Job      *JobViaJSON `json:"job"`
+}
+
+// CronStatus is a summary of a CronJob, for giving to REST API clients.
+type CronStatus struct {
+	Name      string `json:"name"`
+	Schedule  string `json:"schedule"`
+	Cmd       string `json:"cmd"`
+	RepGroup  string `json:"rep_grp"`
+	Owner     string `json:"owner"`
+	Created   int64  `json:"created"`
+	LastTick  int64  `json:"last_tick"`
+	LastAdded int64  `json:"last_added"`
+	NextTick  int64  `json:"next_tick"`
+	Added     int    `json:"added"`
+	Skipped   int    `json:"skipped"`
+}
+
+// ToStatus converts a CronJob in to a CronStatus. Times are given as seconds
+// since the Unix epoch, or 0 if they haven't happened.
+func (cj *CronJob) ToStatus() CronStatus {
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	}
+
+	return CronStatus{
+		Name:      cj.Name,
+		Schedule:  cj.Schedule,
+		Cmd:       cj.Job.Cmd,
+		RepGroup:  cj.Job.RepGroup,
+		Owner:     cj.Job.Owner,
+		Created:   unix(cj.Created),
+		LastTick:  unix(cj.LastTick),
+		LastAdded: unix(cj.LastAdded),
+		NextTick:  unix(cj.NextTick),
+		Added:     cj.Added,
+		Skipped:   cj.Skipped,
+	}
+}
+
+// restCrons lets you GET a list of CronJobs (or just one if the url is
+// suffixed with its name), POST a single CronViaJSON to add a new CronJob, or
+// DELETE a CronJob by suffixing the url with its name. All return a JSON list
+// of CronStatus.
+func restCrons(ctx context.Context, s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue web server restCrons", false)
+
+		user, ok := s.httpUser(w, r)
+		if !ok {
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, restCronsEndpoint)
+
+		var cjs []*CronJob
+		status := http.StatusOK
+		switch r.Method {
+		case http.MethodGet:
+			for _, cj := range s.getCronJobs() {
+				if name == "" || cj.Name == name {
+					cjs = append(cjs, cj)
+				}
+			}
+			if name != "" && len(cjs) == 0 {
+				http.Error(w, fmt.Sprintf("cron %s does not exist", name), http.StatusNotFound)
+				return
+			}
+		case http.MethodPost:
+			var cvj CronViaJSON
+			err := json.NewDecoder(r.Body).Decode(&cvj)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if cvj.Job == nil {
+				http.Error(w, "job was not specified", http.StatusBadRequest)
+				return
+			}
+
+			job, err := cvj.Job.Convert(&JobDefaults{})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("there was a problem interpreting your job: %s", err), http.StatusBadRequest)
+				return
+			}
+
+			setJobsOwner([]*Job{job}, user)
+			cj, srerr, err := s.addCronJob(ctx, &CronJob{Name: cvj.Name, Schedule: cvj.Schedule, Job: job}, []byte{})
+			if err != nil {
+				http.Error(w, err.Error(), serverErrToHTTPStatus(srerr))
+				return
+			}
+			cjs = []*CronJob{cj}
+			status = http.StatusCreated
+		case http.MethodDelete:
+			for _, cj := range s.getCronJobs() {
+				if cj.Name == name {
+					cjs = append(cjs, cj)
+				}
+			}
+
+			srerr, err := s.removeCronJob(ctx, name, user)
+			if err != nil {
+				http.Error(w, err.Error(), serverErrToHTTPStatus(srerr))
+				return
+			}
+		default:
+			http.Error(w, "So far only GET, POST and DELETE are supported", http.StatusBadRequest)
+			return
+		}
+
+		statuses := make([]CronStatus, len(cjs))
+		for i, cj := range cjs {
+			statuses[i] = cj.ToStatus()
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(status)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(statuses)
+		if err != nil {
+			clog.Warn(ctx, "restCrons failed to encode crons", "err", err)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the server to publish job lifecycle events,
+// which can be received via the client protocol, a server-sent events REST
+// endpoint and webhooks.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+// eventLogSize is the number of most recent JobEvents the server remembers, so
+// that consumers can catch up on events they missed while not connected.
+const eventLogSize = 10000
+
+// eventsKeepAliveInterval is how often the events REST endpoint sends a
+// comment to clients when there are no events, to keep the connection open.
+const eventsKeepAliveInterval = 15 * time.Second
+
+// eventStates are the JobStates that JobEvent.ToState can have, and so are
+// valid to filter on.
+var eventStates = map[JobState]bool{
+	JobStateDelayed:   true,
+	JobStateReady:     true,
+	JobStateRunning:   true,
+	JobStateLost:      true,
+	JobStateBuried:    true,
+	JobStateDependent: true,
+	JobStateComplete:  true,
+	JobStateDeleted:   true,
+}
+
+// JobEvent describes a Job changing state. Seq is a number unique to the event
+// that increments with each event the server publishes (starting again from 1
+// if the server restarts), which you can use to ask for only events you
+// haven't seen yet.
+type JobEvent struct {
+	Seq        uint64
+	Time       time.Time
+	Key        string
+	RepGroup   string
+	FromState  JobState
+	ToState    JobState
+	Exitcode   int
+	Host       string
+	FailReason string
+}
+
+// newJobEvent creates a JobEvent for the given Job changing from one state to
+// another. You must hold at least a read lock on the Job.
+func newJobEvent(job *Job, from, to JobState) *JobEvent {
+	return &JobEvent{
+		Time:       time.Now(),
+		Key:        job.Key(),
+		RepGroup:   job.RepGroup,
+		FromState:  from,
+		ToState:    to,
+		Exitcode:   job.Exitcode,
+		Host:       job.Host,
+		FailReason: job.FailReason,
+	}
+}
+
+// EventFilter lets you limit which JobEvents you receive. A nil or empty
+// EventFilter lets through all events.
+type EventFilter struct {
+	// RepGroupPrefix only lets through events for Jobs with a RepGroup that
+	// starts with this.
+	RepGroupPrefix string
+
+	// States only lets through events where the Job changed to one of these
+	// states.
+	States []JobState
+}
+
+// matches tells you if the given event passes this filter.
+func (f *EventFilter) matches(event *JobEvent) bool {
+	if f == nil {
+		return true
+	}
+
+	if !strings.HasPrefix(event.RepGroup, f.RepGroupPrefix) {
+		return false
+	}
+
+	if len(f.States) == 0 {
+		return true
+	}
+
+	for _, state := range f.States {
+		if event.ToState == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate checks that the filter's States are all ones that events can have.
+func (f *EventFilter) validate() error {
+	if f == nil {
+		return nil
+	}
+
+	for _, state := range f.States {
+		if !eventStates[state] {
+			return fmt.Errorf("'%s' is not a valid event state", state)
+		}
+	}
+
+	return nil
+}
+
+// jobEvents stores the most recent JobEvents and lets consumers wait for new
+// ones to be published.
+type jobEvents struct {
+	events  []*JobEvent // the most recent events, oldest first
+	seq     uint64      // Seq of the most recently published event
+	updated chan struct{}
+	stop    chan struct{}
+	stopped bool
+	sync.RWMutex
+}
+
+// newJobEvents creates a new jobEvents.
+func newJobEvents() *jobEvents {
+	return &jobEvents{
+		updated: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+}
+
+// publish gives the supplied events sequence numbers and stores them, waking up
+// anything waiting for new events.
+func (je *jobEvents) publish(events ...*JobEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	je.Lock()
+	defer je.Unlock()
+
+	for _, event := range events {
+		je.seq++
+		event.Seq = je.seq
+		je.events = append(je.events, event)
+	}
+
+	if len(je.events) > 2*eventLogSize {
+		je.events = append([]*JobEvent(nil), je.events[len(je.events)-eventLogSize:]...)
+	}
+
+	close(je.updated)
+	je.updated = make(chan struct{})
+}
+
+// since returns the stored events with a Seq greater than the given seq that
+// pass the given filter, along with the Seq of the most recently published
+// event and a channel that will be closed when more events are published. If
+// seq is greater than any Seq we published (because the server restarted), it
+// is treated as 0.
+func (je *jobEvents) since(seq uint64, filter *EventFilter) ([]*JobEvent, uint64, chan struct{}) {
+	je.RLock()
+	defer je.RUnlock()
+
+	if seq > je.seq {
+		seq = 0
+	}
+
+	i := sort.Search(len(je.events), func(i int) bool {
+		return je.events[i].Seq > seq
+	})
+
+	var events []*JobEvent
+	for _, event := range je.events[i:] {
+		if filter.matches(event) {
+			events = append(events, event)
+		}
+	}
+
+	return events, je.seq, je.updated
+}
+
+// wait is like since(), but if there are no matching events, waits for some to
+// be published. It gives up waiting after the given timeout (if greater than
+// 0), if the context is cancelled, or if close() is called.
+func (je *jobEvents) wait(ctx context.Context, seq uint64, filter *EventFilter, timeout time.Duration) ([]*JobEvent, uint64) {
+	var limit <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		limit = timer.C
+	}
+
+	for {
+		events, latest, updated := je.since(seq, filter)
+		if len(events) > 0 {
+			return events, latest
+		}
+		seq = latest
+
+		select {
+		case <-updated:
+			continue
+		case <-limit:
+		case <-ctx.Done():
+		case <-je.stop:
+		}
+
+		return nil, seq
+	}
+}
+
+// latest returns the Seq of the most recently published event.
+func (je *jobEvents) latest() uint64 {
+	je.RLock()
+	defer je.RUnlock()
+	return je.seq
+}
+
+// close stops anything that is waiting for new events.
+func (je *jobEvents) close() {
+	je.Lock()
+	defer je.Unlock()
+	if !je.stopped {
+		je.stopped = true
+		close(je.stop)
+	}
+}
+
+// isClosed tells you if close() has been called.
+func (je *jobEvents) isClosed() bool {
+	je.RLock()
+	defer je.RUnlock()
+	return je.stopped
+}
+
+// Webhook describes a URL that the server will POST JobEvents to, as a JSON
+// array of JobEvent objects. If Filter is set, only events passing the filter
+// are sent.
+type Webhook struct {
+	URL    string
+	Filter *EventFilter
+}
+
+// ParseWebhooks parses a string specification of webhooks, in the form
+// "url|rep_group_prefix|state,state;url2|...", where the RepGroup prefix and
+// states are optional, returning the corresponding Webhooks.
+func ParseWebhooks(spec string) ([]*Webhook, error) {
+	var hooks []*Webhook
+
+	for _, hookSpec := range strings.Split(spec, ";") {
+		hookSpec = strings.TrimSpace(hookSpec)
+		if hookSpec == "" {
+			continue
+		}
+
+		parts := strings.Split(hookSpec, "|")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("webhook specification '%s' has too many parts", hookSpec)
+		}
+
+		u, err := url.Parse(parts[0])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook specification '%s' does not start with an http(s) URL", hookSpec)
+		}
+
+		hook := &Webhook{URL: parts[0]}
+
+		if len(parts) > 1 {
+			filter := &EventFilter{RepGroupPrefix: parts[1]}
+
+			if len(parts) > 2 && parts[2] != "" {
+				for _, state := range strings.Split(parts[2], ",") {
+					filter.States = append(filter.States, JobState(state))
+				}
+			}
+
+			if err = filter.validate(); err != nil {
+				return nil, fmt.Errorf("webhook specification '%s' is invalid: %w", hookSpec, err)
+			}
+
+			hook.Filter = filter
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// restEvents lets you receive JobEvents as server-sent events. Each event has
+// an id of its Seq, an event type of "job", and data of the JSON encoding of
+// the JobEvent. You can filter the events with the parameters:
+//
+// rep_grp=[prefix] to only get events for Jobs with RepGroups starting with the
+// prefix.
+//
+// state=[state,state] to only get events where Jobs changed to one of these
+// comma-separated states.
+//
+// since=[seq] to first get any remembered events after the one with this Seq.
+// The Last-Event-ID header can also be used for this, as sent by reconnecting
+// EventSource clients.
+func restEvents(ctx context.Context, s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue web server restEvents", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		filter := &EventFilter{RepGroupPrefix: r.Form.Get("rep_grp")}
+		if states := r.Form.Get("state"); states != "" {
+			for _, state := range strings.Split(states, ",") {
+				filter.States = append(filter.States, JobState(state))
+			}
+		}
+		if err := filter.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		since := r.Form.Get("since")
+		if since == "" {
+			since = r.Header.Get("Last-Event-ID")
+		}
+		var seq uint64
+		if since != "" {
+			var err error
+			seq, err = strconv.ParseUint(since, 10, 64)
+			if err != nil {
+				http.Error(w, "since must be a number", http.StatusBadRequest)
+				return
+			}
+		} else {
+			seq = s.events.latest()
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			var events []*JobEvent
+			events, seq = s.events.wait(r.Context(), seq, filter, eventsKeepAliveInterval)
+			if s.events.isClosed() || r.Context().Err() != nil {
+				return
+			}
+
+			var err error
+			if len(events) == 0 {
+				_, err = fmt.Fprint(w, ": keepalive\n\n")
+			}
+
+			for _, event := range events {
+				var data []byte
+				data, err = json.Marshal(event)
+				if err != nil {
+					break
+				}
+
+				_, err = fmt.Fprintf(w, "id: %d\nevent: job\ndata: %s\n\n", event.Seq, data)
+				if err != nil {
+					break
+				}
+			}
+
+			if err != nil {
+				clog.Warn(ctx, "restEvents failed to send events", "err", err)
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+// publishJobEvents creates and publishes JobEvents for the given jobs changing
+// from the from state to the to state. For jobs that were running but have been
+// marked as lost, the from state will be JobStateLost instead. Jobs leaving the
+// queue will have a to state of JobStateComplete if they completed, otherwise
+// JobStateDeleted.
+func (s *Server) publishJobEvents(data []interface{}, from, to JobState) {
+	events := make([]*JobEvent, 0, len(data))
+	for _, inter := range data {
+		job := inter.(*Job)
+		job.RLock()
+		jFrom, jTo := from, to
+		if jFrom == JobStateRunning && job.Lost {
+			jFrom = JobStateLost
+		}
+		if jTo == JobStateDeleted && job.State == JobStateComplete {
+			jTo = JobStateComplete
+		}
+		events = append(events, newJobEvent(job, jFrom, jTo))
+		job.RUnlock()
+	}
+
+	s.events.publish(events...)
+}
+
+// runWebhook sends events to the given webhook as they are published, until
+// the server shuts down.
+func (s *Server) runWebhook(ctx context.Context, hook *Webhook) {
+	defer internal.LogPanic(ctx, "jobqueue webhook", true)
+
+	client := &http.Client{Timeout: ServerWebhookTimeout}
+	seq := s.events.latest()
+
+	for {
+		var events []*JobEvent
+		events, seq = s.events.wait(ctx, seq, hook.Filter, 0)
+		if s.events.isClosed() || ctx.Err() != nil {
+			return
+		}
+
+		if len(events) > 0 {
+			s.sendToWebhook(ctx, client, hook, events)
+		}
+	}
+}
+
+// sendToWebhook POSTs the given events to the webhook, retrying with a
+// doubling delay if it fails, up to ServerWebhookRetries times.
+func (s *Server) sendToWebhook(ctx context.Context, client *http.Client, hook *Webhook, events []*JobEvent) {
+	body, err := json.Marshal(events)
+	if err != nil {
+		clog.Error(ctx, "webhook failed to encode events", "url", hook.URL, "err", err)
+		return
+	}
+
+	wait := ServerWebhookRetryWait
+	for attempt := 0; ; attempt++ {
+		err = postToWebhook(ctx, client, hook.URL, body)
+		if err == nil {
+			return
+		}
+
+		if attempt >= ServerWebhookRetries {
+			clog.Warn(ctx, "webhook failed, giving up on sending events", "url", hook.URL,
+				"events", len(events), "err", err)
+			return
+		}
+
+		select {
+		case <-time.After(wait):
+			wait *= 2
+		case <-s.events.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// postToWebhook does a single POST of the given JSON body to the given url,
+// returning an error if the response was not a 2xx.
+func postToWebhook(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	err = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,293 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the server to track the resource usage of
+// fair-share accounts, and to order the queue according to its
+// FairSharePolicy.
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+// fairShare holds the server's FairSharePolicy and the decayed usage of each
+// account.
+type fairShare struct {
+	policy    *FairSharePolicy
+	usage     map[string]float64
+	decayedAt time.Time
+	factors   map[string]float64
+	stop      chan struct{}
+	stopped   bool
+	sync.Mutex
+}
+
+// newFairShare creates a fairShare that will apply the given policy, which can
+// be nil to not do fair-share.
+func newFairShare(policy *FairSharePolicy) *fairShare {
+	return &fairShare{
+		policy:    policy,
+		usage:     make(map[string]float64),
+		decayedAt: time.Now(),
+		stop:      make(chan struct{}),
+	}
+}
+
+// enabled tells you if we have a policy to apply.
+func (f *fairShare) enabled() bool {
+	return f.policy != nil
+}
+
+// account returns the fair-share account of the given Job, or blank if we're
+// not enabled.
+func (f *fairShare) account(job *Job) string {
+	if !f.enabled() {
+		return ""
+	}
+	return f.policy.account(job)
+}
+
+// schedulerPriority returns the priority that the job scheduler should give to
+// the given Job: its Priority if we're not enabled, otherwise its Priority
+// combined with the fair-share factor of its account.
+func (f *fairShare) schedulerPriority(job *Job) uint8 {
+	job.RLock()
+	priority := job.Priority
+	job.RUnlock()
+
+	if !f.enabled() {
+		return priority
+	}
+
+	account := f.policy.account(job)
+	f.Lock()
+	factor, exists := f.factors[account]
+	f.Unlock()
+	if !exists {
+		factor = 1
+	}
+
+	return fairSharePriority(priority, factor)
+}
+
+// record adds the usage of the given Job's most recent attempt to the usage of
+// its account.
+func (f *fairShare) record(job *Job) {
+	if !f.enabled() {
+		return
+	}
+
+	usage := exitedJobUsage(job)
+	if usage == 0 {
+		return
+	}
+
+	account := f.policy.account(job)
+	f.Lock()
+	defer f.Unlock()
+	f.decay(time.Now())
+	f.usage[account] += usage
+}
+
+// decay decays all the usage we've recorded as of the given time. You must hold
+// the lock before calling this.
+func (f *fairShare) decay(now time.Time) {
+	elapsed := now.Sub(f.decayedAt)
+	if elapsed <= 0 {
+		return
+	}
+
+	for account, usage := range f.usage {
+		f.usage[account] = f.policy.decay(usage, elapsed)
+	}
+	f.decayedAt = now
+}
+
+// currentUsage returns the decayed usage of each account as of the given time,
+// including the usage so far of the given running Jobs.
+func (f *fairShare) currentUsage(now time.Time, running []interface{}) map[string]float64 {
+	f.Lock()
+	f.decay(now)
+	usage := make(map[string]float64, len(f.usage))
+	for account, u := range f.usage {
+		usage[account] = u
+	}
+	f.Unlock()
+
+	for _, inter := range running {
+		job := inter.(*Job)
+		usage[f.policy.account(job)] += runningJobUsage(job, now)
+	}
+
+	return usage
+}
+
+// accounts returns the sorted names of all the accounts in the given usage and
+// our policy's Shares, along with any additional given names.
+func (f *fairShare) accounts(usage map[string]float64, additional ...string) []string {
+	seen := make(map[string]bool)
+	for account := range usage {
+		seen[account] = true
+	}
+	for account := range f.policy.Shares {
+		seen[account] = true
+	}
+	for _, account := range additional {
+		seen[account] = true
+	}
+
+	accounts := make([]string, 0, len(seen))
+	for account := range seen {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+
+	return accounts
+}
+
+// startFairShare loads the historical usage of complete Jobs from the
+// database, then recalculates fair-share factors and reorders the queue every
+// ServerFairShareInterval. Does nothing if we have no FairSharePolicy.
+func (s *Server) startFairShare(ctx context.Context) {
+	if !s.fairShare.enabled() {
+		return
+	}
+
+	go func() {
+		defer internal.LogPanic(ctx, "jobqueue fair-share", true)
+
+		now := time.Now()
+		usage, err := s.db.retrieveFairShareUsage(s.fairShare.policy, now)
+		if err != nil {
+			clog.Warn(ctx, "retrieving historical fair-share usage failed", "err", err)
+		}
+
+		s.fairShare.Lock()
+		s.fairShare.decay(now)
+		for account, u := range usage {
+			s.fairShare.usage[account] += u
+		}
+		s.fairShare.Unlock()
+
+		s.updateFairShare(ctx, now)
+
+		ticker := time.NewTicker(ServerFairShareInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.updateFairShare(ctx, now)
+			case <-s.fairShare.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopFairShare stops fair-share factors from being recalculated.
+func (s *Server) stopFairShare() {
+	s.fairShare.Lock()
+	defer s.fairShare.Unlock()
+	if !s.fairShare.stopped {
+		close(s.fairShare.stop)
+		s.fairShare.stopped = true
+	}
+}
+
+// updateFairShare recalculates the fair-share factor of each account as of the
+// given time, and reorders the queue accordingly.
+func (s *Server) updateFairShare(ctx context.Context, now time.Time) {
+	usage := s.fairShare.currentUsage(now, s.q.GetRunningData())
+	factors := s.fairShare.policy.fairShareFactors(usage, s.fairShare.accounts(usage))
+
+	s.fairShare.Lock()
+	s.fairShare.factors = factors
+	s.fairShare.Unlock()
+
+	s.q.SetFairShare(factors)
+	clog.Debug(ctx, "updated fair-share factors", "accounts", len(factors))
+}
+
+// fairShareReport returns the current fair-share state of every account,
+// sorted by Name. Returns nil if we have no FairSharePolicy.
+func (s *Server) fairShareReport() []*FairShareAccount {
+	if !s.fairShare.enabled() {
+		return nil
+	}
+
+	now := time.Now()
+	usage := s.fairShare.currentUsage(now, s.q.GetRunningData())
+
+	ready := make(map[string]int)
+	running := make(map[string]int)
+	for _, item := range s.q.AllItems() {
+		var counts map[string]int
+		switch item.Stats().State {
+		case queue.ItemStateReady:
+			counts = ready
+		case queue.ItemStateRun:
+			counts = running
+		default:
+			continue
+		}
+
+		counts[s.fairShare.policy.account(item.Data().(*Job))]++
+	}
+
+	var jobAccounts []string
+	for _, counts := range []map[string]int{ready, running} {
+		for account := range counts {
+			jobAccounts = append(jobAccounts, account)
+		}
+	}
+
+	accounts := s.fairShare.accounts(usage, jobAccounts...)
+	factors := s.fairShare.policy.fairShareFactors(usage, accounts)
+
+	var totalUsage, totalShares float64
+	for _, account := range accounts {
+		totalUsage += usage[account]
+		totalShares += s.fairShare.policy.share(account)
+	}
+
+	report := make([]*FairShareAccount, len(accounts))
+	for i, account := range accounts {
+		fsa := &FairShareAccount{
+			Name:    account,
+			Share:   s.fairShare.policy.share(account) / totalShares,
+			Usage:   usage[account],
+			Factor:  factors[account],
+			Ready:   ready[account],
+			Running: running[account],
+		}
+		if totalUsage > 0 {
+			fsa.UsageFraction = usage[account] / totalUsage
+		}
+		report[i] = fsa
+	}
+
+	return report
+}
@@ -0,0 +1,579 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the server to store the output that running
+// Cmds stream to it, and let clients tail that output via the client protocol
+// and a server-sent events REST endpoint.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+const (
+	// LogStreamStdout is the LogChunk.Stream of output a Cmd wrote to STDOUT.
+	LogStreamStdout = "stdout"
+
+	// LogStreamStderr is the LogChunk.Stream of output a Cmd wrote to STDERR.
+	LogStreamStderr = "stderr"
+
+	// jobLogBufferSize is the number of bytes of the most recent output of
+	// each running Cmd that the server remembers.
+	jobLogBufferSize = 1024 * 1024
+
+	// jobLogLinger is how long the server remembers the output of a Cmd after
+	// it stops running, so that anyone tailing it can get the last of it.
+	jobLogLinger = 1 * time.Minute
+
+	// jobLogFilePermission is the permission of the files the server persists
+	// output to.
+	jobLogFilePermission = 0o600
+)
+
+// logStreams are the valid LogChunk.Streams, in the order that persisted
+// output is returned.
+var logStreams = []string{LogStreamStdout, LogStreamStderr}
+
+// LogChunk is some of the output of a running Job's Cmd. Seq is a number that
+// increments with each chunk the server receives for a particular run of the
+// Job, which you can use to ask for only chunks you haven't seen yet. Stream is
+// LogStreamStdout or LogStreamStderr.
+//
+// Like the StdOut and StdErr of Jobs, Data has been filtered to remove most of
+// the lines of progress bars.
+type LogChunk struct {
+	Seq    uint64
+	Time   time.Time
+	Stream string
+	Data   string
+}
+
+// jobLog stores the most recent output of one run of a Job's Cmd.
+type jobLog struct {
+	chunks  []*LogChunk // the most recent chunks, oldest first
+	size    int         // total length of the Data of chunks
+	seq     uint64      // Seq of the most recently stored chunk
+	done    bool        // true once the Cmd is no longer running
+	updated chan struct{}
+	files   map[string]*cappedFile
+}
+
+// jobLogs stores the output that running Cmds stream to the server, and lets
+// consumers wait for more to arrive. It can also persist all of the output to
+// files in a directory, up to a maximum size per file.
+type jobLogs struct {
+	logs    map[string]*jobLog
+	dir     string
+	maxSize int64
+	created chan struct{}
+	stop    chan struct{}
+	stopped bool
+	sync.RWMutex
+}
+
+// newJobLogs creates a new jobLogs. If dir is not blank and maxSize is greater
+// than 0, all output (up to maxSize bytes of each of STDOUT and STDERR of each
+// Job) will also be written to files in dir.
+func newJobLogs(dir string, maxSize int64) *jobLogs {
+	if maxSize <= 0 {
+		dir = ""
+	}
+
+	return &jobLogs{
+		logs:    make(map[string]*jobLog),
+		dir:     dir,
+		maxSize: maxSize,
+		created: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+}
+
+// start begins storing output for a new run of the Job with the given key,
+// forgetting the output of any previous run.
+func (jl *jobLogs) start(ctx context.Context, key string) {
+	jl.Lock()
+	defer jl.Unlock()
+	jl.startLocked(ctx, key)
+}
+
+// startLocked is start() for when you already hold the lock.
+func (jl *jobLogs) startLocked(ctx context.Context, key string) *jobLog {
+	if old, exists := jl.logs[key]; exists {
+		jl.finishLog(ctx, old)
+	}
+
+	log := &jobLog{updated: make(chan struct{})}
+
+	if jl.dir != "" {
+		log.files = make(map[string]*cappedFile, len(logStreams))
+		for _, stream := range logStreams {
+			log.files[stream] = &cappedFile{path: jl.filePath(key, stream), max: jl.maxSize}
+		}
+	}
+
+	jl.logs[key] = log
+
+	close(jl.created)
+	jl.created = make(chan struct{})
+
+	return log
+}
+
+// filePath returns the path of the file that the given stream of the Job with
+// the given key is persisted to.
+func (jl *jobLogs) filePath(key, stream string) string {
+	dir, leaf := calculateHashedDir(jl.dir, key)
+
+	return filepath.Join(dir, leaf+"."+stream)
+}
+
+// append gives the supplied chunks sequence numbers and stores them for the
+// Job with the given key, waking up anything waiting for more output. If start()
+// wasn't called for the Job (because we restarted while it was running), it is
+// called now.
+func (jl *jobLogs) append(ctx context.Context, key string, chunks []*LogChunk) {
+	if len(chunks) == 0 {
+		return
+	}
+
+	jl.Lock()
+	defer jl.Unlock()
+
+	log, exists := jl.logs[key]
+	if !exists || log.done {
+		log = jl.startLocked(ctx, key)
+	}
+
+	now := time.Now()
+	for _, chunk := range chunks {
+		log.seq++
+		chunk.Seq = log.seq
+		chunk.Time = now
+		log.chunks = append(log.chunks, chunk)
+		log.size += len(chunk.Data)
+
+		if file := log.files[chunk.Stream]; file != nil {
+			if err := file.write(chunk.Data); err != nil {
+				clog.Warn(ctx, "failed to persist job output", "path", file.path, "err", err)
+			}
+		}
+	}
+
+	drop := 0
+	for log.size > jobLogBufferSize && drop < len(log.chunks)-1 {
+		log.size -= len(log.chunks[drop].Data)
+		drop++
+	}
+
+	if drop > 0 {
+		log.chunks = append([]*LogChunk(nil), log.chunks[drop:]...)
+	}
+
+	close(log.updated)
+	log.updated = make(chan struct{})
+}
+
+// finish notes that the Cmd of the Job with the given key is no longer running,
+// waking up anything waiting for its output. Its output is forgotten after
+// jobLogLinger.
+func (jl *jobLogs) finish(ctx context.Context, key string) {
+	jl.Lock()
+	defer jl.Unlock()
+
+	log, exists := jl.logs[key]
+	if !exists || log.done {
+		return
+	}
+
+	jl.finishLog(ctx, log)
+
+	time.AfterFunc(jobLogLinger, func() {
+		jl.Lock()
+		defer jl.Unlock()
+
+		if jl.logs[key] == log {
+			delete(jl.logs, key)
+		}
+	})
+}
+
+// finishLog marks the given log as done and closes its files. You must hold
+// the lock.
+func (jl *jobLogs) finishLog(ctx context.Context, log *jobLog) {
+	if log.done {
+		return
+	}
+
+	log.done = true
+
+	for _, file := range log.files {
+		if err := file.close(); err != nil {
+			clog.Warn(ctx, "failed to close persisted job output", "path", file.path, "err", err)
+		}
+	}
+
+	close(log.updated)
+	log.updated = make(chan struct{})
+}
+
+// since returns the stored chunks for the Job with the given key with a Seq
+// greater than the given seq, along with the Seq of the most recently stored
+// chunk and whether the Job's Cmd is still running. If seq is greater than any
+// Seq we stored (because the Job started running again, or we restarted), it is
+// treated as 0.
+//
+// Also returns a channel that will be closed when more output is stored or the
+// Cmd stops running. If the Cmd is not running, this will instead be closed
+// when we start storing output for any Job.
+func (jl *jobLogs) since(key string, seq uint64) ([]*LogChunk, uint64, bool, chan struct{}) {
+	jl.RLock()
+	defer jl.RUnlock()
+
+	log, exists := jl.logs[key]
+	if !exists {
+		return nil, 0, false, jl.created
+	}
+
+	if seq > log.seq {
+		seq = 0
+	}
+
+	i := sort.Search(len(log.chunks), func(i int) bool {
+		return log.chunks[i].Seq > seq
+	})
+
+	var chunks []*LogChunk
+	if i < len(log.chunks) {
+		chunks = append(chunks, log.chunks[i:]...)
+	}
+
+	if log.done {
+		return chunks, log.seq, false, jl.created
+	}
+
+	return chunks, log.seq, true, log.updated
+}
+
+// wait is like since(), but if there are no new chunks and the Cmd is still
+// running, waits for more to be stored. If the Cmd is not running, we only wait
+// for it to start running again if running is true (ie. the Job has been
+// reserved but not yet started). It gives up waiting
+// after the given timeout, if the context is cancelled, or if close() is
+// called. If timeout is 0, it doesn't wait at all.
+func (jl *jobLogs) wait(ctx context.Context, key string, seq uint64, timeout time.Duration,
+	running bool) ([]*LogChunk, uint64, bool) {
+	var limit <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		limit = timer.C
+	}
+
+	for {
+		chunks, latest, live, updated := jl.since(key, seq)
+		if len(chunks) > 0 || timeout <= 0 || (!live && !running) {
+			return chunks, latest, live
+		}
+		seq = latest
+
+		select {
+		case <-updated:
+			continue
+		case <-limit:
+		case <-ctx.Done():
+		case <-jl.stop:
+		}
+
+		return nil, seq, live
+	}
+}
+
+// persisted returns the output of the Job with the given key that was written
+// to files, one chunk per stream, in the order of logStreams. Returns nothing if
+// we are not persisting output or there are no files for the Job.
+func (jl *jobLogs) persisted(key string) ([]*LogChunk, error) {
+	if jl.dir == "" {
+		return nil, nil
+	}
+
+	var chunks []*LogChunk
+
+	for _, stream := range logStreams {
+		path := jl.filePath(key, stream)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		chunk := &LogChunk{Stream: stream, Data: string(data)}
+		if info, errs := os.Stat(path); errs == nil {
+			chunk.Time = info.ModTime()
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, nil
+}
+
+// close stops anything that is waiting for more output, and closes any files
+// we are writing output to.
+func (jl *jobLogs) close(ctx context.Context) {
+	jl.Lock()
+	defer jl.Unlock()
+
+	if jl.stopped {
+		return
+	}
+
+	jl.stopped = true
+	close(jl.stop)
+
+	for _, log := range jl.logs {
+		jl.finishLog(ctx, log)
+	}
+}
+
+// isClosed tells you if close() has been called.
+func (jl *jobLogs) isClosed() bool {
+	jl.RLock()
+	defer jl.RUnlock()
+
+	return jl.stopped
+}
+
+// cappedFile is a file that is created on first write, and that stops being
+// written to once it reaches a maximum size.
+type cappedFile struct {
+	path    string
+	max     int64
+	file    *os.File
+	written int64
+	capped  bool
+}
+
+// write appends data to the file, truncating it and noting that in the file if
+// this would make the file larger than its max.
+func (cf *cappedFile) write(data string) error {
+	if cf.capped {
+		return nil
+	}
+
+	if cf.file == nil {
+		if err := os.MkdirAll(filepath.Dir(cf.path), os.ModePerm); err != nil {
+			cf.capped = true
+
+			return err
+		}
+
+		f, err := os.OpenFile(cf.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, jobLogFilePermission)
+		if err != nil {
+			cf.capped = true
+
+			return err
+		}
+
+		cf.file = f
+	}
+
+	if remaining := cf.max - cf.written; int64(len(data)) > remaining {
+		data = data[:remaining] + fmt.Sprintf("\n[wr: output truncated at %d bytes]\n", cf.max)
+		cf.capped = true
+	}
+
+	n, err := cf.file.WriteString(data)
+	cf.written += int64(n)
+
+	return err
+}
+
+// close closes the file if write() opened it.
+func (cf *cappedFile) close() error {
+	if cf.file == nil {
+		return nil
+	}
+
+	err := cf.file.Close()
+	cf.file = nil
+	cf.capped = true
+
+	return err
+}
+
+// getJobLogs gets the output of the Job with the given key that was streamed to
+// us after the chunk with the given Seq, waiting up to timeout for more if
+// there is none and the Job is running. Also returns the Seq of the latest
+// chunk, and whether more output might arrive in the future.
+//
+// If seq is 0 and the Job is not running, but we persisted its output to files,
+// returns the full output from those files instead.
+func (s *Server) getJobLogs(ctx context.Context, key string, seq uint64, timeout time.Duration) ([]*LogChunk, uint64, bool, error) {
+	running := false
+	if item, err := s.q.Get(key); err == nil && item.Stats().State == queue.ItemStateRun {
+		running = true
+	}
+
+	chunks, latest, live := s.logs.wait(ctx, key, seq, timeout, running)
+	if live || running {
+		return chunks, latest, true, nil
+	}
+
+	if seq == 0 {
+		persisted, err := s.logs.persisted(key)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		if len(persisted) > 0 {
+			return persisted, 0, false, nil
+		}
+	}
+
+	return chunks, latest, false, nil
+}
+
+// restLogs lets you receive the output of a Job's Cmd as server-sent events.
+// The request url must be suffixed with the job's key, eg. /rest/v1/logs/[key].
+// Each event has an id of the LogChunk's Seq, an event type of "log", and data
+// of the JSON encoding of the LogChunk. Once there will be no more output, an
+// event of type "end" is sent and the stream is closed. You can alter the
+// output with the parameters:
+//
+// follow=true to keep sending output as it arrives while the Cmd is running.
+// Otherwise only the output remembered so far is sent.
+//
+// since=[seq] to only get remembered output after the chunk with this Seq. The
+// Last-Event-ID header can also be used for this, as sent by reconnecting
+// EventSource clients.
+func restLogs(ctx context.Context, s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue web server restLogs", false)
+
+		user, ok := s.httpUser(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Path, restLogsEndpoint)
+		if key == "" || strings.Contains(key, "/") {
+			http.Error(w, "a job key must be supplied", http.StatusBadRequest)
+			return
+		}
+
+		if !s.ownsJobKey(user, key) {
+			http.Error(w, ErrNotOwner, http.StatusForbidden)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		since := r.Form.Get("since")
+		if since == "" {
+			since = r.Header.Get("Last-Event-ID")
+		}
+		var seq uint64
+		if since != "" {
+			var err error
+			seq, err = strconv.ParseUint(since, 10, 64)
+			if err != nil {
+				http.Error(w, "since must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var timeout time.Duration
+		if r.Form.Get("follow") == restFormTrue {
+			timeout = eventsKeepAliveInterval
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			chunks, latest, more, err := s.getJobLogs(r.Context(), key, seq, timeout)
+			if s.logs.isClosed() || r.Context().Err() != nil {
+				return
+			}
+			seq = latest
+
+			if err == nil && len(chunks) == 0 && more && timeout > 0 {
+				_, err = fmt.Fprint(w, ": keepalive\n\n")
+			}
+
+			for _, chunk := range chunks {
+				if err != nil {
+					break
+				}
+
+				var data []byte
+				data, err = json.Marshal(chunk)
+				if err != nil {
+					break
+				}
+
+				_, err = fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", chunk.Seq, data)
+			}
+
+			if err == nil && (!more || timeout == 0) {
+				_, err = fmt.Fprint(w, "event: end\ndata: {}\n\n")
+				flusher.Flush()
+
+				return
+			}
+
+			if err != nil {
+				clog.Warn(ctx, "restLogs failed to send output", "err", err)
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the server to provide metrics in the
+// Prometheus text exposition format.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+const (
+	metricsEndpoint    = "/metrics"
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	metricsGauge       = "gauge"
+)
+
+// metricsLabelEscaper escapes label values as required by the Prometheus text
+// format.
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter builds up the text of our metrics page.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+// family writes the HELP and TYPE lines for a new metric.
+func (m *metricsWriter) family(name, help, kind string) {
+	fmt.Fprintf(m, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value for a metric, with optional label name and value
+// pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.WriteString(name)
+
+	if len(labels) > 1 {
+		m.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.WriteString(",")
+			}
+			fmt.Fprintf(m, `%s="%s"`, labels[i], metricsLabelEscaper.Replace(labels[i+1]))
+		}
+		m.WriteString("}")
+	}
+
+	fmt.Fprintf(m, " %s\n", strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// sampleMap writes a value for each entry in the given map, using the map key
+// as the value of the given label. Entries are written in sorted key order.
+func (m *metricsWriter) sampleMap(name, label string, values map[string]int) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		m.sample(name, float64(values[key]), label, key)
+	}
+}
+
+// webMetrics lets Prometheus (or compatible) scrapers get metrics on the state
+// of the queue, limit groups, scheduler, cloud servers and database backups.
+// Like the REST API, you must be authorized with the token in an
+// "Authorization: Bearer" header.
+func webMetrics(ctx context.Context, s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue web server metrics", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		m := &metricsWriter{}
+		s.queueMetrics(ctx, m)
+		s.limitGroupMetrics(m)
+		s.schedulerMetrics(m)
+		s.dbMetrics(m)
+
+		w.Header().Set("Content-Type", metricsContentType)
+		w.WriteHeader(http.StatusOK)
+		_, err := m.WriteTo(w)
+		if err != nil {
+			clog.Warn(ctx, "webMetrics failed to write metrics", "err", err)
+		}
+	}
+}
+
+// queueMetrics adds metrics on the size of the queue's sub-queues and the
+// states of jobs in each RepGroup.
+func (s *Server) queueMetrics(ctx context.Context, m *metricsWriter) {
+	stats := s.q.Stats()
+
+	m.family("wr_queue_items", "Number of items in the queue.", metricsGauge)
+	m.sample("wr_queue_items", float64(stats.Items))
+
+	m.family("wr_queue_subqueue_items", "Number of items in each sub-queue of the queue.", metricsGauge)
+	m.sampleMap("wr_queue_subqueue_items", "subqueue", map[string]int{
+		"delayed":   stats.Delayed,
+		"ready":     stats.Ready,
+		"running":   stats.Running,
+		"buried":    stats.Buried,
+		"dependent": stats.Dependant,
+	})
+
+	counts := make(map[string]map[string]int)
+	for _, item := range s.q.AllItems() {
+		job := item.Data().(*Job)
+		job.RLock()
+		repGroup := job.RepGroup
+		lost := job.Lost
+		job.RUnlock()
+
+		// as in the web interface, merge reserved in to running
+		state := s.itemStateToJobState(item.Stats().State, lost)
+		if state == JobStateReserved {
+			state = JobStateRunning
+		}
+
+		if counts[repGroup] == nil {
+			counts[repGroup] = make(map[string]int)
+		}
+		counts[repGroup][string(state)]++
+	}
+
+	repGroups := make([]string, 0, len(counts))
+	for repGroup := range counts {
+		repGroups = append(repGroups, repGroup)
+	}
+	sort.Strings(repGroups)
+
+	m.family("wr_jobs", "Number of incomplete jobs in each state, per RepGroup.", metricsGauge)
+	for _, repGroup := range repGroups {
+		states := make([]string, 0, len(counts[repGroup]))
+		for state := range counts[repGroup] {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+
+		for _, state := range states {
+			m.sample("wr_jobs", float64(counts[repGroup][state]), "rep_group", repGroup, "state", state)
+		}
+	}
+}
+
+// limitGroupMetrics adds metrics on the usage and capacity of limit groups.
+func (s *Server) limitGroupMetrics(m *metricsWriter) {
+	m.family("wr_limit_group_limit", "The maximum number of jobs that can run in each limit group.", metricsGauge)
+	m.sampleMap("wr_limit_group_limit", "limit_group", s.limiter.GetLimits())
+
+	m.family("wr_limit_group_usage", "The number of jobs currently running in each limit group.", metricsGauge)
+	m.sampleMap("wr_limit_group_usage", "limit_group", s.limiter.GetUsage())
+}
+
+// schedulerMetrics adds metrics on the runners requested per scheduler group,
+// scheduler issues, and cloud servers.
+func (s *Server) schedulerMetrics(m *metricsWriter) {
+	requested := make(map[string]int)
+	s.psgmutex.RLock()
+	for name, group := range s.previouslyScheduledGroups {
+		requested[name] = group.getCount()
+	}
+	s.psgmutex.RUnlock()
+
+	m.family("wr_scheduler_runners", "Number of runners requested from the job scheduler for each scheduler group.", metricsGauge)
+	m.sampleMap("wr_scheduler_runners", "scheduler_group", requested)
+
+	s.simutex.RLock()
+	issues := len(s.schedIssues)
+	s.simutex.RUnlock()
+
+	m.family("wr_scheduler_issues", "Number of distinct issues reported by the job scheduler.", metricsGauge)
+	m.sample("wr_scheduler_issues", float64(issues))
+
+	if servers := s.scheduler.CloudServers(); servers >= 0 {
+		m.family("wr_cloud_servers", "Number of cloud servers currently spawned by the scheduler.", metricsGauge)
+		m.sample("wr_cloud_servers", float64(servers))
+	}
+
+	s.bsmutex.RLock()
+	bad := 0
+	for _, server := range s.badServers {
+		if server.IsBad() {
+			bad++
+		}
+	}
+	s.bsmutex.RUnlock()
+
+	m.family("wr_cloud_bad_servers", "Number of cloud servers that are currently not working.", metricsGauge)
+	m.sample("wr_cloud_bad_servers", float64(bad))
+}
+
+// dbMetrics adds metrics on the age and duration of the latest automatic
+// database backup, if any.
+func (s *Server) dbMetrics(m *metricsWriter) {
+	last, duration := s.db.backupStats()
+	if last.IsZero() {
+		return
+	}
+
+	m.family("wr_db_backup_age_seconds", "Seconds since the last database backup completed.", metricsGauge)
+	m.sample("wr_db_backup_age_seconds", time.Since(last).Seconds())
+
+	m.family("wr_db_backup_duration_seconds", "How long the last database backup took, in seconds.", metricsGauge)
+	m.sample("wr_db_backup_duration_seconds", duration.Seconds())
+}
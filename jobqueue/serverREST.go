@@ -23,12 +23,15 @@ package jobqueue
 // with the job queue using JSON over HTTP.
 
 import (
+	"bytes"
 	"context"
+	_ "embed" // to embed the OpenAPI document
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -37,6 +40,8 @@ import (
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/VertebrateResequencing/wr/internal"
 	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/limiter"
+	"github.com/VertebrateResequencing/wr/queue"
 	"github.com/ugorji/go/codec"
 	"github.com/wtsi-ssg/wr/clog"
 )
@@ -48,11 +53,26 @@ const (
 	restWarningsEndpoint   = "/rest/v" + restAPIVersion + "/warnings/"
 	restBadServersEndpoint = "/rest/v" + restAPIVersion + "/servers/"
 	restFileUploadEndpoint = "/rest/v" + restAPIVersion + "/upload/"
+	restCopiedEndpoint     = "/rest/v" + restAPIVersion + "/copied/"
 	restInfoEndpoint       = "/rest/v" + restAPIVersion + "/info/"
+	restEventsEndpoint     = "/rest/v" + restAPIVersion + "/events/"
+	restLogsEndpoint       = "/rest/v" + restAPIVersion + "/logs/"
+	restCronsEndpoint      = "/rest/v" + restAPIVersion + "/crons/"
+	restUsersEndpoint      = "/rest/v" + restAPIVersion + "/users/"
+	restLimitsEndpoint     = "/rest/v" + restAPIVersion + "/limits/"
+	restManagerEndpoint    = "/rest/v" + restAPIVersion + "/manager/"
+	restBackupEndpoint     = "/rest/v" + restAPIVersion + "/backup/"
+	restOpenAPIEndpoint    = "/rest/v" + restAPIVersion + "/openapi.json"
 	restFormTrue           = "true"
+	restNextCursorHeader   = "X-Next-Cursor"
 	bearerSchema           = "Bearer "
 )
 
+// openAPIDocument describes our REST API in OpenAPI format.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
 // JobViaJSON describes the properties of a JOB that a user wishes to add to the
 // queue, convenient if they are supplying JSON.
 type JobViaJSON struct {
@@ -61,6 +81,7 @@ type JobViaJSON struct {
 	DepGrps      []string          `json:"dep_grps"`
 	Deps         []string          `json:"deps"`
 	CmdDeps      Dependencies      `json:"cmd_deps"`
+	OnDepFail    string            `json:"on_dep_fail"`
 	OnFailure    BehavioursViaJSON `json:"on_failure"`
 	OnSuccess    BehavioursViaJSON `json:"on_success"`
 	OnExit       BehavioursViaJSON `json:"on_exit"`
@@ -93,11 +114,20 @@ type JobViaJSON struct {
 	Priority              *int   `json:"priority"`
 	Retries               *int   `json:"retries"`
 	NoRetriesOverWalltime string `json:"no_retry_over_walltime"`
+	RetryPolicy           string `json:"retry_policy"`
+	Checkpoint            string `json:"checkpoint"`
+	Resources             string `json:"resources"`
 	CloudOSRam            *int   `json:"cloud_ram"`
 	RTimeout              *int   `json:"reserve_timeout"`
 	CwdMatters            bool   `json:"cwd_matters"`
 	ChangeHome            bool   `json:"change_home"`
 	CloudShared           bool   `json:"cloud_shared"`
+	// ArrayTable makes this a job array, with cmd as the template. The first
+	// row gives the parameter names, and subsequent rows the values.
+	ArrayTable [][]string `json:"array_table"`
+	// ArrayRanges makes this a job array, with cmd as the template. Each entry
+	// is an integer parameter in the form name=start-end[:step].
+	ArrayRanges []string `json:"array_ranges"`
 }
 
 // JobDefaults is supplied to JobViaJSON.Convert() to provide default values for
@@ -106,6 +136,7 @@ type JobDefaults struct {
 	LimitGroups   []string
 	DepGroups     []string
 	Deps          Dependencies
+	OnDepFailure  DepFailureAction
 	OnFailure     Behaviours
 	OnSuccess     Behaviours
 	OnExit        Behaviours
@@ -143,9 +174,17 @@ type JobDefaults struct {
 	Override int
 	Priority int
 	Retries  int
+	// Resources are the named consumable resources (eg. gpu) each cmd will
+	// use, and how many of each.
+	Resources map[string]int
 	// NoRetriesOverWalltime is the amount of time that a cmd can run for and
 	// then fail and still automatically retry.
 	NoRetriesOverWalltime time.Duration
+	// RetryPolicy controls how failed cmds are retried; nil for the default.
+	RetryPolicy *RetryPolicy
+	// Checkpoint describes how cmds save their state so they can be resumed;
+	// nil for no checkpointing.
+	Checkpoint *Checkpoint
 	// CloudOSRam is the number of Megabytes that CloudOS needs to run. Defaults
 	// to 1000.
 	CloudOSRam int
@@ -156,6 +195,8 @@ type JobDefaults struct {
 	// being provided with a value of 0 or more.
 	DiskSet     bool
 	CloudShared bool
+	// Array turns the jobs in to job arrays.
+	Array *JobArray
 }
 
 // DefaultCwd returns the Cwd value, defaulting to /tmp.
@@ -239,6 +280,15 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		return nil, fmt.Errorf("cmd was not specified")
 	}
 
+	array := jd.Array
+	if len(jvj.ArrayTable) > 0 || len(jvj.ArrayRanges) > 0 {
+		var err error
+		array, err = jvj.jobArray()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if jvj.Cwd == "" {
 		cwd = jd.DefaultCwd()
 	} else {
@@ -337,6 +387,33 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		}
 	}
 
+	retryPolicy := jd.RetryPolicy
+	if jvj.RetryPolicy != "" {
+		var err error
+		retryPolicy, err = ParseRetryPolicy(jvj.RetryPolicy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resources := jd.Resources
+	if jvj.Resources != "" {
+		var err error
+		resources, err = jqs.ParseResources(jvj.Resources)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	checkpoint := jd.Checkpoint
+	if jvj.Checkpoint != "" {
+		var err error
+		checkpoint, err = ParseCheckpoint(jvj.Checkpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if len(jvj.LimitGrps) == 0 {
 		limitGroups = jd.LimitGroups
 	} else {
@@ -357,11 +434,21 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		}
 		if len(jvj.Deps) > 0 {
 			for _, depgroup := range jvj.Deps {
-				deps = append(deps, NewDepGroupDependency(depgroup))
+				group, mode := SplitDependencyMode(depgroup)
+				deps = append(deps, NewConditionalDependency(NewDepGroupDependency(group), mode))
 			}
 		}
 	}
 
+	onDepFailure := jd.OnDepFailure
+	if jvj.OnDepFail != "" {
+		var err error
+		onDepFailure, err = ParseDepFailureAction(jvj.OnDepFail)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if len(jvj.Env) > 0 {
 		var err error
 		envOverride, err = compressEnv(jvj.Env)
@@ -507,14 +594,17 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		CwdMatters:            cwdMatters,
 		ChangeHome:            changeHome,
 		ReqGroup:              rg,
-		Requirements:          &jqs.Requirements{RAM: mb, Time: dur, Cores: cpus, Disk: disk, DiskSet: diskSet, Other: other},
+		Requirements:          &jqs.Requirements{RAM: mb, Time: dur, Cores: cpus, Disk: disk, DiskSet: diskSet, Other: other, Resources: jqs.CopyResources(resources)},
 		Override:              uint8(override),
 		Priority:              uint8(priority),
 		Retries:               uint8(retries),
 		NoRetriesOverWalltime: noRetry,
+		RetryPolicy:           retryPolicy,
+		Checkpoint:            checkpoint,
 		LimitGroups:           limitGroups,
 		DepGroups:             depGroups,
 		Dependencies:          deps,
+		OnDepFailure:          onDepFailure,
 		EnvOverride:           envOverride,
 		Behaviours:            behaviours,
 		MountConfigs:          mounts,
@@ -523,17 +613,277 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		WithSingularity:       withSingularity,
 		ContainerMounts:       containerMounts,
 		BsubMode:              bsubMode,
+		Array:                 array,
 	}, nil
 }
 
+// ModifierViaJSON describes the changes a user wishes to make to existing Jobs,
+// convenient if they are supplying JSON. Only the properties that are supplied
+// are changed; supplying an empty list for env, limit_grps, deps, cmd_deps or
+// one of the behaviours clears that property. Properties have the same meaning
+// as in JobViaJSON.
+type ModifierViaJSON struct {
+	MountConfigs          MountConfigs      `json:"mounts"`
+	LimitGrps             []string          `json:"limit_grps"`
+	Deps                  []string          `json:"deps"`
+	CmdDeps               Dependencies      `json:"cmd_deps"`
+	OnFailure             BehavioursViaJSON `json:"on_failure"`
+	OnSuccess             BehavioursViaJSON `json:"on_success"`
+	OnExit                BehavioursViaJSON `json:"on_exit"`
+	Env                   []string          `json:"env"`
+	Cmd                   *string           `json:"cmd"`
+	Cwd                   *string           `json:"cwd"`
+	ReqGrp                *string           `json:"req_grp"`
+	Memory                *string           `json:"memory"`
+	Time                  *string           `json:"time"`
+	MonitorDocker         *string           `json:"monitor_docker"`
+	WithDocker            *string           `json:"with_docker"`
+	WithSingularity       *string           `json:"with_singularity"`
+	ContainerMounts       *string           `json:"container_mounts"`
+	CloudOS               *string           `json:"cloud_os"`
+	CloudUser             *string           `json:"cloud_username"`
+	CloudFlavor           *string           `json:"cloud_flavor"`
+	SchedulerQueue        *string           `json:"queue"`
+	SchedulerQueuesAvoid  *string           `json:"queues_avoid"`
+	BsubMode              *string           `json:"bsub_mode"`
+	NoRetriesOverWalltime *string           `json:"no_retry_over_walltime"`
+	RetryPolicy           *string           `json:"retry_policy"`
+	Resources             *string           `json:"resources"`
+	CPUs                  *float64          `json:"cpus"`
+	Disk                  *int              `json:"disk"`
+	Override              *int              `json:"override"`
+	Priority              *int              `json:"priority"`
+	Retries               *int              `json:"retries"`
+	CloudOSRam            *int              `json:"cloud_ram"`
+	CwdMatters            *bool             `json:"cwd_matters"`
+	ChangeHome            *bool             `json:"change_home"`
+	CloudShared           *bool             `json:"cloud_shared"`
+}
+
+// Modifier converts a ModifierViaJSON in to a JobModifier.
+func (mvj *ModifierViaJSON) Modifier() (*JobModifier, error) {
+	jm := NewJobModifer()
+
+	if mvj.Cmd != nil {
+		if *mvj.Cmd == "" {
+			return nil, fmt.Errorf("cmd can't be modified to be empty")
+		}
+		jm.SetCmd(*mvj.Cmd)
+	}
+	if mvj.Cwd != nil {
+		jm.SetCwd(*mvj.Cwd)
+	}
+	if mvj.CwdMatters != nil {
+		jm.SetCwdMatters(*mvj.CwdMatters)
+	}
+	if mvj.ChangeHome != nil {
+		jm.SetChangeHome(*mvj.ChangeHome)
+	}
+	if mvj.ReqGrp != nil {
+		jm.SetReqGroup(*mvj.ReqGrp)
+	}
+	if mvj.LimitGrps != nil {
+		jm.SetLimitGroups(mvj.LimitGrps)
+	}
+
+	req, err := mvj.requirements()
+	if err != nil {
+		return nil, err
+	}
+	if req != nil {
+		jm.SetRequirements(req)
+	}
+
+	if mvj.Override != nil {
+		jm.SetOverride(uint8(*mvj.Override))
+	}
+	if mvj.Priority != nil {
+		jm.SetPriority(uint8(*mvj.Priority))
+	}
+	if mvj.Retries != nil {
+		jm.SetRetries(uint8(*mvj.Retries))
+	}
+	if mvj.NoRetriesOverWalltime != nil {
+		d, errp := time.ParseDuration(*mvj.NoRetriesOverWalltime)
+		if errp != nil {
+			return nil, fmt.Errorf("no_retry_over_walltime was not specified correctly: %w", errp)
+		}
+		jm.SetNoRetriesOverWalltime(d)
+	}
+	if mvj.RetryPolicy != nil {
+		policy, errp := ParseRetryPolicy(*mvj.RetryPolicy)
+		if errp != nil {
+			return nil, errp
+		}
+		jm.SetRetryPolicy(policy)
+	}
+	if mvj.Env != nil {
+		if err = jm.SetEnvOverride(strings.Join(mvj.Env, ",")); err != nil {
+			return nil, err
+		}
+	}
+
+	if mvj.Deps != nil || mvj.CmdDeps != nil {
+		deps := mvj.CmdDeps
+		for _, depgroup := range mvj.Deps {
+			group, mode := SplitDependencyMode(depgroup)
+			deps = append(deps, NewConditionalDependency(NewDepGroupDependency(group), mode))
+		}
+		jm.SetDependencies(deps)
+	}
+
+	var behaviours Behaviours
+	var behavioursSet bool
+	for _, b := range []struct {
+		bjs  BehavioursViaJSON
+		when BehaviourTrigger
+	}{{mvj.OnFailure, OnFailure}, {mvj.OnSuccess, OnSuccess}, {mvj.OnExit, OnExit}} {
+		if b.bjs == nil {
+			continue
+		}
+		bjs := b.bjs
+		if len(bjs) == 0 {
+			bjs = BehavioursViaJSON{{Nothing: true}}
+		}
+		behaviours = append(behaviours, bjs.Behaviours(b.when)...)
+		behavioursSet = true
+	}
+	if behavioursSet {
+		jm.SetBehaviours(behaviours)
+	}
+
+	if mvj.MountConfigs != nil {
+		jm.SetMountConfigs(mvj.MountConfigs)
+	}
+	if mvj.BsubMode != nil {
+		jm.SetBsubMode(*mvj.BsubMode)
+	}
+	if mvj.MonitorDocker != nil {
+		jm.SetMonitorDocker(*mvj.MonitorDocker)
+	}
+	if mvj.WithDocker != nil {
+		jm.SetWithDocker(*mvj.WithDocker)
+	}
+	if mvj.WithSingularity != nil {
+		jm.SetWithSingularity(*mvj.WithSingularity)
+	}
+	if mvj.ContainerMounts != nil {
+		jm.SetContainerMounts(*mvj.ContainerMounts)
+	}
+
+	return jm, nil
+}
+
+// requirements returns the Requirements that should be modified, or nil if
+// none should be.
+func (mvj *ModifierViaJSON) requirements() (*jqs.Requirements, error) {
+	req := &jqs.Requirements{}
+	var setReq bool
+	if mvj.Memory != nil {
+		mb, err := bytefmt.ToMegabytes(*mvj.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("memory was not specified correctly: %w", err)
+		}
+		req.RAM = int(mb)
+		setReq = true
+	}
+	if mvj.Time != nil {
+		t, err := time.ParseDuration(*mvj.Time)
+		if err != nil {
+			return nil, fmt.Errorf("time was not specified correctly: %w", err)
+		}
+		req.Time = t
+		setReq = true
+	}
+	if mvj.CPUs != nil {
+		req.Cores = *mvj.CPUs
+		req.CoresSet = true
+		setReq = true
+	}
+	if mvj.Disk != nil {
+		req.Disk = *mvj.Disk
+		req.DiskSet = true
+		setReq = true
+	}
+	if mvj.Resources != nil {
+		resources, err := jqs.ParseResources(*mvj.Resources)
+		if err != nil {
+			return nil, err
+		}
+		req.Resources = resources
+		req.ResourcesSet = true
+		setReq = true
+	}
+
+	other := make(map[string]string)
+	var otherSet bool
+	if mvj.CloudOS != nil {
+		other["cloud_os"] = *mvj.CloudOS
+	}
+	if mvj.CloudUser != nil {
+		other["cloud_user"] = *mvj.CloudUser
+	}
+	if mvj.CloudOSRam != nil {
+		other["cloud_os_ram"] = strconv.Itoa(*mvj.CloudOSRam)
+	}
+	if mvj.CloudFlavor != nil {
+		if *mvj.CloudFlavor == "" {
+			otherSet = true
+		} else {
+			other["cloud_flavor"] = *mvj.CloudFlavor
+		}
+	}
+	if mvj.CloudShared != nil {
+		other["cloud_shared"] = strconv.FormatBool(*mvj.CloudShared)
+	}
+	if mvj.SchedulerQueue != nil && *mvj.SchedulerQueue != "" {
+		other["scheduler_queue"] = *mvj.SchedulerQueue
+	}
+	if mvj.SchedulerQueuesAvoid != nil && *mvj.SchedulerQueuesAvoid != "" {
+		other["scheduler_queues_avoid"] = *mvj.SchedulerQueuesAvoid
+	}
+	if len(other) > 0 || otherSet {
+		req.Other = other
+		req.OtherSet = true
+		setReq = true
+	}
+
+	if !setReq {
+		return nil, nil
+	}
+	return req, nil
+}
+
 // httpAuthorized checks for parameter 'token' and for Authorization header for
 // Bearer token; if not supplied, or the token is wrong, writes out an error to
 // w, otherwise returns true.
 func (s *Server) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := s.httpUser(w, r)
+	return ok
+}
+
+// httpAuthorizedAdmin is like httpAuthorized(), but also requires that the
+// token belongs to an admin User.
+func (s *Server) httpAuthorizedAdmin(w http.ResponseWriter, r *http.Request) bool {
+	user, ok := s.httpUser(w, r)
+	if !ok {
+		return false
+	}
+
+	if !user.Admin {
+		http.Error(w, ErrNotAdmin, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// httpUser is like httpAuthorized(), but also returns the User the token
+// belongs to.
+func (s *Server) httpUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("form parsing error: %s", err), http.StatusBadRequest)
-		return false
+		return nil, false
 	}
 
 	// try token parameter
@@ -543,47 +893,56 @@ func (s *Server) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return false
+			return nil, false
 		}
 
 		if !strings.HasPrefix(authHeader, bearerSchema) {
 			http.Error(w, "Authorization requires Bearer scheme", http.StatusUnauthorized)
-			return false
+			return nil, false
 		}
 
 		token = authHeader[len(bearerSchema):]
 	}
 
-	if !tokenMatches([]byte(token), s.token) {
+	user := s.authenticate([]byte(token))
+	if user == nil {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return false
+		return nil, false
 	}
-	return true
+	return user, true
 }
 
-// restJobs lets you do CRUD on jobs in the queue.
+// restJobs lets you do CRUD on jobs in the queue: GET their status, POST new
+// jobs, PUT to retry buried jobs, PATCH to modify incomplete jobs and DELETE to
+// cancel them.
 func restJobs(ctx context.Context, s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer internal.LogPanic(ctx, "jobqueue web server restJobs", false)
 
-		ok := s.httpAuthorized(w, r)
+		user, ok := s.httpUser(w, r)
 		if !ok {
 			return
 		}
 
 		// carry out a different action based on the HTTP Verb
 		var jobs []*Job
+		var cursor string
 		var status int
 		var err error
 		switch r.Method {
 		case http.MethodGet:
-			jobs, status, err = restJobsStatus(ctx, r, s)
+			jobs, cursor, status, err = restJobsStatus(ctx, r, s)
+			hideSecrets(user, jobs)
 		case http.MethodPost:
-			jobs, status, err = restJobsAdd(ctx, r, s)
+			jobs, status, err = restJobsAdd(ctx, r, s, user)
+		case http.MethodPut:
+			jobs, status, err = restJobsRetry(ctx, r, s, user)
+		case http.MethodPatch:
+			jobs, status, err = restJobsModify(ctx, r, s, user)
 		case http.MethodDelete:
-			jobs, status, err = restJobsCancel(ctx, r, s)
+			jobs, status, err = restJobsCancel(ctx, r, s, user)
 		default:
-			http.Error(w, "So far only GET, POST and DELETE are supported", http.StatusBadRequest)
+			http.Error(w, "So far only GET, POST, PUT, PATCH and DELETE are supported", http.StatusBadRequest)
 			return
 		}
 
@@ -604,6 +963,9 @@ func restJobs(ctx context.Context, s *Server) http.HandlerFunc {
 
 		// return job details as JSON
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if cursor != "" {
+			w.Header().Set(restNextCursorHeader, cursor)
+		}
 		w.WriteHeader(status)
 		encoder := json.NewEncoder(w)
 		encoder.SetEscapeHTML(false)
@@ -615,19 +977,28 @@ func restJobs(ctx context.Context, s *Server) http.HandlerFunc {
 }
 
 // restJobsStatus gets the status of the requested jobs in the queue. The
-// request url can be suffixed with comma separated job keys or RepGroups.
+// request url can be suffixed with comma separated job keys, job array ids or
+// RepGroups.
 // Possible query parameters are search, std, env (which can take a "true"
 // value), limit (a number) and state (one of
 // delayed|ready|reserved|running|lost|buried|dependent|complete|deletable),
-// where deletable == !(running|complete). Returns the Jobs, a http.Status*
-// value and error.
-func restJobsStatus(ctx context.Context, r *http.Request, s *Server) ([]*Job, int, error) {
+// where deletable == !(running|complete).
+//
+// Results can also be filtered, sorted and paged with the query parameters
+// described by restJobQuery(). Returns the Jobs, the cursor for the next page of
+// results, a http.Status* value and error.
+func restJobsStatus(ctx context.Context, r *http.Request, s *Server) ([]*Job, string, int, error) {
 	// handle possible ?query parameters
 	var search, getStd, getEnv bool
 	var limit int
 	var state JobState
 	var err error
 
+	query, err := restJobQuery(r)
+	if err != nil {
+		return nil, "", http.StatusBadRequest, err
+	}
+
 	if r.Form.Get("search") == restFormTrue {
 		search = true
 	}
@@ -640,7 +1011,7 @@ func restJobsStatus(ctx context.Context, r *http.Request, s *Server) ([]*Job, in
 	if r.Form.Get("limit") != "" {
 		limit, err = strconv.Atoi(r.Form.Get("limit"))
 		if err != nil {
-			return nil, http.StatusBadRequest, err
+			return nil, "", http.StatusBadRequest, err
 		}
 	}
 	if r.Form.Get("state") != "" {
@@ -666,6 +1037,33 @@ func restJobsStatus(ctx context.Context, r *http.Request, s *Server) ([]*Job, in
 		}
 	}
 
+	if query == nil {
+		jobs, errg := restJobsGet(ctx, r, s, search, limit, state, getStd, getEnv)
+		if errg != nil {
+			return nil, "", http.StatusInternalServerError, errg
+		}
+		return jobs, "", http.StatusOK, nil
+	}
+
+	// when querying, we offer the jobs to a pager as we find them, so that
+	// only the requested page of results is kept
+	if limit > 0 && query.sorted() {
+		return nil, "", http.StatusBadRequest, fmt.Errorf("limit can't be used when sorting or paging")
+	}
+
+	pager := newJobPager(query)
+	if err = restJobsPage(ctx, r, s, search, state, pager); err != nil {
+		return nil, "", http.StatusInternalServerError, err
+	}
+
+	jobs, cursor := s.pagedJobs(ctx, pager, limit, getStd, getEnv)
+
+	return jobs, cursor, http.StatusOK, nil
+}
+
+// restJobsGet gets the jobs requested by the url of a GET request as per
+// restJobsStatus().
+func restJobsGet(ctx context.Context, r *http.Request, s *Server, search bool, limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
 	if len(r.URL.Path) > len(restJobsEndpoint) {
 		// get the requested jobs
 		ids := r.URL.Path[len(restJobsEndpoint):]
@@ -678,22 +1076,126 @@ func restJobsStatus(ctx context.Context, r *http.Request, s *Server) ([]*Job, in
 					jobs = append(jobs, theseJobs...)
 					continue
 				}
+
+				// or a Job.ArrayID
+				theseJobs, _, qerr = s.getJobsByArray(ctx, id, -1, getStd, getEnv)
+				if qerr == "" && len(theseJobs) > 0 {
+					jobs = append(jobs, theseJobs...)
+					continue
+				}
 			}
 
 			// id might be a Job.RepGroup
 			theseJobs, _, qerr := s.getJobsByRepGroup(ctx, id, search, limit, state, getStd, getEnv)
 			if qerr != "" {
-				return nil, http.StatusInternalServerError, fmt.Errorf(qerr)
+				return nil, fmt.Errorf(qerr)
 			}
 			if len(theseJobs) > 0 {
 				jobs = append(jobs, theseJobs...)
 			}
 		}
-		return jobs, http.StatusOK, err
+		return jobs, nil
 	}
 
 	// get all current jobs
-	return s.getJobsCurrent(ctx, limit, state, getStd, getEnv), http.StatusOK, err
+	return s.getJobsCurrent(ctx, limit, state, getStd, getEnv), nil
+}
+
+// restJobsPage is like restJobsGet(), but offers the requested jobs to the
+// given pager instead of returning them.
+func restJobsPage(ctx context.Context, r *http.Request, s *Server, search bool, state JobState, pager *jobPager) error {
+	if len(r.URL.Path) <= len(restJobsEndpoint) {
+		s.pageJobsCurrent(pager, state)
+		return nil
+	}
+
+	ids := r.URL.Path[len(restJobsEndpoint):]
+	for _, id := range strings.Split(ids, ",") {
+		if len(id) == 32 {
+			// id might be a Job.key() or a Job.ArrayID
+			theseJobs, _, qerr := s.getJobsByKeys(ctx, []string{id}, false, false)
+			if qerr != "" || len(theseJobs) == 0 {
+				theseJobs, _, qerr = s.getJobsByArray(ctx, id, -1, false, false)
+			}
+			if qerr == "" && len(theseJobs) > 0 {
+				for _, job := range theseJobs {
+					pager.offer(job, nil)
+				}
+				continue
+			}
+		}
+
+		// id might be a Job.RepGroup
+		if _, qerr := s.pageJobsByRepGroup(pager, id, search, state); qerr != "" {
+			return fmt.Errorf(qerr)
+		}
+	}
+
+	return nil
+}
+
+// restJobQuery parses the query parameters of a GET request that filter, sort
+// and page jobs: host, exit_code, fail_reason (a sub-string), started_after,
+// started_before, ended_after, ended_before (all unix timestamps in seconds),
+// limit_grp, dep_grp, sort (one of key|start|end|peakram|exitcode), desc (which
+// can take a "true" value), page_size (a number) and cursor (as returned in the
+// X-Next-Cursor header of the previous page). Returns nil if none of them were
+// supplied.
+func restJobQuery(r *http.Request) (*JobQuery, error) {
+	filter := &JobFilter{
+		Host:       r.Form.Get("host"),
+		FailReason: r.Form.Get("fail_reason"),
+		LimitGroup: r.Form.Get("limit_grp"),
+		DepGroup:   r.Form.Get("dep_grp"),
+	}
+	filtering := filter.Host != "" || filter.FailReason != "" || filter.LimitGroup != "" || filter.DepGroup != ""
+
+	if r.Form.Get("exit_code") != "" {
+		exitCode, err := strconv.Atoi(r.Form.Get("exit_code"))
+		if err != nil {
+			return nil, err
+		}
+		filter.ExitCode = &exitCode
+		filtering = true
+	}
+
+	for param, t := range map[string]*time.Time{
+		"started_after":  &filter.StartedAfter,
+		"started_before": &filter.StartedBefore,
+		"ended_after":    &filter.EndedAfter,
+		"ended_before":   &filter.EndedBefore,
+	} {
+		if r.Form.Get(param) == "" {
+			continue
+		}
+		secs, err := strconv.ParseInt(r.Form.Get(param), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		*t = time.Unix(secs, 0)
+		filtering = true
+	}
+
+	query := &JobQuery{
+		SortBy: JobSortKey(r.Form.Get("sort")),
+		Desc:   r.Form.Get("desc") == restFormTrue,
+		Cursor: r.Form.Get("cursor"),
+	}
+	if r.Form.Get("page_size") != "" {
+		pageSize, err := strconv.Atoi(r.Form.Get("page_size"))
+		if err != nil {
+			return nil, err
+		}
+		query.PageSize = pageSize
+	}
+
+	if filtering {
+		query.Filter = filter
+	} else if !query.sorted() {
+		return nil, nil //nolint:nilnil
+	}
+
+	return query, query.validate()
 }
 
 // restJobsAdd creates and adds jobs to the queue and returns them on success.
@@ -705,8 +1207,9 @@ func restJobsStatus(ctx context.Context, r *http.Request, s *Server) ([]*Job, in
 // a comma-separated list. mounts, on_failure, on_success and on_exit values
 // should be supplied as url query escaped JSON strings.
 //
-// The returned int is a http.Status* variable.
-func restJobsAdd(ctx context.Context, r *http.Request, s *Server) ([]*Job, int, error) {
+// The jobs will be owned by the given User. The returned int is a http.Status*
+// variable.
+func restJobsAdd(ctx context.Context, r *http.Request, s *Server, user *User) ([]*Job, int, error) {
 	// handle possible ?query parameters
 	_, diskSet := r.Form["disk"]
 	jd := &JobDefaults{
@@ -766,6 +1269,27 @@ func restJobsAdd(ctx context.Context, r *http.Request, s *Server) ([]*Job, int,
 			return nil, http.StatusBadRequest, err
 		}
 	}
+	if r.Form.Get("retry_policy") != "" {
+		var err error
+		jd.RetryPolicy, err = ParseRetryPolicy(r.Form.Get("retry_policy"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	if r.Form.Get("resources") != "" {
+		var err error
+		jd.Resources, err = jqs.ParseResources(r.Form.Get("resources"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	if r.Form.Get("checkpoint") != "" {
+		var err error
+		jd.Checkpoint, err = ParseCheckpoint(r.Form.Get("checkpoint"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
 	var rerun bool
 	if r.Form.Get("rerun") == restFormTrue {
 		rerun = true
@@ -773,7 +1297,15 @@ func restJobsAdd(ctx context.Context, r *http.Request, s *Server) ([]*Job, int,
 	defaultDeps := urlStringToSlice(r.Form.Get("deps"))
 	if len(defaultDeps) > 0 {
 		for _, depgroup := range defaultDeps {
-			jd.Deps = append(jd.Deps, NewDepGroupDependency(depgroup))
+			group, mode := SplitDependencyMode(depgroup)
+			jd.Deps = append(jd.Deps, NewConditionalDependency(NewDepGroupDependency(group), mode))
+		}
+	}
+	if r.Form.Get("on_dep_fail") != "" {
+		var err error
+		jd.OnDepFailure, err = ParseDepFailureAction(r.Form.Get("on_dep_fail"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
 		}
 	}
 	if r.Form.Get("on_failure") != "" {
@@ -834,15 +1366,27 @@ func restJobsAdd(ctx context.Context, r *http.Request, s *Server) ([]*Job, int,
 		inputJobs = append(inputJobs, job)
 	}
 
+	setJobsOwner(inputJobs, user)
+
 	envkey, err := s.db.storeEnv([]byte{})
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 
+	inputJobs, arrays, _, _, srerr, err := s.expandJobArrays(ctx, inputJobs, envkey, !rerun)
+	if err != nil {
+		if srerr == ErrBadRequest {
+			return nil, http.StatusBadRequest, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
 	_, _, _, _, err = s.createJobs(ctx, inputJobs, envkey, !rerun)
 	if err != nil {
+		s.abandonJobArrays(ctx, arrays)
 		return nil, http.StatusInternalServerError, err
 	}
+	s.settleJobArrays(ctx, arrays)
 
 	// see which of the inputJobs are now actually in the queue
 	jobs := s.inputToQueuedJobs(ctx, inputJobs)
@@ -853,9 +1397,9 @@ func restJobsAdd(ctx context.Context, r *http.Request, s *Server) ([]*Job, int,
 // restJobsCancel kills running jobs, confirms lost jobs as dead, or deletes
 // incomplete jobs. You identify the jobs to operate on in the same way as for
 // restJobsStatus(). However state must be specified, and only one of:
-// (running|lost|deletable) are allowed. Returns the affected Jobs, a
-// http.Status* value and error.
-func restJobsCancel(ctx context.Context, r *http.Request, s *Server) ([]*Job, int, error) {
+// (running|lost|deletable) are allowed. Jobs not owned by the given User are
+// ignored. Returns the affected Jobs, a http.Status* value and error.
+func restJobsCancel(ctx context.Context, r *http.Request, s *Server, user *User) ([]*Job, int, error) {
 	var state JobState
 	if r.Form.Get("state") != "" {
 		switch r.Form.Get("state") {
@@ -871,10 +1415,11 @@ func restJobsCancel(ctx context.Context, r *http.Request, s *Server) ([]*Job, in
 		return nil, http.StatusBadRequest, fmt.Errorf("state must be supplied as one of running|lost|deletable")
 	}
 
-	jobs, status, err := restJobsStatus(ctx, r, s)
+	jobs, _, status, err := restJobsStatus(ctx, r, s)
 	if err != nil || status != http.StatusOK {
 		return nil, status, err
 	}
+	jobs = ownedJobs(user, jobs)
 
 	var handled []*Job
 	returnStatus := http.StatusAccepted
@@ -906,6 +1451,89 @@ func restJobsCancel(ctx context.Context, r *http.Request, s *Server) ([]*Job, in
 	return handled, returnStatus, nil
 }
 
+// restJobsRetry retries buried jobs, moving them to the ready queue. You
+// identify the jobs to operate on in the same way as for restJobsStatus(); any
+// that are not buried, or not owned by the given User, are ignored. Returns the
+// retried Jobs, a http.Status* value and error.
+func restJobsRetry(ctx context.Context, r *http.Request, s *Server, user *User) ([]*Job, int, error) {
+	jobs, _, status, err := restJobsStatus(ctx, r, s)
+	if err != nil || status != http.StatusOK {
+		return nil, status, err
+	}
+	jobs = ownedJobs(user, jobs)
+
+	var buried []*Job
+	for _, job := range jobs {
+		item, errg := s.q.Get(job.Key())
+		if errg != nil || item.Stats().State != queue.ItemStateBury {
+			continue
+		}
+		buried = append(buried, item.Data().(*Job))
+	}
+
+	s.kickJobs(ctx, buried)
+
+	var retried []*Job
+	for _, job := range buried {
+		job.RLock()
+		kicked := job.State == JobStateReady
+		job.RUnlock()
+		if kicked {
+			retried = append(retried, job)
+		}
+	}
+	return retried, http.StatusOK, nil
+}
+
+// restJobsModify modifies incomplete jobs that aren't running. The request must
+// have some PATCHed JSON that is a ModifierViaJSON, describing the changes to make.
+// You identify the jobs to operate on in the same way as for restJobsStatus();
+// any not owned by the given User are ignored. Returns the modified Jobs, a
+// http.Status* value and error.
+func restJobsModify(ctx context.Context, r *http.Request, s *Server, user *User) ([]*Job, int, error) {
+	var mvj ModifierViaJSON
+	err := json.NewDecoder(r.Body).Decode(&mvj)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	modifier, err := mvj.Modifier()
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	jobs, _, status, err := restJobsStatus(ctx, r, s)
+	if err != nil || status != http.StatusOK {
+		return nil, status, err
+	}
+	jobs = ownedJobs(user, jobs)
+
+	if mvj.Cmd != nil && len(jobs) > 1 {
+		return nil, http.StatusBadRequest, fmt.Errorf("%d jobs matched, but cmd can only be modified for 1 job", len(jobs))
+	}
+
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		keys[i] = job.Key()
+	}
+
+	modified, srerr, err := s.modifyJobs(ctx, keys, modifier)
+	if err != nil {
+		return nil, serverErrToHTTPStatus(srerr), err
+	}
+
+	newKeys := make([]string, 0, len(modified))
+	for newKey := range modified {
+		newKeys = append(newKeys, newKey)
+	}
+
+	jobs, _, qerr := s.getJobsByKeys(ctx, newKeys, false, false)
+	if qerr != "" {
+		return nil, http.StatusInternalServerError, fmt.Errorf(qerr)
+	}
+	return jobs, http.StatusOK, nil
+}
+
 // restWarnings lets you read warnings from the scheduler, and auto-"dismisses"
 // (deletes) them.
 func restWarnings(ctx context.Context, s *Server) http.HandlerFunc {
@@ -946,12 +1574,14 @@ func restWarnings(ctx context.Context, s *Server) http.HandlerFunc {
 
 // restBadServers lets you do CRUD on cloud servers that have gone bad. The
 // DELETE verb has a required 'id' parameter, being the ID of a server you wish
-// to confirm as bad and have terminated if it still exists.
+// to confirm as bad and have terminated if it still exists. Once terminated,
+// any jobs that were running on it are killed, and are returned as a JSON list
+// of JStatus.
 func restBadServers(ctx context.Context, s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer internal.LogPanic(ctx, "jobqueue web server restBadServers", false)
 
-		ok := s.httpAuthorized(w, r)
+		user, ok := s.httpUser(w, r)
 		if !ok {
 			return
 		}
@@ -973,6 +1603,11 @@ func restBadServers(ctx context.Context, s *Server) http.HandlerFunc {
 			}
 			return
 		case http.MethodDelete:
+			if !user.Admin {
+				http.Error(w, ErrNotAdmin, http.StatusForbidden)
+				return
+			}
+
 			serverID := r.Form.Get("id")
 			if serverID == "" {
 				http.Error(w, "id parameter is required", http.StatusBadRequest)
@@ -993,7 +1628,26 @@ func restBadServers(ctx context.Context, s *Server) http.HandlerFunc {
 					return
 				}
 			}
+
+			jobs := s.killJobsOnServers(ctx, map[string]bool{serverID: true})
+			jstati := make([]JStatus, 0, len(jobs))
+			for _, job := range jobs {
+				jstatus, err := job.ToStatus()
+				if err != nil && err != io.ErrUnexpectedEOF {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				jstati = append(jstati, jstatus)
+			}
+
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 			w.WriteHeader(http.StatusOK)
+			encoder := json.NewEncoder(w)
+			encoder.SetEscapeHTML(false)
+			erre := encoder.Encode(jstati)
+			if erre != nil {
+				clog.Warn(ctx, "restBadServers failed to encode job statuses", "err", erre)
+			}
 			return
 		default:
 			http.Error(w, "Only GET and DELETE are supported", http.StatusBadRequest)
@@ -1037,6 +1691,54 @@ func restFileUpload(ctx context.Context, s *Server) http.HandlerFunc {
 	}
 }
 
+// restCopied lets you download files that were copied to the server by jobs
+// with the CopyToManager behaviour. The only method supported is GET, and the
+// request url must be suffixed with the job's key and then the path of the file
+// as listed in the job's CopiedFiles, eg. /rest/v1/copied/[key]/[path].
+func restCopied(ctx context.Context, s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue web server restCopied", false)
+
+		user, ok := s.httpUser(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		keyAndPath := strings.SplitN(strings.TrimPrefix(r.URL.Path, restCopiedEndpoint), "/", 2)
+		if len(keyAndPath) != 2 || keyAndPath[1] == "" {
+			http.Error(w, "a job key and file path must be supplied", http.StatusBadRequest)
+			return
+		}
+
+		if !s.ownsJobKey(user, keyAndPath[0]) {
+			http.Error(w, ErrNotOwner, http.StatusForbidden)
+			return
+		}
+
+		data, err := s.readCopiedFile(keyAndPath[0], keyAndPath[1])
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "file not found", http.StatusNotFound)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(data)
+		if err != nil {
+			clog.Warn(ctx, "restCopied failed to write file", "err", err)
+		}
+	}
+}
+
 // restInfo lets you get info on self.
 func restInfo(ctx context.Context, s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1063,9 +1765,216 @@ func restInfo(ctx context.Context, s *Server) http.HandlerFunc {
 	}
 }
 
+// restLimits lets you GET the limits of all limit groups as a JSON object of
+// group name to limit, or just one if the url is suffixed with its name (groups
+// that aren't known about have a limit of -1). PUT to the url suffixed with a
+// group name with a 'limit' parameter to set that group's limit; a limit of -1
+// makes the group unlimited, and the limit can also be a time-based limit, as
+// per the group:limit syntax of job limit_grps. Only admins can PUT.
+func restLimits(ctx context.Context, s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue web server restLimits", false)
+
+		user, ok := s.httpUser(w, r)
+		if !ok {
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, restLimitsEndpoint)
+
+		var limits map[string]int
+		switch r.Method {
+		case http.MethodGet:
+			if name == "" {
+				limits = s.limiter.GetLimits()
+				break
+			}
+
+			if strings.Contains(name, ":") {
+				http.Error(w, "use PUT to set a limit", http.StatusBadRequest)
+				return
+			}
+
+			limit, srerr, err := s.getSetLimitGroup(ctx, name)
+			if err != nil {
+				http.Error(w, err.Error(), serverErrToHTTPStatus(srerr))
+				return
+			}
+			limits = map[string]int{name: restLimit(limit)}
+		case http.MethodPut:
+			if !user.Admin {
+				http.Error(w, ErrNotAdmin, http.StatusForbidden)
+				return
+			}
+			if name == "" || strings.Contains(name, ":") {
+				http.Error(w, "a limit group name must be supplied", http.StatusBadRequest)
+				return
+			}
+			if r.Form.Get("limit") == "" {
+				http.Error(w, "limit parameter is required", http.StatusBadRequest)
+				return
+			}
+
+			group := name + ":" + r.Form.Get("limit")
+			if _, data := s.splitSuffixedLimitGroup(group); data == nil {
+				http.Error(w, fmt.Sprintf("invalid limit %s", r.Form.Get("limit")), http.StatusBadRequest)
+				return
+			}
+
+			limit, srerr, err := s.getSetLimitGroup(ctx, group)
+			if err != nil {
+				http.Error(w, err.Error(), serverErrToHTTPStatus(srerr))
+				return
+			}
+			limits = map[string]int{name: restLimit(limit)}
+		default:
+			http.Error(w, "Only GET and PUT are supported", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(limits)
+		if err != nil {
+			clog.Warn(ctx, "restLimits failed to encode limits", "err", err)
+		}
+	}
+}
+
+// restLimit converts a limit group's GroupData to the limit we report to REST
+// API clients: -1 for groups that are unlimited or unknown.
+func restLimit(data *limiter.GroupData) int {
+	if !data.IsValid() || !data.IsCount() {
+		return -1
+	}
+	return int(data.Limit())
+}
+
+// restManager lets you GET the ServerStats of the manager, or POST to the url
+// suffixed with pause, resume or drain to carry out that action, as per
+// Server.Pause(), Server.Resume() and Server.Drain(). POSTs also return the
+// ServerStats.
+func restManager(ctx context.Context, s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue web server restManager", false)
+
+		user, ok := s.httpUser(w, r)
+		if !ok {
+			return
+		}
+
+		action := strings.TrimPrefix(r.URL.Path, restManagerEndpoint)
+
+		switch r.Method {
+		case http.MethodGet:
+			if action != "" {
+				http.Error(w, "GET does not take an action", http.StatusBadRequest)
+				return
+			}
+		case http.MethodPost:
+			if !user.Admin {
+				http.Error(w, ErrNotAdmin, http.StatusForbidden)
+				return
+			}
+
+			var err error
+			switch action {
+			case "pause":
+				clog.Debug(ctx, "pause requested")
+				err = s.requestPause(ctx)
+			case "resume":
+				clog.Debug(ctx, "resume requested")
+				var resumed bool
+				resumed, err = s.Resume(ctx)
+				if resumed {
+					clog.Info(ctx, "resumed on request")
+				}
+			case "drain":
+				clog.Info(ctx, "drain requested")
+				err = s.Drain(ctx)
+			default:
+				http.Error(w, "action must be one of pause|resume|drain", http.StatusNotFound)
+				return
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), serverErrToHTTPStatus(serverErrString(err)))
+				return
+			}
+		default:
+			http.Error(w, "Only GET and POST are supported", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(s.GetServerStats())
+		if err != nil {
+			clog.Warn(ctx, "restManager failed to encode ServerStats", "err", err)
+		}
+	}
+}
+
+// restBackup lets you GET a backup of the server's database, as per
+// Server.BackupDB().
+func restBackup(ctx context.Context, s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue web server restBackup", false)
+
+		ok := s.httpAuthorizedAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		clog.Debug(ctx, "backup requested")
+		var b bytes.Buffer
+		err := s.BackupDB(&b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(b.Bytes())
+		if err != nil {
+			clog.Warn(ctx, "restBackup failed to write database", "err", err)
+		}
+	}
+}
+
+// restOpenAPI lets you get the OpenAPI document describing this REST API. Like
+// restVersion, it doesn't need authentication, so that API tooling can read it.
+func restOpenAPI(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue server openapi", false)
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(openAPIDocument)
+		if err != nil {
+			clog.Warn(ctx, "restOpenAPI failed to write document", "err", err)
+		}
+	}
+}
+
 // restVersion lets you get info on the version of the server and the supported
-// API version (we only support 1 API version at a time). This is the only
-// end point that doesn't need authentication.
+// API version (we only support 1 API version at a time). Along with
+// restOpenAPI, this is the only end point that doesn't need authentication.
 func restVersion(ctx context.Context, s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer internal.LogPanic(ctx, "jobqueue server version", false)
@@ -1086,6 +1995,24 @@ func restVersion(ctx context.Context, s *Server) http.HandlerFunc {
 	}
 }
 
+// serverErrToHTTPStatus converts a server error string (one of our Err*
+// constants) to a http.Status* value.
+func serverErrToHTTPStatus(srerr string) int {
+	switch srerr {
+	case ErrBadRequest, ErrBadJob:
+		return http.StatusBadRequest
+	case ErrCronExists, ErrUserExists, ErrBeingDrained:
+		return http.StatusConflict
+	case ErrMissingCron, ErrMissingUser, ErrMissingJob, ErrMissingFile:
+		return http.StatusNotFound
+	case ErrNotAdmin, ErrPermissionDenied:
+		return http.StatusForbidden
+	case ErrNoServer, ErrClosedStop:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
 // urlStringToInt takes a possible string from a url parameter value and
 // converts it to an int. If the value is "", or if the value isn't a number,
 // returns 0.
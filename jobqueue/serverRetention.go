@@ -0,0 +1,131 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the server to archive expired complete Jobs
+// according to its RetentionPolicies, and to search those archives.
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+// retention holds the server's RetentionPolicies.
+type retention struct {
+	policies []*RetentionPolicy
+	stop     chan struct{}
+	stopped  bool
+	sync.Mutex
+}
+
+// startRetention starts enforcing the given RetentionPolicies every
+// ServerRetentionCheckInterval. Does nothing if there are no policies.
+func (s *Server) startRetention(ctx context.Context, policies []*RetentionPolicy) {
+	s.retention = &retention{policies: policies, stop: make(chan struct{})}
+	if len(policies) == 0 {
+		return
+	}
+
+	go func() {
+		defer internal.LogPanic(ctx, "jobqueue retention", true)
+
+		ticker := time.NewTicker(ServerRetentionCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				_, err := s.enforceRetention(ctx, now)
+				if err != nil {
+					clog.Warn(ctx, "enforcing retention policies failed", "err", err)
+				}
+			case <-s.retention.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopRetention stops RetentionPolicies from being enforced, waiting for any
+// current enforcement to complete.
+func (s *Server) stopRetention() {
+	if s.retention == nil {
+		return
+	}
+
+	s.retention.Lock()
+	defer s.retention.Unlock()
+	if !s.retention.stopped {
+		close(s.retention.stop)
+		s.retention.stopped = true
+	}
+}
+
+// enforceRetention archives complete Jobs that have expired according to our
+// RetentionPolicies as of the given time, and then compacts the database if
+// any were archived. Returns the number of Jobs archived.
+func (s *Server) enforceRetention(ctx context.Context, now time.Time) (int, error) {
+	s.retention.Lock()
+	defer s.retention.Unlock()
+	if s.retention.stopped || len(s.retention.policies) == 0 {
+		return 0, nil
+	}
+
+	archived, err := s.db.archiveExpiredJobs(s.retention.policies, now, s.archiveDir)
+	if archived > 0 {
+		clog.Info(ctx, "archived expired complete jobs", "count", archived, "dir", s.archiveDir)
+	}
+	if err != nil || archived == 0 {
+		return archived, err
+	}
+
+	before, after, err := s.db.compact(ctx)
+	if err != nil {
+		return archived, err
+	}
+	clog.Info(ctx, "compacted database", "before", before, "after", after)
+	s.db.backgroundBackup(ctx)
+
+	return archived, nil
+}
+
+// getArchivedJobs searches our archive files for Jobs that have one of the
+// given keys, or if no keys are supplied, that have the given RepGroup (or
+// contain it as a sub-string if search is true).
+func (s *Server) getArchivedJobs(keys []string, repGroup string, search bool) ([]*Job, error) {
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+
+	return searchJobArchives(s.archiveDir, func(job *Job) bool {
+		switch {
+		case len(wanted) > 0:
+			return wanted[job.Key()]
+		case search:
+			return strings.Contains(job.RepGroup, repGroup)
+		default:
+			return job.RepGroup == repGroup
+		}
+	})
+}
@@ -0,0 +1,419 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the server to authenticate clients as named
+// Users, and to authorise what they can do.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/limiter"
+	"github.com/gofrs/uuid"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+// serverAdminName is the Name of the admin User that clients using the server
+// token are identified as, if we can't determine who started the server.
+const serverAdminName = "admin"
+
+// adminMethods are the client request methods that only admin Users can use.
+// "reserve" is amongst them because the runners the server spawns use the
+// server token, and non-admins must not be able to reserve, and so then run or
+// release, the Jobs of other Users.
+var adminMethods = map[string]bool{
+	"reserve":     true,
+	"backup":      true,
+	"pause":       true,
+	"resume":      true,
+	"drain":       true,
+	"shutdown":    true,
+	"dch":         true,
+	"useradd":     true,
+	"userdel":     true,
+	"users":       true,
+	"standby":     true,
+	"standbysnap": true,
+}
+
+// requiresAdmin tells you if only admin Users can make the given request: those
+// using one of the adminMethods, along with the otherwise unrestricted "getbcs"
+// when it destroys servers and "getsetlg" when it sets a limit.
+func requiresAdmin(cr *clientRequest) bool {
+	switch cr.Method {
+	case "getbcs":
+		return cr.ConfirmDeadCloudServers
+	case "getsetlg":
+		_, limit := limiter.NameToGroupData(cr.LimitGroup)
+		return limit != nil
+	}
+	return adminMethods[cr.Method]
+}
+
+// ownedMethods are the client request methods that act on the Jobs with the
+// request Keys, which non-admin Users can only do to Jobs they own. Methods that
+// only get Jobs are not restricted, so Users can see the Cmds and states of
+// each other's Jobs, but hideSecrets() stops them seeing each other's
+// environment variables. The methods used by runners on the Jobs they reserved
+// are also restricted to owners, by getij().
+var ownedMethods = map[string]bool{
+	"jkick": true,
+	"jdel":  true,
+	"jmod":  true,
+	"jkill": true,
+}
+
+// serverUsers holds the Users the server knows about.
+type serverUsers struct {
+	admin *User
+	users map[string]*User
+	sync.RWMutex
+}
+
+// loadUsers loads any Users stored in the database, and sets up the admin User
+// that clients using the server token are identified as.
+func (s *Server) loadUsers(ctx context.Context) error {
+	users, err := s.db.retrieveUsers()
+	if err != nil {
+		return err
+	}
+
+	name, err := internal.Username()
+	if err != nil || name == "" {
+		name = serverAdminName
+	}
+
+	s.users = &serverUsers{
+		admin: &User{Name: name, Admin: true},
+		users: make(map[string]*User),
+	}
+	for _, u := range users {
+		if err = u.validate(); err != nil {
+			clog.Warn(ctx, "ignoring invalid stored user", "name", u.Name, "err", err)
+			continue
+		}
+		s.users.users[u.Name] = u
+	}
+
+	return nil
+}
+
+// authenticate returns the User with the given token, or nil if the token
+// doesn't belong to anyone.
+func (s *Server) authenticate(token []byte) *User {
+	if len(token) != tokenLength {
+		return nil
+	}
+
+	if tokenMatches(token, s.token) {
+		return s.users.admin
+	}
+
+	hashed := hashToken(token)
+	s.users.RLock()
+	defer s.users.RUnlock()
+	for _, u := range s.users.users {
+		if tokenMatches(hashed, u.Token) {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// ownedKeys returns the subset of the given Job keys that correspond to Jobs in
+// the queue that the given User owns. Keys of Jobs that aren't in the queue are
+// also excluded for non-admins.
+func (s *Server) ownedKeys(ctx context.Context, u *User, keys []string) []string {
+	if u != nil && u.Admin {
+		return keys
+	}
+
+	owned := make([]string, 0, len(keys))
+	for _, key := range keys {
+		item, err := s.q.Get(key)
+		if err != nil || item == nil {
+			continue
+		}
+
+		if u.owns(item.Data().(*Job)) {
+			owned = append(owned, key)
+		} else {
+			clog.Debug(ctx, "user does not own job", "user", u.Name, "key", key)
+		}
+	}
+
+	return owned
+}
+
+// ownsJobKey tells you if the given User owns the Job with the given key, which
+// may be in the queue, complete or archived. Jobs that can't be found are only
+// owned by admins.
+func (s *Server) ownsJobKey(u *User, key string) bool {
+	if u != nil && u.Admin {
+		return true
+	}
+
+	if item, err := s.q.Get(key); err == nil && item != nil {
+		return u.owns(item.Data().(*Job))
+	}
+
+	jobs, err := s.db.retrieveCompleteJobsByKeys([]string{key})
+	if err == nil && len(jobs) == 1 {
+		return u.owns(jobs[0])
+	}
+
+	jobs, err = s.getArchivedJobs([]string{key}, "", false)
+	if err == nil && len(jobs) == 1 {
+		return u.owns(jobs[0])
+	}
+
+	return false
+}
+
+// ownedJobs returns the subset of the given Jobs that the given User owns.
+func ownedJobs(u *User, jobs []*Job) []*Job {
+	if u != nil && u.Admin {
+		return jobs
+	}
+
+	owned := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if u.owns(job) {
+			owned = append(owned, job)
+		}
+	}
+
+	return owned
+}
+
+// hideSecrets removes the environment variables from those of the given Jobs
+// that the given User doesn't own, since they may contain secrets. It also
+// removes their ReservedBy, since knowing that would let the User act as the
+// Job's runner.
+func hideSecrets(u *User, jobs []*Job) {
+	if u != nil && u.Admin {
+		return
+	}
+
+	for _, job := range jobs {
+		if u.owns(job) {
+			continue
+		}
+
+		job.Lock()
+		job.EnvC = nil
+		job.EnvOverride = nil
+		job.EnvCRetrieved = false
+		job.ReservedBy = uuid.Nil
+		job.Unlock()
+	}
+}
+
+// setJobsOwner makes the given User the Owner of the given Jobs.
+func setJobsOwner(jobs []*Job, u *User) {
+	for _, job := range jobs {
+		if job != nil {
+			job.Owner = u.Name
+		}
+	}
+}
+
+// addUser creates a new User with the given name and a new token, and stores
+// it. Returns a copy of the User with its Token set, or a server error string
+// and an error if the name is invalid or already taken.
+func (s *Server) addUser(ctx context.Context, name string, admin bool) (*User, string, error) {
+	u := &User{Name: name, Admin: admin}
+	if err := u.validate(); err != nil {
+		return nil, ErrBadRequest, err
+	}
+
+	s.users.Lock()
+	defer s.users.Unlock()
+	if _, exists := s.users.users[name]; exists || name == s.users.admin.Name {
+		return nil, ErrUserExists, fmt.Errorf("user %s already exists", name)
+	}
+
+	token, err := generateToken("")
+	if err != nil {
+		return nil, ErrInternalError, err
+	}
+
+	u.Created = time.Now()
+	u.Token = hashToken(token)
+	if err = s.db.storeUser(u); err != nil {
+		return nil, ErrDBError, err
+	}
+	s.users.users[name] = u
+	clog.Info(ctx, "added user", "name", name, "admin", admin)
+
+	c := *u
+	c.Token = token
+	return &c, "", nil
+}
+
+// removeUser forgets about the User with the given name, so that their token
+// stops working. Jobs they own are unaffected.
+func (s *Server) removeUser(ctx context.Context, name string) (string, error) {
+	s.users.Lock()
+	defer s.users.Unlock()
+	if _, exists := s.users.users[name]; !exists {
+		return ErrMissingUser, fmt.Errorf("user %s does not exist", name)
+	}
+
+	if err := s.db.deleteUser(name); err != nil {
+		return ErrDBError, err
+	}
+	delete(s.users.users, name)
+	clog.Info(ctx, "removed user", "name", name)
+
+	return "", nil
+}
+
+// getUsers returns copies of all the current Users (without their Tokens),
+// including the admin User, sorted by Name.
+func (s *Server) getUsers() []*User {
+	s.users.RLock()
+	defer s.users.RUnlock()
+
+	users := make([]*User, 0, len(s.users.users)+1)
+	admin := *s.users.admin
+	users = append(users, &admin)
+	for _, u := range s.users.users {
+		c := *u
+		c.Token = nil
+		users = append(users, &c)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+
+	return users
+}
+
+// UserViaJSON describes a User that an admin wishes to add, convenient if they
+// are supplying JSON.
+type UserViaJSON struct {
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+}
+
+// UserStatus is a summary of a User, for giving to REST API clients. Token is
+// only set in response to adding a new User.
+type UserStatus struct {
+	Name    string `json:"name"`
+	Admin   bool   `json:"admin"`
+	Created int64  `json:"created"`
+	Token   string `json:"token,omitempty"`
+}
+
+// ToStatus converts a User in to a UserStatus. Created is given as seconds
+// since the Unix epoch, or 0 for the admin User that uses the server token.
+func (u *User) ToStatus() UserStatus {
+	var created int64
+	if !u.Created.IsZero() {
+		created = u.Created.Unix()
+	}
+
+	return UserStatus{
+		Name:    u.Name,
+		Admin:   u.Admin,
+		Created: created,
+		Token:   string(u.Token),
+	}
+}
+
+// restUsers lets you GET a list of Users (just yourself if you're not an
+// admin), POST a single UserViaJSON to add a new User, or DELETE a User by
+// suffixing the url with their name. Only admins can POST and DELETE. All
+// return a JSON list of UserStatus.
+func restUsers(ctx context.Context, s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(ctx, "jobqueue web server restUsers", false)
+
+		user, ok := s.httpUser(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet && !user.Admin {
+			http.Error(w, ErrNotAdmin, http.StatusForbidden)
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, restUsersEndpoint)
+
+		var users []*User
+		status := http.StatusOK
+		switch r.Method {
+		case http.MethodGet:
+			if !user.Admin {
+				users = []*User{{Name: user.Name, Created: user.Created}}
+				break
+			}
+			users = s.getUsers()
+		case http.MethodPost:
+			var uvj UserViaJSON
+			err := json.NewDecoder(r.Body).Decode(&uvj)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			u, srerr, err := s.addUser(ctx, uvj.Name, uvj.Admin)
+			if err != nil {
+				http.Error(w, err.Error(), serverErrToHTTPStatus(srerr))
+				return
+			}
+			users = []*User{u}
+			status = http.StatusCreated
+		case http.MethodDelete:
+			srerr, err := s.removeUser(ctx, name)
+			if err != nil {
+				http.Error(w, err.Error(), serverErrToHTTPStatus(srerr))
+				return
+			}
+		default:
+			http.Error(w, "So far only GET, POST and DELETE are supported", http.StatusBadRequest)
+			return
+		}
+
+		statuses := make([]UserStatus, len(users))
+		for i, u := range users {
+			statuses[i] = u.ToStatus()
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(status)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(statuses)
+		if err != nil {
+			clog.Warn(ctx, "restUsers failed to encode users", "err", err)
+		}
+	}
+}
@@ -75,9 +75,12 @@ type JStatus struct {
 	DepGroups       []string
 	Dependencies    []string
 	OtherRequests   []string
+	CopiedFiles     []string
 	Env             []string
 	Key             string
 	RepGroup        string
+	Owner           string
+	ArrayID         string
 	Cmd             string
 	State           JobState
 	Cwd             string
@@ -97,6 +100,7 @@ type JStatus struct {
 	ExpectedRAM     int     // ExpectedRAM is in Megabytes.
 	ExpectedTime    float64 // ExpectedTime is in seconds.
 	RequestedDisk   int     // RequestedDisk is in Gigabytes.
+	Resources       string  // Resources are the named consumable resources requested, as name=count,name=count
 	Cores           float64
 	PeakRAM         int
 	PeakDisk        int64 // MBs
@@ -107,6 +111,8 @@ type JStatus struct {
 	Started         *int64
 	Ended           *int64
 	Similar         int
+	ArrayIndex      int
+	ArraySize       int
 	Attempts        uint32
 	HomeChanged     bool
 	Exited          bool
@@ -185,7 +191,7 @@ func webSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, bool) {
 // webpage
 func webInterfaceStatusWS(ctx context.Context, s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ok := s.httpAuthorized(w, r)
+		user, ok := s.httpUser(w, r)
 		if !ok {
 			return
 		}
@@ -302,14 +308,14 @@ func webInterfaceStatusWS(ctx context.Context, s *Server) http.HandlerFunc {
 							}
 						}
 					case "retry":
-						jobs := s.reqToJobs(req, []queue.ItemState{queue.ItemStateBury})
+						jobs := ownedJobs(user, s.reqToJobs(req, []queue.ItemState{queue.ItemStateBury}))
 						s.kickJobs(ctx, jobs)
 					case "remove":
-						jobs := s.reqToJobs(req, []queue.ItemState{queue.ItemStateBury, queue.ItemStateDelay, queue.ItemStateDependent, queue.ItemStateReady})
+						jobs := ownedJobs(user, s.reqToJobs(req, []queue.ItemState{queue.ItemStateBury, queue.ItemStateDelay, queue.ItemStateDependent, queue.ItemStateReady}))
 						deleted := s.deleteJobs(ctx, jobs)
 						clog.Debug(ctx, "removed jobs", "count", len(deleted))
 					case "kill":
-						jobs := s.reqToJobs(req, []queue.ItemState{queue.ItemStateRun})
+						jobs := ownedJobs(user, s.reqToJobs(req, []queue.ItemState{queue.ItemStateRun}))
 						for _, job := range jobs {
 							_, err := s.killJob(ctx, job.Key())
 							if err != nil {
@@ -317,7 +323,7 @@ func webInterfaceStatusWS(ctx context.Context, s *Server) http.HandlerFunc {
 							}
 						}
 					case "confirmBadServer":
-						if req.ServerID != "" {
+						if req.ServerID != "" && user.Admin {
 							s.bsmutex.Lock()
 							server := s.badServers[req.ServerID]
 							delete(s.badServers, req.ServerID)
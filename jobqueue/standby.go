@@ -0,0 +1,304 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for running a hot standby server, which keeps a
+// copy of another server's database and takes over from it if it dies.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/wtsi-ssg/wr/clog"
+)
+
+// StandbyInterval is how often a standby server checks the primary server is
+// alive and copies its database.
+var StandbyInterval = 5 * time.Second
+
+// standbyMaxMessageSize is roughly the most database changes or snapshot bytes
+// that a standby server gets from the primary in one request.
+const standbyMaxMessageSize = 4 * 1024 * 1024
+
+// StandbyMaxFailures is how many times in a row a standby server must fail to
+// contact the primary server before it takes over.
+var StandbyMaxFailures = 3
+
+// StandbyConfig describes how a standby server should replicate its primary.
+type StandbyConfig struct {
+	// PrimaryAddr is the host:port of the primary server.
+	PrimaryAddr string
+
+	// Addr is the host:port that clients of the primary should connect to
+	// once we take over.
+	Addr string
+
+	// ReplicaFile is where we store our copy of the primary's database.
+	ReplicaFile string
+}
+
+// Standby runs a hot standby for the server at sc.PrimaryAddr. Every
+// StandbyInterval it tells the primary about us and applies the changes made to
+// its database since last time to our copy of it in sc.ReplicaFile (which must
+// use config.DBBackend). When we start, or if we fall too far behind, we first
+// download a snapshot of the whole database instead. If StandbyMaxFailures attempts to contact the
+// primary fail in a row, we assume it died and take over: the replica is used
+// as config.DBFile (unless that file is newer) and Serve() is called with the
+// given config, which should have the same ports as the primary.
+//
+// Since the primary might not really have died (eg. we were just cut off from
+// it), taking over increments the term stored in the database before we start
+// listening. The term is a fencing token: clients remember the highest term
+// they have seen, and a server stops as soon as a client (or we, retrying
+// every StandbyInterval) tells it about a higher term than its own.
+//
+// config.TokenFile must contain the primary's token, so that we can use it to
+// talk to the primary, and so that its clients can reconnect to us. If the
+// file is deleted, which happens when the primary is stopped deliberately, we
+// return an Error with ErrStandbyNoToken instead of taking over.
+//
+// Clients that have Reserve()d jobs learn about us when they Touch() them, and
+// will reconnect to us if the primary dies while running those jobs.
+//
+// Like Serve(), we stop with an ErrClosedInt or ErrClosedTerm Error on SIGINT
+// or SIGTERM while we are still in standby mode.
+func Standby(ctx context.Context, sc StandbyConfig, config ServerConfig) (*Server, string, []byte, error) {
+	defer internal.LogPanic(ctx, "jobqueue standby", true)
+
+	token, err := os.ReadFile(config.TokenFile)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("could not read the primary's token file: %w", err)
+	}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	ticker := time.NewTicker(StandbyInterval)
+	defer ticker.Stop()
+
+	replica := &dbReplica{path: sc.ReplicaFile, backend: config.DBBackend}
+	defer func() {
+		if errc := replica.close(); errc != nil {
+			clog.Warn(ctx, "failed to close replica database", "err", errc)
+		}
+	}()
+
+	var c *Client
+	failures := 0
+	for {
+		if c == nil {
+			c, err = Connect(sc.PrimaryAddr, config.CAFile, config.CertDomain, token, StandbyInterval)
+			if err != nil {
+				c = nil
+			}
+		}
+
+		if c != nil {
+			err = c.replicate(sc.Addr, replica)
+			if err != nil {
+				errd := c.Disconnect()
+				if errd != nil {
+					clog.Warn(ctx, "standby disconnection from primary failed", "err", errd)
+				}
+				c = nil
+			}
+		}
+
+		if jqerr, ok := err.(Error); ok && (jqerr.Err == ErrPermissionDenied || jqerr.Err == ErrNotAdmin) {
+			// the primary is alive, but won't let us replicate it
+			return nil, "", nil, err
+		}
+
+		if err == nil {
+			failures = 0
+		} else {
+			failures++
+			clog.Warn(ctx, "standby could not contact primary", "failures", failures, "err", err)
+			if failures >= StandbyMaxFailures {
+				break
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case sig := <-sigs:
+			reason := ErrClosedTerm
+			if sig == os.Interrupt {
+				reason = ErrClosedInt
+			}
+			return nil, "", nil, Error{"Standby", "", reason}
+		}
+	}
+
+	if _, err = os.Stat(config.TokenFile); err != nil {
+		return nil, "", nil, Error{"Standby", "", ErrStandbyNoToken}
+	}
+
+	clog.Warn(ctx, "primary appears to be dead; standby taking over", "primary", sc.PrimaryAddr)
+	signal.Stop(sigs)
+
+	if err = replica.close(); err != nil {
+		return nil, "", nil, err
+	}
+
+	if err = useReplica(sc.ReplicaFile, config.DBFile); err != nil {
+		return nil, "", nil, err
+	}
+
+	config.takingOver = true
+	s, msg, token, err := Serve(ctx, config)
+	if err == nil {
+		go s.fencePrimary(ctx, sc.PrimaryAddr, config)
+	}
+
+	return s, msg, token, err
+}
+
+// replicate tells the server that we are its standby at the given addr, and
+// brings the given replica of its database up to date.
+func (c *Client) replicate(addr string, replica *dbReplica) error {
+	for {
+		resp, err := c.request(&clientRequest{Method: "standby", Path: addr, DBVersion: replica.version})
+		if err != nil {
+			return err
+		}
+
+		if resp.DBSize > 0 {
+			if err = c.downloadSnapshot(replica, resp.DBVersion, resp.DBSize); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = replica.apply(resp.DBChanges, resp.DBVersion); err != nil || !resp.DBMore {
+			return err
+		}
+	}
+}
+
+// downloadSnapshot replaces the given replica's database with the server's
+// snapshot of its database with the given version and size.
+func (c *Client) downloadSnapshot(replica *dbReplica, version dbVersion, size int64) error {
+	if err := replica.close(); err != nil {
+		return err
+	}
+	replica.version = dbVersion{}
+
+	tmpPath := replica.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, dbFilePermission)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for offset < size && err == nil {
+		var resp *serverResponse
+		resp, err = c.request(&clientRequest{Method: "standbysnap", DBVersion: version, DBOffset: offset})
+		if err != nil {
+			break
+		}
+		if len(resp.DB) == 0 {
+			err = fmt.Errorf("database snapshot ended after %d of %d bytes", offset, size)
+			break
+		}
+
+		_, err = f.Write(resp.DB)
+		offset += int64(len(resp.DB))
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, replica.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err = replica.open(); err != nil {
+		return err
+	}
+	replica.version = version
+
+	return nil
+}
+
+// fencePrimary is called after we took over from the primary at the given
+// addr. Until we stop, every StandbyInterval we try to contact it, and if it
+// turns out to be alive, tell it our term so that it stops.
+func (s *Server) fencePrimary(ctx context.Context, addr string, config ServerConfig) {
+	s.ssmutex.RLock()
+	term := s.ServerInfo.Term
+	s.ssmutex.RUnlock()
+
+	ticker := time.NewTicker(StandbyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopClientHandling:
+			return
+		}
+
+		c, err := Connect(addr, config.CAFile, config.CertDomain, s.token, StandbyInterval)
+		if err != nil {
+			continue
+		}
+
+		if c.term < term {
+			clog.Warn(ctx, "the server we took over from is still alive; telling it to stop", "addr", addr)
+			c.fence(term)
+		}
+
+		if err = c.Disconnect(); err != nil {
+			clog.Warn(ctx, "disconnection from the server we took over from failed", "err", err)
+		}
+	}
+}
+
+// useReplica moves the replica database file to the given database file path,
+// unless the latter was modified more recently (eg. because the primary was
+// running on this host).
+func useReplica(replica, dbFile string) error {
+	ri, err := os.Stat(replica)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if di, errs := os.Stat(dbFile); errs == nil && di.ModTime().After(ri.ModTime()) {
+		return nil
+	}
+
+	return os.Rename(replica, dbFile)
+}
@@ -0,0 +1,88 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to the named users of a server,
+// who each have their own token and own the Jobs they add.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// userNameRegex is what the Name of a User must match.
+var userNameRegex = regexp.MustCompile(`^[\w.-]+$`)
+
+// User describes a named user of the server. Clients that connect using the
+// token of a User are identified as that User: Jobs they add are owned by
+// them, and unless the User is an Admin, they can only modify, kill, remove
+// and retry the Jobs they own.
+//
+// Clients that connect using the server's own token (as written to
+// ServerConfig.TokenFile) are identified as an Admin User named after the
+// person who started the server.
+type User struct {
+	// Name uniquely identifies the User, and can only contain letters,
+	// numbers, underscores, dots and dashes.
+	Name string
+
+	// Admin users can act on any Job, and can also drain, pause, resume and
+	// shutdown the server, get backups of its database and manage its Users.
+	Admin bool
+
+	// Created is when the server first stored this User.
+	Created time.Time
+
+	// Token is the User's authentication token. It is only set on the User
+	// returned by Client.AddUser(); the server only stores a hash of it.
+	Token []byte
+}
+
+// validate checks that our Name is valid.
+func (u *User) validate() error {
+	if !userNameRegex.MatchString(u.Name) {
+		return fmt.Errorf("user name '%s' is not valid (use letters, numbers, _, . and - only)", u.Name)
+	}
+	return nil
+}
+
+// owns tells you if this User is allowed to act on the given Job: Admins can
+// act on any Job, and other Users on the Jobs they added. A nil User owns
+// nothing.
+func (u *User) owns(job *Job) bool {
+	if u == nil {
+		return false
+	}
+	if u.Admin {
+		return true
+	}
+
+	job.RLock()
+	defer job.RUnlock()
+	return job.Owner == u.Name
+}
+
+// hashToken returns the hash of a token that we store instead of the token
+// itself.
+func hashToken(token []byte) []byte {
+	sum := sha256.Sum256(token)
+	return sum[:]
+}
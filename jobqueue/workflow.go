@@ -0,0 +1,475 @@
+// Copyright © 2026 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions related to workflows: a description of
+// steps that depend on each other, that is turned in to Jobs with generated
+// DepGroups and Dependencies.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// WorkflowRepGroupPrefix is the start of the RepGroup of every Job created from
+// a Workflow. The full RepGroup is this prefix, the workflow name, a dot, and
+// the name of the step the Job is for.
+const WorkflowRepGroupPrefix = "wf."
+
+var (
+	// workflowNameRegex matches valid Workflow names.
+	workflowNameRegex = regexp.MustCompile(`^[\w.-]+$`)
+
+	// workflowStepNameRegex matches valid WorkflowStep names, which can't
+	// contain dots so that the step can be found from a RepGroup.
+	workflowStepNameRegex = regexp.MustCompile(`^[\w-]+$`)
+)
+
+// WorkflowStep describes a step of a Workflow: a command that is run once, or
+// once for every element of its array (see ForEach), after the steps it comes
+// After are complete. All the properties of a JobViaJSON are supported, except
+// for rep_grp.
+type WorkflowStep struct {
+	JobViaJSON
+
+	// Name uniquely identifies the step within its workflow.
+	Name string `json:"name"`
+
+	// After are the names of the steps that must complete before this one
+	// starts. If this step and one of these steps are arrays with the same
+	// parameters, each element of this step only waits for the corresponding
+	// element of the other step; otherwise every Job of this step waits for
+	// every Job of the other step.
+	After []string `json:"after"`
+
+	// ForEach is an alternative to ArrayTable, giving the values of each
+	// parameter of the array. Every parameter must have the same number of
+	// values, and the nth element of the array gets the nth value of each.
+	ForEach map[string][]string `json:"for_each"`
+
+	array *JobArray
+}
+
+// Workflow describes a set of steps that depend on each other. Turn it in to
+// Jobs to Add() to the queue with Jobs().
+type Workflow struct {
+	// Name uniquely identifies the workflow, and is used in the RepGroup of
+	// its Jobs (see WorkflowRepGroupPrefix).
+	Name string
+
+	// Steps are the steps of the workflow, in the order they were described.
+	Steps []*WorkflowStep
+}
+
+// workflowFile is the structure of a file describing a Workflow.
+type workflowFile struct {
+	Name     string                       `json:"name"`
+	Defaults map[string]json.RawMessage   `json:"defaults"`
+	Steps    []map[string]json.RawMessage `json:"steps"`
+}
+
+// ParseWorkflow parses a YAML (or JSON) description of a Workflow, which has a
+// "name", a list of "steps" (with the properties of WorkflowStep, using the
+// keys of their json tags), and optionally a map of "defaults" that supply
+// properties for steps that don't specify them. Eg.
+//
+//	name: calling
+//	defaults:
+//	  memory: 2G
+//	  cwd: /data
+//	steps:
+//	  - name: align
+//	    cmd: align {sample}.fq > {sample}.bam
+//	    for_each:
+//	      sample: [a, b]
+//	  - name: call
+//	    cmd: call {sample}.bam > {sample}.vcf
+//	    for_each:
+//	      sample: [a, b]
+//	    after: [align]
+//	  - name: merge
+//	    cmd: merge a.vcf b.vcf > all.vcf
+//	    after: [call]
+//
+// Returns an error if the description is invalid, including if any steps have
+// a cyclic dependency.
+func ParseWorkflow(data []byte) (*Workflow, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("workflow is not valid YAML: %w", err)
+	}
+
+	wf := &workflowFile{}
+	if err = strictUnmarshal(jsonData, wf); err != nil {
+		return nil, fmt.Errorf("workflow is not valid: %w", err)
+	}
+
+	if !workflowNameRegex.MatchString(wf.Name) {
+		return nil, fmt.Errorf("workflow name '%s' is blank or has characters other than letters, numbers, _, . and -", wf.Name)
+	}
+
+	if len(wf.Steps) == 0 {
+		return nil, fmt.Errorf("workflow has no steps")
+	}
+
+	w := &Workflow{Name: wf.Name}
+
+	for i, props := range wf.Steps {
+		for key, val := range wf.Defaults {
+			if _, set := props[key]; !set {
+				props[key] = val
+			}
+		}
+
+		step, errs := parseWorkflowStep(props)
+		if errs != nil {
+			return nil, fmt.Errorf("workflow step %d is not valid: %w", i+1, errs)
+		}
+
+		w.Steps = append(w.Steps, step)
+	}
+
+	return w, w.validate()
+}
+
+// strictUnmarshal is like json.Unmarshal(), but returns an error if the data
+// has keys that don't correspond to fields of v.
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
+
+// parseWorkflowStep creates a WorkflowStep from its properties.
+func parseWorkflowStep(props map[string]json.RawMessage) (*WorkflowStep, error) {
+	data, err := json.Marshal(props)
+	if err != nil {
+		return nil, err
+	}
+
+	step := &WorkflowStep{}
+	if err = strictUnmarshal(data, step); err != nil {
+		return nil, err
+	}
+
+	if !workflowStepNameRegex.MatchString(step.Name) {
+		return nil, fmt.Errorf("name '%s' is blank or has characters other than letters, numbers, _ and -", step.Name)
+	}
+
+	if step.RepGrp != "" {
+		return nil, fmt.Errorf("step %s can't have a rep_grp", step.Name)
+	}
+
+	if len(step.ForEach) > 0 {
+		if len(step.ArrayTable) > 0 {
+			return nil, fmt.Errorf("step %s can't have both for_each and array_table", step.Name)
+		}
+
+		step.ArrayTable, err = forEachToTable(step.ForEach)
+		if err != nil {
+			return nil, fmt.Errorf("step %s %w", step.Name, err)
+		}
+	}
+
+	if len(step.ArrayTable) > 0 || len(step.ArrayRanges) > 0 {
+		step.array, err = step.jobArray()
+		if err != nil {
+			return nil, fmt.Errorf("step %s: %w", step.Name, err)
+		}
+
+		if step.array.expand(step.Cmd, 0) == step.Cmd {
+			return nil, fmt.Errorf("step %s is an array, but its cmd doesn't use any of the array's parameters", step.Name)
+		}
+	}
+
+	return step, nil
+}
+
+// forEachToTable converts a ForEach to the equivalent ArrayTable, with the
+// parameters in sorted order.
+func forEachToTable(forEach map[string][]string) ([][]string, error) {
+	names := make([]string, 0, len(forEach))
+	for name := range forEach {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := len(forEach[names[0]])
+	table := make([][]string, rows+1)
+	table[0] = names
+
+	for _, name := range names {
+		if len(forEach[name]) != rows {
+			return nil, fmt.Errorf("for_each parameters don't all have the same number of values")
+		}
+
+		for i, val := range forEach[name] {
+			table[i+1] = append(table[i+1], val)
+		}
+	}
+
+	return table, nil
+}
+
+// validate checks step names are unique, that steps only come after steps that
+// exist, and that there are no cycles.
+func (w *Workflow) validate() error {
+	steps := make(map[string]*WorkflowStep, len(w.Steps))
+	for _, step := range w.Steps {
+		if _, exists := steps[step.Name]; exists {
+			return fmt.Errorf("workflow has more than one step named %s", step.Name)
+		}
+		steps[step.Name] = step
+	}
+
+	waiting := make(map[string]int, len(w.Steps))
+	for _, step := range w.Steps {
+		for _, after := range step.After {
+			if _, exists := steps[after]; !exists {
+				return fmt.Errorf("workflow step %s comes after non-existent step %s", step.Name, after)
+			}
+		}
+		waiting[step.Name] = len(step.After)
+	}
+
+	done := 0
+	for progressed := true; progressed; {
+		progressed = false
+		for _, step := range w.Steps {
+			if waiting[step.Name] != 0 {
+				continue
+			}
+
+			waiting[step.Name] = -1
+			done++
+			progressed = true
+
+			for _, other := range w.Steps {
+				for _, after := range other.After {
+					if after == step.Name {
+						waiting[other.Name]--
+					}
+				}
+			}
+		}
+	}
+
+	if done != len(w.Steps) {
+		return fmt.Errorf("workflow steps have a cyclic dependency")
+	}
+
+	return nil
+}
+
+// RepGroup returns the RepGroup prefix shared by all the Jobs of this
+// Workflow.
+func (w *Workflow) RepGroup() string {
+	return WorkflowRepGroup(w.Name)
+}
+
+// WorkflowRepGroup returns the RepGroup prefix shared by all the Jobs of the
+// workflow with the given name.
+func WorkflowRepGroup(name string) string {
+	return WorkflowRepGroupPrefix + name + "."
+}
+
+// Jobs returns the Jobs that carry out the steps of this Workflow. Jobs for
+// steps with arrays are expanded in to one Job per element of the array.
+//
+// Each Job will have a RepGroup of w.RepGroup() followed by its step name, and
+// will be in a DepGroup of the same name. Jobs of arrays are additionally in a
+// DepGroup with the element index as a suffix, used so that elements of later
+// steps with the same array only depend on their corresponding element.
+//
+// The supplied JobDefaults are used as in JobViaJSON.Convert(), except that
+// any RepGrp and Array are ignored.
+//
+// The Jobs can be Add()ed again later (with ignoreComplete true) to resume a
+// workflow that was only partially completed.
+func (w *Workflow) Jobs(jd *JobDefaults) ([]*Job, error) {
+	defaults := *jd
+	defaults.RepGrp = ""
+	defaults.Array = nil
+
+	arrays := make(map[string]*JobArray, len(w.Steps))
+	for _, step := range w.Steps {
+		arrays[step.Name] = step.array
+	}
+
+	var jobs []*Job
+	for _, step := range w.Steps {
+		jvj := step.JobViaJSON
+		jvj.RepGrp = w.RepGroup() + step.Name
+		jvj.ArrayTable = nil
+		jvj.ArrayRanges = nil
+
+		template, err := jvj.Convert(&defaults)
+		if err != nil {
+			return nil, fmt.Errorf("workflow step %s is not valid: %w", step.Name, err)
+		}
+
+		size := 1
+		if step.array != nil {
+			template.Array = step.array
+			size = step.array.Size()
+		}
+
+		for i := 0; i < size; i++ {
+			job := template
+			if step.array != nil {
+				job = workflowElement(template, i)
+			}
+
+			w.setDependencies(job, step, arrays, i)
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs, nil
+}
+
+// workflowElement returns the element with the given index of the given
+// template's Array, as a normal Job rather than a member of a server-side job
+// array.
+func workflowElement(template *Job, index int) *Job {
+	element := template.arrayElement("", index)
+	element.ArrayIndex = 0
+	element.ArraySize = 0
+
+	return element
+}
+
+// setDependencies sets the DepGroups and Dependencies of the given Job, which
+// is the element with the given index of the given step (index is 0 for steps
+// that aren't arrays).
+func (w *Workflow) setDependencies(job *Job, step *WorkflowStep, arrays map[string]*JobArray, index int) {
+	stepGroup := w.RepGroup() + step.Name
+
+	depGroups := append([]string{}, job.DepGroups...)
+	depGroups = append(depGroups, stepGroup)
+	if step.array != nil {
+		depGroups = append(depGroups, stepGroup+"."+strconv.Itoa(index))
+	}
+	job.DepGroups = depGroups
+
+	deps := append(Dependencies{}, job.Dependencies...)
+	for _, after := range step.After {
+		group := w.RepGroup() + after
+		if step.array != nil && arrays[after] != nil && arrays[after].String() == step.array.String() {
+			group += "." + strconv.Itoa(index)
+		}
+		deps = append(deps, NewDepGroupDependency(group))
+	}
+	job.Dependencies = deps
+}
+
+// WorkflowStepStatus summarises the state of the Jobs of a WorkflowStep.
+type WorkflowStepStatus struct {
+	// Step is the name of the step.
+	Step string
+
+	// Expected is the number of Jobs the step should have, or 0 if not
+	// known.
+	Expected int
+
+	// Counts are the number of the step's Jobs in each JobState.
+	Counts map[JobState]int
+}
+
+// Total returns the number of the step's Jobs that were found.
+func (s *WorkflowStepStatus) Total() int {
+	total := 0
+	for _, count := range s.Counts {
+		total += count
+	}
+
+	return total
+}
+
+// Status summarises the states of the given Jobs (which should be those with
+// RepGroups starting with w.RepGroup()) by step, in the order of w.Steps.
+func (w *Workflow) Status(jobs []*Job) []*WorkflowStepStatus {
+	byStep := workflowStepStatuses(w.Name, jobs)
+
+	statuses := make([]*WorkflowStepStatus, 0, len(w.Steps))
+	for _, step := range w.Steps {
+		status, found := byStep[step.Name]
+		if !found {
+			status = &WorkflowStepStatus{Step: step.Name, Counts: make(map[JobState]int)}
+		}
+
+		status.Expected = 1
+		if step.array != nil {
+			status.Expected = step.array.Size()
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// WorkflowStatus is like Workflow.Status(), but for when you only know the
+// workflow's name. Steps are ordered by name, and their Expected is 0.
+func WorkflowStatus(name string, jobs []*Job) []*WorkflowStepStatus {
+	byStep := workflowStepStatuses(name, jobs)
+
+	statuses := make([]*WorkflowStepStatus, 0, len(byStep))
+	for _, status := range byStep {
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Step < statuses[j].Step
+	})
+
+	return statuses
+}
+
+// workflowStepStatuses counts the states of the given Jobs of the workflow
+// with the given name, by step. Jobs of other workflows are ignored.
+func workflowStepStatuses(name string, jobs []*Job) map[string]*WorkflowStepStatus {
+	prefix := WorkflowRepGroup(name)
+	byStep := make(map[string]*WorkflowStepStatus)
+
+	for _, job := range jobs {
+		step := strings.TrimPrefix(job.RepGroup, prefix)
+		if step == job.RepGroup || !workflowStepNameRegex.MatchString(step) {
+			continue
+		}
+
+		status, found := byStep[step]
+		if !found {
+			status = &WorkflowStepStatus{Step: step, Counts: make(map[JobState]int)}
+			byStep[step] = status
+		}
+
+		status.Counts[job.State]++
+	}
+
+	return byStep
+}
@@ -92,6 +92,22 @@ func (l *Limiter) GetLimits() map[string]int {
 	return limits
 }
 
+// GetUsage tells you the current count of all currently set count groups.
+func (l *Limiter) GetUsage() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := make(map[string]int, len(l.groups))
+
+	for name, group := range l.groups {
+		if group.IsCount() {
+			usage[name] = int(group.current)
+		}
+	}
+
+	return usage
+}
+
 // RemoveLimit removes the given group from memory. If your callback also begins
 // returning -1 for this group, the group effectively becomes unlimited.
 func (l *Limiter) RemoveLimit(name string) {
@@ -200,6 +200,9 @@ func TestLimiter(t *testing.T) {
 			l.SetLimit("l2", *NewCountGroupData(2))
 			lgs := l.GetLimits()
 			So(lgs, ShouldResemble, map[string]int{"l1": 1, "l2": 2})
+
+			So(l.Increment(ctx, []string{"l2"}), ShouldBeTrue)
+			So(l.GetUsage(), ShouldResemble, map[string]int{"l1": 0, "l2": 1})
 		})
 
 		Convey("You can have limits of 0 and also RemoveLimit()s", func() {
@@ -107,7 +107,7 @@ import (
 
 func main() {
 	// handle our executable being a symlink named bsub, in which case call
-	// `wr lsf bsub`; likewise for bjobs
+	// `wr lsf bsub`; likewise for bjobs, bkill and bwait
 	switch filepath.Base(os.Args[0]) {
 	case "bsub":
 		cmd.ExecuteLSF("bsub")
@@ -115,6 +115,8 @@ func main() {
 		cmd.ExecuteLSF("bjobs")
 	case "bkill":
 		cmd.ExecuteLSF("bkill")
+	case "bwait":
+		cmd.ExecuteLSF("bwait")
 	default:
 		// otherwise we call our root command, which handles everything else
 		cmd.Execute()
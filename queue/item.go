@@ -50,6 +50,7 @@ var iid uint64
 type Item struct {
 	Key           string
 	ReserveGroup  string
+	account       string
 	data          interface{}
 	state         ItemState
 	reserves      uint32
@@ -64,8 +65,8 @@ type Item struct {
 	readyAt       time.Time
 	releaseAt     time.Time
 	creation      time.Time
-	dependencies  []string
-	remainingDeps map[string]bool
+	dependencies  []Dependency
+	remainingDeps map[Dependency]bool
 	mutex         sync.RWMutex
 	queueIndexes  [5]int
 	iid           uint64
@@ -184,15 +185,32 @@ func (item *Item) ReadyAt() time.Time {
 // back dependencies that already got resolved, leaving you in a permanent
 // dependent state; use UnresolvedDependencies() for that purpose instead.
 func (item *Item) Dependencies() []string {
-	return item.dependencies
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return dependencyKeys(item.dependencies)
+}
+
+// ConditionalDependencies is like Dependencies(), but returns the full
+// Dependency of each, including its Condition.
+func (item *Item) ConditionalDependencies() []Dependency {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	deps := make([]Dependency, len(item.dependencies))
+	copy(deps, item.dependencies)
+	return deps
 }
 
 // UnresolvedDependencies returns the keys of the other items we are still
 // dependent upon.
 func (item *Item) UnresolvedDependencies() []string {
+	return dependencyKeys(item.unresolvedDependencies())
+}
+
+// unresolvedDependencies returns the Dependencies that are not yet resolved.
+func (item *Item) unresolvedDependencies() []Dependency {
 	item.mutex.RLock()
 	defer item.mutex.RUnlock()
-	deps := make([]string, len(item.remainingDeps))
+	deps := make([]Dependency, len(item.remainingDeps))
 	i := 0
 	for dep := range item.remainingDeps {
 		deps[i] = dep
@@ -213,43 +231,58 @@ func (item *Item) ChangedKey(old, new string) {
 	}
 
 	for i, dep := range item.dependencies {
-		if dep == old {
-			item.dependencies[i] = new
-			break
+		if dep.Key == old {
+			newDep := Dependency{Key: new, Condition: dep.Condition}
+			item.dependencies[i] = newDep
+
+			if item.remainingDeps[dep] {
+				delete(item.remainingDeps, dep)
+				item.remainingDeps[newDep] = true
+			}
 		}
 	}
-
-	if item.remainingDeps[old] {
-		delete(item.remainingDeps, old)
-		item.remainingDeps[new] = true
-	}
 }
 
-// setDependencies sets the keys of the other items we are dependent upon. This
-// only records the dependencies on the item; it does not trigger any dependency
+// setDependencies sets the other items we are dependent upon. This only
+// records the dependencies on the item; it does not trigger any dependency
 // related actions or updates.
-func (item *Item) setDependencies(deps []string) {
+func (item *Item) setDependencies(deps []Dependency) {
 	item.mutex.Lock()
 	defer item.mutex.Unlock()
 	item.dependencies = deps
-	item.remainingDeps = make(map[string]bool)
-	for _, key := range item.dependencies {
-		item.remainingDeps[key] = true
+	item.remainingDeps = make(map[Dependency]bool)
+	for _, dep := range item.dependencies {
+		item.remainingDeps[dep] = true
 	}
 }
 
-// resolveDependency takes the key of an item this item depends on, and marks
-// that as a resolved dependency. Returns false if this item is not currently in
-// the dependency sub queue. Otherwise, if all of this item's dependencies have
-// now been resolved in this way, returns true.
-func (item *Item) resolveDependency(key string) bool {
+// resolveDependenciesOn takes the key of an item this item depends on, and
+// marks as resolved our dependencies on it that are satisfied by it being
+// removed (or buried, if buried is true). The first return value is false if
+// this item is not currently in the dependency sub queue. Otherwise, if all of
+// this item's dependencies have now been resolved in this way, it is true. The
+// second return value tells you if we still have an unresolved dependency on
+// the given item.
+func (item *Item) resolveDependenciesOn(key string, buried bool) (bool, bool) {
 	item.mutex.Lock()
 	defer item.mutex.Unlock()
-	delete(item.remainingDeps, key)
+	waiting := false
+	for dep := range item.remainingDeps {
+		if dep.Key != key {
+			continue
+		}
+
+		if dep.Condition.resolvedBy(buried) {
+			delete(item.remainingDeps, dep)
+		} else {
+			waiting = true
+		}
+	}
+
 	if item.state == ItemStateDependent {
-		return len(item.remainingDeps) == 0
+		return len(item.remainingDeps) == 0, waiting
 	}
-	return false
+	return false, waiting
 }
 
 // restart is a thread-safe way to reset the readyAt time, for when the item
@@ -383,6 +416,15 @@ func (item *Item) switchRunDependent() {
 	item.state = ItemStateDependent
 }
 
+// update after we've switched from the dependent to the bury sub-queue
+func (item *Item) switchDependentBury() {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	item.queueIndexes[4] = -1
+	item.buries++
+	item.state = ItemStateBury
+}
+
 // update after we've switched from the bury to the ready sub-queue
 func (item *Item) switchBuryReady() {
 	item.mutex.Lock()
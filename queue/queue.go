@@ -34,8 +34,11 @@ priority (or for those with equal priority, the oldest - fifo) one which
 switches it from the ready queue to the run queue. Items can also have
 dependencies, in which case they start in the dependency queue and only move to
 the ready queue (bypassing the delay queue) once all its dependencies have been
-Remove()d from the queue. Items can also belong to a reservation group, in which
-case you can Reserve() an item in a desired group.
+Remove()d from the queue. Dependencies can also be given a DependencyCondition
+(see AddManyWithDependencies()), so that they are resolved when the item
+depended upon is buried instead of, or as well as, when it is Remove()d. Items
+can also belong to a reservation group, in which case you can Reserve() an item
+in a desired group.
 
 In the run queue the item starts a time-to-release (ttr) countdown; when that
 runs out the item is placed back on the ready queue. This is to handle a
@@ -109,6 +112,25 @@ const (
 	SubQueueRemoved   SubQueue = "removed"
 )
 
+// DependencyCondition describes what must happen to an item for a dependency
+// on it to be resolved.
+type DependencyCondition string
+
+// DependencyOn* constants represent the possible DependencyConditions. Plain
+// dependencies (the keys of the items depended upon) are DependencyOnRemoval.
+const (
+	DependencyOnRemoval       DependencyCondition = ""
+	DependencyOnBury          DependencyCondition = "bury"
+	DependencyOnRemovalOrBury DependencyCondition = "any"
+)
+
+// Dependency describes a dependency on the item with the given Key, which is
+// resolved when that item meets the Condition.
+type Dependency struct {
+	Key       string
+	Condition DependencyCondition
+}
+
 // recallBreak is how long we wait before recalling readyAdded.
 const recallBreak = 500 * time.Millisecond
 
@@ -121,6 +143,7 @@ var (
 	ErrNotReady      = errors.New("not ready")
 	ErrNotRunning    = errors.New("not running")
 	ErrNotBuried     = errors.New("not buried")
+	ErrNotDependent  = errors.New("not dependent")
 )
 
 // Error records an error and the operation, item and queue that caused it.
@@ -152,12 +175,53 @@ type ChangedCallback func(from, to SubQueue, data []interface{})
 // values will be treated as SubQueueReady).
 type TTRCallback func(data interface{}) SubQueue
 
+// AccountCallback is used as a callback to find out which fair-share account
+// (see SetFairShare()) an item belongs to, based on the data it is being added
+// with.
+type AccountCallback func(data interface{}) string
+
 // defaultTTRCallback is used if the the user never calls SetTTRCallback() and
 // always moves the items to the ready sub-queue.
 var defaultTTRCallback = func(data interface{}) SubQueue {
 	return SubQueueReady
 }
 
+// keyDependencies converts plain dependencies (the keys of the items depended
+// upon) to Dependencies that are resolved on removal.
+func keyDependencies(keys []string) []Dependency {
+	deps := make([]Dependency, len(keys))
+	for i, key := range keys {
+		deps[i] = Dependency{Key: key}
+	}
+	return deps
+}
+
+// dependencyKeys returns the unique keys of the items depended upon by the
+// given Dependencies, in order.
+func dependencyKeys(deps []Dependency) []string {
+	seen := make(map[string]bool, len(deps))
+	keys := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		if !seen[dep.Key] {
+			seen[dep.Key] = true
+			keys = append(keys, dep.Key)
+		}
+	}
+	return keys
+}
+
+// resolvedBy tells you if this condition is met by the item depended upon being
+// buried (or removed, if buried is false).
+func (c DependencyCondition) resolvedBy(buried bool) bool {
+	switch c {
+	case DependencyOnBury:
+		return buried
+	case DependencyOnRemovalOrBury:
+		return true
+	}
+	return !buried
+}
+
 // Queue is a synchronized map of items that can shift to different sub-queues,
 // automatically depending on their delay or ttr expiring, or manually by
 // calling certain methods.
@@ -181,6 +245,7 @@ type Queue struct {
 	readyAddedCb           ReadyAddedCallback
 	changedCb              ChangedCallback
 	ttrCb                  TTRCallback
+	accountCb              AccountCallback
 	mutex                  sync.RWMutex
 	readyAddedCbMutex      sync.Mutex
 	closed                 bool
@@ -251,6 +316,37 @@ func (queue *Queue) SetReadyAddedCallback(callback ReadyAddedCallback) {
 	queue.readyAddedCb = callback
 }
 
+// SetAccountCallback sets a callback that will be called when an item is
+// added, to find out which fair-share account it belongs to. If you don't set
+// this, all items belong to the same (blank) account. Like
+// SetReadyAddedCallback(), call this before adding any items.
+func (queue *Queue) SetAccountCallback(callback AccountCallback) {
+	queue.accountCb = callback
+}
+
+// account returns the fair-share account of an item with the given data,
+// according to our AccountCallback.
+func (queue *Queue) account(data interface{}) string {
+	if queue.accountCb == nil {
+		return ""
+	}
+	return queue.accountCb(data)
+}
+
+// SetFairShare changes the order in which ready items are Reserve()d. Items
+// with a higher priority are still reserved first, but amongst items of equal
+// priority, those belonging to the fair-share account (as returned by your
+// AccountCallback) with the highest factor are reserved first, before falling
+// back on size and age as normal. Accounts not in the given factors are
+// treated as having a factor of 1.
+//
+// You would call this periodically with factors based on how much of their
+// share of resources each account has recently used. Supplying nil factors
+// turns off fair-share ordering.
+func (queue *Queue) SetFairShare(factors map[string]float64) {
+	queue.readyQueue.setFairShare(factors)
+}
+
 // TriggerReadyAddedCallback allows you to manually trigger your
 // readyAddedCallback at times when no new items have been added to the ready
 // queue. It will receive the current set of ready item data.
@@ -408,8 +504,9 @@ func (queue *Queue) Stats() *Stats {
 // Add() returns an item, which may have already existed (in which case, nothing
 // was actually added or changed).
 func (queue *Queue) Add(ctx context.Context, key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration, startQueue SubQueue, deps ...[]string) (*Item, error) {
+	account := queue.account(data)
 	queue.mutex.Lock()
-	item, err := queue.newItemForAdd(key, reserveGroup, data, priority, 0, delay, ttr)
+	item, err := queue.newItemForAdd(key, reserveGroup, data, account, priority, 0, delay, ttr)
 	if err != nil {
 		queue.mutex.Unlock()
 		return item, err
@@ -420,7 +517,7 @@ func (queue *Queue) Add(ctx context.Context, key string, reserveGroup string, da
 
 // newItemForAdd prepares a new item for Add() and AddWithSize() methods. You
 // must hold the mutex lock before calling this.
-func (queue *Queue) newItemForAdd(key string, reserveGroup string, data interface{}, priority uint8, size uint8, delay time.Duration, ttr time.Duration) (*Item, error) {
+func (queue *Queue) newItemForAdd(key string, reserveGroup string, data interface{}, account string, priority uint8, size uint8, delay time.Duration, ttr time.Duration) (*Item, error) {
 	if queue.closed {
 		return nil, Error{queue.Name, "Add", key, ErrQueueClosed}
 	}
@@ -432,6 +529,7 @@ func (queue *Queue) newItemForAdd(key string, reserveGroup string, data interfac
 
 	item = newItem(key, reserveGroup, data, priority, delay, ttr)
 	item.size = size
+	item.account = account
 	queue.items[key] = item
 	return item, nil
 }
@@ -440,11 +538,22 @@ func (queue *Queue) newItemForAdd(key string, reserveGroup string, data interfac
 // subqueue. You must hold the mutex lock before calling this. It will unlock.
 func (queue *Queue) handleItemForAdd(ctx context.Context, item *Item, startQueue SubQueue, delay time.Duration, deps ...[]string) {
 	// check dependencies
-	if len(deps) == 1 && len(deps[0]) > 0 {
-		queue.setItemDependencies(item, deps[0])
-		queue.mutex.Unlock()
-		queue.changed(SubQueueNew, SubQueueDependent, []*Item{item})
-		return
+	var unresolved []Dependency
+	if len(deps) == 1 {
+		unresolved = queue.unresolvedDependencies(keyDependencies(deps[0]))
+	}
+	if len(unresolved) > 0 {
+		if startQueue != SubQueueBury {
+			queue.setItemDependencies(item, unresolved)
+			queue.mutex.Unlock()
+			queue.changed(SubQueueNew, SubQueueDependent, []*Item{item})
+			return
+		}
+
+		// buried items stay buried, but remember their dependencies for when
+		// they get kicked
+		item.setDependencies(unresolved)
+		queue.setQueueDeps(item)
 	}
 
 	switch startQueue {
@@ -460,8 +569,13 @@ func (queue *Queue) handleItemForAdd(ctx context.Context, item *Item, startQueue
 		item.switchDelayReady()
 		queue.buryQueue.push(item)
 		item.switchRunBury()
+		addedReadyItems := queue.resolveDependants(item.Key, true)
 		queue.mutex.Unlock()
 		queue.changed(SubQueueNew, SubQueueBury, []*Item{item})
+		if len(addedReadyItems) > 0 {
+			queue.changed(SubQueueDependent, SubQueueReady, addedReadyItems)
+			queue.readyAdded(ctx, "dependent")
+		}
 	default:
 		if delay.Nanoseconds() == 0 {
 			// put it directly on the ready queue
@@ -484,8 +598,9 @@ func (queue *Queue) handleItemForAdd(ctx context.Context, item *Item, startQueue
 // the next to be Reserve()d will be the item with the highest size. If they
 // also have the same size, then they will be Reserve()d in fifo order.
 func (queue *Queue) AddWithSize(ctx context.Context, key string, reserveGroup string, data interface{}, priority uint8, size uint8, delay time.Duration, ttr time.Duration, startQueue SubQueue, deps ...[]string) (*Item, error) {
+	account := queue.account(data)
 	queue.mutex.Lock()
-	item, err := queue.newItemForAdd(key, reserveGroup, data, priority, size, delay, ttr)
+	item, err := queue.newItemForAdd(key, reserveGroup, data, account, priority, size, delay, ttr)
 	if err != nil {
 		queue.mutex.Unlock()
 		return item, err
@@ -494,12 +609,12 @@ func (queue *Queue) AddWithSize(ctx context.Context, key string, reserveGroup st
 	return item, nil
 }
 
-// setItemDependencies sets the given item keys as the dependencies of the given
-// item, and places the item in the dependency queue. Note that you can be
+// setItemDependencies sets the given Dependencies as the dependencies of the
+// given item, and places the item in the dependency queue. Note that you can be
 // dependent on items that do not exist in the queue; the item will remain in
 // dependent queue until you add items with the given deps keys and then
-// Remove() them.
-func (queue *Queue) setItemDependencies(item *Item, deps []string) {
+// Remove() (or bury) them.
+func (queue *Queue) setItemDependencies(item *Item, deps []Dependency) {
 	item.setDependencies(deps)
 	queue.setQueueDeps(item)
 	item.switchDelayDependent()
@@ -510,19 +625,70 @@ func (queue *Queue) setItemDependencies(item *Item, deps []string) {
 // children when you give it a child item (that has had some dependencies set on
 // it).
 func (queue *Queue) setQueueDeps(item *Item) {
-	for _, dep := range item.Dependencies() {
-		if _, exists := queue.dependants[dep]; !exists {
-			queue.dependants[dep] = make(map[string]*Item)
+	for _, parent := range item.Dependencies() {
+		if _, exists := queue.dependants[parent]; !exists {
+			queue.dependants[parent] = make(map[string]*Item)
+		}
+		queue.dependants[parent][item.Key] = item
+	}
+}
+
+// unresolvedDependencies returns the given dependencies, minus those that are
+// already resolved because they are conditional on an item being buried, and
+// that item currently is. You must hold the mutex lock before calling this.
+func (queue *Queue) unresolvedDependencies(deps []Dependency) []Dependency {
+	unresolved := make([]Dependency, 0, len(deps))
+	for _, dep := range deps {
+		if dep.Condition.resolvedBy(true) {
+			if item, exists := queue.items[dep.Key]; exists && item.State() == ItemStateBury {
+				continue
+			}
+		}
+		unresolved = append(unresolved, dep)
+	}
+	return unresolved
+}
+
+// resolveDependants resolves the dependencies that other items have on the
+// item with the given key, now that it has been removed (or buried if buried is
+// true). Dependants that no longer have any unresolved dependencies are
+// switched to the ready sub-queue and returned. You must hold the mutex lock
+// before calling this.
+func (queue *Queue) resolveDependants(key string, buried bool) []*Item {
+	deps, exists := queue.dependants[key]
+	if !exists {
+		return nil
+	}
+
+	var addedReadyItems []*Item
+	for depKey, dep := range deps {
+		done, waiting := dep.resolveDependenciesOn(key, buried)
+		if done && dep.state == ItemStateDependent {
+			queue.depQueue.remove(dep)
+
+			// put it straight on the ready queue, regardless of delay value
+			dep.switchDependentReady()
+			queue.readyQueue.push(dep)
+			addedReadyItems = append(addedReadyItems, dep)
+		}
+
+		if !waiting {
+			delete(deps, depKey)
 		}
-		queue.dependants[dep][item.Key] = item
 	}
+
+	if len(deps) == 0 {
+		delete(queue.dependants, key)
+	}
+
+	return addedReadyItems
 }
 
 // itemHasDeps returns true if the item has unresolved dependencies according
 // to the queue's lookup of parent items to their dependent children.
 func (queue *Queue) itemHasDeps(item *Item) bool {
-	for _, dep := range item.Dependencies() {
-		if _, exists := queue.items[dep]; exists {
+	for _, dep := range queue.unresolvedDependencies(item.unresolvedDependencies()) {
+		if _, exists := queue.items[dep.Key]; exists {
 			return true
 		}
 	}
@@ -534,6 +700,23 @@ func (queue *Queue) itemHasDeps(item *Item) bool {
 // not added because they were duplicates of items already in the queue. If an
 // error occurs, nothing will have been added.
 func (queue *Queue) AddMany(ctx context.Context, items []*ItemDef) (added, dups int, err error) {
+	return queue.addMany(ctx, items, nil)
+}
+
+// AddManyWithDependencies is like AddMany(), but deps[i] are further
+// dependencies of items[i], which can have DependencyConditions.
+func (queue *Queue) AddManyWithDependencies(ctx context.Context, items []*ItemDef, deps [][]Dependency) (added, dups int, err error) {
+	return queue.addMany(ctx, items, deps)
+}
+
+// addMany implements AddMany() and AddManyWithDependencies(), with deps being
+// nil for the former.
+func (queue *Queue) addMany(ctx context.Context, items []*ItemDef, conditionalDeps [][]Dependency) (added, dups int, err error) {
+	accounts := make([]string, len(items))
+	for i, def := range items {
+		accounts[i] = queue.account(def.Data)
+	}
+
 	queue.mutex.Lock()
 
 	if queue.closed {
@@ -548,7 +731,7 @@ func (queue *Queue) AddMany(ctx context.Context, items []*ItemDef) (added, dups
 	var addedDepItems []*Item
 	var addedRunItems []*Item
 	var addedBuryItems []*Item
-	for _, def := range items {
+	for i, def := range items {
 		_, existed := queue.items[def.Key]
 		if existed {
 			dups++
@@ -556,12 +739,28 @@ func (queue *Queue) AddMany(ctx context.Context, items []*ItemDef) (added, dups
 		}
 
 		item := newItem(def.Key, def.ReserveGroup, def.Data, def.Priority, def.Delay, def.TTR)
+		item.account = accounts[i]
 		queue.items[def.Key] = item
 
-		if len(def.Dependencies) > 0 {
-			queue.setItemDependencies(item, def.Dependencies)
+		deps := keyDependencies(def.Dependencies)
+		if conditionalDeps != nil {
+			deps = append(deps, conditionalDeps[i]...)
+		}
+		if len(deps) > 0 {
+			deps = queue.unresolvedDependencies(deps)
+		}
+
+		if len(deps) > 0 && def.StartQueue != SubQueueBury {
+			queue.setItemDependencies(item, deps)
 			addedDepItems = append(addedDepItems, item)
 		} else {
+			if len(deps) > 0 {
+				// buried items stay buried, but remember their dependencies
+				// for when they get kicked
+				item.setDependencies(deps)
+				queue.setQueueDeps(item)
+			}
+
 			switch def.StartQueue {
 			case SubQueueRun:
 				item.switchDelayReady()
@@ -599,7 +798,20 @@ func (queue *Queue) AddMany(ctx context.Context, items []*ItemDef) (added, dups
 		added++
 	}
 
+	// items added as buried resolve the dependencies that other items (which
+	// may have been added before them) have on them being buried
+	var resolvedItems []*Item
+	for _, item := range addedBuryItems {
+		resolvedItems = append(resolvedItems, queue.resolveDependants(item.Key, true)...)
+	}
+
 	queue.mutex.Unlock()
+	if len(resolvedItems) > 0 {
+		queue.changed(SubQueueDependent, SubQueueReady, resolvedItems)
+		if len(addedReadyItems) == 0 {
+			queue.readyAdded(ctx, "dependent")
+		}
+	}
 	if len(addedReadyItems) > 0 {
 		queue.changed(SubQueueNew, SubQueueReady, addedReadyItems)
 		queue.readyAdded(ctx, "new")
@@ -668,6 +880,21 @@ func (queue *Queue) AllItems() []*Item {
 // item.UnresolvedDependencies()), and then calling item.Stats() to get
 // stats.Priority, stats.Delay and stats.TTR.
 func (queue *Queue) Update(ctx context.Context, key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration, deps ...[]string) error {
+	if len(deps) == 1 {
+		return queue.update(ctx, key, reserveGroup, data, priority, delay, ttr, true, keyDependencies(deps[0]))
+	}
+	return queue.update(ctx, key, reserveGroup, data, priority, delay, ttr, false, nil)
+}
+
+// UpdateWithDependencies is like Update(), but always sets the item's
+// dependencies to the given ones, which can have DependencyConditions.
+func (queue *Queue) UpdateWithDependencies(ctx context.Context, key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration, deps []Dependency) error {
+	return queue.update(ctx, key, reserveGroup, data, priority, delay, ttr, true, deps)
+}
+
+// update implements Update() and UpdateWithDependencies(), only changing
+// dependencies if setDeps is true.
+func (queue *Queue) update(ctx context.Context, key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration, setDeps bool, deps []Dependency) error {
 	queue.mutex.Lock()
 
 	if queue.closed {
@@ -684,20 +911,22 @@ func (queue *Queue) Update(ctx context.Context, key string, reserveGroup string,
 	var changedFrom SubQueue
 	var addedReady bool
 	item.SetData(data)
-	if len(deps) == 1 {
+	if setDeps {
+		deps = queue.unresolvedDependencies(deps)
+
 		// check if dependencies actually changed
-		oldDeps := make(map[string]bool)
-		for _, dep := range item.UnresolvedDependencies() {
+		oldDeps := make(map[Dependency]bool)
+		for _, dep := range item.unresolvedDependencies() {
 			oldDeps[dep] = true
 		}
 		newDeps := 0
-		for _, dep := range deps[0] {
+		for _, dep := range deps {
 			if !oldDeps[dep] {
 				newDeps++
 			}
 			delete(oldDeps, dep)
 		}
-		var toRemove []string
+		var toRemove []Dependency
 		for dep := range oldDeps {
 			toRemove = append(toRemove, dep)
 		}
@@ -705,16 +934,16 @@ func (queue *Queue) Update(ctx context.Context, key string, reserveGroup string,
 		if len(toRemove) > 0 || newDeps > 0 {
 			// remove any invalid dependencies from our lookup
 			for _, dep := range toRemove {
-				if _, exists := queue.items[dep]; exists {
-					delete(queue.dependants[dep], key)
-					if len(queue.dependants[dep]) == 0 {
-						delete(queue.dependants, dep)
+				if _, exists := queue.items[dep.Key]; exists {
+					delete(queue.dependants[dep.Key], key)
+					if len(queue.dependants[dep.Key]) == 0 {
+						delete(queue.dependants, dep.Key)
 					}
 				}
 			}
 
 			// set the new dependencies and update our lookup
-			item.setDependencies(deps[0])
+			item.setDependencies(deps)
 			queue.setQueueDeps(item)
 
 			// if we now have unresolved dependencies and we're not in dependent
@@ -722,7 +951,7 @@ func (queue *Queue) Update(ctx context.Context, key string, reserveGroup string,
 			item.mutex.RLock()
 			iState := item.state
 			item.mutex.RUnlock()
-			if len(deps[0]) > 0 && iState != ItemStateDependent {
+			if len(deps) > 0 && iState != ItemStateDependent {
 				pushToDep := true
 				switch iState {
 				case ItemStateDelay:
@@ -745,7 +974,7 @@ func (queue *Queue) Update(ctx context.Context, key string, reserveGroup string,
 				if pushToDep {
 					queue.depQueue.push(item)
 				}
-			} else if len(deps[0]) == 0 {
+			} else if len(deps) == 0 {
 				// switch to ready queue
 				queue.depQueue.remove(item)
 				item.switchDependentReady()
@@ -1055,35 +1284,95 @@ func (queue *Queue) Release(ctx context.Context, key string) error {
 
 // Bury is a thread-safe way to switch an item in the run sub-queue to the
 // bury sub-queue, for when the item can't be dealt with ever, at least until
-// the user takes some action and changes something.
+// the user takes some action and changes something. It is BuryRunning() with a
+// background context.
 func (queue *Queue) Bury(key string) error {
+	return queue.buryRunning(context.Background(), "Bury", key)
+}
+
+// BuryRunning is like Bury(), taking a context for the ready added callback,
+// which is called if any items with a dependency on this item that is
+// conditional on it being buried have all their dependencies resolved.
+func (queue *Queue) BuryRunning(ctx context.Context, key string) error {
+	return queue.buryRunning(ctx, "BuryRunning", key)
+}
+
+// buryRunning implements Bury() and BuryRunning(), using op in any Error.
+func (queue *Queue) buryRunning(ctx context.Context, op, key string) error {
 	queue.mutex.Lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
-		return Error{queue.Name, "Bury", key, ErrQueueClosed}
+		return Error{queue.Name, op, key, ErrQueueClosed}
 	}
 
 	// check it's actually still in the queue first
 	item, ok := queue.items[key]
 	if !ok {
 		queue.mutex.Unlock()
-		return Error{queue.Name, "Bury", key, ErrNotFound}
+		return Error{queue.Name, op, key, ErrNotFound}
 	}
 
 	// and it must be in the run queue
 	if ok = item.state == ItemStateRun; !ok {
 		queue.mutex.Unlock()
-		return Error{queue.Name, "Bury", key, ErrNotRunning}
+		return Error{queue.Name, op, key, ErrNotRunning}
 	}
 
 	// switch from run to bury queue
 	queue.runQueue.remove(item)
 	queue.buryQueue.push(item)
 	item.switchRunBury()
+	addedReadyItems := queue.resolveDependants(key, true)
 	queue.mutex.Unlock()
 	queue.changed(SubQueueRun, SubQueueBury, []*Item{item})
 
+	if len(addedReadyItems) > 0 {
+		queue.changed(SubQueueDependent, SubQueueReady, addedReadyItems)
+		queue.readyAdded(ctx, "dependent")
+	}
+
+	return nil
+}
+
+// BuryDependent is a thread-safe way to switch an item in the dependent sub-
+// queue to the bury sub-queue, for when the item's dependencies can never be
+// resolved. Dependencies of other items on this item are treated as per
+// BuryRunning().
+func (queue *Queue) BuryDependent(ctx context.Context, key string) error {
+	queue.mutex.Lock()
+
+	if queue.closed {
+		queue.mutex.Unlock()
+		return Error{queue.Name, "BuryDependent", key, ErrQueueClosed}
+	}
+
+	// check it's actually still in the queue first
+	item, ok := queue.items[key]
+	if !ok {
+		queue.mutex.Unlock()
+		return Error{queue.Name, "BuryDependent", key, ErrNotFound}
+	}
+
+	// and it must be in the dependent queue
+	if ok = item.state == ItemStateDependent; !ok {
+		queue.mutex.Unlock()
+		return Error{queue.Name, "BuryDependent", key, ErrNotDependent}
+	}
+
+	// switch from dependent to bury queue
+	queue.depQueue.remove(item)
+	queue.buryQueue.push(item)
+	item.switchDependentBury()
+	addedReadyItems := queue.resolveDependants(key, true)
+	queue.mutex.Unlock()
+	queue.changed(SubQueueDependent, SubQueueBury, []*Item{item})
+
+	if len(addedReadyItems) > 0 {
+		queue.changed(SubQueueDependent, SubQueueReady, addedReadyItems)
+		queue.readyAdded(ctx, "dependent")
+	}
+
 	return nil
 }
 
@@ -1144,27 +1433,12 @@ func (queue *Queue) Remove(ctx context.Context, key string) error {
 	}
 
 	// transfer any dependants to the ready queue
-	addedReady := false
-	var addedReadyItems []*Item
-	if deps, exists := queue.dependants[key]; exists {
-		for _, dep := range deps {
-			done := dep.resolveDependency(key)
-			if done && dep.state == ItemStateDependent {
-				queue.depQueue.remove(dep)
-
-				// put it straight on the ready queue, regardless of delay value
-				dep.switchDependentReady()
-				queue.readyQueue.push(dep)
-				addedReadyItems = append(addedReadyItems, dep)
-				addedReady = true
-			}
-		}
-		delete(queue.dependants, key)
-	}
+	addedReadyItems := queue.resolveDependants(key, false)
+	addedReady := len(addedReadyItems) > 0
 
 	// if this item is dependent on other items, update those items that this is
 	// no longer dependent upon them
-	for _, parent := range item.dependencies {
+	for _, parent := range dependencyKeys(item.dependencies) {
 		if deps, exists := queue.dependants[parent]; exists {
 			delete(deps, key)
 			if len(deps) == 0 {
@@ -1221,6 +1495,27 @@ func (queue *Queue) HasDependents(key string) (bool, error) {
 	return has, nil
 }
 
+// Dependents returns the items that have an unresolved dependency on the item
+// with the given key (which need not be in the queue). For example, after
+// Remove()ing an item, this gives you the items with dependencies on it that
+// were conditional on it being buried, which will now never be resolved unless
+// you add and bury an item with the same key.
+func (queue *Queue) Dependents(key string) ([]*Item, error) {
+	queue.mutex.RLock()
+	defer queue.mutex.RUnlock()
+
+	if queue.closed {
+		return nil, Error{queue.Name, "Dependents", key, ErrQueueClosed}
+	}
+
+	deps := queue.dependants[key]
+	items := make([]*Item, 0, len(deps))
+	for _, item := range deps {
+		items = append(items, item)
+	}
+	return items, nil
+}
+
 func (queue *Queue) startDelayProcessing(ctx context.Context) {
 	sendStarted := true
 	for {
@@ -959,6 +959,51 @@ func TestQueue(t *testing.T) {
 		So(item.Key, ShouldEqual, "key_large")
 	})
 
+	Convey("You can order items of equal priority by fair-share", t, func() {
+		queue := New(ctx, "fairshare queue")
+		defer func() {
+			errd := queue.Destroy()
+			So(errd, ShouldBeNil)
+		}()
+
+		queue.SetAccountCallback(func(data interface{}) string {
+			return data.(string)
+		})
+
+		var itemdefs []*ItemDef
+		for i := 0; i < 3; i++ {
+			itemdefs = append(itemdefs, &ItemDef{Key: fmt.Sprintf("a%d", i), Data: "a", TTR: 30 * time.Second})
+		}
+		for i := 0; i < 3; i++ {
+			itemdefs = append(itemdefs, &ItemDef{Key: fmt.Sprintf("b%d", i), Data: "b", TTR: 30 * time.Second})
+		}
+		itemdefs = append(itemdefs, &ItemDef{Key: "high", Data: "a", Priority: 1, TTR: 30 * time.Second})
+		added, _, err := queue.AddMany(ctx, itemdefs)
+		So(err, ShouldBeNil)
+		So(added, ShouldEqual, 7)
+
+		reserve := func() string {
+			item, errr := queue.Reserve("", 0)
+			So(errr, ShouldBeNil)
+			So(item, ShouldNotBeNil)
+			return item.Key
+		}
+
+		So(reserve(), ShouldEqual, "high")
+		So(reserve(), ShouldEqual, "a0")
+
+		queue.SetFairShare(map[string]float64{"a": 0.25, "b": 0.5})
+		So(reserve(), ShouldEqual, "b0")
+		So(reserve(), ShouldEqual, "b1")
+
+		queue.SetFairShare(map[string]float64{"a": 0.75})
+		So(reserve(), ShouldEqual, "b2")
+		So(reserve(), ShouldEqual, "a1")
+
+		queue.SetFairShare(nil)
+		So(reserve(), ShouldEqual, "a2")
+	})
+
 	Convey("Once a thousand items with no delay have been added to the queue", t, func() {
 		queue := New(ctx, "1000 queue")
 		defer qdestroy(queue)
@@ -1475,6 +1520,85 @@ func TestQueue(t *testing.T) {
 
 			So(ten.Stats().State, ShouldEqual, ItemStateReady)
 		})
+
+		Convey("You can add dependencies conditional on items being buried", func() {
+			addConditional := func(key string, dep Dependency) *Item {
+				added, _, erra := queue.AddManyWithDependencies(ctx, []*ItemDef{{Key: key, Data: key, TTR: 30 * time.Second}}, [][]Dependency{{dep}})
+				So(erra, ShouldBeNil)
+				So(added, ShouldEqual, 1)
+				item, errg := queue.Get(key)
+				So(errg, ShouldBeNil)
+				return item
+			}
+
+			onBury := addConditional("key_9", Dependency{Key: "key_1", Condition: DependencyOnBury})
+			So(onBury.Stats().State, ShouldEqual, ItemStateDependent)
+			So(onBury.Dependencies(), ShouldResemble, []string{"key_1"})
+			So(onBury.ConditionalDependencies(), ShouldResemble, []Dependency{{Key: "key_1", Condition: DependencyOnBury}})
+
+			onAny := addConditional("key_10", Dependency{Key: "key_2", Condition: DependencyOnRemovalOrBury})
+			So(onAny.Stats().State, ShouldEqual, ItemStateDependent)
+
+			hasDeps, err := queue.HasDependents("key_1")
+			So(err, ShouldBeNil)
+			So(hasDeps, ShouldBeTrue)
+
+			Convey("Which are resolved when they are buried", func() {
+				one, err := queue.Reserve("", 0)
+				So(err, ShouldBeNil)
+				So(one.Key, ShouldEqual, "key_1")
+				err = queue.BuryRunning(ctx, "key_1")
+				So(err, ShouldBeNil)
+				So(onBury.Stats().State, ShouldEqual, ItemStateReady)
+
+				dependents, err := queue.Dependents("key_1")
+				So(err, ShouldBeNil)
+				So(len(dependents), ShouldEqual, 2)
+
+				eleven := addConditional("key_11", Dependency{Key: "key_1", Condition: DependencyOnRemovalOrBury})
+				So(eleven.Stats().State, ShouldEqual, ItemStateReady)
+
+				err = queue.UpdateWithDependencies(ctx, "key_10", "", "10", 0, 0*time.Second, 30*time.Second, []Dependency{{Key: "key_1", Condition: DependencyOnBury}})
+				So(err, ShouldBeNil)
+				So(onAny.Stats().State, ShouldEqual, ItemStateReady)
+				So(onAny.Dependencies(), ShouldBeEmpty)
+
+				err = queue.BuryDependent(ctx, "key_4")
+				So(err, ShouldBeNil)
+				four, err := queue.Get("key_4")
+				So(err, ShouldBeNil)
+				So(four.Stats().State, ShouldEqual, ItemStateBury)
+
+				err = queue.BuryDependent(ctx, "key_4")
+				So(err, ShouldNotBeNil)
+				qerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(qerr.Err, ShouldEqual, ErrNotDependent)
+			})
+
+			Convey("But not when they are removed, unless conditional on either", func() {
+				err = queue.Remove(ctx, "key_1")
+				So(err, ShouldBeNil)
+				So(onBury.Stats().State, ShouldEqual, ItemStateDependent)
+
+				dependents, err := queue.Dependents("key_1")
+				So(err, ShouldBeNil)
+				So(len(dependents), ShouldEqual, 1)
+				So(dependents[0].Key, ShouldEqual, "key_9")
+
+				err = queue.Remove(ctx, "key_2")
+				So(err, ShouldBeNil)
+				So(onAny.Stats().State, ShouldEqual, ItemStateReady)
+			})
+
+			Convey("And you can change keys without breaking them", func() {
+				err := queue.ChangeKey("key_1", "changed_1")
+				So(err, ShouldBeNil)
+				So(onBury.Dependencies(), ShouldResemble, []string{"changed_1"})
+				So(onBury.UnresolvedDependencies(), ShouldResemble, []string{"changed_1"})
+				So(onBury.ConditionalDependencies(), ShouldResemble, []Dependency{{Key: "changed_1", Condition: DependencyOnBury}})
+			})
+		})
 	})
 
 	Convey("Once some items with dependencies have been added to the queue en-masse", t, func() {
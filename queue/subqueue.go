@@ -36,6 +36,7 @@ type subQueue struct {
 	sqIndex                  int
 	reserveGroup             string
 	pushNotificationChannels map[string]map[string]chan bool
+	factors                  map[string]float64
 }
 
 // create a new subQueue that can hold *Items in "priority" order. sqIndex is
@@ -208,6 +209,37 @@ func (q *subQueue) update(item *Item, oldGroup ...string) {
 	heap.Fix(q, item.queueIndexes[q.sqIndex])
 }
 
+// setFairShare sets the fair-share factors of item accounts, which are used to
+// order items of equal priority, and reorders the queue accordingly. nil
+// factors turns off fair-share ordering. Only for use on the ready subQueue.
+func (q *subQueue) setFairShare(factors map[string]float64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var copied map[string]float64
+	if factors != nil {
+		copied = make(map[string]float64, len(factors))
+		for account, factor := range factors {
+			copied[account] = factor
+		}
+	}
+	q.factors = copied
+
+	for group := range q.groupedItems {
+		q.reserveGroup = group
+		heap.Init(q)
+	}
+}
+
+// factor returns the fair-share factor of the given item's account, defaulting
+// to 1. You must hold the mutex lock before calling this.
+func (q *subQueue) factor(item *Item) float64 {
+	if factor, exists := q.factors[item.account]; exists {
+		return factor
+	}
+	return 1
+}
+
 // empty clears out a queue, setting it back to its new state
 func (q *subQueue) empty() {
 	q.mutex.Lock()
@@ -243,6 +275,12 @@ func (q *subQueue) Less(i, j int) bool {
 	case 1:
 		if itemList, existed := q.groupedItems[q.reserveGroup]; existed {
 			if itemList[i].priority == itemList[j].priority {
+				if q.factors != nil && itemList[i].account != itemList[j].account {
+					fi, fj := q.factor(itemList[i]), q.factor(itemList[j])
+					if fi != fj {
+						return fi > fj
+					}
+				}
 				if itemList[i].size == itemList[j].size {
 					return itemList[i].creation.Before(itemList[j].creation)
 				}